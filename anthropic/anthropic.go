@@ -0,0 +1,580 @@
+// anthropic package provides middleware for partial compatibility with the Anthropic Messages API
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+// Content is the content of a message or system prompt, which is sent either
+// as a string or as a list of content blocks
+type Content []ContentBlock
+
+func (c *Content) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*c = Content{{Type: "text", Text: s}}
+		return nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return errors.New("content must be a string or a list of content blocks")
+	}
+
+	*c = blocks
+	return nil
+}
+
+// ContentBlock is a block of request content. Which fields are set depends on
+// the block's type: text, image, tool_use or tool_result.
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	Text string `json:"text,omitempty"`
+
+	Source *ImageSource `json:"source,omitempty"`
+
+	ID    string         `json:"id,omitempty"`
+	Name  string         `json:"name,omitempty"`
+	Input map[string]any `json:"input,omitempty"`
+
+	ToolUseID string  `json:"tool_use_id,omitempty"`
+	Content   Content `json:"content,omitempty"`
+	IsError   bool    `json:"is_error,omitempty"`
+}
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type Message struct {
+	Role    string  `json:"role"`
+	Content Content `json:"content"`
+}
+
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type MessagesRequest struct {
+	Model         string         `json:"model"`
+	MaxTokens     *int           `json:"max_tokens"`
+	System        Content        `json:"system"`
+	Messages      []Message      `json:"messages"`
+	StopSequences []string       `json:"stop_sequences"`
+	Stream        bool           `json:"stream"`
+	Temperature   *float64       `json:"temperature"`
+	TopP          *float64       `json:"top_p"`
+	TopK          *int           `json:"top_k"`
+	Tools         []Tool         `json:"tools"`
+	Metadata      map[string]any `json:"metadata"`
+}
+
+type TextBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type ToolUseBlock struct {
+	Type  string         `json:"type"`
+	ID    string         `json:"id"`
+	Name  string         `json:"name"`
+	Input map[string]any `json:"input"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type MessageResponse struct {
+	ID           string  `json:"id"`
+	Type         string  `json:"type"`
+	Role         string  `json:"role"`
+	Model        string  `json:"model"`
+	Content      []any   `json:"content"`
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+	Usage        Usage   `json:"usage"`
+}
+
+// Delta is an incremental update to a content block while streaming
+type Delta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+}
+
+// MessageDelta carries the fields of the message that are only known once
+// generation stops
+type MessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+// Event is a server-sent event in a streamed response. Which fields are set
+// depends on the event type.
+type Event struct {
+	Type         string           `json:"type"`
+	Message      *MessageResponse `json:"message,omitempty"`
+	Index        *int             `json:"index,omitempty"`
+	ContentBlock any              `json:"content_block,omitempty"`
+	Delta        any              `json:"delta,omitempty"`
+	Usage        *Usage           `json:"usage,omitempty"`
+	Error        *Error           `json:"error,omitempty"`
+}
+
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		etype = "request_too_large"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		etype = "overloaded_error"
+	default:
+		if code >= http.StatusInternalServerError {
+			etype = "api_error"
+		} else {
+			etype = "invalid_request_error"
+		}
+	}
+
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+func randomID(prefix string) string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return prefix + string(b)
+}
+
+// stopReason maps the native done reason to the Anthropic stop reason, and
+// returns the stop sequence that ended the response if it was one
+func stopReason(r api.ChatResponse) (reason, sequence *string) {
+	var s string
+	switch {
+	case len(r.Message.ToolCalls) > 0:
+		s = "tool_use"
+	case r.DoneReason == api.DoneReasonLength, r.DoneReason == api.DoneReasonTimeLimit:
+		s = "max_tokens"
+	case r.DoneReason == api.DoneReasonStopString:
+		s = "stop_sequence"
+		if r.StopString != "" {
+			sequence = &r.StopString
+		}
+	case r.Done:
+		s = "end_turn"
+	default:
+		return nil, nil
+	}
+	return &s, sequence
+}
+
+func toToolUseBlock(tc api.ToolCall) ToolUseBlock {
+	input := map[string]any(tc.Function.Arguments)
+	if input == nil {
+		input = map[string]any{}
+	}
+
+	return ToolUseBlock{Type: "tool_use", ID: randomID("toolu_"), Name: tc.Function.Name, Input: input}
+}
+
+func toMessage(id string, r api.ChatResponse) MessageResponse {
+	content := []any{}
+	if r.Message.Content != "" {
+		content = append(content, TextBlock{Type: "text", Text: r.Message.Content})
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		content = append(content, toToolUseBlock(tc))
+	}
+
+	reason, sequence := stopReason(r)
+	return MessageResponse{
+		ID:           id,
+		Type:         "message",
+		Role:         "assistant",
+		Model:        r.Model,
+		Content:      content,
+		StopReason:   reason,
+		StopSequence: sequence,
+		Usage: Usage{
+			InputTokens:  r.PromptEvalCount,
+			OutputTokens: r.EvalCount,
+		},
+	}
+}
+
+func fromContent(role string, content Content) ([]api.Message, error) {
+	var messages []api.Message
+	var texts []string
+	var images []api.ImageData
+	var toolCalls []api.ToolCall
+	for _, block := range content {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+		case "image":
+			if block.Source == nil || block.Source.Type != "base64" {
+				return nil, errors.New("image source must be base64")
+			}
+
+			if !slices.Contains([]string{"image/jpeg", "image/png", "image/webp"}, block.Source.MediaType) {
+				return nil, fmt.Errorf("unsupported image media type %q", block.Source.MediaType)
+			}
+
+			img, err := base64.StdEncoding.DecodeString(block.Source.Data)
+			if err != nil {
+				return nil, errors.New("invalid image data")
+			}
+			images = append(images, img)
+		case "tool_use":
+			toolCalls = append(toolCalls, api.ToolCall{Function: api.ToolCallFunction{Name: block.Name, Arguments: block.Input}})
+		case "tool_result":
+			var result []string
+			for _, c := range block.Content {
+				if c.Type != "text" {
+					return nil, fmt.Errorf("unsupported tool_result content block type %q", c.Type)
+				}
+				result = append(result, c.Text)
+			}
+			messages = append(messages, api.Message{Role: "tool", Content: strings.Join(result, "\n")})
+		default:
+			return nil, fmt.Errorf("unsupported content block type %q", block.Type)
+		}
+	}
+
+	if len(texts) > 0 || len(images) > 0 || len(toolCalls) > 0 {
+		messages = append(messages, api.Message{Role: role, Content: strings.Join(texts, "\n"), Images: images, ToolCalls: toolCalls})
+	}
+
+	return messages, nil
+}
+
+func fromMessagesRequest(r MessagesRequest) (*api.ChatRequest, error) {
+	if r.MaxTokens == nil {
+		return nil, errors.New("max_tokens: field required")
+	}
+
+	if len(r.Messages) == 0 {
+		return nil, errors.New("messages: at least one message is required")
+	}
+
+	var messages []api.Message
+	if len(r.System) > 0 {
+		var system []string
+		for _, block := range r.System {
+			if block.Type != "text" {
+				return nil, fmt.Errorf("unsupported system content block type %q", block.Type)
+			}
+			system = append(system, block.Text)
+		}
+		messages = append(messages, api.Message{Role: "system", Content: strings.Join(system, "\n")})
+	}
+
+	for _, msg := range r.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("invalid message role %q, expected user or assistant", msg.Role)
+		}
+
+		m, err := fromContent(msg.Role, msg.Content)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m...)
+	}
+
+	options := map[string]any{
+		"num_predict": *r.MaxTokens,
+	}
+
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		tool := api.Tool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		if len(t.InputSchema) > 0 {
+			if err := json.Unmarshal(t.InputSchema, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("invalid input_schema for tool %q", t.Name)
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	// tool calls are only parsed from complete responses, so requests with
+	// tools are made without streaming and the events are written at once
+	stream := r.Stream && len(tools) == 0
+
+	return &api.ChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Options:  options,
+		Stream:   &stream,
+		Tools:    tools,
+	}, nil
+}
+
+type BaseWriter struct {
+	gin.ResponseWriter
+}
+
+type MessagesWriter struct {
+	stream bool
+	id     string
+	BaseWriter
+
+	// started is set once message_start has been written; index is the
+	// index of the next content block and text whether a text block is open
+	started bool
+	index   int
+	text    bool
+}
+
+func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
+	var serr api.StatusError
+	err := json.Unmarshal(data, &serr)
+	if err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(code, serr.Error()))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) writeEvent(e Event) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, d)))
+	return err
+}
+
+func (w *MessagesWriter) startBlock(block any) error {
+	return w.writeEvent(Event{Type: "content_block_start", Index: &w.index, ContentBlock: block})
+}
+
+func (w *MessagesWriter) stopBlock() error {
+	err := w.writeEvent(Event{Type: "content_block_stop", Index: &w.index})
+	w.index++
+	w.text = false
+	return err
+}
+
+// writeEvents writes the events for a native response, which is either a
+// streamed chunk or a complete response when streaming with tools
+func (w *MessagesWriter) writeEvents(r api.ChatResponse) error {
+	if !w.started {
+		w.started = true
+		if err := w.writeEvent(Event{Type: "message_start", Message: &MessageResponse{
+			ID:      w.id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   r.Model,
+			Content: []any{},
+		}}); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Content != "" {
+		if !w.text {
+			if err := w.startBlock(TextBlock{Type: "text"}); err != nil {
+				return err
+			}
+			w.text = true
+		}
+
+		if err := w.writeEvent(Event{Type: "content_block_delta", Index: &w.index, Delta: Delta{Type: "text_delta", Text: r.Message.Content}}); err != nil {
+			return err
+		}
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		if w.text {
+			if err := w.stopBlock(); err != nil {
+				return err
+			}
+		}
+
+		block := toToolUseBlock(tc)
+		input, err := json.Marshal(block.Input)
+		if err != nil {
+			return err
+		}
+
+		block.Input = map[string]any{}
+		if err := w.startBlock(block); err != nil {
+			return err
+		}
+
+		if err := w.writeEvent(Event{Type: "content_block_delta", Index: &w.index, Delta: Delta{Type: "input_json_delta", PartialJSON: string(input)}}); err != nil {
+			return err
+		}
+
+		if err := w.stopBlock(); err != nil {
+			return err
+		}
+	}
+
+	if !r.Done {
+		return nil
+	}
+
+	if w.text {
+		if err := w.stopBlock(); err != nil {
+			return err
+		}
+	}
+
+	reason, sequence := stopReason(r)
+	if err := w.writeEvent(Event{
+		Type:  "message_delta",
+		Delta: MessageDelta{StopReason: reason, StopSequence: sequence},
+		Usage: &Usage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount},
+	}); err != nil {
+		return err
+	}
+
+	return w.writeEvent(Event{Type: "message_stop"})
+}
+
+func (w *MessagesWriter) writeResponse(data []byte) (int, error) {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err == nil && serr.ErrorMessage != "" {
+		// the status has already been sent, so errors after the response
+		// started streaming are reported as an error event
+		resp := NewError(http.StatusInternalServerError, serr.ErrorMessage)
+		if err := w.writeEvent(Event{Type: "error", Error: &resp.Error}); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	var chatResponse api.ChatResponse
+	if err := json.Unmarshal(data, &chatResponse); err != nil {
+		return 0, err
+	}
+
+	if w.stream {
+		if err := w.writeEvents(chatResponse); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(toMessage(w.id, chatResponse)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+func MessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MessagesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		chatReq, err := fromMessagesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &MessagesWriter{
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			stream:     req.Stream,
+			id:         randomID("msg_"),
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
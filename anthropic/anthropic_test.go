@@ -0,0 +1,388 @@
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+const image = `iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNk+A8AAQUBAScY42YAAAAASUVORK5CYII=`
+
+var (
+	False = false
+	True  = true
+)
+
+func captureRequestMiddleware(capturedRequest any) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bodyBytes, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		err := json.Unmarshal(bodyBytes, capturedRequest)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "failed to unmarshal request")
+		}
+		c.Next()
+	}
+}
+
+func TestMessagesMiddleware(t *testing.T) {
+	img, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weather := api.Tool{Type: "function"}
+	weather.Function.Name = "get_weather"
+	weather.Function.Description = "Get the current weather in a given location"
+	weather.Function.Parameters.Type = "object"
+	weather.Function.Parameters.Required = []string{"location"}
+	weather.Function.Parameters.Properties = map[string]struct {
+		Type        string   `json:"type"`
+		Description string   `json:"description"`
+		Enum        []string `json:"enum,omitempty"`
+	}{
+		"location": {Type: "string", Description: "The city and state"},
+	}
+
+	cases := []struct {
+		name string
+		body string
+		req  *api.ChatRequest
+		err  ErrorResponse
+	}{
+		{
+			name: "text",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"messages": [{"role": "user", "content": "Hello"}]
+			}`,
+			req: &api.ChatRequest{
+				Model:    "test-model",
+				Messages: []api.Message{{Role: "user", Content: "Hello"}},
+				Options:  map[string]any{"num_predict": 1024.0},
+				Stream:   &False,
+			},
+		},
+		{
+			name: "options",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 10,
+				"system": "You are a helpful assistant.",
+				"messages": [{"role": "user", "content": "Hello"}],
+				"stop_sequences": ["\n\nHuman:"],
+				"temperature": 0.5,
+				"top_p": 0.9,
+				"top_k": 40,
+				"stream": true,
+				"metadata": {"user_id": "user"}
+			}`,
+			req: &api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "You are a helpful assistant."},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 10.0,
+					"stop":        []any{"\n\nHuman:"},
+					"temperature": 0.5,
+					"top_p":       0.9,
+					"top_k":       40.0,
+				},
+				Stream: &True,
+			},
+		},
+		{
+			name: "content blocks",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"system": [{"type": "text", "text": "Be brief."}],
+				"messages": [
+					{"role": "user", "content": [
+						{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "` + image + `"}},
+						{"type": "text", "text": "What's in this image?"}
+					]},
+					{"role": "assistant", "content": [{"type": "text", "text": "A pixel."}]}
+				]
+			}`,
+			req: &api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Be brief."},
+					{Role: "user", Content: "What's in this image?", Images: []api.ImageData{img}},
+					{Role: "assistant", Content: "A pixel."},
+				},
+				Options: map[string]any{"num_predict": 1024.0},
+				Stream:  &False,
+			},
+		},
+		{
+			name: "tools",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"stream": true,
+				"tools": [{
+					"name": "get_weather",
+					"description": "Get the current weather in a given location",
+					"input_schema": {
+						"type": "object",
+						"properties": {"location": {"type": "string", "description": "The city and state"}},
+						"required": ["location"]
+					}
+				}],
+				"messages": [
+					{"role": "user", "content": "What's the weather in Paris?"},
+					{"role": "assistant", "content": [
+						{"type": "text", "text": "Let me check."},
+						{"type": "tool_use", "id": "toolu_01", "name": "get_weather", "input": {"location": "Paris"}}
+					]},
+					{"role": "user", "content": [
+						{"type": "tool_result", "tool_use_id": "toolu_01", "content": "15 degrees"}
+					]}
+				]
+			}`,
+			req: &api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather in Paris?"},
+					{Role: "assistant", Content: "Let me check.", ToolCalls: []api.ToolCall{
+						{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}},
+					}},
+					{Role: "tool", Content: "15 degrees"},
+				},
+				Options: map[string]any{"num_predict": 1024.0},
+				// streamed responses with tools are generated without streaming
+				Stream: &False,
+				Tools:  []api.Tool{weather},
+			},
+		},
+		{
+			name: "missing max_tokens",
+			body: `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}]}`,
+			err:  ErrorResponse{Type: "error", Error: Error{Type: "invalid_request_error", Message: "max_tokens: field required"}},
+		},
+		{
+			name: "invalid role",
+			body: `{"model": "test-model", "max_tokens": 1, "messages": [{"role": "system", "content": "Hello"}]}`,
+			err:  ErrorResponse{Type: "error", Error: Error{Type: "invalid_request_error", Message: `invalid message role "system", expected user or assistant`}},
+		},
+		{
+			name: "invalid content",
+			body: `{"model": "test-model", "max_tokens": 1, "messages": [{"role": "user", "content": 1}]}`,
+			err:  ErrorResponse{Type: "error", Error: Error{Type: "invalid_request_error", Message: "content must be a string or a list of content blocks"}},
+		},
+		{
+			name: "unsupported block",
+			body: `{"model": "test-model", "max_tokens": 1, "messages": [{"role": "user", "content": [{"type": "document"}]}]}`,
+			err:  ErrorResponse{Type: "error", Error: Error{Type: "invalid_request_error", Message: `unsupported content block type "document"`}},
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var capturedRequest *api.ChatRequest
+
+			router := gin.New()
+			router.Use(MessagesMiddleware(), captureRequestMiddleware(&capturedRequest))
+			router.Handle(http.MethodPost, "/v1/messages", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			var errResp ErrorResponse
+			if resp.Code != http.StatusOK {
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if diff := cmp.Diff(tt.req, capturedRequest); diff != "" {
+				t.Errorf("request mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.err, errResp); diff != "" {
+				t.Errorf("error mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMessagesResponse(t *testing.T) {
+	// ids vary between runs
+	idPattern := regexp.MustCompile(`"id":"(msg|toolu)_[A-Za-z0-9]+"`)
+
+	// stream writes native responses as the chat handler does, flushing
+	// after each like c.Stream
+	stream := func(chunks ...any) func(c *gin.Context) {
+		return func(c *gin.Context) {
+			c.Header("Content-Type", "application/x-ndjson")
+			for _, chunk := range chunks {
+				b, err := json.Marshal(chunk)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := c.Writer.Write(append(b, '\n')); err != nil {
+					t.Fatal(err)
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+
+	chunk := func(content string) api.ChatResponse {
+		return api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: content}}
+	}
+
+	done := func(r api.ChatResponse, reason string) api.ChatResponse {
+		r.Done = true
+		r.DoneReason = reason
+		r.PromptEvalCount = 12
+		r.EvalCount = 3
+		return r
+	}
+
+	toolCall := api.ChatResponse{
+		Model: "test-model",
+		Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}},
+		}},
+	}
+
+	const body = `{"model": "test-model", "max_tokens": 16, "messages": [{"role": "user", "content": "Hello"}]}`
+	const streamBody = `{"model": "test-model", "max_tokens": 16, "messages": [{"role": "user", "content": "Hello"}], "stream": true}`
+
+	cases := []struct {
+		name     string
+		body     string
+		endpoint func(c *gin.Context)
+		status   int
+	}{
+		{
+			name:     "message",
+			body:     body,
+			endpoint: stream(done(chunk("Hello there!"), "stop")),
+			status:   http.StatusOK,
+		},
+		{
+			name:     "message_tool_use",
+			body:     body,
+			endpoint: stream(done(toolCall, "stop")),
+			status:   http.StatusOK,
+		},
+		{
+			name: "message_stop_sequence",
+			body: body,
+			endpoint: stream(func() api.ChatResponse {
+				r := done(chunk("Hello there!"), "stop_string")
+				r.StopString = "\n\nHuman:"
+				return r
+			}()),
+			status: http.StatusOK,
+		},
+		{
+			name: "text_stream_stop_sequence",
+			body: streamBody,
+			endpoint: stream(chunk("Hello"), func() api.ChatResponse {
+				r := done(chunk("!"), "stop_string")
+				r.StopString = "\n\nHuman:"
+				return r
+			}()),
+			status: http.StatusOK,
+		},
+		{
+			name:     "text_stream",
+			body:     streamBody,
+			endpoint: stream(chunk("Hello"), chunk(" there"), done(chunk("!"), "length")),
+			status:   http.StatusOK,
+		},
+		{
+			name: "tool_use_stream",
+			body: streamBody,
+			endpoint: stream(done(api.ChatResponse{
+				Model: "test-model",
+				Message: api.Message{Role: "assistant", Content: "Let me check.", ToolCalls: []api.ToolCall{
+					{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}},
+					{Function: api.ToolCallFunction{Name: "get_time", Arguments: api.ToolCallFunctionArguments{}}},
+				}},
+			}, "stop")),
+			status: http.StatusOK,
+		},
+		{
+			name:     "error_stream",
+			body:     streamBody,
+			endpoint: stream(chunk("Hello"), gin.H{"error": "llama runner process has terminated: signal: killed"}),
+			status:   http.StatusOK,
+		},
+		{
+			name: "not_found_error",
+			body: body,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusNotFound, gin.H{"error": `model "test-model" not found, try pulling it first`})
+			},
+			status: http.StatusNotFound,
+		},
+		{
+			name: "overloaded_error",
+			body: body,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server busy, please try again.  maximum pending requests exceeded"})
+			},
+			status: http.StatusServiceUnavailable,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(MessagesMiddleware())
+			router.Handle(http.MethodPost, "/v1/messages", tt.endpoint)
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if resp.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.Code)
+			}
+
+			expect, err := os.ReadFile(filepath.Join("testdata", tt.name+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := idPattern.ReplaceAllString(resp.Body.String(), `"id":"${1}_ID"`)
+			if diff := cmp.Diff(string(expect), actual); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -16,14 +16,19 @@ package api
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
@@ -33,8 +38,44 @@ import (
 // Client encapsulates client state for interacting with the ollama
 // service. Use [ClientFromEnvironment] to create new Clients.
 type Client struct {
-	base *url.URL
-	http *http.Client
+	base   *url.URL
+	http   *http.Client
+	apiKey string
+}
+
+// Error responses with these codes are returned as typed errors
+const (
+	// licenseRequiredCode is returned as a [LicenseError]
+	licenseRequiredCode = "license_required"
+
+	// unsupportedModelCode is returned as an [UnsupportedModelError]
+	unsupportedModelCode = "unsupported_model"
+)
+
+// codedError returns the typed error for an error response with a code, or
+// nil if it doesn't have one
+func codedError(body []byte) error {
+	var resp struct {
+		Code string `json:"code"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return nil
+	}
+
+	switch resp.Code {
+	case licenseRequiredCode:
+		var lerr LicenseError
+		if json.Unmarshal(body, &lerr) == nil {
+			return lerr
+		}
+	case unsupportedModelCode:
+		var uerr UnsupportedModelError
+		if json.Unmarshal(body, &uerr) == nil {
+			return uerr
+		}
+	}
+
+	return nil
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -42,6 +83,10 @@ func checkError(resp *http.Response, body []byte) error {
 		return nil
 	}
 
+	if err := codedError(body); err != nil {
+		return err
+	}
+
 	apiError := StatusError{StatusCode: resp.StatusCode}
 
 	err := json.Unmarshal(body, &apiError)
@@ -60,15 +105,38 @@ func checkError(resp *http.Response, body []byte) error {
 //
 //	<scheme>://<host>:<port>
 //
-// If the variable is not specified, a default ollama host and port will be
-// used.
+// or unix://<path> for a server listening on a unix socket. If the variable
+// is not specified, a default ollama host and port will be used.
 func ClientFromEnvironment() (*Client, error) {
+	base := envconfig.Host()
+	if base.Scheme == "unix" {
+		return NewUnixClient(base.Path, envconfig.APIKey()), nil
+	}
+
 	return &Client{
-		base: envconfig.Host(),
-		http: http.DefaultClient,
+		base:   base,
+		http:   http.DefaultClient,
+		apiKey: envconfig.APIKey(),
 	}, nil
 }
 
+// NewUnixClient is [NewClientWithAPIKey] for a server listening on the unix
+// socket at path.
+func NewUnixClient(path, apiKey string) *Client {
+	var d net.Dialer
+	return &Client{
+		base: &url.URL{Scheme: "http", Host: "localhost"},
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+		apiKey: apiKey,
+	}
+}
+
 func NewClient(base *url.URL, http *http.Client) *Client {
 	return &Client{
 		base: base,
@@ -76,7 +144,34 @@ func NewClient(base *url.URL, http *http.Client) *Client {
 	}
 }
 
+// NewClientWithAPIKey is [NewClient] for a server that requires requests to
+// authenticate with apiKey.
+func NewClientWithAPIKey(base *url.URL, http *http.Client, apiKey string) *Client {
+	return &Client{
+		base:   base,
+		http:   http,
+		apiKey: apiKey,
+	}
+}
+
+func (c *Client) setHeaders(request *http.Request, accept string) {
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", accept)
+	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+}
+
 func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
+	_, _, err := c.doIfChanged(ctx, method, path, "", reqData, respData)
+	return err
+}
+
+// doIfChanged is do for a request with the If-None-Match etag, if it isn't
+// empty. It reports whether the response changed, decoding it into respData
+// only if it did, and returns the response's ETag.
+func (c *Client) doIfChanged(ctx context.Context, method, path, etag string, reqData, respData any) (bool, string, error) {
 	var reqBody io.Reader
 	var data []byte
 	var err error
@@ -90,43 +185,50 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 	default:
 		data, err = json.Marshal(reqData)
 		if err != nil {
-			return err
+			return false, "", err
 		}
 
 		reqBody = bytes.NewReader(data)
 	}
 
+	path, query, _ := strings.Cut(path, "?")
 	requestURL := c.base.JoinPath(path)
+	requestURL.RawQuery = query
 	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
 	if err != nil {
-		return err
+		return false, "", err
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/json")
-	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	c.setHeaders(request, "application/json")
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
 
 	respObj, err := c.http.Do(request)
 	if err != nil {
-		return err
+		return false, "", err
 	}
 	defer respObj.Body.Close()
 
+	if respObj.StatusCode == http.StatusNotModified {
+		return false, cmp.Or(respObj.Header.Get("ETag"), etag), nil
+	}
+
 	respBody, err := io.ReadAll(respObj.Body)
 	if err != nil {
-		return err
+		return false, "", err
 	}
 
 	if err := checkError(respObj, respBody); err != nil {
-		return err
+		return false, "", err
 	}
 
 	if len(respBody) > 0 && respData != nil {
 		if err := json.Unmarshal(respBody, respData); err != nil {
-			return err
+			return false, "", err
 		}
 	}
-	return nil
+	return true, respObj.Header.Get("ETag"), nil
 }
 
 const maxBufferSize = 512 * format.KiloByte
@@ -148,9 +250,7 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		return err
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/x-ndjson")
-	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	c.setHeaders(request, "application/x-ndjson")
 
 	response, err := c.http.Do(request)
 	if err != nil {
@@ -172,6 +272,10 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			return fmt.Errorf("unmarshal: %w", err)
 		}
 
+		if err := codedError(bts); err != nil {
+			return err
+		}
+
 		if errorResponse.Error != "" {
 			return errors.New(errorResponse.Error)
 		}
@@ -189,7 +293,13 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		}
 	}
 
-	return nil
+	// the body is closed when ctx is cancelled, which the scanner sees as an
+	// ordinary read error or even the end of the response
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return scanner.Err()
 }
 
 // GenerateResponseFunc is a function that [Client.Generate] invokes every time
@@ -231,6 +341,44 @@ func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc
 	})
 }
 
+// CreateSession creates a chat session whose history is kept by the server,
+// so each message is sent without the ones before it.
+func (c *Client) CreateSession(ctx context.Context, req *CreateSessionRequest) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodPost, "/api/sessions", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SessionChat sends a user message to the session id, adding it and the
+// model's reply to the session's history once the reply is done. fn is
+// called for each response, as in [Client.Chat].
+func (c *Client) SessionChat(ctx context.Context, id string, req *SessionChatRequest, fn ChatResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/sessions/"+url.PathEscape(id)+"/chat", req, func(bts []byte) error {
+		var resp ChatResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
+// Session returns the session id with its history.
+func (c *Client) Session(ctx context.Context, id string) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodGet, "/api/sessions/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteSession ends the session id.
+func (c *Client) DeleteSession(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/sessions/"+url.PathEscape(id), nil, nil)
+}
+
 // PullProgressFunc is a function that [Client.Pull] invokes every time there
 // is progress with a "pull" request sent to the service. If this function
 // returns an error, [Client.Pull] will stop the process and return this error.
@@ -289,6 +437,21 @@ func (c *Client) Create(ctx context.Context, req *CreateRequest, fn CreateProgre
 	})
 }
 
+// Imatrix computes the importance matrix of a model over calibration text
+// and stores it as a blob, whose digest is in the final progress response,
+// for quantizing the model with. fn is a progress function that behaves
+// similarly to other methods (see [Client.Pull]).
+func (c *Client) Imatrix(ctx context.Context, req *ImatrixRequest, fn func(ProgressResponse) error) error {
+	return c.stream(ctx, http.MethodPost, "/api/imatrix", req, func(bts []byte) error {
+		var resp ProgressResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
 // List lists models that are available locally.
 func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	var lr ListResponse
@@ -298,6 +461,18 @@ func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	return &lr, nil
 }
 
+// ListIfChanged is [Client.List] for a client that already has the models
+// from the response with the ETag etag. It returns a nil response if they
+// haven't changed since, along with the ETag to pass to the next call.
+func (c *Client) ListIfChanged(ctx context.Context, etag string) (*ListResponse, string, error) {
+	var lr ListResponse
+	changed, etag, err := c.doIfChanged(ctx, http.MethodGet, "/api/tags", etag, nil, &lr)
+	if err != nil || !changed {
+		return nil, etag, err
+	}
+	return &lr, etag, nil
+}
+
 // ListRunning lists running models.
 func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	var lr ProcessResponse
@@ -307,6 +482,134 @@ func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	return &lr, nil
 }
 
+// ListRunningIfChanged is [Client.ListRunning] for a client that already has
+// the running models from the response with the ETag etag. It returns a nil
+// response if they haven't changed since, along with the ETag to pass to the
+// next call.
+func (c *Client) ListRunningIfChanged(ctx context.Context, etag string) (*ProcessResponse, string, error) {
+	var lr ProcessResponse
+	changed, etag, err := c.doIfChanged(ctx, http.MethodGet, "/api/ps", etag, nil, &lr)
+	if err != nil || !changed {
+		return nil, etag, err
+	}
+	return &lr, etag, nil
+}
+
+// ListRunningVerbose lists running models with the state of their parallel
+// slots, sampled from their runners.
+func (c *Client) ListRunningVerbose(ctx context.Context) (*ProcessResponse, error) {
+	var lr ProcessResponse
+	if err := c.do(ctx, http.MethodGet, "/api/ps?verbose=true", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// ListRemotes lists the remote servers models may be placed on.
+func (c *Client) ListRemotes(ctx context.Context) (*ListRemotesResponse, error) {
+	var lr ListRemotesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/remotes", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// Usage returns the cumulative usage of each model since the server started
+// or its usage was reset. If byKey is set, usage is also grouped by the API
+// key requests were made with.
+func (c *Client) Usage(ctx context.Context, byKey bool) (*UsageResponse, error) {
+	path := "/api/usage"
+	if byKey {
+		path += "?by=key"
+	}
+
+	var resp UsageResponse
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ResetUsage resets the server's usage counters.
+func (c *Client) ResetUsage(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/usage/reset", nil, nil)
+}
+
+// ListPresets lists the server's presets.
+func (c *Client) ListPresets(ctx context.Context) (*ListPresetsResponse, error) {
+	var lr ListPresetsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/presets", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// ListAliases lists the server's aliases.
+func (c *Client) ListAliases(ctx context.Context) (*ListAliasesResponse, error) {
+	var lr ListAliasesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/aliases", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// SetAlias defines an alias, replacing any alias of the same name.
+func (c *Client) SetAlias(ctx context.Context, req *Alias) error {
+	return c.do(ctx, http.MethodPost, "/api/aliases", req, nil)
+}
+
+// DeleteAlias removes an alias.
+func (c *Client) DeleteAlias(ctx context.Context, req *DeleteAliasRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/aliases", req, nil)
+}
+
+// AddRemote registers a remote server to place models on when they don't fit
+// on this server.
+func (c *Client) AddRemote(ctx context.Context, req *RemoteRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/remotes", req, nil)
+}
+
+// DeleteRemote removes a registered remote server.
+func (c *Client) DeleteRemote(ctx context.Context, req *RemoteRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/remotes", req, nil)
+}
+
+// AcceptLicense records that the license of a model has been accepted, for
+// models whose license must be accepted before they're pulled or used.
+func (c *Client) AcceptLicense(ctx context.Context, req *AcceptLicenseRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/license", req, nil)
+}
+
+// Dedupe finds blobs stored more than once across the server's models
+// directory and other models directories, replacing duplicates with hardlinks.
+func (c *Client) Dedupe(ctx context.Context, req *DedupeRequest) (*DedupeResponse, error) {
+	var resp DedupeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/store/dedupe", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Prune removes blobs that aren't used by any model, and reports or removes
+// models that reference blobs that are missing.
+func (c *Client) Prune(ctx context.Context, req *PruneRequest) (*PruneResponse, error) {
+	var resp PruneResponse
+	if err := c.do(ctx, http.MethodPost, "/api/store/prune", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Refresh checks models for updates in the registry, pulling any that have
+// changed and reloading them if they're loaded.
+func (c *Client) Refresh(ctx context.Context, req *RefreshRequest) (*RefreshResponse, error) {
+	var resp RefreshResponse
+	if err := c.do(ctx, http.MethodPost, "/api/refresh", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Copy copies a model - creating a model with another name from an existing
 // model.
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
@@ -318,10 +621,18 @@ func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 
 // Delete deletes a model and its data.
 func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
-	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, nil); err != nil {
-		return err
+	_, err := c.DeleteModels(ctx, req)
+	return err
+}
+
+// DeleteModels deletes one or more models and their data, reporting the disk
+// space reclaimed, or that would be reclaimed if req.DryRun is set.
+func (c *Client) DeleteModels(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	var resp DeleteResponse
+	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, &resp); err != nil {
+		return nil, err
 	}
-	return nil
+	return &resp, nil
 }
 
 // Show obtains model information, including details, modelfile, license etc.
@@ -351,6 +662,16 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// Score returns the log-likelihood of each of the continuations in req
+// following its prompt.
+func (c *Client) Score(ctx context.Context, req *ScoreRequest) (*ScoreResponse, error) {
+	var resp ScoreResponse
+	if err := c.do(ctx, http.MethodPost, "/api/score", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
@@ -362,10 +683,275 @@ func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*Embedd
 
 // CreateBlob creates a blob from a file on the server. digest is the
 // expected SHA256 digest of the file, and r represents the file.
+//
+// If r is an [io.Seeker] with more than [BlobChunkSize] bytes left, such as
+// an [os.File], it's uploaded in chunks that are resumed from where they
+// stopped if the connection fails, and an upload an earlier call didn't
+// finish is resumed rather than started again.
 func (c *Client) CreateBlob(ctx context.Context, digest string, r io.Reader) error {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if start, size, err := remaining(rs); err == nil && size > BlobChunkSize {
+			return c.createBlobChunks(ctx, digest, rs, start, size)
+		}
+	}
+
 	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/blobs/%s", digest), r, nil)
 }
 
+// BlobChunkSize is the size of the chunks [Client.CreateBlob] uploads large
+// blobs in.
+var BlobChunkSize int64 = 64 * format.MebiByte
+
+// blobUploadRetries is how many times in a row a chunk is retried before
+// the upload fails
+const blobUploadRetries = 5
+
+// remaining returns the offset of rs and how many bytes are left after it
+func remaining(rs io.ReadSeeker) (int64, int64, error) {
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	return start, end - start, nil
+}
+
+// createBlobChunks uploads the size bytes of rs from start as the blob with
+// digest, a chunk at a time
+func (c *Client) createBlobChunks(ctx context.Context, digest string, rs io.ReadSeeker, start, size int64) error {
+	path := fmt.Sprintf("/api/blobs/%s", digest)
+
+	// the server knows how much of an upload it has, or that it has the
+	// whole blob already
+	offset, err := c.blobOffset(ctx, path)
+	if errors.Is(err, errBlobExists) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var retries int
+	for {
+		if offset > size {
+			return fmt.Errorf("server has %d bytes of a %d byte blob", offset, size)
+		}
+
+		if _, err := rs.Seek(start+offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		end := min(offset+BlobChunkSize, size)
+		next, err := c.createBlobChunk(ctx, path, io.LimitReader(rs, end-offset), offset, end, size)
+		switch {
+		case err == nil && next == size:
+			return nil
+		case err == nil:
+			offset, retries = next, 0
+			continue
+		case ctx.Err() != nil:
+			return ctx.Err()
+		}
+
+		// connection failures and chunks the server isn't ready for are
+		// retried, other errors aren't
+		var statusError StatusError
+		if errors.As(err, &statusError) && statusError.StatusCode != http.StatusConflict && statusError.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			return err
+		}
+
+		if retries++; retries > blobUploadRetries {
+			return err
+		}
+
+		// wait for the server to notice a dropped connection, then ask it
+		// where to resume
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(retries) * time.Second):
+		}
+
+		// a chunk still being written to keeps the last offset, which the
+		// server corrects if it's wrong
+		next, err = c.blobOffset(ctx, path)
+		switch {
+		case errors.Is(err, errBlobExists):
+			return nil
+		case err == nil:
+			offset = next
+		case !errors.As(err, &statusError) || statusError.StatusCode != http.StatusConflict:
+			return err
+		}
+	}
+}
+
+var errBlobExists = errors.New("blob exists")
+
+// blobOffset returns how much of a partial upload of the blob at path the
+// server has, or errBlobExists if it has all of it
+func (c *Client) blobOffset(ctx context.Context, path string) (int64, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, c.base.JoinPath(path).String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	c.setHeaders(request, "application/json")
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return 0, errBlobExists
+	case http.StatusNotFound:
+		if h := response.Header.Get("Upload-Offset"); h != "" {
+			return strconv.ParseInt(h, 10, 64)
+		}
+		return 0, nil
+	default:
+		return 0, StatusError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+}
+
+// createBlobChunk uploads the bytes from offset to end of a blob of size,
+// returning the offset the server has the blob up to
+func (c *Client) createBlobChunk(ctx context.Context, path string, r io.Reader, offset, end, size int64) (int64, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base.JoinPath(path).String(), r)
+	if err != nil {
+		return 0, err
+	}
+
+	c.setHeaders(request, "application/json")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+	request.ContentLength = end - offset
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkError(response, body); err != nil {
+		return 0, err
+	}
+
+	if response.StatusCode == http.StatusAccepted {
+		return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+	}
+
+	return size, nil
+}
+
+// ListTransfers lists the pulls and pushes in progress.
+func (c *Client) ListTransfers(ctx context.Context) (*ListTransfersResponse, error) {
+	var resp ListTransfersResponse
+	if err := c.do(ctx, http.MethodGet, "/api/transfers", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelTransfer cancels a pull or push and waits for it to stop. The
+// partial downloads of a cancelled pull are kept so pulling the model again
+// resumes them, unless discard is set.
+func (c *Client) CancelTransfer(ctx context.Context, id string, discard bool) error {
+	path := "/api/transfers/" + url.PathEscape(id)
+	if discard {
+		path += "?discard=true"
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// Search searches the registry for models to pull.
+func (c *Client) Search(ctx context.Context, req *SearchRequest) (*SearchResponse, error) {
+	query := url.Values{"q": {req.Query}}
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.Sort != "" {
+		query.Set("sort", req.Sort)
+	}
+
+	var resp SearchResponse
+	if err := c.do(ctx, http.MethodGet, "/api/search?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// HasBlob reports whether the server has the blob with the given digest.
+func (c *Client) HasBlob(ctx context.Context, digest string) (bool, error) {
+	err := c.do(ctx, http.MethodHead, fmt.Sprintf("/api/blobs/%s", digest), nil, nil)
+	var statusError StatusError
+	if errors.As(err, &statusError) && statusError.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Blob returns the contents of the blob with the given digest. The caller
+// must close it.
+func (c *Client) Blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base.JoinPath("/api/blobs", digest).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setHeaders(request, "application/octet-stream")
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, checkError(response, body)
+	}
+
+	return response.Body, nil
+}
+
+// Manifest returns the manifest of a model, listing the blobs it's made of.
+func (c *Client) Manifest(ctx context.Context, model string) (*Manifest, error) {
+	var m Manifest
+	if err := c.do(ctx, http.MethodGet, "/api/manifests/"+model, nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// PutManifest creates or replaces a model from a manifest. Every blob it
+// lists must already be on the server, e.g. from [Client.CreateBlob].
+func (c *Client) PutManifest(ctx context.Context, model string, m *Manifest) error {
+	return c.do(ctx, http.MethodPut, "/api/manifests/"+model, m, nil)
+}
+
 // Version returns the Ollama server version as a string.
 func (c *Client) Version(ctx context.Context) (string, error) {
 	var version struct {
@@ -378,3 +964,19 @@ func (c *Client) Version(ctx context.Context) (string, error) {
 
 	return version.Version, nil
 }
+
+// VersionInfo returns the server's version and build. Verbose responses also
+// list its runners and the GPU backends it found.
+func (c *Client) VersionInfo(ctx context.Context, verbose bool) (*VersionResponse, error) {
+	path := "/api/version"
+	if verbose {
+		path += "?verbose=true"
+	}
+
+	var resp VersionResponse
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
@@ -1,7 +1,14 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestClientFromEnvironment(t *testing.T) {
@@ -43,3 +50,91 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestClientStreamCancel(t *testing.T) {
+	sent := make(chan struct{})
+	cancelled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"message": {"role": "assistant", "content": "partial"}}`)
+		w.(http.Flusher).Flush()
+		close(sent)
+
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			t.Error("expected the request to be cancelled")
+		}
+	}))
+	defer ts.Close()
+
+	base, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(base, http.DefaultClient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var content string
+	err = client.Chat(ctx, &ChatRequest{Model: "test"}, func(resp ChatResponse) error {
+		content += resp.Message.Content
+		<-sent
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if content != "partial" {
+		t.Errorf("expected the partial response, got %q", content)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the cancellation to reach the server")
+	}
+}
+
+func TestClientListIfChanged(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		fmt.Fprintln(w, `{"models": [{"name": "test"}]}`)
+	}))
+	defer ts.Close()
+
+	base, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(base, http.DefaultClient)
+
+	resp, etag, err := client.ListIfChanged(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp == nil || len(resp.Models) != 1 || etag != `"v1"` {
+		t.Fatalf("expected the models, got %v %q", resp, etag)
+	}
+
+	resp, etag, err = client.ListIfChanged(context.Background(), etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp != nil || etag != `"v1"` {
+		t.Errorf("expected no response for unchanged models, got %v %q", resp, etag)
+	}
+}
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+)
+
+// RequestOption sets a field of a request built by [NewGenerateRequest],
+// [NewChatRequest], [NewEmbedRequest] or [NewPullRequest], or by the
+// [Client] methods that take options, such as [Client.ChatWith]. Options
+// that set fields a request doesn't have return an error when it's built,
+// e.g. [WithSystem] for a chat request.
+type RequestOption struct {
+	name string
+
+	generate func(*GenerateRequest)
+	chat     func(*ChatRequest)
+	embed    func(*EmbedRequest)
+	pull     func(*PullRequest)
+}
+
+func (o RequestOption) unsupported(request string) error {
+	return fmt.Errorf("option %s doesn't apply to %s requests", o.name, request)
+}
+
+// NewGenerateRequest returns a request for [Client.Generate] to generate a
+// response to prompt with model.
+func NewGenerateRequest(model, prompt string, opts ...RequestOption) (*GenerateRequest, error) {
+	req := &GenerateRequest{Model: model, Prompt: prompt}
+	for _, opt := range opts {
+		if opt.generate == nil {
+			return nil, opt.unsupported("generate")
+		}
+		opt.generate(req)
+	}
+
+	return req, nil
+}
+
+// NewChatRequest returns a request for [Client.Chat] to generate the next
+// message of a chat with model.
+func NewChatRequest(model string, messages []Message, opts ...RequestOption) (*ChatRequest, error) {
+	req := &ChatRequest{Model: model, Messages: messages}
+	for _, opt := range opts {
+		if opt.chat == nil {
+			return nil, opt.unsupported("chat")
+		}
+		opt.chat(req)
+	}
+
+	return req, nil
+}
+
+// NewEmbedRequest returns a request for [Client.Embed] to embed input, a
+// string or a slice of strings, with model.
+func NewEmbedRequest(model string, input any, opts ...RequestOption) (*EmbedRequest, error) {
+	req := &EmbedRequest{Model: model, Input: input}
+	for _, opt := range opts {
+		if opt.embed == nil {
+			return nil, opt.unsupported("embed")
+		}
+		opt.embed(req)
+	}
+
+	return req, nil
+}
+
+// NewPullRequest returns a request for [Client.Pull] to pull model.
+func NewPullRequest(model string, opts ...RequestOption) (*PullRequest, error) {
+	req := &PullRequest{Model: model}
+	for _, opt := range opts {
+		if opt.pull == nil {
+			return nil, opt.unsupported("pull")
+		}
+		opt.pull(req)
+	}
+
+	return req, nil
+}
+
+// GenerateWith is [Client.Generate] with a request built by
+// [NewGenerateRequest].
+func (c *Client) GenerateWith(ctx context.Context, model, prompt string, fn GenerateResponseFunc, opts ...RequestOption) error {
+	req, err := NewGenerateRequest(model, prompt, opts...)
+	if err != nil {
+		return err
+	}
+
+	return c.Generate(ctx, req, fn)
+}
+
+// ChatWith is [Client.Chat] with a request built by [NewChatRequest].
+func (c *Client) ChatWith(ctx context.Context, model string, messages []Message, fn ChatResponseFunc, opts ...RequestOption) error {
+	req, err := NewChatRequest(model, messages, opts...)
+	if err != nil {
+		return err
+	}
+
+	return c.Chat(ctx, req, fn)
+}
+
+// EmbedWith is [Client.Embed] with a request built by [NewEmbedRequest].
+func (c *Client) EmbedWith(ctx context.Context, model string, input any, opts ...RequestOption) (*EmbedResponse, error) {
+	req, err := NewEmbedRequest(model, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Embed(ctx, req)
+}
+
+// PullWith is [Client.Pull] with a request built by [NewPullRequest].
+func (c *Client) PullWith(ctx context.Context, model string, fn PullProgressFunc, opts ...RequestOption) error {
+	req, err := NewPullRequest(model, opts...)
+	if err != nil {
+		return err
+	}
+
+	return c.Pull(ctx, req, fn)
+}
+
+// mergeOptions sets opts in the request's model options, creating them if needed
+func mergeOptions(dst *map[string]any, opts map[string]any) {
+	if *dst == nil {
+		*dst = make(map[string]any, len(opts))
+	}
+	maps.Copy(*dst, opts)
+}
+
+// WithOptions sets model options, such as "temperature" or "num_ctx", as in
+// the Options field of a request. Options set by earlier calls to
+// WithOptions or [WithOption] are kept unless they're set again. It applies
+// to generate, chat and embed requests.
+func WithOptions(opts map[string]any) RequestOption {
+	return RequestOption{
+		name:     "WithOptions",
+		generate: func(r *GenerateRequest) { mergeOptions(&r.Options, opts) },
+		chat:     func(r *ChatRequest) { mergeOptions(&r.Options, opts) },
+		embed:    func(r *EmbedRequest) { mergeOptions(&r.Options, opts) },
+	}
+}
+
+// WithOption sets the model option key to value. It applies to generate,
+// chat and embed requests.
+func WithOption(key string, value any) RequestOption {
+	opt := WithOptions(map[string]any{key: value})
+	opt.name = "WithOption"
+	return opt
+}
+
+// WithKeepAlive sets how long the model stays loaded after the request. A
+// negative duration keeps it loaded indefinitely, and zero unloads it as soon
+// as the request is done. It applies to generate, chat and embed requests.
+func WithKeepAlive(d time.Duration) RequestOption {
+	return RequestOption{
+		name:     "WithKeepAlive",
+		generate: func(r *GenerateRequest) { r.KeepAlive = &Duration{d} },
+		chat:     func(r *ChatRequest) { r.KeepAlive = &Duration{d} },
+		embed:    func(r *EmbedRequest) { r.KeepAlive = &Duration{d} },
+	}
+}
+
+// WithStream sets whether responses are streamed, which they are by default.
+// It applies to generate, chat and pull requests.
+func WithStream(stream bool) RequestOption {
+	return RequestOption{
+		name:     "WithStream",
+		generate: func(r *GenerateRequest) { r.Stream = &stream },
+		chat:     func(r *ChatRequest) { r.Stream = &stream },
+		pull:     func(r *PullRequest) { r.Stream = &stream },
+	}
+}
+
+// WithFormat sets the format of the response, e.g. "json". It applies to
+// generate and chat requests.
+func WithFormat(format string) RequestOption {
+	return RequestOption{
+		name:     "WithFormat",
+		generate: func(r *GenerateRequest) { r.Format = format },
+		chat:     func(r *ChatRequest) { r.Format = format },
+	}
+}
+
+// WithFlushInterval coalesces streamed responses, sending them at most every
+// d. It applies to generate and chat requests.
+func WithFlushInterval(d time.Duration) RequestOption {
+	return RequestOption{
+		name:     "WithFlushInterval",
+		generate: func(r *GenerateRequest) { r.FlushInterval = &Duration{d} },
+		chat:     func(r *ChatRequest) { r.FlushInterval = &Duration{d} },
+	}
+}
+
+// WithMaxTime stops generation once it has run for d, returning what was
+// generated so far. It applies to generate and chat requests.
+func WithMaxTime(d time.Duration) RequestOption {
+	return RequestOption{
+		name:     "WithMaxTime",
+		generate: func(r *GenerateRequest) { r.MaxTime = &Duration{d} },
+		chat:     func(r *ChatRequest) { r.MaxTime = &Duration{d} },
+	}
+}
+
+// WithChoices generates n independent responses, which requires streaming.
+// It applies to generate and chat requests.
+func WithChoices(n int) RequestOption {
+	return RequestOption{
+		name:     "WithChoices",
+		generate: func(r *GenerateRequest) { r.N = n },
+		chat:     func(r *ChatRequest) { r.N = n },
+	}
+}
+
+// WithReturnOptions includes the options the response was generated with in
+// the final response. It applies to generate and chat requests.
+func WithReturnOptions() RequestOption {
+	return RequestOption{
+		name:     "WithReturnOptions",
+		generate: func(r *GenerateRequest) { r.ReturnOptions = true },
+		chat:     func(r *ChatRequest) { r.ReturnOptions = true },
+	}
+}
+
+// WithReasoning sets how the thinking of reasoning models is returned, one
+// of [ReasoningInclude], [ReasoningSeparate] or [ReasoningStrip]. It applies
+// to generate and chat requests.
+func WithReasoning(reasoning string) RequestOption {
+	return RequestOption{
+		name:     "WithReasoning",
+		generate: func(r *GenerateRequest) { r.Reasoning = reasoning },
+		chat:     func(r *ChatRequest) { r.Reasoning = reasoning },
+	}
+}
+
+// WithJSONStrict checks that responses with the format "json" are valid
+// JSON, repairing them or generating them again as set by policy, one of
+// [JSONStrictRepair] or [JSONStrictRetry]. retries is the most times a
+// response is generated again with [JSONStrictRetry]. It applies to generate
+// and chat requests.
+func WithJSONStrict(policy string, retries int) RequestOption {
+	return RequestOption{
+		name:     "WithJSONStrict",
+		generate: func(r *GenerateRequest) { r.JSONStrict, r.JSONRetries = policy, &retries },
+		chat:     func(r *ChatRequest) { r.JSONStrict, r.JSONRetries = policy, &retries },
+	}
+}
+
+// WithPreset selects one of the server's presets of options and system
+// message. It applies to generate and chat requests.
+func WithPreset(name string) RequestOption {
+	return RequestOption{
+		name:     "WithPreset",
+		generate: func(r *GenerateRequest) { r.Preset = name },
+		chat:     func(r *ChatRequest) { r.Preset = name },
+	}
+}
+
+// WithSystem overrides the model's system message. It applies to generate
+// requests; chat requests set it with a message with the "system" role.
+func WithSystem(system string) RequestOption {
+	return RequestOption{
+		name:     "WithSystem",
+		generate: func(r *GenerateRequest) { r.System = system },
+	}
+}
+
+// WithTemplate overrides the model's prompt template. It applies to generate
+// requests.
+func WithTemplate(template string) RequestOption {
+	return RequestOption{
+		name:     "WithTemplate",
+		generate: func(r *GenerateRequest) { r.Template = template },
+	}
+}
+
+// WithSuffix sets the text after the generated text, for models that can
+// fill in the middle. It applies to generate requests.
+func WithSuffix(suffix string) RequestOption {
+	return RequestOption{
+		name:     "WithSuffix",
+		generate: func(r *GenerateRequest) { r.Suffix = suffix },
+	}
+}
+
+// WithRaw sends the prompt without applying the model's template. It applies
+// to generate requests.
+func WithRaw() RequestOption {
+	return RequestOption{
+		name:     "WithRaw",
+		generate: func(r *GenerateRequest) { r.Raw = true },
+	}
+}
+
+// WithContext continues from the context returned by a previous generate
+// request. It applies to generate requests.
+func WithContext(context []int) RequestOption {
+	return RequestOption{
+		name:     "WithContext",
+		generate: func(r *GenerateRequest) { r.Context = context },
+	}
+}
+
+// WithImages adds images for multimodal models. It applies to generate
+// requests; chat requests add images to their messages.
+func WithImages(images ...ImageData) RequestOption {
+	return RequestOption{
+		name:     "WithImages",
+		generate: func(r *GenerateRequest) { r.Images = append(r.Images, images...) },
+	}
+}
+
+// WithTools sets the tools the model may call. It applies to chat requests.
+func WithTools(tools Tools) RequestOption {
+	return RequestOption{
+		name: "WithTools",
+		chat: func(r *ChatRequest) { r.Tools = append(r.Tools, tools...) },
+	}
+}
+
+// WithTruncate sets how inputs longer than the context are truncated. It
+// applies to embed requests.
+func WithTruncate(truncate Truncate) RequestOption {
+	return RequestOption{
+		name:  "WithTruncate",
+		embed: func(r *EmbedRequest) { r.TruncateMode = truncate },
+	}
+}
+
+// WithDimensions shortens embeddings to n dimensions. It applies to embed
+// requests.
+func WithDimensions(n int) RequestOption {
+	return RequestOption{
+		name:  "WithDimensions",
+		embed: func(r *EmbedRequest) { r.Dimensions = n },
+	}
+}
+
+// WithNormalize sets whether embeddings shortened by [WithDimensions] are
+// normalized. It applies to embed requests.
+func WithNormalize(normalize bool) RequestOption {
+	return RequestOption{
+		name:  "WithNormalize",
+		embed: func(r *EmbedRequest) { r.Normalize = &normalize },
+	}
+}
+
+// WithInsecure allows pulling from registries without TLS. It applies to
+// pull requests.
+func WithInsecure() RequestOption {
+	return RequestOption{
+		name: "WithInsecure",
+		pull: func(r *PullRequest) { r.Insecure = true },
+	}
+}
+
+// WithVariants pulls only the given quantizations of a model with variants.
+// It applies to pull requests.
+func WithVariants(quantizations ...string) RequestOption {
+	return RequestOption{
+		name: "WithVariants",
+		pull: func(r *PullRequest) { r.Variants = append(r.Variants, quantizations...) },
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// requestJSON builds a request and returns its JSON as a map
+func requestJSON(t *testing.T, build func() (any, error)) map[string]any {
+	t.Helper()
+
+	req, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestRequestOptions(t *testing.T) {
+	messages := []Message{{Role: "user", Content: "hi"}}
+	tools := Tools{{Type: "function", Function: ToolFunction{Name: "get_weather"}}}
+
+	cases := []struct {
+		name   string
+		build  func() (any, error)
+		expect map[string]any
+	}{
+		{
+			name: "generate",
+			build: func() (any, error) {
+				return NewGenerateRequest("llama3", "why is the sky blue?",
+					WithSystem("be brief"),
+					WithTemplate("{{ .Prompt }}"),
+					WithSuffix("."),
+					WithRaw(),
+					WithContext([]int{1, 2}),
+					WithImages(ImageData("a"), ImageData("b")),
+					WithFormat("json"),
+					WithStream(false),
+					WithKeepAlive(10*time.Minute),
+					WithFlushInterval(50*time.Millisecond),
+					WithChoices(2),
+					WithReturnOptions(),
+					WithReasoning(ReasoningSeparate),
+				)
+			},
+			expect: map[string]any{
+				"model":          "llama3",
+				"prompt":         "why is the sky blue?",
+				"system":         "be brief",
+				"template":       "{{ .Prompt }}",
+				"suffix":         ".",
+				"raw":            true,
+				"context":        []any{1.0, 2.0},
+				"images":         []any{"YQ==", "Yg=="},
+				"format":         "json",
+				"stream":         false,
+				"keep_alive":     "10m0s",
+				"flush_interval": "50ms",
+				"n":              2.0,
+				"return_options": true,
+				"reasoning":      "separate",
+				"options":        nil,
+			},
+		},
+		{
+			name: "chat",
+			build: func() (any, error) {
+				return NewChatRequest("llama3", messages,
+					WithTools(tools),
+					WithOptions(map[string]any{"temperature": 0.5, "num_ctx": 4096}),
+					WithOption("temperature", 0),
+					WithKeepAlive(-1),
+				)
+			},
+			expect: map[string]any{
+				"model":      "llama3",
+				"messages":   []any{map[string]any{"role": "user", "content": "hi"}},
+				"tools":      []any{map[string]any{"type": "function", "function": map[string]any{"name": "get_weather", "description": "", "parameters": map[string]any{"type": "", "required": nil, "properties": nil}}}},
+				"options":    map[string]any{"temperature": 0.0, "num_ctx": 4096.0},
+				"keep_alive": -1.0,
+				"format":     "",
+			},
+		},
+		{
+			name: "embed",
+			build: func() (any, error) {
+				return NewEmbedRequest("all-minilm", []string{"a", "b"},
+					WithTruncate(TruncateStart),
+					WithDimensions(256),
+					WithNormalize(false),
+					WithKeepAlive(0),
+				)
+			},
+			expect: map[string]any{
+				"model":         "all-minilm",
+				"input":         []any{"a", "b"},
+				"truncate_mode": "start",
+				"dimensions":    256.0,
+				"normalize":     false,
+				"keep_alive":    "0s",
+				"options":       nil,
+			},
+		},
+		{
+			name: "pull",
+			build: func() (any, error) {
+				return NewPullRequest("llama3", WithInsecure(), WithVariants("q4_K_M"), WithStream(false))
+			},
+			expect: map[string]any{
+				"model":    "llama3",
+				"insecure": true,
+				"variants": []any{"q4_K_M"},
+				"stream":   false,
+				"username": "",
+				"password": "",
+				"name":     "",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.expect, requestJSON(t, tt.build)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRequestOptionsUnsupported(t *testing.T) {
+	if _, err := NewChatRequest("llama3", nil, WithSystem("be brief")); err == nil {
+		t.Error("expected an error for a generate option in a chat request")
+	}
+
+	if _, err := NewEmbedRequest("all-minilm", "a", WithFormat("json")); err == nil {
+		t.Error("expected an error for a generate option in an embed request")
+	}
+
+	if _, err := NewPullRequest("llama3", WithKeepAlive(time.Minute)); err == nil {
+		t.Error("expected an error for a keep alive in a pull request")
+	}
+}
+
+func TestClientChatWith(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		if req.Model != "llama3" || len(req.Messages) != 1 || req.KeepAlive == nil || req.KeepAlive.Duration != 10*time.Minute {
+			t.Errorf("unexpected request %+v", req)
+		}
+
+		json.NewEncoder(w).Encode(ChatResponse{Model: req.Model, Message: Message{Role: "assistant", Content: "hello"}, Done: true}) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var content string
+	if err := NewClient(u, http.DefaultClient).ChatWith(context.Background(), "llama3", []Message{{Role: "user", Content: "hi"}}, func(resp ChatResponse) error {
+		content += resp.Message.Content
+		return nil
+	}, WithKeepAlive(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if content != "hello" {
+		t.Errorf("expected hello, got %q", content)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ollama/ollama/types/model"
 )
 
 // StatusError is an error with and HTTP status code.
@@ -64,8 +66,18 @@ type GenerateRequest struct {
 	Stream *bool `json:"stream,omitempty"`
 
 	// Raw set to true means that no formatting will be applied to the prompt.
+	// Nothing from the model's template is used, including its system
+	// message and the stop sequences of its parameters, and images are
+	// placed where the prompt has [img-N], N being the image's index.
 	Raw bool `json:"raw,omitempty"`
 
+	// AddBOS sets whether a BOS token is added to the start of a raw
+	// prompt. It's added if the model's tokenizer does so when unset.
+	AddBOS *bool `json:"add_bos,omitempty"`
+
+	// AddEOS sets whether an EOS token is added to the end of a raw prompt.
+	AddEOS *bool `json:"add_eos,omitempty"`
+
 	// Format specifies the format to return a response in.
 	Format string `json:"format"`
 
@@ -73,10 +85,50 @@ type GenerateRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// FlushInterval coalesces streamed responses, sending them at most this
+	// often instead of as each token is generated. It overrides
+	// OLLAMA_STREAM_FLUSH_INTERVAL; zero sends every token as it's generated.
+	FlushInterval *Duration `json:"flush_interval,omitempty"`
+
+	// MaxTime stops generation once it has run this long, with the done
+	// reason "time_limit", returning what was generated so far. It's
+	// measured once the model is loaded, and ends generation together with
+	// num_predict and the stop options, whichever is reached first.
+	MaxTime *Duration `json:"max_time,omitempty"`
+
 	// Images is an optional list of base64-encoded images accompanying this
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
 
+	// N is the number of independent responses to generate for the prompt.
+	// Responses are streamed interleaved and identified by Index. Values
+	// greater than one require streaming.
+	N int `json:"n,omitempty"`
+
+	// ReturnOptions includes the options the response was generated with in
+	// the final response, so it can be reproduced. A random seed is replaced
+	// by the seed that was used.
+	ReturnOptions bool `json:"return_options,omitempty"`
+
+	// Reasoning is how the thinking of reasoning models is returned, one of
+	// [ReasoningInclude], the default, [ReasoningSeparate] or
+	// [ReasoningStrip].
+	Reasoning string `json:"reasoning,omitempty"`
+
+	// JSONStrict checks that a response with Format "json" is valid JSON,
+	// and if it isn't either repairs it, with [JSONStrictRepair], or
+	// generates it again, with [JSONStrictRetry]. Responses are only sent
+	// once they've been checked, so streamed responses arrive whole.
+	JSONStrict string `json:"json_strict,omitempty"`
+
+	// JSONRetries is the most times a response is generated again with
+	// [JSONStrictRetry], 2 by default.
+	JSONRetries *int `json:"json_retries,omitempty"`
+
+	// Preset names one of the server's presets, whose options and system
+	// message are used unless the model's parameters or the request set them.
+	Preset string `json:"preset,omitempty"`
+
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
@@ -100,13 +152,86 @@ type ChatRequest struct {
 	// followin the request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// FlushInterval coalesces streamed responses, as in [GenerateRequest].
+	FlushInterval *Duration `json:"flush_interval,omitempty"`
+
+	// MaxTime stops generation once it has run this long, as in
+	// [GenerateRequest].
+	MaxTime *Duration `json:"max_time,omitempty"`
+
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// N is the number of independent responses to generate, as in
+	// [GenerateRequest].
+	N int `json:"n,omitempty"`
+
+	// ReturnOptions includes the options used in the final response, as in
+	// [GenerateRequest].
+	ReturnOptions bool `json:"return_options,omitempty"`
+
+	// Reasoning is how the thinking of reasoning models is returned, as in
+	// [GenerateRequest].
+	Reasoning string `json:"reasoning,omitempty"`
+
+	// Template overrides the model's prompt template.
+	Template string `json:"template,omitempty"`
+
+	// JSONStrict checks that the response is valid JSON, as in
+	// [GenerateRequest].
+	JSONStrict string `json:"json_strict,omitempty"`
+
+	// JSONRetries is the most times a response is generated again, as in
+	// [GenerateRequest].
+	JSONRetries *int `json:"json_retries,omitempty"`
+
+	// Preset names one of the server's presets, as in [GenerateRequest].
+	// Its system message is used unless the messages start with one.
+	Preset string `json:"preset,omitempty"`
+
+	// UseModelSystem set to false leaves out the model's SYSTEM for this
+	// request. System messages in the request and the preset's system
+	// message are still used.
+	UseModelSystem *bool `json:"use_model_system,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
 
+const (
+	// ReasoningInclude returns the thinking of reasoning models in the
+	// response as it's generated, tags and all
+	ReasoningInclude = "include"
+
+	// ReasoningSeparate returns the thinking without its tags in its own
+	// field, Thinking, separate from the response
+	ReasoningSeparate = "separate"
+
+	// ReasoningStrip leaves the thinking out of the response. Its tokens are
+	// still counted in the metrics.
+	ReasoningStrip = "strip"
+)
+
+const (
+	// JSONStrictRepair repairs responses that aren't valid JSON by removing
+	// text after the JSON, and continues a response that was cut off for a
+	// bounded number of tokens until its JSON ends
+	JSONStrictRepair = "repair"
+
+	// JSONStrictRetry generates responses that aren't valid JSON again
+	JSONStrictRetry = "retry"
+)
+
+// JSONStrictResult is how a response generated with JSONStrict was made
+// valid JSON.
+type JSONStrictResult struct {
+	// Repaired is true if the response was repaired
+	Repaired bool `json:"repaired"`
+
+	// Retries is the number of times the response was generated again
+	Retries int `json:"retries"`
+}
+
 type Tools []Tool
 
 func (t Tools) String() string {
@@ -127,6 +252,20 @@ type Message struct {
 	Content   string      `json:"content"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// ToolCallID is the ID of the tool call that a message with the "tool"
+	// role is the result of, and Name is the name of the tool. Name is
+	// filled in from the call when it's left out.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+
+	// Thinking is the thinking of a reasoning model before its response,
+	// with the reasoning mode [ReasoningSeparate]
+	Thinking string `json:"thinking,omitempty"`
+
+	// Interrupted marks an assistant message whose response was cancelled
+	// before it was done. It's kept by clients and isn't sent to the server.
+	Interrupted bool `json:"-"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -142,6 +281,10 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 }
 
 type ToolCall struct {
+	// ID identifies the call, so its result can refer to it with
+	// [Message.ToolCallID]. It's assigned by the server if the model doesn't
+	// generate one.
+	ID       string           `json:"id,omitempty"`
 	Function ToolCallFunction `json:"function"`
 }
 
@@ -181,13 +324,102 @@ func (t *ToolFunction) String() string {
 	return string(bts)
 }
 
+// Reasons a response is done, reported in the done_reason of the final
+// response of [Client.Generate] and [Client.Chat]. Every response with Done
+// set has one. Clients should treat reasons they don't recognize, which
+// newer servers may add, as the response being cut off.
+const (
+	// DoneReasonStop is reported when the model ends its response.
+	DoneReasonStop = "stop"
+
+	// DoneReasonStopString, DoneReasonStopRegex and DoneReasonStopToken are
+	// reported when a match of the stop, stop_regex or stop_token_ids
+	// options ends the response. The match isn't included.
+	DoneReasonStopString = "stop_string"
+	DoneReasonStopRegex  = "stop_regex"
+	DoneReasonStopToken  = "stop_token"
+
+	// DoneReasonLength is reported when the response reaches num_predict
+	// tokens.
+	DoneReasonLength = "length"
+
+	// DoneReasonTimeLimit is reported when the response reaches max_time.
+	DoneReasonTimeLimit = "time_limit"
+
+	// DoneReasonToolCalls is reported when the response is tool calls,
+	// which are returned in the message instead of its content.
+	DoneReasonToolCalls = "tool_calls"
+
+	// DoneReasonAbort is reported when the server stops a response that
+	// isn't making progress, such as a model repeating the same token.
+	DoneReasonAbort = "abort"
+
+	// DoneReasonContextShiftError is reported when the response fills the
+	// context and the model can't free space in it to continue.
+	DoneReasonContextShiftError = "context_shift_error"
+
+	// DoneReasonRunnerCrashed is reported when the process running the model
+	// exits unexpectedly, such as when the system runs out of memory. The
+	// model is loaded again by the next request.
+	DoneReasonRunnerCrashed = "runner_crashed"
+
+	// DoneReasonShutdown is reported when the server unloads the model
+	// while responding because it's shutting down.
+	DoneReasonShutdown = "shutdown"
+
+	// DoneReasonLoad and DoneReasonUnload are reported for requests without
+	// a prompt or messages, which only load or unload the model.
+	DoneReasonLoad   = "load"
+	DoneReasonUnload = "unload"
+)
+
 // ChatResponse is the response returned by [Client.Chat]. Its fields are
 // similar to [GenerateResponse].
 type ChatResponse struct {
-	Model      string    `json:"model"`
-	CreatedAt  time.Time `json:"created_at"`
-	Message    Message   `json:"message"`
-	DoneReason string    `json:"done_reason,omitempty"`
+	Model string `json:"model"`
+
+	// ResolvedModel is the model that served the request, if Model is an
+	// alias, as in [GenerateResponse].
+	ResolvedModel string `json:"resolved_model,omitempty"`
+
+	// GenerationID identifies a streamed response, as in [GenerateResponse].
+	GenerationID string `json:"generation_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	Message   Message   `json:"message"`
+
+	// DoneReason is why the response is done, one of the DoneReason
+	// constants.
+	DoneReason string `json:"done_reason,omitempty"`
+
+	// StopString is the string of the stop option that ended the response,
+	// as in [GenerateResponse].
+	StopString string `json:"stop_string,omitempty"`
+
+	// Index identifies which of the N responses this belongs to.
+	Index int `json:"index,omitempty"`
+
+	// Status reports the progress of loading the model, e.g. "loading model:
+	// 43%", in streamed responses sent before the first token.
+	Status string `json:"status,omitempty"`
+
+	// Options are the options used, if requested with ReturnOptions.
+	Options map[string]any `json:"options,omitempty"`
+
+	// OptionSources are where each of the options came from, as in
+	// [GenerateResponse].
+	OptionSources map[string]string `json:"option_sources,omitempty"`
+
+	// System is the system message the response was generated with, and
+	// SystemSource where it came from: "request", "preset" or "model". They're
+	// only set in the final response of requests with ReturnOptions, and are
+	// empty if there was no system message.
+	System       string `json:"system,omitempty"`
+	SystemSource string `json:"system_source,omitempty"`
+
+	// JSONStrict is how the response was made valid JSON, as in
+	// [GenerateResponse].
+	JSONStrict *JSONStrictResult `json:"json_strict,omitempty"`
 
 	Done bool `json:"done"`
 
@@ -201,6 +433,28 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// Variant is the quantization that served the request, for models with
+	// variants
+	Variant string `json:"variant,omitempty"`
+
+	// PromptCacheHit reports whether the prompt started with a prompt
+	// evaluated for another request, when OLLAMA_PROMPT_CACHE_SIZE is set.
+	// PromptCacheTokens is how many prompt tokens were reused.
+	PromptCacheHit    *bool `json:"prompt_cache_hit,omitempty"`
+	PromptCacheTokens int   `json:"prompt_cache_tokens,omitempty"`
+
+	// NumCtx is the context length of each of the model's parallel
+	// sequences, which is chosen when the model is loaded if num_ctx is 0
+	NumCtx int `json:"num_ctx,omitempty"`
+
+	// ImageTokens is how many of the prompt's tokens each image took, in
+	// the order the images appear in the prompt
+	ImageTokens []int `json:"image_tokens,omitempty"`
+
+	// PlacementWarning is set when a request's gpus option was ignored
+	// because the model was already loaded on other GPUs
+	PlacementWarning string `json:"placement_warning,omitempty"`
 }
 
 // Options specified in [GenerateRequest], if you add a new option here add it
@@ -227,10 +481,34 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// StopTokenIDs stops generation when one of the token ids is sampled,
+	// without the token's text.
+	StopTokenIDs []int `json:"stop_token_ids,omitempty"`
+
+	// StopRegex stops generation at the first match of one of the RE2
+	// patterns in the generated text, without the matched text. Patterns
+	// must match at most llm.MaxStopRegexLength bytes, and can't use $ or \b
+	// since they depend on text that hasn't been generated yet.
+	StopRegex []string `json:"stop_regex,omitempty"`
+
+	// DownscaleImages controls whether images larger than the vision model's
+	// native resolution are downscaled to it before they're encoded.
+	// Defaults to true.
+	DownscaleImages *bool `json:"downscale_images,omitempty"`
+
+	// NoRefresh serves the request without extending how long the model
+	// stays loaded, so periodic requests such as health checks don't keep
+	// it loaded. A model the request loads still stays loaded for its
+	// keep alive.
+	NoRefresh bool `json:"no_refresh,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
 type Runner struct {
+	// NumCtx is the context length. Zero, or "auto" in requests and
+	// Modelfiles, uses the context length the model was trained with, up to
+	// OLLAMA_MAX_CONTEXT and what fits in memory.
 	NumCtx    int   `json:"num_ctx,omitempty"`
 	NumBatch  int   `json:"num_batch,omitempty"`
 	NumGPU    int   `json:"num_gpu,omitempty"`
@@ -242,8 +520,62 @@ type Runner struct {
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	UseMLock  bool  `json:"use_mlock,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// PoolingType overrides how embedding models pool token embeddings. It
+	// must be one of [PoolingTypes]; empty uses the model's metadata.
+	PoolingType string `json:"pooling_type,omitempty"`
+
+	// Replicas is the number of independent runners the model may be loaded
+	// as, each on its own GPUs. Zero uses OLLAMA_MODEL_REPLICAS.
+	Replicas int `json:"replicas,omitempty"`
+
+	// Quantization forces the variant of a model with variants to load, such
+	// as "q4_K_M". Empty selects the largest that fits in free memory.
+	Quantization string `json:"quantization,omitempty"`
+
+	// GPUs constrains where the model is loaded to these GPUs, each given by
+	// its ID or its index among the GPUs the server discovered. A model
+	// that's already loaded elsewhere serves the request anyway, with a
+	// warning, unless ForcePlacement is set, which reloads it.
+	GPUs           []string `json:"gpus,omitempty"`
+	ForcePlacement bool     `json:"force_placement,omitempty"`
+
+	// SlidingWindow limits the context a model with sliding-window attention
+	// keeps in memory to this many tokens after its attention sinks, older
+	// tokens being shifted out. It can't be smaller than the model's own
+	// window. Zero keeps the whole context. Experimental.
+	SlidingWindow int `json:"sliding_window,omitempty"`
+
+	// AttentionSinks is the number of tokens at the start of the context
+	// that are always kept when it's truncated or shifted. Experimental.
+	AttentionSinks int `json:"attention_sinks,omitempty"`
+
+	// RopeFrequencyBase and RopeFrequencyScale override the model's RoPE
+	// base frequency and scale, the context being extended by a factor of
+	// 1/RopeFrequencyScale. Zero uses the model's metadata.
+	RopeFrequencyBase  float32 `json:"rope_frequency_base,omitempty"`
+	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
+
+	// RopeScaling overrides the model's RoPE scaling method. It must be one
+	// of [RopeScalingTypes]; empty uses the model's metadata.
+	RopeScaling string `json:"rope_scaling,omitempty"`
+
+	// YaRN settings, which require RopeScaling "yarn" or a model that uses
+	// it. Zero uses the model's metadata or the runner's defaults.
+	YarnOrigCtx    int     `json:"yarn_orig_ctx,omitempty"`
+	YarnExtFactor  float32 `json:"yarn_ext_factor,omitempty"`
+	YarnAttnFactor float32 `json:"yarn_attn_factor,omitempty"`
+	YarnBetaFast   float32 `json:"yarn_beta_fast,omitempty"`
+	YarnBetaSlow   float32 `json:"yarn_beta_slow,omitempty"`
 }
 
+// RopeScalingTypes are the valid values of the rope_scaling option
+var RopeScalingTypes = []string{"none", "linear", "yarn"}
+
+// PoolingTypes are the valid values of the pooling_type option, in the order
+// of the pooling_type values stored in GGUF metadata.
+var PoolingTypes = []string{"none", "mean", "cls", "last"}
+
 // EmbedRequest is the request passed to [Client.Embed].
 type EmbedRequest struct {
 	// Model is the model name.
@@ -256,8 +588,33 @@ type EmbedRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Truncate truncates the end of each input to fit within context length.
+	// Returns error if false and context length is exceeded. Defaults to true.
 	Truncate *bool `json:"truncate,omitempty"`
 
+	// TruncateMode controls how inputs longer than the context length are
+	// handled, overriding Truncate when set.
+	TruncateMode Truncate `json:"truncate_mode,omitempty"`
+
+	// Dimensions shortens the embeddings to the given number of dimensions, for
+	// models trained to support it such as those using Matryoshka representation
+	// learning. Zero returns the model's full embedding size.
+	Dimensions int `json:"dimensions,omitempty"`
+
+	// Normalize controls whether embeddings shortened by Dimensions are
+	// rescaled to unit length. Defaults to true.
+	Normalize *bool `json:"normalize,omitempty"`
+
+	// EncodingFormat selects how embeddings are returned: "float" (default)
+	// returns them in Embeddings, while "base64" and "int8" return them packed
+	// in EncodedEmbeddings.
+	EncodingFormat string `json:"encoding_format,omitempty"`
+
+	// Concurrency limits how many inputs are embedded at once. The limit is
+	// capped by the number of parallel requests the loaded model supports,
+	// which is also the default.
+	Concurrency int `json:"concurrency,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -267,11 +624,153 @@ type EmbedResponse struct {
 	Model      string      `json:"model"`
 	Embeddings [][]float32 `json:"embeddings"`
 
+	// ResolvedModel is the model that embedded the input, if Model is an
+	// alias, as in [GenerateResponse].
+	ResolvedModel string `json:"resolved_model,omitempty"`
+
+	// EncodedEmbeddings holds the embeddings, in input order, when the request
+	// used the "base64" or "int8" encoding format.
+	EncodedEmbeddings []EncodedEmbedding `json:"encoded_embeddings,omitempty"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+
+	// PromptEvalCounts is the number of tokens embedded for each input, in
+	// input order, after any truncation.
+	PromptEvalCounts []int `json:"prompt_eval_counts,omitempty"`
+
+	// Truncated reports, in input order, whether each input was truncated to
+	// fit the context length.
+	Truncated []bool `json:"truncated,omitempty"`
+
+	// Errors is set when embedding some, but not all, of the inputs failed.
+	// It holds the error message for each input in input order, empty for
+	// inputs that succeeded. Failed inputs have an empty embedding.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Truncate is the truncation mode for inputs longer than the context length.
+type Truncate string
+
+const (
+	// TruncateEnd drops tokens from the end of the input.
+	TruncateEnd Truncate = "end"
+
+	// TruncateStart drops tokens from the start of the input.
+	TruncateStart Truncate = "start"
+
+	// TruncateNone returns an error instead of truncating.
+	TruncateNone Truncate = "none"
+)
+
+// UnmarshalJSON accepts one of the truncation modes.
+func (t *Truncate) UnmarshalJSON(b []byte) error {
+	var v *string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("invalid truncate_mode: %w", err)
+	}
+
+	if v == nil {
+		*t = ""
+		return nil
+	}
+
+	switch Truncate(*v) {
+	case "", TruncateEnd, TruncateStart, TruncateNone:
+		*t = Truncate(*v)
+	default:
+		return fmt.Errorf("invalid truncate_mode '%s', expected one of end, start or none", *v)
+	}
+
+	return nil
+}
+
+// TruncateModeOrDefault returns the truncation mode of the request:
+// TruncateMode if it's set, otherwise [TruncateNone] if Truncate is false
+// and [TruncateEnd] if not.
+func (r *EmbedRequest) TruncateModeOrDefault() Truncate {
+	switch {
+	case r.TruncateMode != "":
+		return r.TruncateMode
+	case r.Truncate != nil && !*r.Truncate:
+		return TruncateNone
+	default:
+		return TruncateEnd
+	}
+}
+
+// EncodedEmbedding is a single embedding packed into bytes.
+//
+// For the "base64" encoding format, Data is the base64 encoding of the
+// embedding's float32 values, each 4 bytes little-endian, in order.
+//
+// For the "int8" encoding format, Data is the base64 encoding of one signed
+// byte q per dimension, in order. Each value is recovered as
+// Offset + Scale*float32(q).
+type EncodedEmbedding struct {
+	Data   string  `json:"data"`
+	Scale  float32 `json:"scale,omitempty"`
+	Offset float32 `json:"offset,omitempty"`
+}
+
+// ScoreRequest is the request passed to [Client.Score].
+type ScoreRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is the text the continuations follow. It's scored as given,
+	// without the model's template.
+	Prompt string `json:"prompt"`
+
+	// Continuations are the candidate texts to score after Prompt.
+	Continuations []string `json:"continuations"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// ScoreResponse is the response from [Client.Score].
+type ScoreResponse struct {
+	Model string `json:"model"`
+
+	// ResolvedModel is the model that scored the continuations, if Model is
+	// an alias, as in [GenerateResponse].
+	ResolvedModel string `json:"resolved_model,omitempty"`
+
+	// Scores holds the score of each continuation, in request order.
+	Scores []ContinuationScore `json:"scores"`
+
 	TotalDuration   time.Duration `json:"total_duration,omitempty"`
 	LoadDuration    time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
 }
 
+// ContinuationScore is the likelihood of a continuation following a prompt.
+type ContinuationScore struct {
+	// Logprob is the total log-probability of the continuation, the sum of
+	// the log-probabilities of its tokens.
+	Logprob float64 `json:"logprob"`
+
+	// Tokens holds the log-probability of each token of the continuation,
+	// given the prompt and the tokens before it.
+	Tokens []TokenLogprob `json:"tokens,omitempty"`
+
+	// Error is set when the continuation couldn't be scored, such as when it
+	// doesn't fit in the context length, in which case Logprob is zero.
+	Error string `json:"error,omitempty"`
+}
+
+// TokenLogprob is the log-probability of a single token.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
 // EmbeddingRequest is the request passed to [Client.Embeddings].
 type EmbeddingRequest struct {
 	// Model is the model name.
@@ -298,7 +797,14 @@ type CreateRequest struct {
 	Model     string `json:"model"`
 	Modelfile string `json:"modelfile"`
 	Stream    *bool  `json:"stream,omitempty"`
-	Quantize  string `json:"quantize,omitempty"`
+
+	// Quantize is the quantization level to create the model at, or a
+	// comma-separated list of them to create a model tagged with each
+	Quantize string `json:"quantize,omitempty"`
+
+	// StrictTemplate fails creating the model if its template uses special
+	// tokens that aren't in the model's vocabulary, rather than warning
+	StrictTemplate bool `json:"strict_template,omitempty"`
 
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
@@ -310,14 +816,46 @@ type CreateRequest struct {
 	Quantization string `json:"quantization,omitempty"`
 }
 
+// ImatrixRequest is the request passed to [Client.Imatrix].
+type ImatrixRequest struct {
+	// Model is an unquantized model to compute the importance matrix of
+	Model string `json:"model"`
+
+	// Data is the calibration text the model is run over
+	Data string `json:"data"`
+
+	// Chunks limits the number of 512 token chunks of Data that are used, if
+	// it's positive
+	Chunks int   `json:"chunks,omitempty"`
+	Stream *bool `json:"stream,omitempty"`
+}
+
 // DeleteRequest is the request passed to [Client.Delete].
 type DeleteRequest struct {
 	Model string `json:"model"`
 
+	// Models are more models to delete along with Model
+	Models []string `json:"models,omitempty"`
+
+	// Force deletes models that are loaded, unloading them first. Otherwise
+	// deleting a loaded model fails.
+	Force bool `json:"force,omitempty"`
+
+	// DryRun reports the disk space that would be reclaimed without
+	// deleting anything
+	DryRun bool `json:"dry_run,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
 
+// DeleteResponse is the response from [Client.DeleteModels].
+type DeleteResponse struct {
+	// Reclaimed is the size of the blobs that no remaining model uses,
+	// which is zero for a model whose blobs are all shared with others
+	Reclaimed int64 `json:"reclaimed"`
+}
+
 // ShowRequest is the request passed to [Client.Show].
 type ShowRequest struct {
 	Model  string `json:"model"`
@@ -327,6 +865,10 @@ type ShowRequest struct {
 	Template string `json:"template"`
 	Verbose  bool   `json:"verbose"`
 
+	// Layers includes the model's manifest, with the blob of each layer, in
+	// the response
+	Layers bool `json:"layers,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 
 	// Deprecated: set the model name with Model instead
@@ -344,7 +886,125 @@ type ShowResponse struct {
 	Messages      []Message      `json:"messages,omitempty"`
 	ModelInfo     map[string]any `json:"model_info,omitempty"`
 	ProjectorInfo map[string]any `json:"projector_info,omitempty"`
+	Pooling       *Pooling       `json:"pooling,omitempty"`
+	LongContext   *LongContext   `json:"long_context,omitempty"`
+	Loaded        *LoadSettings  `json:"loaded,omitempty"`
+	Signature     *SignatureInfo `json:"signature,omitempty"`
 	ModifiedAt    time.Time      `json:"modified_at,omitempty"`
+
+	// Capabilities lists what the model can be used for, such as calling
+	// tools or describing images
+	Capabilities []model.Capability `json:"capabilities,omitempty"`
+
+	// Unsupported is set if the model needs a newer version of Ollama to
+	// run. ModelInfo is empty if its GGUF version is too new to read.
+	Unsupported *UnsupportedModelError `json:"unsupported,omitempty"`
+
+	// Warnings describe problems with the model that don't stop it from
+	// running, such as a template that uses special tokens that aren't in
+	// the model's vocabulary
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Manifest describes the files the model is stored as, if the request
+	// set Layers
+	Manifest *ManifestInfo `json:"manifest,omitempty"`
+}
+
+// ManifestInfo describes a model's manifest in [ShowResponse].
+type ManifestInfo struct {
+	// Digest is the digest of the manifest
+	Digest string `json:"digest"`
+
+	// ConfigDigest is the digest of the model's config, which is also
+	// listed in Layers
+	ConfigDigest string `json:"config_digest"`
+
+	// Size is the total size of the layers, including the config
+	Size int64 `json:"size"`
+
+	// Path is where the manifest is stored. Paths are only included for
+	// requests from the server's machine, or made with an admin API key.
+	Path string `json:"path,omitempty"`
+
+	Layers []LayerInfo `json:"layers"`
+}
+
+// LayerInfo describes a layer of a model's manifest in [ManifestInfo].
+type LayerInfo struct {
+	MediaType string `json:"media_type"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+
+	// Variant is the quantization the layer belongs to, for models with
+	// variants
+	Variant string `json:"variant,omitempty"`
+
+	// Path is where the layer's blob is stored, if the manifest's Path is
+	// included
+	Path string `json:"path,omitempty"`
+
+	// Missing is true if the blob isn't stored, such as for variants that
+	// haven't been pulled
+	Missing bool `json:"missing,omitempty"`
+}
+
+// SignatureInfo describes the signature of a model in [ShowResponse].
+type SignatureInfo struct {
+	// Signer names the key that signed the model, from its comment in
+	// OLLAMA_TRUSTED_SIGNERS or otherwise the key's fingerprint.
+	Signer string `json:"signer,omitempty"`
+
+	// Status is "verified" if the model is signed by a trusted signer,
+	// "untrusted" if the signature is valid but the key isn't trusted, and
+	// "invalid" if the signature doesn't match the model, such as when it's
+	// been modified since it was signed.
+	Status string `json:"status"`
+}
+
+// LoadSettings describes how a running model was loaded, after applying the
+// environment defaults and the server's automatic choices.
+type LoadSettings struct {
+	// UseMMap is true if the model's weights are memory mapped.
+	UseMMap bool `json:"use_mmap"`
+
+	// UseMLock is true if the model's memory is locked to keep it from being
+	// swapped out.
+	UseMLock bool `json:"use_mlock"`
+}
+
+// Pooling describes how an embedding model pools token embeddings.
+type Pooling struct {
+	// Metadata is the pooling type stored in the model file.
+	Metadata string `json:"metadata,omitempty"`
+
+	// Override is the pooling_type parameter, if set.
+	Override string `json:"override,omitempty"`
+
+	// Effective is the pooling type used when the model is loaded.
+	Effective string `json:"effective"`
+}
+
+// LongContext describes the sliding window, attention sink and RoPE settings
+// of a model, each option overriding its metadata. Zero values are left to
+// the runner's defaults.
+type LongContext struct {
+	// Window is the model's sliding attention window, from its metadata.
+	Window int `json:"window,omitempty"`
+
+	SlidingWindow      int     `json:"sliding_window,omitempty"`
+	AttentionSinks     int     `json:"attention_sinks,omitempty"`
+	RopeFrequencyBase  float32 `json:"rope_frequency_base,omitempty"`
+	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
+	RopeScaling        string  `json:"rope_scaling,omitempty"`
+	YarnOrigCtx        int     `json:"yarn_orig_ctx,omitempty"`
+	YarnExtFactor      float32 `json:"yarn_ext_factor,omitempty"`
+	YarnAttnFactor     float32 `json:"yarn_attn_factor,omitempty"`
+	YarnBetaFast       float32 `json:"yarn_beta_fast,omitempty"`
+	YarnBetaSlow       float32 `json:"yarn_beta_slow,omitempty"`
+
+	// Loaded is true if these are the settings of the running model, rather
+	// than those it would be loaded with.
+	Loaded bool `json:"loaded,omitempty"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
@@ -361,19 +1021,101 @@ type PullRequest struct {
 	Password string `json:"password"`
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// Variants are the quantizations to pull of a model with variants, such
+	// as "q4_K_M". Empty pulls every variant.
+	Variants []string `json:"variants,omitempty"`
+
+	// Strict refuses to pull a model whose architecture this version of
+	// Ollama can't run, returning an [UnsupportedModelError] before anything
+	// is downloaded. Otherwise the model is pulled after a warning status.
+	Strict bool `json:"strict,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
 
 // ProgressResponse is the response passed to progress functions like
 // [PullProgressFunc] and [PushProgressFunc].
+//
+// Status is meant to be read by people and may change between versions.
+// Clients that follow the progress of a pull, push or create should use
+// Phase and the byte counts instead, which keep their meaning for as long
+// as Schema is [ProgressSchema].
 type ProgressResponse struct {
 	Status    string `json:"status"`
 	Digest    string `json:"digest,omitempty"`
 	Total     int64  `json:"total,omitempty"`
 	Completed int64  `json:"completed,omitempty"`
+
+	// Schema is the version of the structured fields of the response, or 0
+	// from servers that don't report them
+	Schema int `json:"schema,omitempty"`
+
+	// Phase is the step of the operation the response reports, one of the
+	// Phase constants
+	Phase string `json:"phase,omitempty"`
+
+	// OverallTotal and OverallCompleted are the bytes of all the layers a
+	// pull or push transfers and how many of them are transferred, once
+	// they're known
+	OverallTotal     int64 `json:"overall_total,omitempty"`
+	OverallCompleted int64 `json:"overall_completed,omitempty"`
+
+	// Source is where a layer being downloaded comes from, one of the
+	// Source constants. It's empty for layers that were already pulled.
+	Source string `json:"source,omitempty"`
 }
 
+// ProgressSchema is the version of the structured fields of
+// [ProgressResponse] reported by this version of the server. It's increased
+// whenever their meaning changes in a way existing clients would misread.
+const ProgressSchema = 1
+
+// Phases of a pull, push or create, reported in the phase of each
+// [ProgressResponse]. They're reported in this order, though steps that
+// don't apply are skipped, and a create that pulls its base model downloads
+// before it writes. Clients should treat phases they don't recognize as
+// steps of the operation that's still running.
+const (
+	// PhaseResolving is finding what the operation needs, such as the
+	// manifest of the model being pulled or pushed.
+	PhaseResolving = "resolving"
+
+	// PhaseDownloading is pulling layers. Responses with a digest report
+	// the bytes of that layer downloaded.
+	PhaseDownloading = "downloading"
+
+	// PhaseUploading is pushing layers. Responses with a digest report the
+	// bytes of that layer uploaded.
+	PhaseUploading = "uploading"
+
+	// PhaseVerifying is checking the digests of the layers pulled.
+	PhaseVerifying = "verifying"
+
+	// PhaseWriting is creating layers, such as when quantizing, and writing
+	// the manifest.
+	PhaseWriting = "writing"
+
+	// PhaseSuccess is reported by the last response of an operation that
+	// succeeded.
+	PhaseSuccess = "success"
+
+	// PhaseError is reported by the error response of an operation that
+	// failed, which ends it.
+	PhaseError = "error"
+)
+
+// Sources of the layers downloaded by a pull, reported in the source of
+// each [ProgressResponse] in [PhaseDownloading].
+const (
+	// SourceRegistry is the registry the model is pulled from.
+	SourceRegistry = "registry"
+
+	// SourcePeer is another server on the LAN that has the layer, found
+	// when OLLAMA_P2P is set.
+	SourcePeer = "peer"
+)
+
 // PushRequest is the request passed to [Client.Push].
 type PushRequest struct {
 	Model    string `json:"model"`
@@ -382,6 +1124,18 @@ type PushRequest struct {
 	Password string `json:"password"`
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// Sign signs the model's manifest with the server's key, so pulls can
+	// verify it came from a trusted signer.
+	Sign bool `json:"sign,omitempty"`
+
+	// Destination is the name to push the model as, if it's different from
+	// Model. No local model is created with this name.
+	Destination string `json:"destination,omitempty"`
+
+	// DryRun reports the layers that would be uploaded, as progress
+	// responses with their digests and sizes, without pushing anything.
+	DryRun bool `json:"dry_run,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
@@ -404,6 +1158,18 @@ type ListModelResponse struct {
 	Size       int64        `json:"size"`
 	Digest     string       `json:"digest"`
 	Details    ModelDetails `json:"details,omitempty"`
+
+	// Capabilities lists what the model can be used for, as in
+	// [ShowResponse]. It's empty for broken models.
+	Capabilities []model.Capability `json:"capabilities,omitempty"`
+
+	// Broken is set when blobs the model references are missing or
+	// incomplete, such as after an interrupted pull or create.
+	Broken bool `json:"broken,omitempty"`
+
+	// Unsupported is set if this version of Ollama can't run the model's
+	// architecture, as in [ShowResponse].
+	Unsupported *UnsupportedModelError `json:"unsupported,omitempty"`
 }
 
 // ProcessModelResponse is a single model description in [ProcessResponse].
@@ -415,6 +1181,438 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+	Runner    string       `json:"runner,omitempty"`
+
+	// Variant is the quantization loaded, for models with variants
+	Variant string `json:"variant,omitempty"`
+
+	// Location is "local" for models running on this server, or "remote"
+	// for models running on the remote server at Host.
+	Location string `json:"location"`
+	Host     string `json:"host,omitempty"`
+
+	// Replica distinguishes runners when a model is loaded more than once,
+	// GPUs are the IDs of the GPUs it was placed on and InFlight is the
+	// number of requests it's serving.
+	Replica  int      `json:"replica,omitempty"`
+	GPUs     []string `json:"gpus,omitempty"`
+	InFlight int      `json:"in_flight"`
+
+	// GPUConstraint is the gpus option the model was loaded with, the GPUs
+	// it was restricted to
+	GPUConstraint []string `json:"gpu_constraint,omitempty"`
+
+	// NumCtx is the context length of each of the model's parallel
+	// sequences
+	NumCtx int `json:"num_ctx,omitempty"`
+
+	// State is "active" while the model holds its KV cache, "cache-released"
+	// once the cache of an idle model has been freed with only the weights
+	// still loaded, and "unloading" once its keep alive has expired.
+	State string `json:"state"`
+
+	// RefreshedBy is the route of the last request that loaded the model or
+	// extended how long it stays loaded, such as "/api/embed". Requests with
+	// the no_refresh option don't change it.
+	RefreshedBy string `json:"refreshed_by,omitempty"`
+
+	// Slots is the state of the runner's parallel slots, listed by
+	// [Client.ListRunningVerbose] for runners that report them
+	Slots []SlotStatus `json:"slots,omitempty"`
+}
+
+// SlotStatus is the state of one of a runner's parallel slots, which each
+// serve one request at a time.
+type SlotStatus struct {
+	ID int `json:"id"`
+
+	// State is "idle", "prefill" while the slot evaluates a prompt or
+	// "decode" while it generates.
+	State string `json:"state"`
+
+	// RequestID is the ID of the request the slot is processing, returned
+	// to clients in the X-Request-ID header.
+	RequestID string `json:"request_id,omitempty"`
+
+	// TokensProcessed is how many tokens of the current request the slot
+	// has evaluated or generated, and CacheTokens how many tokens its KV
+	// cache retains for later requests with the same prefix.
+	TokensProcessed int `json:"tokens_processed"`
+	CacheTokens     int `json:"cache_tokens"`
+}
+
+// RemoteRequest is the request passed to [Client.AddRemote] and
+// [Client.DeleteRemote].
+type RemoteRequest struct {
+	// Host is the remote Ollama server, in the same form as OLLAMA_HOST.
+	Host string `json:"host"`
+}
+
+// UsageResponse is the response from [Client.Usage].
+type UsageResponse struct {
+	// Since is when the counters started, when the server started or they
+	// were last reset
+	Since  time.Time    `json:"since"`
+	Models []ModelUsage `json:"models"`
+}
+
+// ModelUsage is the cumulative usage of a model by generate and chat
+// requests in [UsageResponse].
+type ModelUsage struct {
+	Model string `json:"model"`
+
+	// Key is the name of the API key the requests were made with, if usage
+	// is grouped by key
+	Key string `json:"key,omitempty"`
+
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+
+	// Aborted is the number of requests whose client went away or that were
+	// cancelled before they finished. They aren't counted as errors.
+	Aborted uint64 `json:"aborted"`
+
+	PromptEvalCount    uint64        `json:"prompt_eval_count"`
+	EvalCount          uint64        `json:"eval_count"`
+	TotalDuration      time.Duration `json:"total_duration"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
+	EvalDuration       time.Duration `json:"eval_duration"`
+}
+
+// CreateSessionRequest is the request passed to [Client.CreateSession].
+type CreateSessionRequest struct {
+	// Model is the model the session chats with. An alias is resolved when
+	// the session is created.
+	Model string `json:"model"`
+
+	// Messages start the session's history, such as with a system message
+	Messages []Message `json:"messages,omitempty"`
+
+	// Options and KeepAlive are used for each of the session's messages, as
+	// in [ChatRequest]
+	Options   map[string]any `json:"options,omitempty"`
+	KeepAlive *Duration      `json:"keep_alive,omitempty"`
+}
+
+// SessionChatRequest is the request passed to [Client.SessionChat]. It's
+// appended to the session's history as a user message.
+type SessionChatRequest struct {
+	Content string      `json:"content"`
+	Images  []ImageData `json:"images,omitempty"`
+
+	// Stream enables streaming of the reply, as in [ChatRequest]
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// SessionResponse is a chat session kept by the server, returned by
+// [Client.CreateSession] and [Client.Session].
+type SessionResponse struct {
+	ID      string         `json:"id"`
+	Model   string         `json:"model"`
+	Options map[string]any `json:"options,omitempty"`
+
+	// Messages are the session's history. They're left out when the session
+	// is created.
+	Messages []Message `json:"messages,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// ExpiresAt is when the session is removed unless it's used again
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ListRemotesResponse is the response from [Client.ListRemotes].
+type ListRemotesResponse struct {
+	Remotes []RemoteResponse `json:"remotes"`
+}
+
+// RemoteResponse is a single remote server in [ListRemotesResponse].
+type RemoteResponse struct {
+	Host string `json:"host"`
+}
+
+// VersionResponse is the response from [Client.VersionInfo].
+type VersionResponse struct {
+	Version string `json:"version"`
+
+	// Commit and BuildDate describe the build, if known.
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version,omitempty"`
+
+	Offline bool        `json:"offline"`
+	CPU     *VersionCPU `json:"cpu,omitempty"`
+
+	// Runners are the runner variants the server has, such as "cpu_avx2"
+	// or "cuda_v12", named for the library versions they're built against.
+	// They're only included in verbose responses.
+	Runners []string `json:"runners,omitempty"`
+
+	// Backends are the GPU libraries the server found, with their drivers.
+	// They're only included in verbose responses.
+	Backends []VersionBackend `json:"backends,omitempty"`
+
+	// Architectures are the model architectures the server can run. They're
+	// only included in verbose responses.
+	Architectures []string `json:"architectures,omitempty"`
+}
+
+// VersionCPU is the CPU's capability and the runner used for it.
+type VersionCPU struct {
+	Capability string `json:"capability"`
+	Runner     string `json:"runner"`
+}
+
+// VersionBackend is a GPU library found by the server in [VersionResponse].
+type VersionBackend struct {
+	// Library is the GPU library, such as "cuda" or "rocm", and Variant the
+	// version of its runners that's used, such as "v12".
+	Library string `json:"library"`
+	Variant string `json:"variant,omitempty"`
+
+	// Driver is the version of the driver, or of the runtime for libraries
+	// that don't report one, e.g. "12.4".
+	Driver string `json:"driver,omitempty"`
+
+	// GPUs is the number of GPUs using the library.
+	GPUs int `json:"gpus"`
+}
+
+// ListPresetsResponse is the response from [Client.ListPresets].
+type ListPresetsResponse struct {
+	Presets []Preset `json:"presets"`
+}
+
+// Preset is a named set of model options and a system message that generate
+// and chat requests select with their Preset field.
+type Preset struct {
+	Name    string         `json:"name"`
+	Options map[string]any `json:"options,omitempty"`
+	System  string         `json:"system,omitempty"`
+}
+
+// ListAliasesResponse is the response from [Client.ListAliases].
+type ListAliasesResponse struct {
+	Aliases []Alias `json:"aliases"`
+}
+
+// Alias is a name requests use in place of a model, such as "default",
+// resolving to the first of its Models that can be placed when the request
+// is made. It's the request passed to [Client.SetAlias].
+type Alias struct {
+	Name string `json:"name"`
+
+	// Models are the models or other aliases the alias resolves to, in order
+	// of preference.
+	Models []string `json:"models"`
+
+	// MaxCPU is the largest fraction of a model, from 0 to 1, that may be
+	// placed in system memory rather than on GPUs before the alias falls back
+	// to its next model.
+	MaxCPU float64 `json:"max_cpu,omitempty"`
+}
+
+// DeleteAliasRequest is the request passed to [Client.DeleteAlias].
+type DeleteAliasRequest struct {
+	Name string `json:"name"`
+}
+
+// Manifest lists the blobs a model is made of. It's returned by
+// [Client.Manifest] and passed to [Client.PutManifest].
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ManifestLayer     `json:"config"`
+	Layers        []ManifestLayer   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ListTransfersResponse is the response from [Client.ListTransfers].
+type ListTransfersResponse struct {
+	Transfers []TransferResponse `json:"transfers"`
+}
+
+// TransferResponse is a single pull or push in progress in
+// [ListTransfersResponse].
+type TransferResponse struct {
+	ID string `json:"id"`
+
+	// Type is "pull" or "push".
+	Type      string    `json:"type"`
+	Model     string    `json:"model"`
+	Status    string    `json:"status"`
+	Total     int64     `json:"total"`
+	Completed int64     `json:"completed"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// SearchRequest is the request passed to [Client.Search].
+type SearchRequest struct {
+	Query string `json:"q"`
+
+	// Limit is the maximum number of models to return, or 0 for every match.
+	Limit int `json:"limit,omitempty"`
+
+	// Sort orders the models by "pulls" (the default), "updated" or "name".
+	Sort string `json:"sort,omitempty"`
+}
+
+// SearchResponse is the response from [Client.Search].
+type SearchResponse struct {
+	Models []SearchModelResponse `json:"models"`
+}
+
+// SearchModelResponse is a single model in [SearchResponse].
+type SearchModelResponse struct {
+	Name          string    `json:"name"`
+	Description   string    `json:"description,omitempty"`
+	Pulls         int64     `json:"pulls"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Sizes         []string  `json:"sizes,omitempty"`
+	Quantizations []string  `json:"quantizations,omitempty"`
+}
+
+// ManifestLayer is a single blob in a [Manifest].
+type ManifestLayer struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// AcceptLicenseRequest is the request passed to [Client.AcceptLicense].
+type AcceptLicenseRequest struct {
+	Model string `json:"model"`
+
+	// User is recorded with the acceptance, naming who accepted the license.
+	User string `json:"user,omitempty"`
+
+	// Insecure allows an insecure connection to the registry, when the
+	// model hasn't been pulled yet.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// LicenseError is returned for a model whose license must be accepted before
+// it's pulled or used, with the license to present. Accept it with
+// [Client.AcceptLicense] and retry the request.
+type LicenseError struct {
+	ErrorMessage string `json:"error"`
+	License      string `json:"license"`
+}
+
+func (e LicenseError) Error() string {
+	return e.ErrorMessage
+}
+
+// UnsupportedModelError is returned for a model that needs a newer version
+// of Ollama to run, such as one with an architecture or GGUF version added
+// since this version.
+type UnsupportedModelError struct {
+	ErrorMessage string `json:"error"`
+
+	// Architecture is the model's architecture, if it could be read.
+	Architecture string `json:"architecture,omitempty"`
+
+	// GGUFVersion is the version of the model's GGUF file.
+	GGUFVersion uint32 `json:"gguf_version"`
+
+	// MinVersion is the first version of Ollama known to support the
+	// model, if it's known.
+	MinVersion string `json:"min_version,omitempty"`
+}
+
+func (e UnsupportedModelError) Error() string {
+	return e.ErrorMessage
+}
+
+// DedupeRequest is the request passed to [Client.Dedupe].
+type DedupeRequest struct {
+	// Dirs are other models directories, such as copies of the store, to
+	// search for blobs also in the server's models directory.
+	Dirs []string `json:"dirs,omitempty"`
+
+	// DryRun reports duplicates without linking them.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// DedupeResponse is the response from [Client.Dedupe].
+type DedupeResponse struct {
+	Duplicates []DuplicateBlob `json:"duplicates"`
+
+	// Total is the size of all duplicates found, and Reclaimed the size of
+	// those replaced with hardlinks.
+	Total     int64 `json:"total"`
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// DuplicateBlob is a single duplicate in [DedupeResponse].
+type DuplicateBlob struct {
+	Digest string `json:"digest"`
+	Path   string `json:"path"`
+
+	// Target is the copy of the blob that Path is linked to.
+	Target string `json:"target"`
+	Size   int64  `json:"size"`
+
+	// Linked is false in dry runs, and when the filesystem doesn't support
+	// hardlinks between Path and Target.
+	Linked bool `json:"linked"`
+}
+
+// PruneRequest is the request passed to [Client.Prune].
+type PruneRequest struct {
+	// DryRun reports what would be removed without removing it.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Broken removes broken models, which are otherwise only reported.
+	Broken bool `json:"broken,omitempty"`
+
+	// Verify hashes every blob used by a model to find those that don't
+	// match their digest, rather than only checking they exist.
+	Verify bool `json:"verify,omitempty"`
+}
+
+// PruneResponse is the response from [Client.Prune].
+type PruneResponse struct {
+	Broken []BrokenModel `json:"broken"`
+	Unused []UnusedBlob  `json:"unused"`
+
+	// Reclaimed is the size of the unused blobs.
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// BrokenModel is a model in [PruneResponse] whose manifest references blobs
+// that are missing or don't match their digest.
+type BrokenModel struct {
+	Model   string   `json:"model"`
+	Missing []string `json:"missing"`
+}
+
+// UnusedBlob is a blob in [PruneResponse] that isn't used by any model.
+type UnusedBlob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// RefreshRequest is the request passed to [Client.Refresh].
+type RefreshRequest struct {
+	// Model is the model to refresh. Every model in OLLAMA_AUTO_PULL is
+	// refreshed if it's empty.
+	Model string `json:"model,omitempty"`
+}
+
+// RefreshResponse is the response from [Client.Refresh].
+type RefreshResponse struct {
+	Models []RefreshModelResponse `json:"models"`
+}
+
+// RefreshModelResponse is the result of refreshing a single model in
+// [RefreshResponse].
+type RefreshModelResponse struct {
+	Model string `json:"model"`
+
+	// Status is "up to date", "updated" or "failed".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
 
 type RetrieveModelResponse struct {
@@ -433,22 +1631,68 @@ type GenerateResponse struct {
 	// Model is the model name that generated the response.
 	Model string `json:"model"`
 
+	// ResolvedModel is the model that generated the response if Model is an
+	// alias of the server, such as "default".
+	ResolvedModel string `json:"resolved_model,omitempty"`
+
+	// GenerationID identifies a streamed response so other clients with the
+	// same API key or address can follow it with
+	// GET /api/generation/{id}/stream. It's set in the first response.
+	GenerationID string `json:"generation_id,omitempty"`
+
 	// CreatedAt is the timestamp of the response.
 	CreatedAt time.Time `json:"created_at"`
 
 	// Response is the textual response itself.
 	Response string `json:"response"`
 
+	// Thinking is the thinking of a reasoning model before its response,
+	// with the reasoning mode [ReasoningSeparate].
+	Thinking string `json:"thinking,omitempty"`
+
 	// Done specifies if the response is complete.
 	Done bool `json:"done"`
 
-	// DoneReason is the reason the model stopped generating text.
+	// DoneReason is why the response is done, one of the DoneReason
+	// constants.
 	DoneReason string `json:"done_reason,omitempty"`
 
+	// StopString is the string of the stop option that ended the response,
+	// set when DoneReason is [DoneReasonStopString].
+	StopString string `json:"stop_string,omitempty"`
+
 	// Context is an encoding of the conversation used in this response; this
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Index identifies which of the N responses this belongs to.
+	Index int `json:"index,omitempty"`
+
+	// PromptTokens is the number of tokens the prompt of a raw request was
+	// tokenized to, including the BOS and EOS tokens and those of images,
+	// before it was truncated to fit the context. It's only set in the
+	// final response.
+	PromptTokens int `json:"prompt_tokens,omitempty"`
+
+	// Status reports the progress of loading the model, e.g. "loading model:
+	// 43%", in streamed responses sent before the first token.
+	Status string `json:"status,omitempty"`
+
+	// Options are the options the response was generated with, after merging
+	// the request's options with the model's and the defaults. They're only
+	// set in the final response of requests with ReturnOptions.
+	Options map[string]any `json:"options,omitempty"`
+
+	// OptionSources are where each of the options came from: "request",
+	// "model" for the model's parameters, "preset" for the request's preset,
+	// "server" for the server's defaults set by OLLAMA_DEFAULT_OPTIONS or
+	// "default".
+	OptionSources map[string]string `json:"option_sources,omitempty"`
+
+	// JSONStrict is how the response was made valid JSON. It's only set in
+	// the final response of requests with JSONStrict.
+	JSONStrict *JSONStrictResult `json:"json_strict,omitempty"`
+
 	Metrics
 }
 
@@ -524,6 +1768,11 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 				case float64:
 					// when JSON unmarshals numbers, it uses float64, not int
 					field.SetInt(int64(t))
+				case string:
+					if key != "num_ctx" || t != "auto" {
+						return fmt.Errorf("option %q must be of type integer", key)
+					}
+					field.SetInt(0)
 				default:
 					return fmt.Errorf("option %q must be of type integer", key)
 				}
@@ -552,14 +1801,42 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 				if !ok {
 					return fmt.Errorf("option %q must be of type array", key)
 				}
+
+				if field.Type().Elem().Kind() == reflect.Int {
+					// convert []interface{} to []int
+					slice := make([]int, len(val))
+					for i, item := range val {
+						switch t := item.(type) {
+						case int64:
+							slice[i] = int(t)
+						case float64:
+							if t != math.Trunc(t) {
+								return fmt.Errorf("option %q must be an array of integers", key)
+							}
+							slice[i] = int(t)
+						default:
+							return fmt.Errorf("option %q must be an array of integers", key)
+						}
+					}
+					field.Set(reflect.ValueOf(slice))
+					break
+				}
+
 				// convert []interface{} to []string
 				slice := make([]string, len(val))
 				for i, item := range val {
-					str, ok := item.(string)
-					if !ok {
+					switch t := item.(type) {
+					case string:
+						slice[i] = t
+					case float64:
+						// GPUs are selected by ID or index
+						if key != "gpus" || t != math.Trunc(t) {
+							return fmt.Errorf("option %q must be of an array of strings", key)
+						}
+						slice[i] = strconv.Itoa(int(t))
+					default:
 						return fmt.Errorf("option %q must be of an array of strings", key)
 					}
-					slice[i] = str
 				}
 				field.Set(reflect.ValueOf(slice))
 			case reflect.Pointer:
@@ -582,6 +1859,33 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 	return nil
 }
 
+// Map returns the options keyed by their JSON names, as accepted by
+// [Options.FromMap]. Unlike marshaling the options, zero values are
+// included; unset pointers and slices aren't.
+func (opts *Options) Map() map[string]any {
+	m := make(map[string]any)
+	valueOpts := reflect.ValueOf(opts).Elem()
+	for _, field := range reflect.VisibleFields(valueOpts.Type()) {
+		jsonTag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonTag == "" || jsonTag == "-" {
+			continue
+		}
+
+		v := valueOpts.FieldByIndex(field.Index)
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Slice:
+			if v.IsNil() {
+				continue
+			}
+			v = reflect.Indirect(v)
+		}
+
+		m[jsonTag] = v.Interface()
+	}
+
+	return m
+}
+
 // DefaultOptions is the default set of options for [GenerateRequest]; these
 // values are used unless the user specifies other values explicitly.
 func DefaultOptions() Options {
@@ -693,6 +1997,11 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 
 					out[key] = float32(floatVal)
 				case reflect.Int:
+					if key == "num_ctx" && vals[0] == "auto" {
+						out[key] = int64(0)
+						break
+					}
+
 					intVal, err := strconv.ParseInt(vals[0], 10, 64)
 					if err != nil {
 						return nil, fmt.Errorf("invalid int value %s", vals)
@@ -709,7 +2018,20 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 				case reflect.String:
 					out[key] = vals[0]
 				case reflect.Slice:
-					// TODO: only string slices are supported right now
+					if field.Type().Elem().Kind() == reflect.Int {
+						ints := make([]int64, len(vals))
+						for i, val := range vals {
+							intVal, err := strconv.ParseInt(val, 10, 64)
+							if err != nil {
+								return nil, fmt.Errorf("invalid int value %s", vals)
+							}
+							ints[i] = intVal
+						}
+
+						out[key] = ints
+						break
+					}
+
 					out[key] = vals
 				case reflect.Pointer:
 					var b bool
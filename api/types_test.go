@@ -107,6 +107,41 @@ func TestDurationMarshalUnmarshal(t *testing.T) {
 	}
 }
 
+func TestTruncateParsingFromJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  Truncate
+		err  bool
+	}{
+		{name: "Undefined", req: `{ }`, exp: TruncateEnd},
+		{name: "Null", req: `{ "truncate_mode": null }`, exp: TruncateEnd},
+		{name: "True", req: `{ "truncate": true }`, exp: TruncateEnd},
+		{name: "False", req: `{ "truncate": false }`, exp: TruncateNone},
+		{name: "End", req: `{ "truncate_mode": "end" }`, exp: TruncateEnd},
+		{name: "Start", req: `{ "truncate_mode": "start" }`, exp: TruncateStart},
+		{name: "None", req: `{ "truncate_mode": "none" }`, exp: TruncateNone},
+		{name: "Mode Overrides Boolean", req: `{ "truncate": false, "truncate_mode": "start" }`, exp: TruncateStart},
+		{name: "Invalid", req: `{ "truncate_mode": "middle" }`, err: true},
+		{name: "Invalid Type", req: `{ "truncate_mode": 1 }`, err: true},
+		{name: "Invalid Boolean", req: `{ "truncate": "start" }`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req EmbedRequest
+			err := json.Unmarshal([]byte(test.req), &req)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, req.TruncateModeOrDefault())
+		})
+	}
+}
+
 func TestUseMmapParsingFromJSON(t *testing.T) {
 	tr := true
 	fa := false
@@ -209,6 +244,93 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestNumCtxAuto(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"num_ctx": {"auto"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), params["num_ctx"])
+
+	for _, v := range []any{"auto", float64(0)} {
+		opts := DefaultOptions()
+		require.NoError(t, opts.FromMap(map[string]any{"num_ctx": v}))
+		assert.Equal(t, 0, opts.NumCtx)
+	}
+
+	opts := DefaultOptions()
+	require.Error(t, opts.FromMap(map[string]any{"num_ctx": "large"}))
+	require.Error(t, opts.FromMap(map[string]any{"num_batch": "auto"}))
+
+	_, err = FormatParams(map[string][]string{"num_batch": {"auto"}})
+	require.Error(t, err)
+}
+
+func TestStopTokenIDs(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"stop_token_ids": {"128001", "128009"}})
+	require.NoError(t, err)
+
+	// options from a Modelfile are stored as JSON
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(m))
+	assert.Equal(t, []int{128001, 128009}, opts.StopTokenIDs)
+
+	require.NoError(t, opts.FromMap(map[string]any{"stop_token_ids": []any{float64(2)}}))
+	assert.Equal(t, []int{2}, opts.StopTokenIDs)
+
+	require.Error(t, opts.FromMap(map[string]any{"stop_token_ids": []any{"2"}}))
+	require.Error(t, opts.FromMap(map[string]any{"stop_token_ids": []any{1.5}}))
+
+	_, err = FormatParams(map[string][]string{"stop_token_ids": {"eos"}})
+	require.Error(t, err)
+}
+
+func TestGPUsOption(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"gpus": {"1,2"}, "force_placement": {"true"}})
+	require.NoError(t, err)
+
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(m))
+	assert.Equal(t, []string{"1,2"}, opts.GPUs)
+	assert.True(t, opts.ForcePlacement)
+
+	// GPUs may be given by index or ID in requests
+	require.NoError(t, opts.FromMap(map[string]any{"gpus": []any{float64(0), "GPU-8b1c2d3e"}}))
+	assert.Equal(t, []string{"0", "GPU-8b1c2d3e"}, opts.GPUs)
+
+	require.Error(t, opts.FromMap(map[string]any{"gpus": []any{0.5}}))
+	require.Error(t, opts.FromMap(map[string]any{"stop": []any{float64(1)}}))
+}
+
+func TestOptionsMap(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Temperature = 0
+	opts.Stop = []string{"User:"}
+
+	// options are returned as JSON, where zero values must still be present
+	b, err := json.Marshal(opts.Map())
+	require.NoError(t, err)
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, float64(0), m["temperature"])
+	assert.Equal(t, float64(-1), m["seed"])
+	assert.NotContains(t, m, "use_mmap")
+
+	var roundtrip Options
+	require.NoError(t, roundtrip.FromMap(m))
+	assert.Equal(t, opts, roundtrip)
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/ollama/ollama/auth"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/version"
 )
 
@@ -37,6 +38,10 @@ type UpdateResponse struct {
 
 func IsNewReleaseAvailable(ctx context.Context) (bool, UpdateResponse) {
 	var updateResp UpdateResponse
+	if envconfig.Offline() {
+		slog.Debug("offline mode, not checking for updates")
+		return false, updateResp
+	}
 
 	requestURL, err := url.Parse(UpdateCheckURLBase)
 	if err != nil {
@@ -19,12 +19,12 @@ import (
 const defaultPrivateKey = "id_ed25519"
 
 func keyPath() (string, error) {
-	home, err := os.UserHomeDir()
+	dir, err := ollamaDir()
 	if err != nil {
 		return "", err
 	}
 
-	return filepath.Join(home, ".ollama", defaultPrivateKey), nil
+	return filepath.Join(dir, defaultPrivateKey), nil
 }
 
 func GetPublicKey() (string, error) {
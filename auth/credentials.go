@@ -0,0 +1,369 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// ErrNoCredential is returned for registries without stored credentials
+var ErrNoCredential = errors.New("no stored credentials")
+
+const credentialsFile = "credentials.json"
+
+// Stores credentials can be kept in
+const (
+	StoreKeychain = "keychain"
+	StoreFile     = "file"
+)
+
+// Credential is what a registry is authenticated with: a username and
+// password, or a token if there's no username
+type Credential struct {
+	Username string `json:"username,omitempty"`
+	Secret   string `json:"secret"`
+}
+
+// StoredCredential is a registry with stored credentials and the store
+// they're in, without the credentials themselves
+type StoredCredential struct {
+	Registry string
+	Store    string
+}
+
+// credentialsIndex is the credentials file, which lists every registry with
+// stored credentials and holds those that aren't in the keychain, encrypted
+type credentialsIndex struct {
+	Registries map[string]credentialEntry `json:"registries"`
+}
+
+type credentialEntry struct {
+	Store string `json:"store"`
+
+	// Sealed is the credential encrypted with a key derived from the Ollama
+	// private key, for credentials in the file store
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// keychain is the operating system's store of secrets
+type keychain interface {
+	set(registry string, secret []byte) error
+	get(registry string) ([]byte, error)
+	delete(registry string) error
+}
+
+func ollamaDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ollama"), nil
+}
+
+// registryKey returns the name credentials for registry are stored under,
+// its lower case host
+func registryKey(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry, _, _ = strings.Cut(registry, "/")
+	return strings.ToLower(registry)
+}
+
+func readCredentialsIndex() (*credentialsIndex, error) {
+	dir, err := ollamaDir()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &credentialsIndex{Registries: map[string]credentialEntry{}}
+	b, err := os.ReadFile(filepath.Join(dir, credentialsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, fmt.Errorf("%s: %w", credentialsFile, err)
+	}
+
+	if idx.Registries == nil {
+		idx.Registries = map[string]credentialEntry{}
+	}
+
+	return idx, nil
+}
+
+// write replaces the credentials file, which only its owner can read
+func (idx *credentialsIndex) write() error {
+	dir, err := ollamaDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(0o600); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(dir, credentialsFile))
+}
+
+// credentialsKey derives the key of the file store from the Ollama private
+// key, so the file is only useful with the key beside it
+func credentialsKey() ([]byte, error) {
+	keyPath, err := keyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeyFile, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := ssh.ParseRawPrivateKey(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var seed []byte
+	switch k := privateKey.(type) {
+	case ed25519.PrivateKey:
+		seed = k.Seed()
+	case *ed25519.PrivateKey:
+		seed = k.Seed()
+	default:
+		return nil, fmt.Errorf("%s isn't an ed25519 key", keyPath)
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte("ollama credentials")), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// seal encrypts b, binding it to the registry so entries can't be swapped
+func seal(registry string, b []byte) ([]byte, error) {
+	key, err := credentialsKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, b, []byte(registry)), nil
+}
+
+func unseal(registry string, sealed []byte) ([]byte, error) {
+	key, err := credentialsKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed credentials")
+	}
+
+	b, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(registry))
+	if err != nil {
+		return nil, errors.New("credentials can't be decrypted, was the Ollama key replaced?")
+	}
+
+	return b, nil
+}
+
+// SetCredential stores c for registry, in the keychain unless
+// OLLAMA_CREDENTIALS_STORE says otherwise or there isn't one, and returns the
+// store it's in
+func SetCredential(registry string, c Credential) (string, error) {
+	registry = registryKey(registry)
+	if registry == "" {
+		return "", errors.New("missing registry")
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	idx, err := readCredentialsIndex()
+	if err != nil {
+		return "", err
+	}
+
+	var entry credentialEntry
+	mode := envconfig.CredentialsStore()
+	kc := systemKeychain()
+	switch {
+	case mode == StoreFile:
+	case kc == nil && mode == StoreKeychain:
+		return "", errors.New("there's no keychain to store credentials in")
+	case kc != nil:
+		if err := kc.set(registry, b); err == nil {
+			entry.Store = StoreKeychain
+		} else if mode == StoreKeychain {
+			return "", err
+		} else {
+			slog.Debug("couldn't store credentials in keychain, using file", "error", err)
+		}
+	}
+
+	if entry.Store == "" {
+		sealed, err := seal(registry, b)
+		if err != nil {
+			return "", err
+		}
+
+		entry = credentialEntry{Store: StoreFile, Sealed: sealed}
+	}
+
+	if old, ok := idx.Registries[registry]; ok && old.Store == StoreKeychain && entry.Store != StoreKeychain && kc != nil {
+		if err := kc.delete(registry); err != nil {
+			slog.Debug("couldn't remove credentials from keychain", "error", err)
+		}
+	}
+
+	idx.Registries[registry] = entry
+	return entry.Store, idx.write()
+}
+
+// GetCredential returns the credentials stored for registry, or
+// ErrNoCredential if there aren't any
+func GetCredential(registry string) (*Credential, error) {
+	registry = registryKey(registry)
+	idx, err := readCredentialsIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := idx.Registries[registry]
+	if !ok {
+		return nil, ErrNoCredential
+	}
+
+	var b []byte
+	switch entry.Store {
+	case StoreKeychain:
+		kc := systemKeychain()
+		if kc == nil {
+			return nil, fmt.Errorf("credentials for %s are in a keychain that isn't available", registry)
+		}
+
+		if b, err = kc.get(registry); err != nil {
+			return nil, err
+		}
+	case StoreFile:
+		if b, err = unseal(registry, entry.Sealed); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("credentials for %s are in an unknown store %q", registry, entry.Store)
+	}
+
+	var c Credential
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// DeleteCredential removes the credentials stored for registry, returning
+// ErrNoCredential if there aren't any
+func DeleteCredential(registry string) error {
+	registry = registryKey(registry)
+	idx, err := readCredentialsIndex()
+	if err != nil {
+		return err
+	}
+
+	entry, ok := idx.Registries[registry]
+	if !ok {
+		return ErrNoCredential
+	}
+
+	if entry.Store == StoreKeychain {
+		if kc := systemKeychain(); kc != nil {
+			if err := kc.delete(registry); err != nil {
+				return err
+			}
+		}
+	}
+
+	delete(idx.Registries, registry)
+	return idx.write()
+}
+
+// ListCredentials returns the registries with stored credentials
+func ListCredentials() ([]StoredCredential, error) {
+	idx, err := readCredentialsIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []StoredCredential
+	for registry, entry := range idx.Registries {
+		creds = append(creds, StoredCredential{Registry: registry, Store: entry.Store})
+	}
+
+	slices.SortFunc(creds, func(a, b StoredCredential) int {
+		return strings.Compare(a.Registry, b.Registry)
+	})
+
+	return creds, nil
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func writeTestKey(t *testing.T, home string) {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(home, ".ollama"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(home, ".ollama", defaultPrivateKey), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OLLAMA_CREDENTIALS_STORE", "file")
+	writeTestKey(t, home)
+
+	if _, err := GetCredential("registry.example.com"); !errors.Is(err, ErrNoCredential) {
+		t.Fatalf("expected ErrNoCredential, got %v", err)
+	}
+
+	if store, err := SetCredential("https://Registry.Example.com/", Credential{Username: "user", Secret: "hunter2"}); err != nil {
+		t.Fatal(err)
+	} else if store != StoreFile {
+		t.Errorf("expected the file store, got %q", store)
+	}
+
+	if _, err := SetCredential("hf.co", Credential{Secret: "hf_token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := GetCredential("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if *c != (Credential{Username: "user", Secret: "hunter2"}) {
+		t.Errorf("unexpected credential %+v", c)
+	}
+
+	path := filepath.Join(home, ".ollama", credentialsFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte("hunter2")) || bytes.Contains(b, []byte("hf_token")) {
+		t.Error("expected the credentials file to be encrypted")
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected the credentials file to be private, got %v", fi.Mode())
+	}
+
+	creds, err := ListCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []StoredCredential{{"hf.co", StoreFile}, {"registry.example.com", StoreFile}}
+	if len(creds) != len(expect) || creds[0] != expect[0] || creds[1] != expect[1] {
+		t.Errorf("expected %v, got %v", expect, creds)
+	}
+
+	if err := DeleteCredential("registry.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteCredential("registry.example.com"); !errors.Is(err, ErrNoCredential) {
+		t.Errorf("expected ErrNoCredential, got %v", err)
+	}
+
+	// credentials can't be read with a different key
+	writeTestKey(t, home)
+	if _, err := GetCredential("hf.co"); err == nil {
+		t.Error("expected an error decrypting with another key")
+	}
+}
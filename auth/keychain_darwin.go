@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+const securityPath = "/usr/bin/security"
+
+// securityKeychain stores secrets in the login keychain through security
+type securityKeychain struct{}
+
+func systemKeychain() keychain {
+	return securityKeychain{}
+}
+
+func (securityKeychain) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(securityPath, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return out, nil
+}
+
+func (k securityKeychain) set(registry string, secret []byte) error {
+	// the secret is given to security on its standard input rather than
+	// its arguments, which other users can see. It's base64 encoded so it
+	// needs no quoting.
+	command := fmt.Sprintf("add-generic-password -U -s ollama -a %q -l %q -w %s\n",
+		registry, "Ollama credentials for "+registry, base64.StdEncoding.EncodeToString(secret))
+	if _, err := k.run([]byte(command), "-i"); err != nil {
+		return err
+	}
+
+	// security -i doesn't fail when its commands do
+	if b, err := k.get(registry); err != nil {
+		return err
+	} else if !bytes.Equal(b, secret) {
+		return errors.New("security didn't store the credentials")
+	}
+
+	return nil
+}
+
+func (k securityKeychain) get(registry string) ([]byte, error) {
+	out, err := k.run(nil, "find-generic-password", "-s", "ollama", "-a", registry, "-w")
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(out)))
+}
+
+func (k securityKeychain) delete(registry string) error {
+	_, err := k.run(nil, "delete-generic-password", "-s", "ollama", "-a", registry)
+	return err
+}
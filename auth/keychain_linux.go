@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// secretTool stores secrets with the Secret Service, such as GNOME Keyring
+// or KWallet, through secret-tool
+type secretTool struct {
+	path string
+}
+
+func systemKeychain() keychain {
+	// the Secret Service is on the session bus, which services don't have
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil
+	}
+
+	path, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return nil
+	}
+
+	return secretTool{path: path}
+}
+
+func (s secretTool) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(s.path, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("secret-tool %s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return out, nil
+}
+
+func (s secretTool) set(registry string, secret []byte) error {
+	_, err := s.run(secret, "store", "--label", "Ollama credentials for "+registry, "service", "ollama", "registry", registry)
+	return err
+}
+
+func (s secretTool) get(registry string) ([]byte, error) {
+	out, err := s.run(nil, "lookup", "service", "ollama", "registry", registry)
+	if err != nil {
+		return nil, err
+	} else if len(out) == 0 {
+		return nil, ErrNoCredential
+	}
+
+	return out, nil
+}
+
+func (s secretTool) delete(registry string) error {
+	_, err := s.run(nil, "clear", "service", "ollama", "registry", registry)
+	return err
+}
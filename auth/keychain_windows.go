@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	advapi32    = windows.NewLazySystemDLL("Advapi32.dll")
+	pCredWrite  = advapi32.NewProc("CredWriteW")
+	pCredRead   = advapi32.NewProc("CredReadW")
+	pCredDelete = advapi32.NewProc("CredDeleteW")
+	pCredFree   = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+// credential is CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// credentialManager stores secrets with the Windows Credential Manager
+type credentialManager struct{}
+
+func systemKeychain() keychain {
+	if advapi32.Load() != nil {
+		return nil
+	}
+
+	return credentialManager{}
+}
+
+func credentialTarget(registry string) (*uint16, error) {
+	return windows.UTF16PtrFromString("ollama:" + registry)
+}
+
+func (credentialManager) set(registry string, secret []byte) error {
+	if len(secret) == 0 {
+		return errors.New("empty secret")
+	}
+
+	target, err := credentialTarget(registry)
+	if err != nil {
+		return err
+	}
+
+	user, err := windows.UTF16PtrFromString(registry)
+	if err != nil {
+		return err
+	}
+
+	c := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(secret)),
+		CredentialBlob:     &secret[0],
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+
+	if r, _, err := pCredWrite.Call(uintptr(unsafe.Pointer(&c)), 0); r == 0 {
+		return err
+	}
+
+	return nil
+}
+
+func (credentialManager) get(registry string) ([]byte, error) {
+	target, err := credentialTarget(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *credential
+	if r, _, err := pCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&c))); r == 0 {
+		if errors.Is(err, windows.ERROR_NOT_FOUND) {
+			return nil, ErrNoCredential
+		}
+		return nil, err
+	}
+	defer pCredFree.Call(uintptr(unsafe.Pointer(c))) //nolint:errcheck
+
+	return append([]byte(nil), unsafe.Slice(c.CredentialBlob, c.CredentialBlobSize)...), nil
+}
+
+func (credentialManager) delete(registry string) error {
+	target, err := credentialTarget(registry)
+	if err != nil {
+		return err
+	}
+
+	if r, _, err := pCredDelete.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0); r == 0 && !errors.Is(err, windows.ERROR_NOT_FOUND) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+package cmd
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/progress"
+)
+
+// messageRoles are the roles of the messages in a messages file
+var messageRoles = []string{"system", "user", "assistant", "tool"}
+
+// fileMessage is a message in a messages file, which has the paths of its
+// images rather than their data
+type fileMessage struct {
+	Role       string         `json:"role"`
+	Content    string         `json:"content"`
+	Images     []string       `json:"images,omitempty"`
+	ToolCalls  []api.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	Thinking   string         `json:"thinking,omitempty"`
+}
+
+// messagesFile is a JSON array of messages for ollama chat, kept as read so
+// a reply can be appended without changing the messages before it
+type messagesFile struct {
+	path     string
+	raw      []json.RawMessage
+	messages []api.Message
+}
+
+// readMessagesFile reads the messages in the file at path, inlining their
+// images, which are relative to the file. Errors give the line and column of
+// the JSON or message they're about.
+func readMessagesFile(path string) (*messagesFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &messagesFile{path: path}
+	if err := json.Unmarshal(b, &mf.raw); err != nil {
+		var terr *json.UnmarshalTypeError
+		if errors.As(err, &terr) && terr.Field == "" {
+			return nil, positionError(path, b, 0, errors.New("expected an array of messages"))
+		}
+
+		return nil, jsonError(path, b, 0, err)
+	}
+
+	if len(mf.raw) == 0 {
+		return nil, fmt.Errorf("%s: no messages", path)
+	}
+
+	// the decoder finds where each message starts to place errors
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	for range mf.raw {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+
+		start := int(dec.InputOffset()) - len(raw)
+		m, err := decodeFileMessage(raw, filepath.Dir(path))
+		if err != nil {
+			return nil, jsonError(path, b, start, err)
+		}
+
+		mf.messages = append(mf.messages, m)
+	}
+
+	return mf, nil
+}
+
+// decodeFileMessage decodes a message of a messages file in dir
+func decodeFileMessage(raw json.RawMessage, dir string) (api.Message, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	var fm fileMessage
+	if err := dec.Decode(&fm); err != nil {
+		return api.Message{}, err
+	}
+
+	m := api.Message{
+		Role:       strings.ToLower(fm.Role),
+		Content:    fm.Content,
+		ToolCalls:  fm.ToolCalls,
+		ToolCallID: fm.ToolCallID,
+		Name:       fm.Name,
+		Thinking:   fm.Thinking,
+	}
+
+	if !slices.Contains(messageRoles, m.Role) {
+		return api.Message{}, fmt.Errorf("unknown role %q, expected one of %s", fm.Role, strings.Join(messageRoles, ", "))
+	}
+
+	for _, path := range fm.Images {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		data, err := getImageData(path)
+		if err != nil {
+			return api.Message{}, fmt.Errorf("image %q: %w", path, err)
+		}
+
+		m.Images = append(m.Images, data)
+	}
+
+	return m, nil
+}
+
+// jsonError returns err, an error decoding the JSON at offset in b, with the
+// line and column it's at
+func jsonError(path string, b []byte, offset int, err error) error {
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &serr):
+		// the offset is that of the byte after the error
+		offset += max(int(serr.Offset)-1, 0)
+	case errors.As(err, &terr):
+		offset += max(int(terr.Offset)-1, 0)
+		err = fmt.Errorf("%s must be of type %s, not %s", cmp.Or(terr.Field, "value"), terr.Type, terr.Value)
+	}
+
+	return positionError(path, b, offset, err)
+}
+
+// positionError returns err prefixed with the path, line and column of offset
+// in b
+func positionError(path string, b []byte, offset int, err error) error {
+	offset = min(offset, len(b))
+	line := bytes.Count(b[:offset], []byte("\n")) + 1
+	col := offset - bytes.LastIndexByte(b[:offset], '\n')
+	return fmt.Errorf("%s:%d:%d: %s", path, line, col, strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// append writes m after the file's messages
+func (mf *messagesFile) append(m api.Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(append(mf.raw, b), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(mf.path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(mf.path), ".messages-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(append(out, '\n')); err != nil {
+		return err
+	}
+
+	if err := f.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), mf.path)
+}
+
+// readTools reads a JSON array of tools from the file at path
+func readTools(path string) (api.Tools, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tools api.Tools
+	if err := json.Unmarshal(b, &tools); err != nil {
+		return nil, jsonError(path, b, 0, err)
+	}
+
+	return tools, nil
+}
+
+// ChatHandler sends the messages in a file to a model and prints its reply,
+// for scripting conversations without the interactive prompt
+func ChatHandler(cmd *cobra.Command, args []string) error {
+	path, err := cmd.Flags().GetString("messages")
+	if err != nil {
+		return err
+	}
+
+	mf, err := readMessagesFile(path)
+	if err != nil {
+		return err
+	}
+
+	req := &api.ChatRequest{
+		Model:    args[0],
+		Messages: mf.messages,
+		Options:  map[string]any{},
+	}
+
+	if toolsPath, err := cmd.Flags().GetString("tools"); err != nil {
+		return err
+	} else if toolsPath != "" {
+		if req.Tools, err = readTools(toolsPath); err != nil {
+			return err
+		}
+	}
+
+	if req.Format, err = cmd.Flags().GetString("format"); err != nil {
+		return err
+	}
+
+	if keepAlive, err := cmd.Flags().GetString("keepalive"); err != nil {
+		return err
+	} else if keepAlive != "" {
+		d, err := time.ParseDuration(keepAlive)
+		if err != nil {
+			return err
+		}
+		req.KeepAlive = &api.Duration{Duration: d}
+	}
+
+	stream, err := cmd.Flags().GetBool("stream")
+	if err != nil {
+		return err
+	}
+	req.Stream = &stream
+
+	asJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return err
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	w := cmd.OutOrStdout()
+	enc := json.NewEncoder(w)
+
+	var latest api.ChatResponse
+	reply := api.Message{Role: "assistant"}
+	if err := withLicense(cmd, client, req.Model, insecure, func() error {
+		p := progress.NewProgress(os.Stderr)
+		defer p.StopAndClear()
+
+		spinner := progress.NewSpinner("")
+		p.Add("", spinner)
+
+		reply = api.Message{Role: "assistant"}
+		return client.Chat(cmd.Context(), req, func(resp api.ChatResponse) error {
+			if resp.Status != "" {
+				spinner.SetMessage(resp.Status)
+				return nil
+			}
+
+			p.StopAndClear()
+
+			latest = resp
+			reply.Role = cmp.Or(resp.Message.Role, reply.Role)
+			reply.Content += resp.Message.Content
+			reply.Thinking += resp.Message.Thinking
+			reply.ToolCalls = append(reply.ToolCalls, resp.Message.ToolCalls...)
+
+			switch {
+			case stream && asJSON:
+				return enc.Encode(resp)
+			case stream:
+				_, err := io.WriteString(w, resp.Message.Content)
+				return err
+			}
+
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	switch {
+	case asJSON && !stream:
+		latest.Message = reply
+		if err := enc.Encode(latest); err != nil {
+			return err
+		}
+	case !asJSON:
+		if !stream {
+			fmt.Fprint(w, reply.Content)
+		}
+
+		if reply.Content != "" && !strings.HasSuffix(reply.Content, "\n") {
+			fmt.Fprintln(w)
+		}
+
+		for _, call := range reply.ToolCalls {
+			fmt.Fprintf(w, "[tool call] %s %s\n", call.Function.Name, call.Function.Arguments.String())
+		}
+	}
+
+	verbose, err := cmd.Flags().GetBool("verbose")
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		latest.Summary()
+	}
+
+	if appendReply, err := cmd.Flags().GetBool("append"); err != nil {
+		return err
+	} else if appendReply {
+		return mf.append(reply)
+	}
+
+	return nil
+}
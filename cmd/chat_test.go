@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestReadMessagesFile(t *testing.T) {
+	dir := t.TempDir()
+	png := []byte("\x89PNG\r\n\x1a\nimage")
+	if err := os.WriteFile(filepath.Join(dir, "cat.png"), png, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(t *testing.T, s string) string {
+		t.Helper()
+		path := filepath.Join(dir, "conv.json")
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		mf, err := readMessagesFile(write(t, `[
+  {"role": "system", "content": "be brief"},
+  {"role": "User", "content": "what's this?", "images": ["cat.png"]},
+  {"role": "assistant", "content": "", "tool_calls": [{"id": "call_1", "function": {"name": "lookup", "arguments": {"q": "cat"}}}]},
+  {"role": "tool", "content": "a cat", "tool_call_id": "call_1", "name": "lookup"}
+]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []api.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: "what's this?", Images: []api.ImageData{png}},
+			{Role: "assistant", ToolCalls: []api.ToolCall{{ID: "call_1", Function: api.ToolCallFunction{Name: "lookup", Arguments: api.ToolCallFunctionArguments{"q": "cat"}}}}},
+			{Role: "tool", Content: "a cat", ToolCallID: "call_1", Name: "lookup"},
+		}
+
+		if diff := cmp.Diff(expect, mf.messages); diff != "" {
+			t.Errorf("unexpected messages (-want +got):\n%s", diff)
+		}
+	})
+
+	cases := []struct {
+		name   string
+		file   string
+		expect string
+	}{
+		{"syntax", "[\n  {\"role\": \"user\",}\n]", "conv.json:2:19: invalid character '}'"},
+		{"truncated", "[\n  {\"role\": \"user\"", "conv.json:2:17: unexpected end of JSON input"},
+		{"not an array", `{"role": "user"}`, "conv.json:1:1: expected an array of messages"},
+		{"empty", `[]`, "conv.json: no messages"},
+		{"unknown field", "[\n  {\"role\": \"user\"},\n  {\"rol\": \"user\"}\n]", `conv.json:3:3: unknown field "rol"`},
+		{"type", "[\n  {\"role\": \"user\", \"content\": 1}\n]", "conv.json:2:31: content must be of type string, not number"},
+		{"role", "[{\"role\": \"robot\"}]", `conv.json:1:2: unknown role "robot"`},
+		{"image", "[\n  {\"role\": \"user\", \"images\": [\"dog.png\"]}\n]", `conv.json:2:3: image "` + filepath.Join(dir, "dog.png")},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readMessagesFile(write(t, tt.file))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if got := strings.TrimPrefix(err.Error(), dir+string(filepath.Separator)); !strings.HasPrefix(got, tt.expect) {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestChatHandler(t *testing.T) {
+	var req api.ChatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+		case "/api/chat":
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+
+			enc := json.NewEncoder(w)
+			enc.Encode(api.ChatResponse{Message: api.Message{Role: "assistant", Content: "Hello"}})                                  //nolint:errcheck
+			enc.Encode(api.ChatResponse{Message: api.Message{Role: "assistant", Content: " there"}, Done: true, DoneReason: "stop"}) //nolint:errcheck
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+
+	path := filepath.Join(t.TempDir(), "conv.json")
+	if err := os.WriteFile(path, []byte(`[{"role": "user", "content": "hi"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T, args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		cmd := NewCLI()
+		cmd.SetOut(&out)
+		cmd.SetArgs(append([]string{"chat", "test", "--messages", path}, args...))
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	if out := run(t); out != "Hello there\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	if req.Stream == nil || *req.Stream {
+		t.Error("expected a request that isn't streamed")
+	}
+
+	if out := run(t, "--stream", "--json"); strings.Count(out, "\n") != 2 || !strings.Contains(out, `"content":" there"`) {
+		t.Errorf("expected a line of JSON for each response, got %q", out)
+	}
+
+	var resp api.ChatResponse
+	if err := json.Unmarshal([]byte(run(t, "--json")), &resp); err != nil {
+		t.Fatal(err)
+	} else if resp.Message.Content != "Hello there" || !resp.Done {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	run(t, "--append")
+	run(t, "--append")
+
+	mf, err := readMessagesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []api.Message{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "Hello there"},
+		{Role: "assistant", Content: "Hello there"},
+	}
+
+	if diff := cmp.Diff(expect, mf.messages); diff != "" {
+		t.Errorf("unexpected messages (-want +got):\n%s", diff)
+	}
+
+	if len(req.Messages) != 2 {
+		t.Errorf("expected the appended reply to be sent, got %d messages", len(req.Messages))
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected the file's mode to be kept, got %v", fi.Mode())
+	}
+}
@@ -3,21 +3,23 @@ package cmd
 import (
 	"archive/zip"
 	"bufio"
-	"bytes"
+	"cmp"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
-	"net"
 	"net/http"
 	"os"
-	"os/signal"
+	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -25,7 +27,7 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
-	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/containerd/console"
@@ -39,6 +41,7 @@ import (
 	"github.com/ollama/ollama/auth"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/progress"
 	"github.com/ollama/ollama/server"
@@ -73,20 +76,51 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if imatrix, _ := cmd.Flags().GetString("imatrix"); imatrix != "" {
+		// the flag replaces IMATRIX in the Modelfile, and its path is
+		// relative to the working directory rather than the build context
+		if strings.HasPrefix(imatrix, "sha256:") {
+			imatrix = "@" + imatrix
+		} else if imatrix, err = filepath.Abs(imatrix); err != nil {
+			return err
+		}
+
+		modelfile.Commands = slices.DeleteFunc(modelfile.Commands, func(c parser.Command) bool {
+			return c.Name == "imatrix"
+		})
+		modelfile.Commands = append(modelfile.Commands, parser.Command{Name: "imatrix", Args: imatrix})
+	}
+
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
 
-	status := "transferring model data"
-	spinner := progress.NewSpinner(status)
-	p.Add(status, spinner)
-	defer p.Stop()
+	// relative paths are resolved against the build context, which is the
+	// Modelfile's directory unless it's given
+	dir := filepath.Dir(filename)
+	if len(args) > 1 {
+		if dir, err = filepath.Abs(args[1]); err != nil {
+			return err
+		}
+	}
+
+	bc, err := newBuildContext(dir)
+	if err != nil {
+		return err
+	}
 
+	var uploads []upload
 	for i := range modelfile.Commands {
 		switch modelfile.Commands[i].Name {
-		case "model", "adapter":
+		case "model", "adapter", "imatrix":
 			path := modelfile.Commands[i].Args
+			if modelfile.Commands[i].Name == "imatrix" && strings.HasPrefix(path, "@") {
+				// importance matrices computed with `ollama imatrix` are
+				// already blobs
+				continue
+			}
+
 			if path == "~" {
 				path = home
 			} else if strings.HasPrefix(path, "~/") {
@@ -94,7 +128,7 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 			}
 
 			if !filepath.IsAbs(path) {
-				path = filepath.Join(filepath.Dir(filename), path)
+				path = filepath.Join(dir, path)
 			}
 
 			fi, err := os.Stat(path)
@@ -104,149 +138,81 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 				return err
 			}
 
-			if fi.IsDir() {
+			if bc.excluded(path, fi.IsDir()) {
+				return fmt.Errorf("%s is excluded by %s", path, ignoreFile)
+			}
+
+			u := upload{command: i, path: path}
+			if fi.IsDir() && modelfile.Commands[i].Name == "imatrix" {
+				return fmt.Errorf("%s is a directory, not an importance matrix", path)
+			} else if fi.IsDir() {
 				// this is likely a safetensors or pytorch directory
 				// TODO make this work w/ adapters
-				tempfile, err := tempZipFiles(path)
-				if err != nil {
+				if u.files, err = bc.modelFiles(path); err != nil {
 					return err
 				}
-				defer os.RemoveAll(tempfile)
-
-				path = tempfile
 			}
 
-			digest, err := createBlob(cmd, client, path, spinner)
-			if err != nil {
-				return err
-			}
-
-			modelfile.Commands[i].Args = "@" + digest
+			uploads = append(uploads, u)
 		}
 	}
 
-	bars := make(map[string]*progress.Bar)
-	fn := func(resp api.ProgressResponse) error {
-		if resp.Digest != "" {
-			spinner.Stop()
-
-			bar, ok := bars[resp.Digest]
-			if !ok {
-				bar = progress.NewBar(fmt.Sprintf("pulling %s...", resp.Digest[7:19]), resp.Total, resp.Completed)
-				bars[resp.Digest] = bar
-				p.Add(resp.Digest, bar)
-			}
-
-			bar.Set(resp.Completed)
-		} else if status != resp.Status {
-			spinner.Stop()
-
-			status = resp.Status
-			spinner = progress.NewSpinner(status)
-			p.Add(status, spinner)
+	if len(uploads) > 0 {
+		if err := printUploads(os.Stderr, uploads); err != nil {
+			return err
 		}
-
-		return nil
 	}
 
-	quantize, _ := cmd.Flags().GetString("quantize")
-
-	request := api.CreateRequest{Name: args[0], Modelfile: modelfile.String(), Quantize: quantize}
-	if err := client.Create(cmd.Context(), &request, fn); err != nil {
-		return err
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		return nil
 	}
 
-	return nil
-}
+	status := "transferring model data"
+	spinner := progress.NewSpinner(status)
+	p.Add(status, spinner)
+	defer p.Stop()
 
-func tempZipFiles(path string) (string, error) {
-	tempfile, err := os.CreateTemp("", "ollama-tf")
-	if err != nil {
-		return "", err
-	}
-	defer tempfile.Close()
+	for _, u := range uploads {
+		path := u.path
+		if u.files != nil {
+			tempfile, err := tempZipFiles(u.path, u.files)
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tempfile)
 
-	detectContentType := func(path string) (string, error) {
-		f, err := os.Open(path)
-		if err != nil {
-			return "", err
+			path = tempfile
 		}
-		defer f.Close()
 
-		var b bytes.Buffer
-		b.Grow(512)
-
-		if _, err := io.CopyN(&b, f, 512); err != nil && !errors.Is(err, io.EOF) {
-			return "", err
+		digest, err := createBlob(cmd, client, path, spinner)
+		if err != nil {
+			return err
 		}
 
-		contentType, _, _ := strings.Cut(http.DetectContentType(b.Bytes()), ";")
-		return contentType, nil
+		modelfile.Commands[u.command].Args = "@" + digest
 	}
 
-	glob := func(pattern, contentType string) ([]string, error) {
-		matches, err := filepath.Glob(pattern)
-		if err != nil {
-			return nil, err
-		}
+	t := newTransferProgress(p, "pulling")
+	t.status, t.spinner = status, spinner
 
-		for _, safetensor := range matches {
-			if ct, err := detectContentType(safetensor); err != nil {
-				return nil, err
-			} else if ct != contentType {
-				return nil, fmt.Errorf("invalid content type: expected %s for %s", ct, safetensor)
-			}
-		}
+	quantize, _ := cmd.Flags().GetString("quantize")
+	strictTemplate, _ := cmd.Flags().GetBool("strict-template")
 
-		return matches, nil
-	}
-
-	var files []string
-	if st, _ := glob(filepath.Join(path, "model*.safetensors"), "application/octet-stream"); len(st) > 0 {
-		// safetensors files might be unresolved git lfs references; skip if they are
-		// covers model-x-of-y.safetensors, model.fp32-x-of-y.safetensors, model.safetensors
-		files = append(files, st...)
-	} else if st, _ := glob(filepath.Join(path, "adapters.safetensors"), "application/octet-stream"); len(st) > 0 {
-		// covers adapters.safetensors
-		files = append(files, st...)
-	} else if st, _ := glob(filepath.Join(path, "adapter_model.safetensors"), "application/octet-stream"); len(st) > 0 {
-		// covers adapter_model.safetensors
-		files = append(files, st...)
-	} else if pt, _ := glob(filepath.Join(path, "pytorch_model*.bin"), "application/zip"); len(pt) > 0 {
-		// pytorch files might also be unresolved git lfs references; skip if they are
-		// covers pytorch_model-x-of-y.bin, pytorch_model.fp32-x-of-y.bin, pytorch_model.bin
-		files = append(files, pt...)
-	} else if pt, _ := glob(filepath.Join(path, "consolidated*.pth"), "application/zip"); len(pt) > 0 {
-		// pytorch files might also be unresolved git lfs references; skip if they are
-		// covers consolidated.x.pth, consolidated.pth
-		files = append(files, pt...)
-	} else {
-		return "", errors.New("no safetensors or torch files found")
+	request := api.CreateRequest{Name: args[0], Modelfile: modelfile.String(), Quantize: quantize, StrictTemplate: strictTemplate}
+	if err := client.Create(cmd.Context(), &request, t.update); err != nil {
+		return err
 	}
 
-	// add configuration files, json files are detected as text/plain
-	js, err := glob(filepath.Join(path, "*.json"), "text/plain")
-	if err != nil {
-		return "", err
-	}
-	files = append(files, js...)
+	return nil
+}
 
-	// bert models require a nested config.json
-	// TODO(mxyng): merge this with the glob above
-	js, err = glob(filepath.Join(path, "**/*.json"), "text/plain")
+// tempZipFiles zips files of the model directory path into a temporary file
+func tempZipFiles(path string, files []string) (string, error) {
+	tempfile, err := os.CreateTemp("", "ollama-tf")
 	if err != nil {
 		return "", err
 	}
-	files = append(files, js...)
-
-	if tks, _ := glob(filepath.Join(path, "tokenizer.model"), "application/octet-stream"); len(tks) > 0 {
-		// add tokenizer.model if it exists, tokenizer.json is automatically picked up by the previous glob
-		// tokenizer.model might be a unresolved git lfs reference; error if it is
-		files = append(files, tks...)
-	} else if tks, _ := glob(filepath.Join(path, "**/tokenizer.model"), "text/plain"); len(tks) > 0 {
-		// some times tokenizer.model is in a subdirectory (e.g. meta-llama/Meta-Llama-3-8B)
-		files = append(files, tks...)
-	}
+	defer tempfile.Close()
 
 	zipfile := zip.NewWriter(tempfile)
 	defer zipfile.Close()
@@ -331,7 +297,7 @@ func createBlob(cmd *cobra.Command, client *api.Client, path string, spinner *pr
 	}()
 
 	digest := fmt.Sprintf("sha256:%x", hash.Sum(nil))
-	if err = client.CreateBlob(cmd.Context(), digest, io.TeeReader(bin, &pw)); err != nil {
+	if err = client.CreateBlob(cmd.Context(), digest, &progressReader{bin, &pw}); err != nil {
 		return "", err
 	}
 	return digest, nil
@@ -346,6 +312,27 @@ func (w *progressWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// progressReader counts the bytes read from a file being uploaded, going
+// back with it when a large upload is resumed from an earlier offset
+type progressReader struct {
+	io.ReadSeeker
+	pw *progressWriter
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.pw.n.Add(int64(n))
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		r.pw.n.Store(n)
+	}
+	return n, err
+}
+
 func loadOrUnloadModel(cmd *cobra.Command, opts *runOptions) error {
 	p := progress.NewProgress(os.Stderr)
 	defer p.StopAndClear()
@@ -363,7 +350,12 @@ func loadOrUnloadModel(cmd *cobra.Command, opts *runOptions) error {
 		KeepAlive: opts.KeepAlive,
 	}
 
-	return client.Generate(cmd.Context(), req, func(api.GenerateResponse) error { return nil })
+	return client.Generate(cmd.Context(), req, func(resp api.GenerateResponse) error {
+		if resp.Status != "" {
+			spinner.SetMessage(resp.Status)
+		}
+		return nil
+	})
 }
 
 func StopHandler(cmd *cobra.Command, args []string) error {
@@ -394,6 +386,14 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 	}
 	opts.Format = format
 
+	if opts.System, err = flagValue(cmd, "system"); err != nil {
+		return err
+	}
+
+	if opts.Template, err = flagValue(cmd, "template"); err != nil {
+		return err
+	}
+
 	keepAlive, err := cmd.Flags().GetString("keepalive")
 	if err != nil {
 		return err
@@ -453,14 +453,42 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if info.Unsupported != nil {
+		return *info.Unsupported
+	}
+
 	opts.MultiModal = slices.Contains(info.Details.Families, "clip")
 	opts.ParentModel = info.Details.ParentModel
 
+	if opts.System != "" {
+		fmt.Fprintln(os.Stderr, "Overriding the model's system message for this session")
+	}
+
+	if opts.Template != "" {
+		fmt.Fprintln(os.Stderr, "Overriding the model's prompt template for this session")
+	}
+
+	for _, warning := range overrideWarnings(opts, info.Template) {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return err
+	}
+
 	if interactive {
-		if err := loadOrUnloadModel(cmd, &opts); err != nil {
+		if err := withLicense(cmd, client, name, insecure, func() error {
+			return loadOrUnloadModel(cmd, &opts)
+		}); err != nil {
 			return err
 		}
 
+		// the system message is set as if with /set system
+		if opts.System != "" {
+			opts.Messages = append(opts.Messages, api.Message{Role: "system", Content: opts.System})
+		}
+
 		for _, msg := range info.Messages {
 			switch msg.Role {
 			case "user":
@@ -475,7 +503,50 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 
 		return generateInteractive(cmd, opts)
 	}
-	return generate(cmd, opts)
+	return withLicense(cmd, client, name, insecure, func() error {
+		return generate(cmd, opts)
+	})
+}
+
+// flagValue returns the value of the string flag name, read from a file if
+// it's given as @path
+func flagValue(cmd *cobra.Command, name string) (string, error) {
+	v, err := cmd.Flags().GetString(name)
+	if err != nil {
+		return "", err
+	}
+
+	if path, ok := strings.CutPrefix(v, "@"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("--%s: %w", name, err)
+		}
+
+		return string(b), nil
+	}
+
+	return v, nil
+}
+
+// overrideWarnings returns warnings about the system message and template
+// overrides of opts that would be silently ignored by the template the model
+// is run with, either the override or the model's own
+func overrideWarnings(opts runOptions, modelTemplate string) []string {
+	tmpl := cmp.Or(opts.Template, modelTemplate)
+	if tmpl == "" {
+		return nil
+	}
+
+	var warnings []string
+	if opts.System != "" && !strings.Contains(tmpl, ".System") && !strings.Contains(tmpl, ".Messages") {
+		warnings = append(warnings, "the template doesn't use .System or .Messages, so the system message is ignored")
+	}
+
+	if opts.Template != "" && !strings.Contains(tmpl, ".Prompt") && !strings.Contains(tmpl, ".Messages") {
+		warnings = append(warnings, "the template doesn't use .Prompt or .Messages, so prompts are ignored")
+	}
+
+	return warnings
 }
 
 func errFromUnknownKey(unknownKeyErr error) error {
@@ -533,46 +604,41 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 	p := progress.NewProgress(os.Stderr)
 	defer p.Stop()
 
-	bars := make(map[string]*progress.Bar)
-	var status string
-	var spinner *progress.Spinner
+	t := newTransferProgress(p, "pushing")
+	fn := t.update
 
-	fn := func(resp api.ProgressResponse) error {
-		if resp.Digest != "" {
-			if spinner != nil {
-				spinner.Stop()
-			}
+	sign, err := cmd.Flags().GetBool("sign")
+	if err != nil {
+		return err
+	}
 
-			bar, ok := bars[resp.Digest]
-			if !ok {
-				bar = progress.NewBar(fmt.Sprintf("pushing %s...", resp.Digest[7:19]), resp.Total, resp.Completed)
-				bars[resp.Digest] = bar
-				p.Add(resp.Digest, bar)
-			}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
 
-			bar.Set(resp.Completed)
-		} else if status != resp.Status {
-			if spinner != nil {
-				spinner.Stop()
-			}
+	dest := args[0]
+	request := api.PushRequest{Name: args[0], Insecure: insecure, Sign: sign, DryRun: dryRun}
+	if len(args) > 1 {
+		dest, request.Destination = args[1], args[1]
+	}
 
-			status = resp.Status
-			spinner = progress.NewSpinner(status)
-			p.Add(status, spinner)
+	var uploads []api.ProgressResponse
+	if dryRun {
+		fn = func(resp api.ProgressResponse) error {
+			if resp.Digest != "" {
+				uploads = append(uploads, resp)
+			}
+			return nil
 		}
-
-		return nil
 	}
 
-	request := api.PushRequest{Name: args[0], Insecure: insecure}
 	if err := client.Push(cmd.Context(), &request, fn); err != nil {
-		if spinner != nil {
-			spinner.Stop()
-		}
-		if strings.Contains(err.Error(), "access denied") {
+		t.stop()
+		if strings.Contains(err.Error(), "unauthorized: access denied") {
 			return errors.New("you are not authorized to push to this namespace, create the model under a namespace you own")
 		}
-		host := model.ParseName(args[0]).Host
+		host := model.ParseName(dest).Host
 		isOllamaHost := strings.HasSuffix(host, ".ollama.ai") || strings.HasSuffix(host, ".ollama.com")
 		if strings.Contains(err.Error(), errtypes.UnknownOllamaKeyErrMsg) && isOllamaHost {
 			// the user has not added their ollama key to ollama.com
@@ -583,7 +649,20 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	spinner.Stop()
+	if dryRun {
+		var total int64
+		for _, u := range uploads {
+			total += u.Total
+		}
+
+		fmt.Printf("pushing %s would upload %d layers (%s)\n", dest, len(uploads), format.HumanBytes(total))
+		for _, u := range uploads {
+			fmt.Printf("  %s  %s\n", u.Digest, format.HumanBytes(u.Total))
+		}
+		return nil
+	}
+
+	t.stop()
 	return nil
 }
 
@@ -602,7 +681,13 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 
 	for _, m := range models.Models {
 		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")})
+			name := m.Name
+			if m.Broken {
+				name += " (broken)"
+			} else if m.Unsupported != nil {
+				name += " (unsupported)"
+			}
+			data = append(data, []string{name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")})
 		}
 	}
 
@@ -620,18 +705,87 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func SearchHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	limit, err := cmd.Flags().GetInt("limit")
+	if err != nil {
+		return err
+	}
+
+	sort, err := cmd.Flags().GetString("sort")
+	if err != nil {
+		return err
+	}
+
+	asJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Search(cmd.Context(), &api.SearchRequest{Query: args[0], Limit: limit, Sort: sort})
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(resp)
+	}
+
+	if len(resp.Models) == 0 {
+		fmt.Fprintf(os.Stderr, "no models found for %q\n", args[0])
+		return nil
+	}
+
+	var data [][]string
+	for _, m := range resp.Models {
+		data = append(data, []string{
+			m.Name,
+			format.HumanNumber(uint64(m.Pulls)),
+			format.HumanTime(m.UpdatedAt, "Never"),
+			strings.Join(m.Sizes, ", "),
+			strings.Join(m.Quantizations, ", "),
+		})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"NAME", "PULLS", "UPDATED", "SIZES", "QUANTIZATIONS"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
 func ListRunningHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
 		return err
 	}
 
-	models, err := client.ListRunning(cmd.Context())
+	listRunning := client.ListRunning
+	slots, _ := cmd.Flags().GetBool("slots")
+	if slots {
+		listRunning = client.ListRunningVerbose
+	}
+
+	models, err := listRunning(cmd.Context())
 	if err != nil {
 		return err
 	}
 
 	var data [][]string
+	var matched []api.ProcessModelResponse
 
 	for _, m := range models.Models {
 		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
@@ -649,6 +803,16 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 				procStr = fmt.Sprintf("%d%%/%d%% CPU/GPU", int(cpuPercent), int(100-cpuPercent))
 			}
 
+			if m.Location == "remote" {
+				procStr = fmt.Sprintf("%s (%s)", procStr, m.Host)
+			}
+			if m.State == "cache-released" {
+				procStr += " (cache released)"
+			}
+			if len(m.GPUConstraint) > 0 {
+				procStr += fmt.Sprintf(" (on %s of gpus %s)", strings.Join(m.GPUs, ","), strings.Join(m.GPUConstraint, ","))
+			}
+
 			var until string
 			delta := time.Since(m.ExpiresAt)
 			if delta > 0 {
@@ -656,7 +820,8 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 			} else {
 				until = format.HumanTime(m.ExpiresAt, "Never")
 			}
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, until})
+			data = append(data, []string{runningName(m), m.Digest[:12], format.HumanBytes(m.Size), procStr, until})
+			matched = append(matched, m)
 		}
 	}
 
@@ -671,6 +836,140 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 	table.AppendBulk(data)
 	table.Render()
 
+	if slots {
+		fmt.Println()
+		showSlots(matched, os.Stdout)
+	}
+
+	return nil
+}
+
+// runningName is the name of a running model listed by ollama ps
+func runningName(m api.ProcessModelResponse) string {
+	name := m.Name
+	if m.Variant != "" {
+		name = fmt.Sprintf("%s (%s)", name, m.Variant)
+	}
+	if m.Replica > 0 {
+		name = fmt.Sprintf("%s (replica %d)", name, m.Replica)
+	}
+
+	return name
+}
+
+// showSlots lists the parallel slots of the running models
+func showSlots(models []api.ProcessModelResponse, w io.Writer) {
+	var data [][]string
+	for _, m := range models {
+		for _, s := range m.Slots {
+			data = append(data, []string{runningName(m), strconv.Itoa(s.ID), s.State, s.RequestID, strconv.Itoa(s.TokensProcessed), strconv.Itoa(s.CacheTokens)})
+		}
+	}
+
+	if len(data) == 0 {
+		fmt.Fprintln(w, "No slots reported by the running models")
+		return
+	}
+
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"NAME", "SLOT", "STATE", "REQUEST", "TOKENS", "CACHED"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+}
+
+// MigrateHandler moves models stored in legacy layouts under OLLAMA_MODELS
+// into the current layout, as the server does when it starts
+func MigrateHandler(cmd *cobra.Command, args []string) error {
+	if !envconfig.Debug() {
+		// skipped models are reported as progress
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	migrated, err := server.MigrateModels(func(resp api.ProgressResponse) {
+		fmt.Fprintln(os.Stderr, resp.Status)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %d models\n", migrated)
+	return nil
+}
+
+// DoctorHandler runs hardware discovery in the current environment and reports what was found, including
+// GPUs that can't be used and any workarounds that were applied or are suggested
+func DoctorHandler(cmd *cobra.Command, args []string) error {
+	if !envconfig.Debug() {
+		// Discovery logs are intended for the server log
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	fmt.Printf("ollama version %s\n", version.Version)
+	fmt.Printf("cpu capability: %s\n\n", gpu.GetCPUCapability())
+
+	var data [][]string
+	for _, g := range gpu.GetGPUInfo() {
+		if g.Library == "cpu" {
+			continue
+		}
+
+		override := g.GfxOverride
+		if g.GfxOverrideAuto {
+			override += " (automatic)"
+		}
+		data = append(data, []string{g.Library, g.ID, g.Name, g.Compute, format.HumanBytes2(g.TotalMemory), override})
+	}
+
+	if len(data) == 0 {
+		fmt.Println("no compatible GPUs were discovered")
+	} else {
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"LIBRARY", "ID", "NAME", "COMPUTE", "VRAM", "GFX OVERRIDE"})
+		table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+		table.SetAlignment(tablewriter.ALIGN_LEFT)
+		table.SetHeaderLine(false)
+		table.SetBorder(false)
+		table.SetNoWhiteSpace(true)
+		table.SetTablePadding("    ")
+		table.AppendBulk(data)
+		table.Render()
+	}
+
+	if unsupported := gpu.GetUnsupportedGPUInfo(); len(unsupported) > 0 {
+		fmt.Println("\nunsupported GPUs:")
+		for _, g := range unsupported {
+			fmt.Printf("  %s %s %s: %s\n", g.Library, g.ID, g.Compute, g.Reason)
+			if g.Suggestion != "" {
+				fmt.Printf("    suggestion: %s\n", g.Suggestion)
+			}
+		}
+	}
+
+	// Credentials are read from the store of the user running doctor, which
+	// is only the server's if it runs as the same user
+	who := "this user"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+
+	creds, err := auth.ListCredentials()
+	if err != nil {
+		fmt.Printf("\ncouldn't read the stored credentials of %s: %v\n", who, err)
+	} else if len(creds) == 0 {
+		fmt.Printf("\nno registry credentials stored for %s\n", who)
+	} else {
+		fmt.Printf("\nregistry credentials stored for %s, which the server only uses if it runs as %s:\n", who, who)
+		for _, c := range creds {
+			fmt.Printf("  %s (%s)\n", c.Registry, storeNames[c.Store])
+		}
+	}
+
 	return nil
 }
 
@@ -680,13 +979,218 @@ func DeleteHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	for _, name := range args {
-		req := api.DeleteRequest{Name: name}
-		if err := client.Delete(cmd.Context(), &req); err != nil {
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return err
+	}
+
+	unload, err := cmd.Flags().GetBool("unload")
+	if err != nil {
+		return err
+	}
+
+	names, err := expandModelNames(cmd.Context(), client, args)
+	if err != nil {
+		return err
+	}
+
+	req := api.DeleteRequest{Model: names[0], Models: names[1:], Force: unload}
+
+	// confirm only when there's someone at a terminal to answer, so scripts
+	// keep removing models as they always have
+	if !force && term.IsTerminal(int(os.Stdin.Fd())) {
+		// report what would be deleted, which also fails if any of the
+		// models are loaded
+		req.DryRun = true
+		resp, err := client.DeleteModels(cmd.Context(), &req)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s\n", name)
+		}
+
+		what := "model"
+		if len(names) > 1 {
+			what = "models"
+		}
+
+		fmt.Fprintf(os.Stderr, "Delete %d %s, reclaiming %s? [y/N] ", len(names), what, format.HumanBytes(resp.Reclaimed))
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
 			return err
 		}
+
+		if answer := strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return errors.New("nothing deleted")
+		}
+
+		req.DryRun = false
+	}
+
+	resp, err := client.DeleteModels(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
 		fmt.Printf("deleted '%s'\n", name)
 	}
+
+	fmt.Printf("reclaimed %s\n", format.HumanBytes(resp.Reclaimed))
+	return nil
+}
+
+// expandModelNames replaces glob patterns in names, such as "myexp-*", with
+// the names of the local models that match them
+func expandModelNames(ctx context.Context, client *api.Client, names []string) ([]string, error) {
+	var models []api.ListModelResponse
+	var expanded []string
+	for _, name := range names {
+		if !strings.ContainsAny(name, "*?[") {
+			if !slices.Contains(expanded, name) {
+				expanded = append(expanded, name)
+			}
+			continue
+		}
+
+		if models == nil {
+			resp, err := client.List(ctx)
+			if err != nil {
+				return nil, err
+			}
+			models = resp.Models
+		}
+
+		var matched bool
+		for _, m := range models {
+			// patterns without a tag match any tag
+			ok, err := path.Match(name, m.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", name, err)
+			}
+
+			if !ok && !strings.Contains(name, ":") {
+				ok, _ = path.Match(name+":*", m.Name)
+			}
+
+			if ok {
+				matched = true
+				if !slices.Contains(expanded, m.Name) {
+					expanded = append(expanded, m.Name)
+				}
+			}
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("no models match '%s'", name)
+		}
+	}
+
+	return expanded, nil
+}
+
+// DedupeHandler replaces blobs stored more than once across the models
+// directory and the directories in args with hardlinks, reporting what was
+// found and how much space was reclaimed
+func DedupeHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	req := api.DedupeRequest{DryRun: dryRun}
+	for _, dir := range args {
+		// the directories are read by the server, which may not share our working directory
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		req.Dirs = append(req.Dirs, abs)
+	}
+
+	resp, err := client.Dedupe(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	var data [][]string
+	for _, d := range resp.Duplicates {
+		status := "linked"
+		switch {
+		case dryRun:
+			status = "duplicate"
+		case !d.Linked:
+			status = "not linked"
+		}
+		data = append(data, []string{strings.TrimPrefix(d.Digest, "sha256-")[:12], format.HumanBytes(d.Size), d.Path, status})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"ID", "SIZE", "PATH", "STATUS"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	if dryRun {
+		fmt.Printf("%d duplicate blobs, %s could be reclaimed\n", len(resp.Duplicates), format.HumanBytes(resp.Total))
+	} else {
+		fmt.Printf("%d duplicate blobs, %s reclaimed\n", len(resp.Duplicates), format.HumanBytes(resp.Reclaimed))
+	}
+	return nil
+}
+
+// PruneHandler removes blobs that aren't used by any model and reports
+// broken models, removing them with --broken
+func PruneHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	dryRun, errDryRun := cmd.Flags().GetBool("dry-run")
+	broken, errBroken := cmd.Flags().GetBool("broken")
+	verify, errVerify := cmd.Flags().GetBool("verify")
+	if err := errors.Join(errDryRun, errBroken, errVerify); err != nil {
+		return err
+	}
+
+	req := api.PruneRequest{DryRun: dryRun, Broken: broken, Verify: verify}
+
+	resp, err := client.Prune(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range resp.Broken {
+		switch {
+		case req.Broken && !req.DryRun:
+			fmt.Printf("removed broken '%s'\n", m.Model)
+		default:
+			fmt.Printf("broken '%s', missing %s\n", m.Model, strings.Join(m.Missing, ", "))
+		}
+	}
+
+	if len(resp.Broken) > 0 && !req.Broken {
+		fmt.Println("remove broken models with --broken, or pull them again")
+	}
+
+	if req.DryRun {
+		fmt.Printf("%d unused blobs, %s could be reclaimed\n", len(resp.Unused), format.HumanBytes(resp.Reclaimed))
+	} else {
+		fmt.Printf("%d unused blobs, %s reclaimed\n", len(resp.Unused), format.HumanBytes(resp.Reclaimed))
+	}
 	return nil
 }
 
@@ -701,8 +1205,9 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 	parameters, errParams := cmd.Flags().GetBool("parameters")
 	system, errSystem := cmd.Flags().GetBool("system")
 	template, errTemplate := cmd.Flags().GetBool("template")
+	layers, errLayers := cmd.Flags().GetBool("layers")
 
-	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate} {
+	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate, errLayers} {
 		if boolErr != nil {
 			return errors.New("error retrieving flags")
 		}
@@ -736,11 +1241,16 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		showType = "template"
 	}
 
+	if layers {
+		flagsSet++
+		showType = "layers"
+	}
+
 	if flagsSet > 1 {
-		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', or '--template' can be specified")
+		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', '--template', or '--layers' can be specified")
 	}
 
-	req := api.ShowRequest{Name: args[0]}
+	req := api.ShowRequest{Name: args[0], Layers: layers}
 	resp, err := client.Show(cmd.Context(), &req)
 	if err != nil {
 		return err
@@ -758,6 +1268,8 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 			fmt.Println(resp.System)
 		case "template":
 			fmt.Println(resp.Template)
+		case "layers":
+			showLayers(resp.Manifest, os.Stdout)
 		}
 
 		return nil
@@ -766,6 +1278,50 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 	return showInfo(resp, os.Stdout)
 }
 
+// showLayers renders the layers of a model's manifest as a table, with the
+// path of each layer's blob if the server included them
+func showLayers(manifest *api.ManifestInfo, w io.Writer) {
+	if manifest == nil {
+		return
+	}
+
+	// the last column has each blob's path, or whether it's missing if the
+	// paths weren't included
+	header := []string{"MEDIA TYPE", "DIGEST", "SIZE", "VARIANT"}
+	if manifest.Path != "" {
+		header = append(header, "PATH")
+	} else if slices.ContainsFunc(manifest.Layers, func(l api.LayerInfo) bool { return l.Missing }) {
+		header = append(header, "STATUS")
+	}
+
+	var data [][]string
+	for _, l := range manifest.Layers {
+		row := []string{strings.TrimPrefix(l.MediaType, "application/vnd.ollama.image."), l.Digest, format.HumanBytes(l.Size), l.Variant}
+		if l.Missing {
+			row = append(row, "missing")
+		} else if len(header) > 4 {
+			row = append(row, l.Path)
+		}
+		data = append(data, row)
+	}
+
+	table := tablewriter.NewWriter(w)
+	table.SetHeader(header)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	fmt.Fprintf(w, "\nmanifest %s, config %s, %s in total\n", manifest.Digest, manifest.ConfigDigest, format.HumanBytes(manifest.Size))
+	if manifest.Path != "" {
+		fmt.Fprintln(w, manifest.Path)
+	}
+}
+
 func showInfo(resp *api.ShowResponse, w io.Writer) error {
 	tableRender := func(header string, rows func() [][]string) {
 		fmt.Fprintln(w, " ", header)
@@ -785,6 +1341,14 @@ func showInfo(resp *api.ShowResponse, w io.Writer) error {
 		fmt.Fprintln(w)
 	}
 
+	if u := resp.Unsupported; u != nil {
+		fmt.Fprintf(w, "  Warning: %s\n\n", u.ErrorMessage)
+	}
+
+	for _, warning := range resp.Warnings {
+		fmt.Fprintf(w, "  Warning: %s\n\n", warning)
+	}
+
 	tableRender("Model", func() (rows [][]string) {
 		if resp.ModelInfo != nil {
 			arch := resp.ModelInfo["general.architecture"].(string)
@@ -796,6 +1360,13 @@ func showInfo(resp *api.ShowResponse, w io.Writer) error {
 			rows = append(rows, []string{"", "architecture", resp.Details.Family})
 			rows = append(rows, []string{"", "parameters", resp.Details.ParameterSize})
 		}
+		if p := resp.Pooling; p != nil {
+			pooling := p.Effective
+			if p.Override != "" && p.Metadata != "" && p.Override != p.Metadata {
+				pooling = fmt.Sprintf("%s (overrides %s)", p.Override, p.Metadata)
+			}
+			rows = append(rows, []string{"", "pooling", pooling})
+		}
 		rows = append(rows, []string{"", "quantization", resp.Details.QuantizationLevel})
 		return
 	})
@@ -811,6 +1382,33 @@ func showInfo(resp *api.ShowResponse, w io.Writer) error {
 		})
 	}
 
+	if len(resp.Capabilities) > 0 {
+		tableRender("Capabilities", func() (rows [][]string) {
+			for _, c := range resp.Capabilities {
+				rows = append(rows, []string{"", c.String()})
+			}
+			return
+		})
+	}
+
+	if l := resp.Loaded; l != nil {
+		tableRender("Loaded", func() (rows [][]string) {
+			rows = append(rows, []string{"", "use_mmap", strconv.FormatBool(l.UseMMap)})
+			rows = append(rows, []string{"", "use_mlock", strconv.FormatBool(l.UseMLock)})
+			return
+		})
+	}
+
+	if s := resp.Signature; s != nil {
+		tableRender("Signature", func() (rows [][]string) {
+			if s.Signer != "" {
+				rows = append(rows, []string{"", "signer", s.Signer})
+			}
+			rows = append(rows, []string{"", "status", s.Status})
+			return
+		})
+	}
+
 	if resp.Parameters != "" {
 		tableRender("Parameters", func() (rows [][]string) {
 			scanner := bufio.NewScanner(strings.NewReader(resp.Parameters))
@@ -854,6 +1452,30 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	remote, err := cmd.Flags().GetString("remote")
+	if err != nil {
+		return err
+	}
+
+	if remote != "" {
+		apiKey, err := cmd.Flags().GetString("remote-api-key")
+		if err != nil {
+			return err
+		}
+
+		dst := args[0]
+		if len(args) > 1 {
+			dst = args[1]
+		}
+
+		to := api.NewClientWithAPIKey(envconfig.ParseHost(remote), http.DefaultClient, cmp.Or(apiKey, envconfig.APIKey()))
+		return copyRemote(cmd.Context(), client, to, args[0], dst)
+	}
+
+	if len(args) != 2 {
+		return errors.New("a destination is required unless copying with --remote")
+	}
+
 	req := api.CopyRequest{Source: args[0], Destination: args[1]}
 	if err := client.Copy(cmd.Context(), &req); err != nil {
 		return err
@@ -862,12 +1484,92 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func PullHandler(cmd *cobra.Command, args []string) error {
-	insecure, err := cmd.Flags().GetBool("insecure")
+// copyRemote copies the model src on from to dst on to, streaming the blobs
+// to that are missing through the client. to verifies each blob against its
+// digest as it's uploaded.
+func copyRemote(ctx context.Context, from, to *api.Client, src, dst string) error {
+	m, err := from.Manifest(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	for _, layer := range append(m.Layers, m.Config) {
+		ok, err := to.HasBlob(ctx, layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		completed := int64(0)
+		if ok {
+			completed = layer.Size
+		}
+
+		bar := progress.NewBar(fmt.Sprintf("copying %s...", layer.Digest[7:19]), layer.Size, completed)
+		p.Add(layer.Digest, bar)
+		if ok {
+			continue
+		}
+
+		if err := copyBlob(ctx, from, to, layer.Digest, bar); err != nil {
+			return err
+		}
+	}
+
+	spinner := progress.NewSpinner("writing manifest")
+	p.Add("manifest", spinner)
+	if err := to.PutManifest(ctx, dst, m); err != nil {
+		return err
+	}
+	spinner.Stop()
+
+	p.Add("success", progress.NewSpinner("success"))
+	return nil
+}
+
+func copyBlob(ctx context.Context, from, to *api.Client, digest string, bar *progress.Bar) error {
+	r, err := from.Blob(ctx, digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var pw progressWriter
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(60 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bar.Set(pw.n.Load())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := to.CreateBlob(ctx, digest, io.TeeReader(r, &pw)); err != nil {
+		return err
+	}
+
+	bar.Set(pw.n.Load())
+	return nil
+}
+
+func ImatrixHandler(cmd *cobra.Command, args []string) error {
+	datafile, _ := cmd.Flags().GetString("data")
+	data, err := os.ReadFile(datafile)
 	if err != nil {
 		return err
 	}
 
+	chunks, _ := cmd.Flags().GetInt("chunks")
+
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
 		return err
@@ -876,26 +1578,27 @@ func PullHandler(cmd *cobra.Command, args []string) error {
 	p := progress.NewProgress(os.Stderr)
 	defer p.Stop()
 
-	bars := make(map[string]*progress.Bar)
-
 	var status string
 	var spinner *progress.Spinner
+	var bar *progress.Bar
+	var digest string
 
 	fn := func(resp api.ProgressResponse) error {
-		if resp.Digest != "" {
-			if spinner != nil {
-				spinner.Stop()
-			}
+		switch {
+		case resp.Digest != "":
+			digest = resp.Digest
+		case resp.Total > 0:
+			if bar == nil {
+				if spinner != nil {
+					spinner.Stop()
+				}
 
-			bar, ok := bars[resp.Digest]
-			if !ok {
-				bar = progress.NewBar(fmt.Sprintf("pulling %s...", resp.Digest[7:19]), resp.Total, resp.Completed)
-				bars[resp.Digest] = bar
-				p.Add(resp.Digest, bar)
+				bar = progress.NewBar(resp.Status, resp.Total, resp.Completed)
+				p.Add(resp.Status, bar)
 			}
 
 			bar.Set(resp.Completed)
-		} else if status != resp.Status {
+		case status != resp.Status:
 			if spinner != nil {
 				spinner.Stop()
 			}
@@ -908,14 +1611,133 @@ func PullHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	request := api.PullRequest{Name: args[0], Insecure: insecure}
-	if err := client.Pull(cmd.Context(), &request, fn); err != nil {
+	request := api.ImatrixRequest{Model: args[0], Data: string(data), Chunks: chunks}
+	if err := client.Imatrix(cmd.Context(), &request, fn); err != nil {
+		return err
+	}
+
+	p.Stop()
+	fmt.Printf("%s\n\nQuantize %s with it using:\n  ollama create --quantize <type> --imatrix %s <name>\n", digest, args[0], digest)
+	return nil
+}
+
+func PullHandler(cmd *cobra.Command, args []string) error {
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return err
+	}
+
+	variants, err := cmd.Flags().GetStringSlice("variant")
+	if err != nil {
+		return err
+	}
+
+	strict, err := cmd.Flags().GetBool("strict")
+	if err != nil {
+		return err
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	if cancel, err := cmd.Flags().GetBool("cancel"); err != nil {
+		return err
+	} else if cancel {
+		discard, err := cmd.Flags().GetBool("discard")
+		if err != nil {
+			return err
+		}
+
+		return cancelTransfers(cmd.Context(), client, "pull", args[0], discard)
+	}
+
+	return withLicense(cmd, client, args[0], insecure, func() error {
+		p := progress.NewProgress(os.Stderr)
+		defer p.Stop()
+
+		t := newTransferProgress(p, "pulling")
+		request := api.PullRequest{Name: args[0], Insecure: insecure, Variants: variants, Strict: strict}
+		return client.Pull(cmd.Context(), &request, t.update)
+	})
+}
+
+// cancelTransfers cancels the transfers of kind in progress for name, which
+// may have been started by any client of the server
+func cancelTransfers(ctx context.Context, client *api.Client, kind, name string, discard bool) error {
+	transfers, err := client.ListTransfers(ctx)
+	if err != nil {
 		return err
 	}
 
+	n := model.ParseName(name)
+
+	var cancelled bool
+	for _, t := range transfers.Transfers {
+		if t.Type != kind || model.ParseName(t.Model) != n {
+			continue
+		}
+
+		if err := client.CancelTransfer(ctx, t.ID, discard); err != nil {
+			return err
+		}
+
+		fmt.Printf("cancelled %s of '%s'\n", kind, t.Model)
+		cancelled = true
+	}
+
+	if !cancelled {
+		return fmt.Errorf("no %s of '%s' in progress", kind, name)
+	}
+
 	return nil
 }
 
+// withLicense runs fn and, if it fails because the license of model hasn't
+// been accepted, shows the license and runs fn again once it's accepted. The
+// license is accepted without asking with --accept-license.
+func withLicense(cmd *cobra.Command, client *api.Client, model string, insecure bool, fn func() error) error {
+	err := fn()
+	var lerr api.LicenseError
+	if !errors.As(err, &lerr) {
+		return err
+	}
+
+	accept, err := cmd.Flags().GetBool("accept-license")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s\n\n", strings.TrimSpace(lerr.License))
+	if !accept {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("%w, use --accept-license to accept it", lerr)
+		}
+
+		fmt.Fprintf(os.Stderr, "Do you accept the license of %s? [y/N] ", model)
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		if answer := strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return errors.New("license not accepted")
+		}
+	}
+
+	var username string
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	if err := client.AcceptLicense(cmd.Context(), &api.AcceptLicenseRequest{Model: model, User: username, Insecure: insecure}); err != nil {
+		return err
+	}
+
+	return fn()
+}
+
 type generateContextKey string
 
 type runOptions struct {
@@ -926,10 +1748,14 @@ type runOptions struct {
 	WordWrap    bool
 	Format      string
 	System      string
+	Template    string
 	Images      []api.ImageData
 	Options     map[string]interface{}
 	MultiModal  bool
 	KeepAlive   *api.Duration
+
+	// Stats is the status line of interactive sessions, or nil
+	Stats *statsLine
 }
 
 type displayResponseState struct {
@@ -997,23 +1823,24 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 	spinner := progress.NewSpinner("")
 	p.Add("", spinner)
 
-	cancelCtx, cancel := context.WithCancel(cmd.Context())
+	cancelCtx, cancel := interrupts.withCancel(cmd.Context())
 	defer cancel()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
-
-	go func() {
-		<-sigChan
-		cancel()
-	}()
-
 	var state *displayResponseState = &displayResponseState{}
 	var latest api.ChatResponse
 	var fullResponse strings.Builder
 	var role string
 
+	stats := opts.Stats
+	stats.begin()
+	var lookedUp bool
+
 	fn := func(response api.ChatResponse) error {
+		if response.Status != "" {
+			spinner.SetMessage(response.Status)
+			return nil
+		}
+
 		p.StopAndClear()
 
 		latest = response
@@ -1022,8 +1849,17 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 		content := response.Message.Content
 		fullResponse.WriteString(content)
 
+		stats.clear()
 		displayResponse(content, opts.WordWrap, state)
 
+		if stats.active() && stats.numCtx == 0 && response.NumCtx == 0 && !lookedUp {
+			// servers that don't report the context length in responses
+			// have it in the running models
+			stats.numCtx = contextLength(cancelCtx, client, opts.Model)
+			lookedUp = true
+		}
+		stats.update(response)
+
 		return nil
 	}
 
@@ -1031,6 +1867,7 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 		Model:    opts.Model,
 		Messages: opts.Messages,
 		Format:   opts.Format,
+		Template: opts.Template,
 		Options:  opts.Options,
 	}
 
@@ -1038,9 +1875,24 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 		req.KeepAlive = opts.KeepAlive
 	}
 
-	if err := client.Chat(cancelCtx, req, fn); err != nil {
+	err = client.Chat(cancelCtx, req, fn)
+	// the line is removed before anything is printed below the response
+	stats.clear()
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			return nil, nil
+			cause := context.Cause(cancelCtx)
+			if !errors.Is(cause, errInterrupted) && !errors.Is(cause, errExit) {
+				return nil, nil
+			}
+
+			// keep what was generated so follow ups have its context
+			var message *api.Message
+			if fullResponse.Len() > 0 {
+				fmt.Println()
+				fmt.Println()
+				message = &api.Message{Role: role, Content: fullResponse.String(), Interrupted: true}
+			}
+			return message, cause
 		}
 		return nil, err
 	}
@@ -1081,20 +1933,17 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		generateContext = []int{}
 	}
 
-	ctx, cancel := context.WithCancel(cmd.Context())
+	ctx, cancel := interrupts.withCancel(cmd.Context())
 	defer cancel()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
-
-	go func() {
-		<-sigChan
-		cancel()
-	}()
-
 	var state *displayResponseState = &displayResponseState{}
 
 	fn := func(response api.GenerateResponse) error {
+		if response.Status != "" {
+			spinner.SetMessage(response.Status)
+			return nil
+		}
+
 		p.StopAndClear()
 
 		latest = response
@@ -1119,6 +1968,7 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		Images:    opts.Images,
 		Format:    opts.Format,
 		System:    opts.System,
+		Template:  opts.Template,
 		Options:   opts.Options,
 		KeepAlive: opts.KeepAlive,
 	}
@@ -1159,7 +2009,7 @@ func RunServer(_ *cobra.Command, _ []string) error {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", envconfig.Host().Host)
+	ln, err := server.Listen(envconfig.Host())
 	if err != nil {
 		return err
 	}
@@ -1240,17 +2090,102 @@ func versionHandler(cmd *cobra.Command, _ []string) {
 		return
 	}
 
-	serverVersion, err := client.Version(cmd.Context())
+	verbose, err := cmd.Flags().GetBool("verbose")
+	if err != nil {
+		return
+	}
+
+	info, err := client.VersionInfo(cmd.Context(), verbose)
 	if err != nil {
 		fmt.Println("Warning: could not connect to a running Ollama instance")
+		info = &api.VersionResponse{}
+	}
+
+	showVersion(os.Stdout, info, verbose)
+}
+
+// showVersion writes the server's version, with a warning if the client's is
+// of a different release, and with verbose the builds of both and the
+// server's runners and GPU backends
+func showVersion(w io.Writer, info *api.VersionResponse, verbose bool) {
+	if info.Version != "" {
+		fmt.Fprintf(w, "ollama version is %s\n", info.Version)
+	}
+
+	if info.Version != version.Version {
+		if info.Version != "" && version.Compatible(info.Version, version.Version) {
+			fmt.Fprintf(w, "client version is %s\n", version.Version)
+		} else {
+			fmt.Fprintf(w, "Warning: client version is %s\n", version.Version)
+		}
+	}
+
+	if !verbose {
+		return
 	}
 
-	if serverVersion != "" {
-		fmt.Printf("ollama version is %s\n", serverVersion)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if info.Version != "" {
+		fmt.Fprintln(tw, "\nServer:")
+		fmt.Fprintf(tw, "  Commit:\t%s\n", cmp.Or(info.Commit, "unknown"))
+		fmt.Fprintf(tw, "  Built:\t%s\n", cmp.Or(info.BuildDate, "unknown"))
+		fmt.Fprintf(tw, "  Go:\t%s\n", info.GoVersion)
+		if info.CPU != nil {
+			fmt.Fprintf(tw, "  CPU:\t%s, runner %s\n", info.CPU.Capability, info.CPU.Runner)
+		}
+
+		fmt.Fprintf(tw, "  Runners:\t%s\n", cmp.Or(strings.Join(info.Runners, ", "), "none"))
+		if len(info.Backends) == 0 {
+			fmt.Fprintln(tw, "  Backends:\tno GPUs found")
+		}
+
+		for i, b := range info.Backends {
+			label := ""
+			if i == 0 {
+				label = "Backends:"
+			}
+
+			backend := b.Library
+			if b.Variant != "" {
+				backend += " " + b.Variant
+			}
+
+			if b.Driver != "" {
+				backend += ", driver " + b.Driver
+			}
+
+			fmt.Fprintf(tw, "  %s\t%s, %d GPU(s)\n", label, backend, b.GPUs)
+		}
+
+		if len(info.Architectures) > 0 {
+			fmt.Fprintf(tw, "  Architectures:\t%s\n", strings.Join(info.Architectures, ", "))
+		}
 	}
 
-	if serverVersion != version.Version {
-		fmt.Printf("Warning: client version is %s\n", version.Version)
+	commit, date := version.Build()
+	fmt.Fprintln(tw, "\nClient:")
+	fmt.Fprintf(tw, "  Version:\t%s\n", version.Version)
+	fmt.Fprintf(tw, "  Commit:\t%s\n", cmp.Or(commit, "unknown"))
+	fmt.Fprintf(tw, "  Built:\t%s\n", cmp.Or(date, "unknown"))
+	fmt.Fprintf(tw, "  Go:\t%s\n", runtime.Version())
+	tw.Flush()
+}
+
+// modelArgs checks args with check, and that the first n of them are valid
+// model names, so invalid names are reported before connecting to the server
+func modelArgs(n int, check cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := check(cmd, args); err != nil {
+			return err
+		}
+
+		for _, arg := range args[:min(n, len(args))] {
+			if _, err := model.ParseNameStrict(arg); err != nil {
+				return err
+			}
+		}
+
+		return nil
 	}
 }
 
@@ -1263,7 +2198,7 @@ func appendEnvDocs(cmd *cobra.Command, envs []envconfig.EnvVar) {
 Environment Variables:
 `
 	for _, e := range envs {
-		envUsage += fmt.Sprintf("      %-24s   %s\n", e.Name, e.Description)
+		envUsage += fmt.Sprintf("      %-25s   %s\n", e.Name, e.Description)
 	}
 
 	cmd.SetUsageTemplate(cmd.UsageTemplate() + envUsage)
@@ -1296,22 +2231,40 @@ func NewCLI() *cobra.Command {
 	}
 
 	rootCmd.Flags().BoolP("version", "v", false, "Show version information")
+	rootCmd.Flags().Bool("verbose", false, "With --version, show the builds of the server and client, and the server's runners and GPU backends")
 
 	createCmd := &cobra.Command{
-		Use:     "create MODEL",
+		Use:     "create MODEL [CONTEXT]",
 		Short:   "Create a model from a Modelfile",
-		Args:    cobra.ExactArgs(1),
+		Long:    "Create a model from a Modelfile. Relative paths in the Modelfile are resolved against CONTEXT, which defaults to the Modelfile's directory. Files matching the patterns in CONTEXT/.ollamaignore, in gitignore syntax, aren't uploaded.",
+		Args:    modelArgs(1, cobra.RangeArgs(1, 2)),
 		PreRunE: checkServerHeartbeat,
 		RunE:    CreateHandler,
 	}
 
 	createCmd.Flags().StringP("file", "f", "Modelfile", "Name of the Modelfile")
-	createCmd.Flags().StringP("quantize", "q", "", "Quantize model to this level (e.g. q4_0)")
+	createCmd.Flags().StringP("quantize", "q", "", "Quantize model to this level (e.g. q4_K_M), or to each of a comma separated list of levels, tagging each model with its level")
+	createCmd.Flags().Bool("dry-run", false, "List the files that would be uploaded without creating the model")
+	createCmd.Flags().String("imatrix", "", "Importance matrix to quantize with, a file or the digest of one from ollama imatrix")
+	createCmd.Flags().Bool("strict-template", false, "Fail if the template uses special tokens that aren't in the model's vocabulary")
+
+	imatrixCmd := &cobra.Command{
+		Use:     "imatrix MODEL",
+		Short:   "Compute the importance matrix of a model for quantizing it",
+		Long:    "Compute the importance matrix of an unquantized model by running calibration text through it. The matrix is stored on the server and its digest can be passed to `ollama create --imatrix` to quantize the model with it.",
+		Args:    modelArgs(1, cobra.ExactArgs(1)),
+		PreRunE: checkServerHeartbeat,
+		RunE:    ImatrixHandler,
+	}
+
+	imatrixCmd.Flags().String("data", "", "File of calibration text")
+	imatrixCmd.Flags().Int("chunks", 0, "Maximum number of 512 token chunks of the calibration text to use")
+	_ = imatrixCmd.MarkFlagRequired("data")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
 		Short:   "Show information for a model",
-		Args:    cobra.ExactArgs(1),
+		Args:    modelArgs(1, cobra.ExactArgs(1)),
 		PreRunE: checkServerHeartbeat,
 		RunE:    ShowHandler,
 	}
@@ -1321,11 +2274,12 @@ func NewCLI() *cobra.Command {
 	showCmd.Flags().Bool("parameters", false, "Show parameters of a model")
 	showCmd.Flags().Bool("template", false, "Show template of a model")
 	showCmd.Flags().Bool("system", false, "Show system message of a model")
+	showCmd.Flags().Bool("layers", false, "Show the layers of a model and the files they're stored as")
 
 	runCmd := &cobra.Command{
 		Use:     "run MODEL [PROMPT]",
 		Short:   "Run a model",
-		Args:    cobra.MinimumNArgs(1),
+		Args:    modelArgs(1, cobra.MinimumNArgs(1)),
 		PreRunE: checkServerHeartbeat,
 		RunE:    RunHandler,
 	}
@@ -1333,13 +2287,37 @@ func NewCLI() *cobra.Command {
 	runCmd.Flags().String("keepalive", "", "Duration to keep a model loaded (e.g. 5m)")
 	runCmd.Flags().Bool("verbose", false, "Show timings for response")
 	runCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	runCmd.Flags().Bool("accept-license", false, "Accept the model's license without asking")
 	runCmd.Flags().Bool("nowordwrap", false, "Don't wrap words to the next line automatically")
 	runCmd.Flags().String("format", "", "Response format (e.g. json)")
+	runCmd.Flags().String("system", "", "Override the model's system message for this session, as text or @file")
+	runCmd.Flags().String("template", "", "Override the model's prompt template for this session, as text or @file")
+
+	chatCmd := &cobra.Command{
+		Use:     "chat MODEL",
+		Short:   "Send a conversation from a file to a model",
+		Long:    "Send the messages in a JSON file, an array of messages as sent to /api/chat with the paths of their images, to a model and print its reply. With --append, the reply is added to the file to continue the conversation.",
+		Args:    modelArgs(1, cobra.ExactArgs(1)),
+		PreRunE: checkServerHeartbeat,
+		RunE:    ChatHandler,
+	}
+
+	chatCmd.Flags().String("messages", "", "JSON file of the messages to send")
+	chatCmd.Flags().String("tools", "", "JSON file of the tools the model may call")
+	chatCmd.Flags().Bool("stream", false, "Print the reply as it's generated")
+	chatCmd.Flags().Bool("json", false, "Print the response as JSON, or each streamed response as a line of JSON")
+	chatCmd.Flags().Bool("append", false, "Append the reply to the messages file")
+	chatCmd.Flags().String("format", "", "Response format (e.g. json)")
+	chatCmd.Flags().String("keepalive", "", "Duration to keep a model loaded (e.g. 5m)")
+	chatCmd.Flags().Bool("verbose", false, "Show timings for response")
+	chatCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	chatCmd.Flags().Bool("accept-license", false, "Accept the model's license without asking")
+	_ = chatCmd.MarkFlagRequired("messages")
 
 	stopCmd := &cobra.Command{
 		Use:     "stop MODEL",
 		Short:   "Stop a running model",
-		Args:    cobra.ExactArgs(1),
+		Args:    modelArgs(1, cobra.ExactArgs(1)),
 		PreRunE: checkServerHeartbeat,
 		RunE:    StopHandler,
 	}
@@ -1355,22 +2333,30 @@ func NewCLI() *cobra.Command {
 	pullCmd := &cobra.Command{
 		Use:     "pull MODEL",
 		Short:   "Pull a model from a registry",
-		Args:    cobra.ExactArgs(1),
+		Args:    modelArgs(1, cobra.ExactArgs(1)),
 		PreRunE: checkServerHeartbeat,
 		RunE:    PullHandler,
 	}
 
 	pullCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pullCmd.Flags().Bool("accept-license", false, "Accept the model's license without asking")
+	pullCmd.Flags().Bool("cancel", false, "Cancel a pull of the model in progress")
+	pullCmd.Flags().Bool("discard", false, "With --cancel, remove the partial download instead of keeping it to resume")
+	pullCmd.Flags().StringSlice("variant", nil, "Quantizations to pull of a model with variants, e.g. q4_K_M (default all)")
+	pullCmd.Flags().Bool("strict", false, "Don't pull models whose architecture this version can't run")
 
 	pushCmd := &cobra.Command{
-		Use:     "push MODEL",
+		Use:     "push MODEL [DESTINATION]",
 		Short:   "Push a model to a registry",
-		Args:    cobra.ExactArgs(1),
+		Long:    "Push a model to a registry, as DESTINATION if it's given, without creating a local copy with that name.",
+		Args:    modelArgs(2, cobra.RangeArgs(1, 2)),
 		PreRunE: checkServerHeartbeat,
 		RunE:    PushHandler,
 	}
 
 	pushCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pushCmd.Flags().Bool("sign", false, "Sign the model with your Ollama key")
+	pushCmd.Flags().Bool("dry-run", false, "List the layers that would be uploaded without pushing")
 
 	listCmd := &cobra.Command{
 		Use:     "list",
@@ -1387,30 +2373,119 @@ func NewCLI() *cobra.Command {
 		RunE:    ListRunningHandler,
 	}
 
+	psCmd.Flags().Bool("slots", false, "Show the state of each model's parallel slots")
+
+	searchCmd := &cobra.Command{
+		Use:     "search QUERY",
+		Short:   "Search the registry for models",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    SearchHandler,
+	}
+
+	searchCmd.Flags().Bool("json", false, "Output the results as JSON")
+	searchCmd.Flags().Int("limit", 20, "Maximum number of models to show, or 0 for all")
+	searchCmd.Flags().String("sort", "pulls", "Sort models by pulls, updated or name")
+
 	copyCmd := &cobra.Command{
-		Use:     "cp SOURCE DESTINATION",
+		Use:     "cp SOURCE [DESTINATION]",
 		Short:   "Copy a model",
-		Args:    cobra.ExactArgs(2),
+		Args:    modelArgs(2, cobra.RangeArgs(1, 2)),
 		PreRunE: checkServerHeartbeat,
 		RunE:    CopyHandler,
 	}
 
+	copyCmd.Flags().String("remote", "", "Copy the model to another Ollama server, in the same form as OLLAMA_HOST")
+	copyCmd.Flags().String("remote-api-key", "", "API key for the --remote server (default OLLAMA_API_KEY)")
+
 	deleteCmd := &cobra.Command{
 		Use:     "rm MODEL [MODEL...]",
-		Short:   "Remove a model",
+		Short:   "Remove models",
+		Long:    "Remove models, which may be given as glob patterns such as \"myexp-*\". Models are removed after confirming when run from a terminal, and loaded models can't be removed without --unload.",
 		Args:    cobra.MinimumNArgs(1),
 		PreRunE: checkServerHeartbeat,
 		RunE:    DeleteHandler,
 	}
 
+	deleteCmd.Flags().BoolP("force", "f", false, "Remove without confirming")
+	deleteCmd.Flags().Bool("unload", false, "Unload models that are loaded before removing them")
+
+	storeCmd := &cobra.Command{
+		Use:   "store",
+		Short: "Maintain the model store",
+	}
+
+	dedupeCmd := &cobra.Command{
+		Use:     "dedupe [DIR...]",
+		Short:   "Replace duplicate blobs with hardlinks",
+		Long:    "Replace blobs stored more than once across the models directory and other models directories, such as copies of the store, with hardlinks. Other directories must be listed in the server's OLLAMA_DEDUPE_DIRS",
+		PreRunE: checkServerHeartbeat,
+		RunE:    DedupeHandler,
+	}
+
+	dedupeCmd.Flags().Bool("dry-run", false, "Report duplicates without linking them")
+
+	pruneCmd := &cobra.Command{
+		Use:     "prune",
+		Short:   "Remove unused blobs and report broken models",
+		Long:    "Remove blobs that aren't used by any model, and report models whose blobs are missing or incomplete, such as after an interrupted pull or create",
+		Args:    cobra.ExactArgs(0),
+		PreRunE: checkServerHeartbeat,
+		RunE:    PruneHandler,
+	}
+
+	pruneCmd.Flags().Bool("dry-run", false, "Report what would be removed without removing it")
+	pruneCmd.Flags().Bool("broken", false, "Remove broken models")
+	pruneCmd.Flags().Bool("verify", false, "Check the digest of every blob, not only that it exists")
+
+	storeCmd.AddCommand(dedupeCmd, pruneCmd)
+
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate models stored by older versions",
+		Long:  "Move models stored in legacy layouts under OLLAMA_MODELS into the current layout, verifying their blobs. The server does this when it starts unless OLLAMA_NOMIGRATE is set.",
+		Args:  cobra.ExactArgs(0),
+		RunE:  MigrateHandler,
+	}
+
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check hardware discovery and configuration",
+		Args:  cobra.ExactArgs(0),
+		RunE:  DoctorHandler,
+	}
+
+	loginCmd := &cobra.Command{
+		Use:   "login REGISTRY",
+		Short: "Store credentials for a registry",
+		Long:  "Store a username and password, or a token, that pulls and pushes use for REGISTRY, such as hf.co. Credentials are kept in the system keychain if there is one, otherwise in a file encrypted with your Ollama key. Only a server running as your user reads them, and it prefers them to HF_TOKEN.",
+		Args:  cobra.ExactArgs(1),
+		RunE:  LoginHandler,
+	}
+
+	loginCmd.Flags().StringP("username", "u", "", "Username, if the registry takes a password rather than a token")
+	loginCmd.Flags().Bool("password-stdin", false, "Read the password or token from standard input")
+
+	logoutCmd := &cobra.Command{
+		Use:   "logout [REGISTRY...]",
+		Short: "Remove stored credentials for registries",
+		RunE:  LogoutHandler,
+	}
+
+	logoutCmd.Flags().Bool("all", false, "Remove the credentials of every registry")
+
 	envVars := envconfig.AsMap()
 
-	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"]}
+	// OLLAMA_API_KEY isn't in envconfig.AsMap so it's never logged
+	apiKeyEnv := envconfig.EnvVar{Name: "OLLAMA_API_KEY", Description: "API key to authenticate with the server"}
+	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"], apiKeyEnv}
 
 	for _, cmd := range []*cobra.Command{
 		createCmd,
+		imatrixCmd,
 		showCmd,
 		runCmd,
+		chatCmd,
 		stopCmd,
 		pullCmd,
 		pushCmd,
@@ -1418,29 +2493,98 @@ func NewCLI() *cobra.Command {
 		psCmd,
 		copyCmd,
 		deleteCmd,
+		searchCmd,
 		serveCmd,
+		dedupeCmd,
+		pruneCmd,
+		doctorCmd,
+		loginCmd,
+		logoutCmd,
 	} {
 		switch cmd {
 		case runCmd:
-			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_NOHISTORY"]})
+			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_HOST"], apiKeyEnv, envVars["OLLAMA_NOHISTORY"], envVars["OLLAMA_STATS"]})
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["OLLAMA_DEBUG"],
 				envVars["OLLAMA_HOST"],
+				envVars["OLLAMA_SOCKET_MODE"],
+				envVars["OLLAMA_SOCKET_GROUP"],
+				envVars["OLLAMA_SOCKET_ALLOWED_UIDS"],
+				envVars["OLLAMA_DEFAULT_OPTIONS"],
+				envVars["OLLAMA_PRESETS"],
+				envVars["OLLAMA_ALIASES"],
 				envVars["OLLAMA_KEEP_ALIVE"],
+				envVars["OLLAMA_CACHE_RELEASE"],
+				envVars["OLLAMA_MAX_CHOICES"],
+				envVars["OLLAMA_MAX_CONTEXT"],
 				envVars["OLLAMA_MAX_LOADED_MODELS"],
 				envVars["OLLAMA_MAX_QUEUE"],
+				envVars["OLLAMA_MAX_QUEUE_PER_MODEL"],
 				envVars["OLLAMA_MODELS"],
+				envVars["OLLAMA_MODEL_REPLICAS"],
+				envVars["OLLAMA_STORAGE_BACKEND"],
 				envVars["OLLAMA_NUM_PARALLEL"],
 				envVars["OLLAMA_NOPRUNE"],
+				envVars["OLLAMA_NOMIGRATE"],
+				envVars["OLLAMA_NOTMPCLEANUP"],
+				envVars["OLLAMA_OFFLINE"],
+				envVars["OLLAMA_OTEL"],
+				envVars["OLLAMA_P2P"],
 				envVars["OLLAMA_ORIGINS"],
+				envVars["OLLAMA_PROMPT_CACHE_SIZE"],
+				envVars["OLLAMA_REGISTRY_PROXY"],
+				envVars["OLLAMA_DEFAULT_REGISTRY"],
+				envVars["OLLAMA_DEFAULT_NAMESPACE"],
+				envVars["OLLAMA_REMOTE_SERVERS"],
 				envVars["OLLAMA_SCHED_SPREAD"],
+				envVars["OLLAMA_TARGET_TTFT"],
+				envVars["OLLAMA_IDEMPOTENCY_TTL"],
+				envVars["OLLAMA_IDEMPOTENCY_CACHE_SIZE"],
+				envVars["OLLAMA_GENERATION_TTL"],
+				envVars["OLLAMA_GENERATION_BUFFER_SIZE"],
+				envVars["OLLAMA_MAX_SESSIONS"],
+				envVars["OLLAMA_SESSION_TTL"],
+				envVars["OLLAMA_SESSION_MAX_SIZE"],
+				envVars["OLLAMA_STREAM_BUFFER_SIZE"],
+				envVars["OLLAMA_LOCK_TIMEOUT"],
 				envVars["OLLAMA_TMPDIR"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
+				envVars["OLLAMA_FETCH_IMAGES"],
 				envVars["OLLAMA_LLM_LIBRARY"],
 				envVars["OLLAMA_GPU_OVERHEAD"],
 				envVars["OLLAMA_LOAD_TIMEOUT"],
+				envVars["OLLAMA_LOAD_PREFETCH"],
+				envVars["OLLAMA_RUNNER_WARM_POOL"],
+				envVars["OLLAMA_ALLOW_SWAP"],
+				envVars["OLLAMA_IMAGE_MAX_SIZE"],
+				envVars["OLLAMA_GPU_ORDER"],
+				envVars["OLLAMA_MAX_MODELS_PER_GPU"],
+				envVars["OLLAMA_USE_MMAP"],
+				envVars["OLLAMA_USE_MLOCK"],
+				envVars["OLLAMA_STREAM_FLUSH_INTERVAL"],
+				envVars["OLLAMA_STREAM_FLUSH_TOKENS"],
+				envVars["OLLAMA_MAX_BLOB_SIZE"],
+				envVars["OLLAMA_MAX_REQUEST_BODY"],
+				envVars["OLLAMA_READ_HEADER_TIMEOUT"],
+				envVars["OLLAMA_IDLE_TIMEOUT"],
+				envVars["OLLAMA_WRITE_TIMEOUT"],
+				envVars["OLLAMA_TRUSTED_SIGNERS"],
+				envVars["OLLAMA_SIGNATURE_POLICY"],
+				envVars["OLLAMA_API_KEYS"],
+				envVars["OLLAMA_SEARCH_FALLBACK"],
+				envVars["OLLAMA_AUTO_PULL"],
+				envVars["OLLAMA_AUTO_PULL_INTERVAL"],
+				envVars["OLLAMA_AUTO_PULL_WINDOW"],
+			})
+		case doctorCmd:
+			appendEnvDocs(cmd, []envconfig.EnvVar{
+				envVars["OLLAMA_DEBUG"],
+				envVars["HSA_OVERRIDE_GFX_VERSION"],
+				envVars["OLLAMA_ROCM_AUTO_OVERRIDE"],
 			})
+		case loginCmd, logoutCmd:
+			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_CREDENTIALS_STORE"]})
 		default:
 			appendEnvDocs(cmd, envs)
 		}
@@ -1449,8 +2593,10 @@ func NewCLI() *cobra.Command {
 	rootCmd.AddCommand(
 		serveCmd,
 		createCmd,
+		imatrixCmd,
 		showCmd,
 		runCmd,
+		chatCmd,
 		stopCmd,
 		pullCmd,
 		pushCmd,
@@ -1458,6 +2604,12 @@ func NewCLI() *cobra.Command {
 		psCmd,
 		copyCmd,
 		deleteCmd,
+		searchCmd,
+		storeCmd,
+		migrateCmd,
+		doctorCmd,
+		loginCmd,
+		logoutCmd,
 	)
 
 	return rootCmd
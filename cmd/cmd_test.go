@@ -2,15 +2,145 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/spf13/cobra"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+	"github.com/ollama/ollama/version"
 )
 
+func TestRunOverrides(t *testing.T) {
+	system := filepath.Join(t.TempDir(), "system.txt")
+	if err := os.WriteFile(system, []byte("You are a pirate.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &cobra.Command{}
+	cmd.Flags().String("system", "", "")
+	cmd.Flags().String("template", "", "")
+	cmd.Flags().Set("system", "@"+system)
+	cmd.Flags().Set("template", "{{ .Prompt }}")
+
+	var opts runOptions
+	var err error
+	if opts.System, err = flagValue(cmd, "system"); err != nil || opts.System != "You are a pirate.\n" {
+		t.Errorf("expected the system message to be read from the file, got %q %v", opts.System, err)
+	}
+
+	if opts.Template, err = flagValue(cmd, "template"); err != nil || opts.Template != "{{ .Prompt }}" {
+		t.Errorf("expected the template as given, got %q %v", opts.Template, err)
+	}
+
+	cmd.Flags().Set("template", "@"+filepath.Join(t.TempDir(), "missing"))
+	if _, err := flagValue(cmd, "template"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	cases := []struct {
+		name           string
+		opts           runOptions
+		modelTemplate  string
+		expectWarnings int
+	}{
+		{"template with system", runOptions{System: "s", Template: "{{ .System }} {{ .Prompt }}"}, "", 0},
+		{"template without system", runOptions{System: "s", Template: "{{ .Prompt }}"}, "{{ .System }}", 1},
+		{"messages template", runOptions{System: "s", Template: "{{ range .Messages }}{{ .Content }}{{ end }}"}, "", 0},
+		{"model template without system", runOptions{System: "s"}, "{{ .Prompt }}", 1},
+		{"template without prompt", runOptions{System: "s", Template: "hello"}, "", 2},
+		{"no model template", runOptions{System: "s"}, "", 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if warnings := overrideWarnings(tt.opts, tt.modelTemplate); len(warnings) != tt.expectWarnings {
+				t.Errorf("expected %d warnings, got %v", tt.expectWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestShowLayers(t *testing.T) {
+	manifest := &api.ManifestInfo{
+		Digest:       "sha256:aaa",
+		ConfigDigest: "sha256:ccc",
+		Size:         2000,
+		Layers: []api.LayerInfo{
+			{MediaType: "application/vnd.ollama.image.model", Digest: "sha256:bbb", Size: 1900, Variant: "Q4_0"},
+			{MediaType: "application/vnd.docker.container.image.v1+json", Digest: "sha256:ccc", Size: 10},
+		},
+	}
+
+	var b bytes.Buffer
+	showLayers(manifest, &b)
+
+	expect := `MEDIA TYPE                                        DIGEST        SIZE      VARIANT 
+model                                             sha256:bbb    1.9 KB    Q4_0       
+application/vnd.docker.container.image.v1+json    sha256:ccc    10 B                 
+
+manifest sha256:aaa, config sha256:ccc, 2 KB in total
+`
+	if diff := cmp.Diff(expect, b.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+
+	manifest.Path = "/models/manifests/m"
+	manifest.Layers[0].Path = "/models/blobs/sha256-bbb"
+	manifest.Layers[1].Missing = true
+
+	b.Reset()
+	showLayers(manifest, &b)
+
+	expect = `MEDIA TYPE                                        DIGEST        SIZE      VARIANT    PATH                     
+model                                             sha256:bbb    1.9 KB    Q4_0       /models/blobs/sha256-bbb    
+application/vnd.docker.container.image.v1+json    sha256:ccc    10 B                 missing                     
+
+manifest sha256:aaa, config sha256:ccc, 2 KB in total
+/models/manifests/m
+`
+	if diff := cmp.Diff(expect, b.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestShowSlots(t *testing.T) {
+	models := []api.ProcessModelResponse{
+		{Name: "llama3.2:latest", Slots: []api.SlotStatus{
+			{ID: 0, State: "decode", RequestID: "3f2a", TokensProcessed: 128, CacheTokens: 640},
+			{ID: 1, State: "idle", CacheTokens: 96},
+		}},
+		{Name: "qwen2.5:latest", Replica: 1},
+	}
+
+	var b bytes.Buffer
+	showSlots(models, &b)
+
+	expect := `NAME               SLOT    STATE     REQUEST    TOKENS    CACHED 
+llama3.2:latest    0       decode    3f2a       128       640       
+llama3.2:latest    1       idle                 0         96        
+`
+	if diff := cmp.Diff(expect, b.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+
+	b.Reset()
+	showSlots(models[1:], &b)
+	if b.String() != "No slots reported by the running models\n" {
+		t.Errorf("unexpected output %q", b.String())
+	}
+}
+
 func TestShowInfo(t *testing.T) {
 	t.Run("bare details", func(t *testing.T) {
 		var b bytes.Buffer
@@ -29,6 +159,62 @@ func TestShowInfo(t *testing.T) {
     parameters      7B      
     quantization    FP16    
 
+`
+
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := showInfo(&api.ShowResponse{
+			Details: api.ModelDetails{
+				Family:            "test",
+				ParameterSize:     "7B",
+				QuantizationLevel: "FP16",
+			},
+			Unsupported: &api.UnsupportedModelError{ErrorMessage: "GGUF v4 is not supported"},
+		}, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := `  Warning: GGUF v4 is not supported
+
+  Model
+    architecture    test    
+    parameters      7B      
+    quantization    FP16    
+
+`
+
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("capabilities", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := showInfo(&api.ShowResponse{
+			Details: api.ModelDetails{
+				Family:            "test",
+				ParameterSize:     "7B",
+				QuantizationLevel: "FP16",
+			},
+			Capabilities: []model.Capability{model.CapabilityCompletion, model.CapabilityTools},
+		}, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := `  Model
+    architecture    test    
+    parameters      7B      
+    quantization    FP16    
+
+  Capabilities
+    completion    
+    tools         
+
 `
 
 		if diff := cmp.Diff(expect, b.String()); diff != "" {
@@ -99,6 +285,91 @@ func TestShowInfo(t *testing.T) {
     stop           up       
     temperature    99       
 
+`
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("pooling override", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := showInfo(&api.ShowResponse{
+			Details: api.ModelDetails{
+				Family:            "test",
+				ParameterSize:     "7B",
+				QuantizationLevel: "FP16",
+			},
+			Pooling: &api.Pooling{
+				Metadata:  "mean",
+				Override:  "cls",
+				Effective: "cls",
+			},
+		}, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := `  Model
+    architecture    test                    
+    parameters      7B                      
+    pooling         cls (overrides mean)    
+    quantization    FP16                    
+
+`
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("loaded", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := showInfo(&api.ShowResponse{
+			Details: api.ModelDetails{
+				Family:            "test",
+				ParameterSize:     "7B",
+				QuantizationLevel: "FP16",
+			},
+			Loaded: &api.LoadSettings{UseMMap: false, UseMLock: true},
+		}, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := `  Model
+    architecture    test    
+    parameters      7B      
+    quantization    FP16    
+
+  Loaded
+    use_mmap     false    
+    use_mlock    true     
+
+`
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("signature", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := showInfo(&api.ShowResponse{
+			Details: api.ModelDetails{
+				Family:            "test",
+				ParameterSize:     "7B",
+				QuantizationLevel: "FP16",
+			},
+			Signature: &api.SignatureInfo{Signer: "build-pipeline", Status: "verified"},
+		}, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := `  Model
+    architecture    test    
+    parameters      7B      
+    quantization    FP16    
+
+  Signature
+    signer    build-pipeline    
+    status    verified          
+
 `
 		if diff := cmp.Diff(expect, b.String()); diff != "" {
 			t.Errorf("unexpected output (-want +got):\n%s", diff)
@@ -204,3 +475,145 @@ Weigh anchor!
 		}
 	})
 }
+
+func TestExpandModelNames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/tags" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+
+		json.NewEncoder(w).Encode(api.ListResponse{Models: []api.ListModelResponse{ //nolint:errcheck
+			{Name: "myexp-1:latest"},
+			{Name: "myexp-2:q4"},
+			{Name: "llama3:latest"},
+		}})
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := api.NewClient(u, http.DefaultClient)
+
+	cases := []struct {
+		args   []string
+		expect []string
+		err    bool
+	}{
+		{args: []string{"llama3", "mistral"}, expect: []string{"llama3", "mistral"}},
+		{args: []string{"myexp-*"}, expect: []string{"myexp-1:latest", "myexp-2:q4"}},
+		{args: []string{"myexp-*:latest", "myexp-1:latest"}, expect: []string{"myexp-1:latest"}},
+		{args: []string{"other-*"}, err: true},
+		{args: []string{"myexp-["}, err: true},
+	}
+
+	for _, tt := range cases {
+		names, err := expandModelNames(context.Background(), client, tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.args)
+			}
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(tt.expect, names); diff != "" {
+			t.Errorf("%v: mismatch (-want +got):\n%s", tt.args, diff)
+		}
+	}
+}
+
+func TestDeleteHandler(t *testing.T) {
+	var reqs []api.DeleteRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/api/delete" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+
+		var req api.DeleteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		reqs = append(reqs, req)
+		json.NewEncoder(w).Encode(api.DeleteResponse{Reclaimed: 1024}) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+
+	cases := []struct {
+		args   []string
+		expect api.DeleteRequest
+	}{
+		// stdin isn't a terminal, so models are removed without confirming
+		{[]string{"llama3"}, api.DeleteRequest{Model: "llama3"}},
+		{[]string{"llama3", "mistral", "--force"}, api.DeleteRequest{Model: "llama3", Models: []string{"mistral"}}},
+		{[]string{"llama3", "--unload"}, api.DeleteRequest{Model: "llama3", Force: true}},
+	}
+
+	for _, tt := range cases {
+		reqs = nil
+
+		cmd := &cobra.Command{RunE: DeleteHandler}
+		cmd.Flags().BoolP("force", "f", false, "")
+		cmd.Flags().Bool("unload", false, "")
+		cmd.SetArgs(tt.args)
+		cmd.SetOut(io.Discard)
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]api.DeleteRequest{tt.expect}, reqs); diff != "" {
+			t.Errorf("%v: mismatch (-want +got):\n%s", tt.args, diff)
+		}
+	}
+}
+
+func TestShowVersion(t *testing.T) {
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "0.3.9"
+
+	cases := []struct {
+		server string
+		expect string
+	}{
+		{"0.3.9", "ollama version is 0.3.9\n"},
+		{"0.3.10", "ollama version is 0.3.10\nclient version is 0.3.9\n"},
+		{"0.4.0", "ollama version is 0.4.0\nWarning: client version is 0.3.9\n"},
+		{"", "Warning: client version is 0.3.9\n"},
+	}
+
+	for _, tt := range cases {
+		var b bytes.Buffer
+		showVersion(&b, &api.VersionResponse{Version: tt.server}, false)
+		if b.String() != tt.expect {
+			t.Errorf("%q: expected %q, got %q", tt.server, tt.expect, b.String())
+		}
+	}
+
+	var b bytes.Buffer
+	showVersion(&b, &api.VersionResponse{
+		Version:   "0.3.9",
+		Commit:    "abcdef1",
+		GoVersion: "go1.22.5",
+		CPU:       &api.VersionCPU{Capability: "avx2", Runner: "cpu_avx2"},
+		Runners:   []string{"cpu", "cpu_avx2", "cuda_v12"},
+		Backends:  []api.VersionBackend{{Library: "cuda", Variant: "v12", Driver: "12.4", GPUs: 2}},
+	}, true)
+
+	for _, line := range []string{
+		"  Commit:    abcdef1\n",
+		"  Built:     unknown\n",
+		"  Runners:   cpu, cpu_avx2, cuda_v12\n",
+		"  Backends:  cuda v12, driver 12.4, 2 GPU(s)\n",
+		"Client:\n  Version:  0.3.9\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/format"
+)
+
+// ignoreFile lists files in the build context of `ollama create` that are
+// never uploaded, in gitignore syntax
+const ignoreFile = ".ollamaignore"
+
+// ignoreRule is a pattern from an ignore file
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnore parses gitignore patterns. Patterns without a slash, other than
+// a trailing one, match at any depth; others are relative to the file's
+// directory.
+func parseIgnore(r io.Reader) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		expr := globRegexp(line)
+		if !anchored {
+			expr = "(?:.*/)?" + expr
+		}
+
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", ignoreFile, scanner.Text(), err)
+		}
+
+		rule.re = re
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// globRegexp converts a gitignore glob to a regular expression
+func globRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return sb.String()
+}
+
+// buildContext is the directory relative paths in a Modelfile are resolved
+// against, along with the rules of its ignore file
+type buildContext struct {
+	dir   string
+	rules []ignoreRule
+}
+
+func newBuildContext(dir string) (*buildContext, error) {
+	bc := &buildContext{dir: dir}
+
+	f, err := os.Open(filepath.Join(dir, ignoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return bc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if bc.rules, err = parseIgnore(f); err != nil {
+		return nil, err
+	}
+
+	return bc, nil
+}
+
+// excluded reports whether path is excluded by the ignore file. Paths outside
+// of the build context are never excluded, and neither are the files of
+// excluded directories re-included, as with gitignore.
+func (bc *buildContext) excluded(path string, isDir bool) bool {
+	rel, err := filepath.Rel(bc.dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i < len(parts); i++ {
+		if bc.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return bc.match(strings.Join(parts, "/"), isDir)
+}
+
+// match applies the rules to a single path, the last matching rule winning
+func (bc *buildContext) match(rel string, isDir bool) bool {
+	var excluded bool
+	for _, rule := range bc.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.re.MatchString(rel) {
+			excluded = !rule.negate
+		}
+	}
+
+	return excluded
+}
+
+// modelFiles returns the files of a safetensors or pytorch model directory
+// that converting it needs, leaving out the ones that are excluded
+func (bc *buildContext) modelFiles(dir string) ([]string, error) {
+	detectContentType := func(path string) (string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		var b bytes.Buffer
+		b.Grow(512)
+
+		if _, err := io.CopyN(&b, f, 512); err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+
+		contentType, _, _ := strings.Cut(http.DetectContentType(b.Bytes()), ";")
+		return contentType, nil
+	}
+
+	checkContentType := func(files []string, contentType string) error {
+		for _, file := range files {
+			if ct, err := detectContentType(file); err != nil {
+				return err
+			} else if ct != contentType {
+				return fmt.Errorf("invalid content type: expected %s for %s", ct, file)
+			}
+		}
+
+		return nil
+	}
+
+	glob := func(pattern, contentType string) ([]string, error) {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		matches = slices.DeleteFunc(matches, func(match string) bool {
+			return bc.excluded(match, false)
+		})
+
+		if err := checkContentType(matches, contentType); err != nil {
+			return nil, err
+		}
+
+		return matches, nil
+	}
+
+	var files []string
+	if st, err := bc.indexedFiles(dir, "model.safetensors.index.json"); err != nil {
+		return nil, err
+	} else if len(st) > 0 {
+		// sharded models only need the shards in their index, not other
+		// checkpoints saved alongside them
+		if err := checkContentType(st, "application/octet-stream"); err != nil {
+			return nil, err
+		}
+		files = append(files, st...)
+	} else if st, _ := glob("model*.safetensors", "application/octet-stream"); len(st) > 0 {
+		// safetensors files might be unresolved git lfs references; skip if they are
+		// covers model-x-of-y.safetensors, model.fp32-x-of-y.safetensors, model.safetensors
+		files = append(files, st...)
+	} else if st, _ := glob("adapters.safetensors", "application/octet-stream"); len(st) > 0 {
+		// covers adapters.safetensors
+		files = append(files, st...)
+	} else if st, _ := glob("adapter_model.safetensors", "application/octet-stream"); len(st) > 0 {
+		// covers adapter_model.safetensors
+		files = append(files, st...)
+	} else if pt, _ := glob("pytorch_model*.bin", "application/zip"); len(pt) > 0 {
+		// pytorch files might also be unresolved git lfs references; skip if they are
+		// covers pytorch_model-x-of-y.bin, pytorch_model.fp32-x-of-y.bin, pytorch_model.bin
+		files = append(files, pt...)
+	} else if pt, _ := glob("consolidated*.pth", "application/zip"); len(pt) > 0 {
+		// pytorch files might also be unresolved git lfs references; skip if they are
+		// covers consolidated.x.pth, consolidated.pth
+		files = append(files, pt...)
+	} else {
+		return nil, errors.New("no safetensors or torch files found")
+	}
+
+	// add the configuration and tokenizer files the conversion reads, json
+	// files are detected as text/plain
+	for _, name := range []string{
+		"config.json",
+		"adapter_config.json",
+		"tokenizer.json",
+		"tokenizer_config.json",
+		"added_tokens.json",
+		"special_tokens_map.json",
+	} {
+		js, err := glob(name, "text/plain")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, js...)
+	}
+
+	// bert models also read their pooling configuration
+	if arch, _ := modelArchitecture(dir); arch == "BertModel" {
+		pooling, err := bc.poolingFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, pooling...)
+	}
+
+	if tks, _ := glob("tokenizer.model", "application/octet-stream"); len(tks) > 0 {
+		// add tokenizer.model if it exists
+		// tokenizer.model might be a unresolved git lfs reference; error if it is
+		files = append(files, tks...)
+	} else if tks, _ := glob("*/tokenizer.model", "text/plain"); len(tks) > 0 {
+		// some times tokenizer.model is in a subdirectory (e.g. meta-llama/Meta-Llama-3-8B)
+		files = append(files, tks...)
+	}
+
+	return files, nil
+}
+
+// indexedFiles returns the shards listed in the weight map of a sharded
+// model's index, or nil if there's no index
+func (bc *buildContext) indexedFiles(dir, index string) ([]string, error) {
+	bts, err := os.ReadFile(filepath.Join(dir, index))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var idx struct {
+		WeightMap map[string]string `json:"weight_map"`
+	}
+	if err := json.Unmarshal(bts, &idx); err != nil {
+		return nil, fmt.Errorf("%s: %w", index, err)
+	}
+
+	var files []string
+	for _, shard := range idx.WeightMap {
+		file := filepath.Join(dir, shard)
+		if !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+
+	slices.Sort(files)
+	for _, file := range files {
+		if bc.excluded(file, false) {
+			return nil, fmt.Errorf("%s is listed in %s but excluded by %s", file, index, ignoreFile)
+		}
+	}
+
+	return files, nil
+}
+
+// poolingFiles returns modules.json and the configuration of the pooling
+// module it lists
+func (bc *buildContext) poolingFiles(dir string) ([]string, error) {
+	path := filepath.Join(dir, "modules.json")
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var modules []struct {
+		Type string `json:"type"`
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(bts, &modules); err != nil {
+		return nil, fmt.Errorf("modules.json: %w", err)
+	}
+
+	files := []string{path}
+	for _, m := range modules {
+		if m.Type == "sentence_transformers.models.Pooling" {
+			files = append(files, filepath.Join(dir, m.Path, "config.json"))
+			break
+		}
+	}
+
+	return slices.DeleteFunc(files, func(file string) bool {
+		return bc.excluded(file, false)
+	}), nil
+}
+
+// modelArchitecture returns the architecture in a model directory's
+// config.json
+func modelArchitecture(dir string) (string, error) {
+	bts, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return "", err
+	}
+
+	var config struct {
+		Architectures []string `json:"architectures"`
+	}
+	if err := json.Unmarshal(bts, &config); err != nil {
+		return "", err
+	}
+
+	if len(config.Architectures) == 0 {
+		return "", errors.New("unknown architecture")
+	}
+
+	return config.Architectures[0], nil
+}
+
+// upload is a file, or the files of a model directory zipped together, that
+// `ollama create` uploads for a command of the Modelfile
+type upload struct {
+	command int
+	path    string
+
+	// files is set for model directories
+	files []string
+}
+
+// printUploads lists the files that will be uploaded and their total size
+func printUploads(w io.Writer, uploads []upload) error {
+	var total int64
+	line := func(name, file string) error {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%-56s %10s\n", name, format.HumanBytes(fi.Size()))
+		total += fi.Size()
+		return nil
+	}
+
+	for _, u := range uploads {
+		if u.files == nil {
+			if err := line(u.path, u.path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Fprintf(w, "%s%c\n", u.path, filepath.Separator)
+		for _, file := range u.files {
+			name, err := filepath.Rel(u.path, file)
+			if err != nil {
+				return err
+			}
+
+			if err := line("  "+name, file); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "total upload size %s\n", format.HumanBytes(total))
+	return nil
+}
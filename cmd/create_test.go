@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIgnore(t *testing.T) {
+	rules, err := parseIgnore(strings.NewReader(`# checkpoints
+optimizer*.pt
+/datasets/
+runs/**/*.json
+!runs/keep/*.json
+logs/
+!logs/important.txt
+\#notes
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := &buildContext{dir: "/ctx", rules: rules}
+	cases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"optimizer.pt", false, true},
+		{"model/optimizer-00001.pt", false, true},
+		{"model/model.safetensors", false, false},
+		{"datasets", true, true},
+		{"datasets/train.json", false, true},
+		{"model/datasets/train.json", false, false},
+		{"runs/a/b/metrics.json", false, true},
+		{"runs/keep/metrics.json", false, false},
+		// files of an excluded directory can't be re-included
+		{"logs/important.txt", false, true},
+		{"#notes", false, true},
+	}
+
+	for _, tt := range cases {
+		if excluded := bc.excluded(filepath.Join("/ctx", tt.path), tt.isDir); excluded != tt.excluded {
+			t.Errorf("%s: expected excluded %v, got %v", tt.path, tt.excluded, excluded)
+		}
+	}
+
+	if bc.excluded("/elsewhere/optimizer.pt", false) {
+		t.Error("expected files outside of the build context not to be excluded")
+	}
+}
+
+func TestModelFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, b []byte) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	weights := make([]byte, 16)
+	write("config.json", []byte(`{"architectures": ["LlamaForCausalLM"]}`))
+	write("tokenizer.json", []byte(`{}`))
+	write("model.safetensors.index.json", []byte(`{"weight_map": {"a": "model-00001-of-00002.safetensors", "b": "model-00002-of-00002.safetensors", "c": "model-00001-of-00002.safetensors"}}`))
+	write("model-00001-of-00002.safetensors", weights)
+	write("model-00002-of-00002.safetensors", weights)
+	write("model-fp32-00001-of-00001.safetensors", weights)
+	write("optimizer.pt", weights)
+	write("datasets/train.json", []byte(`{}`))
+	write("special_tokens_map.json", []byte(`{}`))
+	write(ignoreFile, []byte("special_tokens_map.json\n"))
+
+	bc, err := newBuildContext(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := bc.modelFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+
+	expect := []string{
+		"model-00001-of-00002.safetensors",
+		"model-00002-of-00002.safetensors",
+		"config.json",
+		"tokenizer.json",
+	}
+
+	if diff := cmp.Diff(expect, names); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+
+	var b bytes.Buffer
+	if err := printUploads(&b, []upload{{path: dir, files: files}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(b.String(), "total upload size 73 B\n") {
+		t.Errorf("expected the total size of the files, got %q", b.String())
+	}
+
+	write(ignoreFile, []byte("model-00002-*\n"))
+	if bc, err = newBuildContext(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bc.modelFiles(dir); err == nil || !strings.Contains(err.Error(), "excluded by .ollamaignore") {
+		t.Errorf("expected an error for an excluded shard, got %v", err)
+	}
+}
@@ -63,6 +63,7 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 		fmt.Fprintln(os.Stderr, "  /set noformat          Disable formatting")
 		fmt.Fprintln(os.Stderr, "  /set verbose           Show LLM stats")
 		fmt.Fprintln(os.Stderr, "  /set quiet             Disable LLM stats")
+		fmt.Fprintln(os.Stderr, "  /set stats on|off      Show tokens/s and context usage while responding")
 		fmt.Fprintln(os.Stderr, "")
 	}
 
@@ -124,6 +125,8 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 		scanner.HistoryDisable()
 	}
 
+	opts.Stats = newStatsLine(envconfig.Stats())
+
 	fmt.Print(readline.StartBracketedPaste)
 	defer fmt.Printf(readline.EndBracketedPaste)
 
@@ -131,12 +134,22 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 	var multiline MultilineState
 
 	for {
+		if interrupts.exiting() {
+			return nil
+		}
+
 		line, err := scanner.Readline()
 		switch {
 		case errors.Is(err, io.EOF):
 			fmt.Println()
 			return nil
 		case errors.Is(err, readline.ErrInterrupt):
+			// a second ctrl-c just after cancelling a response exits
+			if interrupts.recent() {
+				fmt.Println()
+				return nil
+			}
+
 			if line == "" {
 				fmt.Println("\nUse Ctrl + d or /bye to exit.")
 			}
@@ -195,6 +208,7 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 			}
 			opts.Model = args[1]
 			opts.Messages = []api.Message{}
+			opts.Stats.reset(true)
 			fmt.Printf("Loading model '%s'\n", opts.Model)
 			if err := loadOrUnloadModel(cmd, &opts); err != nil {
 				return err
@@ -234,6 +248,7 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 				newMessage := api.Message{Role: "system", Content: opts.System}
 				opts.Messages = append(opts.Messages, newMessage)
 			}
+			opts.Stats.reset(false)
 			fmt.Println("Cleared session context")
 			continue
 		case strings.HasPrefix(line, "/set"):
@@ -260,6 +275,21 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 						return err
 					}
 					fmt.Println("Set 'quiet' mode.")
+				case "stats":
+					if len(args) < 3 || (args[2] != "on" && args[2] != "off") {
+						fmt.Println("Invalid or missing value. Use '/set stats on' or '/set stats off'")
+						continue
+					}
+
+					opts.Stats.enabled = args[2] == "on"
+					switch {
+					case !opts.Stats.enabled:
+						fmt.Println("Disabled stats.")
+					case !opts.Stats.tty:
+						fmt.Println("Enabled stats, which are only shown when output is a terminal.")
+					default:
+						fmt.Println("Enabled stats.")
+					}
 				case "format":
 					if len(args) < 3 || args[2] != "json" {
 						fmt.Println("Invalid or missing format. For 'json' mode use '/set format json'")
@@ -383,7 +413,9 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 						fmt.Println("No system message was specified for this model.")
 					}
 				case "template":
-					if resp.Template != "" {
+					if opts.Template != "" {
+						fmt.Println(opts.Template)
+					} else if resp.Template != "" {
 						fmt.Println(resp.Template)
 					} else {
 						fmt.Println("No prompt template was specified for this model.")
@@ -456,7 +488,9 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 			opts.Messages = append(opts.Messages, newMessage)
 
 			assistant, err := chat(cmd, opts)
-			if err != nil {
+			if errors.Is(err, errExit) {
+				return nil
+			} else if err != nil && !errors.Is(err, errInterrupted) {
 				return err
 			}
 			if assistant != nil {
@@ -476,6 +510,10 @@ func buildModelfile(opts runOptions) string {
 		f.Commands = append(f.Commands, parser.Command{Name: "system", Args: opts.System})
 	}
 
+	if opts.Template != "" {
+		f.Commands = append(f.Commands, parser.Command{Name: "template", Args: opts.Template})
+	}
+
 	keys := maps.Keys(opts.Options)
 	slices.Sort(keys)
 	for _, k := range keys {
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// interruptWindow is how soon after cancelling a response a second ctrl-c
+// exits instead
+const interruptWindow = 2 * time.Second
+
+var (
+	// errInterrupted is the cause of a request cancelled by ctrl-c
+	errInterrupted = errors.New("interrupted")
+
+	// errExit is the cause of a request cancelled by a second ctrl-c
+	errExit = errors.New("exit")
+)
+
+// interrupter turns ctrl-c into cancelling the request in flight. The signal
+// is only handled while a request is in flight, so between requests ctrl-c
+// behaves as usual.
+type interrupter struct {
+	mu     sync.Mutex
+	cancel context.CancelCauseFunc
+	last   time.Time
+	exit   bool
+}
+
+var interrupts interrupter
+
+// withCancel returns a context that the next ctrl-c cancels with
+// errInterrupted, or with errExit if it follows another within
+// interruptWindow. The returned function must be called once the request is
+// done, which stops handling the signal.
+func (i *interrupter) withCancel(ctx context.Context) (context.Context, context.CancelFunc) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				i.interrupt()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	i.mu.Lock()
+	i.cancel = cancel
+	i.mu.Unlock()
+
+	return ctx, func() {
+		signal.Stop(ch)
+		close(done)
+
+		i.mu.Lock()
+		i.cancel = nil
+		i.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+func (i *interrupter) interrupt() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	i.exit = i.exit || now.Sub(i.last) < interruptWindow
+	i.last = now
+
+	if i.cancel != nil {
+		if i.exit {
+			i.cancel(errExit)
+		} else {
+			i.cancel(errInterrupted)
+		}
+	}
+}
+
+// recent reports whether a request was interrupted within interruptWindow, in
+// which case another ctrl-c, even one read as input, should exit
+func (i *interrupter) recent() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return time.Since(i.last) < interruptWindow
+}
+
+// exiting reports whether ctrl-c was pressed twice within interruptWindow
+func (i *interrupter) exiting() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.exit
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"testing"
+	"time"
+)
+
+func TestInterrupter(t *testing.T) {
+	var i interrupter
+
+	ctx, cancel := i.withCancel(context.Background())
+	i.interrupt()
+	if cause := context.Cause(ctx); !errors.Is(cause, errInterrupted) {
+		t.Errorf("expected the first interrupt to cancel the request, got %v", cause)
+	}
+	cancel()
+
+	if i.exiting() || !i.recent() {
+		t.Error("expected the first interrupt to only cancel the request")
+	}
+
+	ctx, cancel = i.withCancel(context.Background())
+	defer cancel()
+
+	i.interrupt()
+	if cause := context.Cause(ctx); !errors.Is(cause, errExit) {
+		t.Errorf("expected a second interrupt to exit, got %v", cause)
+	}
+
+	if !i.exiting() {
+		t.Error("expected a second interrupt to exit")
+	}
+}
+
+func TestInterrupterSignal(t *testing.T) {
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var i interrupter
+	ctx, cancel := i.withCancel(context.Background())
+	if err := p.Signal(os.Interrupt); err != nil {
+		cancel()
+		t.Skipf("can't send ctrl-c: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected ctrl-c to cancel the request")
+	}
+	cancel()
+
+	// Once the request is done the signal is left to others
+	i.mu.Lock()
+	i.last, i.exit = time.Time{}, false
+	i.mu.Unlock()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	defer signal.Stop(ch)
+
+	if err := p.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+
+	if i.recent() {
+		t.Error("expected ctrl-c not to be handled after the request")
+	}
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/ollama/ollama/auth"
+)
+
+// storeNames describe the stores credentials are kept in
+var storeNames = map[string]string{
+	auth.StoreKeychain: "the system keychain",
+	auth.StoreFile:     "an encrypted file",
+}
+
+// LoginHandler stores credentials that pulls and pushes use for a registry.
+// The password or token is read from the terminal, or from standard input
+// with --password-stdin so it stays out of shell history.
+func LoginHandler(cmd *cobra.Command, args []string) error {
+	username, err := cmd.Flags().GetString("username")
+	if err != nil {
+		return err
+	}
+
+	fromStdin, err := cmd.Flags().GetBool("password-stdin")
+	if err != nil {
+		return err
+	}
+
+	var secret string
+	if fromStdin {
+		b, err := io.ReadAll(cmd.InOrStdin())
+		if err != nil {
+			return err
+		}
+		secret = strings.TrimRight(string(b), "\r\n")
+	} else {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return errors.New("use --password-stdin to read the password or token from standard input")
+		}
+
+		prompt := "Token: "
+		if username != "" {
+			prompt = "Password: "
+		}
+
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+
+	if secret == "" {
+		return errors.New("missing password or token")
+	}
+
+	// the file store's key is derived from the Ollama key
+	if err := initializeKeypair(); err != nil {
+		return err
+	}
+
+	store, err := auth.SetCredential(args[0], auth.Credential{Username: username, Secret: secret})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "Stored credentials for %s in %s\n", args[0], storeNames[store])
+	return nil
+}
+
+// LogoutHandler removes stored credentials. Registries without credentials
+// aren't an error so it can tear down CI environments unconditionally.
+func LogoutHandler(cmd *cobra.Command, args []string) error {
+	all, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case all && len(args) > 0:
+		return errors.New("use either --all or a registry")
+	case !all && len(args) == 0:
+		return errors.New("missing registry, or --all to remove every registry's credentials")
+	case all:
+		creds, err := auth.ListCredentials()
+		if err != nil {
+			return err
+		}
+
+		for _, c := range creds {
+			args = append(args, c.Registry)
+		}
+	}
+
+	for _, registry := range args {
+		if err := auth.DeleteCredential(registry); errors.Is(err, auth.ErrNoCredential) {
+			fmt.Fprintf(cmd.OutOrStdout(), "No stored credentials for %s\n", registry)
+		} else if err != nil {
+			return err
+		} else {
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed credentials for %s\n", registry)
+		}
+	}
+
+	return nil
+}
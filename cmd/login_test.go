@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/auth"
+)
+
+func TestLoginLogout(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OLLAMA_CREDENTIALS_STORE", "file")
+
+	run := func(t *testing.T, stdin string, args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		cmd := NewCLI()
+		cmd.SetIn(strings.NewReader(stdin))
+		cmd.SetOut(&out)
+		cmd.SetArgs(args)
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	if out := run(t, "hunter2\n", "login", "registry.example.com", "-u", "user", "--password-stdin"); out != "Stored credentials for registry.example.com in an encrypted file\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	run(t, "hf_token", "login", "hf.co", "--password-stdin")
+
+	c, err := auth.GetCredential("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if *c != (auth.Credential{Username: "user", Secret: "hunter2"}) {
+		t.Errorf("unexpected credential %+v", c)
+	}
+
+	if out := run(t, "", "logout", "registry.example.com"); out != "Removed credentials for registry.example.com\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	if out := run(t, "", "logout", "registry.example.com"); out != "No stored credentials for registry.example.com\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	run(t, "", "logout", "--all")
+	if creds, err := auth.ListCredentials(); err != nil {
+		t.Fatal(err)
+	} else if len(creds) > 0 {
+		t.Errorf("expected no credentials, got %v", creds)
+	}
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/progress"
+)
+
+// transferProgress shows the progress of a pull, push or create: a bar for
+// each layer transferred, and a spinner for each other step. Responses from
+// servers that report phases are shown by their phase, and those from older
+// servers by whether they have a digest.
+type transferProgress struct {
+	p    *progress.Progress
+	bars map[string]*progress.Bar
+
+	// verb describes the transfer of layers by servers that don't report
+	// phases
+	verb string
+
+	status  string
+	spinner *progress.Spinner
+}
+
+func newTransferProgress(p *progress.Progress, verb string) *transferProgress {
+	return &transferProgress{p: p, bars: make(map[string]*progress.Bar), verb: verb}
+}
+
+// transferVerb returns how the transfer of a layer reported by resp is
+// described, or "" if resp doesn't report one
+func (t *transferProgress) transferVerb(resp api.ProgressResponse) string {
+	if resp.Digest == "" {
+		return ""
+	}
+
+	switch resp.Phase {
+	case api.PhaseDownloading:
+		return "pulling"
+	case api.PhaseUploading:
+		return "pushing"
+	case "":
+		return t.verb
+	default:
+		return ""
+	}
+}
+
+// transferLabel returns the label of the bar for the transfer of a layer
+// reported by resp, which names peers layers are pulled from
+func transferLabel(verb string, resp api.ProgressResponse) string {
+	if resp.Source == api.SourcePeer {
+		return fmt.Sprintf("%s %s from peer...", verb, resp.Digest[7:19])
+	}
+
+	return fmt.Sprintf("%s %s...", verb, resp.Digest[7:19])
+}
+
+// update shows resp
+func (t *transferProgress) update(resp api.ProgressResponse) error {
+	if verb := t.transferVerb(resp); verb != "" {
+		t.stop()
+
+		bar, ok := t.bars[resp.Digest]
+		if !ok {
+			bar = progress.NewBar(transferLabel(verb, resp), resp.Total, resp.Completed)
+			t.bars[resp.Digest] = bar
+			t.p.Add(resp.Digest, bar)
+		}
+
+		bar.Set(resp.Completed)
+	} else if resp.Total > 0 && t.spinner != nil && resp.Digest == "" {
+		// progress within a step, such as the tensor being quantized,
+		// replaces the step's status
+		t.status = resp.Status
+		t.spinner.SetMessage(t.status)
+	} else if t.status != resp.Status {
+		t.stop()
+
+		t.status = resp.Status
+		t.spinner = progress.NewSpinner(t.status)
+		t.p.Add(t.status, t.spinner)
+	}
+
+	return nil
+}
+
+// stop stops the spinner of the current step
+func (t *transferProgress) stop() {
+	if t.spinner != nil {
+		t.spinner.Stop()
+	}
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestTransferVerb(t *testing.T) {
+	const digest = "sha256:12e97362c3814d20abf8273525951884c80fd238e8cab3f3a657ca7de3766ca7"
+
+	cases := []struct {
+		name   string
+		resp   api.ProgressResponse
+		expect string
+	}{
+		{"downloading", api.ProgressResponse{Digest: digest, Phase: api.PhaseDownloading}, "pulling"},
+		{"uploading", api.ProgressResponse{Digest: digest, Phase: api.PhaseUploading}, "pushing"},
+		{"other phase", api.ProgressResponse{Digest: digest, Phase: api.PhaseResolving}, ""},
+		{"no digest", api.ProgressResponse{Phase: api.PhaseDownloading}, ""},
+		{"older server", api.ProgressResponse{Digest: digest}, "pushing"},
+		{"older server without digest", api.ProgressResponse{Status: "writing manifest"}, ""},
+	}
+
+	p := newTransferProgress(nil, "pushing")
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.transferVerb(tt.resp); got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestTransferLabel(t *testing.T) {
+	const digest = "sha256:12e97362c3814d20abf8273525951884c80fd238e8cab3f3a657ca7de3766ca7"
+
+	cases := []struct {
+		name   string
+		resp   api.ProgressResponse
+		expect string
+	}{
+		{"registry", api.ProgressResponse{Digest: digest, Source: api.SourceRegistry}, "pulling 12e97362c381..."},
+		{"peer", api.ProgressResponse{Digest: digest, Source: api.SourcePeer}, "pulling 12e97362c381 from peer..."},
+		{"older server", api.ProgressResponse{Digest: digest}, "pulling 12e97362c381..."},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transferLabel("pulling", tt.resp); got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
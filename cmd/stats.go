@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/ollama/ollama/api"
+)
+
+// statsLine shows the tokens per second of a response as it streams in ollama
+// run, and how much of the model's context the conversation fills, on the
+// line below the response. It's cleared once the response ends, and never
+// shown unless stdout is a terminal.
+//
+// The line is drawn by moving down from the response and back with the
+// cursor saved, having first made sure there is a line below it to move to,
+// so the response is written as it would be without it.
+type statsLine struct {
+	out     io.Writer
+	tty     bool
+	enabled bool
+
+	// used is the number of tokens of the conversation as of the last
+	// response, and numCtx the context length of the model it was generated
+	// with, or 0 if it isn't known
+	used   int
+	numCtx int
+
+	first  time.Time
+	tokens int
+	shown  bool
+
+	rate    string
+	updated time.Time
+}
+
+const (
+	// statsRefresh is how often the tokens per second are recomputed
+	statsRefresh = 250 * time.Millisecond
+
+	escSave    = "\x1b7"
+	escRestore = "\x1b8"
+	escDown    = "\x1bD" // down a line, scrolling at the bottom of the screen
+	escUp      = "\x1bM"
+	escClear   = "\r\x1b[2K"
+	escDim     = "\x1b[2m"
+	escReset   = "\x1b[0m"
+)
+
+func newStatsLine(enabled bool) *statsLine {
+	return &statsLine{
+		out:     os.Stdout,
+		tty:     term.IsTerminal(int(os.Stdout.Fd())),
+		enabled: enabled,
+	}
+}
+
+func (s *statsLine) active() bool {
+	return s != nil && s.enabled && s.tty
+}
+
+// reset forgets the conversation, as when it's cleared or another model is
+// loaded
+func (s *statsLine) reset(model bool) {
+	if s == nil {
+		return
+	}
+
+	s.used = 0
+	if model {
+		s.numCtx = 0
+	}
+}
+
+// begin starts counting a new response
+func (s *statsLine) begin() {
+	if s == nil {
+		return
+	}
+
+	s.first, s.tokens, s.rate = time.Time{}, 0, ""
+}
+
+// clear removes the line, before more of the response is written over it
+func (s *statsLine) clear() {
+	if !s.active() || !s.shown {
+		return
+	}
+
+	fmt.Fprint(s.out, escSave+escDown+escClear+escRestore)
+	s.shown = false
+}
+
+// update counts a streamed response and redraws the line
+func (s *statsLine) update(resp api.ChatResponse) {
+	if s == nil {
+		return
+	}
+
+	if resp.NumCtx > 0 {
+		s.numCtx = resp.NumCtx
+	}
+
+	if resp.Done {
+		s.used = resp.PromptEvalCount + resp.EvalCount
+		s.clear()
+		return
+	}
+
+	if resp.Message.Content == "" && resp.Message.Thinking == "" {
+		return
+	}
+
+	now := time.Now()
+	if s.first.IsZero() {
+		s.first = now
+	}
+	s.tokens++
+
+	if !s.active() {
+		return
+	}
+
+	if elapsed := now.Sub(s.first); s.tokens > 1 && (s.rate == "" || now.Sub(s.updated) >= statsRefresh) {
+		s.rate = fmt.Sprintf("%.1f tok/s", float64(s.tokens-1)/elapsed.Seconds())
+		s.updated = now
+	}
+
+	// the line below is made first, scrolling the response up if it's at
+	// the bottom of the screen, so the cursor can be saved where it is
+	fmt.Fprint(s.out, escDown+escUp+escSave+escDown+escClear+escDim+s.String()+escReset+escRestore)
+	s.shown = true
+}
+
+// String returns the text of the line. The context usage while a response
+// streams is that of the conversation before it plus its tokens so far, as
+// the tokens of the prompt are only counted once it ends.
+func (s *statsLine) String() string {
+	var parts []string
+	if s.rate != "" {
+		parts = append(parts, s.rate)
+	}
+
+	used := formatTokens(s.used + s.tokens)
+	if s.numCtx > 0 {
+		used += "/" + formatTokens(s.numCtx)
+	}
+	parts = append(parts, used+" ctx")
+
+	return strings.Join(parts, " · ")
+}
+
+// formatTokens formats a number of tokens as context lengths are usually
+// given, e.g. 3.1k or 8k for 8192
+func formatTokens(n int) string {
+	if n < 1024 {
+		return strconv.Itoa(n)
+	}
+
+	k := strconv.FormatFloat(float64(n)/1024, 'f', 1, 64)
+	return strings.TrimSuffix(k, ".0") + "k"
+}
+
+// contextLength returns the context length model is loaded with, for servers
+// that don't report it in responses, or 0 if it isn't loaded
+func contextLength(ctx context.Context, client *api.Client, model string) int {
+	resp, err := client.ListRunning(ctx)
+	if err != nil {
+		return 0
+	}
+
+	for _, m := range resp.Models {
+		if m.Name == model || m.Model == model || m.Name == model+":latest" {
+			return m.NumCtx
+		}
+	}
+
+	return 0
+}
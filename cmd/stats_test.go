@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestFormatTokens(t *testing.T) {
+	cases := map[int]string{
+		0:      "0",
+		812:    "812",
+		1024:   "1k",
+		3174:   "3.1k",
+		8192:   "8k",
+		131072: "128k",
+	}
+
+	for n, expect := range cases {
+		if got := formatTokens(n); got != expect {
+			t.Errorf("formatTokens(%d): expected %q, got %q", n, expect, got)
+		}
+	}
+}
+
+func TestStatsLine(t *testing.T) {
+	chunk := func(content string) api.ChatResponse {
+		return api.ChatResponse{Message: api.Message{Role: "assistant", Content: content}, Metrics: api.Metrics{NumCtx: 8192}}
+	}
+
+	t.Run("terminal", func(t *testing.T) {
+		var out bytes.Buffer
+		s := &statsLine{out: &out, tty: true, enabled: true, used: 3000}
+
+		s.begin()
+		s.update(api.ChatResponse{Status: "loading model"})
+		if out.Len() != 0 {
+			t.Errorf("expected nothing before the first token, got %q", out.String())
+		}
+
+		s.update(chunk("Hello"))
+		s.update(chunk(" world"))
+		if !strings.Contains(out.String(), "2.9k/8k ctx") || !strings.Contains(out.String(), "tok/s") {
+			t.Errorf("expected the rate and context usage, got %q", out.String())
+		}
+
+		// the cursor is returned to the response after each draw
+		if got := out.String(); !strings.HasPrefix(got, escDown+escUp+escSave) || !strings.HasSuffix(got, escRestore) {
+			t.Errorf("expected the line to be drawn below the response, got %q", got)
+		}
+
+		out.Reset()
+		s.update(api.ChatResponse{Done: true, Metrics: api.Metrics{PromptEvalCount: 3100, EvalCount: 2, NumCtx: 8192}})
+		if out.String() != escSave+escDown+escClear+escRestore {
+			t.Errorf("expected the line to be cleared once the response ends, got %q", out.String())
+		}
+
+		if s.used != 3102 {
+			t.Errorf("expected the conversation's tokens to be counted, got %d", s.used)
+		}
+
+		out.Reset()
+		s.clear()
+		if out.Len() != 0 {
+			t.Errorf("expected a cleared line not to be cleared again, got %q", out.String())
+		}
+	})
+
+	t.Run("not a terminal", func(t *testing.T) {
+		var out bytes.Buffer
+		s := &statsLine{out: &out, tty: false, enabled: true}
+
+		s.begin()
+		s.update(chunk("Hello"))
+		s.update(api.ChatResponse{Done: true, Metrics: api.Metrics{PromptEvalCount: 10, EvalCount: 1}})
+		s.clear()
+		if out.Len() != 0 {
+			t.Errorf("expected nothing to be written, got %q", out.String())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var out bytes.Buffer
+		s := &statsLine{out: &out, tty: true}
+
+		s.begin()
+		s.update(chunk("Hello"))
+		if out.Len() != 0 {
+			t.Errorf("expected nothing to be written, got %q", out.String())
+		}
+
+		// the conversation is still counted for when it's enabled
+		s.update(api.ChatResponse{Done: true, Metrics: api.Metrics{PromptEvalCount: 10, EvalCount: 1}})
+		if s.used != 11 {
+			t.Errorf("expected the conversation's tokens to be counted, got %d", s.used)
+		}
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var s *statsLine
+		s.begin()
+		s.update(chunk("Hello"))
+		s.clear()
+		s.reset(true)
+	})
+}
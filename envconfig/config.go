@@ -3,25 +3,38 @@ package envconfig
 import (
 	"fmt"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/ollama/ollama/format"
 )
 
 // Host returns the scheme and host. Host can be configured via the OLLAMA_HOST environment variable.
 // Default is scheme "http" and host "127.0.0.1:11434"
 func Host() *url.URL {
+	return ParseHost(Var("OLLAMA_HOST"))
+}
+
+// ParseHost returns the scheme and host of an Ollama server given in the same form as OLLAMA_HOST. A unix:// URL, such
+// as unix:///run/ollama.sock, is returned with the path of the socket.
+func ParseHost(s string) *url.URL {
 	defaultPort := "11434"
 
-	s := strings.TrimSpace(Var("OLLAMA_HOST"))
+	s = strings.TrimSpace(s)
 	scheme, hostport, ok := strings.Cut(s, "://")
 	switch {
+	case scheme == "unix":
+		return &url.URL{Scheme: scheme, Path: hostport}
 	case !ok:
 		scheme, hostport = "http", s
 	case scheme == "http":
@@ -53,6 +66,50 @@ func Host() *url.URL {
 	}
 }
 
+// RemoteServers returns the Ollama servers models may be placed on when they don't fit locally. RemoteServers can be configured via the OLLAMA_REMOTE_SERVERS environment variable
+// as a comma separated list of hosts in the same form as OLLAMA_HOST.
+func RemoteServers() (hosts []*url.URL) {
+	for _, s := range strings.Split(Var("OLLAMA_REMOTE_SERVERS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			hosts = append(hosts, ParseHost(s))
+		}
+	}
+
+	return hosts
+}
+
+// AutoPull returns the models the server keeps up to date with the registry. AutoPull can be configured via the OLLAMA_AUTO_PULL environment variable
+// as a comma separated list of model names.
+func AutoPull() (models []string) {
+	for _, s := range strings.Split(Var("OLLAMA_AUTO_PULL"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			models = append(models, s)
+		}
+	}
+
+	return models
+}
+
+// DedupeDirs returns the other models directories, such as copies of the store, that dedupe may replace blobs in with hardlinks.
+// DedupeDirs can be configured via the OLLAMA_DEDUPE_DIRS environment variable as a list of paths separated like PATH. Paths are
+// expanded like OLLAMA_MODELS, and invalid paths are ignored with a warning.
+func DedupeDirs() (dirs []string) {
+	for _, s := range filepath.SplitList(Var("OLLAMA_DEDUPE_DIRS")) {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		p, err := expandPath(s)
+		if err != nil {
+			slog.Warn("invalid OLLAMA_DEDUPE_DIRS path, ignoring", "value", s, "error", err)
+			continue
+		}
+		dirs = append(dirs, p)
+	}
+
+	return dirs
+}
+
 // Origins returns a list of allowed origins. Origins can be configured via the OLLAMA_ORIGINS environment variable.
 func Origins() (origins []string) {
 	if s := Var("OLLAMA_ORIGINS"); s != "" {
@@ -78,10 +135,20 @@ func Origins() (origins []string) {
 }
 
 // Models returns the path to the models directory. Models directory can be configured via the OLLAMA_MODELS environment variable.
+// Environment variables in the path are expanded as ${VAR}, or %VAR% on Windows, and a leading ~ is the home directory. The
+// path is cleaned, and paths that are relative, use variables that aren't set or contain characters the platform doesn't allow
+// in paths are ignored with a warning.
 // Default is $HOME/.ollama/models
 func Models() string {
 	if s := Var("OLLAMA_MODELS"); s != "" {
-		return s
+		p, err := expandPath(s)
+		if err == nil {
+			return p
+		}
+
+		if _, warned := invalidModels.LoadOrStore(s, true); !warned {
+			slog.Warn("invalid OLLAMA_MODELS, using default", "value", s, "error", err)
+		}
 	}
 
 	home, err := os.UserHomeDir()
@@ -92,6 +159,76 @@ func Models() string {
 	return filepath.Join(home, ".ollama", "models")
 }
 
+// invalidModels holds the invalid OLLAMA_MODELS values already warned about,
+// since Models is called for most requests
+var invalidModels sync.Map
+
+var (
+	bracedVarPattern  = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	windowsVarPattern = regexp.MustCompile(`%([^%\\/:]+)%`)
+)
+
+// expandPath expands the environment variables and leading ~ of the path s,
+// returning it cleaned. It fails for relative paths, which would depend on
+// the server's working directory, and for paths that can't be created.
+func expandPath(s string) (string, error) {
+	var unset []string
+	expand := func(pattern *regexp.Regexp) {
+		s = pattern.ReplaceAllStringFunc(s, func(m string) string {
+			name := pattern.FindStringSubmatch(m)[1]
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				unset = append(unset, name)
+			}
+			return v
+		})
+	}
+
+	expand(bracedVarPattern)
+	if runtime.GOOS == "windows" {
+		expand(windowsVarPattern)
+	}
+
+	if len(unset) > 0 {
+		return "", fmt.Errorf("environment variable %s isn't set", strings.Join(unset, ", "))
+	}
+
+	if s == "~" || strings.HasPrefix(s, "~/") || (runtime.GOOS == "windows" && strings.HasPrefix(s, `~\`)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		s = filepath.Join(home, s[1:])
+	}
+
+	if !filepath.IsAbs(s) {
+		// a path without a drive on Windows is on the current drive, but
+		// one with a drive and no root is relative to that drive's working
+		// directory
+		if runtime.GOOS != "windows" || !strings.ContainsAny(s[:1], `\/`) {
+			return "", fmt.Errorf("%q isn't an absolute path", s)
+		}
+
+		var err error
+		if s, err = filepath.Abs(s); err != nil {
+			return "", err
+		}
+	}
+
+	illegal := "\x00"
+	if runtime.GOOS == "windows" {
+		illegal = `<>:"|?*`
+	}
+
+	for _, r := range s[len(filepath.VolumeName(s)):] {
+		if strings.ContainsRune(illegal, r) || (runtime.GOOS == "windows" && r < 32) {
+			return "", fmt.Errorf("%q contains %q, which isn't allowed in paths", s, r)
+		}
+	}
+
+	return filepath.Clean(s), nil
+}
+
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the OLLAMA_KEEP_ALIVE environment variable.
 // Negative values are treated as infinite. Zero is treated as no keep alive.
 // Default is 5 minutes.
@@ -132,6 +269,144 @@ func LoadTimeout() (loadTimeout time.Duration) {
 	return loadTimeout
 }
 
+// CacheRelease returns how long a model may be idle before its KV cache is freed while its weights stay loaded. CacheRelease can be configured via the OLLAMA_CACHE_RELEASE environment variable.
+// Zero or Negative values disable releasing the cache, so it's only freed when the model unloads.
+// Default is disabled.
+func CacheRelease() (cacheRelease time.Duration) {
+	if s := Var("OLLAMA_CACHE_RELEASE"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			cacheRelease = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			cacheRelease = time.Duration(n) * time.Second
+		}
+	}
+
+	return max(cacheRelease, 0)
+}
+
+// StreamFlushInterval returns how often streamed responses are flushed, coalescing the tokens generated in between. StreamFlushInterval can be configured via the OLLAMA_STREAM_FLUSH_INTERVAL environment variable.
+// Zero or Negative values flush every token as it's generated.
+// Default is 0.
+func StreamFlushInterval() (interval time.Duration) {
+	if s := Var("OLLAMA_STREAM_FLUSH_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			interval = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			interval = time.Duration(n) * time.Millisecond
+		}
+	}
+
+	return max(interval, 0)
+}
+
+// LoadPrefetch returns whether model files are prefetched into the page cache with large parallel reads while they load. LoadPrefetch can be configured via the OLLAMA_LOAD_PREFETCH environment variable.
+// Default is enabled.
+func LoadPrefetch() bool {
+	if s := Var("OLLAMA_LOAD_PREFETCH"); s != "" {
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+		slog.Warn("invalid OLLAMA_LOAD_PREFETCH, using default", "value", s, "default", true)
+	}
+
+	return true
+}
+
+// Duration returns a function that parses the environment variable key as a duration. Numbers without a unit are seconds.
+// Zero or Negative values return 0, which disables the timeout it configures.
+func Duration(key string, defaultValue time.Duration) func() time.Duration {
+	return func() time.Duration {
+		s := Var(key)
+		if s == "" {
+			return defaultValue
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			n, nerr := strconv.ParseInt(s, 10, 64)
+			if nerr != nil {
+				slog.Warn("invalid environment variable, using default", "key", key, "value", s, "default", defaultValue)
+				return defaultValue
+			}
+			d = time.Duration(n) * time.Second
+		}
+
+		return max(d, 0)
+	}
+}
+
+var (
+	// ReadHeaderTimeout bounds how long a client may take to send request headers. ReadHeaderTimeout can be configured via the OLLAMA_READ_HEADER_TIMEOUT environment variable.
+	ReadHeaderTimeout = Duration("OLLAMA_READ_HEADER_TIMEOUT", 10*time.Second)
+	// IdleTimeout bounds how long an idle keep-alive connection is kept open. IdleTimeout can be configured via the OLLAMA_IDLE_TIMEOUT environment variable.
+	IdleTimeout = Duration("OLLAMA_IDLE_TIMEOUT", 2*time.Minute)
+	// WriteTimeout bounds how long a single write of a response may block on a client that isn't reading. It's reset before each write, so it doesn't limit how long a response may stream. WriteTimeout can be configured via the OLLAMA_WRITE_TIMEOUT environment variable.
+	WriteTimeout = Duration("OLLAMA_WRITE_TIMEOUT", time.Minute)
+	// TargetTTFT is the time to first token that requests predicted to exceed are rejected. Zero disables admission control.
+	// TargetTTFT can be configured via the OLLAMA_TARGET_TTFT environment variable.
+	TargetTTFT = Duration("OLLAMA_TARGET_TTFT", 0)
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key are kept to be replayed. IdempotencyTTL can be configured via the OLLAMA_IDEMPOTENCY_TTL environment variable.
+	IdempotencyTTL = Duration("OLLAMA_IDEMPOTENCY_TTL", 10*time.Minute)
+	// GenerationTTL is how long the responses of streamed generations are kept after they finish, for other clients to
+	// follow or fetch. GenerationTTL can be configured via the OLLAMA_GENERATION_TTL environment variable.
+	GenerationTTL = Duration("OLLAMA_GENERATION_TTL", 5*time.Minute)
+	// SessionTTL is how long chat sessions are kept after they were last used. SessionTTL can be configured via the
+	// OLLAMA_SESSION_TTL environment variable.
+	SessionTTL = Duration("OLLAMA_SESSION_TTL", 30*time.Minute)
+	// LockTimeout is how long a lock on the models directory may go without being refreshed by the server holding it before another server reclaims it. LockTimeout can be configured via the OLLAMA_LOCK_TIMEOUT environment variable.
+	// Zero means locks are never reclaimed.
+	LockTimeout = Duration("OLLAMA_LOCK_TIMEOUT", 2*time.Minute)
+)
+
+// GpuOrder returns how candidate GPUs are ordered before model placement. GpuOrder can be configured via the OLLAMA_GPU_ORDER environment variable.
+// Valid values are "free" (most free VRAM first), "index" (discovery order) and "memory" (most total VRAM first).
+// Default is "free".
+func GpuOrder() string {
+	s := strings.ToLower(Var("OLLAMA_GPU_ORDER"))
+	switch s {
+	case "free", "index", "memory":
+		return s
+	case "":
+		return "free"
+	}
+
+	slog.Warn("invalid OLLAMA_GPU_ORDER, using default", "value", s, "default", "free")
+	return "free"
+}
+
+// SignaturePolicy returns how pulls treat models that aren't signed by a trusted signer. SignaturePolicy can be configured via the OLLAMA_SIGNATURE_POLICY environment variable.
+// Valid values are "warn" (pull the model and log a warning) and "enforce" (reject the model). Signatures are only verified when OLLAMA_TRUSTED_SIGNERS is set,
+// and "enforce" without it rejects every pull.
+// Default is "warn".
+func SignaturePolicy() string {
+	s := strings.ToLower(Var("OLLAMA_SIGNATURE_POLICY"))
+	switch s {
+	case "warn", "enforce":
+		return s
+	case "":
+		return "warn"
+	}
+
+	slog.Warn("invalid OLLAMA_SIGNATURE_POLICY, using default", "value", s, "default", "warn")
+	return "warn"
+}
+
+// CredentialsStore returns where ollama login stores registry credentials. CredentialsStore can be configured via the
+// OLLAMA_CREDENTIALS_STORE environment variable. Valid values are "auto" (the OS keychain if there is one, otherwise
+// an encrypted file), "keychain" and "file". Default is "auto".
+func CredentialsStore() string {
+	s := strings.ToLower(Var("OLLAMA_CREDENTIALS_STORE"))
+	switch s {
+	case "auto", "keychain", "file":
+		return s
+	case "":
+		return "auto"
+	}
+
+	slog.Warn("invalid OLLAMA_CREDENTIALS_STORE, using default", "value", s, "default", "auto")
+	return "auto"
+}
+
 func Bool(k string) func() bool {
 	return func() bool {
 		if s := Var(k); s != "" {
@@ -154,14 +429,67 @@ var (
 	FlashAttention = Bool("OLLAMA_FLASH_ATTENTION")
 	// NoHistory disables readline history.
 	NoHistory = Bool("OLLAMA_NOHISTORY")
+	// Stats shows the tokens per second and context usage of responses as they stream in ollama run.
+	Stats = Bool("OLLAMA_STATS")
 	// NoPrune disables pruning of model blobs on startup.
 	NoPrune = Bool("OLLAMA_NOPRUNE")
+	// P2P announces the server to others on the LAN over mDNS, serves them the blobs of its models and pulls blobs from them before the registry.
+	P2P = Bool("OLLAMA_P2P")
+	// AllowSwap allows models to be placed in system memory that's only available as swap.
+	AllowSwap = Bool("OLLAMA_ALLOW_SWAP")
+	// NoMigrate disables migrating models stored in legacy layouts on startup.
+	NoMigrate = Bool("OLLAMA_NOMIGRATE")
+	// NoTmpCleanup disables removing temporary files left by operations that didn't finish on startup.
+	NoTmpCleanup = Bool("OLLAMA_NOTMPCLEANUP")
 	// SchedSpread allows scheduling models across all GPUs.
 	SchedSpread = Bool("OLLAMA_SCHED_SPREAD")
 	// IntelGPU enables experimental Intel GPU detection.
 	IntelGPU = Bool("OLLAMA_INTEL_GPU")
+	// FetchImages allows the OpenAI compatible API to download images referenced by http(s) URLs.
+	FetchImages = Bool("OLLAMA_FETCH_IMAGES")
+	// RocmAutoOverride applies a known working HSA_OVERRIDE_GFX_VERSION to unsupported AMD GPUs.
+	RocmAutoOverride = Bool("OLLAMA_ROCM_AUTO_OVERRIDE")
+	// Offline forbids requests to registries and other outbound network access, such as update checks and fetching image URLs.
+	Offline = Bool("OLLAMA_OFFLINE")
+	// OTel exports traces of requests over OTLP, configured by the standard OTEL_EXPORTER_OTLP_* variables.
+	OTel = Bool("OLLAMA_OTEL")
+)
+
+// TriState returns a function reading an environment variable that's either
+// true, false or auto. Auto, the default, returns nil, leaving the choice to
+// the caller.
+func TriState(k string) func() *bool {
+	return func() *bool {
+		s := strings.ToLower(Var(k))
+		if s == "" || s == "auto" {
+			return nil
+		}
+
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			slog.Warn("invalid "+k+", using default", "value", s, "default", "auto")
+			return nil
+		}
+
+		return &b
+	}
+}
+
+var (
+	// UseMMap memory maps model weights when requests and Modelfiles don't set use_mmap.
+	UseMMap = TriState("OLLAMA_USE_MMAP")
+	// UseMLock locks model memory when requests and Modelfiles don't set use_mlock. Auto, the default, doesn't lock it.
+	UseMLock = TriState("OLLAMA_USE_MLOCK")
 )
 
+func triStateString(b *bool) string {
+	if b == nil {
+		return "auto"
+	}
+
+	return strconv.FormatBool(*b)
+}
+
 func String(s string) func() string {
 	return func() string {
 		return Var(s)
@@ -179,6 +507,135 @@ var (
 	HsaOverrideGfxVersion = String("HSA_OVERRIDE_GFX_VERSION")
 )
 
+// TrustedSigners is the path to a file of public keys trusted to sign models, one per line in authorized_keys format,
+// with the comment naming the signer. TrustedSigners can be configured via the OLLAMA_TRUSTED_SIGNERS environment variable.
+var TrustedSigners = String("OLLAMA_TRUSTED_SIGNERS")
+
+// APIKeys is the path to a JSON file of API keys that requests must authenticate with, mapping each key to the
+// namespaces whose models it can use. APIKeys can be configured via the OLLAMA_API_KEYS environment variable.
+var APIKeys = String("OLLAMA_API_KEYS")
+
+// SearchFallback is the URL of an Ollama server or registry whose /api/tags are searched when the registry's search
+// can't be reached. SearchFallback can be configured via the OLLAMA_SEARCH_FALLBACK environment variable.
+var SearchFallback = String("OLLAMA_SEARCH_FALLBACK")
+
+// SocketMode is the permissions, in octal such as 0660, the unix socket the server listens on is given when OLLAMA_HOST
+// is a unix:// URL. SocketMode can be configured via the OLLAMA_SOCKET_MODE environment variable.
+var SocketMode = String("OLLAMA_SOCKET_MODE")
+
+// SocketGroup is the name or id of the group the unix socket the server listens on is given when OLLAMA_HOST is a
+// unix:// URL. SocketGroup can be configured via the OLLAMA_SOCKET_GROUP environment variable.
+var SocketGroup = String("OLLAMA_SOCKET_GROUP")
+
+// SocketAllowedUIDs is a comma separated list of the user ids allowed to connect to the unix socket the server listens
+// on. Empty allows any user the socket's permissions do. SocketAllowedUIDs can be configured via the
+// OLLAMA_SOCKET_ALLOWED_UIDS environment variable.
+var SocketAllowedUIDs = String("OLLAMA_SOCKET_ALLOWED_UIDS")
+
+// RegistryProxy is the URL of the proxy that requests to registries go through, taking precedence over HTTPS_PROXY and
+// HTTP_PROXY for them. NO_PROXY is still honored. RegistryProxy can be configured via the OLLAMA_REGISTRY_PROXY environment variable.
+var RegistryProxy = String("OLLAMA_REGISTRY_PROXY")
+
+// DefaultRegistry is the registry host of model names that don't have one, e.g. registry.example.com for llama3 to
+// resolve to registry.example.com/library/llama3:latest. DefaultRegistry can be configured via the OLLAMA_DEFAULT_REGISTRY
+// environment variable. Default is registry.ollama.ai.
+var DefaultRegistry = String("OLLAMA_DEFAULT_REGISTRY")
+
+// DefaultNamespace is the namespace of model names that don't have one. DefaultNamespace can be configured via the
+// OLLAMA_DEFAULT_NAMESPACE environment variable. Default is library.
+var DefaultNamespace = String("OLLAMA_DEFAULT_NAMESPACE")
+
+// redactURL returns the URL s with any credentials in it replaced, so it can be logged. A URL without a scheme is
+// parsed as http, as proxy URLs are.
+func redactURL(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if u, err = url.Parse("http://" + s); err != nil {
+			return "xxxxx"
+		}
+	}
+
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+
+	return u.String()
+}
+
+var (
+	// AutoPullInterval is how often the models in OLLAMA_AUTO_PULL are checked for updates. Zero only checks them when a refresh is requested.
+	// AutoPullInterval can be configured via the OLLAMA_AUTO_PULL_INTERVAL environment variable.
+	AutoPullInterval = Duration("OLLAMA_AUTO_PULL_INTERVAL", 24*time.Hour)
+	// AutoPullWindow is the daily maintenance window, in local time as "HH:MM-HH:MM", that updates found by scheduled checks are pulled in.
+	// Updates are pulled as soon as they're found if it's unset. AutoPullWindow can be configured via the OLLAMA_AUTO_PULL_WINDOW environment variable.
+	AutoPullWindow = String("OLLAMA_AUTO_PULL_WINDOW")
+)
+
+// DefaultOptions are the server's default model options, applied when neither the request nor the model's parameters
+// set them, as a JSON object or a comma separated list of key=value pairs (e.g. "temperature=0.3,num_ctx=8192").
+// DefaultOptions can be configured via the OLLAMA_DEFAULT_OPTIONS environment variable.
+var DefaultOptions = String("OLLAMA_DEFAULT_OPTIONS")
+
+// StorageBackend is where models are stored: "filesystem", the default, for the models directory, or the URL of an HTTP
+// server with the layout of a models directory to read models from. StorageBackend can be configured via the
+// OLLAMA_STORAGE_BACKEND environment variable.
+var StorageBackend = String("OLLAMA_STORAGE_BACKEND")
+
+// Presets is the path of a JSON file of named generation presets, each a set of model options and an optional system
+// message, that requests select with "preset". Presets can be configured via the OLLAMA_PRESETS environment variable.
+var Presets = String("OLLAMA_PRESETS")
+
+// Aliases is the path of a JSON file of model aliases, names such as "default" that requests use in place of a model and
+// that resolve to the first of a list of models that can be placed. Aliases can be configured via the OLLAMA_ALIASES
+// environment variable.
+var Aliases = String("OLLAMA_ALIASES")
+
+// APIKey is the API key the client authenticates with when the server requires one. APIKey can be configured via the
+// OLLAMA_API_KEY environment variable. Unlike other variables it isn't in AsMap, so it's never logged.
+var APIKey = String("OLLAMA_API_KEY")
+
+// HFToken is the Hugging Face token used for models pulled from Hugging Face when ollama login hasn't stored one.
+// HFToken can be configured via the HF_TOKEN environment variable. Like APIKey it isn't in AsMap.
+var HFToken = String("HF_TOKEN")
+
+var gfxVersionPattern = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// HsaOverrideGfxVersionByDevice returns the gfx version overrides for AMD GPUs. HSA_OVERRIDE_GFX_VERSION is either
+// a single version applied to every GPU, or a comma separated list of id=version pairs (e.g. "0=11.0.0,1=10.3.0").
+// A version without an id in the list applies to every GPU not named.
+func HsaOverrideGfxVersionByDevice() (all string, byDevice map[string]string) {
+	s := HsaOverrideGfxVersion()
+	if !strings.Contains(s, "=") {
+		return s, nil
+	}
+
+	byDevice = make(map[string]string)
+	for _, v := range strings.Split(s, ",") {
+		id, version, ok := strings.Cut(v, "=")
+		id, version = strings.TrimSpace(id), strings.TrimSpace(version)
+		if !ok {
+			version = id
+		}
+
+		if !gfxVersionPattern.MatchString(version) || (ok && id == "") {
+			slog.Warn("invalid HSA_OVERRIDE_GFX_VERSION entry, ignoring", "value", s, "entry", v)
+			return "", nil
+		}
+
+		if ok {
+			byDevice[id] = version
+		} else {
+			all = version
+		}
+	}
+
+	return all, byDevice
+}
+
 func Uint(key string, defaultValue uint) func() uint {
 	return func() uint {
 		if s := Var(key); s != "" {
@@ -200,10 +657,62 @@ var (
 	MaxRunners = Uint("OLLAMA_MAX_LOADED_MODELS", 0)
 	// MaxQueue sets the maximum number of queued requests. MaxQueue can be configured via the OLLAMA_MAX_QUEUE environment variable.
 	MaxQueue = Uint("OLLAMA_MAX_QUEUE", 512)
-	// MaxVRAM sets a maximum VRAM override in bytes. MaxVRAM can be configured via the OLLAMA_MAX_VRAM environment variable.
-	MaxVRAM = Uint("OLLAMA_MAX_VRAM", 0)
+	// ImageMaxSize is the longest side, in pixels, of images passed to vision models as they are. Larger images are downscaled to the model's native resolution. Zero uses the native resolution. ImageMaxSize can be configured via the OLLAMA_IMAGE_MAX_SIZE environment variable.
+	ImageMaxSize = Uint("OLLAMA_IMAGE_MAX_SIZE", 0)
+	// MaxQueuePerModel sets the maximum number of queued requests for a single model. MaxQueuePerModel can be configured via the OLLAMA_MAX_QUEUE_PER_MODEL environment variable.
+	// Zero means OLLAMA_MAX_QUEUE.
+	MaxQueuePerModel = Uint("OLLAMA_MAX_QUEUE_PER_MODEL", 0)
+	// MaxModelsPerGPU sets the maximum number of models placed on a single GPU. MaxModelsPerGPU can be configured via the OLLAMA_MAX_MODELS_PER_GPU environment variable.
+	// Zero means no per-GPU limit.
+	MaxModelsPerGPU = Uint("OLLAMA_MAX_MODELS_PER_GPU", 0)
+	// MaxChoices sets the maximum number of choices a single request may generate with n. MaxChoices can be configured via the OLLAMA_MAX_CHOICES environment variable.
+	MaxChoices = Uint("OLLAMA_MAX_CHOICES", 8)
+	// MaxSessions sets the maximum number of chat sessions the server keeps. MaxSessions can be configured via the OLLAMA_MAX_SESSIONS environment variable.
+	// Zero disables sessions.
+	MaxSessions = Uint("OLLAMA_MAX_SESSIONS", 64)
+	// StreamFlushTokens sets the most tokens coalesced into a single flush of a streamed response. StreamFlushTokens can be configured via the OLLAMA_STREAM_FLUSH_TOKENS environment variable.
+	// Zero means flushes are only bounded by OLLAMA_STREAM_FLUSH_INTERVAL.
+	StreamFlushTokens = Uint("OLLAMA_STREAM_FLUSH_TOKENS", 16)
+	// ModelReplicas sets the default number of runners a model may be loaded as to spread requests across GPUs. ModelReplicas can be configured via the OLLAMA_MODEL_REPLICAS environment variable.
+	ModelReplicas = Uint("OLLAMA_MODEL_REPLICAS", 1)
+	// MaxContext caps the context length of models loaded with num_ctx 0, which otherwise use the context length they were trained with. MaxContext can be configured via the OLLAMA_MAX_CONTEXT environment variable.
+	// Zero means no cap other than what fits in memory.
+	MaxContext = Uint("OLLAMA_MAX_CONTEXT", 32768)
+	// IdempotencyCacheSize sets the most responses kept for requests with an Idempotency-Key. IdempotencyCacheSize can be configured via the OLLAMA_IDEMPOTENCY_CACHE_SIZE environment variable.
+	// Zero disables idempotency keys.
+	IdempotencyCacheSize = Uint("OLLAMA_IDEMPOTENCY_CACHE_SIZE", 256)
+	// RunnerWarmPool sets the number of runner processes of each backend started ahead of time, with the GPU context initialized but no model loaded, so loads skip starting the runner. RunnerWarmPool can be configured via the OLLAMA_RUNNER_WARM_POOL environment variable.
+	// Zero disables the pool.
+	RunnerWarmPool = Uint("OLLAMA_RUNNER_WARM_POOL", 0)
 )
 
+func Float(key string, defaultValue float64) func() float64 {
+	return func() float64 {
+		if s := Var(key); s != "" {
+			if f, err := strconv.ParseFloat(s, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				slog.Warn("invalid environment variable, using default", "key", key, "value", s, "default", defaultValue)
+			} else {
+				return f
+			}
+		}
+
+		return defaultValue
+	}
+}
+
+// TegraMemoryFraction returns the fraction of system memory that the integrated GPU on Jetson devices may use.
+// TegraMemoryFraction can be configured via the OLLAMA_TEGRA_MEMORY_FRACTION environment variable.
+// Values outside of (0, 1] are ignored. Default is 0.75.
+func TegraMemoryFraction() float64 {
+	f := Float("OLLAMA_TEGRA_MEMORY_FRACTION", 0.75)()
+	if f <= 0 || f > 1 {
+		slog.Warn("OLLAMA_TEGRA_MEMORY_FRACTION must be greater than 0 and at most 1, using default", "value", f, "default", 0.75)
+		return 0.75
+	}
+
+	return f
+}
+
 func Uint64(key string, defaultValue uint64) func() uint64 {
 	return func() uint64 {
 		if s := Var(key); s != "" {
@@ -218,8 +727,193 @@ func Uint64(key string, defaultValue uint64) func() uint64 {
 	}
 }
 
-// Set aside VRAM per GPU
-var GpuOverhead = Uint64("OLLAMA_GPU_OVERHEAD", 0)
+// Size returns a function that parses the environment variable key as a byte count.
+// Plain integers are bytes; units such as "20GiB", "8000MB" or "1.5g" are also accepted (see parseSize).
+func Size(key string, defaultValue uint64) func() uint64 {
+	return func() uint64 {
+		if s := Var(key); s != "" {
+			if n, err := parseSize(s); err != nil {
+				slog.Warn("invalid environment variable, using default", "key", key, "value", s, "default", defaultValue, "error", err)
+			} else {
+				return n
+			}
+		}
+
+		return defaultValue
+	}
+}
+
+var (
+	// MaxVRAM sets a maximum VRAM override in bytes. MaxVRAM can be configured via the OLLAMA_MAX_VRAM environment variable.
+	MaxVRAM = Size("OLLAMA_MAX_VRAM", 0)
+	// MetalMemoryLimit lowers the VRAM budget on Apple Silicon below the recommended working set size. MetalMemoryLimit can be configured via the OLLAMA_METAL_MEMORY_LIMIT environment variable.
+	// Zero uses the recommended working set size reported by Metal.
+	MetalMemoryLimit = Size("OLLAMA_METAL_MEMORY_LIMIT", 0)
+	// MaxRequestBody sets the largest request body the server accepts, other than blob uploads. MaxRequestBody can be configured via the OLLAMA_MAX_REQUEST_BODY environment variable.
+	// Zero means no limit.
+	MaxRequestBody = Size("OLLAMA_MAX_REQUEST_BODY", 100*format.MebiByte)
+	// MaxBlobSize sets the largest blob that can be uploaded to the server. MaxBlobSize can be configured via the OLLAMA_MAX_BLOB_SIZE environment variable.
+	// Zero means no limit.
+	MaxBlobSize = Size("OLLAMA_MAX_BLOB_SIZE", 0)
+	// PromptCacheSize sets the KV cache memory each loaded model sets aside for prompts shared between requests. PromptCacheSize can be configured via the OLLAMA_PROMPT_CACHE_SIZE environment variable.
+	// Zero disables the shared prompt cache.
+	PromptCacheSize = Size("OLLAMA_PROMPT_CACHE_SIZE", 0)
+	// GenerationBufferSize sets the most memory the responses of streamed generations are kept in, the oldest
+	// generations being evicted first. GenerationBufferSize can be configured via the OLLAMA_GENERATION_BUFFER_SIZE
+	// environment variable. Zero disables following generations.
+	GenerationBufferSize = Size("OLLAMA_GENERATION_BUFFER_SIZE", 64*format.MebiByte)
+	// StreamBufferSize sets the most memory streamed responses are buffered in while they wait for clients that read
+	// them slower than they're generated. StreamBufferSize can be configured via the OLLAMA_STREAM_BUFFER_SIZE
+	// environment variable. Zero disables buffering, so generations wait for their clients.
+	StreamBufferSize = Size("OLLAMA_STREAM_BUFFER_SIZE", 64*format.MebiByte)
+	// SessionMaxSize sets the most memory the history of a chat session is kept in, its oldest messages being dropped
+	// first. SessionMaxSize can be configured via the OLLAMA_SESSION_MAX_SIZE environment variable.
+	SessionMaxSize = Size("OLLAMA_SESSION_MAX_SIZE", 8*format.MebiByte)
+)
+
+// GpuOverheadEntry is the amount of VRAM set aside on a GPU. ID is empty for
+// entries that apply by position in discovery order.
+type GpuOverheadEntry struct {
+	ID    string
+	Bytes uint64
+}
+
+type GpuOverheadList []GpuOverheadEntry
+
+// Get returns the VRAM to set aside on the GPU at index (in discovery order) with the given ID.
+// count is the number of discovered GPUs. A list that does not have exactly one value per GPU
+// applies its first value to every GPU.
+func (l GpuOverheadList) Get(index int, id string, count int) uint64 {
+	if len(l) == 0 {
+		return 0
+	}
+
+	if l.keyed() {
+		for _, e := range l {
+			if e.ID == id {
+				return e.Bytes
+			}
+		}
+		return 0
+	}
+
+	if len(l) != count || index < 0 || index >= len(l) {
+		return l[0].Bytes
+	}
+
+	return l[index].Bytes
+}
+
+// Mismatched reports whether a positional list does not have one value per GPU
+func (l GpuOverheadList) Mismatched(count int) bool {
+	return len(l) > 1 && !l.keyed() && len(l) != count
+}
+
+func (l GpuOverheadList) keyed() bool {
+	for _, e := range l {
+		if e.ID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (l GpuOverheadList) String() string {
+	values := make([]string, len(l))
+	for i, e := range l {
+		values[i] = format.HumanBytes2(e.Bytes)
+		if e.ID != "" {
+			values[i] = e.ID + "=" + values[i]
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// GpuOverhead returns the VRAM to set aside per GPU. GpuOverhead can be configured via the OLLAMA_GPU_OVERHEAD environment variable.
+// The value is either a single size applied to every GPU, or a comma separated list with one size per GPU in discovery order (e.g. "1536MiB,0").
+// List entries may instead name a GPU by ID (e.g. "GPU-1a2b3c=1536MiB"), in which case GPUs not named have nothing set aside.
+func GpuOverhead() (overhead GpuOverheadList) {
+	s := Var("OLLAMA_GPU_OVERHEAD")
+	if s == "" {
+		return nil
+	}
+
+	for _, v := range strings.Split(s, ",") {
+		var e GpuOverheadEntry
+		if id, size, ok := strings.Cut(v, "="); ok {
+			e.ID, v = strings.TrimSpace(id), size
+		}
+
+		n, err := parseSize(v)
+		if err != nil {
+			slog.Warn("invalid OLLAMA_GPU_OVERHEAD entry, ignoring", "value", s, "entry", v, "error", err)
+			return nil
+		}
+
+		e.Bytes = n
+		overhead = append(overhead, e)
+	}
+
+	return overhead
+}
+
+// parseSize parses a byte count with an optional case-insensitive unit suffix.
+// Binary (KiB, MiB, GiB, TiB and the short forms K, M, G, T) and decimal (KB, MB, GB, TB) units are accepted.
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+'
+	})
+	if i <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	value, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+
+	var multiplier float64
+	switch unit {
+	case "b":
+		multiplier = format.Byte
+	case "kb":
+		multiplier = format.KiloByte
+	case "mb":
+		multiplier = format.MegaByte
+	case "gb":
+		multiplier = format.GigaByte
+	case "tb":
+		multiplier = format.TeraByte
+	case "k", "kib":
+		multiplier = format.KibiByte
+	case "m", "mib":
+		multiplier = format.MebiByte
+	case "g", "gib":
+		multiplier = format.GibiByte
+	case "t", "tib":
+		multiplier = format.TebiByte
+	default:
+		return 0, fmt.Errorf("invalid size unit %q", unit)
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	if f < 0 {
+		return 0, fmt.Errorf("negative size %q", s)
+	}
+
+	f *= multiplier
+	if f >= math.MaxUint64 {
+		return 0, fmt.Errorf("size %q overflows", s)
+	}
+
+	return uint64(f), nil
+}
 
 type EnvVar struct {
 	Name        string
@@ -229,22 +923,81 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
-		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
-		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
-		"OLLAMA_GPU_OVERHEAD":      {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
-		"OLLAMA_HOST":              {"OLLAMA_HOST", Host(), "IP Address for the ollama server (default 127.0.0.1:11434)"},
-		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
-		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
-		"OLLAMA_LOAD_TIMEOUT":      {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
-		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
-		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
-		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
-		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
-		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
-		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
-		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", Origins(), "A comma separated list of allowed origins"},
-		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
-		"OLLAMA_TMPDIR":            {"OLLAMA_TMPDIR", TmpDir(), "Location for temporary files"},
+		"OLLAMA_DEBUG":                  {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_ALLOW_SWAP":             {"OLLAMA_ALLOW_SWAP", AllowSwap(), "Allow models to rely on swap when they don't fit in free system memory"},
+		"OLLAMA_DEDUPE_DIRS":            {"OLLAMA_DEDUPE_DIRS", DedupeDirs(), "Other models directories, separated like PATH, that store dedupe may link blobs in"},
+		"OLLAMA_DEFAULT_OPTIONS":        {"OLLAMA_DEFAULT_OPTIONS", DefaultOptions(), "Default model options when neither requests nor Modelfiles set them (e.g. temperature=0.3,num_ctx=8192)"},
+		"OLLAMA_PRESETS":                {"OLLAMA_PRESETS", Presets(), "Path of a JSON file of named presets of model options and system messages that requests can select"},
+		"OLLAMA_ALIASES":                {"OLLAMA_ALIASES", Aliases(), "Path of a JSON file of model aliases, such as \"default\", and the models they resolve to"},
+		"OLLAMA_STORAGE_BACKEND":        {"OLLAMA_STORAGE_BACKEND", StorageBackend(), "Where models are stored: filesystem (default) or the URL of a read-only HTTP model store"},
+		"OLLAMA_FETCH_IMAGES":           {"OLLAMA_FETCH_IMAGES", FetchImages(), "Download images from http(s) URLs in OpenAI chat requests"},
+		"OLLAMA_FLASH_ATTENTION":        {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
+		"OLLAMA_GPU_ORDER":              {"OLLAMA_GPU_ORDER", GpuOrder(), "Order GPUs are considered for placement: free, index or memory (default \"free\")"},
+		"OLLAMA_GPU_OVERHEAD":           {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU, optionally as a comma separated list per GPU (e.g. 1536MiB,0)"},
+		"OLLAMA_HOST":                   {"OLLAMA_HOST", Host(), "IP Address for the ollama server (default 127.0.0.1:11434), or a unix:// socket path"},
+		"OLLAMA_SOCKET_MODE":            {"OLLAMA_SOCKET_MODE", SocketMode(), "Permissions of the server's unix socket, in octal (e.g. 0660)"},
+		"OLLAMA_SOCKET_GROUP":           {"OLLAMA_SOCKET_GROUP", SocketGroup(), "Group of the server's unix socket, by name or id"},
+		"OLLAMA_SOCKET_ALLOWED_UIDS":    {"OLLAMA_SOCKET_ALLOWED_UIDS", SocketAllowedUIDs(), "Comma separated user ids allowed to connect to the server's unix socket"},
+		"OLLAMA_IMAGE_MAX_SIZE":         {"OLLAMA_IMAGE_MAX_SIZE", ImageMaxSize(), "Longest side in pixels of images passed to vision models as they are, larger images are downscaled (default the model's native resolution)"},
+		"OLLAMA_KEEP_ALIVE":             {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
+		"OLLAMA_CACHE_RELEASE":          {"OLLAMA_CACHE_RELEASE", CacheRelease(), "How long a model may be idle before its KV cache is freed ahead of unloading (default disabled)"},
+		"OLLAMA_LLM_LIBRARY":            {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
+		"OLLAMA_LOAD_PREFETCH":          {"OLLAMA_LOAD_PREFETCH", LoadPrefetch(), "Prefetch model files with large parallel reads while they load (default true)"},
+		"OLLAMA_RUNNER_WARM_POOL":       {"OLLAMA_RUNNER_WARM_POOL", RunnerWarmPool(), "Number of runner processes per backend started ahead of loads (default 0)"},
+		"OLLAMA_LOAD_TIMEOUT":           {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
+		"OLLAMA_MAX_CONTEXT":            {"OLLAMA_MAX_CONTEXT", MaxContext(), "Maximum context length of models loaded with num_ctx 0 (default 32768)"},
+		"OLLAMA_MAX_CHOICES":            {"OLLAMA_MAX_CHOICES", MaxChoices(), "Maximum number of choices a request can generate with n (default 8)"},
+		"OLLAMA_MAX_SESSIONS":           {"OLLAMA_MAX_SESSIONS", MaxSessions(), "Maximum number of chat sessions kept by the server (default 64, 0 disables sessions)"},
+		"OLLAMA_MAX_LOADED_MODELS":      {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
+		"OLLAMA_MAX_MODELS_PER_GPU":     {"OLLAMA_MAX_MODELS_PER_GPU", MaxModelsPerGPU(), "Maximum number of models placed on a single GPU"},
+		"OLLAMA_MAX_QUEUE":              {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
+		"OLLAMA_MAX_VRAM":               {"OLLAMA_MAX_VRAM", format.HumanBytes2(MaxVRAM()), "Maximum VRAM override, such as \"20GiB\" (default 0, no override)"},
+		"OLLAMA_MAX_QUEUE_PER_MODEL":    {"OLLAMA_MAX_QUEUE_PER_MODEL", MaxQueuePerModel(), "Maximum number of queued requests for a single model (default OLLAMA_MAX_QUEUE)"},
+		"OLLAMA_MODEL_REPLICAS":         {"OLLAMA_MODEL_REPLICAS", ModelReplicas(), "Number of runners each model may be loaded as to spread requests across GPUs (default 1)"},
+		"OLLAMA_MODELS":                 {"OLLAMA_MODELS", Models(), "The path to the models directory"},
+		"OLLAMA_NOHISTORY":              {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
+		"OLLAMA_STATS":                  {"OLLAMA_STATS", Stats(), "Show tokens/s and context usage while responses stream in ollama run"},
+		"OLLAMA_NOPRUNE":                {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
+		"OLLAMA_P2P":                    {"OLLAMA_P2P", P2P(), "Share model blobs with other servers found on the LAN over mDNS"},
+		"OLLAMA_NOTMPCLEANUP":           {"OLLAMA_NOTMPCLEANUP", NoTmpCleanup(), "Do not remove temporary files left by unfinished operations on startup"},
+		"OLLAMA_NOMIGRATE":              {"OLLAMA_NOMIGRATE", NoMigrate(), "Do not migrate models stored in legacy layouts on startup"},
+		"OLLAMA_OFFLINE":                {"OLLAMA_OFFLINE", Offline(), "Forbid pulls, pushes, searches and other outbound network access"},
+		"OLLAMA_OTEL":                   {"OLLAMA_OTEL", OTel(), "Export request traces over OTLP"},
+		"OLLAMA_NUM_PARALLEL":           {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
+		"OLLAMA_ORIGINS":                {"OLLAMA_ORIGINS", Origins(), "A comma separated list of allowed origins"},
+		"OLLAMA_REGISTRY_PROXY":         {"OLLAMA_REGISTRY_PROXY", redactURL(RegistryProxy()), "Proxy for requests to registries, taking precedence over HTTPS_PROXY for them"},
+		"OLLAMA_DEFAULT_REGISTRY":       {"OLLAMA_DEFAULT_REGISTRY", DefaultRegistry(), "Registry host of model names without one (default: registry.ollama.ai)"},
+		"OLLAMA_DEFAULT_NAMESPACE":      {"OLLAMA_DEFAULT_NAMESPACE", DefaultNamespace(), "Namespace of model names without one (default: library)"},
+		"OLLAMA_REMOTE_SERVERS":         {"OLLAMA_REMOTE_SERVERS", RemoteServers(), "A comma separated list of Ollama servers to run models on when they don't fit locally"},
+		"OLLAMA_SCHED_SPREAD":           {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
+		"OLLAMA_STREAM_FLUSH_INTERVAL":  {"OLLAMA_STREAM_FLUSH_INTERVAL", StreamFlushInterval(), "How often streamed responses are flushed, coalescing tokens in between (default 0, every token)"},
+		"OLLAMA_STREAM_FLUSH_TOKENS":    {"OLLAMA_STREAM_FLUSH_TOKENS", StreamFlushTokens(), "Most tokens coalesced into a single flush of a streamed response (default 16)"},
+		"OLLAMA_MAX_BLOB_SIZE":          {"OLLAMA_MAX_BLOB_SIZE", format.HumanBytes2(MaxBlobSize()), "Largest blob that can be uploaded (default 0, no limit)"},
+		"OLLAMA_MAX_REQUEST_BODY":       {"OLLAMA_MAX_REQUEST_BODY", format.HumanBytes2(MaxRequestBody()), "Largest request body accepted, other than blob uploads (default 100MiB, 0 for no limit)"},
+		"OLLAMA_PROMPT_CACHE_SIZE":      {"OLLAMA_PROMPT_CACHE_SIZE", format.HumanBytes2(PromptCacheSize()), "KV cache memory per model for prompts shared between requests (default 0, disabled)"},
+		"OLLAMA_READ_HEADER_TIMEOUT":    {"OLLAMA_READ_HEADER_TIMEOUT", ReadHeaderTimeout(), "How long clients may take to send request headers (default \"10s\")"},
+		"OLLAMA_IDLE_TIMEOUT":           {"OLLAMA_IDLE_TIMEOUT", IdleTimeout(), "How long idle keep-alive connections are kept open (default \"2m\")"},
+		"OLLAMA_WRITE_TIMEOUT":          {"OLLAMA_WRITE_TIMEOUT", WriteTimeout(), "How long a response write may block on a client that isn't reading (default \"1m\")"},
+		"OLLAMA_TARGET_TTFT":            {"OLLAMA_TARGET_TTFT", TargetTTFT(), "Reject requests predicted to wait longer than this for their first token (default disabled)"},
+		"OLLAMA_LOCK_TIMEOUT":           {"OLLAMA_LOCK_TIMEOUT", LockTimeout(), "How long a lock on the models directory held by a server that stopped responding is kept before it's reclaimed (default \"2m\")"},
+		"OLLAMA_IDEMPOTENCY_TTL":        {"OLLAMA_IDEMPOTENCY_TTL", IdempotencyTTL(), "How long responses to requests with an Idempotency-Key are replayed (default \"10m\")"},
+		"OLLAMA_IDEMPOTENCY_CACHE_SIZE": {"OLLAMA_IDEMPOTENCY_CACHE_SIZE", IdempotencyCacheSize(), "Most responses kept for requests with an Idempotency-Key (default 256, 0 to disable)"},
+		"OLLAMA_GENERATION_TTL":         {"OLLAMA_GENERATION_TTL", GenerationTTL(), "How long streamed generations can be followed after they finish (default \"5m\")"},
+		"OLLAMA_SESSION_TTL":            {"OLLAMA_SESSION_TTL", SessionTTL(), "How long chat sessions are kept after they were last used (default \"30m\")"},
+		"OLLAMA_SESSION_MAX_SIZE":       {"OLLAMA_SESSION_MAX_SIZE", format.HumanBytes2(SessionMaxSize()), "Most memory the history of each chat session is kept in, dropping its oldest messages (default 8MiB)"},
+		"OLLAMA_GENERATION_BUFFER_SIZE": {"OLLAMA_GENERATION_BUFFER_SIZE", format.HumanBytes2(GenerationBufferSize()), "Most memory the responses of streamed generations are kept in to be followed (default 64MiB, 0 to disable)"},
+		"OLLAMA_STREAM_BUFFER_SIZE":     {"OLLAMA_STREAM_BUFFER_SIZE", format.HumanBytes2(StreamBufferSize()), "Most memory streamed responses are buffered in for slow clients (default 64MiB, 0 to disable)"},
+		"OLLAMA_SIGNATURE_POLICY":       {"OLLAMA_SIGNATURE_POLICY", SignaturePolicy(), "How pulls treat models not signed by a trusted signer: warn or enforce (default \"warn\")"},
+		"OLLAMA_TRUSTED_SIGNERS":        {"OLLAMA_TRUSTED_SIGNERS", TrustedSigners(), "File of public keys trusted to sign models, in authorized_keys format"},
+		"OLLAMA_AUTO_PULL":              {"OLLAMA_AUTO_PULL", AutoPull(), "A comma separated list of models to keep up to date with the registry"},
+		"OLLAMA_AUTO_PULL_INTERVAL":     {"OLLAMA_AUTO_PULL_INTERVAL", AutoPullInterval(), "How often to check OLLAMA_AUTO_PULL models for updates (default \"24h\")"},
+		"OLLAMA_AUTO_PULL_WINDOW":       {"OLLAMA_AUTO_PULL_WINDOW", AutoPullWindow(), "Daily window to pull updates in, as local HH:MM-HH:MM (default any time)"},
+		"OLLAMA_SEARCH_FALLBACK":        {"OLLAMA_SEARCH_FALLBACK", SearchFallback(), "Server or registry whose models are searched when the registry is unreachable"},
+		"OLLAMA_API_KEYS":               {"OLLAMA_API_KEYS", APIKeys(), "File of API keys and the model namespaces each can use"},
+		"OLLAMA_CREDENTIALS_STORE":      {"OLLAMA_CREDENTIALS_STORE", CredentialsStore(), "Where ollama login stores credentials: auto, keychain or file (default \"auto\")"},
+		"OLLAMA_TMPDIR":                 {"OLLAMA_TMPDIR", TmpDir(), "Location for temporary files"},
+		"OLLAMA_USE_MLOCK":              {"OLLAMA_USE_MLOCK", triStateString(UseMLock()), "Lock model memory to keep it from being swapped out: true, false or auto (default \"auto\")"},
+		"OLLAMA_USE_MMAP":               {"OLLAMA_USE_MMAP", triStateString(UseMMap()), "Memory map model weights: true, false or auto (default \"auto\")"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
@@ -259,13 +1012,19 @@ func AsMap() map[string]EnvVar {
 		ret["no_proxy"] = EnvVar{"no_proxy", String("no_proxy")(), "No proxy"}
 	}
 
+	if runtime.GOOS == "darwin" {
+		ret["OLLAMA_METAL_MEMORY_LIMIT"] = EnvVar{"OLLAMA_METAL_MEMORY_LIMIT", format.HumanBytes2(MetalMemoryLimit()), "Lower the memory available to Metal below the recommended working set size (e.g. 32GiB)"}
+	}
+
 	if runtime.GOOS != "darwin" {
 		ret["CUDA_VISIBLE_DEVICES"] = EnvVar{"CUDA_VISIBLE_DEVICES", CudaVisibleDevices(), "Set which NVIDIA devices are visible"}
 		ret["HIP_VISIBLE_DEVICES"] = EnvVar{"HIP_VISIBLE_DEVICES", HipVisibleDevices(), "Set which AMD devices are visible"}
 		ret["ROCR_VISIBLE_DEVICES"] = EnvVar{"ROCR_VISIBLE_DEVICES", RocrVisibleDevices(), "Set which AMD devices are visible"}
 		ret["GPU_DEVICE_ORDINAL"] = EnvVar{"GPU_DEVICE_ORDINAL", GpuDeviceOrdinal(), "Set which AMD devices are visible"}
-		ret["HSA_OVERRIDE_GFX_VERSION"] = EnvVar{"HSA_OVERRIDE_GFX_VERSION", HsaOverrideGfxVersion(), "Override the gfx used for all detected AMD GPUs"}
+		ret["HSA_OVERRIDE_GFX_VERSION"] = EnvVar{"HSA_OVERRIDE_GFX_VERSION", HsaOverrideGfxVersion(), "Override the gfx used for all detected AMD GPUs, or per GPU (e.g. 0=11.0.0,1=10.3.0)"}
+		ret["OLLAMA_ROCM_AUTO_OVERRIDE"] = EnvVar{"OLLAMA_ROCM_AUTO_OVERRIDE", RocmAutoOverride(), "Apply a known working gfx override to unsupported AMD GPUs"}
 		ret["OLLAMA_INTEL_GPU"] = EnvVar{"OLLAMA_INTEL_GPU", IntelGPU(), "Enable experimental Intel GPU detection"}
+		ret["OLLAMA_TEGRA_MEMORY_FRACTION"] = EnvVar{"OLLAMA_TEGRA_MEMORY_FRACTION", TegraMemoryFraction(), "Fraction of system memory usable by Jetson integrated GPUs (default 0.75)"}
 	}
 
 	return ret
@@ -279,9 +1038,29 @@ func Values() map[string]string {
 	return vals
 }
 
-// Var returns an environment variable stripped of leading and trailing quotes or spaces
+var (
+	overridesMu sync.RWMutex
+	overrides   map[string]string
+)
+
+// Override sets variables, by name, that take precedence over the environment, so a program embedding the server can
+// configure it without changing its process's environment. The values replace any set before, and nil removes them.
+func Override(values map[string]string) {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+	overrides = maps.Clone(values)
+}
+
+// Var returns an environment variable, or its override, stripped of leading and trailing quotes or spaces
 func Var(key string) string {
-	return strings.Trim(strings.TrimSpace(os.Getenv(key)), "\"'")
+	overridesMu.RLock()
+	v, ok := overrides[key]
+	overridesMu.RUnlock()
+	if !ok {
+		v = os.Getenv(key)
+	}
+
+	return strings.Trim(strings.TrimSpace(v), "\"'")
 }
 
 // On windows, we keep the binary at the top directory, but
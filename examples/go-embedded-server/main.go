@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/server"
+)
+
+func main() {
+	// run the server inside this program, on a port of its own
+	srv, err := server.New(server.Config{
+		KeepAlive: 10 * time.Minute,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	client := api.NewClient(&url.URL{Scheme: "http", Host: ln.Addr().String()}, http.DefaultClient)
+
+	req := &api.GenerateRequest{
+		Model:  "gemma2",
+		Prompt: "how many planets are there?",
+
+		// set streaming to false
+		Stream: new(bool),
+	}
+
+	err = client.Generate(context.Background(), req, func(resp api.GenerateResponse) error {
+		fmt.Println(resp.Response)
+		return nil
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
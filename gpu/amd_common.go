@@ -4,10 +4,12 @@ package gpu
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 
 	"github.com/ollama/ollama/envconfig"
@@ -37,6 +39,78 @@ func GetSupportedGFX(libDir string) ([]string, error) {
 	return ret, nil
 }
 
+// Known working HSA_OVERRIDE_GFX_VERSION values for GPUs the ROCm library doesn't ship kernels
+// for, but which run correctly with the kernels of a closely related gfx target
+var rocmKnownGfxOverrides = map[string]string{
+	"gfx1031": "10.3.0", // RX 6700/6750
+	"gfx1032": "10.3.0", // RX 6600/6650
+	"gfx1034": "10.3.0", // RX 6500/6400
+	"gfx1035": "10.3.0", // Radeon 680M
+	"gfx1036": "10.3.0", // Radeon 610M
+	"gfx1101": "11.0.0", // RX 7800/7700
+	"gfx1102": "11.0.0", // RX 7600
+	"gfx1103": "11.0.0", // Radeon 780M
+}
+
+// gfxTarget returns the gfx target selected by a HSA_OVERRIDE_GFX_VERSION value, e.g. 10.3.0 is gfx1030
+func gfxTarget(version string) string {
+	var major, minor, patch uint64
+	if _, err := fmt.Sscanf(version, "%d.%d.%d", &major, &minor, &patch); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("gfx%d%x%x", major, minor, patch)
+}
+
+// suggestGfxOverride returns a known working HSA_OVERRIDE_GFX_VERSION for an unsupported gfx
+// target, as long as the ROCm library supports the target the override selects
+func suggestGfxOverride(gfx string, supported []string) string {
+	version, ok := rocmKnownGfxOverrides[gfx]
+	if !ok || !slices.Contains(supported, gfxTarget(version)) {
+		return ""
+	}
+	return version
+}
+
+// rocmCheckGfx determines whether the ROCm library can run on the GPU, applying the user's
+// HSA_OVERRIDE_GFX_VERSION for the device, or a known working override if OLLAMA_ROCM_AUTO_OVERRIDE
+// is set. Per device overrides are passed to the runner as HSA_OVERRIDE_GFX_VERSION_<id>. If the GPU
+// can't be used an error is returned along with a suggested workaround if one is known.
+func rocmCheckGfx(gpuInfo *GpuInfo, all string, byDevice map[string]string, supported []string) (suggestion string, err error) {
+	if version, ok := byDevice[gpuInfo.ID]; ok {
+		slog.Info("skipping rocm gfx compatibility check", "gpu", gpuInfo.ID, "HSA_OVERRIDE_GFX_VERSION", version)
+		gpuInfo.GfxOverride = version
+		gpuInfo.EnvWorkarounds = append(gpuInfo.EnvWorkarounds, [2]string{"HSA_OVERRIDE_GFX_VERSION_" + gpuInfo.ID, version})
+		return "", nil
+	}
+
+	if all != "" {
+		slog.Info("skipping rocm gfx compatibility check", "gpu", gpuInfo.ID, "HSA_OVERRIDE_GFX_VERSION", all)
+		gpuInfo.GfxOverride = all
+		return "", nil
+	}
+
+	// Strip off Target Features when comparing
+	gfx := strings.Split(gpuInfo.Compute, ":")[0]
+	if slices.Contains(supported, gfx) {
+		slog.Info("amdgpu is supported", "gpu", gpuInfo.ID, "gpu_type", gfx)
+		return "", nil
+	}
+
+	version := suggestGfxOverride(gfx, supported)
+	if version != "" && envconfig.RocmAutoOverride() {
+		slog.Info("amdgpu is not supported, applying known working override", "gpu", gpuInfo.ID, "gpu_type", gfx, "HSA_OVERRIDE_GFX_VERSION", version)
+		gpuInfo.GfxOverride = version
+		gpuInfo.GfxOverrideAuto = true
+		gpuInfo.EnvWorkarounds = append(gpuInfo.EnvWorkarounds, [2]string{"HSA_OVERRIDE_GFX_VERSION_" + gpuInfo.ID, version})
+		return "", nil
+	}
+
+	if version != "" {
+		suggestion = fmt.Sprintf("set OLLAMA_ROCM_AUTO_OVERRIDE=1 or HSA_OVERRIDE_GFX_VERSION=\"%s=%s\"", gpuInfo.ID, version)
+	}
+	return suggestion, fmt.Errorf("%s is not supported by the rocm library", gfx)
+}
+
 func rocmGetVisibleDevicesEnv(gpuInfo []GpuInfo) (string, string) {
 	ids := []string{}
 	for _, info := range gpuInfo {
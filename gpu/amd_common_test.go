@@ -0,0 +1,88 @@
+//go:build linux || windows
+
+package gpu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestGfxTarget(t *testing.T) {
+	cases := map[string]string{
+		"10.3.0":  "gfx1030",
+		"11.0.0":  "gfx1100",
+		"9.0.10":  "gfx90a",
+		"gfx1030": "",
+		"":        "",
+	}
+
+	for version, expect := range cases {
+		assert.Equal(t, expect, gfxTarget(version), version)
+	}
+}
+
+func TestRocmCheckGfx(t *testing.T) {
+	supported := []string{"gfx1030", "gfx1100", "gfx90a"}
+
+	type expect struct {
+		override   string
+		auto       bool
+		env        [][2]string
+		suggestion string
+		err        bool
+	}
+
+	cases := []struct {
+		name     string
+		compute  string
+		envs     map[string]string
+		expected expect
+	}{
+		{"supported", "gfx1030", nil, expect{}},
+		{"target features", "gfx90a:sramecc+:xnack-", nil, expect{}},
+		{"unknown", "gfx1010", nil, expect{err: true}},
+		{
+			"suggested", "gfx1031", nil,
+			expect{suggestion: `set OLLAMA_ROCM_AUTO_OVERRIDE=1 or HSA_OVERRIDE_GFX_VERSION="0=10.3.0"`, err: true},
+		},
+		{
+			"automatic", "gfx1101", map[string]string{"OLLAMA_ROCM_AUTO_OVERRIDE": "1"},
+			expect{override: "11.0.0", auto: true, env: [][2]string{{"HSA_OVERRIDE_GFX_VERSION_0", "11.0.0"}}},
+		},
+		{"all devices", "gfx1010", map[string]string{"HSA_OVERRIDE_GFX_VERSION": "10.3.0"}, expect{override: "10.3.0"}},
+		{
+			"this device", "gfx1031", map[string]string{"HSA_OVERRIDE_GFX_VERSION": "1=11.0.0,0=10.3.0"},
+			expect{override: "10.3.0", env: [][2]string{{"HSA_OVERRIDE_GFX_VERSION_0", "10.3.0"}}},
+		},
+		{
+			"other device", "gfx1031", map[string]string{"HSA_OVERRIDE_GFX_VERSION": "1=11.0.0"},
+			expect{suggestion: `set OLLAMA_ROCM_AUTO_OVERRIDE=1 or HSA_OVERRIDE_GFX_VERSION="0=10.3.0"`, err: true},
+		},
+		{
+			"user override wins", "gfx1031", map[string]string{"HSA_OVERRIDE_GFX_VERSION": "0=11.0.0", "OLLAMA_ROCM_AUTO_OVERRIDE": "1"},
+			expect{override: "11.0.0", env: [][2]string{{"HSA_OVERRIDE_GFX_VERSION_0", "11.0.0"}}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HSA_OVERRIDE_GFX_VERSION", "")
+			t.Setenv("OLLAMA_ROCM_AUTO_OVERRIDE", "")
+			for k, v := range tt.envs {
+				t.Setenv(k, v)
+			}
+
+			info := GpuInfo{Library: "rocm", ID: "0", Compute: tt.compute}
+			all, byDevice := envconfig.HsaOverrideGfxVersionByDevice()
+			suggestion, err := rocmCheckGfx(&info, all, byDevice, supported)
+			assert.Equal(t, tt.expected.err, err != nil, err)
+			assert.Equal(t, tt.expected.suggestion, suggestion)
+			assert.Equal(t, tt.expected.override, info.GfxOverride)
+			assert.Equal(t, tt.expected.auto, info.GfxOverrideAuto)
+			assert.Equal(t, tt.expected.env, info.EnvWorkarounds)
+		})
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -46,11 +45,13 @@ var (
 	RocmStandardLocations = []string{"/opt/rocm/lib", "/usr/lib64"}
 )
 
-// Gather GPU information from the amdgpu driver if any supported GPUs are detected
-func AMDGetGPUInfo() []RocmGPUInfo {
+// Gather GPU information from the amdgpu driver if any supported GPUs are detected, along with
+// any GPUs that were found but can't be used
+func AMDGetGPUInfo() ([]RocmGPUInfo, []UnsupportedGPUInfo) {
 	resp := []RocmGPUInfo{}
+	var unsupported []UnsupportedGPUInfo
 	if !AMDDetected() {
-		return resp
+		return resp, nil
 	}
 
 	// Opportunistic logging of driver version to aid in troubleshooting
@@ -77,7 +78,7 @@ func AMDGetGPUInfo() []RocmGPUInfo {
 		visibleDevices = strings.Split(gpuDO, ",")
 	}
 
-	gfxOverride := envconfig.HsaOverrideGfxVersion()
+	gfxOverride, gfxOverrideByDevice := envconfig.HsaOverrideGfxVersionByDevice()
 	var supported []string
 	libDir := ""
 
@@ -195,7 +196,7 @@ func AMDGetGPUInfo() []RocmGPUInfo {
 		// Shouldn't happen, but just in case...
 		if gpuID < 0 {
 			slog.Error("unexpected amdgpu sysfs data resulted in negative GPU ID, please set OLLAMA_DEBUG=1 and report an issue")
-			return nil
+			return nil, unsupported
 		}
 
 		if int(major) < RocmComputeMin {
@@ -321,32 +322,29 @@ func AMDGetGPUInfo() []RocmGPUInfo {
 			libDir, err = AMDValidateLibDir()
 			if err != nil {
 				slog.Warn("unable to verify rocm library, will use cpu", "error", err)
-				return nil
+				return nil, unsupported
 			}
 		}
 		gpuInfo.DependencyPath = libDir
 
-		if gfxOverride == "" {
-			// Only load supported list once
-			if len(supported) == 0 {
-				supported, err = GetSupportedGFX(libDir)
-				if err != nil {
-					slog.Warn("failed to lookup supported GFX types, falling back to CPU mode", "error", err)
-					return nil
-				}
-				slog.Debug("rocm supported GPUs", "types", supported)
+		// Only load supported list once
+		if gfxOverride == "" && len(supported) == 0 {
+			supported, err = GetSupportedGFX(libDir)
+			if err != nil {
+				slog.Warn("failed to lookup supported GFX types, falling back to CPU mode", "error", err)
+				return nil, unsupported
 			}
-			gfx := gpuInfo.Compute
-			if !slices.Contains[[]string, string](supported, gfx) {
-				slog.Warn("amdgpu is not supported", "gpu", gpuInfo.ID, "gpu_type", gfx, "library", libDir, "supported_types", supported)
-				// TODO - consider discrete markdown just for ROCM troubleshooting?
-				slog.Warn("See https://github.com/ollama/ollama/blob/main/docs/gpu.md#overrides for HSA_OVERRIDE_GFX_VERSION usage")
-				continue
-			} else {
-				slog.Info("amdgpu is supported", "gpu", gpuInfo.ID, "gpu_type", gfx)
+			slog.Debug("rocm supported GPUs", "types", supported)
+		}
+		if suggestion, err := rocmCheckGfx(&gpuInfo.GpuInfo, gfxOverride, gfxOverrideByDevice, supported); err != nil {
+			slog.Warn("amdgpu is not supported", "gpu", gpuInfo.ID, "gpu_type", gpuInfo.Compute, "library", libDir, "supported_types", supported)
+			if suggestion != "" {
+				slog.Warn("amdgpu is known to work with a gfx override, "+suggestion, "gpu", gpuInfo.ID, "gpu_type", gpuInfo.Compute)
 			}
-		} else {
-			slog.Info("skipping rocm gfx compatibility check", "HSA_OVERRIDE_GFX_VERSION", gfxOverride)
+			// TODO - consider discrete markdown just for ROCM troubleshooting?
+			slog.Warn("See https://github.com/ollama/ollama/blob/main/docs/gpu.md#overrides for HSA_OVERRIDE_GFX_VERSION usage")
+			unsupported = append(unsupported, UnsupportedGPUInfo{GpuInfo: gpuInfo.GpuInfo, Reason: err.Error(), Suggestion: suggestion})
+			continue
 		}
 
 		// Check for env var workarounds
@@ -362,9 +360,9 @@ func AMDGetGPUInfo() []RocmGPUInfo {
 	}
 	if err := verifyKFDDriverAccess(); err != nil {
 		slog.Error("amdgpu devices detected but permission problems block access", "error", err)
-		return nil
+		return nil, unsupported
 	}
-	return resp
+	return resp, unsupported
 }
 
 // Quick check for AMD driver so we can skip amdgpu discovery if not present
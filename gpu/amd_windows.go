@@ -3,6 +3,7 @@ package gpu
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -26,12 +27,15 @@ var (
 	RocmStandardLocations = []string{"C:\\Program Files\\AMD\\ROCm\\6.1\\bin"} // TODO glob?
 )
 
-func AMDGetGPUInfo() []RocmGPUInfo {
+// Gather GPU information from the HIP library if any supported GPUs are detected, along with
+// any GPUs that were found but can't be used
+func AMDGetGPUInfo() ([]RocmGPUInfo, []UnsupportedGPUInfo) {
 	resp := []RocmGPUInfo{}
+	var unsupported []UnsupportedGPUInfo
 	hl, err := NewHipLib()
 	if err != nil {
 		slog.Debug(err.Error())
-		return nil
+		return nil, nil
 	}
 	defer hl.Release()
 
@@ -44,21 +48,30 @@ func AMDGetGPUInfo() []RocmGPUInfo {
 	// Note: the HIP library automatically handles subsetting to any HIP_VISIBLE_DEVICES the user specified
 	count := hl.HipGetDeviceCount()
 	if count == 0 {
-		return nil
+		return nil, nil
 	}
 	libDir, err := AMDValidateLibDir()
 	if err != nil {
 		slog.Warn("unable to verify rocm library, will use cpu", "error", err)
-		return nil
+		return nil, nil
 	}
 
 	var supported []string
-	gfxOverride := envconfig.HsaOverrideGfxVersion()
+	gfxOverride, gfxOverrideByDevice := envconfig.HsaOverrideGfxVersionByDevice()
+	if len(gfxOverrideByDevice) > 0 {
+		// per device overrides are passed as HSA_OVERRIDE_GFX_VERSION_<id>,
+		// which only the linux ROCm runtime reads
+		slog.Warn("per GPU HSA_OVERRIDE_GFX_VERSION isn't supported on windows, ignoring it", "HSA_OVERRIDE_GFX_VERSION", envconfig.HsaOverrideGfxVersion())
+		gfxOverride = ""
+	}
+	if envconfig.RocmAutoOverride() {
+		slog.Warn("OLLAMA_ROCM_AUTO_OVERRIDE isn't supported on windows, ignoring it")
+	}
 	if gfxOverride == "" {
 		supported, err = GetSupportedGFX(libDir)
 		if err != nil {
 			slog.Warn("failed to lookup supported GFX types, falling back to CPU mode", "error", err)
-			return nil
+			return nil, nil
 		}
 	} else {
 		slog.Info("skipping rocm gfx compatibility check", "HSA_OVERRIDE_GFX_VERSION", gfxOverride)
@@ -97,6 +110,10 @@ func AMDGetGPUInfo() []RocmGPUInfo {
 				slog.Warn("amdgpu is not supported", "gpu", i, "gpu_type", gfx, "library", libDir, "supported_types", supported)
 				// TODO - consider discrete markdown just for ROCM troubleshooting?
 				slog.Warn("See https://github.com/ollama/ollama/blob/main/docs/troubleshooting.md for HSA_OVERRIDE_GFX_VERSION usage")
+				unsupported = append(unsupported, UnsupportedGPUInfo{
+					GpuInfo: GpuInfo{Library: "rocm", ID: strconv.Itoa(i), Name: name, Compute: gfx},
+					Reason:  fmt.Sprintf("%s is not supported by the rocm library", strings.Split(gfx, ":")[0]),
+				})
 				continue
 			} else {
 				slog.Debug("amdgpu is supported", "gpu", i, "gpu_type", gfx)
@@ -141,7 +158,7 @@ func AMDGetGPUInfo() []RocmGPUInfo {
 		resp = append(resp, gpuInfo)
 	}
 
-	return resp
+	return resp, unsupported
 }
 
 func AMDValidateLibDir() (string, error) {
@@ -4,12 +4,19 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 
 	"golang.org/x/sys/cpu"
 )
 
 func GetCPUCapability() CPUCapability {
+	if cpu.X86.HasAVX2 && hasAVX512() {
+		if hasAMX() {
+			return CPUCapabilityAMX
+		}
+		return CPUCapabilityAVX512
+	}
 	if cpu.X86.HasAVX2 {
 		return CPUCapabilityAVX2
 	}
@@ -20,6 +27,37 @@ func GetCPUCapability() CPUCapability {
 	return CPUCapabilityNone
 }
 
+// hasAVX512 requires every AVX-512 subset the runners are built with. Hypervisors
+// may mask individual CPUID bits, so a partial feature set is treated as none.
+func hasAVX512() bool {
+	return cpu.X86.HasAVX512F &&
+		cpu.X86.HasAVX512CD &&
+		cpu.X86.HasAVX512BW &&
+		cpu.X86.HasAVX512DQ &&
+		cpu.X86.HasAVX512VL
+}
+
+// hasAMX requires the tile and int8 extensions, and that the kernel has enabled
+// tile state, which linux only advertises in /proc/cpuinfo when it is usable
+func hasAMX() bool {
+	if !cpu.X86.HasAMXTile || !cpu.X86.HasAMXInt8 || runtime.GOOS != "linux" {
+		return false
+	}
+
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "flags") {
+			return slices.Contains(strings.Fields(line), "amx_tile") && slices.Contains(strings.Fields(line), "amx_int8")
+		}
+	}
+
+	return false
+}
+
 func IsNUMA() bool {
 	if runtime.GOOS != "linux" {
 		// numa support in llama.cpp is linux only
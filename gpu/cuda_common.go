@@ -9,12 +9,58 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+
+	"github.com/ollama/ollama/envconfig"
 )
 
 // Jetson devices have JETSON_JETPACK="x.y.z" factory set to the Jetpack version installed.
 // Included to drive logic for reducing Ollama-allocated overhead on L4T/Jetson devices.
 var CudaTegra string = os.Getenv("JETSON_JETPACK")
 
+// Device tree entries used to identify Jetson (Tegra) systems
+var (
+	tegraModelPath      = "/proc/device-tree/model"
+	tegraCompatiblePath = "/proc/device-tree/compatible"
+	tegraReleasePath    = "/etc/nv_tegra_release"
+)
+
+// tegraModel reports whether this is a Jetson (Tegra) system along with the
+// model name from the device tree, if available
+func tegraModel() (string, bool) {
+	if runtime.GOARCH != "arm64" || runtime.GOOS != "linux" {
+		return "", false
+	}
+
+	var model string
+	if data, err := os.ReadFile(tegraModelPath); err == nil {
+		model = strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+	}
+
+	tegra := CudaTegra != "" || strings.Contains(strings.ToLower(model), "jetson")
+	if !tegra {
+		if data, err := os.ReadFile(tegraCompatiblePath); err == nil {
+			tegra = strings.Contains(string(data), "nvidia,tegra")
+		}
+	}
+	if !tegra {
+		_, err := os.Stat(tegraReleasePath)
+		tegra = err == nil
+	}
+	if !tegra {
+		return "", false
+	}
+
+	if model == "" {
+		model = "unknown"
+	}
+	return model, true
+}
+
+// tegraMemoryBudget returns the portion of system memory the Jetson iGPU may use
+func tegraMemoryBudget(systemTotal uint64) uint64 {
+	return uint64(float64(systemTotal) * envconfig.TegraMemoryFraction())
+}
+
 func cudaGetVisibleDevicesEnv(gpuInfo []GpuInfo) (string, string) {
 	ids := []string{}
 	for _, info := range gpuInfo {
@@ -35,7 +81,7 @@ func cudaVariant(gpuInfo CudaGPUInfo) string {
 			if len(ver) > 0 {
 				return "jetpack" + ver[0]
 			}
-		} else if data, err := os.ReadFile("/etc/nv_tegra_release"); err == nil {
+		} else if data, err := os.ReadFile(tegraReleasePath); err == nil {
 			r := regexp.MustCompile(` R(\d+) `)
 			m := r.FindSubmatch(data)
 			if len(m) != 2 {
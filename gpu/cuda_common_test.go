@@ -0,0 +1,65 @@
+//go:build linux || windows
+
+package gpu
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ollama/ollama/format"
+)
+
+func TestTegraMemoryBudget(t *testing.T) {
+	cases := map[string]uint64{
+		"":    48 * format.GibiByte,
+		"0.5": 32 * format.GibiByte,
+		"1":   64 * format.GibiByte,
+		// invalid values
+		"0":   48 * format.GibiByte,
+		"1.5": 48 * format.GibiByte,
+		"-1":  48 * format.GibiByte,
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("OLLAMA_TEGRA_MEMORY_FRACTION", k)
+			assert.Equal(t, v, tegraMemoryBudget(64*format.GibiByte))
+		})
+	}
+}
+
+func TestTegraModel(t *testing.T) {
+	if runtime.GOARCH != "arm64" || runtime.GOOS != "linux" {
+		_, ok := tegraModel()
+		assert.False(t, ok)
+		t.Skip("tegra detection only applies to linux/arm64")
+	}
+
+	modelPath, compatiblePath, releasePath, jetpack := tegraModelPath, tegraCompatiblePath, tegraReleasePath, CudaTegra
+	t.Cleanup(func() {
+		tegraModelPath, tegraCompatiblePath, tegraReleasePath, CudaTegra = modelPath, compatiblePath, releasePath, jetpack
+	})
+
+	dir := t.TempDir()
+	tegraModelPath = filepath.Join(dir, "model")
+	tegraCompatiblePath = filepath.Join(dir, "compatible")
+	tegraReleasePath = filepath.Join(dir, "nv_tegra_release")
+	CudaTegra = ""
+
+	_, ok := tegraModel()
+	assert.False(t, ok)
+
+	assert.NoError(t, os.WriteFile(tegraCompatiblePath, []byte("nvidia,p3737-0000+p3701-0000\x00nvidia,tegra234\x00"), 0o644))
+	model, ok := tegraModel()
+	assert.True(t, ok)
+	assert.Equal(t, "unknown", model)
+
+	assert.NoError(t, os.WriteFile(tegraModelPath, []byte("NVIDIA Jetson AGX Orin Developer Kit\x00"), 0o644))
+	model, ok = tegraModel()
+	assert.True(t, ok)
+	assert.Equal(t, "NVIDIA Jetson AGX Orin Developer Kit", model)
+}
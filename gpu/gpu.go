@@ -54,6 +54,9 @@ var (
 	nvmlLibPath   string
 	rocmGPUs      []RocmGPUInfo
 	oneapiGPUs    []OneapiGPUInfo
+
+	// GPUs found during discovery that can't be used
+	unsupportedGPUs []UnsupportedGPUInfo
 )
 
 // With our current CUDA compile flags, older than 5.0 will not work properly
@@ -167,6 +170,14 @@ func GetCPUInfo() GpuInfoList {
 	return GpuInfoList{cpus[0].GpuInfo}
 }
 
+// GetUnsupportedGPUInfo returns the GPUs found during discovery that can't be used, with the reason
+func GetUnsupportedGPUInfo() []UnsupportedGPUInfo {
+	GetGPUInfo()
+	gpuMutex.Lock()
+	defer gpuMutex.Unlock()
+	return append([]UnsupportedGPUInfo{}, unsupportedGPUs...)
+}
+
 func GetGPUInfo() GpuInfoList {
 	// TODO - consider exploring lspci (and equivalent on windows) to check for
 	// GPUs so we can report warnings if we see Nvidia/AMD but fail to load the libraries
@@ -279,6 +290,21 @@ func GetGPUInfo() GpuInfoList {
 				gpuInfo.Name = C.GoString(&memInfo.gpu_name[0])
 				gpuInfo.Variant = variant
 
+				// Jetson iGPUs have no dedicated VRAM, so budget a portion of system memory
+				if model, ok := tegraModel(); ok {
+					budget := tegraMemoryBudget(cpus[0].TotalMemory)
+					gpuInfo.TotalMemory = budget
+					gpuInfo.FreeMemory = min(gpuInfo.FreeMemory, budget)
+					gpuInfo.UnifiedMemory = true
+					slog.Info("detected jetson device",
+						"id", gpuInfo.ID,
+						"model", model,
+						"variant", variant,
+						"system_memory", format.HumanBytes2(cpus[0].TotalMemory),
+						"budget", format.HumanBytes2(budget),
+					)
+				}
+
 				// query the management library as well so we can record any skew between the two
 				// which represents overhead on the GPU we must set aside on subsequent updates
 				if cHandles.nvml != nil {
@@ -341,7 +367,21 @@ func GetGPUInfo() GpuInfoList {
 			}
 		}
 
-		rocmGPUs = AMDGetGPUInfo()
+		rocmGPUs, unsupportedGPUs = AMDGetGPUInfo()
+
+		// Reservations are indexed in the same order GPUs are reported below
+		discovered := []*GpuInfo{}
+		for i := range cudaGPUs {
+			discovered = append(discovered, &cudaGPUs[i].GpuInfo)
+		}
+		for i := range rocmGPUs {
+			discovered = append(discovered, &rocmGPUs[i].GpuInfo)
+		}
+		for i := range oneapiGPUs {
+			discovered = append(discovered, &oneapiGPUs[i].GpuInfo)
+		}
+		setOverhead(discovered)
+
 		bootstrapped = true
 		if len(cudaGPUs) == 0 && len(rocmGPUs) == 0 && len(oneapiGPUs) == 0 {
 			slog.Info("no compatible GPUs were discovered")
@@ -421,6 +461,9 @@ func GetGPUInfo() GpuInfoList {
 				),
 			)
 			cudaGPUs[i].FreeMemory = uint64(memInfo.free)
+			if gpu.UnifiedMemory {
+				cudaGPUs[i].FreeMemory = min(cudaGPUs[i].FreeMemory, gpu.TotalMemory)
+			}
 		}
 
 		if oHandles == nil && len(oneapiGPUs) > 0 {
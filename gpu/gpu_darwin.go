@@ -34,15 +34,21 @@ func GetGPUInfo() GpuInfoList {
 		Library: "metal",
 		ID:      "0",
 	}
-	info.TotalMemory = uint64(C.getRecommendedMaxVRAM())
+	info.TotalMemory = metalMemoryBudget(uint64(C.getRecommendedMaxVRAM()), uint64(C.getPhysicalMemory()))
 
 	// TODO is there a way to gather actual allocated video memory? (currentAllocatedSize doesn't work)
 	info.FreeMemory = info.TotalMemory
 
 	info.MinimumMemory = metalMinimumMemory
+	setOverhead([]*GpuInfo{&info})
 	return []GpuInfo{info}
 }
 
+// GetUnsupportedGPUInfo returns the GPUs found during discovery that can't be used, with the reason
+func GetUnsupportedGPUInfo() []UnsupportedGPUInfo {
+	return nil
+}
+
 func GetCPUInfo() GpuInfoList {
 	mem, _ := GetCPUMem()
 	return []GpuInfo{
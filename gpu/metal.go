@@ -0,0 +1,23 @@
+package gpu
+
+import (
+	"log/slog"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+)
+
+// metalMemoryBudget returns the memory Metal may use for models. OLLAMA_METAL_MEMORY_LIMIT lowers the
+// recommended working set size reported by Metal, but can't raise it, since unified memory beyond it is
+// needed by the system and would be overcommitted.
+func metalMemoryBudget(recommended, physical uint64) uint64 {
+	budget := recommended
+	if limit := envconfig.MetalMemoryLimit(); limit > recommended {
+		slog.Warn("OLLAMA_METAL_MEMORY_LIMIT exceeds the recommended working set size, using recommended limit", "limit", format.HumanBytes2(limit), "physical", format.HumanBytes2(physical), "recommended", format.HumanBytes2(recommended))
+	} else if limit > 0 {
+		budget = limit
+	}
+
+	slog.Debug("metal memory budget", "budget", format.HumanBytes2(budget), "recommended", format.HumanBytes2(recommended), "physical", format.HumanBytes2(physical))
+	return budget
+}
@@ -0,0 +1,27 @@
+package gpu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ollama/ollama/format"
+)
+
+func TestMetalMemoryBudget(t *testing.T) {
+	cases := map[string]uint64{
+		"":      48 * format.GibiByte,
+		"32GiB": 32 * format.GibiByte,
+		"48GiB": 48 * format.GibiByte,
+		// limits above the recommended size are capped at it
+		"56GiB":  48 * format.GibiByte,
+		"128GiB": 48 * format.GibiByte,
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("OLLAMA_METAL_MEMORY_LIMIT", k)
+			assert.Equal(t, v, metalMemoryBudget(48*format.GibiByte, 64*format.GibiByte))
+		})
+	}
+}
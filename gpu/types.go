@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 )
 
@@ -24,17 +25,28 @@ type GpuInfo struct {
 	// MinimumMemory represents the minimum memory required to use the GPU
 	MinimumMemory uint64 `json:"-"`
 
+	// Overhead is the VRAM set aside on this GPU by OLLAMA_GPU_OVERHEAD
+	Overhead uint64 `json:"-"`
+
 	// Any extra PATH/LD_LIBRARY_PATH dependencies required for the Library to operate properly
 	DependencyPath string `json:"lib_path,omitempty"`
 
 	// Extra environment variables specific to the GPU as list of [key,value]
 	EnvWorkarounds [][2]string `json:"envs,omitempty"`
 
+	// HSA_OVERRIDE_GFX_VERSION applied to this AMD GPU, and whether it was selected automatically
+	GfxOverride     string `json:"gfx_override,omitempty"`
+	GfxOverrideAuto bool   `json:"gfx_override_auto,omitempty"`
+
 	// Set to true if we can NOT reliably discover FreeMemory.  A value of true indicates
 	// the FreeMemory is best effort, and may over or under report actual memory usage
 	// False indicates FreeMemory can generally be trusted on this GPU
 	UnreliableFreeMemory bool
 
+	// Set to true for integrated GPUs that share system memory with the CPU (e.g. Jetson)
+	// so the same memory is not counted as available to both
+	UnifiedMemory bool `json:"unified_memory,omitempty"`
+
 	// GPU information
 	ID      string `json:"gpu_id"`  // string to use for selection of this specific GPU
 	Name    string `json:"name"`    // user friendly name if available
@@ -51,6 +63,13 @@ type CPUInfo struct {
 	GpuInfo
 }
 
+// UnsupportedGPUInfo is a GPU found during discovery that can't be used, with a suggested workaround if one is known
+type UnsupportedGPUInfo struct {
+	GpuInfo
+	Reason     string `json:"reason"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
 type CudaGPUInfo struct {
 	GpuInfo
 	OSOverhead   uint64 // Memory overhead between the driver library and management library
@@ -101,6 +120,21 @@ func (l GpuInfoList) ByLibrary() []GpuInfoList {
 	return resp
 }
 
+// setOverhead records the OLLAMA_GPU_OVERHEAD reservation on each GPU. The GPUs must be in discovery order.
+func setOverhead(gpus []*GpuInfo) {
+	overhead := envconfig.GpuOverhead()
+	if overhead.Mismatched(len(gpus)) {
+		slog.Warn("OLLAMA_GPU_OVERHEAD does not have one value per GPU, applying the first value to all GPUs", "gpu_count", len(gpus), "overhead", overhead)
+	}
+
+	for i, g := range gpus {
+		g.Overhead = overhead.Get(i, g.ID, len(gpus))
+		if g.Overhead > 0 {
+			slog.Debug("reserving gpu overhead", "id", g.ID, "library", g.Library, "overhead", format.HumanBytes2(g.Overhead))
+		}
+	}
+}
+
 // Report the GPU information into the log an Info level
 func (l GpuInfoList) LogDetails() {
 	for _, g := range l {
@@ -124,6 +158,13 @@ func (a ByFreeMemory) Len() int           { return len(a) }
 func (a ByFreeMemory) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByFreeMemory) Less(i, j int) bool { return a[i].FreeMemory < a[j].FreeMemory }
 
+// Sort by Total Space
+type ByTotalMemory []GpuInfo
+
+func (a ByTotalMemory) Len() int           { return len(a) }
+func (a ByTotalMemory) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByTotalMemory) Less(i, j int) bool { return a[i].TotalMemory < a[j].TotalMemory }
+
 type CPUCapability uint32
 
 // Override at build time when building base GPU runners
@@ -133,7 +174,8 @@ const (
 	CPUCapabilityNone CPUCapability = iota
 	CPUCapabilityAVX
 	CPUCapabilityAVX2
-	// TODO AVX512
+	CPUCapabilityAVX512
+	CPUCapabilityAMX
 )
 
 func (c CPUCapability) String() string {
@@ -142,6 +184,10 @@ func (c CPUCapability) String() string {
 		return "avx"
 	case CPUCapabilityAVX2:
 		return "avx2"
+	case CPUCapabilityAVX512:
+		return "avx512"
+	case CPUCapabilityAMX:
+		return "amx"
 	default:
 		return "no vector extensions"
 	}
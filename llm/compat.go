@@ -0,0 +1,104 @@
+package llm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/version"
+)
+
+//go:generate go run ./generate/architectures
+
+// MaxGGUFVersion is the newest GGUF file version this build can read
+const MaxGGUFVersion = 3
+
+// architectureVersions maps model architectures that this build's llama.cpp
+// can't load to the first version of Ollama that supports them. Keep it up
+// to date as support for new architectures is released.
+var architectureVersions = map[string]string{
+	"mllama":   "0.4.0",
+	"gemma3":   "0.6.0",
+	"mistral3": "0.6.5",
+	"llama4":   "0.6.6",
+	"qwen3":    "0.6.6",
+	"qwen3moe": "0.6.6",
+	"qwen25vl": "0.7.0",
+	"gemma3n":  "0.9.3",
+	"gptoss":   "0.11.0",
+}
+
+// Architectures returns the model architectures this build can load
+func Architectures() []string {
+	return slices.Clone(supportedArchitectures)
+}
+
+// CheckArchitecture returns an *UnsupportedModelError if this build can't
+// load models of architecture arch, naming the first version of Ollama known
+// to support it if there is one
+func CheckArchitecture(arch string) error {
+	if minVersion, ok := architectureVersions[arch]; ok {
+		return &UnsupportedModelError{Architecture: arch, MinVersion: minVersion}
+	}
+
+	if !slices.Contains(supportedArchitectures, arch) {
+		return &UnsupportedModelError{Architecture: arch}
+	}
+
+	return nil
+}
+
+// UnsupportedModelError is returned for models that need a newer version of
+// Ollama than this one, detected from their GGUF header and metadata before
+// they're loaded, or from their architecture before they're pulled
+type UnsupportedModelError struct {
+	// Architecture is the model's architecture, which is empty if the file's
+	// version is too new to read it
+	Architecture string
+
+	// GGUFVersion is the version of the model's file, or zero if the model
+	// was checked before it was downloaded
+	GGUFVersion uint32
+
+	// MinVersion is the first version of Ollama known to support the model,
+	// or empty if it isn't known
+	MinVersion string
+}
+
+func (e *UnsupportedModelError) Error() string {
+	var sb strings.Builder
+	switch {
+	case e.Architecture != "" && e.GGUFVersion > 0:
+		fmt.Fprintf(&sb, "model architecture %q (GGUF v%d)", e.Architecture, e.GGUFVersion)
+	case e.Architecture != "":
+		fmt.Fprintf(&sb, "model architecture %q", e.Architecture)
+	default:
+		fmt.Fprintf(&sb, "GGUF v%d", e.GGUFVersion)
+	}
+
+	fmt.Fprintf(&sb, " is not supported by this version of Ollama (%s)", version.Version)
+	if e.MinVersion != "" {
+		fmt.Fprintf(&sb, "; it requires Ollama %s or later", e.MinVersion)
+	} else if e.Architecture == "" {
+		fmt.Fprintf(&sb, ", which reads GGUF v%d and earlier", MaxGGUFVersion)
+	}
+
+	sb.WriteString(". Download the latest version at https://ollama.com/download")
+	return sb.String()
+}
+
+// CheckSupported returns an *UnsupportedModelError if the model needs a newer
+// version of Ollama to load
+func (llm GGML) CheckSupported() error {
+	c, ok := llm.container.(*containerGGUF)
+	if !ok {
+		return nil
+	}
+
+	arch := llm.KV().Architecture()
+	if minVersion, ok := architectureVersions[arch]; ok {
+		return &UnsupportedModelError{Architecture: arch, GGUFVersion: c.Version, MinVersion: minVersion}
+	}
+
+	return nil
+}
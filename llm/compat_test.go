@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnsupportedGGUFVersion(t *testing.T) {
+	var b bytes.Buffer
+	for _, v := range []any{uint32(FILE_MAGIC_GGUF_LE), uint32(4), uint64(0), uint64(0)} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, err := DecodeGGML(bytes.NewReader(b.Bytes()), 0)
+
+	var uerr *UnsupportedModelError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an unsupported model error, got %v", err)
+	}
+
+	if uerr.GGUFVersion != 4 || uerr.Architecture != "" {
+		t.Errorf("unexpected error %+v", uerr)
+	}
+
+	if !strings.Contains(err.Error(), "GGUF v4 is not supported") || !strings.Contains(err.Error(), "ollama.com/download") {
+		t.Errorf("expected an actionable error, got %q", err)
+	}
+}
+
+func TestCheckSupported(t *testing.T) {
+	decode := func(t *testing.T, arch string) *GGML {
+		t.Helper()
+
+		f, err := os.CreateTemp(t.TempDir(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := WriteGGUF(f, KV{"general.architecture": arch}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, _, err := DecodeGGML(f, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ggml
+	}
+
+	// architectures that aren't known to be unsupported are left to the
+	// runner to load
+	for _, arch := range []string{"llama", "bert", "unknown-arch"} {
+		if err := decode(t, arch).CheckSupported(); err != nil {
+			t.Errorf("%s: expected no error, got %v", arch, err)
+		}
+	}
+
+	err := decode(t, "gemma3").CheckSupported()
+
+	var uerr *UnsupportedModelError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an unsupported model error, got %v", err)
+	}
+
+	if *uerr != (UnsupportedModelError{Architecture: "gemma3", GGUFVersion: 3, MinVersion: "0.6.0"}) {
+		t.Errorf("unexpected error %+v", uerr)
+	}
+
+	if !strings.Contains(err.Error(), `model architecture "gemma3" (GGUF v3)`) || !strings.Contains(err.Error(), "requires Ollama 0.6.0 or later") {
+		t.Errorf("expected an actionable error, got %q", err)
+	}
+}
+
+func TestCheckArchitecture(t *testing.T) {
+	for _, arch := range []string{"llama", "bert", "gemma2", "solar"} {
+		if err := CheckArchitecture(arch); err != nil {
+			t.Errorf("%s: expected no error, got %v", arch, err)
+		}
+	}
+
+	cases := []struct {
+		arch   string
+		expect UnsupportedModelError
+		msg    string
+	}{
+		{"gemma3", UnsupportedModelError{Architecture: "gemma3", MinVersion: "0.6.0"}, `model architecture "gemma3" is not supported by this version of Ollama (0.0.0); it requires Ollama 0.6.0 or later`},
+		{"unknown-arch", UnsupportedModelError{Architecture: "unknown-arch"}, `model architecture "unknown-arch" is not supported by this version of Ollama (0.0.0).`},
+	}
+
+	for _, tt := range cases {
+		err := CheckArchitecture(tt.arch)
+
+		var uerr *UnsupportedModelError
+		if !errors.As(err, &uerr) {
+			t.Fatalf("%s: expected an unsupported model error, got %v", tt.arch, err)
+		}
+
+		if *uerr != tt.expect {
+			t.Errorf("%s: unexpected error %+v", tt.arch, uerr)
+		}
+
+		if !strings.HasPrefix(err.Error(), tt.msg) {
+			t.Errorf("%s: expected %q, got %q", tt.arch, tt.msg, err)
+		}
+	}
+
+	if archs := Architectures(); !slices.IsSorted(archs) || slices.ContainsFunc(archs, func(arch string) bool {
+		_, ok := architectureVersions[arch]
+		return ok
+	}) {
+		t.Errorf("expected sorted architectures without any that need a newer version, got %v", archs)
+	}
+}
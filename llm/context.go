@@ -0,0 +1,224 @@
+package llm
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ErrContextOption is returned for sliding window, attention sink and RoPE
+// options that are invalid or that the model's architecture doesn't support
+var ErrContextOption = errors.New("invalid context option")
+
+// noRopeArchitectures are the architectures that don't use rotary position
+// embeddings, which the RoPE options have no effect on
+var noRopeArchitectures = []string{"bert", "jina-bert-v2", "t5", "t5encoder", "gpt2", "bloom", "mpt", "mamba", "rwkv6"}
+
+// SlidingWindow returns the size of the model's sliding attention window, or
+// 0 if it doesn't use sliding-window attention
+func (kv KV) SlidingWindow() uint64 {
+	return kv.u64(fmt.Sprintf("%s.attention.sliding_window", kv.Architecture()))
+}
+
+// RopeFrequencyBase returns the model's RoPE base frequency, or 0 if the
+// metadata doesn't have it
+func (kv KV) RopeFrequencyBase() float32 {
+	return kv.f32(fmt.Sprintf("%s.rope.freq_base", kv.Architecture()))
+}
+
+// RopeScaling returns the model's RoPE scaling method, or an empty string if
+// the metadata doesn't have it
+func (kv KV) RopeScaling() string {
+	s, _ := kv[fmt.Sprintf("%s.rope.scaling.type", kv.Architecture())].(string)
+	return s
+}
+
+// RopeScalingFactor returns the factor the model's context is extended by
+// with RoPE scaling, or 0 if the metadata doesn't have it
+func (kv KV) RopeScalingFactor() float32 {
+	return kv.f32(fmt.Sprintf("%s.rope.scaling.factor", kv.Architecture()))
+}
+
+// RopeScalingOrigCtx returns the context length the model was trained with
+// before its context was extended with RoPE scaling, or 0 if the metadata
+// doesn't have it
+func (kv KV) RopeScalingOrigCtx() uint64 {
+	return kv.u64(fmt.Sprintf("%s.rope.scaling.original_context_length", kv.Architecture()))
+}
+
+func (kv KV) f32(key string) float32 {
+	switch v := kv[key].(type) {
+	case float32:
+		return v
+	case float64:
+		return float32(v)
+	default:
+		return 0
+	}
+}
+
+// CheckContextOptions reports an error wrapping ErrContextOption if any of the
+// sliding window, attention sink or RoPE options is out of range
+func CheckContextOptions(opts api.Runner) error {
+	if opts.RopeScaling != "" && !slices.Contains(api.RopeScalingTypes, opts.RopeScaling) {
+		return fmt.Errorf("%w: rope_scaling '%s', expected one of %s", ErrContextOption, opts.RopeScaling, strings.Join(api.RopeScalingTypes, ", "))
+	}
+
+	for _, o := range contextOptions(opts) {
+		if o.value < 0 {
+			return fmt.Errorf("%w: %s can't be negative", ErrContextOption, o.name)
+		}
+	}
+
+	if opts.SlidingWindow > 0 && opts.AttentionSinks >= opts.SlidingWindow {
+		return fmt.Errorf("%w: attention_sinks must be less than sliding_window", ErrContextOption)
+	}
+
+	return nil
+}
+
+// CheckContextOptions reports an error wrapping ErrContextOption if any of the
+// sliding window, attention sink or RoPE options is out of range or isn't
+// supported by the model's architecture
+func (kv KV) CheckContextOptions(opts api.Runner) error {
+	if err := CheckContextOptions(opts); err != nil {
+		return err
+	}
+
+	arch := kv.Architecture()
+	if opts.SlidingWindow > 0 {
+		window := kv.SlidingWindow()
+		if window == 0 {
+			return fmt.Errorf("%w: sliding_window isn't supported by model architecture %q, which doesn't use sliding-window attention", ErrContextOption, arch)
+		} else if uint64(opts.SlidingWindow) < window {
+			return fmt.Errorf("%w: sliding_window can't be smaller than the model's window of %d tokens", ErrContextOption, window)
+		}
+	}
+
+	if slices.Contains(noRopeArchitectures, arch) {
+		if opts.RopeScaling != "" {
+			return fmt.Errorf("%w: rope_scaling isn't supported by model architecture %q, which doesn't use RoPE", ErrContextOption, arch)
+		}
+
+		for _, o := range contextOptions(opts) {
+			if o.value != 0 && (strings.HasPrefix(o.name, "rope_") || strings.HasPrefix(o.name, "yarn_")) {
+				return fmt.Errorf("%w: %s isn't supported by model architecture %q, which doesn't use RoPE", ErrContextOption, o.name, arch)
+			}
+		}
+	}
+
+	if cmp.Or(opts.RopeScaling, kv.RopeScaling()) != "yarn" {
+		for _, o := range contextOptions(opts) {
+			if o.value != 0 && strings.HasPrefix(o.name, "yarn_") {
+				return fmt.Errorf("%w: %s requires rope_scaling yarn", ErrContextOption, o.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+type contextOption struct {
+	name  string
+	value float64
+}
+
+// contextOptions returns the numeric sliding window, attention sink and RoPE
+// options
+func contextOptions(opts api.Runner) []contextOption {
+	return []contextOption{
+		{"sliding_window", float64(opts.SlidingWindow)},
+		{"attention_sinks", float64(opts.AttentionSinks)},
+		{"rope_frequency_base", float64(opts.RopeFrequencyBase)},
+		{"rope_frequency_scale", float64(opts.RopeFrequencyScale)},
+		{"yarn_orig_ctx", float64(opts.YarnOrigCtx)},
+		{"yarn_ext_factor", float64(opts.YarnExtFactor)},
+		{"yarn_attn_factor", float64(opts.YarnAttnFactor)},
+		{"yarn_beta_fast", float64(opts.YarnBetaFast)},
+		{"yarn_beta_slow", float64(opts.YarnBetaSlow)},
+	}
+}
+
+// windowedContext returns the context length a runner is loaded with, which
+// sliding_window limits to the window and its attention sinks
+func windowedContext(opts api.Options) int {
+	if opts.SlidingWindow > 0 {
+		return min(opts.NumCtx, opts.SlidingWindow+opts.AttentionSinks)
+	}
+
+	return opts.NumCtx
+}
+
+// contextParams returns the runner's parameters for the sliding window,
+// attention sink and RoPE options
+func contextParams(opts api.Options) []string {
+	var params []string
+	if opts.AttentionSinks > 0 {
+		params = append(params, "--attention-sinks", strconv.Itoa(opts.AttentionSinks))
+	}
+
+	if opts.RopeScaling != "" {
+		params = append(params, "--rope-scaling", opts.RopeScaling)
+	}
+
+	for _, p := range []struct {
+		flag  string
+		value float32
+	}{
+		{"--rope-freq-base", opts.RopeFrequencyBase},
+		{"--rope-freq-scale", opts.RopeFrequencyScale},
+		{"--yarn-ext-factor", opts.YarnExtFactor},
+		{"--yarn-attn-factor", opts.YarnAttnFactor},
+		{"--yarn-beta-fast", opts.YarnBetaFast},
+		{"--yarn-beta-slow", opts.YarnBetaSlow},
+	} {
+		if p.value != 0 {
+			params = append(params, p.flag, strconv.FormatFloat(float64(p.value), 'g', -1, 32))
+		}
+	}
+
+	if opts.YarnOrigCtx > 0 {
+		params = append(params, "--yarn-orig-ctx", strconv.Itoa(opts.YarnOrigCtx))
+	}
+
+	return params
+}
+
+// LongContext returns the sliding window, attention sink and RoPE settings a
+// model is loaded with given opts, each option overriding the model's
+// metadata. It returns nil for models none of them apply to.
+func (kv KV) LongContext(opts api.Runner) *api.LongContext {
+	lc := api.LongContext{
+		Window:         int(kv.SlidingWindow()),
+		SlidingWindow:  opts.SlidingWindow,
+		AttentionSinks: opts.AttentionSinks,
+	}
+
+	if !slices.Contains(noRopeArchitectures, kv.Architecture()) {
+		lc.RopeFrequencyBase = cmp.Or(opts.RopeFrequencyBase, kv.RopeFrequencyBase())
+		lc.RopeFrequencyScale = opts.RopeFrequencyScale
+		if f := kv.RopeScalingFactor(); lc.RopeFrequencyScale == 0 && f > 0 {
+			lc.RopeFrequencyScale = 1 / f
+		}
+
+		lc.RopeScaling = cmp.Or(opts.RopeScaling, kv.RopeScaling())
+		if lc.RopeScaling == "yarn" {
+			lc.YarnOrigCtx = cmp.Or(opts.YarnOrigCtx, int(kv.RopeScalingOrigCtx()))
+			lc.YarnExtFactor = opts.YarnExtFactor
+			lc.YarnAttnFactor = opts.YarnAttnFactor
+			lc.YarnBetaFast = opts.YarnBetaFast
+			lc.YarnBetaSlow = opts.YarnBetaSlow
+		}
+	}
+
+	if lc == (api.LongContext{}) {
+		return nil
+	}
+
+	return &lc
+}
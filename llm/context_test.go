@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestCheckContextOptions(t *testing.T) {
+	gemma := KV{
+		"general.architecture":            "gemma2",
+		"gemma2.attention.sliding_window": uint32(4096),
+	}
+	llama := KV{
+		"general.architecture":                       "llama",
+		"llama.rope.scaling.type":                    "yarn",
+		"llama.rope.scaling.original_context_length": uint32(8192),
+	}
+	bert := KV{"general.architecture": "bert"}
+
+	cases := []struct {
+		name string
+		kv   KV
+		opts api.Runner
+		ok   bool
+	}{
+		{"no options", bert, api.Runner{}, true},
+		{"sliding window", gemma, api.Runner{SlidingWindow: 8192, AttentionSinks: 4}, true},
+		{"window smaller than the model's", gemma, api.Runner{SlidingWindow: 2048}, false},
+		{"no sliding window attention", llama, api.Runner{SlidingWindow: 8192}, false},
+		{"sinks outside the window", gemma, api.Runner{SlidingWindow: 4096, AttentionSinks: 4096}, false},
+		{"sinks without a window", llama, api.Runner{AttentionSinks: 4}, true},
+		{"negative", gemma, api.Runner{AttentionSinks: -1}, false},
+		{"rope", gemma, api.Runner{RopeFrequencyBase: 20000, RopeFrequencyScale: 0.5, RopeScaling: "linear"}, true},
+		{"unknown rope scaling", gemma, api.Runner{RopeScaling: "ntk"}, false},
+		{"rope without rope", bert, api.Runner{RopeFrequencyBase: 20000}, false},
+		{"rope scaling without rope", bert, api.Runner{RopeScaling: "none"}, false},
+		{"yarn from metadata", llama, api.Runner{YarnExtFactor: 1, YarnOrigCtx: 4096}, true},
+		{"yarn from options", gemma, api.Runner{RopeScaling: "yarn", YarnBetaFast: 32}, true},
+		{"yarn without yarn", gemma, api.Runner{YarnBetaSlow: 1}, false},
+		{"yarn overridden", llama, api.Runner{RopeScaling: "linear", YarnAttnFactor: 1}, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.kv.CheckContextOptions(tt.opts)
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if !tt.ok && !errors.Is(err, ErrContextOption) {
+				t.Errorf("expected an invalid context option, got %v", err)
+			}
+		})
+	}
+}
+
+func TestContextParams(t *testing.T) {
+	opts := api.DefaultOptions()
+	if params := contextParams(opts); len(params) != 0 {
+		t.Errorf("expected no parameters, got %v", params)
+	}
+
+	opts.NumCtx = 32768
+	opts.SlidingWindow = 4096
+	opts.AttentionSinks = 4
+	opts.RopeScaling = "yarn"
+	opts.RopeFrequencyScale = 0.25
+	opts.YarnOrigCtx = 8192
+
+	want := []string{"--attention-sinks", "4", "--rope-scaling", "yarn", "--rope-freq-scale", "0.25", "--yarn-orig-ctx", "8192"}
+	if params := contextParams(opts); !slices.Equal(params, want) {
+		t.Errorf("expected %v, got %v", want, params)
+	}
+
+	if n := windowedContext(opts); n != 4100 {
+		t.Errorf("expected a context of 4100, got %d", n)
+	}
+}
+
+func TestLongContext(t *testing.T) {
+	kv := KV{
+		"general.architecture":                       "llama",
+		"llama.rope.freq_base":                       float32(500000),
+		"llama.rope.scaling.type":                    "yarn",
+		"llama.rope.scaling.factor":                  float32(4),
+		"llama.rope.scaling.original_context_length": uint32(8192),
+	}
+
+	lc := kv.LongContext(api.Runner{YarnBetaFast: 16})
+	want := api.LongContext{RopeFrequencyBase: 500000, RopeFrequencyScale: 0.25, RopeScaling: "yarn", YarnOrigCtx: 8192, YarnBetaFast: 16}
+	if lc == nil || *lc != want {
+		t.Errorf("expected %+v, got %+v", want, lc)
+	}
+
+	lc = kv.LongContext(api.Runner{RopeFrequencyBase: 1e6, RopeScaling: "none"})
+	want = api.LongContext{RopeFrequencyBase: 1e6, RopeFrequencyScale: 0.25, RopeScaling: "none"}
+	if lc == nil || *lc != want {
+		t.Errorf("expected %+v, got %+v", want, lc)
+	}
+
+	if lc := (KV{"general.architecture": "bert"}).LongContext(api.Runner{}); lc != nil {
+		t.Errorf("expected no settings, got %+v", lc)
+	}
+}
@@ -44,8 +44,14 @@
 #include <errhandlingapi.h>
 #endif
 
+#if defined(GGML_USE_CUDA)
+#include "ggml-cuda.h"
+#endif
+
 #include <algorithm>
+#include <cmath>
 #include <cstddef>
+#include <iostream>
 #include <thread>
 #include <chrono>
 #include <condition_variable>
@@ -64,6 +70,8 @@ struct server_params {
     bool slots_endpoint = true;
     bool metrics_endpoint = false;
     int n_threads_http = -1;
+    int32_t prompt_cache_tokens = 0;
+    int32_t attention_sinks = 0;
 };
 
 bool server_verbose = false;
@@ -95,6 +103,10 @@ struct slot_params {
     int32_t  n_predict = -1; // new tokens to predict
 
     std::vector<std::string> antiprompt;
+    std::vector<llama_token> stop_token_ids;
+
+    int32_t add_bos = -1;    // add a BOS token to the prompt, or follow the model if -1
+    bool    add_eos = false; // add an EOS token to the end of the prompt
 
     json input_prefix;
     json input_suffix;
@@ -115,6 +127,7 @@ struct slot_image {
 struct server_slot {
     int id;
     int task_id = -1;
+    std::string request_id; // set by the client to identify the request in the slot data
 
     struct slot_params params;
 
@@ -134,6 +147,12 @@ struct server_slot {
 
     int32_t n_prompt_tokens           = 0;
     int32_t n_prompt_tokens_processed = 0;
+    int32_t n_prompt_tokens_submitted = 0; // prompt tokens before truncation, including those of images
+
+    // shared prompt cache
+    int32_t n_prompt_cache = -1; // prompt tokens reused from another sequence, -1 if the cache wasn't looked up
+    int32_t n_shareable    = 0;  // prompt tokens in the KV cache that other sequences can reuse
+    int32_t n_kv_shared    = 0;  // tokens at the start of the KV cache that are shared with other sequences
 
     json prompt;
     std::string generated_text;
@@ -143,10 +162,16 @@ struct server_slot {
 
     bool embedding = false;
     bool has_next_token = true;
+
+    // scoring
+    int32_t n_score = 0;  // tokens at the end of the prompt that are scored instead of generating
+    int32_t i_score = -1; // index in the batch of the logits predicting the first scored token
+    json score_tokens = json::array();
     bool truncated = false;
     bool stopped_eos = false;
     bool stopped_word = false;
     bool stopped_limit = false;
+    bool stopped_token = false;
 
     std::string stopping_word;
 
@@ -178,17 +203,23 @@ struct server_slot {
 
     void reset() {
         n_prompt_tokens        = 0;
+        n_prompt_tokens_submitted = 0;
         generated_text         = "";
         truncated              = false;
         stopped_eos            = false;
         stopped_word           = false;
         stopped_limit          = false;
+        stopped_token          = false;
         stopping_word          = "";
         n_past                 = 0;
+        n_prompt_cache         = -1;
+        n_shareable            = 0;
         n_sent_text            = 0;
         n_sent_token_probs     = 0;
         ga_i                   = 0;
         n_past_se              = 0;
+        i_score                = -1;
+        score_tokens           = json::array();
 
         generated_token_probs.clear();
 
@@ -309,6 +340,9 @@ struct server_metrics {
     uint64_t n_tokens_predicted       = 0;
     uint64_t t_tokens_generation      = 0;
 
+    uint64_t n_prompt_cache_hits   = 0;
+    uint64_t n_prompt_cache_misses = 0;
+    uint64_t n_prompt_cache_tokens = 0; // prompt tokens reused
 
     void on_prompt_eval(const server_slot &slot) {
         n_prompt_tokens_processed_total += slot.n_prompt_tokens_processed;
@@ -316,6 +350,15 @@ struct server_metrics {
         t_prompt_processing             += slot.t_prompt_processing;
     }
 
+    void on_prompt_cache(int32_t n_reused) {
+        if (n_reused > 0) {
+            n_prompt_cache_hits++;
+            n_prompt_cache_tokens += n_reused;
+        } else {
+            n_prompt_cache_misses++;
+        }
+    }
+
     void on_prediction(const server_slot &slot) {
         n_tokens_predicted_total += slot.n_decoded;
         n_tokens_predicted       += slot.n_decoded;
@@ -361,6 +404,26 @@ struct llama_server_context
     // slots / clients
     std::vector<server_slot> slots;
 
+    // prompts kept in the KV cache after the slots that evaluated them have
+    // moved on, so later requests starting with them don't evaluate them
+    // again. each entry is a sequence of its own, numbered after the slots'
+    struct prompt_cache_entry {
+        llama_seq_id seq_id;
+        std::vector<llama_token> tokens;
+        int64_t t_last_used;
+    };
+
+    std::vector<prompt_cache_entry> prompt_cache;
+    int32_t prompt_cache_tokens = 0; // KV cache cells set aside for the entries, 0 disables sharing prompts
+
+    // tokens at the start of each slot's context kept when it's truncated or
+    // shifted, so attention has a stable sink to fall back on once the
+    // context is longer than --ctx-size
+    int32_t attention_sinks = 0;
+
+    // shorter prompts aren't worth sharing
+    static constexpr int32_t n_prompt_cache_min = 64;
+
     llama_server_queue    queue_tasks;
     llama_server_response queue_results;
 
@@ -434,7 +497,16 @@ struct llama_server_context
         // create slots
         all_slots_are_idle = true;
 
-        const int32_t n_ctx_slot = n_ctx / params.n_parallel;
+        if (prompt_cache_tokens >= n_ctx) {
+            LOG_WARNING("prompt cache doesn't fit in the context, disabling it", {
+                {"prompt_cache_tokens", prompt_cache_tokens},
+                {"n_ctx",               n_ctx}
+            });
+            prompt_cache_tokens = 0;
+        }
+
+        // the prompt cache's cells come out of the context, the slots share the rest
+        const int32_t n_ctx_slot = (n_ctx - prompt_cache_tokens) / params.n_parallel;
 
         LOG_DEBUG("initializing slots", {{"n_slots", params.n_parallel}});
         for (int i = 0; i < params.n_parallel; i++)
@@ -528,6 +600,24 @@ struct llama_server_context
         return prompt_tokens;
     }
 
+    // tokenize the start of a slot's prompt, with a BOS token if the request
+    // asks for one, or add_bos if it leaves it to the model
+    std::vector<llama_token> tokenize_prompt(const server_slot &slot, const json & json_prompt, bool add_bos) const
+    {
+        if (slot.params.add_bos < 0)
+        {
+            return tokenize(json_prompt, add_bos);
+        }
+
+        std::vector<llama_token> prompt_tokens = tokenize(json_prompt, false);
+        if (slot.params.add_bos > 0)
+        {
+            prompt_tokens.insert(prompt_tokens.begin(), llama_token_bos(model));
+        }
+
+        return prompt_tokens;
+    }
+
     server_slot* get_slot(int id) {
         int64_t t_last = ggml_time_us();
         server_slot *last_used = nullptr;
@@ -553,6 +643,8 @@ struct llama_server_context
         slot_params default_params;
         llama_sampling_params default_sparams;
 
+        slot->request_id                = json_value(data, "request_id",        std::string());
+        slot->n_score                   = json_value(data, "n_score",           0);
         slot->params.stream             = json_value(data, "stream",            false);
         slot->params.cache_prompt       = json_value(data, "cache_prompt",      false);
         slot->params.n_predict          = json_value(data, "n_predict",         default_params.n_predict);
@@ -573,6 +665,8 @@ struct llama_server_context
         slot->sparams.mirostat_eta      = json_value(data, "mirostat_eta",      default_sparams.mirostat_eta);
         slot->sparams.penalize_nl       = json_value(data, "penalize_nl",       default_sparams.penalize_nl);
         slot->params.n_keep             = json_value(data, "n_keep",            slot->params.n_keep);
+        slot->params.add_bos            = json_value(data, "add_bos",           default_params.add_bos);
+        slot->params.add_eos            = json_value(data, "add_eos",           default_params.add_eos);
         slot->sparams.seed              = json_value(data, "seed",              default_params.seed);
         slot->sparams.grammar           = json_value(data, "grammar",           default_sparams.grammar);
         slot->sparams.n_probs           = json_value(data, "n_probs",           default_sparams.n_probs);
@@ -704,6 +798,20 @@ struct llama_server_context
             }
         }
 
+        slot->params.stop_token_ids.clear();
+
+        const auto &stop_token_ids = data.find("stop_token_ids");
+        if (stop_token_ids != data.end() && stop_token_ids->is_array())
+        {
+            for (const auto &tok : *stop_token_ids)
+            {
+                if (tok.is_number_integer())
+                {
+                    slot->params.stop_token_ids.push_back(tok.get<llama_token>());
+                }
+            }
+        }
+
         const auto &samplers_sequence = data.find("samplers");
         if (samplers_sequence != data.end() && samplers_sequence->is_array())
         {
@@ -814,8 +922,195 @@ struct llama_server_context
 
     void kv_cache_clear() {
         // clear the entire KV cache
-        llama_kv_cache_clear(ctx);
+        if (ctx != nullptr) {
+            llama_kv_cache_clear(ctx);
+        }
         clean_kv_cache = false;
+        prompt_cache_clear();
+    }
+
+    void prompt_cache_clear() {
+        prompt_cache.clear();
+        for (server_slot &slot : slots) {
+            slot.n_shareable = 0;
+            slot.n_kv_shared = 0;
+        }
+    }
+
+    // the first n tokens of the slot's KV cache after the system prompt are
+    // shared with another sequence, so a context shift must keep them:
+    // shifting moves cells that the other sequence uses too
+    void prompt_cache_share(server_slot &slot, int32_t n) {
+        slot.n_kv_shared = std::max(slot.n_kv_shared, n);
+        slot.params.n_keep = std::max(slot.params.n_keep, (int32_t) system_tokens.size() + slot.n_kv_shared);
+    }
+
+    // copy the longest prefix of prompt_tokens that's in the KV cache of
+    // another slot, or in the prompt cache, into the slot's sequence if it's
+    // longer than what the slot has itself. the prompt is the key: requests
+    // with different template variables render different prompts, and
+    // prompts with images are never shared. returns the number of tokens
+    // reused
+    int32_t prompt_cache_attach(server_slot &slot, const std::vector<llama_token> &prompt_tokens) {
+        // shared tokens are kept through context shifts, so at most half the
+        // slot's context is shared
+        const int32_t n_max = std::min((int32_t) prompt_tokens.size(), slot.n_ctx / 2);
+
+        int32_t n_best = std::max(slot.n_past, n_prompt_cache_min - 1);
+        server_slot *src_slot = nullptr;
+        prompt_cache_entry *src_entry = nullptr;
+
+        for (server_slot &other : slots) {
+            if (other.id == slot.id || other.n_shareable == 0) {
+                continue;
+            }
+
+            const int32_t n = std::min({(int32_t) common_part(other.cache_tokens, prompt_tokens), other.n_shareable, n_max});
+            if (n > n_best) {
+                n_best = n;
+                src_slot = &other;
+            }
+        }
+
+        for (prompt_cache_entry &entry : prompt_cache) {
+            const int32_t n = std::min((int32_t) common_part(entry.tokens, prompt_tokens), n_max);
+            if (n > n_best) {
+                n_best = n;
+                src_slot = nullptr;
+                src_entry = &entry;
+            }
+        }
+
+        if (src_slot == nullptr && src_entry == nullptr) {
+            return 0;
+        }
+
+        const int p0 = system_tokens.size();
+        const llama_seq_id src = src_slot != nullptr ? src_slot->id : src_entry->seq_id;
+
+        llama_kv_cache_seq_rm(ctx, slot.id, p0, -1);
+        llama_kv_cache_seq_cp(ctx, src, slot.id, p0, p0 + n_best);
+
+        if (src_slot != nullptr) {
+            prompt_cache_share(*src_slot, n_best);
+        } else {
+            src_entry->t_last_used = ggml_time_us();
+        }
+
+        LOG_DEBUG("prompt cache hit", {
+            {"slot_id",  slot.id},
+            {"task_id",  slot.task_id},
+            {"src",      src},
+            {"n_reused", n_best}
+        });
+
+        slot.n_past = n_best;
+        slot.n_kv_shared = n_best;
+        return n_best;
+    }
+
+    // keep the slot's evaluated prompt in the prompt cache, evicting the
+    // least recently used prompts to stay within its budget
+    void prompt_cache_store(server_slot &slot) {
+        const int32_t n = std::min(slot.n_shareable, slot.n_ctx / 2);
+        if (n < n_prompt_cache_min || n > prompt_cache_tokens) {
+            return;
+        }
+
+        const int64_t t_now = ggml_time_us();
+        int32_t n_used = 0;
+        for (auto it = prompt_cache.begin(); it != prompt_cache.end();) {
+            const int32_t n_common = common_part(it->tokens, slot.cache_tokens);
+            if (n_common >= n) {
+                // already cached
+                it->t_last_used = t_now;
+                return;
+            }
+
+            if (n_common == (int32_t) it->tokens.size()) {
+                // the prompt extends the entry, which it replaces
+                llama_kv_cache_seq_rm(ctx, it->seq_id, -1, -1);
+                it = prompt_cache.erase(it);
+                continue;
+            }
+
+            n_used += it->tokens.size();
+            ++it;
+        }
+
+        while (!prompt_cache.empty() && n_used + n > prompt_cache_tokens) {
+            auto lru = std::min_element(prompt_cache.begin(), prompt_cache.end(), [](const prompt_cache_entry &a, const prompt_cache_entry &b) {
+                return a.t_last_used < b.t_last_used;
+            });
+
+            llama_kv_cache_seq_rm(ctx, lru->seq_id, -1, -1);
+            n_used -= lru->tokens.size();
+            prompt_cache.erase(lru);
+        }
+
+        llama_seq_id seq_id = params.n_parallel;
+        while (std::any_of(prompt_cache.begin(), prompt_cache.end(), [seq_id](const prompt_cache_entry &e) { return e.seq_id == seq_id; })) {
+            seq_id++;
+        }
+
+        const int p0 = system_tokens.size();
+        llama_kv_cache_seq_cp(ctx, slot.id, seq_id, p0, p0 + n);
+        prompt_cache.push_back({seq_id, std::vector<llama_token>(slot.cache_tokens.begin(), slot.cache_tokens.begin() + n), t_now});
+        prompt_cache_share(slot, n);
+    }
+
+    int32_t prompt_cache_used() const {
+        int32_t n = 0;
+        for (const prompt_cache_entry &entry : prompt_cache) {
+            n += entry.tokens.size();
+        }
+        return n;
+    }
+
+    // free the context, and with it the KV cache and compute buffers, while
+    // keeping the model weights loaded. returns an error if the cache can't
+    // be released
+    std::string release_cache() {
+        if (ctx == nullptr) {
+            return "";
+        }
+        if (!all_slots_are_idle || !queue_tasks.queue_tasks_deferred.empty()) {
+            return "slots are processing";
+        }
+        if (!params.lora_adapters.empty()) {
+            // adapters are applied to the context and would be lost
+            return "model has adapters";
+        }
+
+        llama_free(ctx);
+        ctx = nullptr;
+        for (server_slot &slot : slots) {
+            slot.cache_tokens.clear();
+            slot.n_past = 0;
+        }
+        prompt_cache_clear();
+        system_tokens.clear();
+        system_need_update = !system_prompt.empty();
+
+        LOG_INFO("released KV cache", {});
+        return "";
+    }
+
+    // recreate the context freed by release_cache
+    bool restore_cache() {
+        if (ctx != nullptr) {
+            return true;
+        }
+
+        ctx = llama_new_context_with_model(model, llama_context_params_from_gpt_params(params));
+        if (ctx == nullptr) {
+            LOG_ERROR("unable to restore KV cache", {});
+            return false;
+        }
+
+        clean_kv_cache = true;
+        LOG_INFO("restored KV cache", {});
+        return true;
     }
 
     void system_prompt_update() {
@@ -912,8 +1207,11 @@ struct llama_server_context
         const std::string token_str = llama_token_to_piece(ctx, result.tok);
         slot.sampled = result.tok;
 
+        // stop tokens end generation like the end of sequence token, without their text
+        const bool is_stop_token = std::find(slot.params.stop_token_ids.begin(), slot.params.stop_token_ids.end(), result.tok) != slot.params.stop_token_ids.end();
+
         // search stop word and delete it
-        if (!llama_token_is_eog(model, result.tok))
+        if (!llama_token_is_eog(model, result.tok) && !is_stop_token)
             slot.generated_text += token_str;
 
         slot.has_next_token = true;
@@ -957,7 +1255,7 @@ struct llama_server_context
         {
             size_t pos = std::min(slot.n_sent_text, slot.generated_text.size());
 
-            if (!llama_token_is_eog(model, result.tok)) {
+            if (!llama_token_is_eog(model, result.tok) && !is_stop_token) {
                 const std::string str_test = slot.generated_text.substr(pos);
                 bool is_stop_full = false;
                 size_t stop_pos = find_stopping_strings(str_test, token_str.size(), STOP_FULL, slot);
@@ -1015,6 +1313,13 @@ struct llama_server_context
             LOG_VERBOSE("eos token found", {});
         }
 
+        if (is_stop_token)
+        {
+            slot.stopped_token = true;
+            slot.has_next_token = false;
+            LOG_VERBOSE("stop token found", {{"token", result.tok}});
+        }
+
         LOG_VERBOSE("next token", {
                                       {"token", result.tok},
                                       {"token_text", tokens_to_output_formatted_string(ctx, result.tok)},
@@ -1160,15 +1465,22 @@ struct llama_server_context
             {"model",               params.model_alias},
             {"tokens_predicted",    slot.n_decoded},
             {"tokens_evaluated",    slot.n_prompt_tokens},
+            {"tokens_submitted",    slot.n_prompt_tokens_submitted},
             {"truncated",           slot.truncated},
             {"stopped_eos",         slot.stopped_eos},
             {"stopped_word",        slot.stopped_word},
             {"stopped_limit",       slot.stopped_limit},
+            {"stopped_token",       slot.stopped_token},
             {"stopping_word",       slot.stopping_word},
             {"tokens_cached",       slot.n_past},
             {"timings",             slot.get_formated_timings()}
         };
 
+        if (slot.n_prompt_cache >= 0)
+        {
+            res.result_json["prompt_cache_tokens"] = slot.n_prompt_cache;
+        }
+
         if (slot.sparams.n_probs > 0)
         {
             std::vector<completion_token_output> probs = {};
@@ -1189,6 +1501,52 @@ struct llama_server_context
         queue_results.send(res);
     }
 
+    // score_tokens records the log-probability of each of the slot's scored
+    // tokens whose logits are in the batch view of n_tokens starting at i_view
+    void score_tokens(server_slot & slot, int32_t i_view, int32_t n_tokens)
+    {
+        const int n_vocab = llama_n_vocab(model);
+        const int32_t first = slot.n_prompt_tokens - slot.n_score;
+
+        for (int32_t j = 0; j < slot.n_score; j++)
+        {
+            const int32_t i = slot.i_score + j;
+            if (i < i_view || i >= i_view + n_tokens)
+            {
+                continue;
+            }
+
+            const float * logits = llama_get_logits_ith(ctx, i - i_view);
+            const float max_logit = *std::max_element(logits, logits + n_vocab);
+
+            double sum = 0.0;
+            for (int k = 0; k < n_vocab; k++)
+            {
+                sum += std::exp(logits[k] - max_logit);
+            }
+
+            const llama_token tok = slot.cache_tokens[first + j];
+            slot.score_tokens.push_back({
+                {"token",   llama_token_to_piece(ctx, tok)},
+                {"logprob", logits[tok] - max_logit - std::log(sum)},
+            });
+        }
+    }
+
+    void send_score(server_slot & slot)
+    {
+        task_result res;
+        res.id = slot.task_id;
+        res.multitask_id = slot.multitask_id;
+        res.error = false;
+        res.stop = true;
+        res.result_json = json
+        {
+            {"tokens", slot.score_tokens},
+        };
+        queue_results.send(res);
+    }
+
     void send_embedding(server_slot & slot, const llama_batch & batch)
     {
         task_result res;
@@ -1345,6 +1703,10 @@ struct llama_server_context
                 (json)(slot.images[image_idx].prefix_prompt);
 
             std::vector<llama_token> append_tokens = tokenize(json_prompt, false); // has next image
+            if (image_idx >= (int) slot.images.size() && slot.params.add_eos)
+            {
+                append_tokens.push_back(llama_token_eos(model));
+            }
             for (int i = 0; i < (int) append_tokens.size(); ++i)
             {
                 llama_batch_add(batch, append_tokens[i], system_tokens.size() + slot.n_past, { slot.id }, true);
@@ -1435,6 +1797,11 @@ struct llama_server_context
         switch (task.type)
         {
             case TASK_TYPE_COMPLETION: {
+                if (!restore_cache()) {
+                    send_error(task, "unable to allocate KV cache");
+                    break;
+                }
+
                 server_slot *slot = nullptr;
                 if (task.embedding_mode) {
                     // Embedding seq_id (aka slot id) must always be <= token length, so always use slot 0
@@ -1486,6 +1853,9 @@ struct llama_server_context
                     slot_data["id"] = slot.id;
                     slot_data["task_id"] = slot.task_id;
                     slot_data["state"] = slot.state;
+                    slot_data["request_id"] = slot.state == IDLE ? "" : slot.request_id;
+                    slot_data["tokens_processed"] = slot.state == IDLE ? 0 : slot.n_prompt_tokens_processed + slot.n_decoded;
+                    slot_data["cache_tokens"] = slot.cache_tokens.size();
                     slot_data["prompt"] = slot.prompt;
                     slot_data["next_token"] = {
                             {"has_next_token",       slot.has_next_token},
@@ -1532,14 +1902,37 @@ struct llama_server_context
                         { "n_tokens_predicted",              metrics.n_tokens_predicted},
                         { "t_tokens_generation",             metrics.t_tokens_generation},
 
-                        { "kv_cache_tokens_count",           llama_get_kv_cache_token_count(ctx)},
-                        { "kv_cache_used_cells",             llama_get_kv_cache_used_cells(ctx)},
+                        { "kv_cache_tokens_count",           ctx ? llama_get_kv_cache_token_count(ctx) : 0},
+                        { "kv_cache_used_cells",             ctx ? llama_get_kv_cache_used_cells(ctx) : 0},
+                        { "kv_cache_released",               ctx == nullptr},
+
+                        { "n_prompt_cache_hits",             metrics.n_prompt_cache_hits},
+                        { "n_prompt_cache_misses",           metrics.n_prompt_cache_misses},
+                        { "n_prompt_cache_tokens",           metrics.n_prompt_cache_tokens},
+                        { "prompt_cache_used",               prompt_cache_used()},
 
                         { "slots",                           slots_data },
                 };
                 metrics.reset_bucket();
                 queue_results.send(res);
             } break;
+            case TASK_TYPE_CACHE_RELEASE:
+            case TASK_TYPE_CACHE_RESTORE: {
+                std::string error;
+                if (task.type == TASK_TYPE_CACHE_RELEASE) {
+                    error = release_cache();
+                } else if (!restore_cache()) {
+                    error = "unable to allocate KV cache";
+                }
+
+                task_result res;
+                res.id = task.id;
+                res.multitask_id = task.multitask_id;
+                res.stop = true;
+                res.error = !error.empty();
+                res.result_json = error.empty() ? json{{"status", "ok"}} : json{{"error", error}};
+                queue_results.send(res);
+            } break;
         }
     }
 
@@ -1620,6 +2013,7 @@ struct llama_server_context
                     slot.cache_tokens.resize(slot.cache_tokens.size() - n_discard);
 
                     slot.n_past -= n_discard;
+                    slot.n_shareable = std::min(slot.n_shareable, n_keep - (int) system_tokens.size());
 
                     slot.truncated = true;
                 }
@@ -1694,14 +2088,20 @@ struct llama_server_context
                     slot.t_start_process_prompt = ggml_time_us();
                     slot.t_start_genereration = 0;
 
-                    prompt_tokens = tokenize(slot.prompt, system_prompt.empty());  // add BOS if there isn't system prompt
+                    prompt_tokens = tokenize_prompt(slot, slot.prompt, system_prompt.empty());  // add BOS if there isn't system prompt
+                    if (slot.params.add_eos && slot.images.empty())
+                    {
+                        prompt_tokens.push_back(llama_token_eos(model));
+                    }
 
                     slot.n_prompt_tokens = prompt_tokens.size();
+                    slot.n_prompt_tokens_submitted = slot.n_prompt_tokens;
 
                     if (slot.params.n_keep < 0)
                     {
                         slot.params.n_keep = slot.n_prompt_tokens;
                     }
+                    slot.params.n_keep = std::max(attention_sinks, slot.params.n_keep);
                     slot.params.n_keep = std::min(slot.n_ctx - 4, slot.params.n_keep);
 
                     // if input prompt is too big, truncate it, if group attention self-extend is disabled
@@ -1759,6 +2159,12 @@ struct llama_server_context
                             slot.n_past -= 1;
                         }
 
+                        if (prompt_cache_tokens > 0 && slot.ga_n == 1 && slot.images.empty())
+                        {
+                            slot.n_prompt_cache = prompt_cache_attach(slot, prompt_tokens);
+                            metrics.on_prompt_cache(slot.n_prompt_cache);
+                        }
+
                         slot.n_prompt_tokens_processed = slot.n_prompt_tokens;
 
                         if (slot.ga_n != 1)
@@ -1790,8 +2196,22 @@ struct llama_server_context
                         });
                     }
 
+                    // the logits predicting each scored token are needed, so the
+                    // tokens before them are evaluated again even if they're cached
+                    if (slot.n_score > 0)
+                    {
+                        slot.n_past = std::min(slot.n_past, slot.n_prompt_tokens - slot.n_score - 1);
+                    }
+
                     slot.cache_tokens = prompt_tokens;
 
+                    // cells past n_past are removed from the slot's sequence below
+                    slot.n_kv_shared = std::min(slot.n_kv_shared, slot.n_past);
+                    if (slot.n_kv_shared > 0)
+                    {
+                        prompt_cache_share(slot, slot.n_kv_shared);
+                    }
+
                     if (slot.n_past == slot.n_prompt_tokens && slot.n_past > 0)
                     {
                         // we have to evaluate at least 1 token to generate logits.
@@ -1823,7 +2243,7 @@ struct llama_server_context
                     const bool has_images = process_images(slot);
 
                     // process the prefix of first image
-                    std::vector<llama_token> prefix_tokens = has_images ? tokenize(slot.images[0].prefix_prompt, add_bos_token) : prompt_tokens;
+                    std::vector<llama_token> prefix_tokens = has_images ? tokenize_prompt(slot, slot.images[0].prefix_prompt, add_bos_token) : prompt_tokens;
 
                     int32_t slot_npast = slot.n_past_se > 0 ? slot.n_past_se : slot.n_past;
 
@@ -1857,12 +2277,28 @@ struct llama_server_context
                         return false;
                     }
 
+                    if (has_images)
+                    {
+                        slot.n_prompt_tokens_submitted = slot.n_past;
+                    }
+
                     // extract the logits only for the last token
                     if (batch.n_tokens > 0)
                     {
                         batch.logits[batch.n_tokens - 1] = true;
                     }
 
+                    // or, when scoring, for each token from the one before the
+                    // first scored token
+                    if (slot.n_score > 0)
+                    {
+                        slot.i_score = batch.n_tokens - slot.n_score - 1;
+                        for (int32_t i = slot.i_score; i < batch.n_tokens; i++)
+                        {
+                            batch.logits[i] = true;
+                        }
+                    }
+
                     slot.n_decoded = 0;
                     slot.i_batch   = batch.n_tokens - 1;
                 }
@@ -1940,6 +2376,15 @@ struct llama_server_context
                 continue;
             }
 
+            // the logits of a batch view are overwritten by the next one
+            for (auto & slot : slots)
+            {
+                if (slot.n_score > 0 && slot.i_score >= 0)
+                {
+                    score_tokens(slot, i, n_tokens);
+                }
+            }
+
             for (auto & slot : slots)
             {
                 if (slot.i_batch < (int) i || slot.i_batch >= (int) (i + n_tokens))
@@ -1947,6 +2392,16 @@ struct llama_server_context
                     continue;
                 }
 
+                // prompt evaluated for scoring
+                if (slot.n_score > 0)
+                {
+                    send_score(slot);
+                    slot.release();
+                    slot.i_batch = -1;
+                    slot.i_score = -1;
+                    continue;
+                }
+
                 // prompt evaluated for embedding
                 if (slot.embedding)
                 {
@@ -1967,6 +2422,12 @@ struct llama_server_context
                     slot.t_start_genereration = ggml_time_us();
                     slot.t_prompt_processing = (slot.t_start_genereration - slot.t_start_process_prompt) / 1e3;
                     metrics.on_prompt_eval(slot);
+
+                    if (prompt_cache_tokens > 0 && slot.ga_n == 1 && slot.images.empty())
+                    {
+                        slot.n_shareable = slot.n_prompt_tokens;
+                        prompt_cache_store(slot);
+                    }
                 }
 
                 llama_token_data_array cur_p = { slot.ctx_sampling->cur.data(), slot.ctx_sampling->cur.size(), false };
@@ -2032,7 +2493,8 @@ static void server_print_usage(const char *argv0, const gpt_params &params,
     printf("  --yarn-attn-factor N      YaRN: scale sqrt(t) or attention magnitude (default: 1.0)\n");
     printf("  --yarn-beta-slow N        YaRN: high correction dim or alpha (default: %.1f)\n", params.yarn_beta_slow);
     printf("  --yarn-beta-fast N        YaRN: low correction dim or beta (default: %.1f)\n", params.yarn_beta_fast);
-    printf("  --pooling {none,mean,cls}\n");
+    printf("  --yarn-orig-ctx N         YaRN: original context size of the model (default: 0 = loaded from model)\n");
+    printf("  --pooling {none,mean,cls,last}\n");
     printf("                        pooling type for embeddings, use model default if unspecified\n");
     printf("  -b N, --batch-size N      batch size for prompt processing (default: %d)\n", params.n_batch);
     printf("  --memory-f32              use f32 instead of f16 for memory key+value (default: disabled)\n");
@@ -2077,6 +2539,8 @@ static void server_print_usage(const char *argv0, const gpt_params &params,
     printf("  --embedding               enable embedding vector output (default: %s)\n", params.embedding ? "enabled" : "disabled");
     printf("  -np N, --parallel N       number of slots for process requests (default: %d)\n", params.n_parallel);
     printf("  -cb, --cont-batching      enable continuous batching (a.k.a dynamic batching) (default: disabled)\n");
+    printf("  --prompt-cache N          context tokens set aside for prompts shared between slots, taken from --ctx-size (default: %d, disabled)\n", sparams.prompt_cache_tokens);
+    printf("  --attention-sinks N       tokens at the start of the context always kept when it's truncated or shifted (default: %d)\n", sparams.attention_sinks);
     printf("  -fa, --flash-attn         enable Flash Attention (default: %s)\n", params.flash_attn ? "enabled" : "disabled");
     printf("  -spf FNAME, --system-prompt-file FNAME\n");
     printf("                            set a file to load a system prompt (initial prompt of all slots), this is useful for chat applications.\n");
@@ -2274,6 +2738,14 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
             }
             params.yarn_beta_slow = std::stof(argv[i]);
         }
+        else if (arg == "--yarn-orig-ctx")
+        {
+            if (++i >= argc) {
+                invalid_param = true;
+                break;
+            }
+            params.yarn_orig_ctx = std::stoi(argv[i]);
+        }
         else if (arg == "--pooling")
         {
             if (++i >= argc) {
@@ -2284,6 +2756,7 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
             /**/ if (value == "none") { params.pooling_type = LLAMA_POOLING_TYPE_NONE; }
             else if (value == "mean") { params.pooling_type = LLAMA_POOLING_TYPE_MEAN; }
             else if (value == "cls")  { params.pooling_type = LLAMA_POOLING_TYPE_CLS; }
+            else if (value == "last") { params.pooling_type = LLAMA_POOLING_TYPE_LAST; }
             else { invalid_param = true; break; }
         }
         else if (arg == "--threads" || arg == "-t")
@@ -2505,6 +2978,24 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
             }
             params.n_parallel = std::stoi(argv[i]);
         }
+        else if (arg == "--prompt-cache")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            sparams.prompt_cache_tokens = std::stoi(argv[i]);
+        }
+        else if (arg == "--attention-sinks")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            sparams.attention_sinks = std::stoi(argv[i]);
+        }
         else if (arg == "-n" || arg == "--n-predict")
         {
             if (++i >= argc)
@@ -2765,6 +3256,38 @@ int main(int argc, char **argv) {
 #if SERVER_VERBOSE != 1
     log_disable();
 #endif
+
+    // A warm runner is started ahead of time by the warm pool in
+    // llm/warmpool.go. It initializes the backend and the GPU context, prints
+    // "ready", and then reads the arguments to load a model with as a JSON
+    // array on stdin, exiting if stdin is closed first.
+    std::vector<std::string> warm_args;
+    std::vector<char *> warm_argv;
+    if (argc == 2 && std::string(argv[1]) == "--warm") {
+        llama_backend_init();
+#if defined(GGML_USE_CUDA)
+        for (int i = 0; i < ggml_backend_cuda_get_device_count(); i++) {
+            size_t free, total;
+            ggml_backend_cuda_get_device_memory(i, &free, &total);
+        }
+#endif
+        printf("ready\n");
+        fflush(stdout);
+
+        std::string line;
+        if (!std::getline(std::cin, line)) {
+            return 0;
+        }
+
+        warm_args = json::parse(line).get<std::vector<std::string>>();
+        warm_argv.push_back(argv[0]);
+        for (auto & arg : warm_args) {
+            warm_argv.push_back(&arg[0]);
+        }
+        argc = (int) warm_argv.size();
+        argv = warm_argv.data();
+    }
+
     // own arguments required by this example
     gpt_params params;
     server_params sparams;
@@ -2846,7 +3369,7 @@ int main(int argc, char **argv) {
             }
             case SERVER_STATE_LOADING_MODEL:
                 char buf[128];
-                snprintf(&buf[0], 128, R"({"status": "loading model", "progress": %0.2f})", llama.modelProgress);
+                snprintf(&buf[0], 128, R"({"status": "loading model", "progress": %0.4f})", llama.modelProgress);
                 res.set_content(buf, "application/json");
                 res.status = 503; // HTTP Service Unavailable
                 break;
@@ -2912,6 +3435,18 @@ int main(int argc, char **argv) {
                             {"name",  "tokens_predicted_total"},
                             {"help",  "Number of generation tokens processed."},
                             {"value",  data["n_tokens_predicted_total"]}
+                    }, {
+                            {"name",  "prompt_cache_hits_total"},
+                            {"help",  "Number of prompts that reused a prefix evaluated for another request."},
+                            {"value",  data["n_prompt_cache_hits"]}
+                    }, {
+                            {"name",  "prompt_cache_misses_total"},
+                            {"help",  "Number of prompts that found no prefix evaluated for another request."},
+                            {"value",  data["n_prompt_cache_misses"]}
+                    }, {
+                            {"name",  "prompt_cache_tokens_total"},
+                            {"help",  "Number of prompt tokens reused from other requests."},
+                            {"value",  data["n_prompt_cache_tokens"]}
                     }}},
                     {"gauge", {{
                             {"name",  "prompt_tokens_seconds"},
@@ -2929,6 +3464,10 @@ int main(int argc, char **argv) {
                             {"name",  "kv_cache_tokens"},
                             {"help",  "KV-cache tokens."},
                             {"value",  data["kv_cache_tokens_count"]}
+                    },{
+                            {"name",  "prompt_cache_tokens"},
+                            {"help",  "Tokens held by the prompt cache."},
+                            {"value",  data["prompt_cache_used"]}
                     },{
                             {"name",  "requests_processing"},
                             {"help",  "Number of request processing."},
@@ -3044,6 +3583,8 @@ int main(int argc, char **argv) {
     // load the model
     params.progress_callback = update_load_progress;
     params.progress_callback_user_data = (void*)&llama;
+    llama.prompt_cache_tokens = sparams.prompt_cache_tokens;
+    llama.attention_sinks = sparams.attention_sinks;
 
     if (!llama.load_model(params))
     {
@@ -3167,6 +3708,33 @@ int main(int argc, char **argv) {
                 }
             });
 
+    const auto handle_cache = [&llama](task_type type, httplib::Response &res)
+            {
+                task_server task;
+                task.id = llama.queue_tasks.get_new_id();
+                task.type = type;
+                task.target_id = -1;
+
+                llama.queue_results.add_waiting_task_id(task.id);
+                llama.queue_tasks.post(task);
+
+                task_result result = llama.queue_results.recv(task.id);
+                llama.queue_results.remove_waiting_task_id(task.id);
+
+                res.status = result.error ? 409 : 200;
+                res.set_content(result.result_json.dump(), "application/json; charset=utf-8");
+            };
+
+    svr.Post("/cache/release", [&handle_cache](const httplib::Request &, httplib::Response &res)
+            {
+                handle_cache(TASK_TYPE_CACHE_RELEASE, res);
+            });
+
+    svr.Post("/cache/restore", [&handle_cache](const httplib::Request &, httplib::Response &res)
+            {
+                handle_cache(TASK_TYPE_CACHE_RESTORE, res);
+            });
+
     svr.Post("/tokenize", [&llama](const httplib::Request &req, httplib::Response &res)
             {
                 res.set_header("Access-Control-Allow-Origin", req.get_header_value("Origin"));
@@ -3222,6 +3790,47 @@ int main(int argc, char **argv) {
                 return res.set_content(result.result_json.dump(), "application/json; charset=utf-8");
             });
 
+    svr.Post("/score", [&llama](const httplib::Request &req, httplib::Response &res)
+            {
+                res.set_header("Access-Control-Allow-Origin", req.get_header_value("Origin"));
+                const json body = json::parse(req.body);
+
+                // the continuation is tokenized on its own, without BOS, so the
+                // tokens scored are its own even if its text would merge with
+                // the end of the prompt
+                std::vector<llama_token> tokens = llama.tokenize(json_value(body, "prompt", std::string()), true);
+                const std::vector<llama_token> continuation = llama.tokenize(json_value(body, "continuation", std::string()), false);
+                if (tokens.empty() || continuation.empty())
+                {
+                    res.status = 400;
+                    return res.set_content("prompt and continuation must not be empty", "text/plain; charset=utf-8");
+                }
+
+                tokens.insert(tokens.end(), continuation.begin(), continuation.end());
+                if ((int) tokens.size() >= llama.slots[0].n_ctx)
+                {
+                    res.status = 400;
+                    return res.set_content("prompt and continuation exceed the context size", "text/plain; charset=utf-8");
+                }
+
+                // create and queue the task
+                const int task_id = llama.queue_tasks.get_new_id();
+                llama.queue_results.add_waiting_task_id(task_id);
+                llama.request_completion(task_id, {{"prompt", tokens}, {"n_score", continuation.size()}, {"cache_prompt", true}}, false, -1);
+
+                // get the result
+                task_result result = llama.queue_results.recv(task_id);
+                llama.queue_results.remove_waiting_task_id(task_id);
+                if (result.error)
+                {
+                    res.status = 500;
+                    return res.set_content(result.result_json["content"], "text/plain; charset=utf-8");
+                }
+
+                // send the result
+                return res.set_content(result.result_json.dump(), "application/json; charset=utf-8");
+            });
+
     // GG: if I put the main loop inside a thread, it crashes on the first request when build in Debug!?
     //     "Bus error: 10" - this is on macOS, it does not crash on Linux
     //std::thread t2([&]()
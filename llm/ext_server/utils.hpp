@@ -70,7 +70,9 @@ enum task_type {
     TASK_TYPE_COMPLETION,
     TASK_TYPE_CANCEL,
     TASK_TYPE_NEXT_RESPONSE,
-    TASK_TYPE_METRICS
+    TASK_TYPE_METRICS,
+    TASK_TYPE_CACHE_RELEASE,
+    TASK_TYPE_CACHE_RESTORE
 };
 
 struct task_server {
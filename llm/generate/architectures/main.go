@@ -0,0 +1,149 @@
+// Architectures generates the list of model architectures the vendored
+// llama.cpp can load, from its LLM_ARCH_NAMES and the names ollama's patches
+// add to or remove from it. It's run by go generate in the llm package:
+//
+//	go generate ./llm
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// archName matches an entry of LLM_ARCH_NAMES, such as
+//
+//	{ LLM_ARCH_LLAMA,           "llama"        },
+var archName = regexp.MustCompile(`^\s*\{\s*LLM_ARCH_\w+\s*,\s*"([^"]+)"\s*\}`)
+
+// parseNames returns the architecture names of the LLM_ARCH_NAMES map in
+// llama.cpp's source r
+func parseNames(r io.Reader) ([]string, error) {
+	var names []string
+	var inMap bool
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.Contains(line, "LLM_ARCH_NAMES = {"):
+			inMap = true
+		case inMap && strings.HasPrefix(strings.TrimSpace(line), "};"):
+			return names, nil
+		case inMap:
+			if m := archName.FindStringSubmatch(line); m != nil && m[1] != "(unknown)" {
+				names = append(names, m[1])
+			}
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("LLM_ARCH_NAMES not found")
+}
+
+// applyPatch adds the architecture names patch r adds to LLM_ARCH_NAMES to
+// names, and removes those it removes
+func applyPatch(names []string, r io.Reader) ([]string, error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") || len(line) == 0 {
+			continue
+		}
+
+		m := archName.FindStringSubmatch(line[1:])
+		if m == nil || m[1] == "(unknown)" {
+			continue
+		}
+
+		switch line[0] {
+		case '+':
+			names = append(names, m[1])
+		case '-':
+			names = slices.DeleteFunc(names, func(name string) bool { return name == m[1] })
+		}
+	}
+
+	return names, sc.Err()
+}
+
+// generate returns the source of a file of package pkg declaring names as
+// supportedArchitectures
+func generate(pkg string, names []string) ([]byte, error) {
+	names = slices.Clone(names)
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "// Code generated by \"go run ./generate/architectures\"; DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	fmt.Fprintln(&b, "// supportedArchitectures are the model architectures this build's llama.cpp")
+	fmt.Fprintln(&b, "// can load, from its LLM_ARCH_NAMES and the architectures llm/patches add")
+	fmt.Fprintln(&b, "var supportedArchitectures = []string{")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%q,\n", name)
+	}
+	fmt.Fprintln(&b, "}")
+
+	return format.Source(b.Bytes())
+}
+
+func main() {
+	src := flag.String("src", filepath.Join("llama.cpp", "src", "llama.cpp"), "llama.cpp source declaring LLM_ARCH_NAMES")
+	patches := flag.String("patches", "patches", "directory of patches applied to llama.cpp")
+	out := flag.String("o", "architectures.go", "file to write")
+	pkg := flag.String("pkg", "llm", "package of the file written")
+	flag.Parse()
+
+	f, err := os.Open(*src)
+	if err != nil {
+		log.Fatalf("%v; is the llama.cpp submodule checked out?", err)
+	}
+	defer f.Close()
+
+	names, err := parseNames(f)
+	if err != nil {
+		log.Fatalf("%s: %v", *src, err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(*patches, "*.patch"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// patches are applied in order of their names
+	slices.Sort(paths)
+	for _, path := range paths {
+		p, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		names, err = applyPatch(names, p)
+		p.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	bts, err := generate(*pkg, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.WriteFile(*out, bts, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const source = `enum llm_arch {
+    LLM_ARCH_LLAMA,
+    LLM_ARCH_RWKV6,
+    LLM_ARCH_UNKNOWN,
+};
+
+static const std::map<llm_arch, const char *> LLM_ARCH_NAMES = {
+    { LLM_ARCH_LLAMA,           "llama"        },
+    { LLM_ARCH_COMMAND_R,       "command-r"    },
+    { LLM_ARCH_RWKV6,           "rwkv6"        },
+    { LLM_ARCH_UNKNOWN,         "(unknown)"    },
+};
+
+static const std::map<llm_arch, std::map<llm_tensor, std::string>> LLM_TENSOR_NAMES = {
+    { LLM_ARCH_GROK, {} },
+};
+`
+
+const patch = `--- a/src/llama.cpp
++++ b/src/llama.cpp
+@@ -261,6 +262,7 @@ static const std::map<llm_arch, const char *> LLM_ARCH_NAMES = {
+-    { LLM_ARCH_COMMAND_R,       "command-r"    },
+     { LLM_ARCH_RWKV6,           "rwkv6"        },
++    { LLM_ARCH_SOLAR,           "solar"        },
+     { LLM_ARCH_UNKNOWN,         "(unknown)"    },
+ };
+`
+
+func TestGenerate(t *testing.T) {
+	names, err := parseNames(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := []string{"llama", "command-r", "rwkv6"}; !slices.Equal(names, expect) {
+		t.Errorf("expected %v, got %v", expect, names)
+	}
+
+	names, err = applyPatch(names, strings.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := []string{"llama", "rwkv6", "solar"}; !slices.Equal(names, expect) {
+		t.Errorf("expected %v, got %v", expect, names)
+	}
+
+	if _, err := parseNames(strings.NewReader("enum llm_arch {};")); err == nil {
+		t.Error("expected an error for a source without LLM_ARCH_NAMES")
+	}
+
+	bts, err := generate("llm", []string{"rwkv6", "llama", "llama"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(bts, []byte("var supportedArchitectures = []string{\n\t\"llama\",\n\t\"rwkv6\",\n}\n")) {
+		t.Errorf("expected sorted, unique names, got %s", bts)
+	}
+}
+
+// TestGenerated checks the generated list is up to date with the vendored
+// llama.cpp and its patches, when the submodule is checked out
+func TestGenerated(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "..", "llama.cpp", "src", "llama.cpp"))
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("the llama.cpp submodule isn't checked out")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names, err := parseNames(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join("..", "..", "patches", "*.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(paths)
+	for _, path := range paths {
+		p, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err = applyPatch(names, p)
+		p.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect, err := generate("llm", names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := os.ReadFile(filepath.Join("..", "..", "architectures.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual, expect) {
+		t.Error("llm/architectures.go is out of date, run go generate ./llm")
+	}
+}
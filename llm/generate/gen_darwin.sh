@@ -44,6 +44,7 @@ case "${GOARCH}" in
         echo "Building LCD CPU"
         build
         sign ${BUILD_DIR}/bin/ollama_llama_server
+        sign ${BUILD_DIR}/bin/llama-imatrix
         compress
 
         #
@@ -57,6 +58,7 @@ case "${GOARCH}" in
         echo "Building AVX CPU"
         build
         sign ${BUILD_DIR}/bin/ollama_llama_server
+        sign ${BUILD_DIR}/bin/llama-imatrix
         compress
 
         #
@@ -71,6 +73,7 @@ case "${GOARCH}" in
         EXTRA_LIBS="${EXTRA_LIBS} -framework Accelerate -framework Foundation"
         build
         sign ${BUILD_DIR}/bin/ollama_llama_server
+        sign ${BUILD_DIR}/bin/llama-imatrix
         compress
     fi
     ;;
@@ -92,6 +95,7 @@ case "${GOARCH}" in
         EXTRA_LIBS="${EXTRA_LIBS} -framework Accelerate -framework Foundation -framework Metal -framework MetalKit -framework MetalPerformanceShaders"
         build
         sign ${BUILD_DIR}/bin/ollama_llama_server
+        sign ${BUILD_DIR}/bin/llama-imatrix
         compress
     fi
     ;;
@@ -148,6 +148,22 @@ if [ -z "${OLLAMA_SKIP_CPU_GENERATE}" ]; then
                 dist
                 compress
             fi
+
+            if [ -z "${OLLAMA_CPU_TARGET}" -o "${OLLAMA_CPU_TARGET}" = "cpu_avx512" ]; then
+                #
+                # ~2017 server and 2019 client CPU Dynamic library
+                # Also selected for CPUs with AMX until the backend has AMX kernels
+                #
+                init_vars
+                CMAKE_DEFS="${COMMON_CPU_DEFS} -DGGML_AVX=on -DGGML_AVX2=on -DGGML_AVX512=on -DGGML_FMA=on -DGGML_F16C=on ${CMAKE_DEFS}"
+                RUNNER=cpu_avx512
+                BUILD_DIR="../build/linux/${GOARCH}/${RUNNER}"
+                echo "Building AVX512 CPU"
+                build
+                install
+                dist
+                compress
+            fi
         fi
     fi
 else
@@ -39,7 +39,7 @@ function init_vars {
         $script:llamacppDir = "../llama.cpp"
     }
     if (!$script:cmakeTargets) {
-        $script:cmakeTargets = @("ollama_llama_server")
+        $script:cmakeTargets = @("ollama_llama_server", "llama-imatrix")
     }
     $script:cmakeDefs = @(
         "-DBUILD_SHARED_LIBS=on",
@@ -275,6 +275,21 @@ function build_cpu_avx2() {
     }
 }
 
+function build_cpu_avx512() {
+    if ((-not "${env:OLLAMA_SKIP_CPU_GENERATE}" ) -and ((-not "${env:OLLAMA_CPU_TARGET}") -or ("${env:OLLAMA_CPU_TARGET}" -eq "cpu_avx512"))) {
+        init_vars
+        $script:cmakeDefs = $script:commonCpuDefs + @("-A", "x64", "-DGGML_AVX=on", "-DGGML_AVX2=on", "-DGGML_AVX512=on", "-DGGML_FMA=on", "-DGGML_F16C=on") + $script:cmakeDefs
+        $script:buildDir="../build/windows/${script:ARCH}/cpu_avx512"
+        $script:distDir="$script:DIST_BASE\cpu_avx512"
+        write-host "Building AVX512 CPU"
+        build
+        sign
+        install
+    } else {
+        write-host "Skipping CPU AVX512 generation step as requested"
+    }
+}
+
 function build_cuda() {
     if ((-not "${env:OLLAMA_SKIP_CUDA_GENERATE}") -and ("${script:CUDA_LIB_DIR}")) {
         # Then build cuda as a dynamically loaded library
@@ -423,6 +438,7 @@ if ($($args.count) -eq 0) {
         build_cpu_x64
         build_cpu_avx
         build_cpu_avx2
+        build_cpu_avx512
         build_cuda
         build_oneapi
         build_rocm
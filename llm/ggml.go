@@ -7,6 +7,7 @@ import (
 	"io"
 	"strings"
 
+	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/util/bufioutil"
 )
 
@@ -111,15 +112,116 @@ func (kv KV) EmbeddingLength() uint64 {
 	return kv.u64(fmt.Sprintf("%s.embedding_length", kv.Architecture()))
 }
 
+// Uint returns the unsigned integer value of key, or 0 if it isn't set
+func (kv KV) Uint(key string) uint64 {
+	return kv.u64(key)
+}
+
+// Ints returns the values of the integer array key, or nil if it isn't set.
+// Like [KV.SpecialTokens], the array is only complete if it was decoded.
+func (kv KV) Ints(key string) []int {
+	var ints []int
+	for _, v := range arrayValues(kv[key]) {
+		switch v := v.(type) {
+		case int32:
+			ints = append(ints, int(v))
+		case uint32:
+			ints = append(ints, int(v))
+		case int64:
+			ints = append(ints, int(v))
+		case uint64:
+			ints = append(ints, int(v))
+		}
+	}
+
+	return ints
+}
+
 func (kv KV) ContextLength() uint64 {
 	return kv.u64(fmt.Sprintf("%s.context_length", kv.Architecture()))
 }
 
+// PoolingType returns the name of the pooling type in the model metadata, or
+// an empty string if the model doesn't specify one
+func (kv KV) PoolingType() string {
+	key := fmt.Sprintf("%s.pooling_type", kv.Architecture())
+	if _, ok := kv[key]; !ok {
+		return ""
+	}
+
+	if t := kv.u64(key); t < uint64(len(api.PoolingTypes)) {
+		return api.PoolingTypes[t]
+	}
+
+	return ""
+}
+
 func (kv KV) ChatTemplate() string {
 	s, _ := kv["tokenizer.chat_template"].(string)
 	return s
 }
 
+// TokenizerModel returns the kind of the model's tokenizer, e.g. "llama" for
+// SentencePiece or "gpt2" for byte-level BPE
+func (kv KV) TokenizerModel() string {
+	s, _ := kv["tokenizer.ggml.model"].(string)
+	return s
+}
+
+// token types of tokens that are matched as a whole before the rest of the
+// text is tokenized
+const (
+	tokenTypeControl     = 3
+	tokenTypeUserDefined = 4
+)
+
+// SpecialTokens returns the control and user defined tokens of the model's
+// vocabulary. The vocabulary is only complete if every array was decoded, see
+// [DecodeGGML].
+func (kv KV) SpecialTokens() []string {
+	tokens := arrayValues(kv["tokenizer.ggml.tokens"])
+	types := arrayValues(kv["tokenizer.ggml.token_type"])
+	if len(types) != len(tokens) {
+		return nil
+	}
+
+	var special []string
+	for i, t := range types {
+		if t, ok := t.(int32); ok && (t == tokenTypeControl || t == tokenTypeUserDefined) {
+			if s, ok := tokens[i].(string); ok {
+				special = append(special, s)
+			}
+		}
+	}
+
+	return special
+}
+
+// arrayValues returns the values of an array in the metadata, either as
+// decoded or as passed to [WriteGGUF]
+func arrayValues(v any) []any {
+	switch v := v.(type) {
+	case *array:
+		return v.values
+	case []any:
+		return v
+	case []string:
+		values := make([]any, len(v))
+		for i := range v {
+			values[i] = v[i]
+		}
+		return values
+	case []int32:
+		values := make([]any, len(v))
+		for i := range v {
+			values[i] = v[i]
+		}
+		return values
+	}
+
+	return nil
+}
+
 type Tensors struct {
 	Items  []*Tensor
 	Offset uint64
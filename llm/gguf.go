@@ -50,6 +50,10 @@ func (c *containerGGUF) Decode(rs io.ReadSeeker) (model, error) {
 		return nil, err
 	}
 
+	if c.Version > MaxGGUFVersion {
+		return nil, &UnsupportedModelError{GGUFVersion: c.Version}
+	}
+
 	var err error
 	switch c.Version {
 	case 1:
@@ -0,0 +1,19 @@
+#include "imatrix.h"
+
+#include <string>
+#include <unordered_map>
+#include <vector>
+
+typedef std::unordered_map<std::string, std::vector<float>> imatrix_map;
+
+void * ollama_imatrix_new(void) {
+    return new imatrix_map();
+}
+
+void ollama_imatrix_add(void * imatrix, const char * name, const float * values, size_t n) {
+    (*static_cast<imatrix_map *>(imatrix))[name] = std::vector<float>(values, values + n);
+}
+
+void ollama_imatrix_free(void * imatrix) {
+    delete static_cast<imatrix_map *>(imatrix);
+}
@@ -0,0 +1,378 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/build"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/runners"
+)
+
+// Imatrix is an importance matrix, the mean squared activations of the inputs
+// to each of a model's weights over some calibration text, in the format
+// written by llama.cpp's llama-imatrix. Quantizations use it to keep the
+// weights that matter most accurate.
+type Imatrix struct {
+	Entries []ImatrixEntry
+
+	// Chunks is the number of chunks of the calibration text the matrix was
+	// computed over, and Dataset the name of its file
+	Chunks  int32
+	Dataset string
+}
+
+// ImatrixEntry is the importance of the inputs to a tensor
+type ImatrixEntry struct {
+	Name string
+
+	// Calls is the number of chunks Values is summed over
+	Calls  int32
+	Values []float32
+}
+
+// DecodeImatrix reads an importance matrix written by llama-imatrix
+func DecodeImatrix(r io.Reader) (*Imatrix, error) {
+	r = bufio.NewReader(r)
+
+	readString := func() (string, error) {
+		var n int32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return "", err
+		}
+
+		if n < 0 || n > 4096 {
+			return "", fmt.Errorf("invalid string length %d", n)
+		}
+
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+
+		return string(b), nil
+	}
+
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, fmt.Errorf("invalid importance matrix: %w", err)
+	}
+
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid importance matrix: %d entries", n)
+	}
+
+	var m Imatrix
+	for range n {
+		var e ImatrixEntry
+		var err error
+		if e.Name, err = readString(); err != nil {
+			return nil, fmt.Errorf("invalid importance matrix: %w", err)
+		}
+
+		var size int32
+		if err := binary.Read(r, binary.LittleEndian, &e.Calls); err != nil {
+			return nil, fmt.Errorf("invalid importance matrix: %s: %w", e.Name, err)
+		} else if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, fmt.Errorf("invalid importance matrix: %s: %w", e.Name, err)
+		} else if size <= 0 {
+			return nil, fmt.Errorf("invalid importance matrix: %s has %d values", e.Name, size)
+		}
+
+		e.Values = make([]float32, size)
+		if err := binary.Read(r, binary.LittleEndian, e.Values); err != nil {
+			return nil, fmt.Errorf("invalid importance matrix: %s: %w", e.Name, err)
+		}
+
+		m.Entries = append(m.Entries, e)
+	}
+
+	// the number of chunks and dataset were added in later versions of
+	// llama-imatrix
+	if err := binary.Read(r, binary.LittleEndian, &m.Chunks); errors.Is(err, io.EOF) {
+		return &m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid importance matrix: %w", err)
+	}
+
+	dataset, err := readString()
+	if err != nil {
+		return nil, fmt.Errorf("invalid importance matrix: %w", err)
+	}
+
+	m.Dataset = dataset
+	return &m, nil
+}
+
+// WriteTo writes the importance matrix in the format DecodeImatrix reads
+func (m *Imatrix) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	write := func(v any) {
+		// writes to a bytes.Buffer don't fail
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+
+	write(int32(len(m.Entries)))
+	for _, e := range m.Entries {
+		write(int32(len(e.Name)))
+		b.WriteString(e.Name)
+		write(e.Calls)
+		write(int32(len(e.Values)))
+		write(e.Values)
+	}
+
+	write(m.Chunks)
+	write(int32(len(m.Dataset)))
+	b.WriteString(m.Dataset)
+
+	return b.WriteTo(w)
+}
+
+// CheckModel returns an error if the importance matrix wasn't computed for the
+// model, which is the case if none of its entries are tensors of the model or
+// any of them are the wrong size
+func (m *Imatrix) CheckModel(ggml *GGML) error {
+	tensors := make(map[string]*Tensor)
+	for _, t := range ggml.Tensors().Items {
+		tensors[t.Name] = t
+	}
+
+	var matched int
+	for _, e := range m.Entries {
+		t, ok := tensors[e.Name]
+		if !ok {
+			continue
+		}
+
+		// the inputs of expert tensors are stacked for each expert
+		if len(t.Shape) == 0 || uint64(len(e.Values))%t.Shape[0] != 0 {
+			return fmt.Errorf("importance matrix has %d values for %s, which has %d inputs; was it computed for a different model?", len(e.Values), e.Name, t.Shape[0])
+		}
+
+		matched++
+	}
+
+	if matched == 0 {
+		return errors.New("importance matrix has no entries for this model's tensors; was it computed for a different model?")
+	}
+
+	return nil
+}
+
+// ImatrixProgress reports the chunk of the calibration text an importance
+// matrix is being computed over
+type ImatrixProgress struct {
+	Completed, Total int
+}
+
+// imatrixContext is the size of the chunks the calibration text is split into
+const imatrixContext = 512
+
+var (
+	imatrixChunksRe = regexp.MustCompile(`computing over (\d+) chunks`)
+	imatrixChunkRe  = regexp.MustCompile(`^\[(\d+)\]`)
+)
+
+// EstimateImatrix estimates how much of the model llama-imatrix can offload
+// to the GPUs
+func EstimateImatrix(gpus gpu.GpuInfoList, ggml *GGML) MemoryEstimate {
+	opts := api.DefaultOptions()
+	opts.NumCtx = imatrixContext
+	return EstimateGPULayers(gpus, ggml, nil, opts)
+}
+
+// GenerateImatrix computes the importance matrix of the model over the text in
+// datafile with llama-imatrix, which is built alongside each runner, writing
+// it to outfile. The model is offloaded to the GPUs as far as estimate allows,
+// so callers sharing the GPUs should hold the memory it estimates for the
+// duration. If chunks is positive, only that many chunks of the text are used.
+func GenerateImatrix(ctx context.Context, gpus gpu.GpuInfoList, estimate MemoryEstimate, model, datafile, outfile string, chunks int, fn func(ImatrixProgress)) error {
+	if estimate.Layers == 0 {
+		gpus = gpu.GetCPUInfo()
+	}
+
+	rDir, err := runners.Refresh(build.EmbedFS)
+	if err != nil {
+		return err
+	}
+
+	servers := []string{runners.ServerForCpu()}
+	if gpus[0].Library != "cpu" {
+		servers = runners.ServersForGpu(gpus[0])
+	}
+
+	available := runners.GetAvailableServers(rDir)
+
+	var bin, dir string
+	for _, server := range servers {
+		dir = available[server]
+		if dir == "" {
+			continue
+		}
+
+		bin = filepath.Join(dir, "llama-imatrix")
+		if runtime.GOOS == "windows" {
+			bin += ".exe"
+		}
+
+		if _, err := os.Stat(bin); err == nil {
+			if strings.HasPrefix(server, "cpu") {
+				estimate.Layers = 0
+			}
+			break
+		}
+
+		bin = ""
+	}
+
+	if bin == "" {
+		return fmt.Errorf("llama-imatrix wasn't found in the runners for %v", servers)
+	}
+
+	params := []string{
+		"--model", model,
+		"--file", datafile,
+		"--output-file", outfile,
+		"--ctx-size", strconv.Itoa(imatrixContext),
+		"--n-gpu-layers", strconv.Itoa(estimate.Layers),
+	}
+
+	if chunks > 0 {
+		params = append(params, "--chunks", strconv.Itoa(chunks))
+	}
+
+	if estimate.Layers > 0 && estimate.TensorSplit != "" {
+		params = append(params, "--tensor-split", estimate.TensorSplit)
+	}
+
+	slog.Info("computing importance matrix", "model", model, "runner", dir, "layers", estimate.Layers)
+
+	cmd := exec.CommandContext(ctx, bin, params...)
+	cmd.Env = imatrixEnv(dir, gpus, estimate.Layers > 0)
+	cmd.SysProcAttr = LlamaServerSysProcAttr
+
+	// llama-imatrix reports the number of chunks on stderr and each chunk's
+	// perplexity, as [n]ppl, on stdout
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+		pw.Close()
+	}()
+
+	var last string
+	var total int
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	scanner.Split(scanImatrixOutput)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if m := imatrixChunksRe.FindStringSubmatch(line); m != nil {
+			total, _ = strconv.Atoi(m[1])
+			fn(ImatrixProgress{Total: total})
+		} else if m := imatrixChunkRe.FindStringSubmatch(line); m != nil && total > 0 {
+			n, _ := strconv.Atoi(m[1])
+			fn(ImatrixProgress{Completed: n, Total: total})
+		} else {
+			last = line
+		}
+	}
+
+	// keep llama-imatrix from blocking on its output if it couldn't be
+	// scanned
+	_, _ = io.Copy(io.Discard, pr)
+
+	if err := <-done; err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("computing importance matrix: %w: %s", err, last)
+	}
+
+	return nil
+}
+
+// scanImatrixOutput splits llama-imatrix's output into lines and the
+// perplexities of chunks, which aren't on lines of their own
+func scanImatrixOutput(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\n,"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// imatrixEnv returns the environment for running llama-imatrix from the
+// runner in dir, with the runner's libraries and the GPUs it's offloaded to
+func imatrixEnv(dir string, gpus gpu.GpuInfoList, offload bool) []string {
+	pathEnv := "LD_LIBRARY_PATH"
+	if runtime.GOOS == "windows" {
+		pathEnv = "PATH"
+	}
+
+	libraryPaths := []string{dir}
+	if offload && gpus[0].DependencyPath != "" {
+		libraryPaths = append([]string{gpus[0].DependencyPath}, libraryPaths...)
+	}
+
+	if libraryPath, ok := os.LookupEnv(pathEnv); ok {
+		libraryPaths = append(libraryPaths, filepath.SplitList(libraryPath)...)
+	}
+
+	env := []string{pathEnv + "=" + strings.Join(libraryPaths, string(filepath.ListSeparator))}
+	if offload {
+		if k, v := gpus.GetVisibleDevicesEnv(); k != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+
+	for _, ev := range os.Environ() {
+		k, _, _ := strings.Cut(ev, "=")
+		if !envContains(env, k) {
+			env = append(env, ev)
+		}
+	}
+
+	return env
+}
+
+// envContains reports whether env sets the variable k
+func envContains(env []string, k string) bool {
+	for _, ev := range env {
+		if ek, _, _ := strings.Cut(ev, "="); strings.EqualFold(ek, k) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,21 @@
+#ifndef OLLAMA_IMATRIX_H
+#define OLLAMA_IMATRIX_H
+
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// llama_model_quantize takes an importance matrix as a pointer to a
+// std::unordered_map<std::string, std::vector<float>> of tensor names to the
+// mean importance of their inputs
+void * ollama_imatrix_new(void);
+void ollama_imatrix_add(void * imatrix, const char * name, const float * values, size_t n);
+void ollama_imatrix_free(void * imatrix);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
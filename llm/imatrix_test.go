@@ -0,0 +1,112 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestImatrix(t *testing.T) {
+	m := Imatrix{
+		Entries: []ImatrixEntry{
+			{Name: "blk.0.attn_q.weight", Calls: 2, Values: []float32{1, 2, 3, 4}},
+			{Name: "blk.0.ffn_down.weight", Calls: 2, Values: []float32{5, 6, 7, 8, 9, 10, 11, 12}},
+		},
+		Chunks:  2,
+		Dataset: "calibration.txt",
+	}
+
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeImatrix(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(&m, decoded); diff != "" {
+		t.Errorf("unexpected importance matrix (-want +got):\n%s", diff)
+	}
+
+	// older versions of llama-imatrix don't write the chunks and dataset
+	legacy := b.Bytes()[:b.Len()-4-4-len(m.Dataset)]
+	if decoded, err = DecodeImatrix(bytes.NewReader(legacy)); err != nil {
+		t.Fatal(err)
+	} else if decoded.Chunks != 0 || decoded.Dataset != "" || len(decoded.Entries) != 2 {
+		t.Errorf("unexpected importance matrix %+v", decoded)
+	}
+
+	if _, err := DecodeImatrix(bytes.NewReader(b.Bytes()[:20])); err == nil {
+		t.Error("expected an error for a truncated importance matrix")
+	}
+
+	var empty bytes.Buffer
+	if err := binary.Write(&empty, binary.LittleEndian, int32(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DecodeImatrix(&empty); err == nil {
+		t.Error("expected an error for an empty importance matrix")
+	}
+}
+
+func TestImatrixCheckModel(t *testing.T) {
+	ggml := decodeQuantizeModel(t, KV{
+		"general.architecture": "llama",
+		"general.file_type":    uint32(fileTypeF16),
+	}, []Tensor{
+		{Name: "blk.0.attn_q.weight", Kind: 1, Shape: []uint64{4, 4}, WriterTo: bytes.NewReader(make([]byte, 4*4*2))},
+	})
+
+	cases := []struct {
+		name    string
+		entries []ImatrixEntry
+		err     string
+	}{
+		{"match", []ImatrixEntry{{Name: "blk.0.attn_q.weight", Values: make([]float32, 4)}, {Name: "blk.1.attn_q.weight", Values: make([]float32, 4)}}, ""},
+		{"other model", []ImatrixEntry{{Name: "blk.9.attn_q.weight", Values: make([]float32, 4)}}, "no entries for this model's tensors"},
+		{"wrong size", []ImatrixEntry{{Name: "blk.0.attn_q.weight", Values: make([]float32, 3)}}, "has 3 values for blk.0.attn_q.weight"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Imatrix{Entries: tt.entries}).CheckModel(ggml)
+			if tt.err == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if err := ggml.CheckQuantize(fileTypeIQ2_XS, &Imatrix{Entries: cases[0].entries}); err != nil {
+		t.Errorf("expected quantizing with an importance matrix to be supported, got %v", err)
+	}
+}
+
+func TestScanImatrixOutput(t *testing.T) {
+	output := "compute_imatrix: tokenizing the input ..\ncompute_imatrix: computing over 3 chunks with batch_size 512\n[1]5.1234,[2]6.0312,[3]5.8765,\nFinal estimate: PPL = 5.8765\n"
+
+	var tokens []string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Split(scanImatrixOutput)
+	for scanner.Scan() {
+		if imatrixChunkRe.MatchString(scanner.Text()) {
+			tokens = append(tokens, scanner.Text())
+		}
+	}
+
+	if diff := cmp.Diff([]string{"[1]5.1234", "[2]6.0312", "[3]5.8765"}, tokens); diff != "" {
+		t.Errorf("unexpected chunks (-want +got):\n%s", diff)
+	}
+
+	if m := imatrixChunksRe.FindStringSubmatch(output); m == nil || m[1] != "3" {
+		t.Errorf("expected the number of chunks, got %v", m)
+	}
+}
@@ -8,11 +8,14 @@ package llm
 // #cgo windows,arm64 LDFLAGS: -lllama -lggml -static-libstdc++ -static-libgcc -static -L${SRCDIR}/build/windows/arm64_static -L${SRCDIR}/build/windows/arm64_static/src -L${SRCDIR}/build/windows/arm64_static/ggml/src
 // #cgo linux,amd64 LDFLAGS: -L${SRCDIR}/build/linux/x86_64_static -L${SRCDIR}/build/linux/x86_64_static/src -L${SRCDIR}/build/linux/x86_64_static/ggml/src
 // #cgo linux,arm64 LDFLAGS: -L${SRCDIR}/build/linux/arm64_static -L${SRCDIR}/build/linux/arm64_static/src -L${SRCDIR}/build/linux/arm64_static/ggml/src
+// #cgo CXXFLAGS: -std=c++11
 // #include <stdlib.h>
 // #include "llama.h"
+// #include "imatrix.h"
 import "C"
 
 import (
+	"context"
 	"errors"
 	"unsafe"
 )
@@ -22,7 +25,31 @@ func SystemInfo() string {
 	return C.GoString(C.llama_print_system_info())
 }
 
-func Quantize(infile, outfile string, ftype fileType) error {
+// Quantize quantizes the model in infile to ftype, writing it to outfile. If
+// imatrix is set, it's used to weight the quantization of each tensor it has
+// an entry for. If fn is set, it's called with the progress as tensors are
+// quantized.
+func Quantize(infile, outfile string, ftype fileType, imatrix *Imatrix, fn func(QuantizeProgress)) error {
+	if fn != nil {
+		ggml, err := LoadModel(infile, 0)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ggml.watchQuantize(ctx, outfile, ftype, fn)
+		}()
+
+		// fn isn't called once quantizing is done
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
 	cinfile := C.CString(infile)
 	defer C.free(unsafe.Pointer(cinfile))
 
@@ -33,6 +60,26 @@ func Quantize(infile, outfile string, ftype fileType) error {
 	params.nthread = -1
 	params.ftype = ftype.Value()
 
+	if imatrix != nil {
+		params.imatrix = C.ollama_imatrix_new()
+		defer C.ollama_imatrix_free(params.imatrix)
+
+		for _, e := range imatrix.Entries {
+			values := e.Values
+			if e.Calls > 0 {
+				// entries are summed over each chunk
+				values = make([]float32, len(e.Values))
+				for i, v := range e.Values {
+					values[i] = v / float32(e.Calls)
+				}
+			}
+
+			cname := C.CString(e.Name)
+			C.ollama_imatrix_add(params.imatrix, cname, (*C.float)(unsafe.Pointer(&values[0])), C.size_t(len(values)))
+			C.free(unsafe.Pointer(cname))
+		}
+	}
+
 	if rc := C.llama_model_quantize(cinfile, coutfile, &params); rc != 0 {
 		return errors.New("failed to quantize model. This model architecture may not be supported, or you may need to upgrade Ollama to the latest version")
 	}
@@ -52,11 +52,16 @@ type MemoryEstimate struct {
 	// For multi-GPU scenarios, this is the size in bytes per GPU
 	GPUSizes []uint64
 
+	// The part of GPUSizes taken by the KV cache and graph, which is freed
+	// when the runner releases its cache
+	CacheSizes []uint64
+
 	// internal fields for logging purposes
 	inferenceLibrary    string
 	layersRequested     int
 	layersModel         int
 	availableList       []string
+	overheadList        []string
 	kv                  uint64
 	allocationsList     []string
 	memoryWeights       uint64
@@ -95,13 +100,20 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 	// Overflow that didn't fit into the GPU
 	var overflow uint64
 
-	overhead := envconfig.GpuOverhead()
 	availableList := make([]string, len(gpus))
+	overheadList := make([]string, len(gpus))
 	for i, gpu := range gpus {
 		availableList[i] = format.HumanBytes2(gpu.FreeMemory)
+		overheadList[i] = format.HumanBytes2(gpu.Overhead)
 	}
 	slog.Debug("evaluating", "library", gpus[0].Library, "gpu_count", len(gpus), "available", availableList)
 
+	// a sliding window limits the context that's kept in memory
+	opts.NumCtx = windowedContext(opts)
+
+	// the shared prompt cache is allocated as more context
+	opts.NumCtx += promptCacheTokens(ggml, opts.NumCtx)
+
 	for _, projector := range projectors {
 		projectorSize += projectorMemoryRequirements(projector)
 
@@ -155,6 +167,7 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 	var layerCount int
 	layerCounts := make([]int, len(gpus))
 	gpuAllocations := make([]uint64, len(gpus))
+	cacheAllocations := make([]uint64, len(gpus))
 	type gs struct {
 		i int
 		g *gpu.GpuInfo
@@ -166,7 +179,7 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 			gzo = gpuZeroOverhead
 		}
 		// Only include GPUs that can fit the graph, gpu minimum, the layer buffer and at least more layer
-		if (gpus[i].FreeMemory - overhead) < gzo+max(graphPartialOffload, graphFullOffload)+gpus[i].MinimumMemory+2*layerSize {
+		if (gpus[i].FreeMemory - gpus[i].Overhead) < gzo+max(graphPartialOffload, graphFullOffload)+gpus[i].MinimumMemory+2*layerSize {
 			slog.Debug("gpu has too little memory to allocate any layers",
 				"id", gpus[i].ID,
 				"library", gpus[i].Library,
@@ -212,8 +225,9 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 		for j := len(gpusWithSpace); j > 0; j-- {
 			g := gpusWithSpace[i%j]
 			used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
-			if (g.g.FreeMemory - overhead) > used+layerSize {
+			if (g.g.FreeMemory - g.g.Overhead) > used+layerSize {
 				gpuAllocations[g.i] += layerSize
+				cacheAllocations[g.i] += kv / ggml.KV().BlockCount()
 				layerCounts[g.i]++
 				layerCount++
 				break
@@ -235,7 +249,7 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 		for j := len(gpusWithSpace); j > 0; j-- {
 			g := gpusWithSpace[layerCount%j]
 			used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
-			if (g.g.FreeMemory - overhead) > used+memoryLayerOutput {
+			if (g.g.FreeMemory - g.g.Overhead) > used+memoryLayerOutput {
 				gpuAllocations[g.i] += memoryLayerOutput
 				layerCounts[g.i]++
 				layerCount++
@@ -256,8 +270,10 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 		}
 		if fullyLoaded {
 			gpuAllocations[i] += graphFullOffload
+			cacheAllocations[i] += graphFullOffload
 		} else {
 			gpuAllocations[i] += graphPartialOffload
+			cacheAllocations[i] += graphPartialOffload
 		}
 	}
 	if fullyLoaded {
@@ -297,6 +313,7 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 		layersRequested:     opts.NumGPU,
 		layersModel:         int(ggml.KV().BlockCount()) + 1,
 		availableList:       availableList,
+		overheadList:        overheadList,
 		kv:                  kv,
 		allocationsList:     allocationsList,
 		memoryWeights:       memoryWeights,
@@ -318,11 +335,11 @@ func EstimateGPULayers(gpus []gpu.GpuInfo, ggml *GGML, projectors []string, opts
 	estimate.TotalSize = memoryRequiredTotal
 	estimate.TensorSplit = tensorSplit
 	estimate.GPUSizes = gpuAllocations
+	estimate.CacheSizes = cacheAllocations
 	return estimate
 }
 
 func (m MemoryEstimate) log() {
-	overhead := envconfig.GpuOverhead()
 	slog.Info(
 		"offload to "+m.inferenceLibrary,
 		slog.Group(
@@ -340,7 +357,7 @@ func (m MemoryEstimate) log() {
 			"memory",
 			// memory available by GPU for offloading
 			"available", m.availableList,
-			"gpu_overhead", format.HumanBytes2(overhead),
+			"gpu_overhead", m.overheadList,
 			slog.Group(
 				"required",
 				// memory required for full offloading
@@ -371,3 +388,20 @@ func (m MemoryEstimate) log() {
 		),
 	)
 }
+
+// promptCacheTokens returns how many tokens of the model's KV cache fit in
+// OLLAMA_PROMPT_CACHE_SIZE, at most numCtx
+func promptCacheTokens(ggml *GGML, numCtx int) int {
+	size := envconfig.PromptCacheSize()
+	if size == 0 {
+		return 0
+	}
+
+	// fp16 k,v, as for the context
+	perToken := 2 * ggml.KV().BlockCount() * (ggml.KV().EmbeddingHeadCountK() + ggml.KV().EmbeddingHeadCountV()) * ggml.KV().HeadCountKV()
+	if perToken == 0 {
+		return 0
+	}
+
+	return int(min(size/perToken, uint64(numCtx)))
+}
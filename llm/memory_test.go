@@ -116,6 +116,10 @@ func TestEstimateGPULayers(t *testing.T) {
 			for _, b := range estimate.GPUSizes {
 				layerSums += b
 			}
+			require.Len(t, estimate.CacheSizes, len(estimate.GPUSizes))
+			for j, c := range estimate.CacheSizes {
+				assert.LessOrEqual(t, c, estimate.GPUSizes[j], "scenario %d: %v %+v", i, s, estimate)
+			}
 			if estimate.Layers < inputLayerCount+1 {
 				assert.Less(t, estimate.VRAMSize, estimate.TotalSize, "scenario %d: %v %+v", i, s, estimate)
 				assert.Equal(t, estimate.VRAMSize, layerSums, "scenario %d: %v %+v", i, s, estimate)
@@ -125,4 +129,88 @@ func TestEstimateGPULayers(t *testing.T) {
 			}
 		})
 	}
+
+	// Per-GPU overhead only reduces the space on the GPU it is set aside on
+	t.Run("overhead", func(t *testing.T) {
+		for i := range gpus {
+			gpus[i].FreeMemory = gpuMinimumMemory + layerSize + 3*layerSize + 1 + max(graphFullOffload, graphPartialOffload)
+		}
+		gpus[0].FreeMemory += memoryLayerOutput
+		gpus[0].Overhead = 2 * layerSize
+		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+		assert.Equal(t, "1,3", estimate.TensorSplit)
+	})
+}
+
+func TestPromptCacheTokens(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "dummy")
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, WriteGGUF(f, KV{
+		"general.architecture":          "llama",
+		"llama.context_length":          uint32(32),
+		"llama.embedding_length":        uint32(4096),
+		"llama.block_count":             uint32(5),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(32),
+		"tokenizer.ggml.tokens":         []string{" "},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []Tensor{
+		{Name: "blk.0.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	}))
+
+	ggml, err := LoadModel(f.Name(), 0)
+	require.NoError(t, err)
+
+	t.Setenv("OLLAMA_PROMPT_CACHE_SIZE", "")
+	assert.Equal(t, 0, promptCacheTokens(ggml, 8192))
+
+	// 2 bytes * 5 layers * (128 + 128) * 32 heads = 80KiB per token
+	t.Setenv("OLLAMA_PROMPT_CACHE_SIZE", "80MiB")
+	assert.Equal(t, 1024, promptCacheTokens(ggml, 8192))
+	assert.Equal(t, 512, promptCacheTokens(ggml, 512))
+}
+
+func TestEstimateSlidingWindow(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "dummy")
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, WriteGGUF(f, KV{
+		"general.architecture":            "gemma2",
+		"gemma2.context_length":           uint32(8192),
+		"gemma2.embedding_length":         uint32(4096),
+		"gemma2.block_count":              uint32(5),
+		"gemma2.attention.head_count":     uint32(32),
+		"gemma2.attention.head_count_kv":  uint32(32),
+		"gemma2.attention.sliding_window": uint32(1024),
+		"tokenizer.ggml.tokens":           []string{" "},
+		"tokenizer.ggml.scores":           []float32{0},
+		"tokenizer.ggml.token_type":       []int32{0},
+	}, []Tensor{
+		{Name: "blk.0.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	}))
+
+	ggml, err := LoadModel(f.Name(), 0)
+	require.NoError(t, err)
+
+	gpus := []gpu.GpuInfo{{Library: "cpu"}}
+	opts := api.DefaultOptions()
+	opts.NumCtx = 8192
+
+	// 2 bytes * 5 layers * (128 + 128) * 32 heads = 80KiB per token
+	full := EstimateGPULayers(gpus, ggml, nil, opts)
+	assert.Equal(t, uint64(8192*80*1024), full.kv)
+
+	opts.SlidingWindow = 2048
+	opts.AttentionSinks = 4
+	windowed := EstimateGPULayers(gpus, ggml, nil, opts)
+	assert.Equal(t, uint64(2052*80*1024), windowed.kv)
+	assert.Less(t, windowed.TotalSize, full.TotalSize)
+
+	// a window longer than the context doesn't grow it
+	opts.SlidingWindow = 16384
+	assert.Equal(t, full.kv, EstimateGPULayers(gpus, ggml, nil, opts).kv)
 }
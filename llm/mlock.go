@@ -0,0 +1,26 @@
+//go:build !windows
+
+package llm
+
+import (
+	"log/slog"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ollama/ollama/format"
+)
+
+// checkMemlockLimit warns when mlock is requested but RLIMIT_MEMLOCK is too
+// low to lock size bytes, in which case the runner can't keep the model from
+// being swapped out
+func checkMemlockLimit(size uint64) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &limit); err != nil {
+		slog.Debug("unable to read RLIMIT_MEMLOCK", "error", err)
+		return
+	}
+
+	if limit.Cur != unix.RLIM_INFINITY && uint64(limit.Cur) < size {
+		slog.Warn("use_mlock is enabled but RLIMIT_MEMLOCK is too low to lock the model, it may be swapped out", "limit", format.HumanBytes2(uint64(limit.Cur)), "required", format.HumanBytes2(size))
+	}
+}
@@ -0,0 +1,5 @@
+package llm
+
+// checkMemlockLimit is a no-op on Windows, where locked memory is bounded by
+// the working set rather than RLIMIT_MEMLOCK
+func checkMemlockLimit(size uint64) {}
@@ -0,0 +1,56 @@
+package llm
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runnerOOMScoreAdj raises the OOM killer's score of runners so that when the
+// system runs out of memory a runner is killed rather than the server
+const runnerOOMScoreAdj = 500
+
+// adjustOOMScore makes the process with pid the OOM killer's preferred victim
+// over the server. Raising the score doesn't need privileges.
+func adjustOOMScore(pid int) {
+	p := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	if err := os.WriteFile(p, []byte(strconv.Itoa(runnerOOMScoreAdj)), 0o644); err != nil {
+		slog.Debug("failed to adjust runner OOM score", "pid", pid, "error", err)
+	}
+}
+
+// oomKills returns how many processes the OOM killer has killed since boot,
+// or 0 if the kernel doesn't report it
+func oomKills() uint64 {
+	f, err := os.Open("/proc/vmstat")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "oom_kill "); ok {
+			n, _ := strconv.ParseUint(v, 10, 64)
+			return n
+		}
+	}
+
+	return 0
+}
+
+// oomKilled reports whether a process that exited with state was killed by
+// the OOM killer: it was killed with SIGKILL and the OOM killer has killed a
+// process since it started, when it had killed before
+func oomKilled(state *os.ProcessState, before uint64) bool {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() || ws.Signal() != syscall.SIGKILL {
+		return false
+	}
+
+	return oomKills() > before
+}
@@ -0,0 +1,66 @@
+package llm
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAdjustOOMScore(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep isn't available:", err)
+	}
+	defer cmd.Wait()         //nolint:errcheck
+	defer cmd.Process.Kill() //nolint:errcheck
+
+	adjustOOMScore(cmd.Process.Pid)
+
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/oom_score_adj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimSpace(string(b)); got != strconv.Itoa(runnerOOMScoreAdj) {
+		t.Errorf("expected oom_score_adj %d, got %s", runnerOOMScoreAdj, got)
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	run := func(t *testing.T, kill bool) *os.ProcessState {
+		t.Helper()
+
+		cmd := exec.Command("sleep", "10")
+		if !kill {
+			cmd = exec.Command("true")
+		}
+
+		if err := cmd.Start(); err != nil {
+			t.Skip("couldn't start a process:", err)
+		}
+
+		if kill {
+			cmd.Process.Kill() //nolint:errcheck
+		}
+
+		cmd.Wait() //nolint:errcheck
+		return cmd.ProcessState
+	}
+
+	kills := oomKills()
+
+	if oomKilled(run(t, false), kills) {
+		t.Error("expected a process that exited not to be OOM killed")
+	}
+
+	killed := run(t, true)
+	if oomKilled(killed, kills) {
+		t.Error("expected a killed process not to be OOM killed without an OOM kill")
+	}
+
+	if kills > 0 && !oomKilled(killed, kills-1) {
+		t.Error("expected a killed process to be OOM killed after an OOM kill")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package llm
+
+import "os"
+
+// adjustOOMScore is a no-op where there's no OOM killer to steer
+func adjustOOMScore(int) {}
+
+func oomKills() uint64 { return 0 }
+
+// oomKilled always reports false where OOM kills can't be told apart from
+// other terminations
+func oomKilled(*os.ProcessState, uint64) bool { return false }
@@ -0,0 +1,104 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ollama/ollama/format"
+)
+
+const (
+	// prefetchChunk is the size of the reads a model file is prefetched with,
+	// much larger than the page faults of the runner mapping it
+	prefetchChunk = 4 * format.MebiByte
+
+	// prefetchWorkers bounds how many reads are in flight per file
+	prefetchWorkers = 4
+
+	// prefetchHeadroom is the free memory that must be left once a model is
+	// prefetched, so warming its pages doesn't evict other models'
+	prefetchHeadroom = format.GibiByte
+)
+
+// prefetcher reads model files into the page cache with large parallel
+// reads while the runner loads them, so the runner's own reads are served
+// from memory instead of waiting on small sequential reads from disk
+type prefetcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	read   atomic.Uint64
+}
+
+// shouldPrefetch reports whether files of size bytes can be prefetched
+// without pushing other pages out of a system with free bytes of memory
+func shouldPrefetch(size, free uint64) bool {
+	return free >= size+size/10+prefetchHeadroom
+}
+
+func startPrefetch(paths ...string) *prefetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetcher{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		for _, path := range paths {
+			if err := p.prefetch(ctx, path); err != nil {
+				if !errors.Is(err, context.Canceled) {
+					slog.Debug("unable to prefetch model file", "path", path, "error", err)
+				}
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// prefetch reads the file at path, with each worker reading every
+// prefetchWorkers'th chunk so together they read it front to back
+func (p *prefetcher) prefetch(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	adviseSequential(f, size)
+
+	g, ctx := errgroup.WithContext(ctx)
+	for w := range int64(prefetchWorkers) {
+		g.Go(func() error {
+			buf := make([]byte, prefetchChunk)
+			for off := w * prefetchChunk; off < size; off += prefetchWorkers * prefetchChunk {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				n, err := f.ReadAt(buf, off)
+				p.read.Add(uint64(n))
+				if err != nil && !errors.Is(err, io.EOF) {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// stop cancels prefetching, if it's still going, and returns how many bytes
+// were read
+func (p *prefetcher) stop() uint64 {
+	p.cancel()
+	<-p.done
+	return p.read.Load()
+}
@@ -0,0 +1,13 @@
+package llm
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential widens the kernel's readahead for the file, which the
+// prefetch reads then keep busy
+func adviseSequential(f *os.File, size int64) {
+	_ = unix.Fadvise(int(f.Fd()), 0, size, unix.FADV_SEQUENTIAL)
+}
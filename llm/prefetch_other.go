@@ -0,0 +1,10 @@
+//go:build !linux
+
+package llm
+
+import "os"
+
+// adviseSequential is a no-op where there's no readahead hint. The prefetch
+// reads are issued at explicit offsets, which are overlapped reads on Windows,
+// so they're still in flight in parallel.
+func adviseSequential(f *os.File, size int64) {}
@@ -0,0 +1,61 @@
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollama/ollama/format"
+)
+
+func TestShouldPrefetch(t *testing.T) {
+	cases := []struct {
+		size, free uint64
+		expect     bool
+	}{
+		{size: 4 * format.GigaByte, free: 16 * format.GigaByte, expect: true},
+		{size: 4 * format.GigaByte, free: 4*format.GigaByte + 400*format.MegaByte + format.GibiByte, expect: true},
+		{size: 4 * format.GigaByte, free: 5 * format.GigaByte, expect: false},
+		{size: 40 * format.GigaByte, free: 32 * format.GigaByte, expect: false},
+		{size: 4 * format.GigaByte, free: 0, expect: false},
+	}
+
+	for _, tt := range cases {
+		if actual := shouldPrefetch(tt.size, tt.free); actual != tt.expect {
+			t.Errorf("size %s, free %s: expected %t, got %t", format.HumanBytes2(tt.size), format.HumanBytes2(tt.free), tt.expect, actual)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	dir := t.TempDir()
+
+	// Sizes that don't divide evenly into chunks or workers
+	var paths []string
+	var size uint64
+	for i, n := range []int{3*prefetchChunk + 123, prefetchChunk/2 + 1} {
+		path := filepath.Join(dir, "blob"+string(rune('a'+i)))
+		if err := os.WriteFile(path, make([]byte, n), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		size += uint64(n)
+	}
+
+	if read := startPrefetch(paths...).stop(); read > size {
+		t.Errorf("read %d bytes from %d bytes of files", read, size)
+	}
+
+	p := startPrefetch(paths...)
+	<-p.done
+	if read := p.stop(); read != size {
+		t.Errorf("expected to read %d bytes, got %d", size, read)
+	}
+
+	// A missing file stops prefetching without failing
+	p = startPrefetch(filepath.Join(dir, "missing"), paths[0])
+	<-p.done
+	if read := p.stop(); read != 0 {
+		t.Errorf("expected nothing to be read after a missing file, got %d bytes", read)
+	}
+}
@@ -0,0 +1,206 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// quantizeInterval is how often the output of a quantization is checked to
+// report its progress
+var quantizeInterval = 500 * time.Millisecond
+
+// QuantizeProgress reports the tensor a quantization is on
+type QuantizeProgress struct {
+	Tensor string
+
+	// Completed is the number of tensors written, out of Total
+	Completed, Total int
+}
+
+// bitsPerWeight returns the average number of bits quantizing a tensor to t
+// stores each weight in, or 0 if tensors can't be quantized to t
+func (t fileType) bitsPerWeight() float64 {
+	switch t {
+	case fileTypeF32:
+		return 32
+	case fileTypeF16, fileTypeBF16:
+		return 16
+	case fileTypeQ4_0:
+		return 4.5
+	case fileTypeQ4_1:
+		return 5
+	case fileTypeQ5_0:
+		return 5.5
+	case fileTypeQ5_1:
+		return 6
+	case fileTypeQ8_0:
+		return 8.5
+	case fileTypeQ2_K, fileTypeQ2_K_S:
+		return 2.625
+	case fileTypeQ3_K_S, fileTypeQ3_K_M, fileTypeQ3_K_L:
+		return 3.4375
+	case fileTypeQ4_K_S, fileTypeQ4_K_M:
+		return 4.5
+	case fileTypeQ5_K_S, fileTypeQ5_K_M:
+		return 5.5
+	case fileTypeQ6_K:
+		return 6.5625
+	case fileTypeIQ1_S:
+		return 1.5625
+	case fileTypeIQ1_M:
+		return 1.75
+	case fileTypeIQ2_XXS:
+		return 2.0625
+	case fileTypeIQ2_XS:
+		return 2.3125
+	case fileTypeIQ2_S, fileTypeIQ2_M:
+		return 2.5625
+	case fileTypeIQ3_XXS:
+		return 3.0625
+	case fileTypeIQ3_XS, fileTypeIQ3_S:
+		return 3.4375
+	case fileTypeIQ4_NL:
+		return 4.5
+	case fileTypeIQ4_XS:
+		return 4.25
+	default:
+		return 0
+	}
+}
+
+// superBlock reports whether t stores weights in blocks of 256, like the
+// k-quants and most i-quants, rather than 32
+func (t fileType) superBlock() bool {
+	if t == fileTypeIQ4_NL {
+		return false
+	}
+
+	return strings.Contains(t.String(), "_K") || strings.HasPrefix(t.String(), "IQ")
+}
+
+// needsImportanceMatrix reports whether t can only be quantized to with an
+// importance matrix, since the model is unusable otherwise
+func (t fileType) needsImportanceMatrix() bool {
+	switch t {
+	case fileTypeIQ1_S, fileTypeIQ1_M, fileTypeIQ2_XXS, fileTypeIQ2_XS, fileTypeIQ2_S, fileTypeQ2_K_S:
+		return true
+	default:
+		return false
+	}
+}
+
+// ImportanceMatrixRecommended reports whether quantizing to t without an
+// importance matrix loses noticeably more quality than with one
+func (t fileType) ImportanceMatrixRecommended() bool {
+	switch t {
+	case fileTypeQ2_K, fileTypeQ3_K_S:
+		return true
+	default:
+		return t.needsImportanceMatrix() || strings.HasPrefix(t.String(), "IQ")
+	}
+}
+
+// CheckQuantize returns an error if the model can't be quantized to t with
+// the importance matrix, which may be nil
+func (llm GGML) CheckQuantize(t fileType, imatrix *Imatrix) error {
+	switch ft := llm.KV().FileType(); ft {
+	case fileTypeF32, fileTypeF16, fileTypeBF16:
+	default:
+		return fmt.Errorf("quantization is only supported for F16, BF16 and F32 models, this model is %s", ft)
+	}
+
+	if t.bitsPerWeight() == 0 {
+		return fmt.Errorf("unsupported quantization type %s", t)
+	}
+
+	if imatrix != nil {
+		if err := imatrix.CheckModel(&llm); err != nil {
+			return err
+		}
+	} else if t.needsImportanceMatrix() {
+		return fmt.Errorf("quantizing to %s requires an importance matrix; set one with IMATRIX or --imatrix, or use IQ3_XXS or larger", t)
+	}
+
+	arch := llm.KV().Architecture()
+	if n := llm.KV().EmbeddingLength(); t.superBlock() && n%256 != 0 {
+		return fmt.Errorf("%s can't be quantized to %s since its embedding length %d isn't a multiple of 256; use Q4_0, Q5_0, Q8_0 or IQ4_NL", arch, t, n)
+	}
+
+	return nil
+}
+
+// quantizable reports whether the tensor is quantized, rather than copied, by
+// a quantization
+func (t Tensor) quantizable() bool {
+	return strings.HasSuffix(t.Name, "weight") && len(t.Shape) >= 2
+}
+
+// quantizedOffsets estimates where each tensor ends in the model quantized to
+// t. Tensors in quantization mixes such as Q4_K_M use a few types, so the
+// offsets are approximate.
+func (llm GGML) quantizedOffsets(t fileType) []uint64 {
+	tensors := llm.Tensors()
+	offsets := make([]uint64, len(tensors.Items))
+
+	offset := tensors.Offset
+	for i, tensor := range tensors.Items {
+		size := tensor.Size()
+		if tensor.quantizable() {
+			size = uint64(float64(tensor.parameters()) * t.bitsPerWeight() / 8)
+		}
+
+		// tensor data is aligned to 32 bytes
+		offset += (size + 31) &^ 31
+		offsets[i] = offset
+	}
+
+	return offsets
+}
+
+// QuantizedSize estimates the size of the model quantized to t
+func (llm GGML) QuantizedSize(t fileType) uint64 {
+	if offsets := llm.quantizedOffsets(t); len(offsets) > 0 {
+		return offsets[len(offsets)-1]
+	}
+
+	return llm.Tensors().Offset
+}
+
+// watchQuantize reports the progress of quantizing the model to t in outfile
+// until ctx is done, from how much of it has been written. Tensors are written
+// in order, after the metadata.
+func (llm GGML) watchQuantize(ctx context.Context, outfile string, t fileType, fn func(QuantizeProgress)) {
+	tensors := llm.Tensors().Items
+	offsets := llm.quantizedOffsets(t)
+
+	ticker := time.NewTicker(quantizeInterval)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(outfile)
+			if err != nil {
+				continue
+			}
+
+			// the tensor being written is the first that ends past what's
+			// been written so far
+			var n int
+			for n < len(offsets)-1 && offsets[n] <= uint64(fi.Size()) {
+				n++
+			}
+
+			if n != last && n < len(tensors) {
+				last = n
+				fn(QuantizeProgress{Tensor: tensors[n].Name, Completed: n, Total: len(tensors)})
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeQuantizeModel(t *testing.T, kv KV, tensors []Tensor) *GGML {
+	t.Helper()
+
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := WriteGGUF(f, kv, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _, err := DecodeGGML(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ggml
+}
+
+func TestCheckQuantize(t *testing.T) {
+	cases := []struct {
+		name      string
+		fileType  fileType
+		embedding uint32
+		target    fileType
+		err       string
+	}{
+		{"f16 to q4_K_M", fileTypeF16, 4096, fileTypeQ4_K_M, ""},
+		{"bf16 to iq4_xs", fileTypeBF16, 4096, fileTypeIQ4_XS, ""},
+		{"f16 to q8_0", fileTypeF16, 100, fileTypeQ8_0, ""},
+		{"quantized source", fileTypeQ4_0, 4096, fileTypeQ4_K_M, "only supported for F16, BF16 and F32 models"},
+		{"importance matrix", fileTypeF16, 4096, fileTypeIQ2_XS, "requires an importance matrix"},
+		{"embedding length", fileTypeF16, 100, fileTypeQ4_K_M, "isn't a multiple of 256"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ggml := decodeQuantizeModel(t, KV{
+				"general.architecture":   "llama",
+				"general.file_type":      uint32(tt.fileType),
+				"llama.embedding_length": tt.embedding,
+			}, nil)
+
+			err := ggml.CheckQuantize(tt.target, nil)
+			if tt.err == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestQuantizedSize(t *testing.T) {
+	ggml := decodeQuantizeModel(t, KV{
+		"general.architecture": "llama",
+		"general.file_type":    uint32(fileTypeF16),
+	}, []Tensor{
+		{Name: "token_embd.weight", Kind: 1, Shape: []uint64{64, 32}, WriterTo: bytes.NewReader(make([]byte, 64*32*2))},
+		{Name: "output_norm.weight", Kind: 0, Shape: []uint64{64}, WriterTo: bytes.NewReader(make([]byte, 64*4))},
+	})
+
+	offsets := ggml.quantizedOffsets(fileTypeQ8_0)
+	if len(offsets) != 2 {
+		t.Fatalf("expected 2 offsets, got %d", len(offsets))
+	}
+
+	// 2048 weights at 8.5 bits, and the norm copied as is
+	start := ggml.Tensors().Offset
+	if offsets[0] != start+2176 || offsets[1] != start+2176+256 {
+		t.Errorf("unexpected offsets %v from %d", offsets, start)
+	}
+
+	if size := ggml.QuantizedSize(fileTypeQ8_0); size != offsets[1] {
+		t.Errorf("expected size %d, got %d", offsets[1], size)
+	}
+}
+
+func TestWatchQuantize(t *testing.T) {
+	quantizeInterval = time.Millisecond
+	t.Cleanup(func() { quantizeInterval = 500 * time.Millisecond })
+
+	ggml := decodeQuantizeModel(t, KV{
+		"general.architecture": "llama",
+		"general.file_type":    uint32(fileTypeF16),
+	}, []Tensor{
+		{Name: "token_embd.weight", Kind: 1, Shape: []uint64{64, 32}, WriterTo: bytes.NewReader(make([]byte, 64*32*2))},
+		{Name: "output.weight", Kind: 1, Shape: []uint64{64, 32}, WriterTo: bytes.NewReader(make([]byte, 64*32*2))},
+	})
+
+	outfile := filepath.Join(t.TempDir(), "out")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progress := make(chan QuantizeProgress)
+	go ggml.watchQuantize(ctx, outfile, fileTypeQ8_0, func(p QuantizeProgress) {
+		progress <- p
+	})
+
+	next := func() QuantizeProgress {
+		t.Helper()
+		select {
+		case p := <-progress:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for progress")
+			return QuantizeProgress{}
+		}
+	}
+
+	// the metadata has been written
+	if err := os.WriteFile(outfile, make([]byte, ggml.Tensors().Offset), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := next(); p != (QuantizeProgress{Tensor: "token_embd.weight", Completed: 0, Total: 2}) {
+		t.Errorf("unexpected progress %+v", p)
+	}
+
+	// the first tensor has been written
+	if err := os.WriteFile(outfile, make([]byte, ggml.quantizedOffsets(fileTypeQ8_0)[0]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := next(); p != (QuantizeProgress{Tensor: "output.weight", Completed: 1, Total: 2}) {
+		t.Errorf("unexpected progress %+v", p)
+	}
+}
@@ -0,0 +1,148 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/ollama/ollama/format"
+)
+
+// maxPooledRequest bounds the buffers kept in requestPool, so a single
+// oversized request doesn't pin its memory after it's sent
+const maxPooledRequest = 64 * format.MebiByte
+
+// requestPool holds the buffers completion requests are encoded into before
+// being sent to the runner. Multimodal requests are dominated by their base64
+// encoded images, so reusing buffers avoids growing a new one per request.
+var requestPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// encodeCompletion encodes request, followed by images as image_data, into
+// buf. The images are base64 encoded straight into buf, which is grown once to
+// fit them, rather than through encoding/json's own buffer.
+func encodeCompletion(buf *bytes.Buffer, request map[string]any, images []ImageData) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(request); err != nil {
+		return err
+	}
+
+	if len(images) == 0 {
+		return nil
+	}
+
+	// Reopen the object by dropping the trailing "}\n"
+	buf.Truncate(buf.Len() - 2)
+
+	size := len(`,"image_data":[]}`) + 1
+	for _, image := range images {
+		size += len(`{"data":"","id":},`) + base64.StdEncoding.EncodedLen(len(image.Data)) + 20
+	}
+	buf.Grow(size)
+
+	buf.WriteString(`,"image_data":[`)
+	for i, image := range images {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteString(`{"data":"`)
+		buf.Write(base64.StdEncoding.AppendEncode(buf.AvailableBuffer(), image.Data))
+		buf.WriteString(`","id":`)
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(image.ID), 10))
+		buf.WriteByte('}')
+	}
+	buf.WriteString("]}\n")
+	return nil
+}
+
+// pooledBuffer is a buffer from requestPool that a request's body is read
+// from. The transport closes the body once it's sent, but may then ask for a
+// new body to retry the request with, so the buffer is only returned to the
+// pool once the request is released and all of its bodies are closed.
+type pooledBuffer struct {
+	mu   sync.Mutex
+	buf  *bytes.Buffer
+	refs int // the request and its open bodies
+}
+
+var errBodyClosed = errors.New("request body closed")
+
+func newPooledBuffer() *pooledBuffer {
+	buf := requestPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return &pooledBuffer{buf: buf, refs: 1}
+}
+
+// body returns a new body reading the buffer from the start. It's used as
+// both the request's Body and its GetBody.
+func (p *pooledBuffer) body() (io.ReadCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.buf == nil {
+		return nil, errBodyClosed
+	}
+
+	p.refs++
+	return &pooledBody{p: p}, nil
+}
+
+// release drops the request's reference once it's done, after which no new
+// bodies can be read from the buffer
+func (p *pooledBuffer) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unref()
+}
+
+// The mu must already be held when calling unref
+func (p *pooledBuffer) unref() {
+	p.refs--
+	if p.refs == 0 {
+		if p.buf.Cap() <= maxPooledRequest {
+			requestPool.Put(p.buf)
+		}
+		p.buf = nil
+	}
+}
+
+// pooledBody is a request body read from a pooledBuffer. The transport may
+// close the body while it's still being read, so reads after Close fail
+// rather than seeing the buffer of another request.
+type pooledBody struct {
+	p      *pooledBuffer
+	off    int
+	closed bool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	b.p.mu.Lock()
+	defer b.p.mu.Unlock()
+	if b.closed {
+		return 0, errBodyClosed
+	}
+
+	if b.off >= b.p.buf.Len() {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.p.buf.Bytes()[b.off:])
+	b.off += n
+	return n, nil
+}
+
+func (b *pooledBody) Close() error {
+	b.p.mu.Lock()
+	defer b.p.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.p.unref()
+	}
+	return nil
+}
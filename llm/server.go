@@ -10,6 +10,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -17,8 +18,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/semaphore"
@@ -38,10 +41,25 @@ type LlamaServer interface {
 	Embedding(ctx context.Context, input string) ([]float32, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
+	LoadProgress() float32
+	ReleaseCache(ctx context.Context) error
+	RestoreCache(ctx context.Context) error
 	Close() error
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
+	EstimatedCacheByGPU(gpuID string) uint64
+	Runner() string
+	UseMMap() bool
+	UseMLock() bool
+
+	// Slots samples the state of the runner's parallel slots. It returns no
+	// slots for runners that don't report them.
+	Slots(ctx context.Context) ([]SlotStatus, error)
+
+	// Score returns the log-probability of each token of a continuation
+	// following a prompt. The runner evaluates both without sampling.
+	Score(ctx context.Context, req ScoreRequest) ([]api.TokenLogprob, error)
 }
 
 // llmServer is an instance of the llama.cpp server
@@ -53,16 +71,27 @@ type llmServer struct {
 	options     api.Options
 	numParallel int
 
+	runner      string // Name of the runner variant, e.g. cpu_avx2 or cuda_v12
 	estimate    MemoryEstimate
 	totalLayers uint64
 	// gpuCount     int
 	gpus         gpu.GpuInfoList // Recorded just before the model loaded, free space will be incorrect
 	loadDuration time.Duration   // Record how long it took the model to load
-	loadProgress float32
+	loadProgress atomic.Uint32   // float32 bits of the progress last reported by the runner
+	loadSize     uint64          // Size of the model files the runner loads
+	prefetch     *prefetcher     // Warms the page cache with the model files while loading, if enabled
+	warm         *warmRunner     // The runner from the warm pool the model was loaded in, if any
+
+	closing     atomic.Bool // Set when the runner is stopped by Close
+	killedByOOM atomic.Bool // Set when the runner exited because the OOM killer killed it
 
 	sem *semaphore.Weighted
 }
 
+// ErrRunnerOOMKilled is returned when the system ran out of memory and killed
+// the runner
+var ErrRunnerOOMKilled = errors.New("llama runner was killed by the system because it ran out of memory")
+
 // LoadModel will load a model from disk. The model must be in the GGML format.
 //
 // It collects array values for arrays with a size less than or equal to
@@ -84,8 +113,10 @@ func LoadModel(model string, maxArraySize int) (*GGML, error) {
 }
 
 // NewLlamaServer will run a server for the given GPUs
-// The gpu list must be a single family.
-func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+// The gpu list must be a single family. reserved is the estimate the
+// scheduler already made for gpus, if any, which is used rather than
+// estimating again.
+func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, opts api.Options, numParallel int, reserved *MemoryEstimate) (LlamaServer, error) {
 	var err error
 	var cpuRunner string
 	var estimate MemoryEstimate
@@ -111,12 +142,17 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		cpuRunner = runners.ServerForCpu()
 		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
 	} else {
-		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		if reserved != nil {
+			estimate = *reserved
+		} else {
+			estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		}
 
 		switch {
 		case gpus[0].Library == "metal" && estimate.VRAMSize > systemTotalMemory:
 			// disable partial offloading when model is greater than total system memory as this
 			// can lead to locking up the system
+			slog.Warn("model requires more memory than is physically installed, disabling metal offload", "required", format.HumanBytes2(estimate.VRAMSize), "physical", format.HumanBytes2(systemTotalMemory))
 			opts.NumGPU = 0
 		case gpus[0].Library != "metal" && estimate.Layers == 0:
 			// Don't bother loading into the GPU if no layers can fit
@@ -131,10 +167,13 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	// Darwin has fully dynamic swap so has no direct concept of free swap space
 	if runtime.GOOS != "darwin" {
 		systemMemoryRequired := estimate.TotalSize - estimate.VRAMSize
-		available := systemFreeMemory + systemSwapFreeMemory
-		if systemMemoryRequired > available {
-			slog.Warn("model request too large for system", "requested", format.HumanBytes2(systemMemoryRequired), "available", available, "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "swap", format.HumanBytes2(systemSwapFreeMemory))
-			return nil, fmt.Errorf("model requires more system memory (%s) than is available (%s)", format.HumanBytes2(systemMemoryRequired), format.HumanBytes2(available))
+		if len(gpus) > 0 && gpus[0].UnifiedMemory {
+			// The GPU portion is also allocated from system memory
+			systemMemoryRequired = estimate.TotalSize
+		}
+		if err := checkSystemMemory(systemMemoryRequired, systemFreeMemory, systemSwapFreeMemory, envconfig.AllowSwap()); err != nil {
+			slog.Warn("model request too large for system", "requested", format.HumanBytes2(systemMemoryRequired), "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "swap", format.HumanBytes2(systemSwapFreeMemory), "allow_swap", envconfig.AllowSwap())
+			return nil, err
 		}
 	}
 
@@ -181,9 +220,13 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		return nil, fmt.Errorf("no servers found for %v", gpus)
 	}
 
+	// The prompt cache is kept in the KV cache after the slots' contexts
+	numCtx := windowedContext(opts)
+	promptCache := promptCacheTokens(ggml, numCtx)
+
 	params := []string{
 		"--model", model,
-		"--ctx-size", strconv.Itoa(opts.NumCtx),
+		"--ctx-size", strconv.Itoa(numCtx + promptCache),
 		"--batch-size", strconv.Itoa(opts.NumBatch),
 		"--embedding",
 	}
@@ -216,6 +259,12 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
 	}
 
+	if opts.PoolingType != "" {
+		params = append(params, "--pooling", opts.PoolingType)
+	}
+
+	params = append(params, contextParams(opts)...)
+
 	if !opts.F16KV {
 		params = append(params, "--memory-f32")
 	}
@@ -244,17 +293,22 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	// Windows CUDA should not use mmap for best performance
 	// Linux  with a model larger than free space, mmap leads to thrashing
 	// For CPU loads we want the memory to be allocated, not FS cache
-	if (runtime.GOOS == "windows" && gpus[0].Library == "cuda" && opts.UseMMap == nil) ||
+	useMMap := !((runtime.GOOS == "windows" && gpus[0].Library == "cuda" && opts.UseMMap == nil) ||
 		(runtime.GOOS == "linux" && systemFreeMemory < estimate.TotalSize && opts.UseMMap == nil) ||
 		(gpus[0].Library == "cpu" && opts.UseMMap == nil) ||
-		(opts.UseMMap != nil && !*opts.UseMMap) {
+		(opts.UseMMap != nil && !*opts.UseMMap))
+	if !useMMap {
 		params = append(params, "--no-mmap")
 	}
 
 	if opts.UseMLock {
 		params = append(params, "--mlock")
+		checkMemlockLimit(estimate.TotalSize)
 	}
 
+	// Record the effective setting so it can be reported for the loaded model
+	opts.UseMMap = &useMMap
+
 	if gpu.IsNUMA() && gpus[0].Library == "cpu" {
 		numaMode := "distribute"
 		if runtime.GOOS == "linux" {
@@ -267,6 +321,10 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 
 	params = append(params, "--parallel", strconv.Itoa(numParallel))
 
+	if promptCache > 0 {
+		params = append(params, "--prompt-cache", strconv.Itoa(promptCache))
+	}
+
 	if estimate.TensorSplit != "" {
 		params = append(params, "--tensor-split", estimate.TensorSplit)
 	}
@@ -299,29 +357,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		}
 		finalParams := append(params, "--port", strconv.Itoa(port))
 
-		pathEnv := "LD_LIBRARY_PATH"
-		if runtime.GOOS == "windows" {
-			pathEnv = "PATH"
-		}
-		// Start with the server directory for the LD_LIBRARY_PATH/PATH
-		libraryPaths := []string{dir}
-
-		if libraryPath, ok := os.LookupEnv(pathEnv); ok {
-			// favor our bundled library dependencies over system libraries
-			libraryPaths = append(libraryPaths, filepath.SplitList(libraryPath)...)
-		}
-
-		// Note: we always put the dependency path first
-		// since this was the exact version we compiled/linked against
-		if gpus[0].DependencyPath != "" {
-			// assume gpus from the same library have the same dependency path
-			libraryPaths = append([]string{gpus[0].DependencyPath}, libraryPaths...)
-		}
-
-		server := filepath.Join(dir, "ollama_llama_server")
-		if runtime.GOOS == "windows" {
-			server += ".exe"
-		}
+		server := runnerPath(dir)
 
 		// Detect tmp cleaners wiping out the file
 		_, err := os.Stat(server)
@@ -336,8 +372,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 
 		s := &llmServer{
 			port:        port,
-			cmd:         exec.Command(server, finalParams...),
-			status:      NewStatusWriter(os.Stderr),
+			runner:      servers[i],
 			options:     opts,
 			estimate:    estimate,
 			numParallel: numParallel,
@@ -347,45 +382,20 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 			done:        make(chan error, 1),
 		}
 
-		s.cmd.Env = os.Environ()
-		s.cmd.Stdout = os.Stdout
-		s.cmd.Stderr = s.status
-		s.cmd.SysProcAttr = LlamaServerSysProcAttr
-
-		envWorkarounds := [][2]string{}
-		for _, gpu := range gpus {
-			envWorkarounds = append(envWorkarounds, gpu.EnvWorkarounds...)
-		}
-		visibleDevicesEnv, visibleDevicesEnvVal := gpus.GetVisibleDevicesEnv()
-		pathEnvVal := strings.Join(libraryPaths, string(filepath.ListSeparator))
-
-		// Update or add the path and visible devices variable with our adjusted version
-		pathNeeded := true
-		devicesNeeded := visibleDevicesEnv != ""
-		for i := range s.cmd.Env {
-			cmp := strings.SplitN(s.cmd.Env[i], "=", 2)
-			if strings.EqualFold(cmp[0], pathEnv) {
-				s.cmd.Env[i] = pathEnv + "=" + pathEnvVal
-				pathNeeded = false
-			} else if devicesNeeded && strings.EqualFold(cmp[0], visibleDevicesEnv) {
-				s.cmd.Env[i] = visibleDevicesEnv + "=" + visibleDevicesEnvVal
-				devicesNeeded = false
-			} else if len(envWorkarounds) != 0 {
-				for _, kv := range envWorkarounds {
-					if strings.EqualFold(cmp[0], kv[0]) {
-						s.cmd.Env[i] = kv[0] + "=" + kv[1]
-					}
-				}
-			}
-		}
-		if pathNeeded {
-			s.cmd.Env = append(s.cmd.Env, pathEnv+"="+pathEnvVal)
-		}
-		if devicesNeeded {
-			s.cmd.Env = append(s.cmd.Env, visibleDevicesEnv+"="+visibleDevicesEnvVal)
+		env := runnerEnv(dir, gpus)
+		s.warm = runnerPool.take(model, server, env)
+		if s.warm != nil {
+			s.cmd, s.status = s.warm.cmd, s.warm.status
+			slog.Info("starting llama server from the warm pool", "cmd", strings.Join(append([]string{server}, finalParams...), " "), "pid", s.cmd.Process.Pid)
+		} else {
+			s.cmd = exec.Command(server, finalParams...)
+			s.status = NewStatusWriter(os.Stderr)
+			s.cmd.Env = env
+			s.cmd.Stdout = os.Stdout
+			s.cmd.Stderr = s.status
+			s.cmd.SysProcAttr = LlamaServerSysProcAttr
+			slog.Info("starting llama server", "cmd", s.cmd.String())
 		}
-
-		slog.Info("starting llama server", "cmd", s.cmd.String())
 		if envconfig.Debug() {
 			filteredEnv := []string{}
 			for _, ev := range s.cmd.Env {
@@ -405,7 +415,31 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 			slog.Debug("subprocess", "environment", filteredEnv)
 		}
 
-		if err = s.cmd.Start(); err != nil {
+		files := append([]string{model}, projectors...)
+		for _, f := range files {
+			if fi, err := os.Stat(f); err == nil {
+				s.loadSize += uint64(fi.Size())
+			}
+		}
+
+		if envconfig.LoadPrefetch() {
+			if shouldPrefetch(s.loadSize, systemFreeMemory) {
+				s.prefetch = startPrefetch(files...)
+			} else {
+				slog.Info("skipping model prefetch, not enough free memory", "size", format.HumanBytes2(s.loadSize), "free", format.HumanBytes2(systemFreeMemory))
+			}
+		}
+
+		if s.warm != nil {
+			err = s.warm.load(finalParams)
+		} else {
+			err = s.cmd.Start()
+		}
+		if err != nil {
+			s.stopPrefetch()
+			if s.warm != nil {
+				s.warm.stop()
+			}
 			// Detect permission denied and augment the message about noexec
 			if errors.Is(err, os.ErrPermission) {
 				finalErr = fmt.Errorf("unable to start server %w.  %s may have noexec set.  Set OLLAMA_TMPDIR for server to a writable executable directory", err, dir)
@@ -420,9 +454,30 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 			continue
 		}
 
+		// the runner, rather than the server, is killed if the system runs
+		// out of memory
+		adjustOOMScore(s.cmd.Process.Pid)
+		oomKillsBefore := oomKills()
+
+		// the pool starts a runner to replace the one this load used, or the
+		// one it would have used
+		go runnerPool.replenish(servers[i], server, env)
+
+		wait := s.cmd.Wait
+		if s.warm != nil {
+			wait = s.warm.wait
+		}
+
 		// reap subprocess when it exits
 		go func() {
-			err := s.cmd.Wait()
+			err := wait()
+			if err != nil && !s.closing.Load() && oomKilled(s.cmd.ProcessState, oomKillsBefore) {
+				slog.Error("llama runner was killed by the OOM killer", "pid", s.cmd.Process.Pid, "model", model)
+				s.killedByOOM.Store(true)
+				s.done <- ErrRunnerOOMKilled
+				return
+			}
+
 			// Favor a more detailed message over the process exit status
 			if err != nil && s.status != nil && s.status.LastErrMsg != "" {
 				slog.Debug("llama runner terminated", "error", err)
@@ -442,6 +497,114 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	return nil, finalErr
 }
 
+// runnerPath returns the runner executable in dir
+func runnerPath(dir string) string {
+	server := filepath.Join(dir, "ollama_llama_server")
+	if runtime.GOOS == "windows" {
+		server += ".exe"
+	}
+
+	return server
+}
+
+// runnerEnv returns the environment of the runner in dir for gpus, with the
+// library path and visible devices adjusted for them
+func runnerEnv(dir string, gpus gpu.GpuInfoList) []string {
+	pathEnv := "LD_LIBRARY_PATH"
+	if runtime.GOOS == "windows" {
+		pathEnv = "PATH"
+	}
+	// Start with the server directory for the LD_LIBRARY_PATH/PATH
+	libraryPaths := []string{dir}
+
+	if libraryPath, ok := os.LookupEnv(pathEnv); ok {
+		// favor our bundled library dependencies over system libraries
+		libraryPaths = append(libraryPaths, filepath.SplitList(libraryPath)...)
+	}
+
+	// Note: we always put the dependency path first
+	// since this was the exact version we compiled/linked against
+	if gpus[0].DependencyPath != "" {
+		// assume gpus from the same library have the same dependency path
+		libraryPaths = append([]string{gpus[0].DependencyPath}, libraryPaths...)
+	}
+
+	envWorkarounds := [][2]string{}
+	for _, gpu := range gpus {
+		envWorkarounds = append(envWorkarounds, gpu.EnvWorkarounds...)
+	}
+	visibleDevicesEnv, visibleDevicesEnvVal := gpus.GetVisibleDevicesEnv()
+	pathEnvVal := strings.Join(libraryPaths, string(filepath.ListSeparator))
+
+	// Per device gfx overrides are passed to the runner as HSA_OVERRIDE_GFX_VERSION_<id>, so only
+	// the version that applies to every device, if any, is left in HSA_OVERRIDE_GFX_VERSION
+	gfxOverride, gfxOverrideByDevice := envconfig.HsaOverrideGfxVersionByDevice()
+
+	// Update or add the path and visible devices variable with our adjusted version
+	pathNeeded := true
+	devicesNeeded := visibleDevicesEnv != ""
+	var env []string
+	for _, ev := range os.Environ() {
+		cmp := strings.SplitN(ev, "=", 2)
+		if strings.EqualFold(cmp[0], pathEnv) {
+			ev = pathEnv + "=" + pathEnvVal
+			pathNeeded = false
+		} else if devicesNeeded && strings.EqualFold(cmp[0], visibleDevicesEnv) {
+			ev = visibleDevicesEnv + "=" + visibleDevicesEnvVal
+			devicesNeeded = false
+		} else if gfxOverrideByDevice != nil && cmp[0] == "HSA_OVERRIDE_GFX_VERSION" {
+			if gfxOverride == "" {
+				continue
+			}
+			ev = "HSA_OVERRIDE_GFX_VERSION=" + gfxOverride
+		} else if len(envWorkarounds) != 0 {
+			for _, kv := range envWorkarounds {
+				if strings.EqualFold(cmp[0], kv[0]) {
+					ev = kv[0] + "=" + kv[1]
+				}
+			}
+		}
+		env = append(env, ev)
+	}
+	if pathNeeded {
+		env = append(env, pathEnv+"="+pathEnvVal)
+	}
+	if devicesNeeded {
+		env = append(env, visibleDevicesEnv+"="+visibleDevicesEnvVal)
+	}
+	for _, kv := range envWorkarounds {
+		if !slices.ContainsFunc(env, func(ev string) bool {
+			k, _, _ := strings.Cut(ev, "=")
+			return strings.EqualFold(k, kv[0])
+		}) {
+			env = append(env, kv[0]+"="+kv[1])
+		}
+	}
+
+	return env
+}
+
+// checkSystemMemory returns an error stating the shortfall if required bytes
+// of system memory don't fit in free memory, or in free memory and swap if
+// allowSwap is set. Models paged in and out of swap stall the whole system,
+// so placements relying on it are refused unless they're allowed.
+func checkSystemMemory(required, free, freeSwap uint64, allowSwap bool) error {
+	available := free
+	if allowSwap {
+		available += freeSwap
+	}
+
+	if required <= available {
+		return nil
+	}
+
+	if !allowSwap && required <= free+freeSwap {
+		return fmt.Errorf("model requires more system memory (%s) than is available without swap (%s), a shortfall of %s; set OLLAMA_ALLOW_SWAP=1 to use swap", format.HumanBytes2(required), format.HumanBytes2(available), format.HumanBytes2(required-available))
+	}
+
+	return fmt.Errorf("model requires more system memory (%s) than is available (%s), a shortfall of %s", format.HumanBytes2(required), format.HumanBytes2(available), format.HumanBytes2(required-available))
+}
+
 func projectorMemoryRequirements(filename string) uint64 {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -493,10 +656,78 @@ type ServerStatusResp struct {
 	SlotsProcessing int     `json:"slots_processing"`
 	Error           string  `json:"error"`
 	Progress        float32 `json:"progress"`
+
+	// Slots is the state of each slot, which runners only report for
+	// /health?include_slots=1 so health checks stay cheap
+	Slots []runnerSlot `json:"slots,omitempty"`
+}
+
+// runnerSlot is a slot as the runner reports it
+type runnerSlot struct {
+	ID int `json:"id"`
+
+	// State is 0 while the slot is idle and 1 while it's processing
+	State int `json:"state"`
+
+	RequestID       string `json:"request_id"`
+	TokensProcessed int    `json:"tokens_processed"`
+	CacheTokens     int    `json:"cache_tokens"`
+
+	NextToken struct {
+		NumTokensPredicted int `json:"num_tokens_predicted"`
+	} `json:"next_token"`
+}
+
+// status returns the slot's state, processing slots being in prefill until
+// they predict their first token
+func (r runnerSlot) status() SlotStatus {
+	state := SlotStateIdle
+	if r.State != 0 {
+		state = SlotStatePrefill
+		if r.NextToken.NumTokensPredicted > 0 {
+			state = SlotStateDecode
+		}
+	}
+
+	return SlotStatus{
+		ID:              r.ID,
+		State:           state,
+		RequestID:       r.RequestID,
+		TokensProcessed: r.TokensProcessed,
+		CacheTokens:     r.CacheTokens,
+	}
+}
+
+// States of a runner's slots
+const (
+	SlotStateIdle    = "idle"
+	SlotStatePrefill = "prefill"
+	SlotStateDecode  = "decode"
+)
+
+// SlotStatus is the state of one of a runner's parallel slots
+type SlotStatus struct {
+	ID int `json:"id"`
+
+	// State is idle, prefill while the slot evaluates a prompt or decode
+	// while it generates
+	State string `json:"state"`
+
+	// RequestID is the ID of the completion the slot is processing
+	RequestID string `json:"request_id,omitempty"`
+
+	// TokensProcessed is how many tokens of the current request the slot
+	// has evaluated or generated, and CacheTokens how many tokens its KV
+	// cache retains, which later requests with the same prefix reuse
+	TokensProcessed int `json:"tokens_processed"`
+	CacheTokens     int `json:"cache_tokens"`
 }
 
 func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
 	// Fail fast if its exited
+	if s.killedByOOM.Load() {
+		return ServerStatusError, ErrRunnerOOMKilled
+	}
 	if s.cmd.ProcessState != nil {
 		msg := ""
 		if s.status != nil && s.status.LastErrMsg != "" {
@@ -540,7 +771,7 @@ func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
 	case "no slot available":
 		return ServerStatusNoSlotsAvailable, nil
 	case "loading model":
-		s.loadProgress = status.Progress
+		s.setLoadProgress(status.Progress)
 		return ServerStatusLoadingModel, nil
 	default:
 		return ServerStatusError, fmt.Errorf("server error: %+v", status)
@@ -570,6 +801,31 @@ func (s *llmServer) getServerStatusRetry(ctx context.Context) (ServerStatus, err
 	}
 }
 
+func (s *llmServer) Slots(ctx context.Context) ([]SlotStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/health?include_slots=1", s.port), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("health resp: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var status ServerStatusResp
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("health unmarshal encode response: %w", err)
+	}
+
+	slots := make([]SlotStatus, len(status.Slots))
+	for i, slot := range status.Slots {
+		slots[i] = slot.status()
+	}
+
+	return slots, nil
+}
+
 func (s *llmServer) Ping(ctx context.Context) error {
 	_, err := s.getServerStatus(ctx)
 	if err != nil {
@@ -581,12 +837,12 @@ func (s *llmServer) Ping(ctx context.Context) error {
 
 func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 	start := time.Now()
-	stallDuration := envconfig.LoadTimeout()    // If no progress happens
-	stallTimer := time.Now().Add(stallDuration) // give up if we stall
+	// Prefetching only helps while the runner is loading
+	defer s.stopPrefetch()
+	stall := newLoadStall(envconfig.LoadTimeout(), start) // give up if no progress happens
 
 	slog.Info("waiting for llama runner to start responding")
 	var lastStatus ServerStatus = -1
-	fullyLoaded := false
 
 	for {
 		select {
@@ -597,14 +853,6 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			return fmt.Errorf("llama runner process has terminated: %w", err)
 		default:
 		}
-		if time.Now().After(stallTimer) {
-			// timeout
-			msg := ""
-			if s.status != nil && s.status.LastErrMsg != "" {
-				msg = s.status.LastErrMsg
-			}
-			return fmt.Errorf("timed out waiting for llama runner to start - progress %0.2f - %s", s.loadProgress, msg)
-		}
 		if s.cmd.ProcessState != nil {
 			msg := ""
 			if s.status != nil && s.status.LastErrMsg != "" {
@@ -612,29 +860,42 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			}
 			return fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg)
 		}
-		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
-		defer cancel()
-		priorProgress := s.loadProgress
-		status, _ := s.getServerStatus(ctx)
+		statusCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		status, _ := s.getServerStatus(statusCtx)
+		cancel()
 		if lastStatus != status && status != ServerStatusReady {
 			// Only log on status changes
 			slog.Info("waiting for server to become available", "status", status.ToString())
 		}
 		switch status {
 		case ServerStatusReady:
+			s.setLoadProgress(1)
 			s.loadDuration = time.Since(start)
-			slog.Info(fmt.Sprintf("llama runner started in %0.2f seconds", s.loadDuration.Seconds()))
+			args := []any{
+				"size", format.HumanBytes2(s.loadSize),
+				"throughput", format.HumanBytes2(uint64(float64(s.loadSize)/max(s.loadDuration.Seconds(), 0.001))) + "/s",
+				"prefetched", format.HumanBytes2(s.stopPrefetch()),
+			}
+			if s.warm != nil {
+				// the runner was started before the load, so its start up
+				// isn't part of the load time
+				args = append(args, "warm_pool_saved", s.warm.saved.Round(time.Millisecond))
+			}
+			slog.Info(fmt.Sprintf("llama runner started in %0.2f seconds", s.loadDuration.Seconds()), args...)
 			return nil
 		default:
 			lastStatus = status
-			// Reset the timer as long as we're making forward progress on the load
-			if priorProgress != s.loadProgress {
-				slog.Debug(fmt.Sprintf("model load progress %0.2f", s.loadProgress))
-				stallTimer = time.Now().Add(stallDuration)
-			} else if !fullyLoaded && int(s.loadProgress*100.0) >= 100 {
-				slog.Debug("model load completed, waiting for server to become available", "status", status.ToString())
-				stallTimer = time.Now().Add(stallDuration)
-				fullyLoaded = true
+			// The deadline moves as long as we're making forward progress on the load
+			progress := s.LoadProgress()
+			if progress > stall.progress {
+				slog.Debug(fmt.Sprintf("model load progress %0.2f", progress))
+			}
+			if stall.update(progress, time.Now()) {
+				msg := ""
+				if s.status != nil && s.status.LastErrMsg != "" {
+					msg = s.status.LastErrMsg
+				}
+				return fmt.Errorf("timed out waiting for llama runner to start: no progress for %s, stalled at %d%% loaded - %s", stall.timeout, int(stall.progress*100), msg)
 			}
 			time.Sleep(time.Millisecond * 250)
 			continue
@@ -642,6 +903,38 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 	}
 }
 
+// LoadProgress returns how much of the model the runner has loaded, from 0 to 1
+func (s *llmServer) LoadProgress() float32 {
+	return math.Float32frombits(s.loadProgress.Load())
+}
+
+func (s *llmServer) setLoadProgress(progress float32) {
+	s.loadProgress.Store(math.Float32bits(progress))
+}
+
+// loadStall detects a model load that has stopped making progress. The
+// deadline moves forward whenever more of the model is loaded, so slow loads
+// aren't given up on as long as they keep progressing.
+type loadStall struct {
+	timeout  time.Duration
+	deadline time.Time
+	progress float32
+}
+
+func newLoadStall(timeout time.Duration, now time.Time) *loadStall {
+	return &loadStall{timeout: timeout, deadline: now.Add(timeout)}
+}
+
+// update records the latest load progress, returning true once there has
+// been none for the timeout
+func (l *loadStall) update(progress float32, now time.Time) bool {
+	if progress > l.progress {
+		l.progress = progress
+		l.deadline = now.Add(l.timeout)
+	}
+	return now.After(l.deadline)
+}
+
 const jsonGrammar = `
 root   ::= object
 value  ::= object | array | string | number | ("true" | "false" | "null") ws
@@ -675,6 +968,10 @@ const maxBufferSize = 512 * format.KiloByte
 type ImageData struct {
 	Data []byte `json:"data"`
 	ID   int    `json:"id"`
+
+	// Tokens is how many context tokens the image's embeddings take, as
+	// estimated from the projector's metadata
+	Tokens int `json:"-"`
 }
 
 type completion struct {
@@ -683,6 +980,23 @@ type completion struct {
 	Prompt       string `json:"prompt"`
 	Stop         bool   `json:"stop"`
 	StoppedLimit bool   `json:"stopped_limit"`
+	StoppedWord  bool   `json:"stopped_word"`
+	StoppedToken bool   `json:"stopped_token"`
+	StoppingWord string `json:"stopping_word"`
+
+	// PromptCacheTokens is the number of prompt tokens reused from other
+	// requests, and is missing if the prompt cache wasn't looked up
+	PromptCacheTokens *int `json:"prompt_cache_tokens"`
+
+	// TokensSubmitted is the number of tokens of the prompt before it was
+	// truncated
+	TokensSubmitted int `json:"tokens_submitted"`
+
+	// Error is set on events reporting that the runner stopped the
+	// completion because of an error
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
 
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
@@ -693,12 +1007,29 @@ type completion struct {
 }
 
 type CompletionRequest struct {
+	// ID identifies the request in the runner's slot statistics
+	ID string
+
 	Prompt  string
 	Format  string
 	Images  []ImageData
 	Options *api.Options
+
+	// AddBOS sets whether a BOS token is added to the start of the prompt,
+	// leaving it to the model if nil, and AddEOS whether an EOS token is
+	// added to its end
+	AddBOS *bool
+	AddEOS bool
+
+	// MaxTime stops the completion once it has run this long, including
+	// the time spent waiting for a free slot, if it's greater than zero
+	MaxTime time.Duration
 }
 
+// errTimeLimit is the cause of the cancellation of completions that reach
+// their MaxTime
+var errTimeLimit = errors.New("time limit reached")
+
 type CompletionResponse struct {
 	Content            string
 	DoneReason         string
@@ -707,10 +1038,96 @@ type CompletionResponse struct {
 	PromptEvalDuration time.Duration
 	EvalCount          int
 	EvalDuration       time.Duration
+
+	// PromptCacheLookup is set if the prompt was looked up in the shared
+	// prompt cache, and PromptCacheTokens is how many of its tokens were
+	// reused from other requests
+	PromptCacheLookup bool
+	PromptCacheTokens int
+
+	// PromptTokens is the number of tokens of the prompt, including those
+	// of images, before it was truncated
+	PromptTokens int
+
+	// StopString is the stop string that ended the response, when
+	// DoneReason is api.DoneReasonStopString
+	StopString string
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+	// max_time is enforced by cancelling the request to the runner, so a
+	// runner that stalls can't hold the response past it
+	parent := ctx
+	if req.MaxTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, req.MaxTime, errTimeLimit)
+		defer cancel()
+	}
+
+	// the runner only reports timings once it stops, so those of generations
+	// stopped by stop_regex or max_time are counted here
+	var evalStart time.Time
+	var evalCount int
+	var stopper *regexStopper
+
+	// timeLimit ends a completion that reached its max_time with the text
+	// generated so far, reporting whether it did
+	timeLimit := func() bool {
+		if parent.Err() != nil || !errors.Is(context.Cause(ctx), errTimeLimit) {
+			return false
+		}
+
+		if stopper != nil {
+			if content := stopper.flush(); content != "" {
+				fn(CompletionResponse{Content: content})
+			}
+		}
+
+		resp := CompletionResponse{Done: true, DoneReason: api.DoneReasonTimeLimit, EvalCount: evalCount}
+		if !evalStart.IsZero() {
+			resp.EvalDuration = time.Since(evalStart)
+		}
+
+		fn(resp)
+		return true
+	}
+
+	// stopped ends a completion the server stops before the runner does,
+	// with the text generated so far
+	stopped := func(reason string) {
+		resp := CompletionResponse{Done: true, DoneReason: reason, EvalCount: evalCount}
+		if !evalStart.IsZero() {
+			resp.EvalDuration = time.Since(evalStart)
+		}
+
+		fn(resp)
+	}
+
+	// interrupted ends a completion whose runner stopped responding before
+	// it was done, either because it's being unloaded or it crashed
+	interrupted := func(err error) {
+		if s.closing.Load() {
+			stopped(api.DoneReasonShutdown)
+			return
+		}
+
+		msg := ""
+		if s.status != nil && s.status.LastErrMsg != "" {
+			msg = s.status.LastErrMsg
+		}
+		slog.Error("llama runner stopped responding during a completion", "error", err, "msg", msg)
+
+		// the runner is stopped, if it's still running, so the next request
+		// loads the model again
+		s.Close()
+		stopped(api.DoneReasonRunnerCrashed)
+	}
+
 	if err := s.sem.Acquire(ctx, 1); err != nil {
+		if timeLimit() {
+			return nil
+		}
+
 		slog.Error("Failed to acquire semaphore", "error", err)
 		return err
 	}
@@ -743,13 +1160,35 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"penalize_nl":       req.Options.PenalizeNewline,
 		"seed":              req.Options.Seed,
 		"stop":              req.Options.Stop,
-		"image_data":        req.Images,
+		"stop_token_ids":    req.Options.StopTokenIDs,
 		"cache_prompt":      true,
 	}
 
+	if req.ID != "" {
+		request["request_id"] = req.ID
+	}
+
+	if req.AddBOS != nil {
+		request["add_bos"] = *req.AddBOS
+	}
+
+	if req.AddEOS {
+		request["add_eos"] = true
+	}
+
+	// stop_regex is matched here rather than by the runner, since it's
+	// evaluated on decoded text with RE2 syntax
+	stopper, err := newRegexStopper(req.Options.StopRegex)
+	if err != nil {
+		return err
+	}
+
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
 	if err != nil {
+		if timeLimit() {
+			return nil
+		}
 		return err
 	} else if status != ServerStatusReady {
 		return fmt.Errorf("unexpected server status: %s", status.ToString())
@@ -762,24 +1201,34 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		}
 	}
 
-	// Handling JSON marshaling with special characters unescaped.
-	buffer := &bytes.Buffer{}
-	enc := json.NewEncoder(buffer)
-	enc.SetEscapeHTML(false)
-
-	if err := enc.Encode(request); err != nil {
+	// The buffer goes back to the pool once the completion is done and the
+	// transport has closed the bodies it read
+	pooled := newPooledBuffer()
+	defer pooled.release()
+	if err := encodeCompletion(pooled.buf, request, req.Images); err != nil {
 		return fmt.Errorf("failed to marshal data: %v", err)
 	}
 
+	body, err := pooled.body()
+	if err != nil {
+		return err
+	}
+
 	endpoint := fmt.Sprintf("http://127.0.0.1:%d/completion", s.port)
-	serverReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, buffer)
+	serverReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
 	if err != nil {
+		body.Close()
 		return fmt.Errorf("error creating POST request: %v", err)
 	}
+	serverReq.ContentLength = int64(pooled.buf.Len())
+	serverReq.GetBody = pooled.body
 	serverReq.Header.Set("Content-Type", "application/json")
 
 	res, err := http.DefaultClient.Do(serverReq)
 	if err != nil {
+		if timeLimit() {
+			return nil
+		}
 		return fmt.Errorf("POST predict: %v", err)
 	}
 	defer res.Body.Close()
@@ -804,6 +1253,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
+			if timeLimit() {
+				return nil
+			}
+
 			// This handles the request cancellation
 			return ctx.Err()
 		default:
@@ -822,6 +1275,21 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				return fmt.Errorf("error unmarshalling llm prediction response: %v", err)
 			}
 
+			if c.Error != nil {
+				if content := stopper.flush(); content != "" {
+					fn(CompletionResponse{Content: content})
+				}
+
+				// runners without context shifting stop once the context
+				// is full
+				if strings.Contains(c.Error.Message, "context shift") {
+					stopped(api.DoneReasonContextShiftError)
+					return nil
+				}
+
+				return fmt.Errorf("llama runner error: %s", c.Error.Message)
+			}
+
 			switch {
 			case strings.TrimSpace(c.Content) == lastToken:
 				tokenRepeat++
@@ -833,47 +1301,91 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			// 30 picked as an arbitrary max token repeat limit, modify as needed
 			if tokenRepeat > 30 {
 				slog.Debug("prediction aborted, token repeat limit reached")
-				return ctx.Err()
+				stopped(api.DoneReasonAbort)
+				return nil
 			}
 
-			if c.Content != "" {
+			if !c.Stop {
+				if evalStart.IsZero() {
+					evalStart = time.Now()
+				}
+				evalCount++
+			}
+
+			content, stopped := stopper.add(c.Content)
+			if c.Stop {
+				content += stopper.flush()
+			}
+
+			if content != "" {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Content: content,
 				})
 			}
 
+			if stopped {
+				// returning closes the stream, which stops the runner
+				fn(CompletionResponse{
+					Done:         true,
+					DoneReason:   api.DoneReasonStopRegex,
+					EvalCount:    evalCount,
+					EvalDuration: time.Since(evalStart),
+				})
+				return nil
+			}
+
 			if c.Stop {
-				doneReason := "stop"
-				if c.StoppedLimit {
-					doneReason = "length"
+				doneReason := api.DoneReasonStop
+				switch {
+				case c.StoppedLimit:
+					doneReason = api.DoneReasonLength
+				case c.StoppedWord:
+					doneReason = api.DoneReasonStopString
+				case c.StoppedToken:
+					doneReason = api.DoneReasonStopToken
 				}
 
-				fn(CompletionResponse{
+				resp := CompletionResponse{
 					Done:               true,
 					DoneReason:         doneReason,
 					PromptEvalCount:    c.Timings.PromptN,
 					PromptEvalDuration: parseDurationMs(c.Timings.PromptMS),
 					EvalCount:          c.Timings.PredictedN,
 					EvalDuration:       parseDurationMs(c.Timings.PredictedMS),
-				})
+					PromptTokens:       c.TokensSubmitted,
+				}
+
+				if doneReason == api.DoneReasonStopString {
+					resp.StopString = c.StoppingWord
+				}
+
+				if c.PromptCacheTokens != nil {
+					resp.PromptCacheLookup = true
+					resp.PromptCacheTokens = *c.PromptCacheTokens
+				}
+
+				fn(resp)
 				return nil
 			}
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		if strings.Contains(err.Error(), "unexpected EOF") {
-			s.Close()
-			msg := ""
-			if s.status != nil && s.status.LastErrMsg != "" {
-				msg = s.status.LastErrMsg
-			}
-			return fmt.Errorf("an unknown error was encountered while running the model %s", msg)
+		if timeLimit() {
+			return nil
 		}
 
-		return fmt.Errorf("error reading llm response: %v", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		interrupted(err)
+		return nil
 	}
 
+	// the stream only ends before the runner stops the completion if the
+	// runner exits
+	interrupted(io.ErrUnexpectedEOF)
 	return nil
 }
 
@@ -935,6 +1447,69 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 	return e.Embedding, nil
 }
 
+// ScoreRequest is sent to the runner's /score endpoint, which tokenizes
+// Prompt with a BOS token and Continuation on its own, without one, and
+// evaluates them in a single prefill keeping the logits that predict each of
+// the continuation's tokens. Only the continuation's tokens are returned.
+type ScoreRequest struct {
+	Prompt       string `json:"prompt"`
+	Continuation string `json:"continuation"`
+}
+
+type ScoreResponse struct {
+	Tokens []api.TokenLogprob `json:"tokens"`
+}
+
+func (s *llmServer) Score(ctx context.Context, req ScoreRequest) ([]api.TokenLogprob, error) {
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		slog.Error("Failed to acquire semaphore", "error", err)
+		return nil, err
+	}
+	defer s.sem.Release(1)
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return nil, err
+	} else if status != ServerStatusReady {
+		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling score data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/score", s.port), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("error creating score request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("do score request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading score response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		slog.Error("llm score error", "error", string(body))
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	var score ScoreResponse
+	if err := json.Unmarshal(body, &score); err != nil {
+		return nil, fmt.Errorf("unmarshal score response: %w", err)
+	}
+
+	return score.Tokens, nil
+}
+
 type TokenizeRequest struct {
 	Content string `json:"content"`
 }
@@ -1039,9 +1614,59 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 	return decoded.Content, nil
 }
 
+// ReleaseCache frees the KV cache and compute buffers of an idle runner while
+// keeping the weights loaded
+func (s *llmServer) ReleaseCache(ctx context.Context) error {
+	return s.postCache(ctx, "release")
+}
+
+// RestoreCache reallocates the KV cache freed by ReleaseCache. The runner also
+// reallocates it on the next completion, but restoring it first surfaces
+// allocation failures before a request depends on it.
+func (s *llmServer) RestoreCache(ctx context.Context) error {
+	return s.postCache(ctx, "restore")
+}
+
+func (s *llmServer) postCache(ctx context.Context, action string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/cache/%s", s.port, action), nil)
+	if err != nil {
+		return fmt.Errorf("cache %s request: %w", action, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("do cache %s request: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("cache %s failed: %s", action, resp.Status)
+		}
+		return fmt.Errorf("cache %s failed: %s", action, e.Error)
+	}
+
+	return nil
+}
+
+// stopPrefetch stops prefetching the model files, returning how many bytes
+// were prefetched
+func (s *llmServer) stopPrefetch() uint64 {
+	if s.prefetch == nil {
+		return 0
+	}
+
+	return s.prefetch.stop()
+}
+
 func (s *llmServer) Close() error {
-	if s.cmd != nil {
+	s.stopPrefetch()
+	if s.cmd != nil && s.cmd.Process != nil {
 		slog.Debug("stopping llama server")
+		s.closing.Store(true)
 		if err := s.cmd.Process.Kill(); err != nil {
 			return err
 		}
@@ -1065,6 +1690,21 @@ func (s *llmServer) EstimatedTotal() uint64 {
 	return s.estimate.TotalSize
 }
 
+func (s *llmServer) Runner() string {
+	return s.runner
+}
+
+// UseMMap reports whether the model's weights are memory mapped
+func (s *llmServer) UseMMap() bool {
+	return s.options.UseMMap != nil && *s.options.UseMMap
+}
+
+// UseMLock reports whether the model's memory is locked to keep it from being
+// swapped out
+func (s *llmServer) UseMLock() bool {
+	return s.options.UseMLock
+}
+
 func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	for i, gpu := range s.gpus {
 		if gpu.ID == gpuID {
@@ -1074,6 +1714,15 @@ func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	return 0
 }
 
+func (s *llmServer) EstimatedCacheByGPU(gpuID string) uint64 {
+	for i, gpu := range s.gpus {
+		if gpu.ID == gpuID && i < len(s.estimate.CacheSizes) {
+			return s.estimate.CacheSizes[i]
+		}
+	}
+	return 0
+}
+
 func parseDurationMs(ms float64) time.Duration {
 	dur, err := time.ParseDuration(fmt.Sprintf("%fms", ms))
 	if err != nil {
@@ -0,0 +1,728 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+)
+
+func TestLoadStall(t *testing.T) {
+	start := time.Now()
+	l := newLoadStall(time.Minute, start)
+
+	if l.update(0, start.Add(30*time.Second)) {
+		t.Fatal("stalled before the timeout")
+	}
+
+	// Progress moves the deadline forward
+	if l.update(0.5, start.Add(50*time.Second)) {
+		t.Fatal("stalled while making progress")
+	}
+	if l.update(0.5, start.Add(90*time.Second)) {
+		t.Fatal("stalled before the timeout since the last progress")
+	}
+
+	// Progress going backwards isn't progress
+	if !l.update(0.25, start.Add(111*time.Second)) {
+		t.Fatal("expected stall without progress for the timeout")
+	}
+	if l.progress != 0.5 {
+		t.Errorf("expected progress 0.5, got %f", l.progress)
+	}
+}
+
+func randomImages(t testing.TB, sizes ...int) []ImageData {
+	t.Helper()
+	images := make([]ImageData, len(sizes))
+	for i, size := range sizes {
+		images[i] = ImageData{ID: i, Data: make([]byte, size)}
+		if _, err := rand.Read(images[i].Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return images
+}
+
+func TestEncodeCompletion(t *testing.T) {
+	type decoded struct {
+		Prompt string      `json:"prompt"`
+		Images []ImageData `json:"image_data"`
+	}
+
+	decode := func(t *testing.T, b []byte) decoded {
+		t.Helper()
+		var d decoded
+		if err := json.Unmarshal(b, &d); err != nil {
+			t.Fatalf("invalid request %q: %v", b, err)
+		}
+		return d
+	}
+
+	request := map[string]any{"prompt": "<b>describe</b> these", "stream": true}
+
+	t.Run("no images", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := encodeCompletion(&buf, request, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if d := decode(t, buf.Bytes()); d.Prompt != request["prompt"] || d.Images != nil {
+			t.Errorf("unexpected request %+v", d)
+		}
+	})
+
+	t.Run("images", func(t *testing.T) {
+		images := randomImages(t, 0, 1, 2, 3, 1000)
+		var buf bytes.Buffer
+		if err := encodeCompletion(&buf, request, images); err != nil {
+			t.Fatal(err)
+		}
+
+		d := decode(t, buf.Bytes())
+		if d.Prompt != request["prompt"] {
+			t.Errorf("expected prompt %q, got %q", request["prompt"], d.Prompt)
+		}
+
+		if len(d.Images) != len(images) {
+			t.Fatalf("expected %d images, got %d", len(images), len(d.Images))
+		}
+
+		for i := range images {
+			if d.Images[i].ID != images[i].ID || !bytes.Equal(d.Images[i].Data, images[i].Data) {
+				t.Errorf("image %d doesn't match", i)
+			}
+		}
+	})
+}
+
+func TestPooledBody(t *testing.T) {
+	t.Run("closed", func(t *testing.T) {
+		buf := newPooledBuffer()
+		buf.buf.WriteString("request")
+		body, err := buf.body()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := body.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := body.Read(make([]byte, 8)); !errors.Is(err, errBodyClosed) {
+			t.Errorf("expected reads after close to fail, got %v", err)
+		}
+
+		// Closing twice mustn't put the buffer in the pool twice
+		if err := body.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.refs != 1 {
+			t.Errorf("expected only the request's reference, got %d", buf.refs)
+		}
+
+		buf.release()
+		if _, err := buf.body(); !errors.Is(err, errBodyClosed) {
+			t.Errorf("expected no bodies after release, got %v", err)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		// The transport closes the body it sent before asking for another
+		// to retry the request with
+		buf := newPooledBuffer()
+		defer buf.release()
+		buf.buf.WriteString("request")
+
+		body, err := buf.body()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.ReadAll(body); err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+
+		retry, err := buf.body()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer retry.Close()
+
+		b, err := io.ReadAll(retry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "request" {
+			t.Errorf("expected the retried body to be read from the start, got %q", b)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		// A 307 redirect is followed by resending the body from GetBody
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				http.Redirect(w, r, "/completion", http.StatusTemporaryRedirect)
+				return
+			}
+
+			b, _ := io.ReadAll(r.Body)
+			w.Write(b)
+		}))
+		defer srv.Close()
+
+		buf := newPooledBuffer()
+		defer buf.release()
+		buf.buf.WriteString("request")
+		body, err := buf.body()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = int64(buf.buf.Len())
+		req.GetBody = buf.body
+
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "request" {
+			t.Errorf("expected the body to be resent, got %q", b)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		// Requests sharing the pool must each read back their own images
+		var wg sync.WaitGroup
+		for i := range 16 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					images := randomImages(t, 4096+i)
+					buf := newPooledBuffer()
+					if err := encodeCompletion(buf.buf, map[string]any{"prompt": "p"}, images); err != nil {
+						t.Error(err)
+						return
+					}
+
+					body, err := buf.body()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					b, err := io.ReadAll(body)
+					body.Close()
+					buf.release()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					var d struct {
+						Images []ImageData `json:"image_data"`
+					}
+					if err := json.Unmarshal(b, &d); err != nil {
+						t.Error(err)
+						return
+					}
+
+					if len(d.Images) != 1 || !bytes.Equal(d.Images[0].Data, images[0].Data) {
+						t.Error("image was corrupted by another request")
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+// BenchmarkEncodeCompletion compares encoding a multimodal completion request
+// with encoding/json into a new buffer, as requests were encoded before, with
+// encoding it into a pooled buffer
+func BenchmarkEncodeCompletion(b *testing.B) {
+	for _, size := range []int{4 * format.MebiByte, 20 * format.MebiByte} {
+		images := randomImages(b, size)
+		request := map[string]any{"prompt": "describe this image", "stream": true, "n_predict": 128}
+
+		b.Run(fmt.Sprintf("json/%dMiB", size/format.MebiByte), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				r := maps.Clone(request)
+				r["image_data"] = images
+
+				buf := &bytes.Buffer{}
+				enc := json.NewEncoder(buf)
+				enc.SetEscapeHTML(false)
+				if err := enc.Encode(r); err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := io.Copy(io.Discard, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("pooled/%dMiB", size/format.MebiByte), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				buf := newPooledBuffer()
+				if err := encodeCompletion(buf.buf, request, images); err != nil {
+					b.Fatal(err)
+				}
+
+				body, err := buf.body()
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := io.Copy(io.Discard, body); err != nil {
+					b.Fatal(err)
+				}
+				body.Close()
+				buf.release()
+			}
+		})
+	}
+}
+
+// stallingRunner is a runner that generates tokens and then stalls until the
+// request is cancelled
+func stallingRunner(t *testing.T, tokens ...string) *llmServer {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, `{"status": "ok"}`)
+		case "/completion":
+			for _, token := range tokens {
+				b, _ := json.Marshal(completion{Content: token})
+				fmt.Fprintf(w, "data: %s\n\n", b)
+				w.(http.Flusher).Flush()
+			}
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &llmServer{
+		port:    port,
+		cmd:     &exec.Cmd{},
+		options: api.Options{Runner: api.Runner{NumCtx: 2048}},
+		sem:     semaphore.NewWeighted(1),
+	}
+}
+
+func TestCompletionMaxTime(t *testing.T) {
+	complete := func(ctx context.Context, s *llmServer, maxTime time.Duration) ([]CompletionResponse, error) {
+		opts := api.DefaultOptions()
+		opts.StopRegex = []string{`\d{3}`}
+
+		var responses []CompletionResponse
+		err := s.Completion(ctx, CompletionRequest{Prompt: "hi", Options: &opts, MaxTime: maxTime}, func(r CompletionResponse) {
+			responses = append(responses, r)
+		})
+		return responses, err
+	}
+
+	t.Run("stalled runner", func(t *testing.T) {
+		start := time.Now()
+		responses, err := complete(context.Background(), stallingRunner(t, "a", "b", "1"), 200*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the completion to stop after max_time, took %s", elapsed)
+		}
+
+		var content string
+		for _, r := range responses {
+			content += r.Content
+		}
+
+		// the text held back by stop_regex is returned too
+		if content != "ab1" {
+			t.Errorf("expected the text generated so far, got %q", content)
+		}
+
+		last := responses[len(responses)-1]
+		if !last.Done || last.DoneReason != api.DoneReasonTimeLimit || last.EvalCount != 3 || last.EvalDuration <= 0 {
+			t.Errorf("unexpected final response %+v", last)
+		}
+	})
+
+	t.Run("waiting for a slot", func(t *testing.T) {
+		s := stallingRunner(t)
+		if !s.sem.TryAcquire(1) {
+			t.Fatal("expected a free slot")
+		}
+		defer s.sem.Release(1)
+
+		responses, err := complete(context.Background(), s, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(responses) != 1 || responses[0].DoneReason != api.DoneReasonTimeLimit || responses[0].EvalCount != 0 {
+			t.Errorf("expected an empty response, got %+v", responses)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		responses, err := complete(ctx, stallingRunner(t, "a"), time.Minute)
+		if err == nil {
+			t.Error("expected the request's own cancellation to be an error")
+		}
+
+		if len(responses) > 0 && responses[len(responses)-1].Done {
+			t.Errorf("expected no final response, got %+v", responses)
+		}
+	})
+}
+
+func TestCompletionDoneReason(t *testing.T) {
+	// runner returns a runner that streams events and then ends the stream,
+	// with closing set if the runner is being unloaded
+	runner := func(t *testing.T, closing bool, events ...completion) *llmServer {
+		t.Helper()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/health":
+				fmt.Fprint(w, `{"status": "ok"}`)
+			case "/completion":
+				for _, evt := range events {
+					b, _ := json.Marshal(evt)
+					fmt.Fprintf(w, "data: %s\n\n", b)
+				}
+			}
+		}))
+		t.Cleanup(srv.Close)
+
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := &llmServer{
+			port:    port,
+			cmd:     &exec.Cmd{},
+			options: api.Options{Runner: api.Runner{NumCtx: 2048}},
+			sem:     semaphore.NewWeighted(1),
+		}
+		s.closing.Store(closing)
+		return s
+	}
+
+	runnerError := func(msg string) completion {
+		var c completion
+		c.Error = &struct {
+			Message string `json:"message"`
+		}{msg}
+		return c
+	}
+
+	repeated := make([]completion, 40)
+	for i := range repeated {
+		repeated[i] = completion{Content: "a"}
+	}
+
+	cases := []struct {
+		name    string
+		closing bool
+		events  []completion
+		regex   []string
+		expect  string
+		stop    string
+	}{
+		{name: "end of sequence", events: []completion{{Content: "a"}, {Stop: true}}, expect: api.DoneReasonStop},
+		{name: "num_predict", events: []completion{{Content: "a"}, {Stop: true, StoppedLimit: true}}, expect: api.DoneReasonLength},
+		{name: "stop", events: []completion{{Content: "a"}, {Stop: true, StoppedWord: true, StoppingWord: "\n\n"}}, expect: api.DoneReasonStopString, stop: "\n\n"},
+		{name: "stop_token_ids", events: []completion{{Content: "a"}, {Stop: true, StoppedToken: true}}, expect: api.DoneReasonStopToken},
+		{name: "stop_regex", events: []completion{{Content: "a1"}, {Content: "23"}}, regex: []string{`\d{3}`}, expect: api.DoneReasonStopRegex},
+		{name: "repeated token", events: repeated, expect: api.DoneReasonAbort},
+		{name: "context shift", events: []completion{{Content: "a"}, runnerError("context is full and context shift is disabled")}, expect: api.DoneReasonContextShiftError},
+		{name: "runner crashed", events: []completion{{Content: "a"}}, expect: api.DoneReasonRunnerCrashed},
+		{name: "runner unloaded", closing: true, events: []completion{{Content: "a"}}, expect: api.DoneReasonShutdown},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.StopRegex = tt.regex
+
+			var responses []CompletionResponse
+			err := runner(t, tt.closing, tt.events...).Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(r CompletionResponse) {
+				responses = append(responses, r)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(responses) == 0 {
+				t.Fatal("expected a final response")
+			}
+
+			last := responses[len(responses)-1]
+			if !last.Done || last.DoneReason != tt.expect || last.StopString != tt.stop {
+				t.Errorf("expected done reason %q and stop string %q, got %+v", tt.expect, tt.stop, last)
+			}
+		})
+	}
+
+	t.Run("runner error", func(t *testing.T) {
+		opts := api.DefaultOptions()
+		err := runner(t, false, runnerError("failed to decode batch")).Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(CompletionResponse) {})
+		if err == nil || !strings.Contains(err.Error(), "failed to decode batch") {
+			t.Errorf("expected the runner's error, got %v", err)
+		}
+	})
+}
+
+func TestSlots(t *testing.T) {
+	// runner reports its slots for /health?include_slots=1, as the
+	// runner's server.cpp does, and records the ID of the last completion
+	runner := func(t *testing.T, reportSlots bool) (*llmServer, func() string) {
+		t.Helper()
+
+		var mu sync.Mutex
+		var requestID string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/health":
+				if !reportSlots || !r.URL.Query().Has("include_slots") {
+					json.NewEncoder(w).Encode(ServerStatusResp{Status: "ok", SlotsIdle: 1, SlotsProcessing: 2}) //nolint:errcheck
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				fmt.Fprintf(w, `{"status":"ok","slots_idle":1,"slots_processing":2,"slots":[
+					{"n_ctx":2048,"id":0,"task_id":-1,"state":0,"request_id":"","tokens_processed":0,"cache_tokens":12,"prompt":"","next_token":{"has_next_token":true,"n_remain":-1,"num_tokens_predicted":0}},
+					{"n_ctx":2048,"id":1,"task_id":3,"state":1,"request_id":%q,"tokens_processed":40,"cache_tokens":40,"prompt":"hello","next_token":{"has_next_token":true,"n_remain":-1,"num_tokens_predicted":8}},
+					{"n_ctx":2048,"id":2,"task_id":4,"state":1,"request_id":"def","tokens_processed":16,"cache_tokens":16,"prompt":"hi","next_token":{"has_next_token":true,"n_remain":-1,"num_tokens_predicted":0}}
+				]}`, requestID)
+			case "/completion":
+				var req struct {
+					RequestID string `json:"request_id"`
+				}
+				json.NewDecoder(r.Body).Decode(&req) //nolint:errcheck
+				mu.Lock()
+				requestID = req.RequestID
+				mu.Unlock()
+
+				b, _ := json.Marshal(completion{Content: "hi", Stop: true})
+				fmt.Fprintf(w, "data: %s\n\n", b)
+			}
+		}))
+		t.Cleanup(srv.Close)
+
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &llmServer{
+			port:    port,
+			cmd:     &exec.Cmd{},
+			options: api.Options{Runner: api.Runner{NumCtx: 2048}},
+			sem:     semaphore.NewWeighted(1),
+		}, func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return requestID
+		}
+	}
+
+	t.Run("reported", func(t *testing.T) {
+		s, requestID := runner(t, true)
+
+		opts := api.DefaultOptions()
+		if err := s.Completion(context.Background(), CompletionRequest{ID: "abc", Prompt: "hello", Options: &opts}, func(CompletionResponse) {}); err != nil {
+			t.Fatal(err)
+		}
+
+		if id := requestID(); id != "abc" {
+			t.Errorf("expected the request ID to be sent to the runner, got %q", id)
+		}
+
+		slots, err := s.Slots(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []SlotStatus{
+			{ID: 0, State: SlotStateIdle, CacheTokens: 12},
+			{ID: 1, State: SlotStateDecode, RequestID: "abc", TokensProcessed: 40, CacheTokens: 40},
+			{ID: 2, State: SlotStatePrefill, RequestID: "def", TokensProcessed: 16, CacheTokens: 16},
+		}
+		if !slices.Equal(slots, expect) {
+			t.Errorf("expected slots %+v, got %+v", expect, slots)
+		}
+	})
+
+	t.Run("not reported", func(t *testing.T) {
+		s, _ := runner(t, false)
+
+		slots, err := s.Slots(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(slots) != 0 {
+			t.Errorf("expected no slots, got %+v", slots)
+		}
+	})
+}
+
+func TestCheckSystemMemory(t *testing.T) {
+	cases := []struct {
+		name           string
+		required, free uint64
+		swap           uint64
+		allowSwap      bool
+		expect         string
+	}{
+		{name: "fits", required: 4 * format.GibiByte, free: 8 * format.GibiByte, swap: 8 * format.GibiByte},
+		{name: "needs swap", required: 12 * format.GibiByte, free: 8 * format.GibiByte, swap: 8 * format.GibiByte, expect: "than is available without swap (8.0 GiB), a shortfall of 4.0 GiB; set OLLAMA_ALLOW_SWAP=1"},
+		{name: "swap allowed", required: 12 * format.GibiByte, free: 8 * format.GibiByte, swap: 8 * format.GibiByte, allowSwap: true},
+		{name: "too large", required: 20 * format.GibiByte, free: 8 * format.GibiByte, swap: 8 * format.GibiByte, allowSwap: true, expect: "model requires more system memory (20.0 GiB) than is available (16.0 GiB), a shortfall of 4.0 GiB"},
+		{name: "too large without swap", required: 20 * format.GibiByte, free: 8 * format.GibiByte, swap: 8 * format.GibiByte, expect: "than is available (8.0 GiB), a shortfall of 12.0 GiB"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSystemMemory(tt.required, tt.free, tt.swap, tt.allowSwap)
+			switch {
+			case tt.expect == "" && err != nil:
+				t.Errorf("expected the model to fit, got %v", err)
+			case tt.expect != "" && (err == nil || !strings.Contains(err.Error(), tt.expect)):
+				t.Errorf("expected an error containing %q, got %v", tt.expect, err)
+			}
+		})
+	}
+}
+
+func TestScore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			json.NewEncoder(w).Encode(ServerStatusResp{Status: "ok", SlotsIdle: 1}) //nolint:errcheck
+		case "/score":
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			// the runner reads only these fields from the body
+			var body map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if len(body) != 2 {
+				http.Error(w, fmt.Sprintf("unexpected fields: %v", body), http.StatusBadRequest)
+				return
+			}
+
+			prompt, _ := body["prompt"].(string)
+			continuation, _ := body["continuation"].(string)
+			if prompt == "" || continuation == "" {
+				http.Error(w, "prompt and continuation must not be empty", http.StatusBadRequest)
+				return
+			}
+
+			// and returns a log-probability for each of the continuation's tokens
+			fmt.Fprint(w, `{"tokens":[{"token":" bl","logprob":-1.5},{"token":"ue","logprob":-0.25}]}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &llmServer{port: port, cmd: &exec.Cmd{}, sem: semaphore.NewWeighted(1)}
+
+	tokens, err := s.Score(context.Background(), ScoreRequest{Prompt: "the sky is", Continuation: " blue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []api.TokenLogprob{{Token: " bl", Logprob: -1.5}, {Token: "ue", Logprob: -0.25}}
+	if !slices.Equal(tokens, expect) {
+		t.Errorf("expected %+v, got %+v", expect, tokens)
+	}
+
+	if _, err := s.Score(context.Background(), ScoreRequest{Prompt: "the sky is"}); err == nil || !strings.Contains(err.Error(), "must not be empty") {
+		t.Errorf("expected the runner's error, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxStopRegexLength is the most bytes a stop_regex pattern may match. Output
+// that could still become part of a match is held back from the response, so
+// this bounds how far streaming may lag behind generation.
+const MaxStopRegexLength = 256
+
+// ErrStopRegex is returned for stop_regex patterns that can't be matched
+// incrementally as text is generated
+var ErrStopRegex = errors.New("invalid stop_regex")
+
+// CheckStopRegex reports an error wrapping ErrStopRegex if any pattern can't
+// be used as a stop_regex
+func CheckStopRegex(patterns []string) error {
+	_, err := newRegexStopper(patterns)
+	return err
+}
+
+// regexStopper finds the first match of any of a set of patterns in text as
+// it's generated. Text is released once it's too far back to be part of a
+// match, which requires every match to be of bounded length.
+type regexStopper struct {
+	res []*regexp.Regexp
+
+	// hold is the number of bytes of pending text that must be held back
+	// since a match ending in text not yet generated may start in them
+	hold int
+
+	// prev is the last rune released, which ^ in multiline patterns is
+	// evaluated against
+	prev    string
+	pending string
+}
+
+func newRegexStopper(patterns []string) (*regexStopper, error) {
+	s := &regexStopper{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrStopRegex, pattern, err)
+		}
+
+		parsed, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrStopRegex, pattern, err)
+		}
+
+		if op, ok := findOp(parsed, syntax.OpEndLine, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary); ok {
+			return nil, fmt.Errorf("%w %q: %s depends on text that hasn't been generated yet", ErrStopRegex, pattern, opString(op))
+		}
+
+		if re.MatchString("") {
+			return nil, fmt.Errorf("%w %q: pattern matches empty text", ErrStopRegex, pattern)
+		}
+
+		n := maxMatchLength(parsed)
+		if n < 0 || n > MaxStopRegexLength {
+			return nil, fmt.Errorf("%w %q: pattern may match more than %d bytes, the most that can be held back while streaming", ErrStopRegex, pattern, MaxStopRegexLength)
+		}
+
+		s.res = append(s.res, re)
+		s.hold = max(s.hold, n-1)
+	}
+
+	return s, nil
+}
+
+// add appends generated text, returning the text that can be released and
+// whether a pattern matched. Text from the start of the match is dropped.
+func (s *regexStopper) add(content string) (string, bool) {
+	if len(s.res) == 0 {
+		return content, false
+	}
+
+	s.pending += content
+	text := s.prev + s.pending
+
+	start := -1
+	for _, re := range s.res {
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			// matches starting in prev were found before, or are only
+			// matches since the text before prev is missing
+			if loc[0] >= len(s.prev) {
+				if start < 0 || loc[0] < start {
+					start = loc[0]
+				}
+				break
+			}
+		}
+	}
+
+	if start >= 0 {
+		out := text[len(s.prev):start]
+		s.pending = ""
+		return out, true
+	}
+
+	n := len(s.pending) - s.hold
+	for n > 0 && n < len(s.pending) && !utf8.RuneStart(s.pending[n]) {
+		n--
+	}
+
+	if n <= 0 {
+		return "", false
+	}
+
+	out := s.pending[:n]
+	s.pending = s.pending[n:]
+	if _, size := utf8.DecodeLastRuneInString(out); size > 0 {
+		s.prev = out[len(out)-size:]
+	}
+
+	return out, false
+}
+
+// flush returns the text held back once generation has finished
+func (s *regexStopper) flush() string {
+	out := s.pending
+	s.pending = ""
+	return out
+}
+
+// maxMatchLength returns the most bytes re can match, or -1 if it's unbounded
+func maxMatchLength(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		var n int
+		for _, r := range re.Rune {
+			n += maxRuneLength(r, re.Flags&syntax.FoldCase != 0)
+		}
+		return n
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return 0
+		}
+		// runes are encoded in more bytes the larger they are
+		return utf8.RuneLen(re.Rune[len(re.Rune)-1])
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return utf8.UTFMax
+	case syntax.OpCapture, syntax.OpQuest:
+		return maxMatchLength(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus:
+		return -1
+	case syntax.OpRepeat:
+		n := maxMatchLength(re.Sub[0])
+		if re.Max < 0 || n < 0 {
+			return -1
+		}
+		return min(re.Max*n, MaxStopRegexLength+1)
+	case syntax.OpConcat:
+		var n int
+		for _, sub := range re.Sub {
+			m := maxMatchLength(sub)
+			if m < 0 {
+				return -1
+			}
+			n += m
+		}
+		return n
+	case syntax.OpAlternate:
+		var n int
+		for _, sub := range re.Sub {
+			m := maxMatchLength(sub)
+			if m < 0 {
+				return -1
+			}
+			n = max(n, m)
+		}
+		return n
+	default:
+		// empty matches and assertions
+		return 0
+	}
+}
+
+// maxRuneLength returns the most bytes r is encoded in, including its other
+// cases if fold is set
+func maxRuneLength(r rune, fold bool) int {
+	n := utf8.RuneLen(r)
+	if fold {
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			n = max(n, utf8.RuneLen(f))
+		}
+	}
+	return n
+}
+
+// findOp returns the first of ops used in re
+func findOp(re *syntax.Regexp, ops ...syntax.Op) (syntax.Op, bool) {
+	for _, op := range ops {
+		if re.Op == op {
+			return op, true
+		}
+	}
+
+	for _, sub := range re.Sub {
+		if op, ok := findOp(sub, ops...); ok {
+			return op, true
+		}
+	}
+
+	return 0, false
+}
+
+func opString(op syntax.Op) string {
+	switch op {
+	case syntax.OpEndLine, syntax.OpEndText:
+		return "matching the end of text or a line"
+	default:
+		return "matching a word boundary"
+	}
+}
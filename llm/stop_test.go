@@ -0,0 +1,134 @@
+package llm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRegexStopper(t *testing.T) {
+	cases := []struct {
+		name     string
+		patterns []string
+		chunks   []string
+		expect   string
+		stopped  bool
+	}{
+		{
+			name:     "none",
+			patterns: nil,
+			chunks:   []string{"Hello", " world"},
+			expect:   "Hello world",
+		},
+		{
+			name:     "line prefix",
+			patterns: []string{`(?m)^User:`},
+			chunks:   []string{"Sure.", "\n", "Us", "er", ": next", " question"},
+			expect:   "Sure.\n",
+			stopped:  true,
+		},
+		{
+			name:     "line prefix mid line",
+			patterns: []string{`(?m)^User:`},
+			chunks:   []string{"Ask the User", ": anything"},
+			expect:   "Ask the User: anything",
+		},
+		{
+			name:     "start of response",
+			patterns: []string{`^Sorry`},
+			chunks:   []string{"Yes. Sorry", " for the delay"},
+			expect:   "Yes. Sorry for the delay",
+		},
+		{
+			name:     "earliest match",
+			patterns: []string{`[0-9]{3}`, `ab`},
+			chunks:   []string{"xx12", "3ab"},
+			expect:   "xx",
+			stopped:  true,
+		},
+		{
+			name:     "multibyte",
+			patterns: []string{`→ [A-Z]`},
+			chunks:   []string{"a → b ", "→", " C"},
+			expect:   "a → b ",
+			stopped:  true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newRegexStopper(tt.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sb strings.Builder
+			var stopped bool
+			for _, chunk := range tt.chunks {
+				var out string
+				out, stopped = s.add(chunk)
+				sb.WriteString(out)
+				if stopped {
+					break
+				}
+			}
+
+			if !stopped {
+				sb.WriteString(s.flush())
+			}
+
+			if sb.String() != tt.expect || stopped != tt.stopped {
+				t.Errorf("expected %q stopped %v, got %q stopped %v", tt.expect, tt.stopped, sb.String(), stopped)
+			}
+		})
+	}
+}
+
+func TestRegexStopperHold(t *testing.T) {
+	s, err := newRegexStopper([]string{`User:`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the last 4 bytes can still become part of a match
+	if out, _ := s.add("Hello there"); out != "Hello t" {
+		t.Errorf("expected the text before the last 4 bytes, got %q", out)
+	}
+
+	s, err = newRegexStopper([]string{`User:`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rune that's partly in the last 4 bytes is held back whole
+	if out, _ := s.add("éabc"); out != "" {
+		t.Errorf("expected no text, got %q", out)
+	}
+
+	if out, _ := s.add("d"); out != "é" {
+		t.Errorf("expected the first rune, got %q", out)
+	}
+}
+
+func TestCheckStopRegex(t *testing.T) {
+	valid := []string{`(?m)^User:`, `<\|end\|>`, `(?i)stop`, `[0-9]{1,64}`, `a|bc?`}
+	if err := CheckStopRegex(valid); err != nil {
+		t.Errorf("expected %v to be valid, got %v", valid, err)
+	}
+
+	cases := map[string]string{
+		`(`:            "missing closing )",
+		`(?m)^User:.*`: "may match more than 256 bytes",
+		`a{300}`:       "may match more than 256 bytes",
+		`x?`:           "matches empty text",
+		`done$`:        "end of text or a line",
+		`\bend\b`:      "word boundary",
+	}
+
+	for pattern, expect := range cases {
+		err := CheckStopRegex([]string{pattern})
+		if !errors.Is(err, ErrStopRegex) || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%s: expected an error containing %q, got %v", pattern, expect, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package llm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/build"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/runners"
+)
+
+// warmRunner is a runner process started ahead of a load with the --warm
+// flag. It initializes the backend and GPU context, prints "ready", and waits
+// for the arguments to load a model with on stdin. Until then it holds no
+// memory beyond the context the GPUs report it using, so it isn't reserved
+// in the scheduler's VRAM budget.
+type warmRunner struct {
+	backend string   // runner variant, e.g. cpu_avx2 or cuda_v12
+	path    string   // runner executable
+	env     []string // environment, which includes the visible devices
+
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	status  *StatusWriter
+	started time.Time
+
+	ready    chan struct{} // closed once the runner printed "ready"
+	initTime time.Duration // how long the runner took to be ready
+	exited   chan error    // receives the runner's exit
+
+	// saved is how much of the runner's start up the load that took it
+	// from the pool skipped
+	saved time.Duration
+}
+
+func startWarmRunner(backend, path string, env []string) (*warmRunner, error) {
+	w := &warmRunner{
+		backend: backend,
+		path:    path,
+		env:     env,
+		cmd:     exec.Command(path, "--warm"),
+		status:  NewStatusWriter(os.Stderr),
+		ready:   make(chan struct{}),
+		exited:  make(chan error, 1),
+	}
+
+	w.cmd.Env = env
+	w.cmd.Stderr = w.status
+	w.cmd.SysProcAttr = LlamaServerSysProcAttr
+
+	stdin, err := w.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.stdin = stdin
+
+	// stdout is read until "ready" and then passed through, like the
+	// output of other runners
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	w.cmd.Stdout = stdoutW
+
+	w.started = time.Now()
+	err = w.cmd.Start()
+	stdoutW.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, err
+	}
+
+	adjustOOMScore(w.cmd.Process.Pid)
+
+	go func() {
+		defer stdout.Close()
+		r := bufio.NewReader(stdout)
+		for {
+			line, err := r.ReadString('\n')
+			if line == "ready\n" {
+				w.initTime = time.Since(w.started)
+				close(w.ready)
+				break
+			}
+
+			os.Stdout.WriteString(line)
+			if err != nil {
+				return
+			}
+		}
+
+		io.Copy(os.Stdout, r) //nolint:errcheck
+	}()
+
+	go func() {
+		w.exited <- w.cmd.Wait()
+	}()
+
+	return w, nil
+}
+
+// load gives the runner the arguments to load a model with, after which it
+// runs like a runner started with them
+func (w *warmRunner) load(args []string) error {
+	bts, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.stdin.Write(append(bts, '\n')); err != nil {
+		return fmt.Errorf("warm runner exited: %w", err)
+	}
+
+	// The runner may have read the arguments and exited already, in which
+	// case reaping it closed stdin
+	if err := w.stdin.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// wait waits for the runner to exit, in place of cmd.Wait, which the pool
+// already calls to reap runners that exit before they're used
+func (w *warmRunner) wait() error {
+	return <-w.exited
+}
+
+// startedFor returns how long the runner has been starting up, up to the
+// time it was ready
+func (w *warmRunner) startedFor() time.Duration {
+	select {
+	case <-w.ready:
+		return w.initTime
+	default:
+		return time.Since(w.started)
+	}
+}
+
+// stop stops a runner that hasn't been given a model
+func (w *warmRunner) stop() {
+	// the runner exits once stdin is closed, but may not have started
+	// reading it yet
+	w.stdin.Close()
+	if err := w.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		slog.Debug("failed to stop warm runner", "pid", w.cmd.Process.Pid, "error", err)
+	}
+}
+
+// WarmPoolStat counts the loads of a model that used a runner from the warm
+// pool, those that had to start one, and the start up time the pool saved
+type WarmPoolStat struct {
+	Hits   uint64
+	Misses uint64
+	Saved  time.Duration
+}
+
+// warmPool keeps up to OLLAMA_RUNNER_WARM_POOL warm runners of each backend.
+// Runners are only used for loads with the same executable and environment,
+// so the pool is replenished with the runners of the loads that use it.
+type warmPool struct {
+	mu     sync.Mutex
+	idle   []*warmRunner
+	closed bool
+	stats  map[string]WarmPoolStat // model -> stats
+
+	size  func() uint
+	start func(backend, path string, env []string) (*warmRunner, error)
+}
+
+var runnerPool = &warmPool{
+	stats: make(map[string]WarmPoolStat),
+	size:  envconfig.RunnerWarmPool,
+	start: startWarmRunner,
+}
+
+// take removes and returns an idle runner of the backend at path with env,
+// or nil if there isn't one, counting the load of model as a hit or miss
+func (p *warmPool) take(model, path string, env []string) *warmRunner {
+	if p.size() == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stat := p.stats[model]
+	defer func() { p.stats[model] = stat }()
+
+	for i := 0; i < len(p.idle); i++ {
+		w := p.idle[i]
+		if w.path != path || !slices.Equal(w.env, env) {
+			continue
+		}
+
+		p.idle = slices.Delete(p.idle, i, i+1)
+		i--
+
+		select {
+		case err := <-w.exited:
+			slog.Debug("warm runner exited before it was used", "backend", w.backend, "error", err)
+			continue
+		default:
+		}
+
+		w.saved = w.startedFor()
+		stat.Hits++
+		stat.Saved += w.saved
+		return w
+	}
+
+	stat.Misses++
+	return nil
+}
+
+// replenish starts a runner of the backend at path with env, if the pool
+// has room for it. A backend with a full pool replaces its oldest runner
+// with a different environment, since loads have moved on from it.
+func (p *warmPool) replenish(backend, path string, env []string) {
+	size := int(p.size())
+	if size == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+
+	var same, others []int
+	for i, w := range p.idle {
+		if w.backend != backend {
+			continue
+		}
+
+		if w.path == path && slices.Equal(w.env, env) {
+			same = append(same, i)
+		} else {
+			others = append(others, i)
+		}
+	}
+
+	if len(same) >= size {
+		return
+	}
+
+	if len(same)+len(others) >= size {
+		i := others[0]
+		p.idle[i].stop()
+		p.idle = slices.Delete(p.idle, i, i+1)
+	}
+
+	w, err := p.start(backend, path, env)
+	if err != nil {
+		slog.Warn("failed to start warm runner", "backend", backend, "error", err)
+		return
+	}
+
+	slog.Debug("started warm runner", "backend", backend, "pid", w.cmd.Process.Pid)
+	p.idle = append(p.idle, w)
+}
+
+// close stops the idle runners, which aren't replenished until the pool is
+// opened again
+func (p *warmPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, w := range p.idle {
+		w.stop()
+	}
+	p.idle = nil
+}
+
+func (p *warmPool) open() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = false
+}
+
+// PrewarmRunners fills the warm pool with runners of the backend each
+// library of gpus would load models with, if OLLAMA_RUNNER_WARM_POOL is set
+func PrewarmRunners(gpus gpu.GpuInfoList) {
+	runnerPool.open()
+	if runnerPool.size() == 0 {
+		return
+	}
+
+	rDir, err := runners.Refresh(build.EmbedFS)
+	if err != nil {
+		slog.Warn("unable to prewarm runners", "error", err)
+		return
+	}
+
+	availableServers := runners.GetAvailableServers(rDir)
+	for _, gpus := range gpus.ByLibrary() {
+		var backend string
+		if gpus[0].Library == "cpu" {
+			backend = runners.ServerForCpu()
+		} else if servers := runners.ServersForGpu(gpus[0]); len(servers) > 0 {
+			backend = servers[0]
+		}
+
+		if lib := envconfig.LLMLibrary(); availableServers[lib] != "" {
+			backend = lib
+		}
+
+		dir := availableServers[backend]
+		if dir == "" {
+			continue
+		}
+
+		for range runnerPool.size() {
+			runnerPool.replenish(backend, runnerPath(dir), runnerEnv(dir, gpus))
+		}
+	}
+}
+
+// CloseWarmPool stops the runners in the warm pool
+func CloseWarmPool() {
+	runnerPool.close()
+}
+
+// WarmPoolStats returns the warm pool's counts for each model path
+func WarmPoolStats() map[string]WarmPoolStat {
+	runnerPool.mu.Lock()
+	defer runnerPool.mu.Unlock()
+	stats := make(map[string]WarmPoolStat, len(runnerPool.stats))
+	for model, stat := range runnerPool.stats {
+		stats[model] = stat
+	}
+
+	return stats
+}
@@ -0,0 +1,175 @@
+//go:build !windows
+
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRunner writes a script that behaves like a warm runner, writing the
+// arguments it's given to the file in $OUT
+func fakeRunner(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ollama_llama_server")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+const warmScript = `echo ready
+read -r args || exit 0
+printf '%s\n' "$args" > "$OUT"
+`
+
+func TestWarmRunner(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "args")
+	w, err := startWarmRunner("cpu", fakeRunner(t, warmScript), []string{"OUT=" + out})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-w.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the runner to be ready")
+	}
+
+	if err := w.load([]string{"--model", "a b.gguf", "--port", "1234"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	bts, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimSpace(string(bts)); got != `["--model","a b.gguf","--port","1234"]` {
+		t.Errorf("unexpected arguments %s", got)
+	}
+
+	if w.startedFor() != w.initTime || w.initTime <= 0 {
+		t.Errorf("expected the start up time to stop at ready, got %s and %s", w.startedFor(), w.initTime)
+	}
+}
+
+func TestWarmPool(t *testing.T) {
+	path := fakeRunner(t, warmScript)
+	size := uint(2)
+	p := &warmPool{
+		stats: make(map[string]WarmPoolStat),
+		size:  func() uint { return size },
+		start: startWarmRunner,
+	}
+	defer p.close()
+
+	a := []string{"CUDA_VISIBLE_DEVICES=0"}
+	b := []string{"CUDA_VISIBLE_DEVICES=1"}
+
+	for range 3 {
+		p.replenish("cuda_v12", path, a)
+	}
+
+	if len(p.idle) != 2 {
+		t.Fatalf("expected the pool to hold 2 runners, got %d", len(p.idle))
+	}
+
+	// a backend with a full pool makes room for the environment in demand
+	p.replenish("cuda_v12", path, b)
+	if len(p.idle) != 2 || !slices.Equal(p.idle[1].env, b) {
+		t.Fatalf("expected a runner to be replaced, got %d runners", len(p.idle))
+	}
+
+	// other backends have a pool of their own
+	p.replenish("cpu_avx2", path, nil)
+	if len(p.idle) != 3 {
+		t.Fatalf("expected 3 runners, got %d", len(p.idle))
+	}
+
+	if w := p.take("model-1", path, a); w == nil {
+		t.Fatal("expected a runner")
+	} else {
+		w.stop()
+	}
+
+	if w := p.take("model-1", path, a); w != nil {
+		t.Fatal("expected the pool to have no more runners")
+	}
+
+	if w := p.take("model-2", path, b); w == nil {
+		t.Fatal("expected a runner")
+	} else {
+		w.stop()
+	}
+
+	if s := p.stats["model-1"]; s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("expected a hit and a miss, got %+v", s)
+	}
+
+	if s := p.stats["model-2"]; s.Hits != 1 || s.Misses != 0 {
+		t.Errorf("expected a hit, got %+v", s)
+	}
+
+	p.close()
+	if len(p.idle) != 0 {
+		t.Errorf("expected the pool to be emptied, got %d runners", len(p.idle))
+	}
+
+	p.replenish("cpu_avx2", path, nil)
+	if len(p.idle) != 0 {
+		t.Errorf("expected a closed pool not to be replenished, got %d runners", len(p.idle))
+	}
+
+	size = 0
+	p.open()
+	p.replenish("cpu_avx2", path, nil)
+	if w := p.take("model-1", path, nil); w != nil || len(p.idle) != 0 {
+		t.Error("expected a disabled pool to be empty")
+	}
+
+	if s := p.stats["model-1"]; s.Misses != 1 {
+		t.Errorf("expected a disabled pool not to count misses, got %+v", s)
+	}
+}
+
+func TestWarmPoolExited(t *testing.T) {
+	path := fakeRunner(t, "exit 1\n")
+	p := &warmPool{
+		stats: make(map[string]WarmPoolStat),
+		size:  func() uint { return 1 },
+		start: startWarmRunner,
+	}
+	defer p.close()
+
+	p.replenish("cpu", path, nil)
+	if len(p.idle) != 1 {
+		t.Fatalf("expected a runner, got %d", len(p.idle))
+	}
+
+	// wait for the runner to be reaped without taking it from the exited
+	// channel
+	for i := 0; len(p.idle[0].exited) == 0; i++ {
+		if i > 500 {
+			t.Fatal("timeout waiting for the runner to exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if w := p.take("model", path, nil); w != nil {
+		t.Error("expected a runner that exited not to be used")
+	}
+
+	if len(p.idle) != 0 {
+		t.Errorf("expected the runner to be removed, got %d runners", len(p.idle))
+	}
+}
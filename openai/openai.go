@@ -3,23 +3,41 @@ package openai
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/types/model"
+	"github.com/ollama/ollama/version"
 )
 
+// ModelDigestKey is the context key under which handlers store the digest of
+// the model serving a request, from which the system fingerprint is derived
+const ModelDigestKey = "model_digest"
+
+// maxStop is the most stop sequences a request may set
+const maxStop = 4
+
 type Error struct {
 	Message string      `json:"message"`
 	Type    string      `json:"type"`
@@ -32,9 +50,15 @@ type ErrorResponse struct {
 }
 
 type Message struct {
-	Role      string     `json:"role"`
-	Content   any        `json:"content"`
-	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Role       string     `json:"role"`
+	Content    any        `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
+
+	// ReasoningContent is an extension, understood by some clients, with the
+	// thinking of reasoning models when it's returned separately
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 }
 
 type Choice struct {
@@ -66,23 +90,41 @@ type ResponseFormat struct {
 }
 
 type EmbedRequest struct {
-	Input any    `json:"input"`
-	Model string `json:"model"`
+	Input          any    `json:"input"`
+	Model          string `json:"model"`
+	Dimensions     int    `json:"dimensions,omitempty"`
+	EncodingFormat string `json:"encoding_format,omitempty"`
+
+	// KeepAlive and Options are extensions passed through to /api/embed, so
+	// health checks can embed with the no_refresh option
+	KeepAlive *api.Duration  `json:"keep_alive,omitempty"`
+	Options   map[string]any `json:"options,omitempty"`
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model               string          `json:"model"`
+	Messages            []Message       `json:"messages"`
+	Stream              bool            `json:"stream"`
+	N                   *int            `json:"n"`
+	MaxTokens           *int            `json:"max_tokens"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	Seed                *int            `json:"seed"`
+	Stop                any             `json:"stop"`
+	Temperature         *float64        `json:"temperature"`
+	FrequencyPenalty    *float64        `json:"frequency_penalty"`
+	PresencePenalty     *float64        `json:"presence_penalty"`
+	TopP                *float64        `json:"top_p"`
+	ResponseFormat      *ResponseFormat `json:"response_format"`
+	Tools               []api.Tool      `json:"tools"`
+
+	// Reasoning is an extension setting how the thinking of reasoning models
+	// is returned, as in the native API. It's returned as ReasoningContent if
+	// it's "separate".
+	Reasoning string `json:"reasoning"`
+
+	// MaxTime is an extension that stops generation once it has run this
+	// long, as in the native API
+	MaxTime *api.Duration `json:"max_time"`
 }
 
 type ChatCompletion struct {
@@ -110,6 +152,7 @@ type CompletionRequest struct {
 	Prompt           string   `json:"prompt"`
 	FrequencyPenalty float32  `json:"frequency_penalty"`
 	MaxTokens        *int     `json:"max_tokens"`
+	N                *int     `json:"n"`
 	PresencePenalty  float32  `json:"presence_penalty"`
 	Seed             *int     `json:"seed"`
 	Stop             any      `json:"stop"`
@@ -117,6 +160,10 @@ type CompletionRequest struct {
 	Temperature      *float32 `json:"temperature"`
 	TopP             float32  `json:"top_p"`
 	Suffix           string   `json:"suffix"`
+
+	// MaxTime is an extension that stops generation once it has run this
+	// long, as in the native API
+	MaxTime *api.Duration `json:"max_time"`
 }
 
 type Completion struct {
@@ -152,12 +199,18 @@ type Model struct {
 	Object  string `json:"object"`
 	Created int64  `json:"created"`
 	OwnedBy string `json:"owned_by"`
+
+	// Capabilities is an extension that lists what the model can be used
+	// for, as in /api/show
+	Capabilities []model.Capability `json:"capabilities,omitempty"`
 }
 
 type Embedding struct {
-	Object    string    `json:"object"`
-	Embedding []float32 `json:"embedding"`
-	Index     int       `json:"index"`
+	Object string `json:"object"`
+	// Embedding is either a list of floats, or a base64 string of
+	// little-endian float32 values when the base64 encoding format is used
+	Embedding any `json:"embedding"`
+	Index     int `json:"index"`
 }
 
 type ListCompletion struct {
@@ -179,18 +232,61 @@ type EmbeddingUsage struct {
 
 func NewError(code int, message string) ErrorResponse {
 	var etype string
-	switch code {
-	case http.StatusBadRequest:
-		etype = "invalid_request_error"
-	case http.StatusNotFound:
-		etype = "not_found_error"
+	switch {
+	case code == http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	case code >= http.StatusInternalServerError:
+		etype = "server_error"
 	default:
-		etype = "api_error"
+		etype = "invalid_request_error"
 	}
 
 	return ErrorResponse{Error{Type: etype, Message: message}}
 }
 
+// modelNotFound matches the errors the native API returns when the requested
+// model doesn't exist, as opposed to other missing resources such as sessions
+var modelNotFound = regexp.MustCompile(`^model ['"][^'"]*['"] not found`)
+
+// toError maps an error returned by the native API to the status code and
+// error body returned by the OpenAI API, so that clients can tell which
+// failures are worth retrying. param is the request field holding the input,
+// which is reported for context length errors.
+func toError(code int, message, param string) (int, ErrorResponse) {
+	withCode := func(code int, ecode string, param any) (int, ErrorResponse) {
+		resp := NewError(code, message)
+		resp.Error.Code = &ecode
+		resp.Error.Param = param
+		return code, resp
+	}
+
+	switch {
+	case code == http.StatusNotFound && modelNotFound.MatchString(message):
+		return withCode(http.StatusNotFound, "model_not_found", "model")
+	case code == http.StatusBadRequest && strings.Contains(message, "exceeds maximum context length"):
+		return withCode(http.StatusBadRequest, "context_length_exceeded", param)
+	case code == http.StatusUnauthorized:
+		return withCode(http.StatusUnauthorized, "invalid_api_key", nil)
+	case code == http.StatusServiceUnavailable && strings.Contains(message, "maximum pending requests exceeded"):
+		// the request queue is full, which OpenAI clients retry with backoff
+		return withCode(http.StatusTooManyRequests, "rate_limit_exceeded", nil)
+	}
+
+	return code, NewError(code, message)
+}
+
+// systemFingerprint identifies the model and server version that generated a
+// response. Outputs for the same seed are only expected to be reproducible
+// while the fingerprint is unchanged.
+func systemFingerprint(digest string) string {
+	if digest == "" {
+		return "fp_ollama"
+	}
+
+	h := sha256.Sum256([]byte(digest + version.Version))
+	return "fp_" + hex.EncodeToString(h[:])[:10]
+}
+
 func toolCallId() string {
 	const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
 	b := make([]byte, 8)
@@ -200,10 +296,10 @@ func toolCallId() string {
 	return "call_" + strings.ToLower(string(b))
 }
 
-func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
+func toChatCompletion(id, fingerprint string, r api.ChatResponse) ChatCompletion {
 	toolCalls := make([]ToolCall, len(r.Message.ToolCalls))
 	for i, tc := range r.Message.ToolCalls {
-		toolCalls[i].ID = toolCallId()
+		toolCalls[i].ID = cmp.Or(tc.ID, toolCallId())
 		toolCalls[i].Type = "function"
 		toolCalls[i].Function.Name = tc.Function.Name
 
@@ -221,18 +317,15 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Object:            "chat.completion",
 		Created:           r.CreatedAt.Unix(),
 		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
+		SystemFingerprint: fingerprint,
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:   r.Index,
+			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls, ReasoningContent: r.Message.Thinking},
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
 				}
-				if len(reason) > 0 {
-					return &reason
-				}
-				return nil
+				return finishReason(reason)
 			}(r.DoneReason),
 		}},
 		Usage: Usage{
@@ -243,42 +336,63 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	}
 }
 
-func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
+// toChatCompletions combines the responses for each choice of a request made
+// with n into a single completion. The prompt is only counted once.
+func toChatCompletions(id, fingerprint string, rs []api.ChatResponse) ChatCompletion {
+	c := toChatCompletion(id, fingerprint, rs[0])
+	for _, r := range rs[1:] {
+		cc := toChatCompletion(id, fingerprint, r)
+		c.Choices = append(c.Choices, cc.Choices...)
+		c.Usage.CompletionTokens += cc.Usage.CompletionTokens
+	}
+	c.Usage.TotalTokens = c.Usage.PromptTokens + c.Usage.CompletionTokens
+	return c
+}
+
+func toChunk(id, fingerprint string, r api.ChatResponse) ChatCompletionChunk {
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
 		Created:           time.Now().Unix(),
 		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
+		SystemFingerprint: fingerprint,
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content},
-			FinishReason: func(reason string) *string {
-				if len(reason) > 0 {
-					return &reason
-				}
-				return nil
-			}(r.DoneReason),
+			Index:        r.Index,
+			Delta:        Message{Role: "assistant", Content: r.Message.Content, ReasoningContent: r.Message.Thinking},
+			FinishReason: finishReason(r.DoneReason),
 		}},
 	}
 }
 
-func toCompletion(id string, r api.GenerateResponse) Completion {
+// finishReason maps the native done reason to the OpenAI finish reason, which
+// doesn't tell apart the stop, stop_regex and stop_token_ids options. Like
+// num_predict, the other reasons cut the response short, so they're reported
+// as length.
+func finishReason(reason string) *string {
+	switch reason {
+	case "", api.DoneReasonToolCalls:
+	case api.DoneReasonStop, api.DoneReasonStopString, api.DoneReasonStopRegex, api.DoneReasonStopToken:
+		reason = "stop"
+	default:
+		reason = "length"
+	}
+	if len(reason) > 0 {
+		return &reason
+	}
+	return nil
+}
+
+func toCompletion(id, fingerprint string, r api.GenerateResponse) Completion {
 	return Completion{
 		Id:                id,
 		Object:            "text_completion",
 		Created:           r.CreatedAt.Unix(),
 		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
+		SystemFingerprint: fingerprint,
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
-			FinishReason: func(reason string) *string {
-				if len(reason) > 0 {
-					return &reason
-				}
-				return nil
-			}(r.DoneReason),
+			Text:         r.Response,
+			Index:        r.Index,
+			FinishReason: finishReason(r.DoneReason),
 		}},
 		Usage: Usage{
 			PromptTokens:     r.PromptEvalCount,
@@ -288,22 +402,30 @@ func toCompletion(id string, r api.GenerateResponse) Completion {
 	}
 }
 
-func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
+// toCompletions combines the responses for each choice of a request made
+// with n into a single completion. The prompt is only counted once.
+func toCompletions(id, fingerprint string, rs []api.GenerateResponse) Completion {
+	c := toCompletion(id, fingerprint, rs[0])
+	for _, r := range rs[1:] {
+		cc := toCompletion(id, fingerprint, r)
+		c.Choices = append(c.Choices, cc.Choices...)
+		c.Usage.CompletionTokens += cc.Usage.CompletionTokens
+	}
+	c.Usage.TotalTokens = c.Usage.PromptTokens + c.Usage.CompletionTokens
+	return c
+}
+
+func toCompleteChunk(id, fingerprint string, r api.GenerateResponse) CompletionChunk {
 	return CompletionChunk{
 		Id:                id,
 		Object:            "text_completion",
 		Created:           time.Now().Unix(),
 		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
+		SystemFingerprint: fingerprint,
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
-			FinishReason: func(reason string) *string {
-				if len(reason) > 0 {
-					return &reason
-				}
-				return nil
-			}(r.DoneReason),
+			Text:         r.Response,
+			Index:        r.Index,
+			FinishReason: finishReason(r.DoneReason),
 		}},
 	}
 }
@@ -312,10 +434,11 @@ func toListCompletion(r api.ListResponse) ListCompletion {
 	var data []Model
 	for _, m := range r.Models {
 		data = append(data, Model{
-			Id:      m.Name,
-			Object:  "model",
-			Created: m.ModifiedAt.Unix(),
-			OwnedBy: model.ParseName(m.Name).Namespace,
+			Id:           m.Name,
+			Object:       "model",
+			Created:      m.ModifiedAt.Unix(),
+			OwnedBy:      model.ParseName(m.Name).Namespace,
+			Capabilities: m.Capabilities,
 		})
 	}
 
@@ -336,6 +459,14 @@ func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
 			})
 		}
 
+		for i, e := range r.EncodedEmbeddings {
+			data = append(data, Embedding{
+				Object:    "embedding",
+				Embedding: e.Data,
+				Index:     i,
+			})
+		}
+
 		return EmbeddingList{
 			Object: "list",
 			Data:   data,
@@ -352,20 +483,25 @@ func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
 
 func toModel(r api.ShowResponse, m string) Model {
 	return Model{
-		Id:      m,
-		Object:  "model",
-		Created: r.ModifiedAt.Unix(),
-		OwnedBy: model.ParseName(m).Namespace,
+		Id:           m,
+		Object:       "model",
+		Created:      r.ModifiedAt.Unix(),
+		OwnedBy:      model.ParseName(m).Namespace,
+		Capabilities: r.Capabilities,
 	}
 }
 
-func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
+func fromChatRequest(ctx context.Context, r ChatCompletionRequest) (*api.ChatRequest, error) {
 	var messages []api.Message
 	for _, msg := range r.Messages {
 		switch content := msg.Content.(type) {
 		case string:
-			messages = append(messages, api.Message{Role: msg.Role, Content: content})
+			messages = append(messages, api.Message{Role: msg.Role, Content: content, ToolCallID: msg.ToolCallID, Name: msg.Name})
 		case []any:
+			// content parts make up a single message, with text parts
+			// joined and images attached in the order they appear
+			var texts []string
+			var images []api.ImageData
 			for _, c := range content {
 				data, ok := c.(map[string]any)
 				if !ok {
@@ -377,8 +513,10 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 					if !ok {
 						return nil, errors.New("invalid message format")
 					}
-					messages = append(messages, api.Message{Role: msg.Role, Content: text})
+					texts = append(texts, text)
 				case "image_url":
+					// detail is accepted but ignored since images are
+					// always processed at the model's native resolution
 					var url string
 					if urlMap, ok := data["image_url"].(map[string]any); ok {
 						if url, ok = urlMap["url"].(string); !ok {
@@ -390,31 +528,17 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 						}
 					}
 
-					types := []string{"jpeg", "jpg", "png"}
-					valid := false
-					for _, t := range types {
-						prefix := "data:image/" + t + ";base64,"
-						if strings.HasPrefix(url, prefix) {
-							url = strings.TrimPrefix(url, prefix)
-							valid = true
-							break
-						}
-					}
-
-					if !valid {
-						return nil, errors.New("invalid image input")
-					}
-
-					img, err := base64.StdEncoding.DecodeString(url)
+					img, err := fromImageURL(ctx, url)
 					if err != nil {
-						return nil, errors.New("invalid message format")
+						return nil, err
 					}
 
-					messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{img}})
+					images = append(images, img)
 				default:
 					return nil, errors.New("invalid message format")
 				}
 			}
+			messages = append(messages, api.Message{Role: msg.Role, Content: strings.Join(texts, "\n"), Images: images})
 		default:
 			if msg.ToolCalls == nil {
 				return nil, fmt.Errorf("invalid message content type: %T", content)
@@ -422,6 +546,7 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 
 			toolCalls := make([]api.ToolCall, len(msg.ToolCalls))
 			for i, tc := range msg.ToolCalls {
+				toolCalls[i].ID = tc.ID
 				toolCalls[i].Function.Name = tc.Function.Name
 				err := json.Unmarshal([]byte(tc.Function.Arguments), &toolCalls[i].Function.Arguments)
 				if err != nil {
@@ -434,20 +559,19 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 
 	options := make(map[string]interface{})
 
-	switch stop := r.Stop.(type) {
-	case string:
-		options["stop"] = []string{stop}
-	case []any:
-		var stops []string
-		for _, s := range stop {
-			if str, ok := s.(string); ok {
-				stops = append(stops, str)
-			}
-		}
-		options["stop"] = stops
+	stop, err := fromStop(r.Stop)
+	if err != nil {
+		return nil, err
 	}
 
-	if r.MaxTokens != nil {
+	if stop != nil {
+		options["stop"] = stop
+	}
+
+	// newer clients send max_completion_tokens in place of max_tokens
+	if r.MaxCompletionTokens != nil {
+		options["num_predict"] = *r.MaxCompletionTokens
+	} else if r.MaxTokens != nil {
 		options["num_predict"] = *r.MaxTokens
 	}
 
@@ -480,32 +604,42 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		format = "json"
 	}
 
+	n, err := fromChoices(r.N)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > 1 && len(r.Tools) > 0 {
+		return nil, errors.New("n greater than 1 is not supported with tools")
+	}
+
+	// multiple choices are always streamed from the native API and collected
+	// by the writer if the client isn't streaming
+	stream := r.Stream || n > 1
+
 	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
+		Model:     r.Model,
+		Messages:  messages,
+		Format:    format,
+		Options:   options,
+		Stream:    &stream,
+		Tools:     r.Tools,
+		N:         n,
+		Reasoning: r.Reasoning,
+		MaxTime:   r.MaxTime,
 	}, nil
 }
 
 func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 	options := make(map[string]any)
 
-	switch stop := r.Stop.(type) {
-	case string:
-		options["stop"] = []string{stop}
-	case []any:
-		var stops []string
-		for _, s := range stop {
-			if str, ok := s.(string); ok {
-				stops = append(stops, str)
-			} else {
-				return api.GenerateRequest{}, fmt.Errorf("invalid type for 'stop' field: %T", s)
-			}
-		}
-		options["stop"] = stops
+	stop, err := fromStop(r.Stop)
+	if err != nil {
+		return api.GenerateRequest{}, err
+	}
+
+	if stop != nil {
+		options["stop"] = stop
 	}
 
 	if r.MaxTokens != nil {
@@ -532,28 +666,232 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	n, err := fromChoices(r.N)
+	if err != nil {
+		return api.GenerateRequest{}, err
+	}
+
+	// multiple choices are always streamed from the native API and collected
+	// by the writer if the client isn't streaming
+	stream := r.Stream || n > 1
+
 	return api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  r.Prompt,
 		Options: options,
-		Stream:  &r.Stream,
+		Stream:  &stream,
 		Suffix:  r.Suffix,
+		N:       n,
+		MaxTime: r.MaxTime,
 	}, nil
 }
 
+// imageTypes are the image formats accepted in content parts
+var imageTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// maxImageSize is the largest image that will be downloaded from a URL
+const maxImageSize = 20 << 20
+
+// fromImageURL returns the image referenced by an image_url content part,
+// which is either a base64 data URL or, if enabled, an http(s) URL to fetch
+func fromImageURL(ctx context.Context, url string) (api.ImageData, error) {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		if envconfig.Offline() {
+			return nil, errors.New("image URLs are not supported in offline mode, use a base64 data URL")
+		}
+
+		if !envconfig.FetchImages() {
+			return nil, errors.New("image URLs are not supported, use a base64 data URL or set OLLAMA_FETCH_IMAGES=1 on the server")
+		}
+
+		return fetchImage(ctx, url)
+	}
+
+	mediaType, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ";base64,")
+	if !ok || !strings.HasPrefix(url, "data:") {
+		return nil, errors.New("invalid image input")
+	}
+
+	// image/jpg isn't a registered type but is commonly sent
+	if mediaType == "image/jpg" {
+		mediaType = "image/jpeg"
+	}
+
+	if !slices.Contains(imageTypes, mediaType) {
+		return nil, fmt.Errorf("unsupported image type %q, expected one of %s", mediaType, strings.Join(imageTypes, ", "))
+	}
+
+	img, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errors.New("invalid message format")
+	}
+
+	return img, nil
+}
+
+// maxImageRedirects is how many redirects are followed fetching an image
+const maxImageRedirects = 5
+
+// imageAddrAllowed reports whether images may be fetched from addr. Images
+// are only fetched from public addresses, so clients can't use the server to
+// reach its loopback, private or link-local networks, such as the metadata
+// endpoints of cloud providers.
+var imageAddrAllowed = func(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddrs.Contains(addr)
+}
+
+// sharedAddrs are the carrier-grade NAT addresses, which aren't public
+// though IsPrivate doesn't report them
+var sharedAddrs = netip.MustParsePrefix("100.64.0.0/10")
+
+var errImageAddr = errors.New("image URLs must be on public addresses")
+
+// imageClient fetches image URLs. Addresses are checked as each connection
+// is made, after the host is resolved, so redirects and hosts resolving to
+// other addresses are held to the same rule. Requests don't go through a
+// proxy, which would connect to the image's host on the client's behalf.
+var imageClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addr, err := netip.ParseAddrPort(address)
+				if err != nil || !imageAddrAllowed(addr.Addr()) {
+					return fmt.Errorf("%w, not %s", errImageAddr, address)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxImageRedirects)
+		}
+
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("unsupported redirect to %q", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+func fetchImage(ctx context.Context, url string) (api.ImageData, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image url: %w", err)
+	}
+
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch image: %s", resp.Status)
+	}
+
+	img, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+
+	if len(img) > maxImageSize {
+		return nil, fmt.Errorf("image exceeds the maximum size of %d MB", maxImageSize>>20)
+	}
+
+	// the response's content type isn't trusted since servers often send a
+	// generic type for images
+	if contentType := http.DetectContentType(img); !slices.Contains(imageTypes, contentType) {
+		return nil, fmt.Errorf("unsupported image type %q, expected one of %s", contentType, strings.Join(imageTypes, ", "))
+	}
+
+	return img, nil
+}
+
+// fromStop converts the stop field, which is either a single sequence or a
+// list of up to four
+func fromStop(stop any) ([]string, error) {
+	switch stop := stop.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{stop}, nil
+	case []any:
+		if len(stop) > maxStop {
+			return nil, fmt.Errorf("%d stop sequences is more than the maximum of %d - 'stop'", len(stop), maxStop)
+		}
+
+		stops := make([]string, 0, len(stop))
+		for _, s := range stop {
+			str, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid type for 'stop' field: %T", s)
+			}
+			stops = append(stops, str)
+		}
+		return stops, nil
+	default:
+		return nil, fmt.Errorf("invalid type for 'stop' field: %T", stop)
+	}
+}
+
+// fromChoices validates the number of choices requested with n, which
+// defaults to one
+func fromChoices(n *int) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+
+	if *n < 1 {
+		return 0, fmt.Errorf("%d is less than the minimum of 1 - 'n'", *n)
+	}
+
+	return *n, nil
+}
+
 type BaseWriter struct {
 	gin.ResponseWriter
+
+	// param is the request field holding the input, used in errors
+	param string
+
+	// ctx is the request context, which holds the model digest once the
+	// handler has scheduled the model
+	ctx *gin.Context
 }
 
 type ChatWriter struct {
 	stream bool
 	id     string
+
+	// n is the number of choices requested and done the number that have
+	// finished. choices collects each choice when n is greater than one and
+	// the client isn't streaming.
+	n       int
+	done    int
+	choices []api.ChatResponse
+
 	BaseWriter
 }
 
 type CompleteWriter struct {
 	stream bool
 	id     string
+
+	// n is the number of choices requested and done the number that have
+	// finished. choices collects each choice when n is greater than one and
+	// the client isn't streaming.
+	n       int
+	done    int
+	choices []api.GenerateResponse
+
 	BaseWriter
 }
 
@@ -571,6 +909,15 @@ type EmbedWriter struct {
 	model string
 }
 
+// fingerprint returns the system fingerprint of the model serving the request
+func (w *BaseWriter) fingerprint() string {
+	if w.ctx == nil {
+		return systemFingerprint("")
+	}
+
+	return systemFingerprint(w.ctx.GetString(ModelDigestKey))
+}
+
 func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
 	var serr api.StatusError
 	err := json.Unmarshal(data, &serr)
@@ -578,8 +925,10 @@ func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
 		return 0, err
 	}
 
+	code, resp := toError(code, serr.Error(), w.param)
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(http.StatusInternalServerError, serr.Error()))
+	w.ResponseWriter.WriteHeader(code)
+	err = json.NewEncoder(w.ResponseWriter).Encode(resp)
 	if err != nil {
 		return 0, err
 	}
@@ -587,6 +936,38 @@ func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
 	return len(data), nil
 }
 
+// streamError returns the error in a streamed response chunk, if any
+func streamError(data []byte) string {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return ""
+	}
+
+	return serr.ErrorMessage
+}
+
+// writeStreamError reports an error that occurred after a response started
+// streaming as a final event followed by [DONE], as OpenAI does, since the
+// status code has already been sent
+func (w *BaseWriter) writeStreamError(data []byte, message string) (int, error) {
+	_, resp := toError(http.StatusInternalServerError, message, w.param)
+	d, err := json.Marshal(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	if _, err := w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d))); err != nil {
+		return 0, err
+	}
+
+	if _, err := w.ResponseWriter.Write([]byte("data: [DONE]\n\n")); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
 func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 	var chatResponse api.ChatResponse
 	err := json.Unmarshal(data, &chatResponse)
@@ -596,7 +977,18 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 
 	// chat chunk
 	if w.stream {
-		d, err := json.Marshal(toChunk(w.id, chatResponse))
+		// an error in any choice ends the stream, and the other choices may
+		// still be generating when it does
+		if w.done >= w.n {
+			return len(data), nil
+		}
+
+		if message := streamError(data); message != "" {
+			w.done = w.n
+			return w.writeStreamError(data, message)
+		}
+
+		d, err := json.Marshal(toChunk(w.id, w.fingerprint(), chatResponse))
 		if err != nil {
 			return 0, err
 		}
@@ -608,6 +1000,10 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		}
 
 		if chatResponse.Done {
+			w.done++
+		}
+
+		if chatResponse.Done && w.done >= w.n {
 			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
 			if err != nil {
 				return 0, err
@@ -617,9 +1013,13 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		return len(data), nil
 	}
 
+	if w.choices != nil {
+		return w.collect(data, chatResponse)
+	}
+
 	// chat completion
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toChatCompletion(w.id, chatResponse))
+	err = json.NewEncoder(w.ResponseWriter).Encode(toChatCompletion(w.id, w.fingerprint(), chatResponse))
 	if err != nil {
 		return 0, err
 	}
@@ -627,6 +1027,46 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// collect appends a streamed response to its choice and writes a single
+// completion once every choice is done. An error in any choice fails the
+// whole request, as nothing has been sent to the client yet.
+func (w *ChatWriter) collect(data []byte, r api.ChatResponse) (int, error) {
+	if w.done >= w.n {
+		return len(data), nil
+	}
+
+	if message := streamError(data); message != "" {
+		w.done = w.n
+		return w.writeError(http.StatusInternalServerError, data)
+	}
+
+	if r.Index < 0 || r.Index >= len(w.choices) {
+		return 0, fmt.Errorf("unexpected choice index %d", r.Index)
+	}
+
+	content := w.choices[r.Index].Message.Content + r.Message.Content
+	thinking := w.choices[r.Index].Message.Thinking + r.Message.Thinking
+	w.choices[r.Index] = r
+	w.choices[r.Index].Message.Content = content
+	w.choices[r.Index].Message.Thinking = thinking
+
+	if !r.Done {
+		return len(data), nil
+	}
+
+	w.done++
+	if w.done < w.n {
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(toChatCompletions(w.id, w.fingerprint(), w.choices)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
 func (w *ChatWriter) Write(data []byte) (int, error) {
 	code := w.ResponseWriter.Status()
 	if code != http.StatusOK {
@@ -636,6 +1076,16 @@ func (w *ChatWriter) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
+// Flush is a no-op while choices are being collected so that the status
+// isn't sent before it's known whether every choice succeeded
+func (w *ChatWriter) Flush() {
+	if w.choices != nil && w.done < w.n {
+		return
+	}
+
+	w.ResponseWriter.Flush()
+}
+
 func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 	var generateResponse api.GenerateResponse
 	err := json.Unmarshal(data, &generateResponse)
@@ -645,7 +1095,18 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 
 	// completion chunk
 	if w.stream {
-		d, err := json.Marshal(toCompleteChunk(w.id, generateResponse))
+		// an error in any choice ends the stream, and the other choices may
+		// still be generating when it does
+		if w.done >= w.n {
+			return len(data), nil
+		}
+
+		if message := streamError(data); message != "" {
+			w.done = w.n
+			return w.writeStreamError(data, message)
+		}
+
+		d, err := json.Marshal(toCompleteChunk(w.id, w.fingerprint(), generateResponse))
 		if err != nil {
 			return 0, err
 		}
@@ -657,6 +1118,10 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		}
 
 		if generateResponse.Done {
+			w.done++
+		}
+
+		if generateResponse.Done && w.done >= w.n {
 			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
 			if err != nil {
 				return 0, err
@@ -666,9 +1131,13 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		return len(data), nil
 	}
 
+	if w.choices != nil {
+		return w.collect(data, generateResponse)
+	}
+
 	// completion
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toCompletion(w.id, generateResponse))
+	err = json.NewEncoder(w.ResponseWriter).Encode(toCompletion(w.id, w.fingerprint(), generateResponse))
 	if err != nil {
 		return 0, err
 	}
@@ -676,6 +1145,44 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// collect appends a streamed response to its choice and writes a single
+// completion once every choice is done. An error in any choice fails the
+// whole request, as nothing has been sent to the client yet.
+func (w *CompleteWriter) collect(data []byte, r api.GenerateResponse) (int, error) {
+	if w.done >= w.n {
+		return len(data), nil
+	}
+
+	if message := streamError(data); message != "" {
+		w.done = w.n
+		return w.writeError(http.StatusInternalServerError, data)
+	}
+
+	if r.Index < 0 || r.Index >= len(w.choices) {
+		return 0, fmt.Errorf("unexpected choice index %d", r.Index)
+	}
+
+	text := w.choices[r.Index].Response + r.Response
+	w.choices[r.Index] = r
+	w.choices[r.Index].Response = text
+
+	if !r.Done {
+		return len(data), nil
+	}
+
+	w.done++
+	if w.done < w.n {
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(toCompletions(w.id, w.fingerprint(), w.choices)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
 func (w *CompleteWriter) Write(data []byte) (int, error) {
 	code := w.ResponseWriter.Status()
 	if code != http.StatusOK {
@@ -685,6 +1192,16 @@ func (w *CompleteWriter) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
+// Flush is a no-op while choices are being collected so that the status
+// isn't sent before it's known whether every choice succeeded
+func (w *CompleteWriter) Flush() {
+	if w.choices != nil && w.done < w.n {
+		return
+	}
+
+	w.ResponseWriter.Flush()
+}
+
 func (w *ListWriter) writeResponse(data []byte) (int, error) {
 	var listResponse api.ListResponse
 	err := json.Unmarshal(data, &listResponse)
@@ -775,8 +1292,16 @@ func ListMiddleware() gin.HandlerFunc {
 
 func RetrieveMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// the route uses a wildcard so that names with a namespace or host,
+		// which contain slashes, can be retrieved
+		name := strings.TrimPrefix(c.Param("model"), "/")
+		if name == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, "model is required"))
+			return
+		}
+
 		var b bytes.Buffer
-		if err := json.NewEncoder(&b).Encode(api.ShowRequest{Name: c.Param("model")}); err != nil {
+		if err := json.NewEncoder(&b).Encode(api.ShowRequest{Name: name}); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
 			return
 		}
@@ -786,7 +1311,7 @@ func RetrieveMiddleware() gin.HandlerFunc {
 		// response writer
 		w := &RetrieveWriter{
 			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
-			model:      c.Param("model"),
+			model:      name,
 		}
 
 		c.Writer = w
@@ -819,9 +1344,14 @@ func CompletionsMiddleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &CompleteWriter{
-			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer, param: "prompt", ctx: c},
 			stream:     req.Stream,
 			id:         fmt.Sprintf("cmpl-%d", rand.Intn(999)),
+			n:          max(genReq.N, 1),
+		}
+
+		if w.n > 1 && !w.stream {
+			w.choices = make([]api.GenerateResponse, w.n)
 		}
 
 		c.Writer = w
@@ -852,8 +1382,13 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "invalid encoding_format, expected float or base64"))
+			return
+		}
+
 		var b bytes.Buffer
-		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input}); err != nil {
+		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input, Dimensions: req.Dimensions, EncodingFormat: req.EncodingFormat, KeepAlive: req.KeepAlive, Options: req.Options}); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
 			return
 		}
@@ -861,7 +1396,7 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &EmbedWriter{
-			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer, param: "input"},
 			model:      req.Model,
 		}
 
@@ -887,7 +1422,7 @@ func ChatMiddleware() gin.HandlerFunc {
 
 		var b bytes.Buffer
 
-		chatReq, err := fromChatRequest(req)
+		chatReq, err := fromChatRequest(c.Request.Context(), req)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
 			return
@@ -901,9 +1436,14 @@ func ChatMiddleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &ChatWriter{
-			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer, param: "messages", ctx: c},
 			stream:     req.Stream,
 			id:         fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			n:          max(chatReq.N, 1),
+		}
+
+		if w.n > 1 && !w.stream {
+			w.choices = make([]api.ChatResponse, w.n)
 		}
 
 		c.Writer = w
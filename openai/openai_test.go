@@ -2,19 +2,28 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
 )
 
 const (
@@ -111,6 +120,56 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "chat handler with reasoning",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"reasoning": "separate"
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream:    &False,
+				Reasoning: "separate",
+			},
+		},
+		{
+			name: "chat handler with max_time",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"max_time": "250ms"
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream:  &False,
+				MaxTime: &api.Duration{Duration: 250 * time.Millisecond},
+			},
+		},
 		{
 			name: "chat handler with image content",
 			body: `{
@@ -139,9 +198,6 @@ func TestChatMiddleware(t *testing.T) {
 					{
 						Role:    "user",
 						Content: "Hello",
-					},
-					{
-						Role: "user",
 						Images: []api.ImageData{
 							func() []byte {
 								img, _ := base64.StdEncoding.DecodeString(image)
@@ -163,7 +219,8 @@ func TestChatMiddleware(t *testing.T) {
 				"model": "test-model",
 				"messages": [
 					{"role": "user", "content": "What's the weather like in Paris Today?"},
-					{"role": "assistant", "tool_calls": [{"id": "id", "type": "function", "function": {"name": "get_current_weather", "arguments": "{\"location\": \"Paris, France\", \"format\": \"celsius\"}"}}]}
+					{"role": "assistant", "tool_calls": [{"id": "id", "type": "function", "function": {"name": "get_current_weather", "arguments": "{\"location\": \"Paris, France\", \"format\": \"celsius\"}"}}]},
+					{"role": "tool", "tool_call_id": "id", "content": "22"}
 				]
 			}`,
 			req: api.ChatRequest{
@@ -177,6 +234,7 @@ func TestChatMiddleware(t *testing.T) {
 						Role: "assistant",
 						ToolCalls: []api.ToolCall{
 							{
+								ID: "id",
 								Function: api.ToolCallFunction{
 									Name: "get_current_weather",
 									Arguments: map[string]interface{}{
@@ -187,6 +245,11 @@ func TestChatMiddleware(t *testing.T) {
 							},
 						},
 					},
+					{
+						Role:       "tool",
+						Content:    "22",
+						ToolCallID: "id",
+					},
 				},
 				Options: map[string]any{
 					"temperature": 1.0,
@@ -195,7 +258,48 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
-
+		{
+			name: "chat handler with n",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"n": 2
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &True,
+				N:      2,
+			},
+		},
+		{
+			name: "chat handler with n and tools",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"tools": [{"type": "function", "function": {"name": "get_current_weather"}}],
+				"n": 2
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "n greater than 1 is not supported with tools",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "chat handler error forwarding",
 			body: `{
@@ -283,6 +387,40 @@ func TestCompletionsMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "completions handler with n",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"n": 3
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream: &True,
+				N:      3,
+			},
+		},
+		{
+			name: "completions handler invalid n",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"n": 0
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "0 is less than the minimum of 1 - 'n'",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "completions handler error forwarding",
 			body: `{
@@ -371,6 +509,46 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 				Model: "test-model",
 			},
 		},
+		{
+			name: "embed handler dimensions",
+			body: `{
+				"input": "Hello",
+				"model": "test-model",
+				"dimensions": 256
+			}`,
+			req: api.EmbedRequest{
+				Input:      "Hello",
+				Model:      "test-model",
+				Dimensions: 256,
+			},
+		},
+		{
+			name: "embed handler base64 encoding",
+			body: `{
+				"input": "Hello",
+				"model": "test-model",
+				"encoding_format": "base64"
+			}`,
+			req: api.EmbedRequest{
+				Input:          "Hello",
+				Model:          "test-model",
+				EncodingFormat: "base64",
+			},
+		},
+		{
+			name: "embed handler invalid encoding",
+			body: `{
+				"input": "Hello",
+				"model": "test-model",
+				"encoding_format": "int8"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid encoding_format, expected float or base64",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "embed handler error forwarding",
 			body: `{
@@ -422,6 +600,41 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 	}
 }
 
+func TestEmbeddingsMiddlewareUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(EmbeddingsMiddleware())
+	router.Handle(http.MethodPost, "/api/embed", func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.EmbedResponse{
+			Model:            "test-model",
+			Embeddings:       [][]float32{{0.1}, {0.2}},
+			PromptEvalCount:  10,
+			PromptEvalCounts: []int{8, 2},
+			Truncated:        []bool{true, false},
+		})
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/embed", strings.NewReader(`{"input": ["Hello", "World"], "model": "test-model"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var list EmbeddingList
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	// usage counts the tokens embedded after truncation
+	if list.Usage.PromptTokens != 10 || list.Usage.TotalTokens != 10 {
+		t.Errorf("expected 10 prompt and total tokens, got %+v", list.Usage)
+	}
+
+	if len(list.Data) != 2 || list.Data[1].Index != 1 {
+		t.Errorf("expected embeddings in input order, got %+v", list.Data)
+	}
+}
+
 func TestListMiddleware(t *testing.T) {
 	type testCase struct {
 		name     string
@@ -436,8 +649,9 @@ func TestListMiddleware(t *testing.T) {
 				c.JSON(http.StatusOK, api.ListResponse{
 					Models: []api.ListModelResponse{
 						{
-							Name:       "test-model",
-							ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
+							Name:         "test-model",
+							ModifiedAt:   time.Unix(int64(1686935002), 0).UTC(),
+							Capabilities: []model.Capability{model.CapabilityCompletion, model.CapabilityTools},
 						},
 					},
 				})
@@ -449,7 +663,8 @@ func TestListMiddleware(t *testing.T) {
 						"id": "test-model",
 						"object": "model",
 						"created": 1686935002,
-						"owned_by": "library"
+						"owned_by": "library",
+						"capabilities": ["completion", "tools"]
 					}
 				]
 			}`,
@@ -497,6 +712,7 @@ func TestListMiddleware(t *testing.T) {
 func TestRetrieveMiddleware(t *testing.T) {
 	type testCase struct {
 		name     string
+		path     string
 		endpoint func(c *gin.Context)
 		resp     string
 	}
@@ -504,6 +720,7 @@ func TestRetrieveMiddleware(t *testing.T) {
 	testCases := []testCase{
 		{
 			name: "retrieve handler",
+			path: "/api/show/test-model",
 			endpoint: func(c *gin.Context) {
 				c.JSON(http.StatusOK, api.ShowResponse{
 					ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
@@ -516,17 +733,54 @@ func TestRetrieveMiddleware(t *testing.T) {
 				"owned_by":"library"}
 			`,
 		},
+		{
+			name: "retrieve handler namespace and tag",
+			path: "/api/show/myorg/test-model:q4_0",
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusOK, api.ShowResponse{
+					ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
+				})
+			},
+			resp: `{
+				"id":"myorg/test-model:q4_0",
+				"object":"model",
+				"created":1686935002,
+				"owned_by":"myorg"}
+			`,
+		},
+		{
+			name: "retrieve handler escaped name",
+			path: "/api/show/myorg%2Ftest-model%3Aq4_0",
+			endpoint: func(c *gin.Context) {
+				var req api.ShowRequest
+				if err := c.ShouldBindJSON(&req); err != nil || req.Name != "myorg/test-model:q4_0" {
+					c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Name)})
+					return
+				}
+
+				c.JSON(http.StatusOK, api.ShowResponse{
+					ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
+				})
+			},
+			resp: `{
+				"id":"myorg/test-model:q4_0",
+				"object":"model",
+				"created":1686935002,
+				"owned_by":"myorg"}
+			`,
+		},
 		{
 			name: "retrieve handler error forwarding",
+			path: "/api/show/test-model",
 			endpoint: func(c *gin.Context) {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "model not found"})
+				c.JSON(http.StatusNotFound, gin.H{"error": "model 'test-model' not found"})
 			},
 			resp: `{
 				"error": {
-				  "code": null,
-				  "message": "model not found",
-				  "param": null,
-				  "type": "api_error"
+				  "code": "model_not_found",
+				  "message": "model 'test-model' not found",
+				  "param": "model",
+				  "type": "invalid_request_error"
 				}
 			}`,
 		},
@@ -537,8 +791,8 @@ func TestRetrieveMiddleware(t *testing.T) {
 	for _, tc := range testCases {
 		router := gin.New()
 		router.Use(RetrieveMiddleware())
-		router.Handle(http.MethodGet, "/api/show/:model", tc.endpoint)
-		req, _ := http.NewRequest(http.MethodGet, "/api/show/test-model", nil)
+		router.Handle(http.MethodGet, "/api/show/*model", tc.endpoint)
+		req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
 
 		resp := httptest.NewRecorder()
 		router.ServeHTTP(resp, req)
@@ -555,7 +809,763 @@ func TestRetrieveMiddleware(t *testing.T) {
 		}
 
 		if !reflect.DeepEqual(expected, actual) {
-			t.Errorf("responses did not match\nExpected: %+v\nActual: %+v", expected, actual)
+			t.Errorf("%s: responses did not match\nExpected: %+v\nActual: %+v", tc.name, expected, actual)
+		}
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	// ids and timestamps in streamed chunks vary between runs
+	idPattern := regexp.MustCompile(`"id":"[a-z]+-\d+"`)
+	createdPattern := regexp.MustCompile(`"created":\d+`)
+
+	// streamError streams chunks followed by an error, as the native API
+	// does when generation fails after the response has started
+	streamError := func(message string, chunks ...any) func(c *gin.Context) {
+		return func(c *gin.Context) {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(http.StatusOK)
+			for _, chunk := range append(chunks, gin.H{"error": message}) {
+				b, err := json.Marshal(chunk)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := c.Writer.Write(append(b, '\n')); err != nil {
+					t.Fatal(err)
+				}
+			}
 		}
 	}
+
+	cases := []struct {
+		name       string
+		middleware gin.HandlerFunc
+		body       string
+		endpoint   func(c *gin.Context)
+		status     int
+	}{
+		{
+			name:       "model_not_found",
+			middleware: ChatMiddleware(),
+			body:       `{"model": "missing", "messages": [{"role": "user", "content": "Hello"}]}`,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusNotFound, gin.H{"error": `model "missing" not found, try pulling it first`})
+			},
+			status: http.StatusNotFound,
+		},
+		{
+			name:       "not_found",
+			middleware: ChatMiddleware(),
+			body:       `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}]}`,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			},
+			status: http.StatusNotFound,
+		},
+		{
+			name:       "context_length_exceeded",
+			middleware: EmbeddingsMiddleware(),
+			body:       `{"model": "test-model", "input": ["Hello"]}`,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length of 8 tokens for inputs at index 0"})
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:       "queue_full",
+			middleware: ChatMiddleware(),
+			body:       `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}]}`,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server busy, please try again.  maximum pending requests exceeded"})
+			},
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:       "unauthorized",
+			middleware: CompletionsMiddleware(),
+			body:       `{"model": "test-model", "prompt": "Hello"}`,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:       "runner_crash",
+			middleware: CompletionsMiddleware(),
+			body:       `{"model": "test-model", "prompt": "Hello"}`,
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "llama runner process has terminated: signal: killed"})
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:       "invalid_request",
+			middleware: ChatMiddleware(),
+			body:       `{"model": "test-model", "messages": []}`,
+			status:     http.StatusBadRequest,
+		},
+		{
+			name:       "chat_stream_error",
+			middleware: ChatMiddleware(),
+			body:       `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "stream": true}`,
+			endpoint: streamError("llama runner process has terminated: signal: killed",
+				api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi"}},
+			),
+			status: http.StatusOK,
+		},
+		{
+			name:       "completion_stream_error",
+			middleware: CompletionsMiddleware(),
+			body:       `{"model": "test-model", "prompt": "Hello", "stream": true}`,
+			endpoint: streamError("llama runner process has terminated: signal: killed",
+				api.GenerateResponse{Model: "test-model", Response: "Hi"},
+			),
+			status: http.StatusOK,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := tt.endpoint
+			if endpoint == nil {
+				endpoint = func(c *gin.Context) {
+					t.Fatal("request should not reach the endpoint")
+				}
+			}
+
+			router := gin.New()
+			router.Use(tt.middleware)
+			router.Handle(http.MethodPost, "/", endpoint)
+
+			req, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if resp.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.Code)
+			}
+
+			expect, err := os.ReadFile(filepath.Join("testdata", "errors", tt.name+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := idPattern.ReplaceAllString(resp.Body.String(), `"id":"ID"`)
+			actual = createdPattern.ReplaceAllString(actual, `"created":0`)
+			if diff := cmp.Diff(string(expect), actual); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChoices(t *testing.T) {
+	// stream interleaves the responses for each choice as the native API does
+	// when a request is made with n, flushing after each like c.Stream
+	stream := func(chunks ...any) func(c *gin.Context) {
+		return func(c *gin.Context) {
+			c.Header("Content-Type", "application/x-ndjson")
+			for _, chunk := range chunks {
+				b, err := json.Marshal(chunk)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := c.Writer.Write(append(b, '\n')); err != nil {
+					t.Fatal(err)
+				}
+				c.Writer.Flush()
+			}
+		}
+	}
+
+	chat := func(index int, content string, done bool) api.ChatResponse {
+		r := api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: content}, Index: index, Done: done}
+		if done {
+			r.DoneReason = "stop"
+			r.PromptEvalCount = 5
+			r.EvalCount = 2
+		}
+		return r
+	}
+
+	generate := func(index int, response string, done bool) api.GenerateResponse {
+		r := api.GenerateResponse{Model: "test-model", Response: response, Index: index, Done: done}
+		if done {
+			r.DoneReason = "stop"
+			r.PromptEvalCount = 5
+			r.EvalCount = 2
+		}
+		return r
+	}
+
+	serve := func(t *testing.T, middleware gin.HandlerFunc, body string, endpoint func(c *gin.Context)) *httptest.ResponseRecorder {
+		t.Helper()
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(middleware)
+		router.Handle(http.MethodPost, "/", endpoint)
+
+		req, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("chat", func(t *testing.T) {
+		resp := serve(t, ChatMiddleware(), `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "n": 2}`,
+			stream(chat(1, "Hey", false), chat(0, "Hi", false), chat(0, " there", true), chat(1, " you", true)))
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+		}
+
+		if ct := resp.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected application/json, got %s", ct)
+		}
+
+		var completion ChatCompletion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+
+		stop := "stop"
+		expectChoices := []Choice{
+			{Index: 0, Message: Message{Role: "assistant", Content: "Hi there"}, FinishReason: &stop},
+			{Index: 1, Message: Message{Role: "assistant", Content: "Hey you"}, FinishReason: &stop},
+		}
+		if diff := cmp.Diff(expectChoices, completion.Choices); diff != "" {
+			t.Errorf("choices mismatch (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(Usage{PromptTokens: 5, CompletionTokens: 4, TotalTokens: 9}, completion.Usage); diff != "" {
+			t.Errorf("usage mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("chat stream", func(t *testing.T) {
+		resp := serve(t, ChatMiddleware(), `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "n": 2, "stream": true}`,
+			stream(chat(1, "Hey", false), chat(0, "Hi", true), chat(1, " you", true)))
+
+		var indexes []int
+		var done int
+		for _, event := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+			data := strings.TrimPrefix(event, "data: ")
+			if data == "[DONE]" {
+				done++
+				continue
+			}
+
+			if done > 0 {
+				t.Fatalf("chunk after [DONE]: %s", data)
+			}
+
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				t.Fatal(err)
+			}
+			indexes = append(indexes, chunk.Choices[0].Index)
+		}
+
+		if diff := cmp.Diff([]int{1, 0, 1}, indexes); diff != "" {
+			t.Errorf("indexes mismatch (-want +got):\n%s", diff)
+		}
+
+		if done != 1 {
+			t.Errorf("expected a single [DONE], got %d", done)
+		}
+	})
+
+	t.Run("chat stream error", func(t *testing.T) {
+		resp := serve(t, ChatMiddleware(), `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "n": 2, "stream": true}`,
+			stream(chat(0, "Hi", true), gin.H{"error": "llama runner process has terminated"}, chat(1, "Hey", true)))
+
+		events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+		if len(events) != 3 {
+			t.Fatalf("expected a chunk, an error and [DONE], got %q", events)
+		}
+
+		var errResp ErrorResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(events[1], "data: ")), &errResp); err != nil {
+			t.Fatal(err)
+		}
+
+		if errResp.Error.Message != "llama runner process has terminated" {
+			t.Errorf("unexpected error %q", errResp.Error.Message)
+		}
+
+		if events[2] != "data: [DONE]" {
+			t.Errorf("expected the stream to end with [DONE], got %q", events[2])
+		}
+	})
+
+	t.Run("chat error", func(t *testing.T) {
+		resp := serve(t, ChatMiddleware(), `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "n": 2}`,
+			stream(chat(0, "Hi", true), gin.H{"error": "llama runner process has terminated"}, chat(1, "Hey", true)))
+
+		if resp.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d: %s", resp.Code, resp.Body.String())
+		}
+
+		var errResp ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			t.Fatal(err)
+		}
+
+		if errResp.Error.Message != "llama runner process has terminated" {
+			t.Errorf("unexpected error %q", errResp.Error.Message)
+		}
+	})
+
+	t.Run("completions", func(t *testing.T) {
+		resp := serve(t, CompletionsMiddleware(), `{"model": "test-model", "prompt": "Hello", "n": 3}`,
+			stream(generate(2, "c", true), generate(0, "a", false), generate(1, "b", true), generate(0, "a", true)))
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+		}
+
+		var completion Completion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+
+		stop := "stop"
+		expectChoices := []CompleteChunkChoice{
+			{Index: 0, Text: "aa", FinishReason: &stop},
+			{Index: 1, Text: "b", FinishReason: &stop},
+			{Index: 2, Text: "c", FinishReason: &stop},
+		}
+		if diff := cmp.Diff(expectChoices, completion.Choices); diff != "" {
+			t.Errorf("choices mismatch (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(Usage{PromptTokens: 5, CompletionTokens: 6, TotalTokens: 11}, completion.Usage); diff != "" {
+			t.Errorf("usage mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestFromRequestOptions(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+
+	cases := []struct {
+		name   string
+		chat   ChatCompletionRequest
+		expect map[string]any
+		err    string
+	}{
+		{
+			name:   "max_tokens",
+			chat:   ChatCompletionRequest{MaxTokens: intPtr(10)},
+			expect: map[string]any{"num_predict": 10},
+		},
+		{
+			name:   "max_completion_tokens",
+			chat:   ChatCompletionRequest{MaxCompletionTokens: intPtr(20)},
+			expect: map[string]any{"num_predict": 20},
+		},
+		{
+			name:   "max_completion_tokens preferred",
+			chat:   ChatCompletionRequest{MaxTokens: intPtr(10), MaxCompletionTokens: intPtr(20)},
+			expect: map[string]any{"num_predict": 20},
+		},
+		{
+			name:   "seed",
+			chat:   ChatCompletionRequest{Seed: intPtr(42)},
+			expect: map[string]any{"seed": 42},
+		},
+		{
+			name:   "zero seed",
+			chat:   ChatCompletionRequest{Seed: intPtr(0)},
+			expect: map[string]any{"seed": 0},
+		},
+		{
+			name:   "stop string",
+			chat:   ChatCompletionRequest{Stop: "\n"},
+			expect: map[string]any{"stop": []string{"\n"}},
+		},
+		{
+			name:   "stop array",
+			chat:   ChatCompletionRequest{Stop: []any{"a", "b", "c", "d"}},
+			expect: map[string]any{"stop": []string{"a", "b", "c", "d"}},
+		},
+		{
+			name:   "empty stop array",
+			chat:   ChatCompletionRequest{Stop: []any{}},
+			expect: map[string]any{"stop": []string{}},
+		},
+		{
+			name: "too many stop sequences",
+			chat: ChatCompletionRequest{Stop: []any{"a", "b", "c", "d", "e"}},
+			err:  "5 stop sequences is more than the maximum of 4 - 'stop'",
+		},
+		{
+			name: "invalid stop sequence",
+			chat: ChatCompletionRequest{Stop: []any{"a", 1.0}},
+			err:  "invalid type for 'stop' field: float64",
+		},
+		{
+			name: "invalid stop",
+			chat: ChatCompletionRequest{Stop: 1.0},
+			err:  "invalid type for 'stop' field: float64",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("chat", func(t *testing.T) {
+				req, err := fromChatRequest(context.Background(), tt.chat)
+				if tt.err != "" {
+					if err == nil || err.Error() != tt.err {
+						t.Fatalf("expected error %q, got %v", tt.err, err)
+					}
+					return
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				for k, v := range tt.expect {
+					if diff := cmp.Diff(v, req.Options[k]); diff != "" {
+						t.Errorf("%s mismatch (-want +got):\n%s", k, diff)
+					}
+				}
+			})
+
+			// completions share the translation of every field except
+			// max_completion_tokens, which only exists for chat
+			if tt.chat.MaxCompletionTokens != nil {
+				return
+			}
+
+			t.Run("completions", func(t *testing.T) {
+				req, err := fromCompleteRequest(CompletionRequest{
+					MaxTokens: tt.chat.MaxTokens,
+					Seed:      tt.chat.Seed,
+					Stop:      tt.chat.Stop,
+				})
+				if tt.err != "" {
+					if err == nil || err.Error() != tt.err {
+						t.Fatalf("expected error %q, got %v", tt.err, err)
+					}
+					return
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				for k, v := range tt.expect {
+					if diff := cmp.Diff(v, req.Options[k]); diff != "" {
+						t.Errorf("%s mismatch (-want +got):\n%s", k, diff)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSystemFingerprint(t *testing.T) {
+	if systemFingerprint("") != "fp_ollama" {
+		t.Errorf("expected fp_ollama without a digest, got %s", systemFingerprint(""))
+	}
+
+	a, b := systemFingerprint("sha256:aaaa"), systemFingerprint("sha256:bbbb")
+	if a == b {
+		t.Errorf("expected different fingerprints for different models, got %s", a)
+	}
+
+	if !regexp.MustCompile(`^fp_[0-9a-f]{10}$`).MatchString(a) {
+		t.Errorf("unexpected fingerprint format %s", a)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ChatMiddleware())
+	router.Handle(http.MethodPost, "/", func(c *gin.Context) {
+		c.Set(ModelDigestKey, "sha256:aaaa")
+		c.Status(http.StatusOK)
+		for _, r := range []api.ChatResponse{
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi"}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "!"}, Done: true, DoneReason: "stop"},
+		} {
+			b, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := c.Writer.Write(append(b, '\n')); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(`{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "seed": 1, "stream": true}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var chunks int
+	for _, event := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+		data := strings.TrimPrefix(event, "data: ")
+		if data == "[DONE]" {
+			continue
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		if chunk.SystemFingerprint != a {
+			t.Errorf("expected fingerprint %s, got %s", a, chunk.SystemFingerprint)
+		}
+		chunks++
+	}
+
+	if chunks != 2 {
+		t.Errorf("expected 2 chunks, got %d", chunks)
+	}
+}
+
+func TestVision(t *testing.T) {
+	decode := func(s string) api.ImageData {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	png := decode(image)
+	webp := decode("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+
+	// payloads in testdata/vision were serialized by the openai Python SDK
+	cases := map[string][]api.Message{
+		"text_and_image.json": {
+			{Role: "user", Content: "What's in this image?", Images: []api.ImageData{png}},
+		},
+		"detail.json": {
+			{Role: "system", Content: "You are a helpful assistant."},
+			{Role: "user", Content: "Describe them.", Images: []api.ImageData{png, png}},
+		},
+		"multiple_images.json": {
+			{Role: "user", Content: "Compare these images.\nAnd this one.", Images: []api.ImageData{png, webp}},
+		},
+	}
+
+	for name, expect := range cases {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "vision", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var req ChatCompletionRequest
+			if err := json.NewDecoder(f).Decode(&req); err != nil {
+				t.Fatal(err)
+			}
+
+			chatReq, err := fromChatRequest(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(expect, chatReq.Messages); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("unsupported type", func(t *testing.T) {
+		_, err := fromChatRequest(context.Background(), ChatCompletionRequest{
+			Messages: []Message{{Role: "user", Content: []any{
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/gif;base64,R0lGODlh"}},
+			}}},
+		})
+		if err == nil || !strings.Contains(err.Error(), `unsupported image type "image/gif"`) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			// servers often send images with a generic content type
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(png)
+		case "/text":
+			w.Write([]byte("not an image"))
+		case "/moved":
+			http.Redirect(w, r, "/image", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/metadata":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	public := imageAddrAllowed
+	for addr, expect := range map[string]bool{
+		"8.8.8.8":          true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"0.0.0.0":          false,
+		"10.0.0.1":         false,
+		"192.168.1.1":      false,
+		"100.64.0.1":       false,
+		"169.254.169.254":  false,
+		"fd00:ec2::254":    false,
+		"fe80::1":          false,
+		"224.0.0.1":        false,
+	} {
+		if got := public(netip.MustParseAddr(addr)); got != expect {
+			t.Errorf("imageAddrAllowed(%s) = %t, want %t", addr, got, expect)
+		}
+	}
+
+	// the test server is on the loopback address, which the image client
+	// only connects to in tests
+	imageAddrAllowed = func(addr netip.Addr) bool { return addr.IsLoopback() }
+	t.Cleanup(func() { imageAddrAllowed = public })
+
+	fetch := func(path string) (*api.ChatRequest, error) {
+		return fromChatRequest(context.Background(), ChatCompletionRequest{
+			Messages: []Message{{Role: "user", Content: []any{
+				map[string]any{"type": "text", "text": "What's in this image?"},
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": srv.URL + path, "detail": "low"}},
+			}}},
+		})
+	}
+
+	t.Run("url disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "0")
+		if _, err := fetch("/image"); err == nil || !strings.Contains(err.Error(), "image URLs are not supported") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("url", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "1")
+		req, err := fetch("/image")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []api.Message{{Role: "user", Content: "What's in this image?", Images: []api.ImageData{png}}}
+		if diff := cmp.Diff(expect, req.Messages); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("url not found", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "1")
+		if _, err := fetch("/missing"); err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("url not an image", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "1")
+		if _, err := fetch("/text"); err == nil || !strings.Contains(err.Error(), "unsupported image type") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("url redirected", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "1")
+		if _, err := fetch("/moved"); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("url redirected too often", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "1")
+		if _, err := fetch("/loop"); err == nil || !strings.Contains(err.Error(), "stopped after 5 redirects") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("url redirected to link-local", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "1")
+		if _, err := fetch("/metadata"); !errors.Is(err, errImageAddr) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("url on loopback", func(t *testing.T) {
+		t.Setenv("OLLAMA_FETCH_IMAGES", "1")
+		imageAddrAllowed = public
+		imageClient.CloseIdleConnections()
+		defer func() { imageAddrAllowed = func(addr netip.Addr) bool { return addr.IsLoopback() } }()
+		if _, err := fetch("/image"); !errors.Is(err, errImageAddr) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestReasoningContent(t *testing.T) {
+	r := api.ChatResponse{
+		Model:      "test-model",
+		Message:    api.Message{Role: "assistant", Content: "4", Thinking: "2 plus 2 is 4"},
+		Done:       true,
+		DoneReason: "stop",
+	}
+
+	completion := toChatCompletion("id", "fp", r)
+	if got := completion.Choices[0].Message.ReasoningContent; got != "2 plus 2 is 4" {
+		t.Errorf("expected reasoning content in the message, got %q", got)
+	}
+
+	chunk := toChunk("id", "fp", r)
+	if got := chunk.Choices[0].Delta.ReasoningContent; got != "2 plus 2 is 4" {
+		t.Errorf("expected reasoning content in the delta, got %q", got)
+	}
+
+	b, err := json.Marshal(toChunk("id", "fp", api.ChatResponse{Message: api.Message{Role: "assistant", Content: "4"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte("reasoning_content")) {
+		t.Errorf("expected no reasoning content without thinking, got %s", b)
+	}
+}
+
+func TestFinishReason(t *testing.T) {
+	cases := map[string]string{
+		"stop":                "stop",
+		"stop_string":         "stop",
+		"stop_regex":          "stop",
+		"stop_token":          "stop",
+		"tool_calls":          "tool_calls",
+		"length":              "length",
+		"time_limit":          "length",
+		"abort":               "length",
+		"context_shift_error": "length",
+		"runner_crashed":      "length",
+		"shutdown":            "length",
+	}
+
+	for reason, want := range cases {
+		if got := finishReason(reason); got == nil || *got != want {
+			t.Errorf("finishReason(%q) = %v, want %q", reason, got, want)
+		}
+	}
+
+	if got := finishReason(""); got != nil {
+		t.Errorf("expected no finish reason, got %q", *got)
+	}
 }
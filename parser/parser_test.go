@@ -184,6 +184,41 @@ BADCOMMAND param1 value1
 	require.ErrorIs(t, err, errInvalidCommand)
 }
 
+func TestParseFileRequireLicenseAcceptance(t *testing.T) {
+	input := `
+FROM foo
+LICENSE MIT
+REQUIRE_LICENSE_ACCEPTANCE true
+`
+	modelfile, err := ParseFile(strings.NewReader(input))
+	require.NoError(t, err)
+
+	assert.Equal(t, []Command{
+		{Name: "model", Args: "foo"},
+		{Name: "license", Args: "MIT"},
+		{Name: "require_license_acceptance", Args: "true"},
+	}, modelfile.Commands)
+
+	_, err = ParseFile(strings.NewReader("FROM foo\nREQUIRE_LICENSE true\n"))
+	require.ErrorIs(t, err, errInvalidCommand)
+}
+
+func TestParseFileImatrix(t *testing.T) {
+	input := `
+FROM ./model-f16.gguf
+IMATRIX ./imatrix.dat
+`
+	modelfile, err := ParseFile(strings.NewReader(input))
+	require.NoError(t, err)
+
+	assert.Equal(t, []Command{
+		{Name: "model", Args: "./model-f16.gguf"},
+		{Name: "imatrix", Args: "./imatrix.dat"},
+	}, modelfile.Commands)
+
+	assert.Equal(t, "FROM ./model-f16.gguf\nIMATRIX ./imatrix.dat\n", modelfile.String())
+}
+
 func TestParseFileMessages(t *testing.T) {
 	cases := []struct {
 		input    string
@@ -562,6 +597,11 @@ MESSAGE assistant Hello, I want to parse all the things!
 		`
 FROM foo
 SYSTEM ""
+`,
+		`
+FROM foo
+LICENSE MIT
+REQUIRE_LICENSE_ACCEPTANCE true
 `,
 	}
 
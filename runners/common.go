@@ -298,6 +298,21 @@ func GetAvailableServers(payloadsDir string) map[string]string {
 	return servers
 }
 
+// Available returns the names of the runners that were extracted, sorted
+func Available() []string {
+	if runnersDir == "" {
+		return nil
+	}
+
+	var names []string
+	for name := range GetAvailableServers(runnersDir) {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
 // serversForGpu returns a list of compatible servers give the provided GPU
 // info, ordered by performance. assumes Init() has been called
 // TODO - switch to metadata based mapping
@@ -341,21 +356,7 @@ func ServersForGpu(info gpu.GpuInfo) []string {
 	if !(runtime.GOOS == "darwin" && runtime.GOARCH == "arm64") {
 		// Load up the best CPU variant if not primary requested
 		if info.Library != "cpu" {
-			variant := gpu.GetCPUCapability()
-			// If no variant, then we fall back to default
-			// If we have a variant, try that if we find an exact match
-			// Attempting to run the wrong CPU instructions will panic the
-			// process
-			if variant != gpu.CPUCapabilityNone {
-				for cmp := range availableServers {
-					if cmp == "cpu_"+variant.String() {
-						servers = append(servers, cmp)
-						break
-					}
-				}
-			} else {
-				servers = append(servers, "cpu")
-			}
+			servers = append(servers, cpuServer(availableServers, gpu.GetCPUCapability()))
 		}
 
 		if len(servers) == 0 {
@@ -371,13 +372,17 @@ func ServerForCpu() string {
 	if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
 		return "metal"
 	}
-	variant := gpu.GetCPUCapability()
-	availableServers := GetAvailableServers(runnersDir)
-	if variant != gpu.CPUCapabilityNone {
-		for cmp := range availableServers {
-			if cmp == "cpu_"+variant.String() {
-				return cmp
-			}
+	return cpuServer(GetAvailableServers(runnersDir), gpu.GetCPUCapability())
+}
+
+// cpuServer returns the best cpu runner for the given capability. Variants
+// that were not built fall back to the next lower capability, and finally to
+// the lowest common denominator. Attempting to run the wrong CPU instructions
+// will panic the process, so a higher variant is never returned.
+func cpuServer(availableServers map[string]string, variant gpu.CPUCapability) string {
+	for c := variant; c > gpu.CPUCapabilityNone; c-- {
+		if _, ok := availableServers["cpu_"+c.String()]; ok {
+			return "cpu_" + c.String()
 		}
 	}
 	return "cpu"
@@ -8,6 +8,8 @@ import (
 	"strings"
 	"testing"
 	"testing/fstest"
+
+	"github.com/ollama/ollama/gpu"
 )
 
 func TestRefreshRunners(t *testing.T) {
@@ -48,3 +50,29 @@ func TestRefreshRunners(t *testing.T) {
 
 	Cleanup(payloadFS)
 }
+
+func TestCPUServer(t *testing.T) {
+	all := map[string]string{"cpu": "", "cpu_avx": "", "cpu_avx2": "", "cpu_avx512": ""}
+	legacy := map[string]string{"cpu": "", "cpu_avx": "", "cpu_avx2": ""}
+	cases := []struct {
+		available map[string]string
+		variant   gpu.CPUCapability
+		expect    string
+	}{
+		{all, gpu.CPUCapabilityNone, "cpu"},
+		{all, gpu.CPUCapabilityAVX, "cpu_avx"},
+		{all, gpu.CPUCapabilityAVX2, "cpu_avx2"},
+		{all, gpu.CPUCapabilityAVX512, "cpu_avx512"},
+		{all, gpu.CPUCapabilityAMX, "cpu_avx512"},
+		{legacy, gpu.CPUCapabilityAVX512, "cpu_avx2"},
+		{legacy, gpu.CPUCapabilityAMX, "cpu_avx2"},
+		{map[string]string{"cpu": ""}, gpu.CPUCapabilityAVX2, "cpu"},
+		{map[string]string{"cpu_avx2": ""}, gpu.CPUCapabilityAVX, "cpu"},
+	}
+
+	for _, tt := range cases {
+		if s := cpuServer(tt.available, tt.variant); s != tt.expect {
+			t.Errorf("%s: expected %s, got %s", tt.variant, tt.expect, s)
+		}
+	}
+}
@@ -3,7 +3,7 @@
 set -eu
 
 export VERSION=${VERSION:-0.0.0}
-export GOFLAGS="'-ldflags=-w -s \"-X=github.com/ollama/ollama/version.Version=$VERSION\" \"-X=github.com/ollama/ollama/server.mode=release\"'"
+export GOFLAGS="'-ldflags=-w -s \"-X=github.com/ollama/ollama/version.Version=$VERSION\" \"-X=github.com/ollama/ollama/version.Commit=$(git rev-parse HEAD 2>/dev/null)\" \"-X=github.com/ollama/ollama/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)\" \"-X=github.com/ollama/ollama/server.mode=release\"'"
 
 docker build \
     --push \
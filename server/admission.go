@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+// throughputWeight is the weight of each completed request in the rolling
+// averages of a model's throughput
+const throughputWeight = 0.2
+
+// ttftError is returned for requests that are predicted to miss, or have
+// already missed, OLLAMA_TARGET_TTFT
+type ttftError struct {
+	Predicted, Target time.Duration
+}
+
+func (e *ttftError) Error() string {
+	return fmt.Sprintf("server busy, predicted time to first token %s exceeds the target of %s", e.Predicted.Round(time.Millisecond), e.Target)
+}
+
+// modelAdmission is a model's throughput, as rolling averages of its
+// completed requests, and the admission decisions made from it
+type modelAdmission struct {
+	Model string `json:"model"`
+
+	PromptTokensPerSecond float64 `json:"prompt_tokens_per_second"`
+	EvalTokensPerSecond   float64 `json:"eval_tokens_per_second"`
+	RequestSeconds        float64 `json:"request_seconds"`
+
+	// LastPredictionSeconds is the time to first token predicted for the
+	// last request considered
+	LastPredictionSeconds float64 `json:"last_prediction_seconds"`
+
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	Shed     uint64 `json:"shed"`
+}
+
+// admission predicts the time to first token of requests from how many are
+// ahead of them and the model's throughput, rejecting those that would miss
+// OLLAMA_TARGET_TTFT. It does nothing unless OLLAMA_TARGET_TTFT is set.
+type admission struct {
+	mu     sync.Mutex
+	models map[string]*modelAdmission // model path -> throughput
+}
+
+// The mu must already be held when calling model
+func (a *admission) model(modelPath string) *modelAdmission {
+	if a.models == nil {
+		a.models = make(map[string]*modelAdmission)
+	}
+
+	m, ok := a.models[modelPath]
+	if !ok {
+		m = &modelAdmission{Model: modelPath}
+		a.models[modelPath] = m
+	}
+
+	return m
+}
+
+// rollingAverage adds v to the rolling average avg, which is zero before
+// anything has been added
+func rollingAverage(avg, v float64) float64 {
+	if avg == 0 {
+		return v
+	}
+
+	return avg + throughputWeight*(v-avg)
+}
+
+// observe adds a completed request to the model's throughput
+func (a *admission) observe(modelPath string, r llm.CompletionResponse) {
+	if envconfig.TargetTTFT() <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := a.model(modelPath)
+	if r.PromptEvalCount > 0 && r.PromptEvalDuration > 0 {
+		m.PromptTokensPerSecond = rollingAverage(m.PromptTokensPerSecond, float64(r.PromptEvalCount)/r.PromptEvalDuration.Seconds())
+	}
+
+	if r.EvalCount > 0 && r.EvalDuration > 0 {
+		m.EvalTokensPerSecond = rollingAverage(m.EvalTokensPerSecond, float64(r.EvalCount)/r.EvalDuration.Seconds())
+	}
+
+	if d := r.PromptEvalDuration + r.EvalDuration; d > 0 {
+		m.RequestSeconds = rollingAverage(m.RequestSeconds, d.Seconds())
+	}
+}
+
+// admit predicts the time to first token of a request with about
+// promptTokens of prompt, with ahead requests queued or running before it on
+// slots parallel slots, returning a ttftError if it exceeds target. Requests
+// are admitted until the model's throughput has been observed.
+func (a *admission) admit(modelPath string, promptTokens, ahead, slots int, target time.Duration) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := a.model(modelPath)
+	if m.PromptTokensPerSecond == 0 {
+		m.Accepted++
+		return nil
+	}
+
+	// a slot frees up every RequestSeconds/slots on average, and the
+	// request starts once enough have for those ahead of it
+	var wait float64
+	if slots = max(slots, 1); ahead >= slots {
+		wait = float64(ahead-slots+1) * m.RequestSeconds / float64(slots)
+	}
+
+	prefill := float64(promptTokens) / m.PromptTokensPerSecond
+	predicted := time.Duration((wait + prefill) * float64(time.Second))
+	m.LastPredictionSeconds = predicted.Seconds()
+
+	if predicted > target {
+		m.Rejected++
+		slog.Debug("rejecting request, predicted to miss the target time to first token", "model", modelPath, "predicted", predicted, "target", target)
+		return &ttftError{Predicted: predicted, Target: target}
+	}
+
+	m.Accepted++
+	return nil
+}
+
+// shed returns a ttftError for a queued request that has already waited
+// longer than target, so its client can try elsewhere rather than wait
+func (a *admission) shed(req *LlmRequest, target time.Duration) error {
+	waited := time.Since(req.enqueuedAt)
+	if target <= 0 || waited <= target {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.model(req.model.ModelPath).Shed++
+
+	slog.Debug("shedding request, waited longer than the target time to first token", "model", req.model.ModelPath, "waited", waited, "target", target)
+	return &ttftError{Predicted: waited, Target: target}
+}
+
+func (a *admission) state() []modelAdmission {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var state []modelAdmission
+	for _, m := range a.models {
+		state = append(state, *m)
+	}
+
+	sort.Slice(state, func(i, j int) bool {
+		return state[i].Model < state[j].Model
+	})
+	return state
+}
+
+// admit returns a ttftError if a request for the model with about
+// promptTokens of prompt is predicted to miss OLLAMA_TARGET_TTFT
+func (s *Scheduler) admit(model *Model, promptTokens int) error {
+	target := envconfig.TargetTTFT()
+	if target <= 0 {
+		return nil
+	}
+
+	s.loadedMu.Lock()
+	replicas := s.replicas(model.ModelPath)
+	s.loadedMu.Unlock()
+
+	ahead := s.queues.modelLen(model.ModelPath)
+	var slots int
+	for _, r := range replicas {
+		// The refMu is held for the duration of a load
+		if !r.refMu.TryLock() {
+			continue
+		}
+		ahead += int(r.refCount)
+		slots += r.numParallel
+		r.refMu.Unlock()
+	}
+
+	return s.admission.admit(model.ModelPath, promptTokens, ahead, slots, target)
+}
+
+// estimateTokens roughly estimates the number of tokens in text, at about
+// four bytes per token, before it can be tokenized
+func estimateTokens(text ...string) int {
+	var n int
+	for _, s := range text {
+		n += len(s)
+	}
+
+	return n / 4
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func TestAdmission(t *testing.T) {
+	t.Setenv("OLLAMA_TARGET_TTFT", "3s")
+
+	var a admission
+	if err := a.admit("model", 1000, 10, 1, 3*time.Second); err != nil {
+		t.Fatalf("expected requests to be admitted before throughput is observed, got %v", err)
+	}
+
+	a.observe("model", llm.CompletionResponse{
+		PromptEvalCount:    1000,
+		PromptEvalDuration: time.Second,
+		EvalCount:          100,
+		EvalDuration:       time.Second,
+	})
+
+	cases := []struct {
+		name         string
+		promptTokens int
+		ahead, slots int
+		predicted    time.Duration
+	}{
+		{name: "idle", promptTokens: 500, ahead: 0, slots: 1},
+		{name: "free slot", promptTokens: 500, ahead: 1, slots: 2},
+		{name: "long prompt", promptTokens: 4000, ahead: 0, slots: 1, predicted: 4 * time.Second},
+		{name: "queued", promptTokens: 500, ahead: 2, slots: 1, predicted: 4500 * time.Millisecond},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.admit("model", tt.promptTokens, tt.ahead, tt.slots, 3*time.Second)
+			if tt.predicted == 0 {
+				if err != nil {
+					t.Fatalf("expected the request to be admitted, got %v", err)
+				}
+				return
+			}
+
+			var terr *ttftError
+			if !errors.As(err, &terr) {
+				t.Fatalf("expected a ttftError, got %v", err)
+			}
+
+			if terr.Predicted != tt.predicted || terr.Target != 3*time.Second {
+				t.Errorf("expected a prediction of %s, got %s", tt.predicted, terr.Predicted)
+			}
+		})
+	}
+
+	state := a.state()
+	if len(state) != 1 {
+		t.Fatalf("expected one model, got %v", state)
+	}
+
+	if m := state[0]; m.Accepted != 3 || m.Rejected != 2 || m.PromptTokensPerSecond != 1000 || m.EvalTokensPerSecond != 100 || m.RequestSeconds != 2 {
+		t.Errorf("unexpected state %+v", m)
+	}
+}
+
+func TestAdmissionDisabled(t *testing.T) {
+	t.Setenv("OLLAMA_TARGET_TTFT", "")
+
+	var a admission
+	a.observe("model", llm.CompletionResponse{PromptEvalCount: 1, PromptEvalDuration: time.Second})
+	if state := a.state(); len(state) != 0 {
+		t.Errorf("expected nothing to be observed, got %v", state)
+	}
+
+	var s Scheduler
+	if err := s.admit(&Model{ModelPath: "model"}, 1<<20); err != nil {
+		t.Errorf("expected requests to be admitted, got %v", err)
+	}
+}
+
+func TestAdmissionShed(t *testing.T) {
+	var a admission
+	req := &LlmRequest{model: &Model{ModelPath: "model"}, enqueuedAt: time.Now().Add(-5 * time.Second)}
+
+	if err := a.shed(req, 0); err != nil {
+		t.Errorf("expected nothing to be shed without a target, got %v", err)
+	}
+
+	if err := a.shed(req, 10*time.Second); err != nil {
+		t.Errorf("expected a request within the target to be kept, got %v", err)
+	}
+
+	var terr *ttftError
+	if err := a.shed(req, 3*time.Second); !errors.As(err, &terr) {
+		t.Fatalf("expected a ttftError, got %v", err)
+	}
+
+	if state := a.state(); len(state) != 1 || state[0].Shed != 1 {
+		t.Errorf("expected one request to be shed, got %v", state)
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	handleScheduleError(c, "model", terr)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", w.Code)
+	}
+
+	var resp struct {
+		Predicted float64 `json:"predicted_ttft"`
+		Target    float64 `json:"target_ttft"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Predicted < 5 || resp.Target != 3 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// aliasSet is the server's aliases, which requests use in place of a model
+// name. It's seeded from OLLAMA_ALIASES and can be changed at runtime
+// through the aliases API.
+type aliasSet struct {
+	mu      sync.Mutex
+	aliases map[string]api.Alias
+}
+
+// aliasKey normalizes name so "default" and "default:latest" are the same alias
+func aliasKey(name string) string {
+	return strings.ToLower(model.ParseName(name).String())
+}
+
+// loadAliases reads the aliases file at path, an object of aliases by name:
+//
+//	{"default": {"models": ["qwen2.5-coder:32b", "qwen2.5-coder:7b"], "max_cpu": 0.2}}
+//
+// It returns no aliases if path is empty.
+func loadAliases(path string) (map[string]api.Alias, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file map[string]struct {
+		Models []string `json:"models"`
+		MaxCPU float64  `json:"max_cpu"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	aliases := make(map[string]api.Alias, len(file))
+	for name, a := range file {
+		aliases[aliasKey(name)] = api.Alias{Name: name, Models: a.Models, MaxCPU: a.MaxCPU}
+	}
+
+	for _, a := range aliases {
+		if err := checkAlias(aliases, a); err != nil {
+			return nil, err
+		}
+	}
+
+	return aliases, nil
+}
+
+// checkAlias validates a as one of aliases: its name must be a valid model
+// name that isn't a model's, and each of its models must be a model or
+// another alias, without any alias eventually resolving to itself
+func checkAlias(aliases map[string]api.Alias, a api.Alias) error {
+	n := model.ParseName(a.Name)
+	if !n.IsValid() {
+		return fmt.Errorf("alias %q: invalid name", a.Name)
+	}
+
+	if _, err := ParseNamedManifest(n); err == nil {
+		return fmt.Errorf("alias %q: a model has the same name", a.Name)
+	}
+
+	if len(a.Models) == 0 {
+		return fmt.Errorf("alias %q: models are required", a.Name)
+	}
+
+	if a.MaxCPU < 0 || a.MaxCPU > 1 {
+		return fmt.Errorf("alias %q: max_cpu must be between 0 and 1", a.Name)
+	}
+
+	for _, target := range a.Models {
+		if _, ok := aliases[aliasKey(target)]; ok {
+			continue
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName(target)); err != nil {
+			return fmt.Errorf("alias %q: model %q not found", a.Name, target)
+		}
+	}
+
+	var visit func(key string, path []string) error
+	visit = func(key string, path []string) error {
+		if slices.Contains(path, key) {
+			return fmt.Errorf("alias %q: cycle %s", a.Name, strings.Join(append(path, key), " -> "))
+		}
+
+		next, ok := aliases[key]
+		if !ok {
+			return nil
+		}
+
+		for _, target := range next.Models {
+			if err := visit(aliasKey(target), append(path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return visit(aliasKey(a.Name), nil)
+}
+
+func (s *aliasSet) list() []api.Alias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	aliases := make([]api.Alias, 0, len(s.aliases))
+	for _, a := range s.aliases {
+		aliases = append(aliases, a)
+	}
+
+	slices.SortFunc(aliases, func(a, b api.Alias) int { return strings.Compare(a.Name, b.Name) })
+	return aliases
+}
+
+func (s *aliasSet) get(name string) (api.Alias, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.aliases[aliasKey(name)]
+	return a, ok
+}
+
+// set defines a, replacing any alias of the same name
+func (s *aliasSet) set(a api.Alias) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	aliases := maps.Clone(s.aliases)
+	if aliases == nil {
+		aliases = make(map[string]api.Alias)
+	}
+
+	aliases[aliasKey(a.Name)] = a
+	if err := checkAlias(aliases, a); err != nil {
+		return err
+	}
+
+	s.aliases = aliases
+	return nil
+}
+
+// remove deletes the alias name. Aliases other aliases resolve to can't be
+// removed.
+func (s *aliasSet) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := aliasKey(name)
+	if _, ok := s.aliases[key]; !ok {
+		return fmt.Errorf("alias %q: %w", name, os.ErrNotExist)
+	}
+
+	for _, a := range s.aliases {
+		if slices.ContainsFunc(a.Models, func(target string) bool { return aliasKey(target) == key }) {
+			return fmt.Errorf("alias %q is used by alias %q", name, a.Name)
+		}
+	}
+
+	delete(s.aliases, key)
+	return nil
+}
+
+// expand returns the models an alias resolves to in order of preference,
+// replacing the aliases among them with their own models
+func (s *aliasSet) expand(a api.Alias) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var models []string
+	var walk func(a api.Alias)
+	walk = func(a api.Alias) {
+		for _, target := range a.Models {
+			if next, ok := s.aliases[aliasKey(target)]; ok {
+				walk(next)
+			} else if !slices.Contains(models, target) {
+				models = append(models, target)
+			}
+		}
+	}
+
+	walk(a)
+	return models
+}
+
+// resolveAlias returns the model a request for name should use. Names that
+// aren't aliases are returned as is. An alias resolves to the first of its
+// models, which the request's key can use and that has caps, that's already
+// loaded or can be loaded without unloading other models and with at most
+// the alias's max_cpu of it in system memory. If none can, it resolves to
+// the last one, the alias's final fallback.
+func (s *Server) resolveAlias(ctx context.Context, name string, caps []model.Capability, presetOpts, requestOpts map[string]any) (string, error) {
+	a, ok := s.aliases.get(name)
+	if !ok {
+		return name, nil
+	}
+
+	var fallback string
+	var lastErr error
+	for _, target := range s.aliases.expand(a) {
+		m, err := getNamespacedModel(ctx, target)
+		if err != nil {
+			slog.Debug("skipping alias model", "alias", a.Name, "model", target, "error", err)
+			lastErr = err
+			continue
+		}
+
+		if err := m.CheckCapabilities(caps...); err != nil {
+			lastErr = fmt.Errorf("%s %w", target, err)
+			continue
+		}
+
+		opts, err := modelOptions(m, presetOpts, requestOpts)
+		if err != nil {
+			return "", err
+		}
+
+		m, err = s.sched.selectVariant(m, opts)
+		if err != nil {
+			return "", err
+		}
+
+		fallback = target
+		if ok, err := s.sched.placeable(m, opts, a.MaxCPU); err != nil {
+			return "", err
+		} else if ok {
+			slog.Debug("resolved alias", "alias", a.Name, "model", target)
+			return target, nil
+		}
+	}
+
+	if fallback == "" {
+		return "", lastErr
+	}
+
+	slog.Info("no model of alias can be placed without unloading or offloading, using the last", "alias", a.Name, "model", fallback)
+	return fallback, nil
+}
+
+// resolvedModel returns the model m that served a request for name, for the
+// resolved_model field of responses, or "" if name isn't an alias
+func (s *Server) resolvedModel(name string, m *Model) string {
+	if _, ok := s.aliases.get(name); !ok {
+		return ""
+	}
+
+	return m.ShortName
+}
+
+// placeable reports whether m is loaded, or fits in the free memory of the
+// CPU or of the GPUs of one library with at most maxCPU of it, as a fraction
+// of its size, in system memory
+func (s *Scheduler) placeable(m *Model, opts api.Options, maxCPU float64) (bool, error) {
+	s.loadedMu.Lock()
+	loaded := len(s.replicas(m.ModelPath)) > 0
+	s.loadedMu.Unlock()
+	if loaded {
+		return true, nil
+	}
+
+	ggml, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		return false, err
+	}
+
+	var gpus gpu.GpuInfoList
+	if opts.NumGPU == 0 {
+		gpus = s.getCpuFn()
+	} else {
+		gpus = s.getGpuFn()
+	}
+
+	if len(gpus) == 0 {
+		return false, nil
+	}
+
+	if gpus[0].Library == "cpu" {
+		return llm.EstimateGPULayers(gpus, ggml, m.ProjectorPaths, opts).TotalSize <= gpus[0].FreeMemory, nil
+	}
+
+	for _, gl := range gpus.ByLibrary() {
+		estimate := llm.EstimateGPULayers(gl, ggml, m.ProjectorPaths, opts)
+		if estimate.TotalSize > 0 && 1-float64(estimate.VRAMSize)/float64(estimate.TotalSize) <= maxCPU {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Server) ListAliasesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.ListAliasesResponse{Aliases: s.aliases.list()})
+}
+
+func (s *Server) SetAliasHandler(c *gin.Context) {
+	var req api.Alias
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.aliases.set(req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.Info("set alias", "alias", req.Name, "models", req.Models)
+	c.JSON(http.StatusOK, req)
+}
+
+func (s *Server) DeleteAliasHandler(c *gin.Context) {
+	var req api.DeleteAliasRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.aliases.remove(req.Name); errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("alias '%s' not found", req.Name)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.Info("removed alias", "alias", req.Name)
+}
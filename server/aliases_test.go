@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestLoadAliases(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	createVariants(t)
+
+	write := func(t *testing.T, s string) string {
+		t.Helper()
+		p := filepath.Join(t.TempDir(), "aliases.json")
+		if err := os.WriteFile(p, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	aliases, err := loadAliases(write(t, `{
+		"default": {"models": ["fast", "mymodel:q8_0"], "max_cpu": 0.5},
+		"fast": {"models": ["mymodel:q4_K_M"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]api.Alias{
+		aliasKey("default"): {Name: "default", Models: []string{"fast", "mymodel:q8_0"}, MaxCPU: 0.5},
+		aliasKey("fast"):    {Name: "fast", Models: []string{"mymodel:q4_K_M"}},
+	}
+	if diff := cmp.Diff(expect, aliases); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if aliases, err := loadAliases(""); err != nil || aliases != nil {
+		t.Errorf("expected no aliases without a file, got %v %v", aliases, err)
+	}
+
+	for _, tt := range []struct{ file, err string }{
+		{`{"default": {"models": ["missing"]}}`, `model "missing" not found`},
+		{`{"default": {"models": []}}`, "models are required"},
+		{`{"default": {"models": ["mymodel"], "max_cpu": 2}}`, "max_cpu"},
+		{`{"mymodel": {"models": ["mymodel:q8_0"]}}`, "a model has the same name"},
+		{`{"a": {"models": ["b"]}, "b": {"models": ["a"]}}`, "cycle"},
+		{`{"a": {"models": ["a:latest"]}}`, "cycle"},
+		{`{"default": {"model": ["mymodel"]}}`, "unknown field"},
+	} {
+		if _, err := loadAliases(write(t, tt.file)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("loadAliases(%s): expected error containing %q, got %v", tt.file, tt.err, err)
+		}
+	}
+}
+
+func TestAliasSet(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	createVariants(t)
+
+	var s aliasSet
+	if err := s.set(api.Alias{Name: "fast", Models: []string{"mymodel:q4_K_M"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.set(api.Alias{Name: "default", Models: []string{"mymodel:q8_0", "fast", "mymodel:q4_K_M"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.get("default:latest"); !ok {
+		t.Error("expected default:latest to be the default alias")
+	}
+
+	a, _ := s.get("default")
+	if diff := cmp.Diff([]string{"mymodel:q8_0", "mymodel:q4_K_M"}, s.expand(a)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// a cycle leaves the aliases unchanged
+	if err := s.set(api.Alias{Name: "fast", Models: []string{"default"}}); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+
+	if a, _ := s.get("fast"); a.Models[0] != "mymodel:q4_K_M" {
+		t.Errorf("expected fast to be unchanged, got %v", a.Models)
+	}
+
+	if err := s.remove("fast"); err == nil || !strings.Contains(err.Error(), `used by alias "default"`) {
+		t.Errorf("expected fast to be in use, got %v", err)
+	}
+
+	if err := s.remove("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.remove("default"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected default not to exist, got %v", err)
+	}
+
+	if aliases := s.list(); len(aliases) != 1 || aliases[0].Name != "fast" {
+		t.Errorf("expected only fast, got %v", aliases)
+	}
+}
+
+func TestResolveAlias(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	createVariants(t)
+
+	free := func(n uint64) func() gpu.GpuInfoList {
+		return func() gpu.GpuInfoList {
+			g := gpu.GpuInfo{Library: "cpu"}
+			g.TotalMemory = n
+			g.FreeMemory = n
+			return []gpu.GpuInfo{g}
+		}
+	}
+
+	large, err := GetModel("mymodel:q8_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		models []string
+		free   uint64
+		loaded bool
+		caps   []model.Capability
+		expect string
+		err    bool
+	}{
+		{name: "first fits", models: []string{"mymodel:q8_0", "mymodel:q4_K_M"}, free: 1 << 34, expect: "mymodel:q8_0"},
+		{name: "none fit", models: []string{"mymodel:q8_0", "mymodel:q4_K_M"}, free: 0, expect: "mymodel:q4_K_M"},
+		{name: "loaded", models: []string{"mymodel:q8_0", "mymodel:q4_K_M"}, free: 0, loaded: true, expect: "mymodel:q8_0"},
+		{name: "missing capability", models: []string{"mymodel:q8_0"}, free: 1 << 34, caps: []model.Capability{model.CapabilityInsert}, err: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Server{
+				sched: &Scheduler{
+					loaded:   make(map[string]*runnerRef),
+					getGpuFn: free(tt.free),
+					getCpuFn: free(tt.free),
+				},
+			}
+
+			if tt.loaded {
+				s.sched.loaded[large.ModelPath] = &runnerRef{modelPath: large.ModelPath}
+			}
+
+			if err := s.aliases.set(api.Alias{Name: "default", Models: tt.models}); err != nil {
+				t.Fatal(err)
+			}
+
+			name, err := s.resolveAlias(context.Background(), "default", tt.caps, nil, map[string]any{"num_ctx": float64(2048)})
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", name)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if name != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, name)
+			}
+
+			if name, err := s.resolveAlias(context.Background(), "mymodel", nil, nil, nil); err != nil || name != "mymodel" {
+				t.Errorf("expected models to resolve to themselves, got %s %v", name, err)
+			}
+		})
+	}
+}
+
+func TestAliasHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	createVariants(t)
+
+	var s Server
+	w := createRequest(t, s.SetAliasHandler, api.Alias{Name: "default", Models: []string{"mymodel:q8_0"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d %s", w.Code, w.Body)
+	}
+
+	w = createRequest(t, s.SetAliasHandler, api.Alias{Name: "other", Models: []string{"missing"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a missing model, got %d", w.Code)
+	}
+
+	w = createRequest(t, s.ListAliasesHandler, nil)
+	var resp api.ListAliasesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]api.Alias{{Name: "default", Models: []string{"mymodel:q8_0"}}}, resp.Aliases); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	w = createRequest(t, s.DeleteAliasHandler, api.DeleteAliasRequest{Name: "default"})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+
+	w = createRequest(t, s.DeleteAliasHandler, api.DeleteAliasRequest{Name: "default"})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
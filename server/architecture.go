@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+// checkPullArchitecture checks that this version of Ollama can run the
+// architecture of the model being pulled, from its config, before any of its
+// weights are downloaded. Models it can't run are pulled with a warning, or
+// not at all if strict is set.
+func checkPullArchitecture(ctx context.Context, mp ModelPath, m *Manifest, strict bool, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	if m.Config.Digest == "" {
+		return nil
+	}
+
+	if _, err := downloadBlob(ctx, downloadOpts{mp: mp, digest: m.Config.Digest, size: m.Config.Size, regOpts: regOpts, fn: fn}); err != nil {
+		return err
+	}
+
+	if err := verifyBlob(m.Config.Digest); err != nil {
+		return err
+	}
+
+	err := configArchitectureSupported(m.Config)
+	var uerr *llm.UnsupportedModelError
+	if !errors.As(err, &uerr) {
+		return err
+	}
+
+	if strict {
+		return err
+	}
+
+	slog.Warn("pulling model this version can't run", "model", mp.GetShortTagname(), "architecture", uerr.Architecture, "min_version", uerr.MinVersion)
+	fn(api.ProgressResponse{Status: "warning: " + err.Error()})
+	return nil
+}
+
+// configArchitectureSupported returns an *llm.UnsupportedModelError if the
+// architecture in the model config config can't be run by this version of
+// Ollama. Configs that don't name an architecture, such as those of older
+// models, are assumed to be supported.
+func configArchitectureSupported(config Layer) error {
+	f, err := config.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var cf ConfigV2
+	if err := json.NewDecoder(f).Decode(&cf); err != nil {
+		return err
+	}
+
+	if cf.ModelFamily == "" {
+		return nil
+	}
+
+	return llm.CheckArchitecture(cf.ModelFamily)
+}
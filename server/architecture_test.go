@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestPullArchitecture(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	registry := newSignatureRegistry(t)
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := fmt.Sprintf("%s/library/newer:latest", u.Host)
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      name,
+		Modelfile: "FROM " + createBinFile(t, llm.KV{"general.architecture": "gemma3"}, nil),
+		Stream:    &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	// the model is listed as one this version can't run
+	w = createRequest(t, s.ListHandler, nil)
+	if !strings.Contains(w.Body.String(), `"min_version":"0.6.0"`) {
+		t.Errorf("expected the model to be listed as unsupported, got %s", w.Body.String())
+	}
+
+	opts := &registryOptions{Insecure: true}
+	if err := PushModel(context.Background(), "http://"+name, opts, false, func(api.ProgressResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the registry only serves manifests, so the blobs are kept to pull from
+	p, err := GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(p); err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []string
+	fn := func(r api.ProgressResponse) { statuses = append(statuses, r.Status) }
+
+	err = PullModelWith(context.Background(), "http://"+name, PullOptions{Strict: true}, opts, fn)
+	var uerr *llm.UnsupportedModelError
+	if !errors.As(err, &uerr) || uerr.Architecture != "gemma3" || uerr.MinVersion != "0.6.0" {
+		t.Fatalf("expected a strict pull to be refused, got %v", err)
+	}
+
+	if _, err := ParseNamedManifest(model.ParseName(name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the model not to be pulled, got %v", err)
+	}
+
+	statuses = nil
+	if err := PullModel(context.Background(), "http://"+name, opts, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	var warned bool
+	for _, status := range statuses {
+		if strings.HasPrefix(status, "warning: ") && strings.Contains(status, `"gemma3"`) && strings.Contains(status, "0.6.0") {
+			warned = true
+		}
+	}
+
+	if !warned {
+		t.Errorf("expected a warning status, got %q", statuses)
+	}
+
+	if _, err := ParseNamedManifest(model.ParseName(name)); err != nil {
+		t.Errorf("expected the model to be pulled, got %v", err)
+	}
+}
@@ -7,16 +7,20 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/auth"
+	"github.com/ollama/ollama/envconfig"
 )
 
 type registryChallenge struct {
@@ -66,8 +70,67 @@ func getAuthorizationToken(ctx context.Context, challenge registryChallenge) (st
 	}
 
 	headers.Add("Authorization", signature)
+	return requestToken(ctx, redirectURL, headers, &registryOptions{})
+}
+
+// huggingFaceHosts are the registries HF_TOKEN is used for
+var huggingFaceHosts = []string{"hf.co", "huggingface.co"}
+
+// registryCredential returns the credentials for the registry at host that
+// were stored with ollama login, or for Hugging Face set in HF_TOKEN, or nil
+// if there are none
+func registryCredential(host string) *auth.Credential {
+	c, err := auth.GetCredential(host)
+	if err == nil {
+		return c
+	} else if !errors.Is(err, auth.ErrNoCredential) {
+		slog.Warn("couldn't read stored credentials", "registry", host, "error", err)
+	}
+
+	if slices.Contains(huggingFaceHosts, strings.ToLower(host)) {
+		if token := envconfig.HFToken(); token != "" {
+			return &auth.Credential{Secret: token}
+		}
+	}
+
+	return nil
+}
+
+// useCredential sets regOpts to answer a registry's challenge with c. A token
+// is sent as is. A username and password are exchanged for a token at the
+// challenge's realm, or sent with basic authentication if the registry asks
+// for it.
+func useCredential(ctx context.Context, header string, c *auth.Credential, regOpts *registryOptions) error {
+	switch {
+	case c.Username == "":
+		regOpts.Token = c.Secret
+	case strings.HasPrefix(strings.ToLower(header), "basic"):
+		regOpts.Token = ""
+		regOpts.Username, regOpts.Password = c.Username, c.Secret
+	default:
+		redirectURL, err := parseRegistryChallenge(header).URL()
+		if err != nil {
+			return err
+		}
+
+		headers := make(http.Header)
+		basic := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Secret))
+		headers.Set("Authorization", "Basic "+basic)
+
+		token, err := requestToken(ctx, redirectURL, headers, &registryOptions{Insecure: regOpts.Insecure})
+		if err != nil {
+			return err
+		}
+
+		regOpts.Token = token
+	}
+
+	return nil
+}
 
-	response, err := makeRequest(ctx, http.MethodGet, redirectURL, headers, nil, &registryOptions{})
+// requestToken requests a token from a registry's token server
+func requestToken(ctx context.Context, redirectURL *url.URL, headers http.Header, regOpts *registryOptions) (string, error) {
+	response, err := makeRequest(ctx, http.MethodGet, redirectURL, headers, nil, regOpts)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollama/ollama/auth"
+)
+
+func TestRegistryCredentials(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OLLAMA_CREDENTIALS_STORE", "file")
+	t.Setenv("HF_TOKEN", "")
+
+	private, _ := newSigningKey(t, "")
+	if err := os.MkdirAll(filepath.Join(home, ".ollama"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(home, ".ollama", "id_ed25519"), private, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "hunter2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]string{"token": "exchanged"}) //nolint:errcheck
+		case "/v2/bearer":
+			if r.Header.Get("Authorization") != "Bearer exchanged" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:bearer:pull"`, srv.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case "/v2/basic":
+			if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "hunter2" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case "/v2/token":
+			if r.Header.Get("Authorization") != "Bearer hf_token" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, path string) error {
+		t.Helper()
+		resp, err := makeRequestWithRetry(context.Background(), http.MethodGet, u.JoinPath(path), nil, nil, &registryOptions{})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if _, err := auth.SetCredential(u.Host, auth.Credential{Username: "user", Secret: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/v2/bearer", "/v2/basic"} {
+		if err := get(t, path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if _, err := auth.SetCredential(u.Host, auth.Credential{Secret: "hf_token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := get(t, "/v2/token"); err != nil {
+		t.Error(err)
+	}
+
+	if err := auth.DeleteCredential(u.Host); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("hf token", func(t *testing.T) {
+		if c := registryCredential("hf.co"); c != nil {
+			t.Errorf("expected no credentials, got %+v", c)
+		}
+
+		t.Setenv("HF_TOKEN", "hf_env")
+		if c := registryCredential("hf.co"); c == nil || c.Secret != "hf_env" {
+			t.Errorf("expected HF_TOKEN, got %+v", c)
+		}
+
+		if _, err := auth.SetCredential("hf.co", auth.Credential{Secret: "hf_stored"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if c := registryCredential("hf.co"); c == nil || c.Secret != "hf_stored" {
+			t.Errorf("expected stored credentials before HF_TOKEN, got %+v", c)
+		}
+
+		if c := registryCredential(u.Host); c != nil {
+			t.Errorf("expected HF_TOKEN to only be used for Hugging Face, got %+v", c)
+		}
+	})
+}
@@ -0,0 +1,452 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+)
+
+// Blobs can be uploaded whole, or in ranges sent with a Content-Range header
+// so an upload interrupted by a flaky connection can be resumed. Either way
+// the upload is written to its own temporary directory, hashed as it's read,
+// and only moved into the blobs directory once it matches its digest.
+//
+// A partial upload is kept until it's finished or it's idle for
+// blobUploadIdle. One left by a server that died is removed by the sweep of
+// temporary directories when the next server starts.
+
+// blobUploadIdle is how long a partial upload is kept without any more of it
+// being sent
+var blobUploadIdle = 30 * time.Minute
+
+// uploadOffsetHeader reports how much of a partial upload the server has
+const uploadOffsetHeader = "Upload-Offset"
+
+var (
+	errBlobDigestMismatch = errors.New("digest mismatch")
+	errUploadInUse        = errors.New("another request is uploading this blob")
+	errUploadIncomplete   = errors.New("upload ended before the end of its range")
+)
+
+// incomingBlob is a blob being written to a temporary file
+type incomingBlob struct {
+	mu     sync.Mutex
+	td     *tempDir
+	file   *os.File
+	hash   hash.Hash
+	offset int64
+	total  int64 // the blob's size, or -1 if it isn't known
+	idle   *time.Timer
+}
+
+func newIncomingBlob(total int64) (*incomingBlob, error) {
+	td, err := newTempDir("upload")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(td.Path("blob"))
+	if err != nil {
+		td.Remove()
+		return nil, err
+	}
+
+	return &incomingBlob{td: td, file: f, hash: sha256.New(), total: total}, nil
+}
+
+// Write appends b to the upload, counting only the bytes that were written
+// so a failed write can be resumed from where it stopped
+func (u *incomingBlob) Write(b []byte) (int, error) {
+	n, err := u.file.Write(b)
+	u.hash.Write(b[:n])
+	u.offset += int64(n)
+	return n, err
+}
+
+// finish stores the upload as the blob with digest if it matches it, and
+// removes it either way
+func (u *incomingBlob) finish(digest string) error {
+	defer u.remove()
+
+	if err := u.file.Close(); err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("sha256:%x", u.hash.Sum(nil)); got != digest {
+		return fmt.Errorf("%w, expected %q, got %q", errBlobDigestMismatch, digest, got)
+	}
+
+	return storeBlob(digest, u.file.Name())
+}
+
+func (u *incomingBlob) remove() {
+	u.file.Close()
+	u.td.Remove()
+}
+
+// storeBlob moves src into storage as the blob with digest. Temporary
+// directories may be on another file system than the blobs, in which case
+// src is copied into the blobs directory first.
+func storeBlob(digest, src string) error {
+	st := storage()
+	err := st.WriteBlob(digest, src)
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return err
+	}
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(blobs, "sha256-")
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(temp, f); err != nil {
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return st.WriteBlob(digest, temp.Name())
+}
+
+// incomingBlobs are the partial uploads of blobs sent in ranges, by digest
+type incomingBlobs struct {
+	mu      sync.Mutex
+	uploads map[string]*incomingBlob
+}
+
+// acquire returns the partial upload of the blob with digest, starting it if
+// there isn't one, for the caller to write to. The upload is locked until
+// it's released.
+func (b *incomingBlobs) acquire(digest string, total int64) (*incomingBlob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if u, ok := b.uploads[digest]; ok {
+		if !u.mu.TryLock() {
+			return nil, errUploadInUse
+		}
+
+		if u.total != total {
+			u.mu.Unlock()
+			return nil, fmt.Errorf("blob is %d bytes, not %d as the upload started with", total, u.total)
+		}
+
+		u.idle.Stop()
+		return u, nil
+	}
+
+	u, err := newIncomingBlob(total)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	u.idle = time.AfterFunc(blobUploadIdle, func() { b.expire(digest, u) })
+	u.idle.Stop()
+
+	if b.uploads == nil {
+		b.uploads = make(map[string]*incomingBlob)
+	}
+	b.uploads[digest] = u
+	return u, nil
+}
+
+// release unlocks an upload, removing it if it's done or otherwise keeping
+// it for blobUploadIdle for the rest of it to be sent
+func (b *incomingBlobs) release(digest string, u *incomingBlob, done bool) {
+	if done {
+		b.mu.Lock()
+		if b.uploads[digest] == u {
+			delete(b.uploads, digest)
+		}
+		b.mu.Unlock()
+	} else {
+		u.idle.Reset(blobUploadIdle)
+	}
+
+	u.mu.Unlock()
+}
+
+func (b *incomingBlobs) expire(digest string, u *incomingBlob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.uploads[digest] != u || !u.mu.TryLock() {
+		// it's finished or being written to
+		return
+	}
+	defer u.mu.Unlock()
+
+	slog.Info("removing idle partial upload", "digest", digest, "offset", u.offset, "size", u.total)
+	delete(b.uploads, digest)
+	u.remove()
+}
+
+// offset returns how much of the blob with digest has been uploaded, if an
+// upload of it has started. It returns errUploadInUse while a request is
+// writing to the upload, as its offset isn't known until the request ends.
+func (b *incomingBlobs) offset(digest string) (int64, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	u, ok := b.uploads[digest]
+	if !ok {
+		return 0, false, nil
+	}
+
+	if !u.mu.TryLock() {
+		return 0, true, errUploadInUse
+	}
+	defer u.mu.Unlock()
+	return u.offset, true, nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/size", where end is inclusive
+func parseContentRange(s string) (start, end, size int64, err error) {
+	rest, ok := strings.CutPrefix(s, "bytes ")
+	rng, total, ok2 := strings.Cut(rest, "/")
+	first, last, ok3 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q, expected bytes start-end/size", s)
+	}
+
+	if start, err = strconv.ParseInt(first, 10, 64); err == nil {
+		if end, err = strconv.ParseInt(last, 10, 64); err == nil {
+			size, err = strconv.ParseInt(total, 10, 64)
+		}
+	}
+
+	if err != nil || start < 0 || end < start || end >= size {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q, expected bytes start-end/size", s)
+	}
+
+	return start, end, size, nil
+}
+
+// blobExists reports whether the blob with digest is stored, or is the
+// digest of a file that was converted to an intermediate blob that is
+func blobExists(digest string) (bool, error) {
+	if ib, ok := intermediateBlobs[digest]; ok {
+		_, err := storage().StatBlob(ib)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
+			delete(intermediateBlobs, digest)
+		case err != nil:
+			return false, err
+		default:
+			return true, nil
+		}
+	}
+
+	_, err := storage().StatBlob(digest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func blobTooLarge(c *gin.Context, limit uint64) {
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("blob is larger than the %s limit set by OLLAMA_MAX_BLOB_SIZE", format.HumanBytes2(limit))})
+}
+
+// HeadBlobHandler reports whether the server has a blob: 200 with its size if
+// it does, or 404 if it doesn't, with the Upload-Offset of its partial upload
+// if there is one, or 409 if a request is uploading part of it.
+func (s *Server) HeadBlobHandler(c *gin.Context) {
+	digest := c.Param("digest")
+	if _, err := GetBlobsPath(digest); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	ok, err := blobExists(digest)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if ok && s.blobUsable(c.Request.Context(), digest) {
+		if fi, err := storage().StatBlob(digest); err == nil {
+			c.Header("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	offset, ok, err := s.uploads.offset(digest)
+	if err != nil {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	} else if ok {
+		c.Header(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	}
+	c.AbortWithStatus(http.StatusNotFound)
+}
+
+// blobUsable reports whether the request's API key can use the blob with
+// digest, because a model it can use references the blob or it uploaded it
+func (s *Server) blobUsable(ctx context.Context, digest string) bool {
+	return blobInNamespace(ctx, digest) || s.owners.owns(ctx, digest)
+}
+
+// CreateBlobHandler stores the request body as the blob with the digest in
+// the path, or the range of it in the request's Content-Range. Ranges must be
+// sent in order, and each is answered with the Upload-Offset the next starts
+// at. A blob the request's API key can't use yet is uploaded and verified
+// even if the server has it, which proves the key has the blob.
+func (s *Server) CreateBlobHandler(c *gin.Context) {
+	digest := c.Param("digest")
+	if _, err := GetBlobsPath(digest); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if ok, err := blobExists(digest); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	} else if ok && s.blobUsable(c.Request.Context(), digest) {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	limit := envconfig.MaxBlobSize()
+	if limit > 0 && c.Request.ContentLength > int64(limit) {
+		blobTooLarge(c, limit)
+		return
+	}
+
+	if rng := c.GetHeader("Content-Range"); rng != "" {
+		s.createBlobRange(c, digest, rng, limit)
+		return
+	}
+
+	u, err := newIncomingBlob(c.Request.ContentLength)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	body := io.Reader(c.Request.Body)
+	if limit > 0 {
+		body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(limit))
+	}
+
+	if _, err := io.Copy(u, body); err != nil {
+		u.remove()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			blobTooLarge(c, limit)
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	s.finishBlob(c, digest, u)
+}
+
+func (s *Server) createBlobRange(c *gin.Context, digest, rng string, limit uint64) {
+	start, end, size, err := parseContentRange(rng)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if limit > 0 && size > int64(limit) {
+		blobTooLarge(c, limit)
+		return
+	}
+
+	if c.Request.ContentLength >= 0 && c.Request.ContentLength != end-start+1 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Content-Range %q doesn't match the body's %d bytes", rng, c.Request.ContentLength)})
+		return
+	}
+
+	u, err := s.uploads.acquire(digest, size)
+	if errors.Is(err, errUploadInUse) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if start != u.offset {
+		c.Header(uploadOffsetHeader, strconv.FormatInt(u.offset, 10))
+		s.uploads.release(digest, u, false)
+		c.AbortWithStatusJSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": fmt.Sprintf("upload is at offset %d, not %d", u.offset, start)})
+		return
+	}
+
+	// whatever was received is kept if the connection drops, so the range
+	// can be resumed from there
+	_, err = io.Copy(u, io.LimitReader(c.Request.Body, end-start+1))
+	if err == nil && u.offset <= end {
+		err = errUploadIncomplete
+	}
+
+	if err != nil {
+		c.Header(uploadOffsetHeader, strconv.FormatInt(u.offset, 10))
+		s.uploads.release(digest, u, false)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if u.offset < size {
+		c.Header(uploadOffsetHeader, strconv.FormatInt(u.offset, 10))
+		s.uploads.release(digest, u, false)
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	s.finishBlob(c, digest, u)
+	s.uploads.release(digest, u, true)
+}
+
+func (s *Server) finishBlob(c *gin.Context, digest string, u *incomingBlob) {
+	if err := u.finish(digest); errors.Is(err, errBlobDigestMismatch) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.owners.add(c.Request.Context(), digest)
+	c.Status(http.StatusCreated)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func blobDigest(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+func TestCreateBlob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_TMPDIR", t.TempDir())
+	t.Setenv("OLLAMA_MAX_BLOB_SIZE", "1KiB")
+
+	var s Server
+	ts := httptest.NewServer(s.GenerateRoutes())
+	defer ts.Close()
+
+	send := func(t *testing.T, method, digest, contentRange string, body []byte) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, ts.URL+"/api/blobs/"+digest, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if contentRange != "" {
+			r.Header.Set("Content-Range", contentRange)
+		}
+
+		resp, err := ts.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	blob := bytes.Repeat([]byte("0123456789"), 30)
+	digest := blobDigest(blob)
+
+	t.Run("head", func(t *testing.T) {
+		if resp := send(t, http.MethodHead, "sha256:invalid", "", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for an invalid digest, got %d", resp.StatusCode)
+		}
+
+		if resp := send(t, http.MethodHead, digest, "", nil); resp.StatusCode != http.StatusNotFound || resp.Header.Get(uploadOffsetHeader) != "" {
+			t.Errorf("expected status 404 without an offset, got %d %v", resp.StatusCode, resp.Header)
+		}
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		if resp := send(t, http.MethodPost, digest, "", append(blob, 'x')); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", resp.StatusCode)
+		}
+
+		// neither the upload nor a blob of what was uploaded is kept
+		if _, err := storage().StatBlob(blobDigest(append(blob, 'x'))); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the mismatched upload to be discarded, got %v", err)
+		}
+
+		if dirs, _ := filepath.Glob(filepath.Join(tempBase(), tempDirPrefix+"*")); len(dirs) != 0 {
+			t.Errorf("expected the upload's temporary directory to be removed, got %v", dirs)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		large := bytes.Repeat([]byte("a"), 2048)
+		if resp := send(t, http.MethodPost, blobDigest(large), "", large); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413, got %d", resp.StatusCode)
+		}
+
+		if resp := send(t, http.MethodPost, blobDigest(large), "bytes 0-99/2048", large[:100]); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413 for a range of a large blob, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("ranges", func(t *testing.T) {
+		if resp := send(t, http.MethodPost, digest, "bytes 100-199/300", blob[100:200]); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get(uploadOffsetHeader) != "0" {
+			t.Errorf("expected status 416 at offset 0, got %d %v", resp.StatusCode, resp.Header)
+		}
+
+		if resp := send(t, http.MethodPost, digest, "bytes 0-99/300", blob[:100]); resp.StatusCode != http.StatusAccepted || resp.Header.Get(uploadOffsetHeader) != "100" {
+			t.Errorf("expected status 202 at offset 100, got %d %v", resp.StatusCode, resp.Header)
+		}
+
+		if resp := send(t, http.MethodHead, digest, "", nil); resp.StatusCode != http.StatusNotFound || resp.Header.Get(uploadOffsetHeader) != "100" {
+			t.Errorf("expected status 404 at offset 100, got %d %v", resp.StatusCode, resp.Header)
+		}
+
+		if resp := send(t, http.MethodPost, digest, "bytes 0-99/300", blob[:100]); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get(uploadOffsetHeader) != "100" {
+			t.Errorf("expected status 416 at offset 100, got %d %v", resp.StatusCode, resp.Header)
+		}
+
+		if resp := send(t, http.MethodPost, digest, "bytes 100-299/301", blob[100:]); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for a different size, got %d", resp.StatusCode)
+		}
+
+		if resp := send(t, http.MethodPost, digest, "bytes 100-299/300", blob[100:]); resp.StatusCode != http.StatusCreated {
+			t.Errorf("expected status 201, got %d", resp.StatusCode)
+		}
+
+		resp := send(t, http.MethodHead, digest, "", nil)
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(blob)) {
+			t.Errorf("expected status 200 with the blob's size, got %d %d", resp.StatusCode, resp.ContentLength)
+		}
+
+		if resp := send(t, http.MethodPost, digest, "bytes 0-99/300", blob[:100]); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200 for a blob that exists, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		idle := blobUploadIdle
+		blobUploadIdle = 10 * time.Millisecond
+		t.Cleanup(func() { blobUploadIdle = idle })
+
+		other := []byte("an upload that's never finished")
+		if resp := send(t, http.MethodPost, blobDigest(other), "bytes 0-9/31", other[:10]); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d", resp.StatusCode)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if resp := send(t, http.MethodHead, blobDigest(other), "", nil); resp.Header.Get(uploadOffsetHeader) == "" {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatal("expected the idle upload to be removed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if dirs, _ := filepath.Glob(filepath.Join(tempBase(), tempDirPrefix+"*")); len(dirs) != 0 {
+			t.Errorf("expected the upload's temporary directory to be removed, got %v", dirs)
+		}
+	})
+}
+
+func TestParseContentRange(t *testing.T) {
+	cases := []struct {
+		value             string
+		start, end, total int64
+		err               bool
+	}{
+		{value: "bytes 0-99/300", start: 0, end: 99, total: 300},
+		{value: "bytes 299-299/300", start: 299, end: 299, total: 300},
+		{value: "bytes 0-300/300", err: true},
+		{value: "bytes 10-9/300", err: true},
+		{value: "bytes -1-9/300", err: true},
+		{value: "bytes 0-99/*", err: true},
+		{value: "0-99/300", err: true},
+		{value: "bytes 0-99", err: true},
+	}
+
+	for _, tt := range cases {
+		start, end, total, err := parseContentRange(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.value)
+			}
+			continue
+		}
+
+		if err != nil || start != tt.start || end != tt.end || total != tt.total {
+			t.Errorf("%q: expected %d-%d/%d, got %d-%d/%d %v", tt.value, tt.start, tt.end, tt.total, start, end, total, err)
+		}
+	}
+}
+
+// flakyTransport drops the connection of the second ranged upload partway
+// through its body
+type flakyTransport struct {
+	requests atomic.Int32
+}
+
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("connection dropped")
+	}
+
+	n, err := f.r.Read(b[:min(len(b), f.n)])
+	f.n -= n
+	return n, err
+}
+
+func (t *flakyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("Content-Range") != "" && t.requests.Add(1) == 2 {
+		r = r.Clone(r.Context())
+		r.Body = io.NopCloser(&failingReader{r: r.Body, n: 100})
+	}
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestCreateBlobResume(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_TMPDIR", t.TempDir())
+
+	chunk := api.BlobChunkSize
+	api.BlobChunkSize = 1024
+	t.Cleanup(func() { api.BlobChunkSize = chunk })
+
+	var s Server
+	ts := httptest.NewServer(s.GenerateRoutes())
+	defer ts.Close()
+
+	base, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var transport flakyTransport
+	client := api.NewClient(base, &http.Client{Transport: &transport})
+
+	blob := []byte(strings.Repeat("resumable uploads ", 300))
+	digest := blobDigest(blob)
+	if err := client.CreateBlob(context.Background(), digest, bytes.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := transport.requests.Load(); n < 6 {
+		t.Errorf("expected the blob to be uploaded in chunks with one retried, got %d requests", n)
+	}
+
+	r, err := client.Blob(context.Background(), digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("expected the uploaded blob, got %d bytes %v", len(got), err)
+	}
+
+	// the blob isn't uploaded again
+	requests := transport.requests.Load()
+	if err := client.CreateBlob(context.Background(), digest, bytes.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := transport.requests.Load(); n != requests {
+		t.Errorf("expected no more uploads of a blob that exists, got %d", n-requests)
+	}
+}
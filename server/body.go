@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/format"
+)
+
+// maxPooledBody bounds the buffers kept in bodyPool, so a single oversized
+// request doesn't pin its memory after it's decoded
+const maxPooledBody = 64 * format.MebiByte
+
+// bodyPool holds the buffers request bodies are read into before they're
+// decoded. Multimodal requests are dominated by their base64 encoded images,
+// so reusing buffers avoids growing a new one per request.
+var bodyPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// bindJSON decodes the request body into v like c.ShouldBindJSON, but reads
+// the body into a pooled buffer sized from its content length instead of
+// letting the decoder repeatedly grow its own. Bodies over
+// OLLAMA_MAX_REQUEST_BODY have already been rejected by maxBodyMiddleware, so
+// nothing is decoded for them. Decoding copies everything out of the buffer,
+// including images, so it's returned to the pool before bindJSON returns.
+func bindJSON(c *gin.Context, v any) error {
+	if c.Request.Body == nil {
+		return io.EOF
+	}
+
+	buf := bodyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBody {
+			bodyPool.Put(buf)
+		}
+	}()
+
+	// Leave room for the final read that finds the end of the body, which
+	// would otherwise grow the buffer again
+	if n := c.Request.ContentLength; n > 0 {
+		buf.Grow(int(n) + bytes.MinRead)
+	}
+
+	if _, err := buf.ReadFrom(c.Request.Body); err != nil {
+		return err
+	}
+
+	if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+		return io.EOF
+	}
+
+	return json.Unmarshal(buf.Bytes(), v)
+}
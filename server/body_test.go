@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+)
+
+func imageRequest(tb testing.TB, size int) (api.GenerateRequest, []byte) {
+	tb.Helper()
+	image := make([]byte, size)
+	if _, err := rand.Read(image); err != nil {
+		tb.Fatal(err)
+	}
+
+	req := api.GenerateRequest{Model: "test", Prompt: "describe this image", Images: []api.ImageData{image}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return req, body
+}
+
+func bindContext(body []byte) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(body))
+	return c
+}
+
+func TestBindJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("empty", func(t *testing.T) {
+		var req api.GenerateRequest
+		if err := bindJSON(bindContext([]byte(" \n")), &req); !errors.Is(err, io.EOF) {
+			t.Errorf("expected io.EOF for an empty body, got %v", err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var req api.GenerateRequest
+		if err := bindJSON(bindContext([]byte(`{"model": `)), &req); err == nil {
+			t.Error("expected an error for an invalid body")
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		// Decoded images must not share memory with the pooled buffers, which
+		// are reused by the requests that follow
+		type result struct {
+			expect, actual api.GenerateRequest
+		}
+
+		var mu sync.Mutex
+		var results []result
+		var wg sync.WaitGroup
+		for i := range 16 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 10 {
+					expect, body := imageRequest(t, 64*format.KibiByte+i)
+					var actual api.GenerateRequest
+					if err := bindJSON(bindContext(body), &actual); err != nil {
+						t.Error(err)
+						return
+					}
+
+					mu.Lock()
+					results = append(results, result{expect, actual})
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		for _, r := range results {
+			if len(r.actual.Images) != 1 || !bytes.Equal(r.actual.Images[0], r.expect.Images[0]) {
+				t.Fatal("image was corrupted by another request")
+			}
+		}
+	})
+}
+
+// BenchmarkBindJSON compares decoding a request with an image with
+// c.ShouldBindJSON, as requests were decoded before, with bindJSON
+func BenchmarkBindJSON(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+
+	for _, size := range []int{4 * format.MebiByte, 20 * format.MebiByte} {
+		_, body := imageRequest(b, size)
+
+		b.Run(fmt.Sprintf("ShouldBindJSON/%dMiB", size/format.MebiByte), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				var req api.GenerateRequest
+				if err := bindContext(body).ShouldBindJSON(&req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("bindJSON/%dMiB", size/format.MebiByte), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				var req api.GenerateRequest
+				if err := bindJSON(bindContext(body), &req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
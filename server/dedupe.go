@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// storeMu keeps maintenance of the blob store from racing the pulls and
+// deletes that change it. Pulls and deletes only read lock it, so they still
+// run alongside each other, while dedupe holds it exclusively.
+var storeMu sync.RWMutex
+
+var blobNamePattern = regexp.MustCompile("^sha256-[0-9a-fA-F]{64}$")
+
+// link is replaced in tests to simulate filesystems without hardlinks
+var link = os.Link
+
+var errDedupeDir = errors.New("directory isn't in OLLAMA_DEDUPE_DIRS")
+
+// dedupeBlobs finds blobs stored more than once across the models directory
+// and dirs, which are other models directories such as copies of the store
+// and must be listed in OLLAMA_DEDUPE_DIRS. Unless dryRun is set, each
+// duplicate is replaced with a hardlink to the first copy found, with the
+// models directory searched first. Only copies whose content matches their
+// digest are linked, and duplicates that can't be linked, such as across
+// filesystems, are only reported.
+func dedupeBlobs(dirs []string, dryRun bool) (*api.DedupeResponse, error) {
+	allowed := envconfig.DedupeDirs()
+	for _, dir := range dirs {
+		if !slices.Contains(allowed, filepath.Clean(dir)) {
+			return nil, fmt.Errorf("%w: %s", errDedupeDir, dir)
+		}
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	unlock, err := lockStore(context.Background(), storeLockName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dirs = append([]string{envconfig.Models()}, dirs...)
+
+	var digests []string
+	paths := make(map[string][]string)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(filepath.Join(dir, "blobs"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || !blobNamePattern.MatchString(entry.Name()) {
+				continue
+			}
+
+			if _, ok := paths[entry.Name()]; !ok {
+				digests = append(digests, entry.Name())
+			}
+			paths[entry.Name()] = append(paths[entry.Name()], filepath.Join(dir, "blobs", entry.Name()))
+		}
+	}
+
+	resp := api.DedupeResponse{Duplicates: []api.DuplicateBlob{}}
+	for _, digest := range digests {
+		if len(paths[digest]) < 2 {
+			continue
+		}
+
+		first, err := os.Stat(paths[digest][0])
+		if err != nil {
+			return nil, err
+		}
+
+		// The first copy is only hashed once a duplicate needs it
+		var targetChecked bool
+		for _, path := range paths[digest][1:] {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+
+			if os.SameFile(first, fi) {
+				continue
+			}
+
+			if fi.Size() != first.Size() {
+				slog.Warn("skipping blob with mismatched size", "digest", digest, "path", path, "size", fi.Size(), "expected", first.Size())
+				continue
+			}
+
+			// Names and sizes are easily matched by a corrupt or planted
+			// file, which mustn't be linked over a good copy, or replaced
+			// by a bad one
+			if !targetChecked {
+				if err := checkBlob(paths[digest][0], digest); err != nil {
+					slog.Warn("skipping blob that doesn't match its digest", "digest", digest, "path", paths[digest][0], "error", err)
+					break
+				}
+				targetChecked = true
+			}
+
+			if err := checkBlob(path, digest); err != nil {
+				slog.Warn("skipping blob that doesn't match its digest", "digest", digest, "path", path, "error", err)
+				continue
+			}
+
+			dup := api.DuplicateBlob{
+				Digest: digest,
+				Path:   path,
+				Target: paths[digest][0],
+				Size:   fi.Size(),
+			}
+
+			if !dryRun {
+				if err := linkBlob(paths[digest][0], path); err != nil {
+					slog.Info("couldn't link duplicate blob", "digest", digest, "path", path, "error", err)
+				} else {
+					dup.Linked = true
+					resp.Reclaimed += fi.Size()
+				}
+			}
+
+			resp.Total += fi.Size()
+			resp.Duplicates = append(resp.Duplicates, dup)
+		}
+	}
+
+	return &resp, nil
+}
+
+// checkBlob hashes the blob file at path, failing if it doesn't match the
+// digest it's named for
+func checkBlob(path, digest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("sha256-%x", h.Sum(nil)); !strings.EqualFold(got, digest) {
+		return fmt.Errorf("%w: want %s, got %s", errDigestMismatch, digest, got)
+	}
+	return nil
+}
+
+// linkBlob replaces path with a hardlink to target. The link is created
+// beside path first and renamed over it, so path is never missing.
+func linkBlob(target, path string) error {
+	tmp := fmt.Sprintf("%s-dedupe", path)
+	if err := link(target, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeBlob(t *testing.T, dir string, data string) string {
+	t.Helper()
+	digest := fmt.Sprintf("sha256-%x", sha256.Sum256([]byte(data)))
+	path := filepath.Join(dir, "blobs", digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	fa, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fb, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(fa, fb)
+}
+
+func TestDedupeBlobs(t *testing.T) {
+	setup := func(t *testing.T) (models, other, shared string) {
+		t.Helper()
+		models, other = t.TempDir(), t.TempDir()
+		t.Setenv("OLLAMA_MODELS", models)
+		t.Setenv("OLLAMA_DEDUPE_DIRS", other)
+
+		shared = writeBlob(t, models, "shared")
+		writeBlob(t, other, "shared")
+		writeBlob(t, models, "models only")
+		writeBlob(t, other, "other only")
+
+		// partial downloads aren't blobs
+		if err := os.WriteFile(filepath.Join(other, "blobs", shared+"-partial"), []byte("shared"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return models, other, shared
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		models, other, shared := setup(t)
+
+		resp, err := dedupeBlobs([]string{other}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Duplicates) != 1 || resp.Duplicates[0].Digest != shared || resp.Duplicates[0].Linked {
+			t.Fatalf("unexpected duplicates %+v", resp.Duplicates)
+		}
+
+		if resp.Total != int64(len("shared")) || resp.Reclaimed != 0 {
+			t.Errorf("expected %d bytes found and none reclaimed, got %d and %d", len("shared"), resp.Total, resp.Reclaimed)
+		}
+
+		if sameFile(t, filepath.Join(models, "blobs", shared), filepath.Join(other, "blobs", shared)) {
+			t.Error("expected a dry run not to link blobs")
+		}
+	})
+
+	t.Run("link", func(t *testing.T) {
+		models, other, shared := setup(t)
+
+		resp, err := dedupeBlobs([]string{other}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Duplicates) != 1 || !resp.Duplicates[0].Linked {
+			t.Fatalf("unexpected duplicates %+v", resp.Duplicates)
+		}
+
+		if resp.Reclaimed != int64(len("shared")) {
+			t.Errorf("expected %d bytes reclaimed, got %d", len("shared"), resp.Reclaimed)
+		}
+
+		if !sameFile(t, filepath.Join(models, "blobs", shared), filepath.Join(other, "blobs", shared)) {
+			t.Error("expected the duplicate to be linked to the models directory")
+		}
+
+		if _, err := os.Stat(filepath.Join(other, "blobs", shared+"-dedupe")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the temporary link to be renamed, got %v", err)
+		}
+
+		// blobs that are already linked aren't duplicates
+		resp, err = dedupeBlobs([]string{other}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Duplicates) != 0 || resp.Total != 0 {
+			t.Errorf("expected no duplicates once linked, got %+v", resp.Duplicates)
+		}
+	})
+
+	t.Run("no hardlinks", func(t *testing.T) {
+		models, other, shared := setup(t)
+
+		link = func(string, string) error { return &os.LinkError{Op: "link", Err: errors.ErrUnsupported} }
+		t.Cleanup(func() { link = os.Link })
+
+		resp, err := dedupeBlobs([]string{other}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Duplicates) != 1 || resp.Duplicates[0].Linked {
+			t.Fatalf("expected the duplicate to be reported but not linked, got %+v", resp.Duplicates)
+		}
+
+		if resp.Total != int64(len("shared")) || resp.Reclaimed != 0 {
+			t.Errorf("expected %d bytes found and none reclaimed, got %d and %d", len("shared"), resp.Total, resp.Reclaimed)
+		}
+
+		if sameFile(t, filepath.Join(models, "blobs", shared), filepath.Join(other, "blobs", shared)) {
+			t.Error("expected blobs not to be linked")
+		}
+
+		if b, err := os.ReadFile(filepath.Join(other, "blobs", shared)); err != nil || string(b) != "shared" {
+			t.Errorf("expected the duplicate to be untouched, got %q, %v", b, err)
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		_, other, _ := setup(t)
+		t.Setenv("OLLAMA_DEDUPE_DIRS", "")
+
+		if _, err := dedupeBlobs([]string{other}, false); !errors.Is(err, errDedupeDir) {
+			t.Errorf("expected directories outside OLLAMA_DEDUPE_DIRS to be rejected, got %v", err)
+		}
+
+		// the models directory itself is always searched
+		if _, err := dedupeBlobs(nil, false); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("mismatched digest", func(t *testing.T) {
+		models, other, shared := setup(t)
+
+		// a file of the same name and size that isn't the blob
+		corrupt := writeBlob(t, models, "corrupt")
+		if err := os.WriteFile(filepath.Join(other, "blobs", corrupt), []byte("CORRUPT"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		// and the same the other way around
+		planted := writeBlob(t, other, "planted")
+		if err := os.WriteFile(filepath.Join(models, "blobs", planted), []byte("PLANTED"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := dedupeBlobs([]string{other}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Duplicates) != 1 || resp.Duplicates[0].Digest != shared {
+			t.Fatalf("expected only the matching blob to be a duplicate, got %+v", resp.Duplicates)
+		}
+
+		for _, digest := range []string{corrupt, planted} {
+			if sameFile(t, filepath.Join(models, "blobs", digest), filepath.Join(other, "blobs", digest)) {
+				t.Errorf("expected %s not to be linked", digest)
+			}
+		}
+	})
+
+	t.Run("waits for pulls", func(t *testing.T) {
+		_, other, _ := setup(t)
+
+		storeMu.RLock()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, err := dedupeBlobs([]string{other}, false); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("expected dedupe to wait for the pull to finish")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		storeMu.RUnlock()
+		<-done
+	})
+}
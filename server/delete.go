@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+// reclaimable returns the size of the blobs used by the models named names
+// that no other model uses, which is the disk space deleting them reclaims
+func reclaimable(names []model.Name) (int64, error) {
+	ms, err := Manifests()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := make(map[string]bool)
+	for _, n := range names {
+		deleted[n.Filepath()] = true
+	}
+
+	used := make(map[string]bool)
+	for n, m := range ms {
+		if deleted[n.Filepath()] {
+			continue
+		}
+
+		for _, layer := range m.allLayers() {
+			used[layer.Digest] = true
+		}
+	}
+
+	var size int64
+	for n, m := range ms {
+		if !deleted[n.Filepath()] {
+			continue
+		}
+
+		for _, layer := range m.allLayers() {
+			if layer.Digest == "" || used[layer.Digest] {
+				continue
+			}
+
+			// count layers shared between the deleted models once
+			used[layer.Digest] = true
+
+			p, err := GetBlobsPath(layer.Digest)
+			if err != nil {
+				return 0, err
+			}
+
+			fi, err := os.Stat(p)
+			if errors.Is(err, fs.ErrNotExist) {
+				// not pulled, such as a variant
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+
+			size += fi.Size()
+		}
+	}
+
+	return size, nil
+}
+
+// loadedAs returns the runners loaded for the model named n
+func (s *Scheduler) loadedAs(n model.Name) []*runnerRef {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+
+	var runners []*runnerRef
+	for _, r := range s.loaded {
+		if r.model != nil && model.ParseName(r.model.ShortName).Filepath() == n.Filepath() {
+			runners = append(runners, r)
+		}
+	}
+
+	return runners
+}
@@ -0,0 +1,18 @@
+package server
+
+import "golang.org/x/sys/windows"
+
+// diskFree returns the bytes available to the user on the volume of dir
+func diskFree(dir string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+
+	return free, nil
+}
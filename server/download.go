@@ -23,6 +23,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 )
 
@@ -209,7 +210,6 @@ func newBackoff(maxBackoff time.Duration) func(ctx context.Context) error {
 
 func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *registryOptions) error {
 	defer blobDownloadManager.Delete(b.Digest)
-	ctx, b.CancelFunc = context.WithCancel(ctx)
 
 	file, err := os.OpenFile(b.Name+"-partial", os.O_CREATE|os.O_RDWR, 0o644)
 	if err != nil {
@@ -289,7 +289,9 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 				case err != nil:
 					sleep := time.Second * time.Duration(math.Pow(2, float64(try)))
 					slog.Info(fmt.Sprintf("%s part %d attempt %d failed: %v, retrying in %s", b.Digest[7:19], part.N, try, err, sleep))
-					time.Sleep(sleep)
+					if err := sleepContext(inner, sleep); err != nil {
+						return err
+					}
 					continue
 				default:
 					return nil
@@ -315,22 +317,22 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 		}
 	}
 
-	if err := os.Rename(file.Name(), b.Name); err != nil {
-		return err
-	}
-
-	return nil
+	return storage().WriteBlob(b.Digest, file.Name())
 }
 
 func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w io.Writer, part *blobDownloadPart) error {
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
+		if envconfig.Offline() {
+			return errOffline
+		}
+
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
 		if err != nil {
 			return err
 		}
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.StartsAt(), part.StopsAt()-1))
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := (&http.Client{Transport: registryTransport}).Do(req)
 		if err != nil {
 			return err
 		}
@@ -434,9 +436,22 @@ func (b *blobDownload) Wait(ctx context.Context, fn func(api.ProgressResponse))
 	defer b.release()
 
 	ticker := time.NewTicker(60 * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-b.done:
+			if b.err == nil {
+				// the last progress is always reported, so a finished
+				// download is seen as complete
+				fn(api.ProgressResponse{
+					Status:    fmt.Sprintf("pulling %s", b.Digest[7:19]),
+					Digest:    b.Digest,
+					Total:     b.Total,
+					Completed: b.Total,
+					Phase:     api.PhaseDownloading,
+					Source:    api.SourceRegistry,
+				})
+			}
 			return b.err
 		case <-ticker.C:
 			fn(api.ProgressResponse{
@@ -444,6 +459,8 @@ func (b *blobDownload) Wait(ctx context.Context, fn func(api.ProgressResponse))
 				Digest:    b.Digest,
 				Total:     b.Total,
 				Completed: b.Completed.Load(),
+				Phase:     api.PhaseDownloading,
+				Source:    api.SourceRegistry,
 			})
 		case <-ctx.Done():
 			return ctx.Err()
@@ -452,20 +469,24 @@ func (b *blobDownload) Wait(ctx context.Context, fn func(api.ProgressResponse))
 }
 
 type downloadOpts struct {
-	mp      ModelPath
-	digest  string
+	mp     ModelPath
+	digest string
+	// size is the blob's size from its manifest, or zero if it isn't known,
+	// in which case it isn't downloaded from peers
+	size    int64
 	regOpts *registryOptions
 	fn      func(api.ProgressResponse)
 }
 
-// downloadBlob downloads a blob from the registry and stores it in the blobs directory
+// downloadBlob downloads a blob from a LAN peer that has it, or else from the
+// registry, and stores it in the blobs directory
 func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ error) {
 	fp, err := GetBlobsPath(opts.digest)
 	if err != nil {
 		return false, err
 	}
 
-	fi, err := os.Stat(fp)
+	fi, err := storage().StatBlob(opts.digest)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
 	case err != nil:
@@ -476,11 +497,16 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 			Digest:    opts.digest,
 			Total:     fi.Size(),
 			Completed: fi.Size(),
+			Phase:     api.PhaseDownloading,
 		})
 
 		return true, nil
 	}
 
+	if envconfig.P2P() && downloadFromPeer(ctx, opts) {
+		return false, nil
+	}
+
 	data, ok := blobDownloadManager.LoadOrStore(opts.digest, &blobDownload{Name: fp, Digest: opts.digest})
 	download := data.(*blobDownload)
 	if !ok {
@@ -491,9 +517,27 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 			return false, err
 		}
 
+		// the download outlives the pull that started it while other pulls
+		// are waiting for it, and is cancelled once none are
 		//nolint:contextcheck
-		go download.Run(context.Background(), requestURL, opts.regOpts)
+		runCtx, cancel := context.WithCancel(context.Background())
+		download.CancelFunc = cancel
+		go download.Run(runCtx, requestURL, opts.regOpts)
 	}
 
 	return false, download.Wait(ctx, opts.fn)
 }
+
+// sleepContext sleeps for d, returning early with ctx's error if it's
+// cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelsVersion counts the changes this server makes to manifests and blobs,
+// so clients of /api/tags and /api/show can tell whether their responses
+// changed. Manifests changed by other servers sharing the models directory
+// are caught by their digests and modification times instead.
+var modelsVersion atomic.Uint64
+
+// etag returns the entity tag of a response described by parts, which must
+// include everything the response depends on
+func etag(parts ...any) string {
+	h := sha256.New()
+	for _, part := range parts {
+		if err := json.NewEncoder(h).Encode(part); err != nil {
+			panic(err)
+		}
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// notModified sets the ETag header of c's response to tag and reports whether
+// the request's If-None-Match has it, in which case it responds 304 Not
+// Modified and the handler shouldn't respond
+func notModified(c *gin.Context, tag string) bool {
+	c.Header("ETag", tag)
+
+	for _, match := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == tag || match == "*" {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
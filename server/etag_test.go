@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// conditionalRequest is createRequest with the If-None-Match tag
+func conditionalRequest(t *testing.T, fn func(*gin.Context), body any, tag string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(body); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Request = &http.Request{
+		URL:    &url.URL{},
+		Header: http.Header{},
+		Body:   io.NopCloser(&b),
+	}
+
+	if tag != "" {
+		c.Request.Header.Set("If-None-Match", tag)
+	}
+
+	fn(c)
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func TestListETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	create := func(name string) {
+		t.Helper()
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+			Stream:    &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	create("test")
+
+	w := conditionalRequest(t, s.ListHandler, nil, "")
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || tag == "" {
+		t.Fatalf("expected a tagged response, got %d %q", w.Code, tag)
+	}
+
+	if w := conditionalRequest(t, s.ListHandler, nil, tag); w.Code != http.StatusNotModified || w.Body.Len() > 0 {
+		t.Errorf("expected status 304 without a body, got %d %s", w.Code, w.Body)
+	}
+
+	if w := conditionalRequest(t, s.ListHandler, nil, `"other", W/`+tag); w.Code != http.StatusNotModified {
+		t.Errorf("expected a weak tag in a list to match, got %d", w.Code)
+	}
+
+	for _, change := range []struct {
+		name string
+		fn   func()
+	}{
+		{"create", func() { create("test2") }},
+		{"copy", func() { createRequest(t, s.CopyHandler, api.CopyRequest{Source: "test", Destination: "test3"}) }},
+		{"delete", func() { createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "test3"}) }},
+	} {
+		if w := conditionalRequest(t, s.ListHandler, nil, tag); w.Code != http.StatusNotModified {
+			t.Fatalf("%s: expected status 304 before the change, got %d", change.name, w.Code)
+		}
+
+		change.fn()
+
+		if w := conditionalRequest(t, s.ListHandler, nil, tag); w.Code != http.StatusOK {
+			t.Errorf("%s: expected the models to change, got %d", change.name, w.Code)
+		} else {
+			tag = w.Header().Get("ETag")
+		}
+	}
+}
+
+func TestPsETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+	w := conditionalRequest(t, s.PsHandler, nil, "")
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || tag == "" {
+		t.Fatalf("expected a tagged response, got %d %q", w.Code, tag)
+	}
+
+	if w := conditionalRequest(t, s.PsHandler, nil, tag); w.Code != http.StatusNotModified {
+		t.Errorf("expected status 304, got %d", w.Code)
+	}
+
+	s.sched.version.Add(1)
+	if w := conditionalRequest(t, s.PsHandler, nil, tag); w.Code != http.StatusOK {
+		t.Errorf("expected the runners to change, got %d", w.Code)
+	}
+}
+
+func TestShowETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:     "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	w = conditionalRequest(t, s.ShowHandler, api.ShowRequest{Model: "test"}, "")
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || tag == "" {
+		t.Fatalf("expected a tagged response, got %d %q", w.Code, tag)
+	}
+
+	if w := conditionalRequest(t, s.ShowHandler, api.ShowRequest{Model: "test"}, tag); w.Code != http.StatusNotModified {
+		t.Errorf("expected status 304, got %d", w.Code)
+	}
+
+	if w := conditionalRequest(t, s.ShowHandler, api.ShowRequest{Model: "test", Verbose: true}, tag); w.Code != http.StatusOK {
+		t.Errorf("expected a different request to have a different tag, got %d", w.Code)
+	}
+}
@@ -0,0 +1,496 @@
+package server
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+var errGenerationEvicted = errors.New("generation evicted")
+
+// generationOrphanTimeout is how long a generation that has been followed
+// keeps running once neither the client that started it nor any follower is
+// attached, giving a client that reloads time to attach again
+const generationOrphanTimeout = 10 * time.Second
+
+// generation is the buffered stream of a streamed generate or chat request,
+// which other clients of the same API key or address can follow by its id
+type generation struct {
+	id string
+
+	// key and ip identify the client that started the generation. Only
+	// requests with the same API key, or from the same address if the server
+	// doesn't use keys, can follow it.
+	key *apiKey
+	ip  string
+
+	// ctx is the context the generation runs with. It's cancelled with the
+	// request that started the generation until a follower attaches, and
+	// after that only once every client has left it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// merge combines the generation's chunks into a single response
+	merge func(lines [][]byte) (any, error)
+
+	// teed is set once the generation's responses are buffered by tee
+	teed bool
+
+	mu     sync.Mutex
+	lines  [][]byte
+	size   uint64
+	done   bool
+	gone   bool // evicted, its lines dropped
+	notify chan struct{}
+
+	clients  int
+	followed bool
+	orphan   *time.Timer
+
+	expires time.Time
+	elem    *list.Element
+}
+
+// generationStore keeps the chunks of streamed generations while they run
+// and for ttl after, evicting the oldest generations once their chunks take
+// more than size bytes
+type generationStore struct {
+	size uint64
+	ttl  time.Duration
+
+	mu          sync.Mutex
+	generations map[string]*generation
+	order       *list.List // oldest at the back
+	used        uint64
+}
+
+// newGenerationStore returns a store of size bytes of chunks kept for ttl,
+// or nil if size is zero, which disables following generations
+func newGenerationStore(size uint64, ttl time.Duration) *generationStore {
+	if size == 0 {
+		return nil
+	}
+
+	return &generationStore{
+		size:        size,
+		ttl:         ttl,
+		generations: make(map[string]*generation),
+		order:       list.New(),
+	}
+}
+
+// start begins buffering a generation for the streamed request c, returning
+// nil if the store is disabled or the request isn't streamed on the native
+// API. The generation runs with its own context, which outlives c only once
+// a follower has attached.
+func (s *generationStore) start(c *gin.Context, stream *bool, merge func([][]byte) (any, error)) *generation {
+	if s == nil || stream != nil && !*stream || !strings.HasPrefix(c.FullPath(), "/api/") {
+		return nil
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b) //nolint:errcheck
+
+	reqCtx := c.Request.Context()
+	ctx, cancel := context.WithCancel(context.WithoutCancel(reqCtx))
+	g := &generation{
+		id:      hex.EncodeToString(b),
+		ip:      c.RemoteIP(),
+		ctx:     ctx,
+		cancel:  cancel,
+		merge:   merge,
+		notify:  make(chan struct{}),
+		clients: 1,
+	}
+	g.key, _ = reqCtx.Value(apiKeyContextKey{}).(*apiKey)
+
+	s.mu.Lock()
+	s.expireLocked()
+	g.elem = s.order.PushFront(g)
+	s.generations[g.id] = g
+	s.mu.Unlock()
+
+	go func() {
+		select {
+		case <-reqCtx.Done():
+			g.leave()
+		case <-ctx.Done():
+		}
+	}()
+
+	return g
+}
+
+// expireLocked removes the finished generations whose ttl has passed
+func (s *generationStore) expireLocked() {
+	now := time.Now()
+	for e := s.order.Back(); e != nil; {
+		prev := e.Prev()
+		g := e.Value.(*generation)
+		g.mu.Lock()
+		expired := g.done && now.After(g.expires)
+		g.mu.Unlock()
+		if expired {
+			s.removeLocked(g)
+		}
+		e = prev
+	}
+}
+
+func (s *generationStore) removeLocked(g *generation) {
+	s.order.Remove(g.elem)
+	delete(s.generations, g.id)
+
+	g.mu.Lock()
+	s.used -= g.size
+	g.lines, g.size, g.gone = nil, 0, true
+	close(g.notify)
+	g.notify = make(chan struct{})
+	g.mu.Unlock()
+}
+
+// get returns the generation id if c's client may follow it
+func (s *generationStore) get(c *gin.Context, id string) (*generation, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	g, ok := s.generations[id]
+	if !ok {
+		return nil, false
+	}
+
+	if k, _ := c.Request.Context().Value(apiKeyContextKey{}).(*apiKey); k != g.key || k == nil && c.RemoteIP() != g.ip {
+		return nil, false
+	}
+
+	return g, true
+}
+
+// append buffers line, a chunk of g, evicting the oldest generations if the
+// store is over its size
+func (s *generationStore) append(g *generation, line []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g.mu.Lock()
+	if g.gone {
+		g.mu.Unlock()
+		return
+	}
+
+	g.lines = append(g.lines, line)
+	g.size += uint64(len(line))
+	close(g.notify)
+	g.notify = make(chan struct{})
+	g.mu.Unlock()
+
+	s.used += uint64(len(line))
+	for s.used > s.size && s.order.Len() > 0 {
+		oldest := s.order.Back().Value.(*generation)
+		slog.Debug("evicting buffered generation", "id", oldest.id, "size", oldest.size)
+		s.removeLocked(oldest)
+	}
+}
+
+// finish marks g done, to be kept for the store's ttl
+func (s *generationStore) finish(g *generation) {
+	g.cancel()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.done = true
+	g.expires = time.Now().Add(s.ttl)
+	close(g.notify)
+	g.notify = make(chan struct{})
+}
+
+// tee relays the values of ch to the returned channel, buffering them as g's
+// chunks and setting the generation id of the first. Once the client that
+// started g leaves, values are only buffered, for g's followers.
+func (s *generationStore) tee(g *generation, c *gin.Context, ch chan any) chan any {
+	if g == nil {
+		return ch
+	}
+
+	g.teed = true
+
+	// c is reused once the handler returns, which it may before ch is closed
+	reqCtx := c.Request.Context()
+	out := make(chan any)
+	go func() {
+		defer close(out)
+		defer s.finish(g)
+
+		first, relay := true, true
+		for val := range ch {
+			if first {
+				switch v := val.(type) {
+				case api.GenerateResponse:
+					v.GenerationID = g.id
+					val = v
+				case api.ChatResponse:
+					v.GenerationID = g.id
+					val = v
+				}
+				first = false
+			}
+
+			if bts, err := json.Marshal(val); err == nil {
+				s.append(g, append(bts, '\n'))
+			}
+
+			if relay {
+				select {
+				case out <- val:
+				case <-reqCtx.Done():
+					relay = false
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// abandon removes g if its request returned before its responses were
+// buffered, such as when it failed or was proxied to a remote server
+func (s *generationStore) abandon(g *generation) {
+	if g == nil || g.teed {
+		return
+	}
+
+	g.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.generations[g.id]; ok {
+		s.removeLocked(g)
+	}
+}
+
+// ID returns g's id, or "" if g is nil
+func (g *generation) ID() string {
+	if g == nil {
+		return ""
+	}
+
+	return g.id
+}
+
+// context returns the context g runs with, or ctx if g is nil
+func (g *generation) context(ctx context.Context) context.Context {
+	if g == nil {
+		return ctx
+	}
+
+	return g.ctx
+}
+
+// attach adds a follower to g, stopping it from being cancelled
+func (g *generation) attach() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.clients++
+	g.followed = true
+	if g.orphan != nil {
+		g.orphan.Stop()
+		g.orphan = nil
+	}
+}
+
+// leave removes a client from g. A generation that was never followed is
+// cancelled right away, like any request whose client leaves, and one that
+// was is cancelled if no client attaches again before
+// generationOrphanTimeout.
+func (g *generation) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.clients--
+	if g.clients > 0 || g.done {
+		return
+	}
+
+	if !g.followed {
+		g.cancel()
+		return
+	}
+
+	g.orphan = time.AfterFunc(generationOrphanTimeout, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.clients == 0 && !g.done {
+			slog.Debug("cancelling generation without clients", "id", g.id)
+			g.cancel()
+		}
+	})
+}
+
+// follow calls fn with each of g's chunks, those already buffered first,
+// until g is done or ctx is cancelled
+func (g *generation) follow(ctx context.Context, fn func([]byte) error) error {
+	for i := 0; ; {
+		g.mu.Lock()
+		if g.gone {
+			g.mu.Unlock()
+			return errGenerationEvicted
+		}
+		lines, done, notify := g.lines[i:], g.done, g.notify
+		g.mu.Unlock()
+
+		for _, line := range lines {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		i += len(lines)
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// mergeGenerate combines the chunks of a generate request's first choice
+// into a single response, as if it hadn't been streamed
+func mergeGenerate(lines [][]byte) (any, error) {
+	var resp api.GenerateResponse
+	var sb, tb strings.Builder
+	for _, line := range lines {
+		var r api.GenerateResponse
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, err
+		}
+
+		if r.Index != 0 {
+			continue
+		}
+
+		sb.WriteString(r.Response)
+		tb.WriteString(r.Thinking)
+		id := cmp.Or(resp.GenerationID, r.GenerationID)
+		resp = r
+		resp.GenerationID = id
+	}
+
+	resp.Response = sb.String()
+	resp.Thinking = tb.String()
+	return resp, nil
+}
+
+// mergeChat combines the chunks of a chat request's first choice into a
+// single response, as if it hadn't been streamed
+func mergeChat(lines [][]byte) (any, error) {
+	var resp api.ChatResponse
+	var sb, tb strings.Builder
+	for _, line := range lines {
+		var r api.ChatResponse
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, err
+		}
+
+		if r.Index != 0 {
+			continue
+		}
+
+		sb.WriteString(r.Message.Content)
+		tb.WriteString(r.Message.Thinking)
+		id := cmp.Or(resp.GenerationID, r.GenerationID)
+		resp = r
+		resp.GenerationID = id
+	}
+
+	resp.Message.Content = sb.String()
+	resp.Message.Thinking = tb.String()
+	return resp, nil
+}
+
+// GenerationStreamHandler streams the chunks of a generation, replaying
+// those already generated before following it live
+func (s *Server) GenerationStreamHandler(c *gin.Context) {
+	g, ok := s.generations.get(c, c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "generation not found"})
+		return
+	}
+
+	g.attach()
+	defer g.leave()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	if err := g.follow(c.Request.Context(), func(line []byte) error {
+		if _, err := c.Writer.Write(line); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}); err != nil {
+		slog.Debug("stopped following generation", "id", g.id, "error", err)
+	}
+}
+
+// GenerationHandler returns the result of a generation as a single
+// response, waiting for it to finish
+func (s *Server) GenerationHandler(c *gin.Context) {
+	g, ok := s.generations.get(c, c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "generation not found"})
+		return
+	}
+
+	g.attach()
+	defer g.leave()
+
+	var lines [][]byte
+	if err := g.follow(c.Request.Context(), func(line []byte) error {
+		lines = append(lines, line)
+		return nil
+	}); errors.Is(err, errGenerationEvicted) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "generation not found"})
+		return
+	} else if err != nil {
+		return
+	}
+
+	for _, line := range lines {
+		var r struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(line, &r) == nil && r.Error != "" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": r.Error})
+			return
+		}
+	}
+
+	resp, err := g.merge(lines)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// startGeneration starts a generation of s for a streamed request from addr
+func startGeneration(t *testing.T, s *generationStore, addr string) (*generation, context.CancelFunc) {
+	t.Helper()
+
+	r := gin.New()
+	var g *generation
+	r.POST("/api/generate", func(c *gin.Context) {
+		g = s.start(c, nil, mergeGenerate)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/api/generate", nil).WithContext(ctx)
+	req.RemoteAddr = addr
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if g == nil {
+		t.Fatal("expected a generation")
+	}
+
+	return g, cancel
+}
+
+func followRequest(s *Server, path, addr string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.GET("/api/generation/:id", s.GenerationHandler)
+	r.GET("/api/generation/:id/stream", s.GenerationStreamHandler)
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestGenerationStore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	if s := newGenerationStore(0, time.Minute); s != nil {
+		t.Error("expected a store of size 0 to be disabled")
+	}
+
+	s := newGenerationStore(1024, time.Minute)
+	g, cancel := startGeneration(t, s, "10.0.0.1:1234")
+	defer cancel()
+
+	ch := make(chan any)
+	out := s.tee(g, &gin.Context{Request: httptest.NewRequest(http.MethodPost, "/", nil)}, ch)
+	go func() {
+		defer close(ch)
+		ch <- api.GenerateResponse{Response: "hello"}
+		ch <- api.GenerateResponse{Response: " world", Done: true, DoneReason: api.DoneReasonStop}
+	}()
+
+	var first api.GenerateResponse
+	for val := range out {
+		if r := val.(api.GenerateResponse); r.Response == "hello" {
+			first = r
+		}
+	}
+
+	if first.GenerationID != g.id {
+		t.Errorf("expected the first chunk to have id %s, got %q", g.id, first.GenerationID)
+	}
+
+	var lines int
+	if err := g.follow(context.Background(), func([]byte) error { lines++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines != 2 {
+		t.Errorf("expected 2 buffered chunks, got %d", lines)
+	}
+
+	if g.ctx.Err() == nil {
+		t.Error("expected a finished generation's context to be cancelled")
+	}
+
+	// a newer generation over the store's size evicts the oldest
+	g2, cancel2 := startGeneration(t, s, "10.0.0.1:1234")
+	defer cancel2()
+	s.append(g2, make([]byte, 1000))
+
+	if err := g.follow(context.Background(), func([]byte) error { return nil }); err != errGenerationEvicted {
+		t.Errorf("expected the oldest generation to be evicted, got %v", err)
+	}
+
+	if _, ok := s.generations[g2.id]; !ok {
+		t.Error("expected the newest generation to be kept")
+	}
+}
+
+func TestGenerationAbandon(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newGenerationStore(1024, time.Minute)
+	g, cancel := startGeneration(t, s, "10.0.0.1:1234")
+	defer cancel()
+
+	s.abandon(g)
+	if _, ok := s.generations[g.id]; ok {
+		t.Error("expected an abandoned generation to be removed")
+	}
+
+	if g.ctx.Err() == nil {
+		t.Error("expected an abandoned generation to be cancelled")
+	}
+}
+
+func TestGenerationCancelledWithRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newGenerationStore(1024, time.Minute)
+	g, cancel := startGeneration(t, s, "10.0.0.1:1234")
+	cancel()
+
+	select {
+	case <-g.ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("expected a generation no one followed to be cancelled with its request")
+	}
+}
+
+func TestGenerationOutlivesRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newGenerationStore(1024, time.Minute)
+	g, cancel := startGeneration(t, s, "10.0.0.1:1234")
+
+	g.attach()
+	cancel()
+
+	// give the watcher time to see the original client leave
+	time.Sleep(50 * time.Millisecond)
+	if g.ctx.Err() != nil {
+		t.Error("expected a followed generation to keep running")
+	}
+
+	g.leave()
+	g.mu.Lock()
+	orphaned := g.orphan != nil
+	g.mu.Unlock()
+	if !orphaned {
+		t.Error("expected a generation without clients to be scheduled for cancellation")
+	}
+
+	g.attach()
+	g.mu.Lock()
+	orphaned = g.orphan != nil
+	g.mu.Unlock()
+	if orphaned {
+		t.Error("expected attaching to stop the cancellation")
+	}
+}
+
+func TestGenerationHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{generations: newGenerationStore(1<<20, time.Minute)}
+	g, cancel := startGeneration(t, s.generations, "10.0.0.1:1234")
+	defer cancel()
+
+	ch := make(chan any)
+	out := s.generations.tee(g, &gin.Context{Request: httptest.NewRequest(http.MethodPost, "/", nil)}, ch)
+	go func() {
+		for range out {
+		}
+	}()
+
+	streamed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		streamed <- followRequest(s, "/api/generation/"+g.id+"/stream", "10.0.0.1:5678")
+	}()
+
+	ch <- api.GenerateResponse{Model: "test", Response: "hello"}
+	ch <- api.GenerateResponse{Model: "test", Response: " world", Done: true, DoneReason: api.DoneReasonStop}
+	close(ch)
+
+	w := <-streamed
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an ndjson stream, got %d %v", w.Code, w.Header())
+	}
+
+	var chunks []api.GenerateResponse
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		var r api.GenerateResponse
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, r)
+	}
+
+	if len(chunks) != 2 || chunks[0].GenerationID != g.id || !chunks[1].Done {
+		t.Errorf("expected both chunks, got %+v", chunks)
+	}
+
+	w = followRequest(s, "/api/generation/"+g.id, "10.0.0.1:5678")
+	var resp api.GenerateResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Response != "hello world" || !resp.Done || resp.GenerationID != g.id {
+		t.Errorf("expected the merged response, got %+v", resp)
+	}
+
+	if w := followRequest(s, "/api/generation/"+g.id, "10.0.0.2:5678"); w.Code != http.StatusNotFound {
+		t.Errorf("expected another client's generation to be hidden, got %d", w.Code)
+	}
+
+	// Forwarding headers are set by the client, so they can't claim its address
+	r := gin.New()
+	r.GET("/api/generation/:id", s.GenerationHandler)
+	req := httptest.NewRequest(http.MethodGet, "/api/generation/"+g.id, nil)
+	req.RemoteAddr = "10.0.0.2:5678"
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a spoofed address to be ignored, got %d", w.Code)
+	}
+
+	if w := followRequest(s, "/api/generation/missing", "10.0.0.1:5678"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+
+	if w := followRequest(&Server{}, "/api/generation/"+g.id, "10.0.0.1:5678"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without a store, got %d", w.Code)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyEntry is the response to a request with an Idempotency-Key. It's
+// shared by the request that runs it and any duplicates that arrive while it
+// runs or after, until it expires.
+type idempotencyEntry struct {
+	id string
+
+	// done is closed once the response below is recorded
+	done chan struct{}
+
+	status int
+	header http.Header
+	body   []byte
+
+	expires time.Time
+	elem    *list.Element
+}
+
+// idempotencyCache keeps the responses to requests with an Idempotency-Key,
+// evicting the least recently used once there are more than size of them.
+// Requests that are still running aren't counted or evicted.
+type idempotencyCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	lru     *list.List
+}
+
+// newIdempotencyCache returns a cache of size responses kept for ttl, or nil
+// if either is zero, which disables idempotency keys
+func newIdempotencyCache(size int, ttl time.Duration) *idempotencyCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+
+	return &idempotencyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*idempotencyEntry),
+		lru:     list.New(),
+	}
+}
+
+// start returns the entry for id and whether the caller is the first request
+// with it, and so must run the request and finish the entry
+func (c *idempotencyCache) start(id string) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		if e.elem == nil {
+			// still running
+			return e, false
+		}
+
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(e.elem)
+			return e, false
+		}
+
+		c.lru.Remove(e.elem)
+		delete(c.entries, id)
+	}
+
+	e := &idempotencyEntry{id: id, done: make(chan struct{})}
+	c.entries[id] = e
+	return e, true
+}
+
+// finish records the response to e's request, releasing any duplicates
+// waiting on it. Only successful responses are kept to be replayed, so a
+// request that failed runs again when it's retried.
+func (c *idempotencyCache) finish(e *idempotencyEntry, status int, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.status, e.header, e.body = status, header, body
+	close(e.done)
+
+	if status < 200 || status >= 300 {
+		delete(c.entries, e.id)
+		return
+	}
+
+	e.expires = time.Now().Add(c.ttl)
+	e.elem = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Remove(c.lru.Back()).(*idempotencyEntry)
+		delete(c.entries, oldest.id)
+	}
+}
+
+// recordingWriter keeps a copy of the response it writes
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyMiddleware runs requests with an Idempotency-Key header once,
+// replaying the response to later requests with the same key and body with
+// an Idempotent-Replayed header. Duplicates that arrive while the first
+// request is running wait for its response rather than running again.
+// Streamed responses aren't kept, so requests to handlers that stream by
+// default must set "stream": false to use a key.
+func idempotencyMiddleware(cache *idempotencyCache, streams bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" || cache == nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Invalid bodies are left for the handler to reject
+		var req struct {
+			Stream *bool `json:"stream"`
+		}
+		_ = json.Unmarshal(body, &req)
+		if streams && (req.Stream == nil || *req.Stream) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": `Idempotency-Key is only supported for requests with "stream": false`})
+			return
+		}
+
+		// Keys are scoped to the route and the API key, so clients sharing a
+		// server can't see each other's responses
+		h := sha256.New()
+		for _, s := range []string{key, c.FullPath(), apiKeyName(c.Request.Context())} {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+		h.Write(body)
+
+		e, first := cache.start(hex.EncodeToString(h.Sum(nil)))
+		if !first {
+			select {
+			case <-e.done:
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+
+			for k, v := range e.header {
+				if _, ok := c.Writer.Header()[k]; !ok {
+					c.Writer.Header()[k] = v
+				}
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Status(e.status)
+			_, _ = c.Writer.Write(e.body)
+			c.Abort()
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+
+		// The request runs to completion even if its client goes away, since
+		// the client is most likely to retry when its connection drops
+		c.Request = c.Request.WithContext(context.WithoutCancel(c.Request.Context()))
+
+		finished := false
+		defer func() {
+			// Release duplicates of a request whose handler panicked
+			if !finished {
+				cache.finish(e, http.StatusInternalServerError, nil, nil)
+			}
+		}()
+
+		c.Next()
+		cache.finish(e, w.Status(), w.Header().Clone(), w.body.Bytes())
+		finished = true
+	}
+}
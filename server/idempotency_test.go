@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func idempotentRequest(r http.Handler, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var runs atomic.Int32
+	status := http.StatusOK
+	r := gin.New()
+	r.POST("/api/generate", idempotencyMiddleware(newIdempotencyCache(2, time.Minute), true), func(c *gin.Context) {
+		n := runs.Add(1)
+		c.JSON(status, gin.H{"run": n})
+	})
+
+	body := `{"model": "test", "prompt": "hi", "stream": false}`
+
+	w := idempotentRequest(r, "a", body)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected the first request to run, got %d %v", w.Code, w.Header())
+	}
+
+	w = idempotentRequest(r, "a", body)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" || w.Body.String() != `{"run":1}` {
+		t.Errorf("expected the first response to be replayed, got %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	if w := idempotentRequest(r, "a", `{"model": "test", "prompt": "bye", "stream": false}`); w.Body.String() != `{"run":2}` {
+		t.Errorf("expected a different body to run, got %s", w.Body)
+	}
+
+	if w := idempotentRequest(r, "", body); w.Body.String() != `{"run":3}` {
+		t.Errorf("expected a request without a key to run, got %s", w.Body)
+	}
+
+	w = idempotentRequest(r, "a", `{"model": "test", "prompt": "hi"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `\"stream\": false`) {
+		t.Errorf("expected a streamed request to be rejected, got %d %s", w.Code, w.Body)
+	}
+
+	status = http.StatusInternalServerError
+	idempotentRequest(r, "b", body)
+	status = http.StatusOK
+	if w := idempotentRequest(r, "b", body); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected a failed request to run again, got %d %v", w.Code, w.Header())
+	}
+
+	// "a" is evicted as the least recently used of three responses
+	idempotentRequest(r, "c", body)
+	if w := idempotentRequest(r, "a", body); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected an evicted response to run again, got %s", w.Body)
+	}
+}
+
+func TestIdempotencyCoalesce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var runs atomic.Int32
+	release := make(chan struct{})
+	r := gin.New()
+	r.POST("/api/generate", idempotencyMiddleware(newIdempotencyCache(8, time.Minute), true), func(c *gin.Context) {
+		runs.Add(1)
+		<-release
+		c.JSON(http.StatusOK, gin.H{"response": "hello"})
+	})
+
+	body := `{"model": "test", "prompt": "hi", "stream": false}`
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 4)
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = idempotentRequest(r, "a", body)
+		}()
+	}
+
+	// let the duplicates queue behind the first request
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("expected duplicates to run once, ran %d times", n)
+	}
+
+	var replayed int
+	for _, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != `{"response":"hello"}` {
+			t.Errorf("unexpected response %d %s", w.Code, w.Body)
+		}
+
+		if w.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+
+	if replayed != len(responses)-1 {
+		t.Errorf("expected %d replayed responses, got %d", len(responses)-1, replayed)
+	}
+}
+
+func TestIdempotencyCacheExpiry(t *testing.T) {
+	c := newIdempotencyCache(8, time.Minute)
+	e, first := c.start("a")
+	if !first {
+		t.Fatal("expected the first request to run")
+	}
+	c.finish(e, http.StatusOK, nil, []byte("ok"))
+
+	if _, first := c.start("a"); first {
+		t.Error("expected the response to be replayed")
+	}
+
+	e.expires = time.Now().Add(-time.Second)
+	if _, first := c.start("a"); !first {
+		t.Error("expected an expired response to run again")
+	}
+
+	if c := newIdempotencyCache(0, time.Minute); c != nil {
+		t.Error("expected a cache of size 0 to disable idempotency keys")
+	}
+}
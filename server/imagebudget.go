@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+// defaultImageTokens is how many tokens images are assumed to take when the
+// projector's metadata doesn't describe them
+const defaultImageTokens = 768
+
+// errImagesExceedContext is returned when a request's images alone don't fit
+// in the context length
+var errImagesExceedContext = errors.New("images exceed the context length")
+
+// visionProjector describes how a model's projector turns images into
+// embeddings, from the projector's metadata. Images are resized to tiles of
+// imageSize pixels, each split into patches of patchSize pixels.
+type visionProjector struct {
+	kind      string
+	imageSize int
+	patchSize int
+
+	// queries is the number of embeddings resampler projectors produce for
+	// each tile, regardless of its patches
+	queries int
+
+	// pinpoints are the resolutions, as width and height, that projectors
+	// supporting any resolution tile images to, in addition to encoding the
+	// whole image as one tile
+	pinpoints [][2]int
+}
+
+// visionProjectors caches projectors by path. Projectors are blobs, which
+// never change, so they're only read once.
+var visionProjectors sync.Map
+
+func loadVisionProjector(path string) (*visionProjector, error) {
+	if p, ok := visionProjectors.Load(path); ok {
+		return p.(*visionProjector), nil
+	}
+
+	ggml, err := llm.LoadModel(path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newVisionProjector(ggml.KV())
+	visionProjectors.Store(path, p)
+	return p, nil
+}
+
+func newVisionProjector(kv llm.KV) *visionProjector {
+	p := &visionProjector{
+		kind:      "mlp",
+		imageSize: int(kv.Uint("clip.vision.image_size")),
+		patchSize: int(kv.Uint("clip.vision.patch_size")),
+	}
+
+	if kind, ok := kv["clip.projector_type"].(string); ok && kind != "" {
+		p.kind = kind
+	}
+
+	if p.kind == "resampler" {
+		// MiniCPM-V 2.5 and 2.6 resample tiles to 96 and 64 embeddings
+		p.queries = 96
+		if kv.Uint("clip.minicpmv_version") == 3 {
+			p.queries = 64
+		}
+	}
+
+	pinpoints := kv.Ints("clip.vision.image_grid_pinpoints")
+	for i := 0; i+1 < len(pinpoints); i += 2 {
+		p.pinpoints = append(p.pinpoints, [2]int{pinpoints[i], pinpoints[i+1]})
+	}
+
+	return p
+}
+
+// visionProjector returns the projector of a vision model, or nil if the
+// model has none. Projectors whose metadata can't be read take
+// defaultImageTokens for every image.
+func (m *Model) visionProjector() *visionProjector {
+	if len(m.ProjectorPaths) == 0 {
+		return nil
+	}
+
+	p, err := loadVisionProjector(m.ProjectorPaths[0])
+	if err != nil {
+		slog.Debug("couldn't read projector metadata", "projector", m.ProjectorPaths[0], "error", err)
+		return &visionProjector{}
+	}
+
+	return p
+}
+
+// tokens returns how many tokens an image of width by height pixels takes
+func (p *visionProjector) tokens(width, height int) int {
+	if p.imageSize == 0 || p.patchSize == 0 {
+		return defaultImageTokens
+	}
+
+	side := p.imageSize / p.patchSize
+	n := side * side
+	switch p.kind {
+	case "ldp", "ldpv2":
+		// pooled 2x2
+		n /= 4
+	case "resampler":
+		n = p.queries
+	}
+
+	if len(p.pinpoints) > 0 {
+		w, h := p.resolution(width, height)
+		n *= 1 + (w/p.imageSize)*(h/p.imageSize)
+	}
+
+	return n
+}
+
+// resolution returns the native resolution an image of width by height
+// pixels is encoded at. For projectors supporting any resolution, it's the
+// pinpoint that keeps most of the image's detail while wasting the least
+// space, as llava-next selects it.
+func (p *visionProjector) resolution(width, height int) (int, int) {
+	if len(p.pinpoints) == 0 {
+		return p.imageSize, p.imageSize
+	}
+
+	if width <= 0 || height <= 0 {
+		// the largest, for images whose size isn't known
+		best := p.pinpoints[0]
+		for _, pp := range p.pinpoints[1:] {
+			if pp[0]*pp[1] > best[0]*best[1] {
+				best = pp
+			}
+		}
+		return best[0], best[1]
+	}
+
+	var best [2]int
+	maxEffective, minWasted := -1, 0
+	for _, pp := range p.pinpoints {
+		scale := min(float64(pp[0])/float64(width), float64(pp[1])/float64(height))
+		w, h := int(float64(width)*scale), int(float64(height)*scale)
+		effective := min(w*h, width*height)
+		wasted := pp[0]*pp[1] - effective
+		if effective > maxEffective || (effective == maxEffective && wasted < minWasted) {
+			best, maxEffective, minWasted = pp, effective, wasted
+		}
+	}
+
+	return best[0], best[1]
+}
+
+// downscaled returns the size an image of width by height pixels is
+// downscaled to: images with a side longer than limit pixels, or than their
+// native resolution if limit is 0, are shrunk to fit in it, keeping their
+// aspect ratio
+func (p *visionProjector) downscaled(width, height, limit int) (int, int) {
+	nw, nh := p.resolution(width, height)
+	if nw <= 0 || nh <= 0 {
+		return width, height
+	}
+
+	if limit <= 0 {
+		limit = max(nw, nh)
+	}
+
+	if width <= limit && height <= limit {
+		return width, height
+	}
+
+	scale := min(float64(nw)/float64(width), float64(nh)/float64(height))
+	if scale >= 1 {
+		return width, height
+	}
+
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+// prepare downscales an image that's larger than its native resolution, as
+// configured by OLLAMA_IMAGE_MAX_SIZE, if downscale is set, and returns it
+// with how many tokens it takes. Images in formats that can't be decoded here
+// are left for the runner, assuming they're as large as the projector allows.
+func (p *visionProjector) prepare(data []byte, downscale bool) ([]byte, int) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, p.tokens(0, 0)
+	}
+
+	if !downscale {
+		return data, p.tokens(cfg.Width, cfg.Height)
+	}
+
+	w, h := p.downscaled(cfg.Width, cfg.Height, int(envconfig.ImageMaxSize()))
+	if w == cfg.Width && h == cfg.Height {
+		return data, p.tokens(w, h)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		slog.Warn("couldn't decode image to downscale it", "error", err)
+		return data, p.tokens(cfg.Width, cfg.Height)
+	}
+
+	var b bytes.Buffer
+	resized := resizeImage(img, w, h)
+	if format == "jpeg" {
+		err = jpeg.Encode(&b, resized, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&b, resized)
+	}
+	if err != nil {
+		slog.Warn("couldn't encode downscaled image", "error", err)
+		return data, p.tokens(cfg.Width, cfg.Height)
+	}
+
+	slog.Debug("downscaled image", "from", fmt.Sprintf("%dx%d", cfg.Width, cfg.Height), "to", fmt.Sprintf("%dx%d", w, h))
+	return b.Bytes(), p.tokens(w, h)
+}
+
+// resizeImage scales img down to width by height pixels, averaging the
+// pixels each pixel of the result covers
+func resizeImage(img image.Image, width, height int) *image.RGBA64 {
+	b := img.Bounds()
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := range height {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/height)
+		for x := range width {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/width)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// downscaleImages reports whether images should be downscaled for opts
+func downscaleImages(opts *api.Options) bool {
+	return opts.DownscaleImages == nil || *opts.DownscaleImages
+}
+
+// checkImageTokens returns an error wrapping errImagesExceedContext, naming
+// the first image that doesn't fit, if images alone take more than numCtx
+// tokens
+func checkImageTokens(images []llm.ImageData, numCtx int) error {
+	var total int
+	for i, img := range images {
+		total += img.Tokens
+		if img.Tokens > numCtx {
+			return fmt.Errorf("%w: image %d takes %d tokens, more than the context length of %d tokens", errImagesExceedContext, i, img.Tokens, numCtx)
+		} else if total > numCtx {
+			return fmt.Errorf("%w: image %d takes %d tokens, bringing the images to %d tokens, more than the context length of %d tokens", errImagesExceedContext, i, img.Tokens, total, numCtx)
+		}
+	}
+
+	return nil
+}
+
+// imageTokens returns how many tokens each image takes, or nil if there are
+// no images
+func imageTokens(images []llm.ImageData) []int {
+	if len(images) == 0 {
+		return nil
+	}
+
+	tokens := make([]int, len(images))
+	for i, img := range images {
+		tokens[i] = img.Tokens
+	}
+
+	return tokens
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// llavaNext is the projector of llava-next models, which tile images to one
+// of the pinpoint resolutions
+var llavaNext = visionProjector{
+	kind:      "mlp",
+	imageSize: 336,
+	patchSize: 14,
+	pinpoints: [][2]int{{336, 672}, {672, 336}, {672, 672}, {1008, 336}, {336, 1008}},
+}
+
+func TestNewVisionProjector(t *testing.T) {
+	p := newVisionProjector(llm.KV{
+		"general.architecture":             "clip",
+		"clip.vision.image_size":           uint32(336),
+		"clip.vision.patch_size":           uint32(14),
+		"clip.vision.image_grid_pinpoints": []int32{336, 672, 672, 336, 672, 672, 1008, 336, 336, 1008},
+	})
+
+	if p.kind != llavaNext.kind || p.imageSize != llavaNext.imageSize || p.patchSize != llavaNext.patchSize {
+		t.Errorf("expected %+v, got %+v", llavaNext, p)
+	}
+
+	if len(p.pinpoints) != len(llavaNext.pinpoints) {
+		t.Fatalf("expected pinpoints %v, got %v", llavaNext.pinpoints, p.pinpoints)
+	}
+
+	for i := range p.pinpoints {
+		if p.pinpoints[i] != llavaNext.pinpoints[i] {
+			t.Errorf("expected pinpoints %v, got %v", llavaNext.pinpoints, p.pinpoints)
+		}
+	}
+
+	minicpmv := newVisionProjector(llm.KV{
+		"clip.projector_type":    "resampler",
+		"clip.minicpmv_version":  uint32(3),
+		"clip.vision.image_size": uint32(448),
+		"clip.vision.patch_size": uint32(14),
+	})
+
+	if minicpmv.queries != 64 {
+		t.Errorf("expected 64 queries, got %d", minicpmv.queries)
+	}
+}
+
+func TestVisionProjectorTokens(t *testing.T) {
+	cases := []struct {
+		name          string
+		projector     visionProjector
+		width, height int
+		expect        int
+	}{
+		{name: "llava", projector: visionProjector{kind: "mlp", imageSize: 336, patchSize: 14}, width: 1920, height: 1080, expect: 576},
+		{name: "mobilevlm", projector: visionProjector{kind: "ldpv2", imageSize: 336, patchSize: 14}, width: 1920, height: 1080, expect: 144},
+		{name: "minicpmv", projector: visionProjector{kind: "resampler", imageSize: 448, patchSize: 14, queries: 64}, width: 1920, height: 1080, expect: 64},
+		{name: "no metadata", width: 1920, height: 1080, expect: defaultImageTokens},
+		{name: "llava-next square", projector: llavaNext, width: 1000, height: 1000, expect: 576 * 5},
+		{name: "llava-next wide", projector: llavaNext, width: 2000, height: 1000, expect: 576 * 3},
+		{name: "llava-next panorama", projector: llavaNext, width: 3000, height: 900, expect: 576 * 4},
+		{name: "llava-next small", projector: llavaNext, width: 300, height: 300, expect: 576 * 3},
+		{name: "llava-next unknown size", projector: llavaNext, expect: 576 * 5},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := tt.projector.tokens(tt.width, tt.height); n != tt.expect {
+				t.Errorf("expected %d tokens, got %d", tt.expect, n)
+			}
+		})
+	}
+}
+
+func TestVisionProjectorDownscaled(t *testing.T) {
+	llava := visionProjector{kind: "mlp", imageSize: 336, patchSize: 14}
+
+	cases := []struct {
+		name                      string
+		projector                 visionProjector
+		width, height, limit      int
+		expectWidth, expectHeight int
+	}{
+		{name: "native", projector: llava, width: 1000, height: 500, expectWidth: 336, expectHeight: 168},
+		{name: "portrait", projector: llava, width: 500, height: 1000, expectWidth: 168, expectHeight: 336},
+		{name: "small", projector: llava, width: 300, height: 200, expectWidth: 300, expectHeight: 200},
+		{name: "under limit", projector: llava, width: 1000, height: 500, limit: 2048, expectWidth: 1000, expectHeight: 500},
+		{name: "over limit", projector: llava, width: 3000, height: 1500, limit: 2048, expectWidth: 336, expectHeight: 168},
+		{name: "limit under native", projector: llava, width: 300, height: 300, limit: 200, expectWidth: 300, expectHeight: 300},
+		{name: "llava-next wide", projector: llavaNext, width: 2000, height: 1000, expectWidth: 672, expectHeight: 336},
+		{name: "llava-next square", projector: llavaNext, width: 2000, height: 2000, expectWidth: 672, expectHeight: 672},
+		{name: "llava-next fits", projector: llavaNext, width: 600, height: 600, expectWidth: 600, expectHeight: 600},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := tt.projector.downscaled(tt.width, tt.height, tt.limit)
+			if w != tt.expectWidth || h != tt.expectHeight {
+				t.Errorf("expected %dx%d, got %dx%d", tt.expectWidth, tt.expectHeight, w, h)
+			}
+		})
+	}
+}
+
+func TestVisionProjectorPrepare(t *testing.T) {
+	p := visionProjector{kind: "mlp", imageSize: 336, patchSize: 14}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatal(err)
+	}
+
+	data, tokens := p.prepare(b.Bytes(), true)
+	if tokens != 576 {
+		t.Errorf("expected 576 tokens, got %d", tokens)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Width != 336 || cfg.Height != 168 {
+		t.Errorf("expected the image to be downscaled to 336x168, got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if data, _ := p.prepare(b.Bytes(), false); !bytes.Equal(data, b.Bytes()) {
+		t.Error("expected the image to be left as it is")
+	}
+
+	if data, tokens := p.prepare([]byte("not an image"), true); string(data) != "not an image" || tokens != 576 {
+		t.Errorf("expected an image that can't be decoded to be left as it is, got %q with %d tokens", data, tokens)
+	}
+}
+
+func TestCheckImageTokens(t *testing.T) {
+	images := []llm.ImageData{{Tokens: 576}, {Tokens: 2880}, {Tokens: 576}}
+
+	if err := checkImageTokens(images, 8192); err != nil {
+		t.Errorf("expected the images to fit, got %v", err)
+	}
+
+	err := checkImageTokens(images, 2048)
+	if !errors.Is(err, errImagesExceedContext) || !strings.Contains(err.Error(), "image 1 takes 2880 tokens") {
+		t.Errorf("expected image 1 not to fit, got %v", err)
+	}
+
+	err = checkImageTokens(images, 3600)
+	if !errors.Is(err, errImagesExceedContext) || !strings.Contains(err.Error(), "image 2 takes 576 tokens, bringing the images to 4032 tokens") {
+		t.Errorf("expected image 2 not to fit, got %v", err)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/auth"
@@ -39,15 +40,17 @@ var (
 	errCapabilityCompletion = errors.New("completion")
 	errCapabilityTools      = errors.New("tools")
 	errCapabilityInsert     = errors.New("insert")
+	errCapabilityVision     = errors.New("vision")
 )
 
-type Capability string
-
-const (
-	CapabilityCompletion = Capability("completion")
-	CapabilityTools      = Capability("tools")
-	CapabilityInsert     = Capability("insert")
-)
+// capabilityErrors are the errors CheckCapabilities returns for each missing
+// capability that requests can require
+var capabilityErrors = map[model.Capability]error{
+	model.CapabilityCompletion: errCapabilityCompletion,
+	model.CapabilityTools:      errCapabilityTools,
+	model.CapabilityInsert:     errCapabilityInsert,
+	model.CapabilityVision:     errCapabilityVision,
+}
 
 type registryOptions struct {
 	Insecure bool
@@ -69,49 +72,94 @@ type Model struct {
 	System         string
 	License        []string
 	Digest         string
-	Options        map[string]interface{}
-	Messages       []api.Message
+
+	// RequireLicenseAcceptance is set for models whose license must be
+	// accepted before they're loaded, identified by LicenseDigests
+	RequireLicenseAcceptance bool
+	LicenseDigests           []string
+
+	Options  map[string]interface{}
+	Messages []api.Message
 
 	Template *template.Template
+
+	// Variants are the pulled quantizations of a model with variants,
+	// largest first, and Variant is the one ModelPath loads
+	Variants []ModelVariant
+	Variant  string
+}
+
+// capabilitiesCache caches the capabilities of models by their manifest's
+// digest, since finding them reads the model's metadata
+var capabilitiesCache sync.Map
+
+// Capabilities returns what the model can be used for, from its architecture,
+// template and projectors
+func (m *Model) Capabilities() []model.Capability {
+	if m.Digest != "" {
+		if caps, ok := capabilitiesCache.Load(m.Digest); ok {
+			return caps.([]model.Capability)
+		}
+	}
+
+	var caps []model.Capability
+
+	// embedding models set a pooling type and can't generate completions
+	embedding := false
+	if ggml, err := llm.LoadModel(m.ModelPath, 0); err != nil {
+		slog.Error("couldn't decode ggml", "error", err)
+	} else if _, ok := ggml.KV()[fmt.Sprintf("%s.pooling_type", ggml.KV().Architecture())]; ok {
+		embedding = true
+	}
+
+	if embedding {
+		caps = append(caps, model.CapabilityEmbedding)
+	} else {
+		caps = append(caps, model.CapabilityCompletion)
+	}
+
+	if m.Template != nil {
+		vars := m.Template.Vars()
+		if slices.Contains(vars, "tools") {
+			caps = append(caps, model.CapabilityTools)
+		}
+
+		if slices.Contains(vars, "suffix") {
+			caps = append(caps, model.CapabilityInsert)
+		}
+
+		if _, _, ok := m.Template.ThinkingTags(); ok {
+			caps = append(caps, model.CapabilityThinking)
+		}
+	}
+
+	if len(m.ProjectorPaths) > 0 {
+		caps = append(caps, model.CapabilityVision)
+	}
+
+	if m.Digest != "" {
+		capabilitiesCache.Store(m.Digest, caps)
+	}
+
+	return caps
 }
 
 // CheckCapabilities checks if the model has the specified capabilities returning an error describing
 // any missing or unknown capabilities
-func (m *Model) CheckCapabilities(caps ...Capability) error {
+func (m *Model) CheckCapabilities(caps ...model.Capability) error {
+	available := m.Capabilities()
+
 	var errs []error
 	for _, cap := range caps {
-		switch cap {
-		case CapabilityCompletion:
-			f, err := os.Open(m.ModelPath)
-			if err != nil {
-				slog.Error("couldn't open model file", "error", err)
-				continue
-			}
-			defer f.Close()
-
-			// TODO(mxyng): decode the GGML into model to avoid doing this multiple times
-			ggml, _, err := llm.DecodeGGML(f, 0)
-			if err != nil {
-				slog.Error("couldn't decode ggml", "error", err)
-				continue
-			}
-
-			if _, ok := ggml.KV()[fmt.Sprintf("%s.pooling_type", ggml.KV().Architecture())]; ok {
-				errs = append(errs, errCapabilityCompletion)
-			}
-		case CapabilityTools:
-			if !slices.Contains(m.Template.Vars(), "tools") {
-				errs = append(errs, errCapabilityTools)
-			}
-		case CapabilityInsert:
-			vars := m.Template.Vars()
-			if !slices.Contains(vars, "suffix") {
-				errs = append(errs, errCapabilityInsert)
-			}
-		default:
+		err, ok := capabilityErrors[cap]
+		if !ok {
 			slog.Error("unknown capability", "capability", cap)
 			return fmt.Errorf("unknown capability: %s", cap)
 		}
+
+		if !slices.Contains(available, cap) {
+			errs = append(errs, err)
+		}
 	}
 
 	if err := errors.Join(errs...); err != nil {
@@ -121,6 +169,19 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 	return nil
 }
 
+// missingCapabilities returns the capabilities that err, from
+// CheckCapabilities, reports missing
+func missingCapabilities(err error) []model.Capability {
+	var caps []model.Capability
+	for _, cap := range []model.Capability{model.CapabilityCompletion, model.CapabilityTools, model.CapabilityInsert, model.CapabilityVision} {
+		if errors.Is(err, capabilityErrors[cap]) {
+			caps = append(caps, cap)
+		}
+	}
+
+	return caps
+}
+
 func (m *Model) String() string {
 	var modelfile parser.File
 
@@ -181,6 +242,13 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.RequireLicenseAcceptance {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "require_license_acceptance",
+			Args: "true",
+		})
+	}
+
 	for _, msg := range m.Messages {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "message",
@@ -198,6 +266,10 @@ type ConfigV2 struct {
 	ModelType     string   `json:"model_type"`
 	FileType      string   `json:"file_type"`
 
+	// Imatrix is the digest of the importance matrix the model was quantized
+	// with, if any
+	Imatrix string `json:"imatrix,omitempty"`
+
 	// required by spec
 	Architecture string `json:"architecture"`
 	OS           string `json:"os"`
@@ -210,12 +282,11 @@ type RootFS struct {
 }
 
 func GetManifest(mp ModelPath) (*Manifest, string, error) {
-	fp, err := mp.GetManifestPath()
-	if err != nil {
+	if _, err := mp.GetManifestPath(); err != nil {
 		return nil, "", err
 	}
 
-	f, err := os.Open(fp)
+	f, _, err := openManifest(mp.name())
 	if err != nil {
 		return nil, "", err
 	}
@@ -243,10 +314,16 @@ func GetModel(name string) (*Model, error) {
 		ShortName: mp.GetShortTagname(),
 		Digest:    digest,
 		Template:  template.DefaultTemplate,
+
+		RequireLicenseAcceptance: manifest.requiresLicenseAcceptance(),
+		LicenseDigests:           manifest.licenseDigests(),
 	}
 
+	// runners and the files of the model are read from local files, which
+	// storage outside the models directory caches
+	st := storage()
 	if manifest.Config.Digest != "" {
-		filename, err := GetBlobsPath(manifest.Config.Digest)
+		filename, err := st.BlobPath(context.Background(), manifest.Config.Digest)
 		if err != nil {
 			return nil, err
 		}
@@ -263,7 +340,7 @@ func GetModel(name string) (*Model, error) {
 	}
 
 	for _, layer := range manifest.Layers {
-		filename, err := GetBlobsPath(layer.Digest)
+		filename, err := st.BlobPath(context.Background(), layer.Digest)
 		if err != nil {
 			return nil, err
 		}
@@ -328,6 +405,12 @@ func GetModel(name string) (*Model, error) {
 		}
 	}
 
+	if len(manifest.Variants) > 0 {
+		if err := model.loadVariants(manifest); err != nil {
+			return nil, err
+		}
+	}
+
 	return model, nil
 }
 
@@ -356,7 +439,51 @@ func realpath(rel, from string) string {
 	return abspath
 }
 
-func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantization string, modelfile *parser.File, fn func(resp api.ProgressResponse)) (err error) {
+// checkDiskFree returns an error if dir doesn't have size bytes free. It
+// doesn't fail if the free space can't be determined.
+func checkDiskFree(dir string, size uint64) error {
+	free, err := diskFree(dir)
+	if err != nil {
+		slog.Warn("couldn't check free disk space", "dir", dir, "error", err)
+		return nil
+	}
+
+	if free < size {
+		return fmt.Errorf("%s of temporary space is needed but %s has %s free, set OLLAMA_TMPDIR to a directory with more space", format.HumanBytes2(size), dir, format.HumanBytes2(free))
+	}
+
+	return nil
+}
+
+// readImatrix reads the importance matrix of an IMATRIX command, which is a
+// blob or a path relative to the Modelfile, returning it with its contents
+func readImatrix(modelFileDir, ref string) (*llm.Imatrix, []byte, error) {
+	path := realpath(modelFileDir, ref)
+	if digest, ok := strings.CutPrefix(ref, "@"); ok {
+		p, err := GetBlobsPath(digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		path = p
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid importance matrix reference: %w", err)
+	}
+
+	imatrix, err := llm.DecodeImatrix(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return imatrix, b, nil
+}
+
+func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantization string, modelfile *parser.File, strictTemplate bool, fn func(resp api.ProgressResponse)) (err error) {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
 	config := ConfigV2{
 		OS:           "linux",
 		Architecture: "amd64",
@@ -368,8 +495,29 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 	var messages []*api.Message
 	parameters := make(map[string]any)
 
+	// the importance matrix is read up front since it's needed whenever the
+	// model is quantized
+	var imatrix *llm.Imatrix
+	var imatrixData []byte
+	for _, c := range modelfile.Commands {
+		if c.Name == "imatrix" {
+			if imatrix, imatrixData, err = readImatrix(modelFileDir, c.Args); err != nil {
+				return err
+			}
+		}
+	}
+
+	if imatrix != nil && quantization == "" {
+		fn(api.ProgressResponse{Status: "warning: the importance matrix is only used when quantizing"})
+	}
+
 	var layers []Layer
 	var baseLayers []*layerGGML
+	var requireLicense bool
+
+	// imatrixLayer is the importance matrix the model was quantized with,
+	// which the manifest references so it's kept as long as the model is
+	var imatrixLayer *Layer
 	for _, c := range modelfile.Commands {
 		mediatype := fmt.Sprintf("application/vnd.ollama.image.%s", c.Name)
 		command := c.Name
@@ -377,10 +525,20 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		switch command {
 		case "model", "adapter":
 			if name := model.ParseName(c.Args); name.IsValid() && command == "model" {
+				if !inNamespace(ctx, name) {
+					return fmt.Errorf("base model %q not found", c.Args)
+				}
+
 				baseLayers, err = parseFromModel(ctx, name, fn)
 				if err != nil {
 					return err
 				}
+
+				// models built on one whose license must be accepted carry
+				// its license, so they require acceptance too
+				if base, err := ParseNamedManifest(name); err == nil && base.requiresLicenseAcceptance() {
+					requireLicense = true
+				}
 			} else if strings.HasPrefix(c.Args, "@") {
 				digest := strings.TrimPrefix(c.Args, "@")
 				if ib, ok := intermediateBlobs[digest]; ok {
@@ -435,25 +593,48 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 						return err
 					}
 
-					ft := baseLayer.GGML.KV().FileType()
-					if !slices.Contains([]string{"F16", "F32"}, ft.String()) {
-						return errors.New("quantization is only supported for F16 and F32 models")
-					} else if want != ft {
-						fn(api.ProgressResponse{Status: fmt.Sprintf("quantizing %s model to %s", ft, quantization)})
+					if ft := baseLayer.GGML.KV().FileType(); want != ft {
+						if err := baseLayer.GGML.CheckQuantize(want, imatrix); err != nil {
+							return err
+						}
+
+						if imatrix == nil && want.ImportanceMatrixRecommended() {
+							slog.Warn("quantizing without an importance matrix", "type", want)
+							fn(api.ProgressResponse{Status: fmt.Sprintf("warning: quantizing to %s without an importance matrix significantly reduces quality, set one with IMATRIX or --imatrix", want)})
+						}
+
+						// quantized models are written to OLLAMA_TMPDIR before
+						// they're added to the models directory
+						if err := checkDiskFree(tempBase(), baseLayer.GGML.QuantizedSize(want)); err != nil {
+							return fmt.Errorf("quantizing to %s: %w", quantization, err)
+						}
+
+						fn(api.ProgressResponse{Status: fmt.Sprintf("quantizing %s model to %s", ft, quantization), Phase: api.PhaseWriting})
 
 						blob, err := GetBlobsPath(baseLayer.Digest)
 						if err != nil {
 							return err
 						}
 
-						temp, err := os.CreateTemp(filepath.Dir(blob), quantization)
+						td, err := newTempDir("quantize")
+						if err != nil {
+							return err
+						}
+						defer td.Remove()
+
+						temp, err := os.Create(td.Path(quantization))
 						if err != nil {
 							return err
 						}
 						defer temp.Close()
-						defer os.Remove(temp.Name())
 
-						if err := llm.Quantize(blob, temp.Name(), want); err != nil {
+						if err := llm.Quantize(blob, temp.Name(), want, imatrix, func(p llm.QuantizeProgress) {
+							fn(api.ProgressResponse{
+								Status:    fmt.Sprintf("quantizing %s (%d/%d)", p.Tensor, p.Completed+1, p.Total),
+								Total:     int64(p.Total),
+								Completed: int64(p.Completed),
+							})
+						}); err != nil {
 							return err
 						}
 
@@ -473,6 +654,15 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 						baseLayer.Layer = layer
 						baseLayer.GGML = ggml
+						if imatrix != nil && imatrixLayer == nil {
+							layer, err := NewLayer(bytes.NewReader(imatrixData), "application/vnd.ollama.image.imatrix")
+							if err != nil {
+								return err
+							}
+
+							imatrixLayer = &layer
+							config.Imatrix = layer.Digest
+						}
 					}
 				}
 
@@ -522,12 +712,32 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			}
 
 			messages = append(messages, &api.Message{Role: role, Content: content})
+		case "imatrix":
+			// read before the model is quantized
+		case "require_license_acceptance":
+			require, err := strconv.ParseBool(c.Args)
+			if err != nil {
+				return fmt.Errorf("invalid require_license_acceptance: %s", c.Args)
+			}
+
+			requireLicense = requireLicense || require
 		default:
 			ps, err := api.FormatParams(map[string][]string{c.Name: {c.Args}})
 			if err != nil {
 				return err
 			}
 
+			switch c.Name {
+			case "pooling_type":
+				if err := checkPoolingType(c.Args); err != nil {
+					return err
+				}
+			case "rope_scaling":
+				if err := llm.CheckContextOptions(api.Runner{RopeScaling: c.Args}); err != nil {
+					return err
+				}
+			}
+
 			for k, v := range ps {
 				if ks, ok := parameters[k].([]string); ok {
 					parameters[k] = append(ks, v.([]string)...)
@@ -581,6 +791,15 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		return err2
 	}
 
+	// the importance matrix of a base model that's quantized again no longer
+	// applies
+	if imatrixLayer != nil {
+		layers = slices.DeleteFunc(layers, func(layer Layer) bool {
+			return layer.MediaType == "application/vnd.ollama.image.imatrix"
+		})
+		layers = append(layers, *imatrixLayer)
+	}
+
 	if len(messages) > 0 {
 		var b bytes.Buffer
 		if err := json.NewEncoder(&b).Encode(messages); err != nil {
@@ -609,6 +828,22 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		layers = append(layers, layer)
 	}
 
+	// templates written for another model's tokenizer use special tokens
+	// this model sees as plain text
+	unknown, err := templateUnknownTokens(layers)
+	if err != nil {
+		return err
+	}
+
+	if len(unknown) > 0 {
+		if strictTemplate {
+			return fmt.Errorf("%w: %s", errBadTemplate, unknownTokensWarning(unknown))
+		}
+
+		slog.Warn("template uses special tokens that aren't in the model's vocabulary", "model", name.DisplayShortest(), "tokens", unknown)
+		fn(api.ProgressResponse{Status: "warning: " + unknownTokensWarning(unknown)})
+	}
+
 	digests := make([]string, len(layers))
 	for i, layer := range layers {
 		digests[i] = layer.Digest
@@ -628,14 +863,23 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 	for _, layer := range append(layers, configLayer) {
 		if layer.status != "" {
-			fn(api.ProgressResponse{Status: layer.status})
+			fn(api.ProgressResponse{Status: layer.status, Phase: api.PhaseWriting})
 		}
 	}
 
 	old, _ := ParseNamedManifest(name)
 
-	fn(api.ProgressResponse{Status: "writing manifest"})
-	if err := WriteManifest(name, configLayer, layers); err != nil {
+	var annotations map[string]string
+	if requireLicense {
+		if !slices.ContainsFunc(layers, func(l Layer) bool { return l.MediaType == "application/vnd.ollama.image.license" }) {
+			return errors.New("REQUIRE_LICENSE_ACCEPTANCE requires a LICENSE")
+		}
+
+		annotations = map[string]string{licenseAnnotation: "true"}
+	}
+
+	fn(api.ProgressResponse{Status: "writing manifest", Phase: api.PhaseWriting})
+	if err := WriteManifest(name, configLayer, layers, annotations); err != nil {
 		return err
 	}
 
@@ -645,7 +889,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		}
 	}
 
-	fn(api.ProgressResponse{Status: "success"})
+	fn(api.ProgressResponse{Status: "success", Phase: api.PhaseSuccess})
 	return nil
 }
 
@@ -661,56 +905,60 @@ func CopyModel(src, dst model.Name) error {
 		return nil
 	}
 
-	manifests, err := GetManifestPath()
-	if err != nil {
-		return err
-	}
-
-	dstpath := filepath.Join(manifests, dst.Filepath())
-	if err := os.MkdirAll(filepath.Dir(dstpath), 0o755); err != nil {
-		return err
-	}
-
-	srcpath := filepath.Join(manifests, src.Filepath())
-	srcfile, err := os.Open(srcpath)
+	srcfile, _, err := openManifest(src)
 	if err != nil {
 		return err
 	}
 	defer srcfile.Close()
 
-	dstfile, err := os.Create(dstpath)
+	b, err := io.ReadAll(srcfile)
 	if err != nil {
 		return err
 	}
-	defer dstfile.Close()
 
-	_, err = io.Copy(dstfile, srcfile)
-	return err
+	return storage().WriteManifest(dst, b)
 }
 
 func deleteUnusedLayers(deleteMap map[string]struct{}) error {
+	unlock, err := lockStore(context.Background(), storeLockName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	manifests, err := Manifests()
 	if err != nil {
 		return err
 	}
 
 	for _, manifest := range manifests {
-		for _, layer := range manifest.Layers {
+		for _, layer := range manifest.allLayers() {
 			delete(deleteMap, layer.Digest)
 		}
 
 		delete(deleteMap, manifest.Config.Digest)
 	}
 
+	// models in legacy layouts that haven't been migrated keep their layers
+	legacy, err := legacyLayers()
+	if err != nil {
+		return err
+	}
+
+	for digest := range legacy {
+		delete(deleteMap, digest)
+	}
+
 	// only delete the files which are still in the deleteMap
 	for k := range deleteMap {
-		fp, err := GetBlobsPath(k)
-		if err != nil {
-			slog.Info(fmt.Sprintf("couldn't get file path for '%s': %v", k, err))
+		// blobs being pulled aren't referenced by a manifest yet
+		if lockHeld(blobLockName(k)) {
+			delete(deleteMap, k)
 			continue
 		}
-		if err := os.Remove(fp); err != nil {
-			slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", fp, err))
+
+		if err := storage().DeleteBlob(k); err != nil {
+			slog.Info(fmt.Sprintf("couldn't remove blob '%s': %v", k, err))
 			continue
 		}
 	}
@@ -719,6 +967,12 @@ func deleteUnusedLayers(deleteMap map[string]struct{}) error {
 }
 
 func PruneLayers() error {
+	unlock, err := lockStore(context.Background(), storeLockName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	deleteMap := make(map[string]struct{})
 	p, err := GetBlobsPath("")
 	if err != nil {
@@ -738,7 +992,12 @@ func PruneLayers() error {
 		_, err := GetBlobsPath(name)
 		if err != nil {
 			if errors.Is(err, ErrInvalidDigestFormat) {
-				// remove invalid blobs (e.g. partial downloads)
+				// partial downloads are kept while another server is pulling
+				// them, and otherwise removed with other invalid blobs
+				if digest, _, ok := strings.Cut(blob.Name(), "-partial"); ok && lockHeld(digest) {
+					continue
+				}
+
 				if err := os.Remove(filepath.Join(p, blob.Name())); err != nil {
 					slog.Error("couldn't remove blob", "blob", blob.Name(), "error", err)
 				}
@@ -759,6 +1018,18 @@ func PruneLayers() error {
 
 	slog.Info(fmt.Sprintf("total unused blobs removed: %d", len(deleteMap)))
 
+	ms, err := Manifests()
+	if err != nil {
+		slog.Error(fmt.Sprintf("couldn't check for broken models: %v", err))
+		return nil
+	}
+
+	for n, m := range ms {
+		if missing := m.brokenLayers(false); len(missing) > 0 {
+			slog.Warn("model is broken, remove it with 'ollama store prune --broken' or pull it again", "model", n.DisplayShortest(), "missing", missing)
+		}
+	}
+
 	return nil
 }
 
@@ -795,11 +1066,24 @@ func PruneDirectory(path string) error {
 	return nil
 }
 
-func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+func PushModel(ctx context.Context, name string, regOpts *registryOptions, sign bool, fn func(api.ProgressResponse)) error {
+	return PushModelAs(ctx, name, "", false, regOpts, sign, fn)
+}
+
+// PushModelAs pushes the model name to the reference dest, or to name if dest
+// is empty, without creating a local model named dest. With dryRun, nothing is
+// uploaded or signed, and the layers that would be uploaded are reported
+// instead.
+func PushModelAs(ctx context.Context, name, dest string, dryRun bool, regOpts *registryOptions, sign bool, fn func(api.ProgressResponse)) error {
 	mp := ParseModelPath(name)
-	fn(api.ProgressResponse{Status: "retrieving manifest"})
+	dp := mp
+	if dest != "" {
+		dp = ParseModelPath(dest)
+	}
 
-	if mp.ProtocolScheme == "http" && !regOpts.Insecure {
+	fn(api.ProgressResponse{Status: "retrieving manifest", Phase: api.PhaseResolving})
+
+	if dp.ProtocolScheme == "http" && !regOpts.Insecure {
 		return errors.New("insecure protocol http")
 	}
 
@@ -809,22 +1093,53 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return err
 	}
 
-	var layers []Layer
-	layers = append(layers, manifest.Layers...)
-	if manifest.Config.Digest != "" {
-		layers = append(layers, manifest.Config)
+	if sign && !dryRun {
+		fn(api.ProgressResponse{Status: "signing manifest", Phase: api.PhaseWriting})
+		if err := manifest.sign(ctx); err != nil {
+			return err
+		}
+
+		// keep the signature locally too, so the model shows as signed
+		b, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+
+		if err := storage().WriteManifest(mp.name(), b); err != nil {
+			return err
+		}
 	}
 
-	for _, layer := range layers {
-		if err := uploadBlob(ctx, mp, layer, regOpts, fn); err != nil {
+	if pulled := manifest.pulledVariants(); len(pulled) < len(manifest.Variants) {
+		var missing []string
+		for _, v := range manifest.Variants {
+			if !slices.ContainsFunc(pulled, func(p Variant) bool { return p.Quantization == v.Quantization }) {
+				missing = append(missing, v.Quantization)
+			}
+		}
+
+		return fmt.Errorf("variants %s of %s haven't been pulled; pull them before pushing", strings.Join(missing, ", "), mp.GetShortTagname())
+	}
+
+	fn = transferProgress(fn, manifest.allLayers())
+	if dryRun {
+		return reportUploads(ctx, dp, manifest, regOpts, fn)
+	}
+
+	for _, layer := range manifest.allLayers() {
+		if layer.Digest == "" {
+			continue
+		}
+
+		if err := uploadBlob(ctx, dp, layer, regOpts, fn); err != nil {
 			slog.Info(fmt.Sprintf("error uploading blob: %v", err))
 			return err
 		}
 	}
 
-	fn(api.ProgressResponse{Status: "pushing manifest"})
-	requestURL := mp.BaseURL()
-	requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+	fn(api.ProgressResponse{Status: "pushing manifest", Phase: api.PhaseWriting})
+	requestURL := dp.BaseURL()
+	requestURL = requestURL.JoinPath("v2", dp.GetNamespaceRepository(), "manifests", dp.Tag)
 
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
@@ -839,14 +1154,83 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	}
 	defer resp.Body.Close()
 
-	fn(api.ProgressResponse{Status: "success"})
+	fn(api.ProgressResponse{Status: "success", Phase: api.PhaseSuccess})
 
 	return nil
 }
 
+// reportUploads reports the layers of manifest that pushing it to mp would
+// upload, which are those the registry doesn't already have
+func reportUploads(ctx context.Context, mp ModelPath, manifest *Manifest, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	for _, layer := range manifest.allLayers() {
+		if layer.Digest == "" {
+			continue
+		}
+
+		requestURL := mp.BaseURL()
+		requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "blobs", layer.Digest)
+
+		resp, err := makeRequestWithRetry(ctx, http.MethodHead, requestURL, nil, nil, regOpts)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return err
+		default:
+			resp.Body.Close()
+			continue
+		}
+
+		fn(api.ProgressResponse{
+			Status: fmt.Sprintf("would push %s", layer.Digest[7:19]),
+			Digest: layer.Digest,
+			Total:  layer.Size,
+		})
+	}
+
+	fn(api.ProgressResponse{Status: "success", Phase: api.PhaseSuccess})
+	return nil
+}
+
 func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	return PullModelWith(ctx, name, PullOptions{}, regOpts, fn)
+}
+
+// PullOptions are how a model is pulled
+type PullOptions struct {
+	// Variants are the variants to pull of a model with variants, or all of
+	// them if it's empty
+	Variants []string
+
+	// Strict refuses to pull a model whose architecture this version of
+	// Ollama can't run, rather than pulling it with a warning
+	Strict bool
+}
+
+// PullModelWith pulls name as opts say
+func PullModelWith(ctx context.Context, name string, opts PullOptions, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return pullModel(ctx, name, opts, regOpts, fn)
+}
+
+// pullModel pulls name, with storeMu already read locked by the caller
+func pullModel(ctx context.Context, name string, opts PullOptions, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	variants := opts.Variants
+
+	if storage().ReadOnly() {
+		return errReadOnlyStorage
+	}
+
 	mp := ParseModelPath(name)
 
+	// manifests pinned to a digest never change, so one that's already
+	// local isn't pulled from the registry
+	if mp.Digest != "" && len(variants) == 0 {
+		if pulled, err := pullPinnedLocally(mp, fn); pulled || err != nil {
+			return err
+		}
+	}
+
 	// build deleteMap to prune unused layers
 	deleteMap := make(map[string]struct{})
 	manifest, _, err := GetManifest(mp)
@@ -855,7 +1239,7 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	} else {
-		for _, l := range manifest.Layers {
+		for _, l := range manifest.allLayers() {
 			deleteMap[l.Digest] = struct{}{}
 		}
 		if manifest.Config.Digest != "" {
@@ -867,24 +1251,74 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return errors.New("insecure protocol http")
 	}
 
-	fn(api.ProgressResponse{Status: "pulling manifest"})
+	fn(api.ProgressResponse{Status: "pulling manifest", Phase: api.PhaseResolving})
+
+	manifest, manifestJSON, err := pullModelManifest(ctx, mp, regOpts)
+	if err != nil {
+		return fmt.Errorf("pull model manifest: %w", err)
+	}
+
+	if err := checkPullSignature(mp.GetShortTagname(), manifest, fn); err != nil {
+		return err
+	}
+
+	if err := checkPullLicense(ctx, mp, manifest, regOpts, fn); err != nil {
+		return err
+	}
+
+	if err := checkPullArchitecture(ctx, mp, manifest, opts.Strict, regOpts, fn); err != nil {
+		return err
+	}
 
-	manifest, err = pullModelManifest(ctx, mp, regOpts)
+	selected, err := manifest.selectVariants(variants)
 	if err != nil {
-		return fmt.Errorf("pull model manifest: %s", err)
+		return fmt.Errorf("%s: %w", mp.GetShortTagname(), err)
 	}
 
+	// the layers of variants are only pulled for the selected variants
+	optional := manifest.variantLayers()
+
 	var layers []Layer
-	layers = append(layers, manifest.Layers...)
+	for _, layer := range manifest.Layers {
+		if _, ok := optional[layer.Digest]; !ok {
+			layers = append(layers, layer)
+		}
+	}
 	if manifest.Config.Digest != "" {
 		layers = append(layers, manifest.Config)
 	}
 
-	skipVerify := make(map[string]bool)
+	// Other servers sharing the models directory wait for the blobs to be
+	// pulled rather than pulling them over each other, and don't remove them
+	// before the manifest referencing them is written
+	digests := make([]string, 0, len(layers))
 	for _, layer := range layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, v := range selected {
+		for _, layer := range v.Layers {
+			digests = append(digests, layer.Digest)
+		}
+	}
+
+	unlock, err := lockBlobs(ctx, digests)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	transferred := slices.Clone(layers)
+	for _, v := range selected {
+		transferred = append(transferred, v.Layers...)
+	}
+	fn = transferProgress(fn, transferred)
+
+	skipVerify := make(map[string]bool)
+	download := func(layer Layer) error {
 		cacheHit, err := downloadBlob(ctx, downloadOpts{
 			mp:      mp,
 			digest:  layer.Digest,
+			size:    layer.Size,
 			regOpts: regOpts,
 			fn:      fn,
 		})
@@ -893,10 +1327,33 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		}
 		skipVerify[layer.Digest] = cacheHit
 		delete(deleteMap, layer.Digest)
+		return nil
+	}
+
+	for _, layer := range layers {
+		if err := download(layer); err != nil {
+			return err
+		}
 	}
 	delete(deleteMap, manifest.Config.Digest)
 
-	fn(api.ProgressResponse{Status: "verifying sha256 digest"})
+	for _, v := range selected {
+		fn(api.ProgressResponse{Status: fmt.Sprintf("pulling %s variant", v.Quantization), Phase: api.PhaseDownloading})
+		for _, layer := range v.Layers {
+			if err := download(layer); err != nil {
+				return err
+			}
+
+			layers = append(layers, layer)
+		}
+	}
+
+	// variants pulled before are kept even if they weren't selected this time
+	for _, layer := range manifest.allLayers() {
+		delete(deleteMap, layer.Digest)
+	}
+
+	fn(api.ProgressResponse{Status: "verifying sha256 digest", Phase: api.PhaseVerifying})
 	for _, layer := range layers {
 		if skipVerify[layer.Digest] {
 			continue
@@ -904,37 +1361,21 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		if err := verifyBlob(layer.Digest); err != nil {
 			if errors.Is(err, errDigestMismatch) {
 				// something went wrong, delete the blob
-				fp, err := GetBlobsPath(layer.Digest)
-				if err != nil {
-					return err
-				}
-				if err := os.Remove(fp); err != nil {
+				if err := storage().DeleteBlob(layer.Digest); err != nil {
 					// log this, but return the original error
-					slog.Info(fmt.Sprintf("couldn't remove file with digest mismatch '%s': %v", fp, err))
+					slog.Info(fmt.Sprintf("couldn't remove blob with digest mismatch '%s': %v", layer.Digest, err))
 				}
 			}
 			return err
 		}
 	}
 
-	fn(api.ProgressResponse{Status: "writing manifest"})
+	fn(api.ProgressResponse{Status: "writing manifest", Phase: api.PhaseWriting})
 
-	manifestJSON, err := json.Marshal(manifest)
-	if err != nil {
-		return err
-	}
-
-	fp, err := mp.GetManifestPath()
-	if err != nil {
-		return err
-	}
-	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
-		return err
-	}
-
-	err = os.WriteFile(fp, manifestJSON, 0o644)
-	if err != nil {
-		slog.Info(fmt.Sprintf("couldn't write to %s", fp))
+	// the manifest is written as the registry sent it, so its digest is the
+	// registry's
+	if err := storage().WriteManifest(mp.name(), manifestJSON); err != nil {
+		slog.Info(fmt.Sprintf("couldn't write manifest of %s", mp.GetShortTagname()))
 		return err
 	}
 
@@ -945,28 +1386,89 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		}
 	}
 
-	fn(api.ProgressResponse{Status: "success"})
+	fn(api.ProgressResponse{Status: "success", Phase: api.PhaseSuccess})
 
 	return nil
 }
 
-func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*Manifest, error) {
-	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+// pullModelManifest pulls the manifest of mp, returning it with the bytes the
+// registry sent. The manifest of a model pinned to a digest is checked
+// against the digest.
+func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*Manifest, []byte, error) {
+	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.reference())
 
 	headers := make(http.Header)
 	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
 	resp, err := makeRequestWithRetry(ctx, http.MethodGet, requestURL, headers, nil, regOpts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sha256sum := sha256.Sum256(b)
+	if got := "sha256:" + hex.EncodeToString(sha256sum[:]); mp.Digest != "" && got != mp.Digest {
+		return nil, nil, fmt.Errorf("%s: the registry's manifest has the digest %s", mp.GetShortTagname(), got)
+	}
+
 	var m Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return nil, err
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, nil, err
 	}
 
-	return &m, err
+	m.digest = hex.EncodeToString(sha256sum[:])
+	return &m, b, nil
+}
+
+// pullPinnedLocally pins mp to a local manifest with its digest if there's
+// one with all of its layers, reporting whether there was. No variants of
+// the manifest are pulled.
+func pullPinnedLocally(mp ModelPath, fn func(api.ProgressResponse)) (bool, error) {
+	n := mp.name()
+	f, stored, err := openManifest(n)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return false, err
+	}
+
+	st := storage()
+	optional := m.variantLayers()
+	for _, layer := range append(m.Layers, m.Config) {
+		if _, ok := optional[layer.Digest]; ok || layer.Digest == "" {
+			continue
+		}
+
+		if _, err := st.StatBlob(layer.Digest); err != nil {
+			return false, nil
+		}
+	}
+
+	// the manifest of a tag is copied so the pin outlives changes to the tag
+	if stored != n {
+		fn(api.ProgressResponse{Status: "writing manifest", Phase: api.PhaseWriting})
+		if err := st.WriteManifest(n, b); err != nil {
+			return false, err
+		}
+	}
+
+	fn(api.ProgressResponse{Status: "success", Phase: api.PhaseSuccess})
+	return true, nil
 }
 
 // GetSHA256Digest returns the SHA256 hash of a given buffer and returns it, and the size of buffer
@@ -982,6 +1484,9 @@ func GetSHA256Digest(r io.Reader) (string, int64) {
 
 var errUnauthorized = errors.New("unauthorized: access denied")
 
+// errOffline is returned for requests to registries when OLLAMA_OFFLINE is set
+var errOffline = errors.New("server is in offline mode")
+
 // getTokenSubject returns the subject of a JWT token, it does not validate the token
 func getTokenSubject(token string) string {
 	parts := strings.Split(token, ".")
@@ -1027,14 +1532,22 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 		case resp.StatusCode == http.StatusUnauthorized:
 			resp.Body.Close()
 
-			// Handle authentication error with one retry
-			challenge := parseRegistryChallenge(resp.Header.Get("www-authenticate"))
-			token, err := getAuthorizationToken(ctx, challenge)
-			if err != nil {
-				return nil, err
+			// Handle authentication error with one retry, using stored
+			// credentials for the registry in place of the Ollama key
+			header := resp.Header.Get("www-authenticate")
+			if c := registryCredential(requestURL.Host); c != nil {
+				if err := useCredential(ctx, header, c, regOpts); err != nil {
+					return nil, err
+				}
+				anonymous = false
+			} else {
+				token, err := getAuthorizationToken(ctx, parseRegistryChallenge(header))
+				if err != nil {
+					return nil, err
+				}
+				anonymous = getTokenSubject(token) == "anonymous"
+				regOpts.Token = token
 			}
-			anonymous = getTokenSubject(token) == "anonymous"
-			regOpts.Token = token
 			if body != nil {
 				_, err = body.Seek(0, io.SeekStart)
 				if err != nil {
@@ -1044,6 +1557,18 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 		case resp.StatusCode == http.StatusNotFound:
 			resp.Body.Close()
 			return nil, os.ErrNotExist
+		case resp.StatusCode == http.StatusForbidden:
+			// the registry explains why access is denied, so pass that on
+			defer resp.Body.Close()
+			responseBody, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", resp.StatusCode, err)
+			}
+			if msg := registryErrorMessage(responseBody); msg != "" {
+				return nil, errors.New(msg)
+			}
+			// responses to HEAD requests have no body
+			return nil, fmt.Errorf("%d: %s", resp.StatusCode, http.StatusText(resp.StatusCode))
 		case resp.StatusCode >= http.StatusBadRequest:
 			defer resp.Body.Close()
 			responseBody, err := io.ReadAll(resp.Body)
@@ -1069,7 +1594,38 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 	return nil, errUnauthorized
 }
 
+// registryErrorMessage returns the messages of a registry's error response,
+// which lists errors as {"errors": [{"code": ..., "message": ...}]}, or the
+// response itself if it isn't one
+func registryErrorMessage(body []byte) string {
+	var resp struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	var messages []string
+	if err := json.Unmarshal(body, &resp); err == nil {
+		for _, e := range resp.Errors {
+			if e.Message != "" {
+				messages = append(messages, e.Message)
+			}
+		}
+	}
+
+	if len(messages) == 0 {
+		return strings.TrimSpace(string(body))
+	}
+
+	return strings.Join(messages, "; ")
+}
+
 func makeRequest(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.Reader, regOpts *registryOptions) (*http.Response, error) {
+	if envconfig.Offline() {
+		return nil, errOffline
+	}
+
 	if requestURL.Scheme != "http" && regOpts != nil && regOpts.Insecure {
 		requestURL.Scheme = "http"
 	}
@@ -1103,6 +1659,7 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 	}
 
 	resp, err := (&http.Client{
+		Transport:     registryTransport,
 		CheckRedirect: regOpts.CheckRedirect,
 	}).Do(req)
 	if err != nil {
@@ -1148,12 +1705,7 @@ func parseRegistryChallenge(authStr string) registryChallenge {
 var errDigestMismatch = errors.New("digest mismatch, file must be downloaded again")
 
 func verifyBlob(digest string) error {
-	fp, err := GetBlobsPath(digest)
-	if err != nil {
-		return err
-	}
-
-	f, err := os.Open(fp)
+	f, err := storage().OpenBlob(digest)
 	if err != nil {
 		return err
 	}
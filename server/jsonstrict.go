@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+const (
+	defaultJSONRetries = 2
+
+	// maxJSONRetries bounds json_retries, since each retry generates the
+	// whole response again
+	maxJSONRetries = 10
+
+	// jsonRepairTokens bounds how many more tokens are generated to finish
+	// a response that was cut off
+	jsonRepairTokens = 256
+)
+
+// invalidJSONCode is the code of error responses for json_strict requests
+// whose response couldn't be made valid JSON
+const invalidJSONCode = "invalid_json"
+
+// invalidJSONError is returned for a json_strict response that couldn't be
+// made valid JSON, with the last response generated
+type invalidJSONError struct {
+	Policy   string
+	Retries  int
+	Response string
+}
+
+func (e *invalidJSONError) Error() string {
+	if e.Policy == api.JSONStrictRetry {
+		return fmt.Sprintf("response isn't valid JSON after %d retries", e.Retries)
+	}
+
+	return "response isn't valid JSON and couldn't be completed"
+}
+
+func checkJSONStrict(policy, format string, retries *int) error {
+	switch policy {
+	case "":
+		return nil
+	case api.JSONStrictRepair, api.JSONStrictRetry:
+	default:
+		return fmt.Errorf("invalid json_strict %q, expected %s or %s", policy, api.JSONStrictRepair, api.JSONStrictRetry)
+	}
+
+	if format != "json" {
+		return errors.New(`json_strict requires format "json"`)
+	}
+
+	if retries != nil && (*retries < 0 || *retries > maxJSONRetries) {
+		return fmt.Errorf("json_retries must be between 0 and %d", maxJSONRetries)
+	}
+
+	return nil
+}
+
+// completionFunc runs a completion, as traceCompletion does
+type completionFunc func(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error
+
+// jsonStrictCompletion returns a completionFunc that buffers the whole
+// response to check that it's valid JSON, repairing it or generating it
+// again under policy, and records how in result. Repairs are generated too,
+// as in repairJSON. fn is called once, with the
+// final response and all of its content. Retries of a request with a fixed
+// seed are offset by stride, the number of choices, so they sample
+// differently from each other and from the other choices.
+func jsonStrictCompletion(policy string, retries *int, stride int, result *api.JSONStrictResult) completionFunc {
+	maxRetries := defaultJSONRetries
+	if retries != nil {
+		maxRetries = *retries
+	}
+
+	return func(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+		for {
+			var sb strings.Builder
+			var final llm.CompletionResponse
+			if err := traceCompletion(ctx, r, req, func(cr llm.CompletionResponse) {
+				sb.WriteString(cr.Content)
+				if cr.Done {
+					final = cr
+				}
+			}); err != nil {
+				return err
+			}
+
+			content := sb.String()
+			switch {
+			case json.Valid([]byte(content)):
+			case policy == api.JSONStrictRepair:
+				repaired, ok, err := repairJSON(ctx, r, req, content, &final)
+				if err != nil {
+					return err
+				} else if !ok {
+					return &invalidJSONError{Policy: policy, Response: repaired}
+				}
+
+				result.Repaired = true
+				content = repaired
+			default:
+				if result.Retries >= maxRetries {
+					return &invalidJSONError{Policy: policy, Retries: result.Retries, Response: content}
+				}
+
+				slog.Debug("response isn't valid JSON, generating it again", "retry", result.Retries+1)
+				result.Retries++
+				if req.Options != nil && req.Options.Seed >= 0 {
+					opts := *req.Options
+					opts.Seed += stride
+					req.Options = &opts
+				}
+				continue
+			}
+
+			final.Content = content
+			fn(final)
+			return nil
+		}
+	}
+}
+
+// completionError is the response sent for an error from a completion
+func completionError(err error) gin.H {
+	var jerr *invalidJSONError
+	if errors.As(err, &jerr) {
+		return gin.H{
+			"error":    jerr.Error(),
+			"code":     invalidJSONCode,
+			"retries":  jerr.Retries,
+			"response": jerr.Response,
+		}
+	}
+
+	return gin.H{"error": err.Error()}
+}
+
+// repairJSON makes s, a response that isn't valid JSON, valid. Text after
+// the first complete array or object is dropped. A response that was cut off
+// before the array or object ended is continued for up to jsonRepairTokens
+// more tokens, stopping once it ends, adding the tokens generated to final.
+// It returns false, with the response as far as it got, if s doesn't start
+// with an array or object or it still isn't valid.
+func repairJSON(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, s string, final *llm.CompletionResponse) (string, bool, error) {
+	var scan jsonScanner
+	if end := scan.feed(s); end >= 0 {
+		v := strings.TrimSpace(s[:end])
+		return v, json.Valid([]byte(v)), nil
+	} else if scan.invalid {
+		return s, false, nil
+	}
+
+	opts := api.DefaultOptions()
+	if req.Options != nil {
+		opts = *req.Options
+	}
+	opts.NumPredict = jsonRepairTokens
+
+	// the continuation is generated without the JSON grammar, which would
+	// start a new value rather than finish this one
+	req.Prompt += s
+	req.Format = ""
+	req.Options = &opts
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var sb strings.Builder
+	sb.WriteString(s)
+	end, tokens := -1, 0
+	err := traceCompletion(ctx, r, req, func(cr llm.CompletionResponse) {
+		if end >= 0 {
+			return
+		}
+
+		if cr.Content != "" {
+			tokens++
+		}
+
+		sb.WriteString(cr.Content)
+		if end = scan.feed(cr.Content); end >= 0 {
+			cancel()
+		} else if cr.Done {
+			tokens = cr.EvalCount
+		}
+	})
+	if err != nil && end < 0 {
+		return "", false, err
+	}
+
+	final.EvalCount += tokens
+	if end < 0 {
+		return sb.String(), false, nil
+	}
+
+	final.DoneReason = "stop"
+	v := strings.TrimSpace(sb.String()[:end])
+	return v, json.Valid([]byte(v)), nil
+}
+
+// jsonScanner finds the end of the array or object text starts with, as the
+// text is generated
+type jsonScanner struct {
+	// n is the number of bytes scanned
+	n     int
+	depth int
+
+	inString, escaped bool
+
+	// invalid is set if the text doesn't start with an array or object
+	invalid bool
+}
+
+// feed scans s, the next piece of the text, returning the offset just past
+// the end of the array or object in all the text scanned, or -1 if it hasn't
+// ended
+func (j *jsonScanner) feed(s string) int {
+	for i := 0; i < len(s) && !j.invalid; i++ {
+		c := s[i]
+		switch {
+		case j.inString:
+			switch {
+			case j.escaped:
+				j.escaped = false
+			case c == '\\':
+				j.escaped = true
+			case c == '"':
+				j.inString = false
+			}
+		case c == '{' || c == '[':
+			j.depth++
+		case c == '}' || c == ']':
+			j.depth--
+			if j.depth <= 0 {
+				j.n += i + 1
+				return j.n
+			}
+		case j.depth == 0:
+			j.invalid = !strings.ContainsRune(" \t\r\n", rune(c))
+		case c == '"':
+			j.inString = true
+		}
+	}
+
+	j.n += len(s)
+	return -1
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestRepairJSON(t *testing.T) {
+	cases := []struct {
+		in string
+		// continuation is what the runner generates to continue the
+		// response, if it's asked to
+		continuation string
+		want         string
+		ok           bool
+	}{
+		{in: `{"a": 1} I hope this helps!`, want: `{"a": 1}`, ok: true},
+		{in: "\n[1, 2]\n\nDone.", want: `[1, 2]`, ok: true},
+		{in: `{"a": "}", "b": 1} {`, want: `{"a": "}", "b": 1}`, ok: true},
+		{in: `{"a": [1, {"b": 2`, continuation: `}]} and more`, want: `{"a": [1, {"b": 2}]}`, ok: true},
+		{in: `{"a": "hel`, continuation: `lo"}`, want: `{"a": "hello"}`, ok: true},
+		{in: `{"a": "hel\`, continuation: `"lo"}`, want: `{"a": "hel\"lo"}`, ok: true},
+		{in: `{"a": 1,`, continuation: ` "b": 2`, want: `{"a": 1, "b": 2`},
+		{in: `{"a": 1,`, continuation: `}`, want: `{"a": 1,}`},
+		{in: `Sure! {"a": 1}`, want: `Sure! {"a": 1}`},
+		{in: `{"a": 1]`, want: `{"a": 1]`},
+	}
+
+	for _, tt := range cases {
+		r := &sequenceRunner{}
+		if tt.continuation != "" {
+			r.responses = []string{tt.continuation}
+		}
+
+		opts := api.DefaultOptions()
+		final := llm.CompletionResponse{DoneReason: "length", EvalCount: 10}
+		got, ok, err := repairJSON(context.Background(), r, llm.CompletionRequest{Prompt: "prompt", Format: "json", Options: &opts}, tt.in, &final)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("repairJSON(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+
+		if tt.continuation == "" {
+			if len(r.requests) > 0 {
+				t.Errorf("%q: expected no continuation, got %+v", tt.in, r.requests)
+			}
+			continue
+		}
+
+		// the response is continued without the grammar, for a bounded
+		// number of tokens
+		if len(r.requests) != 1 {
+			t.Fatalf("%q: expected one continuation, got %d", tt.in, len(r.requests))
+		}
+
+		req := r.requests[0]
+		if req.Prompt != "prompt"+tt.in || req.Format != "" || req.Options.NumPredict != jsonRepairTokens {
+			t.Errorf("%q: unexpected continuation request %+v", tt.in, req)
+		}
+
+		if final.EvalCount <= 10 {
+			t.Errorf("%q: expected the continuation's tokens to be counted, got %d", tt.in, final.EvalCount)
+		}
+	}
+}
+
+func TestCheckJSONStrict(t *testing.T) {
+	retries := func(n int) *int { return &n }
+
+	cases := []struct {
+		policy, format string
+		retries        *int
+		ok             bool
+	}{
+		{ok: true},
+		{policy: api.JSONStrictRepair, format: "json", ok: true},
+		{policy: api.JSONStrictRetry, format: "json", retries: retries(0), ok: true},
+		{policy: api.JSONStrictRetry, format: "json", retries: retries(maxJSONRetries + 1)},
+		{policy: api.JSONStrictRetry, format: "json", retries: retries(-1)},
+		{policy: api.JSONStrictRepair},
+		{policy: "fix", format: "json"},
+	}
+
+	for _, tt := range cases {
+		if err := checkJSONStrict(tt.policy, tt.format, tt.retries); (err == nil) != tt.ok {
+			t.Errorf("checkJSONStrict(%q, %q, %v) = %v", tt.policy, tt.format, tt.retries, err)
+		}
+	}
+}
+
+// sequenceRunner responds to each completion with the next of responses,
+// streamed a byte at a time
+type sequenceRunner struct {
+	llm.LlamaServer
+
+	responses []string
+	requests  []llm.CompletionRequest
+}
+
+func (r *sequenceRunner) Completion(_ context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	r.requests = append(r.requests, req)
+	s := r.responses[0]
+	r.responses = r.responses[1:]
+	for i := range len(s) {
+		fn(llm.CompletionResponse{Content: s[i : i+1]})
+	}
+	fn(llm.CompletionResponse{Done: true, DoneReason: "stop", EvalCount: len(s)})
+	return nil
+}
+
+func TestJSONStrictCompletion(t *testing.T) {
+	complete := func(t *testing.T, r *sequenceRunner, policy string, retries *int) (*api.JSONStrictResult, []llm.CompletionResponse, error) {
+		t.Helper()
+
+		opts := api.DefaultOptions()
+		opts.Seed = 10
+
+		var result api.JSONStrictResult
+		var responses []llm.CompletionResponse
+		err := jsonStrictCompletion(policy, retries, 2, &result)(context.Background(), r, llm.CompletionRequest{Options: &opts}, func(cr llm.CompletionResponse) {
+			responses = append(responses, cr)
+		})
+		return &result, responses, err
+	}
+
+	t.Run("repair", func(t *testing.T) {
+		result, responses, err := complete(t, &sequenceRunner{responses: []string{`{"a": [1, 2`, `]}`}}, api.JSONStrictRepair, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(responses) != 1 || responses[0].Content != `{"a": [1, 2]}` || !responses[0].Done || responses[0].EvalCount != 13 {
+			t.Errorf("expected one repaired response, got %+v", responses)
+		}
+
+		if !result.Repaired || result.Retries != 0 {
+			t.Errorf("unexpected result %+v", result)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		r := &sequenceRunner{responses: []string{`{"a": `, `{"a": 1}`}}
+		result, responses, err := complete(t, r, api.JSONStrictRetry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(responses) != 1 || responses[0].Content != `{"a": 1}` {
+			t.Errorf("expected the retried response, got %+v", responses)
+		}
+
+		if result.Repaired || result.Retries != 1 {
+			t.Errorf("unexpected result %+v", result)
+		}
+
+		if len(r.requests) != 2 || r.requests[0].Options.Seed != 10 || r.requests[1].Options.Seed != 12 {
+			t.Errorf("expected retries to be offset by the number of choices, got %+v", r.requests)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		retries := 1
+		_, responses, err := complete(t, &sequenceRunner{responses: []string{`nope`, `still no`}}, api.JSONStrictRetry, &retries)
+
+		var jerr *invalidJSONError
+		if !errors.As(err, &jerr) || jerr.Retries != 1 || jerr.Response != "still no" {
+			t.Fatalf("expected an invalid JSON error, got %v", err)
+		}
+
+		if len(responses) != 0 {
+			t.Errorf("expected no responses, got %+v", responses)
+		}
+
+		if h := completionError(err); h["code"] != invalidJSONCode || h["response"] != "still no" {
+			t.Errorf("unexpected error response %v", h)
+		}
+	})
+}
@@ -40,18 +40,12 @@ func NewLayer(r io.Reader, mediatype string) (Layer, error) {
 	}
 
 	digest := fmt.Sprintf("sha256:%x", sha256sum.Sum(nil))
-	blob, err := GetBlobsPath(digest)
-	if err != nil {
-		return Layer{}, err
-	}
+	st := storage()
 
 	status := "using existing layer"
-	if _, err := os.Stat(blob); err != nil {
+	if _, err := st.StatBlob(digest); err != nil {
 		status = "creating new layer"
-		if err := os.Rename(temp.Name(), blob); err != nil {
-			return Layer{}, err
-		}
-		if err := os.Chmod(blob, 0o644); err != nil {
+		if err := st.WriteBlob(digest, temp.Name()); err != nil {
 			return Layer{}, err
 		}
 	}
@@ -69,12 +63,7 @@ func NewLayerFromLayer(digest, mediatype, from string) (Layer, error) {
 		return Layer{}, errors.New("creating new layer from layer with empty digest")
 	}
 
-	blob, err := GetBlobsPath(digest)
-	if err != nil {
-		return Layer{}, err
-	}
-
-	fi, err := os.Stat(blob)
+	fi, err := storage().StatBlob(digest)
 	if err != nil {
 		return Layer{}, err
 	}
@@ -93,12 +82,7 @@ func (l *Layer) Open() (io.ReadSeekCloser, error) {
 		return nil, errors.New("opening layer with empty digest")
 	}
 
-	blob, err := GetBlobsPath(l.Digest)
-	if err != nil {
-		return nil, err
-	}
-
-	return os.Open(blob)
+	return storage().OpenBlob(l.Digest)
 }
 
 func (l *Layer) Remove() error {
@@ -106,13 +90,18 @@ func (l *Layer) Remove() error {
 		return nil
 	}
 
+	if lockHeld(blobLockName(l.Digest)) {
+		// a pull is about to use this layer
+		return nil
+	}
+
 	ms, err := Manifests()
 	if err != nil {
 		return err
 	}
 
 	for _, m := range ms {
-		for _, layer := range append(m.Layers, m.Config) {
+		for _, layer := range m.allLayers() {
 			if layer.Digest == l.Digest {
 				// something is using this layer
 				return nil
@@ -120,10 +109,5 @@ func (l *Layer) Remove() error {
 		}
 	}
 
-	blob, err := GetBlobsPath(l.Digest)
-	if err != nil {
-		return err
-	}
-
-	return os.Remove(blob)
+	return storage().DeleteBlob(l.Digest)
 }
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// licenseAnnotation marks a manifest whose license must be accepted before
+// the model is pulled or loaded. It's set by REQUIRE_LICENSE_ACCEPTANCE in
+// the Modelfile.
+const licenseAnnotation = "com.ollama.license.require-acceptance"
+
+// licenseRequiredCode is the code of error responses for models whose
+// license hasn't been accepted, so clients can present the license
+const licenseRequiredCode = "license_required"
+
+var errLicenseRequired = errors.New("license must be accepted")
+
+// licenseError is returned for a model whose license hasn't been accepted,
+// with the license text to present
+type licenseError struct {
+	model   string
+	license string
+}
+
+func (e *licenseError) Error() string {
+	return fmt.Sprintf("the license of %s must be accepted before it's used", e.model)
+}
+
+func (e *licenseError) Unwrap() error {
+	return errLicenseRequired
+}
+
+// licenseErrorResponse returns the error response for err if it's a
+// licenseError
+func licenseErrorResponse(err error) (gin.H, bool) {
+	var lerr *licenseError
+	if !errors.As(err, &lerr) {
+		return nil, false
+	}
+
+	return gin.H{"error": err.Error(), "code": licenseRequiredCode, "license": lerr.license}, true
+}
+
+// licenseAcceptance records that a user accepted a model's license. It
+// applies to any model with the same license layers, and no longer applies
+// once they change.
+type licenseAcceptance struct {
+	Model       string    `json:"model"`
+	ModelDigest string    `json:"model_digest"`
+	Licenses    []string  `json:"licenses"`
+	User        string    `json:"user,omitempty"`
+	AcceptedAt  time.Time `json:"accepted_at"`
+}
+
+// licensesMu serializes updates to the license acceptance file
+var licensesMu sync.Mutex
+
+func licenseAcceptancesPath() string {
+	return filepath.Join(envconfig.Models(), "licenses.json")
+}
+
+func readLicenseAcceptances() ([]licenseAcceptance, error) {
+	b, err := os.ReadFile(licenseAcceptancesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var acceptances []licenseAcceptance
+	if err := json.Unmarshal(b, &acceptances); err != nil {
+		return nil, fmt.Errorf("%s: %w", licenseAcceptancesPath(), err)
+	}
+
+	return acceptances, nil
+}
+
+func (m *Manifest) requiresLicenseAcceptance() bool {
+	return m.Annotations[licenseAnnotation] == "true"
+}
+
+// licenseDigests returns the digests of the license layers of m
+func (m *Manifest) licenseDigests() []string {
+	var digests []string
+	for _, layer := range m.Layers {
+		if layer.MediaType == "application/vnd.ollama.image.license" {
+			digests = append(digests, layer.Digest)
+		}
+	}
+
+	return digests
+}
+
+// licenseAccepted reports whether a license with the given layers has been
+// accepted
+func licenseAccepted(digests []string) (bool, error) {
+	licensesMu.Lock()
+	defer licensesMu.Unlock()
+
+	acceptances, err := readLicenseAcceptances()
+	if err != nil {
+		return false, err
+	}
+
+	return slices.ContainsFunc(acceptances, func(a licenseAcceptance) bool {
+		return slices.Equal(a.Licenses, digests)
+	}), nil
+}
+
+// acceptLicense records that user accepted the license of the model name
+// with manifest m
+func acceptLicense(name string, m *Manifest, user string) error {
+	digest, err := m.signedDigest()
+	if err != nil {
+		return err
+	}
+
+	licensesMu.Lock()
+	defer licensesMu.Unlock()
+
+	acceptances, err := readLicenseAcceptances()
+	if err != nil {
+		return err
+	}
+
+	acceptances = append(acceptances, licenseAcceptance{
+		Model:       name,
+		ModelDigest: digest,
+		Licenses:    m.licenseDigests(),
+		User:        user,
+		AcceptedAt:  time.Now().UTC(),
+	})
+
+	b, err := json.MarshalIndent(acceptances, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(envconfig.Models(), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(envconfig.Models(), ".licenses-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	slog.Info("accepted model license", "model", name, "user", user, "licenses", m.licenseDigests())
+	return os.Rename(f.Name(), licenseAcceptancesPath())
+}
+
+// checkModelLicense returns a licenseError if m requires its license to be
+// accepted and it hasn't been
+func checkModelLicense(m *Model) error {
+	if !m.RequireLicenseAcceptance {
+		return nil
+	}
+
+	accepted, err := licenseAccepted(m.LicenseDigests)
+	if err != nil {
+		return err
+	}
+
+	if accepted {
+		return nil
+	}
+
+	return &licenseError{model: m.ShortName, license: strings.Join(m.License, "\n\n")}
+}
+
+// checkPullLicense returns a licenseError if the model being pulled requires
+// its license to be accepted and it hasn't been. Only the license layers are
+// downloaded, so the license can be presented before the rest of the model.
+func checkPullLicense(ctx context.Context, mp ModelPath, m *Manifest, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	if !m.requiresLicenseAcceptance() {
+		return nil
+	}
+
+	accepted, err := licenseAccepted(m.licenseDigests())
+	if err != nil {
+		return err
+	}
+
+	if accepted {
+		return nil
+	}
+
+	var licenses []string
+	for _, digest := range m.licenseDigests() {
+		if _, err := downloadBlob(ctx, downloadOpts{mp: mp, digest: digest, regOpts: regOpts, fn: fn}); err != nil {
+			return err
+		}
+
+		if err := verifyBlob(digest); err != nil {
+			return err
+		}
+
+		p, err := GetBlobsPath(digest)
+		if err != nil {
+			return err
+		}
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		licenses = append(licenses, string(b))
+	}
+
+	return &licenseError{model: mp.GetShortTagname(), license: strings.Join(licenses, "\n\n")}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestLicenseAcceptance(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	create := func(t *testing.T, name, modelfile string) {
+		t.Helper()
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: modelfile,
+			Stream:    &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	check := func(t *testing.T, name string) error {
+		t.Helper()
+		m, err := GetModel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return checkModelLicense(m)
+	}
+
+	bin := createBinFile(t, nil, nil)
+	create(t, "gated", fmt.Sprintf("FROM %s\nLICENSE \"terms v1\"\nREQUIRE_LICENSE_ACCEPTANCE true", bin))
+
+	t.Run("annotation", func(t *testing.T) {
+		m, err := ParseNamedManifest(model.ParseName("gated"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !m.requiresLicenseAcceptance() {
+			t.Errorf("expected the manifest to require license acceptance, got %v", m.Annotations)
+		}
+	})
+
+	t.Run("missing license", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "unlicensed",
+			Modelfile: fmt.Sprintf("FROM %s\nREQUIRE_LICENSE_ACCEPTANCE true", bin),
+			Stream:    &stream,
+		})
+		if w.Code == http.StatusOK {
+			t.Error("expected a model without a license to be rejected")
+		}
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "gated", Prompt: "hi"})
+		if w.Code != http.StatusUnavailableForLegalReasons {
+			t.Fatalf("expected status code 451, actual %d", w.Code)
+		}
+
+		var resp struct {
+			Code    string `json:"code"`
+			License string `json:"license"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != licenseRequiredCode || resp.License != "terms v1" {
+			t.Errorf("expected the license to be returned, got %+v", resp)
+		}
+	})
+
+	t.Run("derived", func(t *testing.T) {
+		create(t, "derived", "FROM gated\nSYSTEM hello")
+		if err := check(t, "derived"); !errors.Is(err, errLicenseRequired) {
+			t.Errorf("expected a model created from a gated model to require acceptance, got %v", err)
+		}
+	})
+
+	t.Run("accept", func(t *testing.T) {
+		w := createRequest(t, s.AcceptLicenseHandler, api.AcceptLicenseRequest{Model: "gated", User: "alice"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		acceptances, err := readLicenseAcceptances()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(acceptances) != 1 || acceptances[0].Model != "gated:latest" || acceptances[0].User != "alice" || acceptances[0].ModelDigest == "" || acceptances[0].AcceptedAt.IsZero() {
+			t.Errorf("expected the acceptance to be recorded, got %+v", acceptances)
+		}
+
+		for _, name := range []string{"gated", "derived"} {
+			if err := check(t, name); err != nil {
+				t.Errorf("expected %s to be accepted, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("license changed", func(t *testing.T) {
+		create(t, "gated", fmt.Sprintf("FROM %s\nLICENSE \"terms v2\"\nREQUIRE_LICENSE_ACCEPTANCE true", bin))
+		if err := check(t, "gated"); !errors.Is(err, errLicenseRequired) {
+			t.Errorf("expected a new license to require acceptance again, got %v", err)
+		}
+	})
+}
+
+func TestPullLicense(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	registry := newSignatureRegistry(t)
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := fmt.Sprintf("%s/library/gated:latest", u.Host)
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      name,
+		Modelfile: fmt.Sprintf("FROM %s\nLICENSE \"terms\"\nREQUIRE_LICENSE_ACCEPTANCE true", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	opts := &registryOptions{Insecure: true}
+	fn := func(api.ProgressResponse) {}
+	if err := PushModel(context.Background(), "http://"+name, opts, false, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	// the registry only serves manifests, so the blobs are kept to pull from
+	m, err := ParseNamedManifest(model.ParseName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PullModel(context.Background(), "http://"+name, opts, fn); !errors.Is(err, errLicenseRequired) {
+		t.Fatalf("expected the pull to require the license to be accepted, got %v", err)
+	}
+
+	if _, err := ParseNamedManifest(model.ParseName(name)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the model not to be pulled, got %v", err)
+	}
+
+	w = createRequest(t, s.AcceptLicenseHandler, api.AcceptLicenseRequest{Model: name, User: "alice", Insecure: true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := PullModel(context.Background(), "http://"+name, opts, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	pulled, err := ParseNamedManifest(model.ParseName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pulled.requiresLicenseAcceptance() || pulled.Config.Digest != m.Config.Digest {
+		t.Errorf("expected the pulled model to match the pushed one, got %+v", pulled)
+	}
+}
@@ -1,16 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"slices"
+	"strings"
 
+	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/types/model"
 )
 
@@ -20,34 +25,121 @@ type Manifest struct {
 	Config        Layer   `json:"config"`
 	Layers        []Layer `json:"layers"`
 
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Variants are the quantizations of the model, each with the layers that
+	// replace the model's weights. Layers has the weights of the default
+	// variant, so older versions load it. Variants don't all have to be
+	// pulled.
+	Variants []Variant `json:"variants,omitempty"`
+
+	name     model.Name
 	filepath string
 	fi       os.FileInfo
 	digest   string
 }
 
+// Variant is a quantization of a model with variants
+type Variant struct {
+	Quantization string  `json:"quantization"`
+	Layers       []Layer `json:"layers"`
+}
+
 func (m *Manifest) Size() (size int64) {
-	for _, layer := range append(m.Layers, m.Config) {
+	for _, layer := range m.allLayers() {
 		size += layer.Size
 	}
 
 	return
 }
 
+// allLayers returns the manifest's layers, its config and the layers of its
+// variants that aren't also in Layers
+func (m *Manifest) allLayers() []Layer {
+	layers := append(slices.Clone(m.Layers), m.Config)
+	for _, v := range m.Variants {
+		for _, layer := range v.Layers {
+			if !slices.ContainsFunc(layers, func(l Layer) bool { return l.Digest == layer.Digest }) {
+				layers = append(layers, layer)
+			}
+		}
+	}
+
+	return layers
+}
+
+// variantLayers returns the digests of the layers of the manifest's
+// variants, which may not have been pulled
+func (m *Manifest) variantLayers() map[string]struct{} {
+	digests := make(map[string]struct{})
+	for _, v := range m.Variants {
+		for _, layer := range v.Layers {
+			digests[layer.Digest] = struct{}{}
+		}
+	}
+
+	return digests
+}
+
 func (m *Manifest) Remove() error {
-	if err := os.Remove(m.filepath); err != nil {
-		return err
+	return storage().DeleteManifest(m.name)
+}
+
+// pulledVariants returns the variants whose layers have all been pulled
+func (m *Manifest) pulledVariants() []Variant {
+	var variants []Variant
+	st := storage()
+	for _, v := range m.Variants {
+		if !slices.ContainsFunc(v.Layers, func(layer Layer) bool {
+			_, err := st.StatBlob(layer.Digest)
+			return err != nil
+		}) {
+			variants = append(variants, v)
+		}
 	}
 
-	manifests, err := GetManifestPath()
-	if err != nil {
-		return err
+	return variants
+}
+
+// info describes the manifest for /api/show, with the paths of its files if
+// withPaths is set
+func (m *Manifest) info(withPaths bool) *api.ManifestInfo {
+	info := &api.ManifestInfo{
+		Digest:       m.digest,
+		ConfigDigest: m.Config.Digest,
+		Size:         m.Size(),
+		Layers:       []api.LayerInfo{},
+	}
+
+	if withPaths {
+		info.Path = m.filepath
+	}
+
+	st := storage()
+	for _, layer := range m.allLayers() {
+		l := api.LayerInfo{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size}
+		for _, v := range m.Variants {
+			if slices.ContainsFunc(v.Layers, func(vl Layer) bool { return vl.Digest == layer.Digest }) {
+				l.Variant = v.Quantization
+				break
+			}
+		}
+
+		if _, err := st.StatBlob(layer.Digest); err != nil {
+			l.Missing = true
+		} else if withPaths {
+			// blobs in other storage are cached at the same paths
+			l.Path, _ = GetBlobsPath(layer.Digest)
+		}
+
+		info.Layers = append(info.Layers, l)
 	}
 
-	return PruneDirectory(manifests)
+	return info
 }
 
 func (m *Manifest) RemoveLayers() error {
-	for _, layer := range append(m.Layers, m.Config) {
+	for _, layer := range m.allLayers() {
 		if layer.Digest != "" {
 			if err := layer.Remove(); errors.Is(err, os.ErrNotExist) {
 				slog.Debug("layer does not exist", "digest", layer.Digest)
@@ -60,20 +152,62 @@ func (m *Manifest) RemoveLayers() error {
 	return nil
 }
 
-func ParseNamedManifest(n model.Name) (*Manifest, error) {
-	if !n.IsFullyQualified() {
-		return nil, model.Unqualified(n)
+// openManifest opens the manifest of n, returning the name it's stored as.
+// Names pinned to a digest that weren't pulled by it open the manifest of a
+// tag of the model with that digest, so models can be pinned without a pull.
+func openManifest(n model.Name) (fs.File, model.Name, error) {
+	st := storage()
+	f, err := st.OpenManifest(n)
+	if n.Digest == "" || !errors.Is(err, fs.ErrNotExist) {
+		return f, n, err
 	}
 
-	manifests, err := GetManifestPath()
+	names, lerr := st.ListManifests()
+	if lerr != nil {
+		return nil, n, lerr
+	}
+
+	for _, tagged := range names {
+		if tagged.Digest != "" || !strings.EqualFold(tagged.Host, n.Host) || !strings.EqualFold(tagged.Namespace, n.Namespace) || !strings.EqualFold(tagged.Model, n.Model) {
+			continue
+		}
+
+		if digest, derr := manifestDigest(st, tagged); derr == nil && digest == n.Digest {
+			f, err := st.OpenManifest(tagged)
+			return f, tagged, err
+		}
+	}
+
+	return nil, n, err
+}
+
+// manifestDigest returns the digest of the manifest of n as it's stored,
+// which is the digest the registry has for pulled manifests
+func manifestDigest(st Storage, n model.Name) (string, error) {
+	f, err := st.OpenManifest(n)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	defer f.Close()
+
+	sha256sum := sha256.New()
+	if _, err := io.Copy(sha256sum, f); err != nil {
+		return "", err
 	}
 
-	p := filepath.Join(manifests, n.Filepath())
+	return "sha256:" + hex.EncodeToString(sha256sum.Sum(nil)), nil
+}
+
+// ParseNamedManifest reads the manifest of n. The manifest of a name pinned
+// to a digest may be that of a tag with the digest, as with openManifest,
+// in which case the manifest is named by the tag.
+func ParseNamedManifest(n model.Name) (*Manifest, error) {
+	if !n.IsFullyQualified() {
+		return nil, model.Unqualified(n)
+	}
 
 	var m Manifest
-	f, err := os.Open(p)
+	f, n, err := openManifest(n)
 	if err != nil {
 		return nil, err
 	}
@@ -89,82 +223,97 @@ func ParseNamedManifest(n model.Name) (*Manifest, error) {
 		return nil, err
 	}
 
-	m.filepath = p
+	m.name = n
+	if f, ok := f.(interface{ Name() string }); ok {
+		m.filepath = f.Name()
+	}
 	m.fi = fi
 	m.digest = hex.EncodeToString(sha256sum.Sum(nil))
 
 	return &m, nil
 }
 
-func WriteManifest(name model.Name, config Layer, layers []Layer) error {
+func WriteManifest(name model.Name, config Layer, layers []Layer, annotations map[string]string) error {
+	return writeManifest(name, Manifest{
+		Config:      config,
+		Layers:      layers,
+		Annotations: annotations,
+	})
+}
+
+// writeManifest writes m as the manifest of name
+func writeManifest(name model.Name, m Manifest) error {
+	m.SchemaVersion = 2
+	m.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(m); err != nil {
+		return err
+	}
+
+	return storage().WriteManifest(name, b.Bytes())
+}
+
+// writeManifestFile replaces the manifest at p with b. The manifest is
+// written to a temporary file and renamed into place, so it's never seen
+// partially written. The temporary file is outside the tree of model names
+// so it's never listed as a model.
+func writeManifestFile(p string, b []byte) error {
 	manifests, err := GetManifestPath()
 	if err != nil {
 		return err
 	}
 
-	p := filepath.Join(manifests, name.Filepath())
-	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+	unlock, err := lockStore(context.Background(), storeLockName)
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	f, err := os.Create(p)
+	f, err := os.CreateTemp(manifests, ".manifest-*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
-	m := Manifest{
-		SchemaVersion: 2,
-		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
-		Config:        config,
-		Layers:        layers,
+	if _, err := f.Write(b); err != nil {
+		return err
 	}
 
-	return json.NewEncoder(f).Encode(m)
-}
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
 
-func Manifests() (map[model.Name]*Manifest, error) {
-	manifests, err := GetManifestPath()
-	if err != nil {
-		return nil, err
+	if err := f.Close(); err != nil {
+		return err
 	}
 
-	// TODO(mxyng): use something less brittle
-	matches, err := filepath.Glob(filepath.Join(manifests, "*", "*", "*", "*"))
+	if err := os.Rename(f.Name(), p); err != nil {
+		return err
+	}
+
+	modelsVersion.Add(1)
+	return nil
+}
+
+func Manifests() (map[model.Name]*Manifest, error) {
+	names, err := storage().ListManifests()
 	if err != nil {
 		return nil, err
 	}
 
 	ms := make(map[model.Name]*Manifest)
-	for _, match := range matches {
-		fi, err := os.Stat(match)
-		if err != nil {
-			return nil, err
+	for _, n := range names {
+		m, err := ParseNamedManifest(n)
+		if syntax := &(json.SyntaxError{}); errors.As(err, &syntax) {
+			slog.Warn("bad manifest", "name", n, "error", err)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", n, err)
 		}
 
-		if !fi.IsDir() {
-			rel, err := filepath.Rel(manifests, match)
-			if err != nil {
-				slog.Warn("bad filepath", "path", match, "error", err)
-				continue
-			}
-
-			n := model.ParseNameFromFilepath(rel)
-			if !n.IsValid() {
-				slog.Warn("bad manifest name", "path", rel)
-				continue
-			}
-
-			m, err := ParseNamedManifest(n)
-			if syntax := &(json.SyntaxError{}); errors.As(err, &syntax) {
-				slog.Warn("bad manifest", "name", n, "error", err)
-				continue
-			} else if err != nil {
-				return nil, fmt.Errorf("%s: %w", n, err)
-			}
-
-			ms[n] = m
-		}
+		ms[n] = m
 	}
 
 	return ms, nil
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// metric is a Prometheus metric with a value per model
+type metric struct {
+	name, help, kind string
+	values           map[string]float64 // model -> value
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes metrics in the Prometheus text format, labelling
+// values with the model's digest
+func writeMetrics(w io.Writer, metrics []metric) error {
+	for _, m := range metrics {
+		if len(m.values) == 0 {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+
+		models := make([]string, 0, len(m.values))
+		for model := range m.values {
+			models = append(models, model)
+		}
+		slices.Sort(models)
+
+		for _, model := range models {
+			if _, err := fmt.Fprintf(w, "%s{model=\"%s\"} %g\n", m.name, labelEscaper.Replace(filepath.Base(model)), m.values[model]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// MetricsHandler reports the shared prompt cache, admission control, slow
+// client, runner warm pool and usage counters of each model in the
+// Prometheus text format
+func (s *Server) MetricsHandler(c *gin.Context) {
+	hits := metric{name: "ollama_prompt_cache_hits_total", help: "Requests whose prompt started with a prompt evaluated for another request.", kind: "counter", values: map[string]float64{}}
+	misses := metric{name: "ollama_prompt_cache_misses_total", help: "Requests whose prompt was looked up in the prompt cache and not found.", kind: "counter", values: map[string]float64{}}
+	tokens := metric{name: "ollama_prompt_cache_tokens_total", help: "Prompt tokens reused from other requests.", kind: "counter", values: map[string]float64{}}
+	for _, m := range s.sched.promptCache.state() {
+		hits.values[m.Model] = float64(m.Hits)
+		misses.values[m.Model] = float64(m.Misses)
+		tokens.values[m.Model] = float64(m.Tokens)
+	}
+
+	accepted := metric{name: "ollama_admission_accepted_total", help: "Requests admitted by admission control.", kind: "counter", values: map[string]float64{}}
+	rejected := metric{name: "ollama_admission_rejected_total", help: "Requests rejected for being predicted to miss OLLAMA_TARGET_TTFT.", kind: "counter", values: map[string]float64{}}
+	shed := metric{name: "ollama_admission_shed_total", help: "Queued requests shed for waiting longer than OLLAMA_TARGET_TTFT.", kind: "counter", values: map[string]float64{}}
+	for _, m := range s.sched.admission.state() {
+		accepted.values[m.Model] = float64(m.Accepted)
+		rejected.values[m.Model] = float64(m.Rejected)
+		shed.values[m.Model] = float64(m.Shed)
+	}
+
+	aborted := metric{name: "ollama_stream_slow_client_aborts_total", help: "Streamed responses abandoned because the client stopped reading for OLLAMA_WRITE_TIMEOUT.", kind: "counter", values: map[string]float64{}}
+	for model, n := range s.streams.abortedStreams() {
+		aborted.values[model] = float64(n)
+	}
+
+	warmHits := metric{name: "ollama_runner_warm_pool_hits_total", help: "Model loads that used a runner started ahead of time by OLLAMA_RUNNER_WARM_POOL.", kind: "counter", values: map[string]float64{}}
+	warmMisses := metric{name: "ollama_runner_warm_pool_misses_total", help: "Model loads that started a runner because the warm pool had none for them.", kind: "counter", values: map[string]float64{}}
+	warmSaved := metric{name: "ollama_runner_warm_pool_saved_seconds_total", help: "Runner start up time skipped by model loads that used the warm pool.", kind: "counter", values: map[string]float64{}}
+	for model, stat := range llm.WarmPoolStats() {
+		warmHits.values[model] = float64(stat.Hits)
+		warmMisses.values[model] = float64(stat.Misses)
+		warmSaved.values[model] = stat.Saved.Seconds()
+	}
+
+	requests := metric{name: "ollama_requests_total", help: "Generate and chat requests.", kind: "counter", values: map[string]float64{}}
+	requestErrors := metric{name: "ollama_request_errors_total", help: "Generate and chat requests that failed.", kind: "counter", values: map[string]float64{}}
+	requestAborts := metric{name: "ollama_request_aborts_total", help: "Generate and chat requests cancelled or abandoned by their client.", kind: "counter", values: map[string]float64{}}
+	promptTokens := metric{name: "ollama_prompt_tokens_total", help: "Prompt tokens evaluated for generate and chat requests.", kind: "counter", values: map[string]float64{}}
+	generatedTokens := metric{name: "ollama_generated_tokens_total", help: "Tokens generated for generate and chat requests.", kind: "counter", values: map[string]float64{}}
+	requestSeconds := metric{name: "ollama_request_duration_seconds_total", help: "Time spent serving generate and chat requests.", kind: "counter", values: map[string]float64{}}
+	promptSeconds := metric{name: "ollama_prompt_eval_duration_seconds_total", help: "Time spent evaluating the prompts of generate and chat requests.", kind: "counter", values: map[string]float64{}}
+	evalSeconds := metric{name: "ollama_eval_duration_seconds_total", help: "Time spent generating tokens for generate and chat requests.", kind: "counter", values: map[string]float64{}}
+	state, _ := s.usage.state(false, nil)
+	for k, u := range state {
+		requests.values[k.model] = float64(u.Requests)
+		requestErrors.values[k.model] = float64(u.Errors)
+		requestAborts.values[k.model] = float64(u.Aborted)
+		promptTokens.values[k.model] = float64(u.PromptEvalCount)
+		generatedTokens.values[k.model] = float64(u.EvalCount)
+		requestSeconds.values[k.model] = u.TotalDuration.Seconds()
+		promptSeconds.values[k.model] = u.PromptEvalDuration.Seconds()
+		evalSeconds.values[k.model] = u.EvalDuration.Seconds()
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(http.StatusOK)
+	if err := writeMetrics(c.Writer, []metric{
+		hits, misses, tokens, accepted, rejected, shed, aborted, warmHits, warmMisses, warmSaved,
+		requests, requestErrors, requestAborts, promptTokens, generatedTokens, requestSeconds, promptSeconds, evalSeconds,
+	}); err != nil {
+		slog.Debug("failed to write metrics", "error", err)
+	}
+}
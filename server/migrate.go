@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// legacyManifest is a manifest stored in a legacy layout, without the host
+// or namespace directories of the current layout, which is
+// manifests/<host>/<namespace>/<model>/<tag>
+type legacyManifest struct {
+	path string
+	name model.Name
+
+	// dir is the top level directory of the manifest, which is removed
+	// once it's empty
+	dir string
+}
+
+// legacyManifests returns the manifests stored in legacy layouts:
+// manifests/<model>/<tag> and manifests/<namespace>/<model>/<tag>
+func legacyManifests() ([]legacyManifest, error) {
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var legacy []legacyManifest
+	err = filepath.WalkDir(manifests, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(d.Name(), ".") && p != manifests {
+			// temporary files and the like
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(manifests, p)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if d.IsDir() {
+			if len(parts) >= 4 {
+				// manifests in the current layout
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var n model.Name
+		switch len(parts) {
+		case 2:
+			n = model.ParseName(parts[0] + ":" + parts[1])
+		case 3:
+			n = model.ParseName(parts[0] + "/" + parts[1] + ":" + parts[2])
+		default:
+			return nil
+		}
+
+		if !n.IsValid() {
+			slog.Warn("skipping unrecognized file in the manifests directory", "path", p)
+			return nil
+		}
+
+		legacy = append(legacy, legacyManifest{path: p, name: n, dir: filepath.Join(manifests, parts[0])})
+		return nil
+	})
+
+	return legacy, err
+}
+
+// legacyLayers returns the digests of the layers of the manifests stored in
+// legacy layouts, which pruning keeps since those models may still be
+// migrated. A manifest that can't be read fails it, as its layers aren't known.
+func legacyLayers() (map[string]struct{}, error) {
+	legacy, err := legacyManifests()
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string]struct{})
+	for _, l := range legacy {
+		b, err := os.ReadFile(l.path)
+		if err != nil {
+			return nil, err
+		}
+
+		var m Manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("legacy manifest %s: %w", l.path, err)
+		}
+
+		for _, layer := range m.allLayers() {
+			digests[layer.Digest] = struct{}{}
+		}
+	}
+
+	return digests, nil
+}
+
+// MigrateModels moves manifests stored in legacy layouts into the current
+// layout, so models that were pulled or created by older versions are found
+// again. The blobs of each manifest are verified before it's moved, and
+// manifests whose blobs are missing or corrupt are left where they are. The
+// original is only removed once the manifest has been written to its new
+// location, so migrating can be interrupted and run again. It returns the
+// number of models migrated.
+func MigrateModels(fn func(api.ProgressResponse)) (int, error) {
+	legacy, err := legacyManifests()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(legacy) == 0 {
+		return 0, nil
+	}
+
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return 0, err
+	}
+
+	verified := make(map[string]bool)
+	var migrated int
+	for i, l := range legacy {
+		fn(api.ProgressResponse{Status: fmt.Sprintf("migrating %s (%d of %d)", l.name.DisplayShortest(), i+1, len(legacy))})
+		if err := migrateManifest(manifests, l, verified, fn); err != nil {
+			slog.Warn("not migrating model", "model", l.name.DisplayShortest(), "path", l.path, "error", err)
+			fn(api.ProgressResponse{Status: fmt.Sprintf("skipped %s: %v", l.name.DisplayShortest(), err)})
+			continue
+		}
+
+		migrated++
+		if err := PruneDirectory(l.dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateManifest moves the legacy manifest l to its path in the current
+// layout, after verifying its blobs. verified holds the digests of the blobs
+// already verified.
+func migrateManifest(manifests string, l legacyManifest, verified map[string]bool, fn func(api.ProgressResponse)) error {
+	b, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	for _, layer := range m.allLayers() {
+		if layer.Digest == "" || verified[layer.Digest] {
+			continue
+		}
+
+		fn(api.ProgressResponse{Status: fmt.Sprintf("verifying %s", layer.Digest), Digest: layer.Digest, Total: layer.Size})
+		if err := verifyBlob(layer.Digest); err != nil {
+			return err
+		}
+
+		verified[layer.Digest] = true
+	}
+
+	p := filepath.Join(manifests, l.name.Filepath())
+	if existing, err := os.ReadFile(p); err == nil {
+		// a previous migration was interrupted before removing the
+		// original, or the model has since been pulled again
+		if !bytes.Equal(existing, b) {
+			return fmt.Errorf("%s already exists", l.name.DisplayShortest())
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	} else {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+
+		if err := writeManifestFile(p, b); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("migrated model", "model", l.name.DisplayShortest(), "from", l.path, "to", p)
+	return os.Remove(l.path)
+}
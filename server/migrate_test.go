@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestMigrateModels(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+	for _, name := range []string{"test", "user/test2", "broken", "resumed"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: fmt.Sprintf("FROM %s\nSYSTEM %s", createBinFile(t, nil, nil), name),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	manifests := filepath.Join(p, "manifests")
+	library := filepath.Join(manifests, "registry.ollama.ai", "library")
+	move := func(from, to string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	move(filepath.Join(library, "test", "latest"), filepath.Join(manifests, "test", "latest"))
+	move(filepath.Join(manifests, "registry.ollama.ai", "user", "test2", "latest"), filepath.Join(manifests, "user", "test2", "latest"))
+	move(filepath.Join(library, "broken", "latest"), filepath.Join(manifests, "broken", "latest"))
+
+	// an interrupted migration wrote the manifest but didn't remove the original
+	b, err := os.ReadFile(filepath.Join(library, "resumed", "latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(manifests, "resumed"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(manifests, "resumed", "latest"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// models in legacy layouts aren't listed, but pruning keeps their blobs
+	if ms, err := Manifests(); err != nil || len(ms) != 1 {
+		t.Fatalf("expected one model in the current layout, got %v, %v", ms, err)
+	}
+
+	if err := PruneLayers(); err != nil {
+		t.Fatal(err)
+	}
+
+	var m Manifest
+	b, err = os.ReadFile(filepath.Join(manifests, "broken", "latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, layer := range m.allLayers() {
+		blob, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(blob); err != nil {
+			t.Errorf("expected %s to be kept, got %v", layer.Digest, err)
+		}
+
+		// the system prompt is only used by broken
+		if layer.MediaType == "application/vnd.ollama.image.system" {
+			if err := os.WriteFile(blob, []byte("corrupt"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var statuses []string
+	migrated, err := MigrateModels(func(resp api.ProgressResponse) {
+		statuses = append(statuses, resp.Status)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if migrated != 3 {
+		t.Errorf("expected 3 models to be migrated, got %d: %v", migrated, statuses)
+	}
+
+	checkFileExists(t, filepath.Join(manifests, "*", "*", "*", "*"), []string{
+		filepath.Join(library, "resumed", "latest"),
+		filepath.Join(library, "test", "latest"),
+		filepath.Join(manifests, "registry.ollama.ai", "user", "test2", "latest"),
+	})
+
+	// the broken model is left where it is
+	checkFileExists(t, filepath.Join(manifests, "*", "*"), []string{
+		filepath.Join(manifests, "broken", "latest"),
+		filepath.Join(manifests, "registry.ollama.ai", "library"),
+		filepath.Join(manifests, "registry.ollama.ai", "user"),
+	})
+
+	// migrating again only retries the broken model
+	if migrated, err := MigrateModels(func(api.ProgressResponse) {}); err != nil || migrated != 0 {
+		t.Errorf("expected nothing to be migrated, got %d, %v", migrated, err)
+	}
+
+	if _, err := GetModel("user/test2"); err != nil {
+		t.Errorf("expected the migrated model to be found, got %v", err)
+	}
+
+	// pruning after the migration keeps the blobs of the broken model, which
+	// are old enough to be pruned if they weren't used
+	old := time.Now().Add(-2 * pruneGracePeriod)
+	for _, layer := range m.allLayers() {
+		blob, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(blob, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := PruneLayers(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := pruneModels(false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, layer := range m.allLayers() {
+		blob, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(blob); err != nil {
+			t.Errorf("expected %s of the broken model to be kept, got %v", layer.Digest, err)
+		}
+	}
+
+	if len(resp.Unused) > 0 {
+		t.Errorf("expected no blobs to be unused, got %v", resp.Unused)
+	}
+
+	// a legacy manifest that can't be read stops pruning rather than
+	// losing its blobs
+	if err := os.WriteFile(filepath.Join(manifests, "broken", "latest"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pruneModels(true, false, false); err == nil {
+		t.Error("expected pruning to fail with an unreadable legacy manifest")
+	}
+}
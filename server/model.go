@@ -11,7 +11,6 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
 	"slices"
 	"strings"
 	"text/template/parse"
@@ -34,7 +33,14 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	m, err := ParseNamedManifest(name)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
-		if err := PullModel(ctx, name.String(), &registryOptions{}, fn); err != nil {
+		// the pull succeeding isn't the create succeeding
+		pull := func(r api.ProgressResponse) {
+			if r.Phase != api.PhaseSuccess {
+				fn(r)
+			}
+		}
+
+		if err := pullModel(ctx, name.String(), PullOptions{}, &registryOptions{}, pull); err != nil {
 			return nil, err
 		}
 
@@ -92,13 +98,14 @@ func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML
 		return nil, err
 	}
 
-	p, err := os.MkdirTemp(filepath.Dir(f.Name()), "")
+	td, err := newTempDir("convert")
 	if err != nil {
 		return nil, err
 	}
-	defer os.RemoveAll(p)
+	defer td.Remove()
+	p := td.path
 
-	fn(api.ProgressResponse{Status: "converting model"})
+	fn(api.ProgressResponse{Status: "converting model", Phase: api.PhaseWriting})
 	// TODO(mxyng): this should write directly into a layer
 	// e.g. NewLayer(arch.Reader(), "application/vnd.ollama.image.model")
 	t, err := os.CreateTemp(p, "fp16")
@@ -106,7 +113,6 @@ func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML
 		return nil, err
 	}
 	defer t.Close()
-	defer os.Remove(t.Name())
 
 	var layerType string
 
@@ -296,9 +302,9 @@ func parseObjects(s string) []map[string]any {
 	return objs
 }
 
-// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
+// parseJSONToolCalls attempts to parse a JSON string into a slice of ToolCalls.
 // mxyng: this only really works if the input contains tool calls in some JSON format
-func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+func (m *Model) parseJSONToolCalls(s string) ([]api.ToolCall, bool) {
 	// create a subtree from the node that ranges over .ToolCalls
 	tmpl := m.Template.Subtree(func(n parse.Node) bool {
 		if t, ok := n.(*parse.RangeNode); ok {
@@ -316,6 +322,7 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	if err := tmpl.Execute(&b, map[string][]api.ToolCall{
 		"ToolCalls": {
 			{
+				ID: "@@id@@",
 				Function: api.ToolCallFunction{
 					Name: "@@name@@",
 					Arguments: api.ToolCallFunctionArguments{
@@ -333,12 +340,17 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 		return nil, false
 	}
 
-	// find the keys that correspond to the name and arguments fields
-	var name, arguments string
+	// find the keys that correspond to the id, name and arguments fields
+	var id, name, arguments string
 	for k, v := range templateObjects[0] {
-		switch v.(type) {
+		switch v := v.(type) {
 		case string:
-			name = k
+			switch v {
+			case "@@name@@":
+				name = k
+			case "@@id@@":
+				id = k
+			}
 		case map[string]any:
 			arguments = k
 		}
@@ -381,7 +393,9 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 		n, nok := kv[name].(string)
 		a, aok := kv[arguments].(map[string]any)
 		if nok && aok {
+			i, _ := kv[id].(string)
 			toolCalls = append(toolCalls, api.ToolCall{
+				ID: i,
 				Function: api.ToolCallFunction{
 					Name:      n,
 					Arguments: a,
@@ -8,6 +8,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -260,3 +262,69 @@ func TestParseObjects(t *testing.T) {
 		})
 	}
 }
+
+func TestToolLoop(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+	cases := []struct {
+		model  string
+		output string
+		id     bool
+	}{
+		{"llama3.1", `{"name": "get_current_weather", "parameters": {"format":"celsius","location":"Toronto, Canada"}}`, false},
+		{"qwen2.5", "<tool_call>\n" + `{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}` + "\n</tool_call>", false},
+		{"mistral", `[TOOL_CALLS] [{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}, "id": "f5g6h7i8j"}]`, true},
+	}
+
+	var tools []api.Tool
+	if err := json.Unmarshal(readFile(t, p, "tools.json").Bytes(), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	p = filepath.Join(p, "loop")
+
+	// the model calls a tool, gets its result, then calls it again
+	var messages []api.Message
+	if err := json.Unmarshal(readFile(t, p, "messages.json").Bytes(), &messages); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", tt.model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var actual bytes.Buffer
+			if err := tmpl.Execute(&actual, template.Values{Tools: tools, Messages: messages}); err != nil {
+				t.Fatal(err)
+			}
+
+			expect := readFile(t, p, fmt.Sprintf("%s.out", tt.model)).String()
+			if diff := cmp.Diff(actual.String(), expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			// the second call, as the model generates it, is rendered the
+			// same way when it's sent back
+			if !strings.Contains(expect, tt.output) {
+				t.Errorf("expected the prompt to contain the call %q", tt.output)
+			}
+
+			calls := slices.Clone(messages[4].ToolCalls)
+			if !tt.id {
+				calls[0].ID = ""
+			}
+
+			m := &Model{Template: tmpl}
+			actualCalls, ok := m.parseToolCalls(tt.output)
+			if !ok {
+				t.Fatal("expected tool calls")
+			}
+
+			if diff := cmp.Diff(actualCalls, calls); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
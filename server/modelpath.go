@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"net/url"
@@ -10,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
 )
 
 type ModelPath struct {
@@ -18,6 +20,10 @@ type ModelPath struct {
 	Namespace      string
 	Repository     string
 	Tag            string
+
+	// Digest pins the model to the manifest with this digest, in place of
+	// the tag
+	Digest string
 }
 
 const (
@@ -35,12 +41,13 @@ var (
 )
 
 func ParseModelPath(name string) ModelPath {
+	d := model.DefaultName()
 	mp := ModelPath{
 		ProtocolScheme: DefaultProtocolScheme,
-		Registry:       DefaultRegistry,
-		Namespace:      DefaultNamespace,
+		Registry:       d.Host,
+		Namespace:      d.Namespace,
 		Repository:     "",
-		Tag:            DefaultTag,
+		Tag:            d.Tag,
 	}
 
 	before, after, found := strings.Cut(name, "://")
@@ -49,6 +56,10 @@ func ParseModelPath(name string) ModelPath {
 		name = after
 	}
 
+	if i := strings.LastIndexByte(name, '@'); i >= 0 {
+		name, mp.Digest, mp.Tag = name[:i], name[i+1:], ""
+	}
+
 	name = strings.ReplaceAll(name, string(os.PathSeparator), "/")
 	parts := strings.Split(name, "/")
 	switch len(parts) {
@@ -65,7 +76,9 @@ func ParseModelPath(name string) ModelPath {
 
 	if repo, tag, found := strings.Cut(mp.Repository, ":"); found {
 		mp.Repository = repo
-		mp.Tag = tag
+		if mp.Digest == "" {
+			mp.Tag = tag
+		}
 	}
 
 	return mp
@@ -73,33 +86,81 @@ func ParseModelPath(name string) ModelPath {
 
 var errModelPathInvalid = errors.New("invalid model path")
 
+// parseModelName parses the name of a model in a request, returning an error
+// wrapping model.ErrInvalidName that says what's wrong with it if it isn't
+// valid. Names can be pinned to a digest.
+func parseModelName(s string) (model.Name, error) {
+	return model.ParseNameStrict(s)
+}
+
+// parseModelTag is parseModelName for requests that create or change the
+// model named s, which rejects names pinned to a digest since their
+// manifests can't change
+func parseModelTag(s string) (model.Name, error) {
+	n, err := model.ParseNameStrict(s)
+	if err != nil {
+		return model.Name{}, err
+	}
+
+	if n.Digest != "" {
+		return model.Name{}, &model.NameError{Name: s, Part: "digest", Offset: strings.LastIndexByte(s, '@') + 1, Reason: "models pinned to a digest can't be changed, use a tag"}
+	}
+
+	return n, nil
+}
+
 func (mp ModelPath) GetNamespaceRepository() string {
 	return fmt.Sprintf("%s/%s", mp.Namespace, mp.Repository)
 }
 
+// reference returns the tag of mp, or its digest if it's pinned to one
+func (mp ModelPath) reference() string {
+	return cmp.Or(mp.Digest, mp.Tag)
+}
+
+// suffix returns the part of mp's names after the repository
+func (mp ModelPath) suffix() string {
+	if mp.Digest != "" {
+		return "@" + mp.Digest
+	}
+
+	return ":" + mp.Tag
+}
+
 func (mp ModelPath) GetFullTagname() string {
-	return fmt.Sprintf("%s/%s/%s:%s", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+	return fmt.Sprintf("%s/%s/%s%s", mp.Registry, mp.Namespace, mp.Repository, mp.suffix())
 }
 
 func (mp ModelPath) GetShortTagname() string {
-	if mp.Registry == DefaultRegistry {
-		if mp.Namespace == DefaultNamespace {
-			return fmt.Sprintf("%s:%s", mp.Repository, mp.Tag)
+	d := model.DefaultName()
+	if mp.Registry == d.Host {
+		if mp.Namespace == d.Namespace {
+			return fmt.Sprintf("%s%s", mp.Repository, mp.suffix())
 		}
-		return fmt.Sprintf("%s/%s:%s", mp.Namespace, mp.Repository, mp.Tag)
+		return fmt.Sprintf("%s/%s%s", mp.Namespace, mp.Repository, mp.suffix())
 	}
-	return fmt.Sprintf("%s/%s/%s:%s", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+	return fmt.Sprintf("%s/%s/%s%s", mp.Registry, mp.Namespace, mp.Repository, mp.suffix())
 }
 
 // GetManifestPath returns the path to the manifest file for the given model path, it is up to the caller to create the directory if it does not exist.
 func (mp ModelPath) GetManifestPath() (string, error) {
-	if p := filepath.Join(mp.Registry, mp.Namespace, mp.Repository, mp.Tag); filepath.IsLocal(p) {
+	tag := mp.Tag
+	if mp.Digest != "" {
+		tag = strings.Replace(mp.Digest, ":", "-", 1)
+	}
+
+	if p := filepath.Join(mp.Registry, mp.Namespace, mp.Repository, tag); filepath.IsLocal(p) {
 		return filepath.Join(envconfig.Models(), "manifests", p), nil
 	}
 
 	return "", errModelPathInvalid
 }
 
+// name returns the model name of mp
+func (mp ModelPath) name() model.Name {
+	return model.ParseName(mp.GetFullTagname())
+}
+
 func (mp ModelPath) BaseURL() *url.URL {
 	return &url.URL{
 		Scheme: mp.ProtocolScheme,
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+// publicNamespace holds models visible to every API key
+const publicNamespace = "public"
+
+// apiKey is an entry in the OLLAMA_API_KEYS file. Keys see and use models
+// in their namespaces and the public namespace, while admin keys see every
+// model and can use the store and remotes APIs.
+type apiKey struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces"`
+	Admin      bool     `json:"admin"`
+}
+
+// loadAPIKeys reads the file of API keys at path, mapping each key to its
+// entry. It returns nil if path is empty, which leaves the server open.
+func loadAPIKeys(path string) (map[string]*apiKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]*apiKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, k := range keys {
+		if key == "" || k == nil {
+			return nil, fmt.Errorf("%s: invalid key", path)
+		}
+	}
+
+	slog.Info("loaded API keys", "path", path, "keys", len(keys))
+	return keys, nil
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyMiddleware authenticates requests by the API key in the
+// Authorization or x-api-key header, adding its entry to the request's
+// context. Requests without a known key are rejected when keys is set.
+func apiKeyMiddleware(keys map[string]*apiKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if keys == nil || c.Request.URL.Path == "/" {
+			c.Next()
+			return
+		}
+
+		// peers sharing blobs don't have keys, and are served the blobs of
+		// public models by their digests if they're on the LAN
+		if envconfig.P2P() && strings.HasPrefix(c.Request.URL.Path, "/api/p2p/blobs/") && lanAddr(c.RemoteIP()) {
+			c.Next()
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			token = c.GetHeader("x-api-key")
+		}
+
+		for key, k := range keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+				c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), apiKeyContextKey{}, k))
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+	}
+}
+
+// requireAdmin rejects requests made with an API key that isn't an admin key
+func requireAdmin(c *gin.Context) {
+	if k, ok := c.Request.Context().Value(apiKeyContextKey{}).(*apiKey); ok && !k.Admin {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API key required"})
+		return
+	}
+
+	c.Next()
+}
+
+// localOrAdmin reports whether the request was made with an admin API key
+// when API keys are configured, or from the server's machine when they
+// aren't. Only these requests see details of the server's filesystem, such
+// as paths. Requests forwarded by a proxy on the server's machine come from
+// its loopback address too, so requests with forwarding headers aren't
+// taken for local ones.
+func (s *Server) localOrAdmin(c *gin.Context) bool {
+	if s.keys != nil {
+		k, ok := c.Request.Context().Value(apiKeyContextKey{}).(*apiKey)
+		return ok && k.Admin
+	}
+
+	for _, h := range []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"} {
+		if c.GetHeader(h) != "" {
+			return false
+		}
+	}
+
+	ip, err := netip.ParseAddr(c.RemoteIP())
+	return err == nil && ip.IsLoopback()
+}
+
+// apiKeyName returns the name of the request's API key, or "" if API keys
+// aren't configured
+func apiKeyName(ctx context.Context) string {
+	if k, ok := ctx.Value(apiKeyContextKey{}).(*apiKey); ok {
+		return k.Name
+	}
+
+	return ""
+}
+
+// inNamespace reports whether the request's API key can use models named n,
+// which is always the case when API keys aren't configured
+func inNamespace(ctx context.Context, n model.Name) bool {
+	k, ok := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	if !ok || k.Admin {
+		return true
+	}
+
+	return strings.EqualFold(n.Namespace, publicNamespace) || slices.ContainsFunc(k.Namespaces, func(ns string) bool {
+		return strings.EqualFold(ns, n.Namespace)
+	})
+}
+
+// getNamespacedModel is GetModel for a model the request's API key can use,
+// returning an error wrapping os.ErrNotExist for models outside its namespaces
+// and one wrapping model.ErrInvalidName for names that aren't valid
+func getNamespacedModel(ctx context.Context, name string) (*Model, error) {
+	n, err := parseModelName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !inNamespace(ctx, n) {
+		return nil, fmt.Errorf("model %q: %w", name, os.ErrNotExist)
+	}
+
+	return GetModel(name)
+}
+
+// blobInNamespace reports whether a model the request's API key can use
+// references the blob with digest, so keys can't read the blobs of models
+// they can't see
+func blobInNamespace(ctx context.Context, digest string) bool {
+	if k, ok := ctx.Value(apiKeyContextKey{}).(*apiKey); !ok || k.Admin {
+		return true
+	}
+
+	ms, err := Manifests()
+	if err != nil {
+		return false
+	}
+
+	for n, m := range ms {
+		if inNamespace(ctx, n) && slices.ContainsFunc(m.allLayers(), func(layer Layer) bool {
+			return layer.Digest == digest
+		}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blobOwners are the namespaces whose API keys uploaded each blob, by
+// digest. A key that uploads a blob the server already has proves it has the
+// blob, so it may use it even if it's only referenced by the models of other
+// namespaces. Ownership is kept until the server stops, by which time the
+// key's manifests reference the blobs it uploaded for them.
+type blobOwners struct {
+	mu     sync.Mutex
+	owners map[string]map[string]bool
+}
+
+// add records that the request's API key uploaded the blob with digest
+func (o *blobOwners) add(ctx context.Context, digest string) {
+	k, ok := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	if !ok || k.Admin {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.owners == nil {
+		o.owners = make(map[string]map[string]bool)
+	}
+
+	if o.owners[digest] == nil {
+		o.owners[digest] = make(map[string]bool)
+	}
+
+	for _, ns := range k.Namespaces {
+		o.owners[digest][strings.ToLower(ns)] = true
+	}
+}
+
+// owns reports whether a key sharing a namespace with the request's API key
+// uploaded the blob with digest
+func (o *blobOwners) owns(ctx context.Context, digest string) bool {
+	k, ok := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	if !ok {
+		return false
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.ContainsFunc(k.Namespaces, func(ns string) bool {
+		return o.owners[digest][strings.ToLower(ns)]
+	})
+}
+
+// blobsReferenceable reports whether the request's API key may reference
+// the blobs with digests in a manifest it writes. Keys may reference the
+// blobs of models they can use, blobs they've uploaded and blobs no model
+// uses yet, but not the blobs of other namespaces' models. It returns the
+// first blob the key may not reference.
+func (s *Server) blobsReferenceable(ctx context.Context, digests []string) (string, bool) {
+	if k, ok := ctx.Value(apiKeyContextKey{}).(*apiKey); !ok || k.Admin {
+		return "", true
+	}
+
+	ms, err := Manifests()
+	if err != nil {
+		return digests[0], false
+	}
+
+	usable := make(map[string]bool)
+	for n, m := range ms {
+		for _, layer := range m.allLayers() {
+			usable[layer.Digest] = usable[layer.Digest] || inNamespace(ctx, n)
+		}
+	}
+
+	for _, digest := range digests {
+		if ok, referenced := usable[digest]; referenced && !ok && !s.owners.owns(ctx, digest) {
+			return digest, false
+		}
+	}
+
+	return "", true
+}
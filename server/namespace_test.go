@@ -0,0 +1,335 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestNamespaces(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := Server{keys: map[string]*apiKey{
+		"team-a-key": {Name: "team a", Namespaces: []string{"teamA"}},
+		"team-b-key": {Name: "team b", Namespaces: []string{"teamB"}},
+		"admin-key":  {Name: "admin", Admin: true},
+	}}
+
+	for _, name := range []string{"teamA/alpha", "teamB/beta", "public/shared"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+			Stream:    &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	router := s.GenerateRoutes()
+	do := func(t *testing.T, key, method, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		var b bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&b).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r := httptest.NewRequest(method, path, &b)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	list := func(t *testing.T, key string) []string {
+		t.Helper()
+		w := do(t, key, http.MethodGet, "/api/tags", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range resp.Models {
+			names = append(names, m.Name)
+		}
+
+		slices.Sort(names)
+		return names
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		for _, key := range []string{"", "wrong-key"} {
+			if w := do(t, key, http.MethodGet, "/api/tags", nil); w.Code != http.StatusUnauthorized {
+				t.Errorf("expected status code 401 with key %q, actual %d", key, w.Code)
+			}
+		}
+
+		if w := do(t, "", http.MethodGet, "/", nil); w.Code != http.StatusOK {
+			t.Errorf("expected the health check to be open, actual %d", w.Code)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		if names := list(t, "team-a-key"); !slices.Equal(names, []string{"public/shared:latest", "teamA/alpha:latest"}) {
+			t.Errorf("expected team a to see its and public models, got %v", names)
+		}
+
+		if names := list(t, "team-b-key"); !slices.Equal(names, []string{"public/shared:latest", "teamB/beta:latest"}) {
+			t.Errorf("expected team b to see its and public models, got %v", names)
+		}
+
+		if names := list(t, "admin-key"); len(names) != 3 {
+			t.Errorf("expected the admin to see every model, got %v", names)
+		}
+	})
+
+	t.Run("x-api-key", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+		r.Header.Set("x-api-key", "team-a-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", w.Code)
+		}
+	})
+
+	t.Run("show", func(t *testing.T) {
+		if w := do(t, "team-a-key", http.MethodPost, "/api/show", api.ShowRequest{Model: "teamB/beta"}); w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+
+		for _, name := range []string{"teamA/alpha", "public/shared"} {
+			if w := do(t, "team-a-key", http.MethodPost, "/api/show", api.ShowRequest{Model: name}); w.Code != http.StatusOK {
+				t.Errorf("expected status code 200 for %s, actual %d", name, w.Code)
+			}
+		}
+
+		if w := do(t, "admin-key", http.MethodPost, "/api/show", api.ShowRequest{Model: "teamB/beta"}); w.Code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", w.Code)
+		}
+	})
+
+	t.Run("generate", func(t *testing.T) {
+		if w := do(t, "team-a-key", http.MethodPost, "/api/generate", api.GenerateRequest{Model: "teamB/beta", Prompt: "hi"}); w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+
+		if w := do(t, "team-a-key", http.MethodPost, "/api/chat", api.ChatRequest{Model: "teamB/beta", Messages: []api.Message{{Role: "user", Content: "hi"}}}); w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		w := do(t, "team-a-key", http.MethodPost, "/api/create", api.CreateRequest{Name: "teamB/gamma", Modelfile: "FROM teamA/alpha", Stream: &stream})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected status code 403, actual %d", w.Code)
+		}
+
+		w = do(t, "team-a-key", http.MethodPost, "/api/create", api.CreateRequest{Name: "teamA/gamma", Modelfile: "FROM teamB/beta", Stream: &stream})
+		if w.Code == http.StatusOK {
+			t.Error("expected a model to not be created from another namespace")
+		}
+
+		w = do(t, "team-a-key", http.MethodPost, "/api/copy", api.CopyRequest{Source: "teamB/beta", Destination: "teamA/beta"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		if w := do(t, "team-a-key", http.MethodPost, "/api/store/prune", api.PruneRequest{DryRun: true}); w.Code != http.StatusForbidden {
+			t.Errorf("expected status code 403, actual %d", w.Code)
+		}
+
+		if w := do(t, "admin-key", http.MethodPost, "/api/store/prune", api.PruneRequest{DryRun: true}); w.Code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", w.Code)
+		}
+
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			if w := do(t, "team-a-key", method, "/api/remotes", api.RemoteRequest{Host: "gpubox"}); w.Code != http.StatusForbidden {
+				t.Errorf("expected status code 403 for %s /api/remotes, actual %d", method, w.Code)
+			}
+		}
+	})
+
+	t.Run("manifests", func(t *testing.T) {
+		put := func(t *testing.T, key, name string, layers ...Layer) int {
+			t.Helper()
+			m := api.Manifest{SchemaVersion: 2, Config: api.ManifestLayer{MediaType: layers[0].MediaType, Digest: layers[0].Digest, Size: layers[0].Size}}
+			for _, layer := range layers[1:] {
+				m.Layers = append(m.Layers, api.ManifestLayer{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+			}
+			return do(t, key, http.MethodPut, "/api/manifests/"+name, m).Code
+		}
+
+		// models made from the same file share their blobs, so the secret
+		// model has one of its own
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "teamB/secret",
+			Modelfile: fmt.Sprintf("FROM %s\nSYSTEM secret", createBinFile(t, nil, nil)),
+			Stream:    &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		secret, err := ParseNamedManifest(model.ParseName("teamB/secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code := put(t, "team-a-key", "teamA/stolen", secret.allLayers()...); code != http.StatusBadRequest {
+			t.Errorf("expected the blobs of another namespace to be rejected, got %d", code)
+		}
+
+		alpha, err := ParseNamedManifest(model.ParseName("teamA/alpha"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code := put(t, "team-a-key", "teamA/copy", alpha.allLayers()...); code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", code)
+		}
+
+		// a blob the key has just uploaded isn't used by any model yet
+		blob := []byte("uploaded")
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+		r := httptest.NewRequest(http.MethodPost, "/api/blobs/"+digest, bytes.NewReader(blob))
+		r.Header.Set("Authorization", "Bearer team-a-key")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated && w.Code != http.StatusOK {
+			t.Fatalf("expected the blob to be created, got %d", w.Code)
+		}
+
+		layers := append([]Layer{{MediaType: "application/vnd.docker.container.image.v1+json", Digest: digest, Size: int64(len(blob))}}, alpha.Layers...)
+		if code := put(t, "team-a-key", "teamA/uploaded", layers...); code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", code)
+		}
+
+		// a key that uploads the blobs of another namespace's model proves it
+		// has them, so it may reference them
+		upload := func(t *testing.T, digest string, blob []byte) int {
+			t.Helper()
+			r := httptest.NewRequest(http.MethodPost, "/api/blobs/"+digest, bytes.NewReader(blob))
+			r.Header.Set("Authorization", "Bearer team-a-key")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		var uploaded int
+		for _, layer := range secret.allLayers() {
+			// the model file is shared with the models team A can use
+			if code := do(t, "team-a-key", http.MethodHead, "/api/blobs/"+layer.Digest, nil).Code; code == http.StatusOK {
+				continue
+			} else if code != http.StatusNotFound {
+				t.Errorf("expected status code 404 before uploading %s, actual %d", layer.Digest, code)
+			}
+
+			if code := upload(t, layer.Digest, []byte("not the blob")); code != http.StatusBadRequest {
+				t.Errorf("expected a blob not matching %s to be rejected, got %d", layer.Digest, code)
+			}
+
+			path, err := GetBlobsPath(layer.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blob, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if code := upload(t, layer.Digest, blob); code != http.StatusCreated {
+				t.Errorf("expected status code 201 uploading %s, actual %d", layer.Digest, code)
+			}
+
+			if code := do(t, "team-a-key", http.MethodHead, "/api/blobs/"+layer.Digest, nil).Code; code != http.StatusOK {
+				t.Errorf("expected status code 200 after uploading %s, actual %d", layer.Digest, code)
+			}
+			uploaded++
+		}
+
+		if uploaded == 0 {
+			t.Fatal("expected the secret model to have blobs team A can't use")
+		}
+
+		if code := put(t, "team-a-key", "teamA/uploaded-secret", secret.allLayers()...); code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", code)
+		}
+
+		if code := put(t, "admin-key", "teamA/admin", secret.allLayers()...); code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", code)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if w := do(t, "team-a-key", http.MethodDelete, "/api/delete", api.DeleteRequest{Model: "teamB/beta"}); w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("teamB/beta")); err != nil {
+			t.Errorf("expected the model to be kept, got %v", err)
+		}
+
+		if w := do(t, "team-b-key", http.MethodDelete, "/api/delete", api.DeleteRequest{Model: "teamB/beta"}); w.Code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", w.Code)
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("teamB/beta")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the model to be deleted, got %v", err)
+		}
+	})
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	if keys, err := loadAPIKeys(""); err != nil || keys != nil {
+		t.Errorf("expected no keys, got %v, %v", keys, err)
+	}
+
+	p := t.TempDir() + "/keys.json"
+	if err := os.WriteFile(p, []byte(`{"team-a-key": {"name": "team a", "namespaces": ["teamA"]}, "admin-key": {"admin": true}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadAPIKeys(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || !slices.Equal(keys["team-a-key"].Namespaces, []string{"teamA"}) || !keys["admin-key"].Admin {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+
+	if err := os.WriteFile(p, []byte(`{"": {}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadAPIKeys(p); err == nil {
+		t.Error("expected an empty key to be rejected")
+	}
+}
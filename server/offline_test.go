@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestOffline(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_OFFLINE", "1")
+
+	var dials atomic.Int32
+	registry := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	registry.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	registry.Start()
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+	regOpts := &registryOptions{Insecure: true}
+	fn := func(api.ProgressResponse) {}
+
+	if err := PullModel(context.Background(), host+"/library/model:latest", regOpts, fn); !errors.Is(err, errOffline) {
+		t.Errorf("expected errOffline pulling, got %v", err)
+	}
+
+	registrySearchURL = registry.URL + "/api/search"
+	t.Cleanup(func() { registrySearchURL = "https://ollama.com/api/search" })
+	t.Setenv("OLLAMA_SEARCH_FALLBACK", registry.URL)
+
+	if _, err := searchRegistry(context.Background(), api.SearchRequest{Query: "model"}); !errors.Is(err, errOffline) {
+		t.Errorf("expected errOffline searching, got %v", err)
+	}
+
+	var s Server
+	for _, tt := range []struct {
+		name    string
+		handler func(*gin.Context)
+		body    any
+	}{
+		{"pull", s.PullHandler, api.PullRequest{Model: host + "/library/model:latest", Insecure: true}},
+		{"push", s.PushHandler, api.PushRequest{Model: host + "/library/model:latest", Insecure: true}},
+	} {
+		w := createRequest(t, tt.handler, tt.body)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), errOffline.Error()) {
+			t.Errorf("%s: expected an offline error, got %d %s", tt.name, w.Code, w.Body.String())
+		}
+	}
+
+	if _, err := newStorage(registry.URL); !errors.Is(err, errOffline) {
+		t.Errorf("expected errOffline for an http storage backend, got %v", err)
+	}
+
+	s.sched = &Scheduler{remotes: newRemoteServers(nil)}
+	if w := createRequest(t, s.AddRemoteHandler, api.RemoteRequest{Host: registry.URL}); w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 adding a remote server, got %d", w.Code)
+	}
+
+	if n := dials.Load(); n != 0 {
+		t.Errorf("expected no connections to the registry, got %d", n)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+// Where an option came from, from the highest precedence to the lowest
+const (
+	optionSourceRequest = "request"
+	optionSourceModel   = "model"
+	optionSourcePreset  = "preset"
+	optionSourceServer  = "server"
+	optionSourceDefault = "default"
+)
+
+// parseDefaultOptions parses the server's default options, either a JSON
+// object or a comma separated list of key=value pairs as in a Modelfile's
+// parameters, e.g. "temperature=0.3,num_ctx=8192". Options that are lists,
+// such as stop, are repeated to give more than one value.
+func parseDefaultOptions(s string) (map[string]any, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	var opts map[string]any
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), &opts); err != nil {
+			return nil, err
+		}
+	} else {
+		params := make(map[string][]string)
+		for _, kv := range strings.Split(s, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+			if !ok || k == "" {
+				return nil, fmt.Errorf("invalid option %q, expected key=value", kv)
+			}
+
+			params[k] = append(params[k], v)
+		}
+
+		formatted, err := api.FormatParams(params)
+		if err != nil {
+			return nil, err
+		}
+
+		// the options are decoded the same way as a model's, which are
+		// stored as JSON
+		b, err := json.Marshal(formatted)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(b, &opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// checkOptions checks that opts, set in the server's configuration, are all
+// known options with values of the right types
+func checkOptions(opts map[string]any) error {
+	names := optionNames()
+	for k := range opts {
+		if _, ok := names[k]; !ok {
+			return fmt.Errorf("unknown parameter '%s'", k)
+		}
+	}
+
+	var o api.Options
+	if err := o.FromMap(opts); err != nil {
+		return err
+	}
+
+	if err := checkPoolingType(o.PoolingType); err != nil {
+		return err
+	}
+
+	return llm.CheckContextOptions(o.Runner)
+}
+
+// optionNames returns the JSON names of the options
+func optionNames() map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(api.Options{})) {
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+			names[name] = struct{}{}
+		}
+	}
+
+	return names
+}
+
+// serverOptions returns the default options set by OLLAMA_DEFAULT_OPTIONS,
+// which is checked when the server starts
+func serverOptions() map[string]any {
+	opts, err := parseDefaultOptions(envconfig.DefaultOptions())
+	if err != nil {
+		slog.Warn("invalid OLLAMA_DEFAULT_OPTIONS, ignoring", "error", err)
+		return nil
+	}
+
+	return opts
+}
+
+// optionSources returns where each of opts, merged by modelOptions, came
+// from: the request, the model's parameters, the request's preset, the
+// server's defaults or the built in defaults
+func optionSources(opts *api.Options, m *Model, presetOpts, requestOpts map[string]any) map[string]string {
+	server := serverOptions()
+
+	set := func(opts map[string]any, k string) bool {
+		v, ok := opts[k]
+		return ok && v != nil
+	}
+
+	sources := make(map[string]string)
+	for k := range opts.Map() {
+		switch {
+		case set(requestOpts, k):
+			sources[k] = optionSourceRequest
+		case set(m.Options, k):
+			sources[k] = optionSourceModel
+		case set(presetOpts, k):
+			sources[k] = optionSourcePreset
+		case set(server, k):
+			sources[k] = optionSourceServer
+		case k == "use_mmap", k == "use_mlock":
+			// use_mmap has no built in default and use_mlock's is false,
+			// which is omitted, so these were set by OLLAMA_USE_MMAP or
+			// OLLAMA_USE_MLOCK
+			sources[k] = optionSourceServer
+		default:
+			sources[k] = optionSourceDefault
+		}
+	}
+
+	return sources
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestParseDefaultOptions(t *testing.T) {
+	cases := []struct {
+		value  string
+		expect map[string]any
+		err    string
+	}{
+		{value: ""},
+		{
+			value:  `{"temperature": 0.3, "num_ctx": 8192, "stop": ["<|end|>"]}`,
+			expect: map[string]any{"temperature": 0.3, "num_ctx": float64(8192), "stop": []any{"<|end|>"}},
+		},
+		{
+			value:  "temperature=0.3, num_ctx=8192,repeat_penalty=1.05,stop=a,stop=b",
+			expect: map[string]any{"temperature": 0.3, "num_ctx": float64(8192), "repeat_penalty": 1.05, "stop": []any{"a", "b"}},
+		},
+		{value: `{"tempurature": 0.3}`, err: "unknown parameter 'tempurature'"},
+		{value: "num_ctx=8192,tempurature=0.3", err: "unknown parameter 'tempurature'"},
+		{value: `{"num_ctx": "big"}`, err: `option "num_ctx" must be of type integer`},
+		{value: "num_ctx=big", err: "invalid int value"},
+		{value: "temperature", err: "expected key=value"},
+		{value: `{"pooling_type": "max"}`, err: "pooling_type"},
+		{value: `{"temperature": 0.3`, err: "unexpected end of JSON input"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			opts, err := parseDefaultOptions(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, opts); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestModelOptionsPrecedence(t *testing.T) {
+	t.Setenv("OLLAMA_DEFAULT_OPTIONS", `{"temperature": 0.3, "num_ctx": 8192, "repeat_penalty": 1.05}`)
+
+	m := &Model{Options: map[string]any{"num_ctx": float64(4096)}}
+	request := map[string]any{"repeat_penalty": 1.2, "top_k": nil}
+
+	opts, err := modelOptions(m, nil, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Temperature != 0.3 || opts.NumCtx != 4096 || opts.RepeatPenalty != 1.2 || opts.TopK != 40 {
+		t.Errorf("unexpected options: temperature %v, num_ctx %d, repeat_penalty %v, top_k %d", opts.Temperature, opts.NumCtx, opts.RepeatPenalty, opts.TopK)
+	}
+
+	sources := optionSources(&opts, m, nil, request)
+	expect := map[string]string{
+		"temperature":    "server",
+		"num_ctx":        "model",
+		"repeat_penalty": "request",
+		"top_k":          "default",
+	}
+
+	for k, v := range expect {
+		if sources[k] != v {
+			t.Errorf("expected %s to come from %s, got %q", k, v, sources[k])
+		}
+	}
+}
+
+func TestModelOptionsPresetPrecedence(t *testing.T) {
+	t.Setenv("OLLAMA_DEFAULT_OPTIONS", `{"temperature": 0.3, "top_p": 0.8, "num_ctx": 8192}`)
+
+	m := &Model{Options: map[string]any{"num_ctx": float64(4096)}}
+	preset := map[string]any{"temperature": 0.1, "num_ctx": float64(2048), "top_k": float64(10)}
+	request := map[string]any{"top_k": float64(20)}
+
+	opts, err := modelOptions(m, preset, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the preset overrides the server's defaults, and is overridden by the
+	// model's parameters and the request
+	if opts.Temperature != 0.1 || opts.TopP != 0.8 || opts.NumCtx != 4096 || opts.TopK != 20 {
+		t.Errorf("unexpected options: temperature %v, top_p %v, num_ctx %d, top_k %d", opts.Temperature, opts.TopP, opts.NumCtx, opts.TopK)
+	}
+
+	sources := optionSources(&opts, m, preset, request)
+	expect := map[string]string{
+		"temperature": "preset",
+		"top_p":       "server",
+		"num_ctx":     "model",
+		"top_k":       "request",
+		"seed":        "default",
+	}
+
+	for k, v := range expect {
+		if sources[k] != v {
+			t.Errorf("expected %s to come from %s, got %q", k, v, sources[k])
+		}
+	}
+
+	remote := remotePresetOptions(&api.Preset{Options: preset}, m, request)
+	if diff := cmp.Diff(map[string]any{"temperature": 0.1, "top_k": float64(20)}, remote); diff != "" {
+		t.Errorf("unexpected options for a remote server (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials reads the credentials of c's peer with LOCAL_PEERCRED and
+// LOCAL_PEERPID
+func peerCredentials(c *net.UnixConn) (peerCred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+
+	var cred *unix.Xucred
+	var pid int
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if credErr == nil {
+			pid, credErr = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+		}
+	}); err != nil {
+		return peerCred{}, err
+	}
+
+	if credErr != nil {
+		return peerCred{}, credErr
+	}
+
+	var gid uint32
+	if cred.Ngroups > 0 {
+		gid = cred.Groups[0]
+	}
+
+	return peerCred{UID: cred.Uid, GID: gid, PID: int32(pid)}, nil
+}
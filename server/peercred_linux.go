@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials reads the credentials of c's peer with SO_PEERCRED
+func peerCredentials(c *net.UnixConn) (peerCred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return peerCred{}, err
+	}
+
+	if credErr != nil {
+		return peerCred{}, credErr
+	}
+
+	return peerCred{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials isn't supported on this platform, so connections over unix
+// sockets aren't audited or restricted to OLLAMA_SOCKET_ALLOWED_UIDS
+func peerCredentials(*net.UnixConn) (peerCred, error) {
+	return peerCred{}, errors.ErrUnsupported
+}
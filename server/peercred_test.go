@@ -0,0 +1,108 @@
+//go:build linux || darwin
+
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPeerCredentials(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c.(*net.UnixConn)
+	}
+
+	cred, err := peerCredentials(conns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cred.UID != uint32(os.Getuid()) || cred.GID != uint32(os.Getgid()) || cred.PID != int32(os.Getpid()) {
+		t.Errorf("expected this process's credentials, got %+v", cred)
+	}
+
+	ctx := peerConnContext(context.Background(), conns[1])
+	if got, ok := ctx.Value(peerCredContextKey{}).(peerCred); !ok || got != cred {
+		t.Errorf("expected the credentials in the context, got %v", ctx.Value(peerCredContextKey{}))
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ollama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "s")
+	t.Setenv("OLLAMA_SOCKET_MODE", "0600")
+	t.Setenv("OLLAMA_SOCKET_GROUP", strconv.Itoa(os.Getgid()))
+
+	ln, err := Listen(&url.URL{Scheme: "unix", Path: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Type() != fs.ModeSocket || fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected a socket with mode 0600, got %v", fi.Mode())
+	}
+
+	if gid := fi.Sys().(*syscall.Stat_t).Gid; gid != uint32(os.Getgid()) {
+		t.Errorf("expected group %d, got %d", os.Getgid(), gid)
+	}
+
+	if _, err := Listen(&url.URL{Scheme: "unix", Path: p}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("expected the socket to be in use, got %v", err)
+	}
+
+	// a socket left by a server that didn't shut down is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = Listen(&url.URL{Scheme: "unix", Path: p})
+	if err != nil {
+		t.Fatalf("expected a stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+
+	if err := os.WriteFile(p, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Listen(&url.URL{Scheme: "unix", Path: p}); err == nil || !strings.Contains(err.Error(), "isn't a socket") {
+		t.Errorf("expected a file not to be replaced, got %v", err)
+	}
+
+	t.Setenv("OLLAMA_SOCKET_GROUP", "no-such-group-ollama")
+	if _, err := Listen(&url.URL{Scheme: "unix", Path: filepath.Join(dir, "t")}); err == nil || !strings.Contains(err.Error(), "OLLAMA_SOCKET_GROUP") {
+		t.Errorf("expected an OLLAMA_SOCKET_GROUP error, got %v", err)
+	}
+}
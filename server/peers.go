@@ -0,0 +1,591 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Servers with OLLAMA_P2P set share the blobs of their models with each
+// other on the LAN. Each announces itself over mDNS and serves its blobs by
+// digest from /api/p2p/blobs, and pulls ask the peers they find for each
+// layer before the registry. Blobs from peers are verified against their
+// digests like those from the registry.
+
+var errPeerBlobSize = errors.New("blob size mismatch")
+
+// peerService is the mDNS service servers sharing blobs are announced as
+const peerService = "_ollama-blobs._tcp.local."
+
+var (
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+	// peerBrowseTimeout is how long peers are given to answer a query, and
+	// to answer whether they have a blob
+	peerBrowseTimeout = time.Second
+
+	// peerCacheTTL is how long the peers found are asked for blobs before
+	// they're looked up again
+	peerCacheTTL = time.Minute
+
+	// peerStallTimeout is how long a download from a peer may go without
+	// progress before it's given up for the registry
+	peerStallTimeout = 30 * time.Second
+)
+
+// peerInstance is the name this server announces itself by, which tells
+// its own answers apart from those of its peers
+var peerInstance = sync.OnceValue(func() string {
+	host, _ := os.Hostname()
+	host, _, _ = strings.Cut(host, ".")
+	if len(host) > 40 {
+		host = host[:40]
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	if host == "" {
+		return hex.EncodeToString(b)
+	}
+
+	return host + "-" + hex.EncodeToString(b)
+})
+
+var peerClient = &http.Client{
+	Transport: &http.Transport{
+		// peers are on the LAN, so requests to them never go through a proxy
+		DialContext:           (&net.Dialer{Timeout: peerBrowseTimeout}).DialContext,
+		ResponseHeaderTimeout: peerBrowseTimeout,
+	},
+}
+
+// peerQuery returns an mDNS query for the peers sharing blobs
+func peerQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(peerService)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	return msg.Pack()
+}
+
+// isPeerQuery reports whether b is an mDNS query for the peers sharing
+// blobs, returning its ID
+func isPeerQuery(b []byte) (uint16, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil || h.Response {
+		return 0, false
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return 0, false
+	}
+
+	for _, q := range questions {
+		if strings.EqualFold(q.Name.String(), peerService) && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) {
+			return h.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// peerAnswer returns the answer to the query with id announcing instance,
+// serving blobs on port
+func peerAnswer(id uint16, instance string, port int) ([]byte, error) {
+	service, err := dnsmessage.NewName(peerService)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := dnsmessage.NewName(instance + "." + peerService)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := dnsmessage.NewName(instance + ".local.")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: []dnsmessage.Question{{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.PTRResource{PTR: name},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.SRVResource{Target: target, Port: uint16(port)},
+			},
+		},
+	}
+	return msg.Pack()
+}
+
+// parsePeerAnswer returns the instance and port announced by b, an answer
+// to a query for the peers sharing blobs
+func parsePeerAnswer(b []byte) (instance string, port uint16, ok bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil || !h.Response {
+		return "", 0, false
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", 0, false
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return "", 0, false
+	}
+
+	for _, a := range answers {
+		srv, isSRV := a.Body.(*dnsmessage.SRVResource)
+		name := a.Header.Name.String()
+		if isSRV && len(name) > len(peerService)+1 && strings.EqualFold(name[len(name)-len(peerService)-1:], "."+peerService) {
+			return name[:len(name)-len(peerService)-1], srv.Port, true
+		}
+	}
+
+	return "", 0, false
+}
+
+// announcePeer answers the queries of peers on the LAN with this server,
+// which serves blobs on addr, until ctx is done
+func announcePeer(ctx context.Context, addr net.Addr) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		slog.Warn("OLLAMA_P2P is set, but peers can't be served on this address", "addr", addr)
+		return
+	} else if ap.Addr().IsLoopback() {
+		slog.Warn("OLLAMA_P2P is set, but peers can't reach a server listening on a loopback address; set OLLAMA_HOST to share blobs with them", "addr", addr)
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		slog.Warn("couldn't announce this server to peers", "error", err)
+		return
+	}
+
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	slog.Info("sharing blobs with peers", "instance", peerInstance(), "addr", addr)
+	go func() {
+		b := make([]byte, 9000)
+		for {
+			n, src, err := conn.ReadFromUDP(b)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("stopped announcing this server to peers", "error", err)
+				}
+				return
+			}
+
+			id, ok := isPeerQuery(b[:n])
+			if !ok {
+				continue
+			}
+
+			answer, err := peerAnswer(id, peerInstance(), int(ap.Port()))
+			if err != nil {
+				slog.Warn("couldn't answer a peer", "error", err)
+				continue
+			}
+
+			// queries from mDNS responders are answered on the group,
+			// and those from other ports, as pulls send, to the sender
+			dst := src
+			if src.Port == mdnsGroup.Port {
+				dst = mdnsGroup
+			}
+
+			if _, err := conn.WriteToUDP(answer, dst); err != nil {
+				slog.Debug("couldn't answer a peer", "peer", src, "error", err)
+			}
+		}
+	}()
+}
+
+// browsePeers queries the LAN for peers sharing blobs, returning the
+// address of each that answers in time other than this server
+func browsePeers(ctx context.Context) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	query, err := peerQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(peerBrowseTimeout)); err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	b := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(b)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return peers, nil
+		} else if err != nil {
+			return nil, cmp.Or(ctx.Err(), err)
+		}
+
+		instance, port, ok := parsePeerAnswer(b[:n])
+		if !ok || instance == peerInstance() {
+			continue
+		}
+
+		addr := net.JoinHostPort(src.IP.String(), strconv.Itoa(int(port)))
+		if !slices.Contains(peers, addr) {
+			peers = append(peers, addr)
+		}
+	}
+}
+
+// peerSet is the peers pulls ask for blobs, found again once they're older
+// than peerCacheTTL
+type peerSet struct {
+	mu      sync.Mutex
+	addrs   []string
+	updated time.Time
+
+	// browse finds the peers on the LAN
+	browse func(context.Context) ([]string, error)
+}
+
+var lanPeers = peerSet{browse: browsePeers}
+
+// list returns the peers, finding them if they're out of date
+func (p *peerSet) list(ctx context.Context) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.updated.IsZero() && time.Since(p.updated) < peerCacheTTL {
+		return p.addrs
+	}
+
+	addrs, err := p.browse(ctx)
+	if err != nil {
+		slog.Warn("couldn't find peers", "error", err)
+		return nil
+	}
+
+	slog.Debug("found peers", "peers", addrs)
+	p.addrs, p.updated = addrs, time.Now()
+	return addrs
+}
+
+func peerBlobURL(addr, digest string) string {
+	return "http://" + addr + "/api/p2p/blobs/" + digest
+}
+
+// peerWithBlob returns the first of peers to answer that it has the blob
+// digest, or "" if none do
+func peerWithBlob(ctx context.Context, peers []string, digest string) string {
+	ctx, cancel := context.WithTimeout(ctx, peerBrowseTimeout)
+	defer cancel()
+
+	found := make(chan string, len(peers))
+	for _, addr := range peers {
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, peerBlobURL(addr, digest), nil)
+			if err != nil {
+				found <- ""
+				return
+			}
+
+			resp, err := peerClient.Do(req)
+			if err != nil {
+				found <- ""
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				found <- ""
+				return
+			}
+
+			found <- addr
+		}()
+	}
+
+	for range peers {
+		if addr := <-found; addr != "" {
+			return addr
+		}
+	}
+
+	return ""
+}
+
+// downloadFromPeer downloads the blob of opts from a peer that has it,
+// reporting whether it did. The blob is left to the registry when no peer
+// has it or the download fails.
+func downloadFromPeer(ctx context.Context, opts downloadOpts) bool {
+	// a peer could otherwise send any amount of data before the digest is
+	// checked
+	if opts.size <= 0 {
+		return false
+	}
+
+	peers := lanPeers.list(ctx)
+	if len(peers) == 0 {
+		return false
+	}
+
+	addr := peerWithBlob(ctx, peers, opts.digest)
+	if addr == "" {
+		slog.Debug("no peer has blob, pulling it from the registry", "digest", opts.digest)
+		return false
+	}
+
+	slog.Info("pulling blob from peer", "digest", opts.digest, "peer", addr)
+	if err := fetchPeerBlob(ctx, addr, opts); err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("couldn't pull blob from peer, pulling it from the registry", "digest", opts.digest, "peer", addr, "error", err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// fetchPeerBlob downloads the blob of opts from the peer at addr,
+// verifying it against its size and digest before it's stored. At most one
+// byte more than the blob's size is read, to tell a longer blob apart.
+func fetchPeerBlob(ctx context.Context, addr string, opts downloadOpts) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peerBlobURL(addr, opts.digest), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength != opts.size {
+		return fmt.Errorf("%w: peer sent %d bytes, expected %d", errPeerBlobSize, resp.ContentLength, opts.size)
+	}
+
+	td, err := newTempDir("peer")
+	if err != nil {
+		return err
+	}
+	defer td.Remove()
+
+	f, err := os.Create(td.Path("blob"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var completed atomic.Int64
+	h := sha256.New()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.MultiWriter(f, h, counter{&completed}), io.LimitReader(resp.Body, opts.size+1))
+		done <- err
+	}()
+
+	progress := func(n int64) {
+		opts.fn(api.ProgressResponse{
+			Status:    fmt.Sprintf("pulling %s", opts.digest[7:19]),
+			Digest:    opts.digest,
+			Total:     opts.size,
+			Completed: n,
+			Phase:     api.PhaseDownloading,
+			Source:    api.SourcePeer,
+		})
+	}
+
+	ticker := time.NewTicker(60 * time.Millisecond)
+	defer ticker.Stop()
+
+	var last int64
+	lastProgress := time.Now()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return cmp.Or(context.Cause(ctx), err)
+			}
+
+			if n := completed.Load(); n != opts.size {
+				return fmt.Errorf("%w: peer sent %d bytes, expected %d", errPeerBlobSize, n, opts.size)
+			}
+
+			if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != opts.digest {
+				return fmt.Errorf("%w: got %s", errDigestMismatch, got)
+			}
+
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+			if err := storeBlob(opts.digest, f.Name()); err != nil {
+				return err
+			}
+
+			progress(completed.Load())
+			return nil
+		case <-ticker.C:
+			n := completed.Load()
+			if n != last {
+				last, lastProgress = n, time.Now()
+			} else if time.Since(lastProgress) > peerStallTimeout {
+				cancel(errors.New("peer stopped sending the blob"))
+			}
+
+			progress(n)
+		}
+	}
+}
+
+// counter counts the bytes written to it
+type counter struct {
+	n *atomic.Int64
+}
+
+func (c counter) Write(b []byte) (int, error) {
+	c.n.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// PeerBlobHandler serves a blob to a server on the LAN pulling it with
+// OLLAMA_P2P. Peers don't have API keys, so blobs are served only by their
+// digest, which can't be listed here, and not at all unless OLLAMA_P2P is
+// set. When the server uses API keys, models outside the public namespace
+// belong to the keys that can use them, so only blobs of public models are
+// served.
+func (s *Server) PeerBlobHandler(c *gin.Context) {
+	if !envconfig.P2P() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "sharing blobs with peers is disabled"})
+		return
+	}
+
+	digest := c.Param("digest")
+	path, err := GetBlobsPath(digest)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if s.keys != nil {
+		public, err := publicBlob(digest)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if !public {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", digest)})
+			return
+		}
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", digest)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), f)
+}
+
+// publicBlob reports whether digest is a blob of a model in the public
+// namespace
+func publicBlob(digest string) (bool, error) {
+	ms, err := Manifests()
+	if err != nil {
+		return false, err
+	}
+
+	for n, m := range ms {
+		if !strings.EqualFold(n.Namespace, publicNamespace) {
+			continue
+		}
+
+		if m.Config.Digest == digest || slices.ContainsFunc(m.Layers, func(l Layer) bool { return l.Digest == digest }) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// lanAddr reports whether ip is a private, link-local or loopback address,
+// which peers on the LAN connect from
+func lanAddr(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLoopback()
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestPeerAnswer(t *testing.T) {
+	query, err := peerQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := isPeerQuery(query); !ok {
+		t.Fatal("expected a query for peers")
+	}
+
+	if _, _, ok := parsePeerAnswer(query); ok {
+		t.Error("expected a query not to be taken for an answer")
+	}
+
+	answer, err := peerAnswer(42, "host-0a1b2c3d", 11434)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := isPeerQuery(answer); ok {
+		t.Error("expected an answer not to be taken for a query")
+	}
+
+	instance, port, ok := parsePeerAnswer(answer)
+	if !ok || instance != "host-0a1b2c3d" || port != 11434 {
+		t.Errorf("expected host-0a1b2c3d on port 11434, got %q on port %d", instance, port)
+	}
+}
+
+func TestPeerBlobHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	blob := []byte("blob")
+	digest := "sha256:fa2c8cc4f28176bbeed4b736df569a34c79cd3723e9ec42f9674b4d46ac6b8b8"
+	path, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, blob, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteManifest(model.ParseName("public/shared"), Layer{}, []Layer{{Digest: digest, Size: int64(len(blob))}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a blob only a namespaced model has
+	private := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	path, err = GetBlobsPath(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteManifest(model.ParseName("teamA/alpha"), Layer{}, []Layer{{Digest: private, Size: 11}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{keys: map[string]*apiKey{"secret": {Name: "admin", Admin: true}}}
+	router := s.GenerateRoutes()
+
+	// peers connect from the LAN
+	request := func(method, digest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/api/p2p/blobs/"+digest, nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		if w := request(http.MethodGet, digest); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 without an API key, got %d", w.Code)
+		}
+
+		var s Server
+		w := httptest.NewRecorder()
+		s.GenerateRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/p2p/blobs/"+digest, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Setenv("OLLAMA_P2P", "1")
+
+	t.Run("get", func(t *testing.T) {
+		w := request(http.MethodGet, digest)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !bytes.Equal(w.Body.Bytes(), blob) {
+			t.Errorf("expected %q, got %q", blob, w.Body)
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		w := request(http.MethodHead, digest)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if w.Header().Get("Content-Length") != "4" {
+			t.Errorf("expected a content length of 4, got %q", w.Header().Get("Content-Length"))
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if w := request(http.MethodGet, "sha256:"+strings.Repeat("0", 64)); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("namespaced model", func(t *testing.T) {
+		if w := request(http.MethodGet, private); w.Code != http.StatusNotFound {
+			t.Errorf("expected a blob only a namespaced model has not to be shared, got %d", w.Code)
+		}
+	})
+
+	t.Run("outside the LAN", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/p2p/blobs/"+digest, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 without an API key, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid digest", func(t *testing.T) {
+		if w := request(http.MethodGet, "sha256:abc"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("other routes", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/blobs/"+digest, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 without an API key, got %d", w.Code)
+		}
+	})
+}
+
+func TestPullFromPeer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_NOPRUNE", "1")
+	t.Setenv("OLLAMA_P2P", "1")
+
+	registry := newProgressRegistry(t)
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const model = "sha256:12e97362c3814d20abf8273525951884c80fd238e8cab3f3a657ca7de3766ca7"
+
+	cases := []struct {
+		name string
+		blob []byte
+		// chunked sends the blob without its length
+		chunked bool
+		// expect is the source each layer is last downloaded from
+		expect map[string]string
+	}{
+		{
+			"peer",
+			bytes.Repeat([]byte("ollama"), 8192),
+			false,
+			map[string]string{
+				model: api.SourcePeer,
+				"sha256:62083d25e8b1bfb2ab2b60ae52ec1fad997630c8648447f7a37a6b79ff2137f1": api.SourceRegistry,
+				"sha256:b507b9c2f6ca642bffcd06665ea7c91f235fd32daeefdf875a0f938db05fb315": api.SourceRegistry,
+			},
+		},
+		{
+			"digest mismatch",
+			bytes.Repeat([]byte("llama"), 8192),
+			false,
+			map[string]string{
+				model: api.SourceRegistry,
+				"sha256:62083d25e8b1bfb2ab2b60ae52ec1fad997630c8648447f7a37a6b79ff2137f1": api.SourceRegistry,
+				"sha256:b507b9c2f6ca642bffcd06665ea7c91f235fd32daeefdf875a0f938db05fb315": api.SourceRegistry,
+			},
+		},
+		{
+			"longer blob",
+			append(bytes.Repeat([]byte("ollama"), 8192), bytes.Repeat([]byte("more"), 8192)...),
+			true,
+			map[string]string{
+				model: api.SourceRegistry,
+				"sha256:62083d25e8b1bfb2ab2b60ae52ec1fad997630c8648447f7a37a6b79ff2137f1": api.SourceRegistry,
+				"sha256:b507b9c2f6ca642bffcd06665ea7c91f235fd32daeefdf875a0f938db05fb315": api.SourceRegistry,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+			// the peer has only the model layer
+			peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/p2p/blobs/"+model {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				if tt.chunked && r.Method == http.MethodGet {
+					w.Write(tt.blob[:1]) //nolint:errcheck
+					w.(http.Flusher).Flush()
+					w.Write(tt.blob[1:]) //nolint:errcheck
+					return
+				}
+
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(tt.blob))
+			}))
+			defer peer.Close()
+
+			peers := lanPeers.browse
+			lanPeers = peerSet{browse: func(context.Context) ([]string, error) {
+				return []string{strings.TrimPrefix(peer.URL, "http://")}, nil
+			}}
+			t.Cleanup(func() { lanPeers = peerSet{browse: peers} })
+
+			b, err := json.Marshal(api.PullRequest{Model: u.Host + "/library/test", Insecure: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var s Server
+			w := NewRecorder()
+			s.GenerateRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/pull", bytes.NewReader(b)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			sources := make(map[string]string)
+			var last api.ProgressResponse
+			sc := bufio.NewScanner(w.Body)
+			for sc.Scan() {
+				var resp api.ProgressResponse
+				if err := json.Unmarshal(sc.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Source != "" {
+					sources[resp.Digest] = resp.Source
+				}
+
+				last = resp
+			}
+
+			if last.Phase != api.PhaseSuccess {
+				t.Fatalf("expected the pull to succeed, got %+v", last)
+			}
+
+			for digest, source := range tt.expect {
+				if sources[digest] != source {
+					t.Errorf("expected %s to be pulled from the %s, got %q", digest[7:19], source, sources[digest])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// loadPresets reads the presets file at path, an object of presets by name:
+//
+//	{"code": {"options": {"temperature": 0.2}, "system": "You write Go."}}
+//
+// It returns no presets if path is empty.
+func loadPresets(path string) (map[string]api.Preset, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file map[string]struct {
+		Options map[string]any `json:"options"`
+		System  string         `json:"system"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	presets := make(map[string]api.Preset, len(file))
+	for name, p := range file {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("preset names can't be empty")
+		}
+
+		if err := checkOptions(p.Options); err != nil {
+			return nil, fmt.Errorf("preset %q: %w", name, err)
+		}
+
+		presets[name] = api.Preset{Name: name, Options: p.Options, System: p.System}
+	}
+
+	return presets, nil
+}
+
+// presetNames returns the names of the server's presets in order
+func (s *Server) presetNames() []string {
+	names := make([]string, 0, len(s.presets))
+	for name := range s.presets {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// preset returns the preset a request selects by name, or nil if it doesn't
+// select one. Requests for unknown presets are rejected with the names of
+// those that exist.
+func (s *Server) preset(c *gin.Context, name string) (*api.Preset, bool) {
+	if name == "" {
+		return nil, true
+	}
+
+	p, ok := s.presets[name]
+	if !ok {
+		names := s.presetNames()
+		msg := fmt.Sprintf("preset %q not found, the server has no presets", name)
+		if len(names) > 0 {
+			msg = fmt.Sprintf("preset %q not found, expected one of %s", name, strings.Join(names, ", "))
+		}
+
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": msg, "presets": names})
+		return nil, false
+	}
+
+	return &p, true
+}
+
+// presetOptions returns the options of p, which may be nil
+func presetOptions(p *api.Preset) map[string]any {
+	if p == nil {
+		return nil
+	}
+
+	return p.Options
+}
+
+// presetSystem returns system, the model's SYSTEM, or if it's empty the
+// system message of p, which may be nil. Like its options, a preset's system
+// message is only used if the model doesn't set one.
+func presetSystem(p *api.Preset, system string) string {
+	if system != "" || p == nil {
+		return system
+	}
+
+	return p.System
+}
+
+// chatSystem returns the system message of a chat with messages msgs and
+// where it came from. System messages in the request are used as they are,
+// otherwise the model's SYSTEM is used unless useModelSystem is false, then
+// the system message of the request's preset p. It returns "" if there's
+// none.
+func chatSystem(msgs []api.Message, p *api.Preset, m *Model, useModelSystem bool) (system, source string) {
+	switch {
+	case len(msgs) > 0 && msgs[0].Role == "system":
+		return msgs[0].Content, optionSourceRequest
+	case useModelSystem && m.System != "":
+		return m.System, optionSourceModel
+	case p != nil && p.System != "":
+		return p.System, optionSourcePreset
+	}
+
+	return "", ""
+}
+
+// remotePresetOptions returns the options of a request for m with preset p
+// to proxy to a remote server, which doesn't know the preset. p's options
+// are added unless the request or the model's parameters set them.
+func remotePresetOptions(p *api.Preset, m *Model, requestOpts map[string]any) map[string]any {
+	if p == nil || len(p.Options) == 0 {
+		return requestOpts
+	}
+
+	opts := make(map[string]any, len(requestOpts)+len(p.Options))
+	for k, v := range p.Options {
+		if _, ok := m.Options[k]; !ok {
+			opts[k] = v
+		}
+	}
+
+	for k, v := range requestOpts {
+		opts[k] = v
+	}
+
+	return opts
+}
+
+func (s *Server) ListPresetsHandler(c *gin.Context) {
+	presets := []api.Preset{}
+	for _, name := range s.presetNames() {
+		presets = append(presets, s.presets[name])
+	}
+
+	c.JSON(http.StatusOK, api.ListPresetsResponse{Presets: presets})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestLoadPresets(t *testing.T) {
+	write := func(t *testing.T, s string) string {
+		t.Helper()
+		p := filepath.Join(t.TempDir(), "presets.json")
+		if err := os.WriteFile(p, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	presets, err := loadPresets(write(t, `{
+		"code": {"options": {"temperature": 0.2, "num_ctx": 16384}, "system": "You write Go."},
+		"extraction": {"options": {"temperature": 0}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]api.Preset{
+		"code":       {Name: "code", Options: map[string]any{"temperature": 0.2, "num_ctx": float64(16384)}, System: "You write Go."},
+		"extraction": {Name: "extraction", Options: map[string]any{"temperature": float64(0)}},
+	}
+	if diff := cmp.Diff(expect, presets); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if presets, err := loadPresets(""); err != nil || presets != nil {
+		t.Errorf("expected no presets without a file, got %v %v", presets, err)
+	}
+
+	for _, tt := range []struct{ file, err string }{
+		{`{"code": {"options": {"temprature": 0.2}}}`, "unknown parameter 'temprature'"},
+		{`{"code": {"options": {"num_ctx": "big"}}}`, "num_ctx"},
+		{`{"code": {"parameters": {}}}`, "unknown field"},
+		{`{"": {}}`, "can't be empty"},
+	} {
+		if _, err := loadPresets(write(t, tt.file)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("loadPresets(%s): expected error containing %q, got %v", tt.file, tt.err, err)
+		}
+	}
+}
+
+func TestListPresetsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+	w := createRequest(t, s.ListPresetsHandler, nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"presets":[]}` {
+		t.Errorf("expected no presets, got %d %s", w.Code, w.Body)
+	}
+
+	s.presets = map[string]api.Preset{
+		"extraction": {Name: "extraction", Options: map[string]any{"temperature": 0.0}},
+		"code":       {Name: "code", System: "You write Go."},
+	}
+
+	w = createRequest(t, s.ListPresetsHandler, nil)
+	var resp api.ListPresetsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, p := range resp.Presets {
+		names = append(names, p.Name)
+	}
+
+	if diff := cmp.Diff([]string{"code", "extraction"}, names); diff != "" {
+		t.Errorf("expected presets in order (-want +got):\n%s", diff)
+	}
+}
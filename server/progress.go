@@ -0,0 +1,67 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// progressPhases wraps fn, the progress function of a pull, push or create,
+// to fill in the structured fields of each response. A response that
+// doesn't set its phase, such as a warning, is in the phase of the response
+// before it, and the operation starts out resolving.
+func progressPhases(fn func(api.ProgressResponse)) func(api.ProgressResponse) {
+	var mu sync.Mutex
+	phase := api.PhaseResolving
+	return func(r api.ProgressResponse) {
+		mu.Lock()
+		if r.Phase == "" {
+			r.Phase = phase
+		}
+		phase = r.Phase
+		mu.Unlock()
+
+		r.Schema = api.ProgressSchema
+		fn(r)
+	}
+}
+
+// progressError marks resp as the error response that ends a pull, push or
+// create
+func progressError(resp gin.H) gin.H {
+	resp["phase"] = api.PhaseError
+	resp["schema"] = api.ProgressSchema
+	return resp
+}
+
+// transferProgress wraps fn to report the overall progress of transferring
+// layers in each response. The progress of each layer is taken from the
+// responses with its digest.
+func transferProgress(fn func(api.ProgressResponse), layers []Layer) func(api.ProgressResponse) {
+	var total int64
+	completed := make(map[string]int64)
+	for _, layer := range layers {
+		if _, ok := completed[layer.Digest]; !ok && layer.Digest != "" {
+			completed[layer.Digest] = 0
+			total += layer.Size
+		}
+	}
+
+	var mu sync.Mutex
+	return func(r api.ProgressResponse) {
+		mu.Lock()
+		if _, ok := completed[r.Digest]; ok {
+			completed[r.Digest] = r.Completed
+		}
+
+		r.OverallTotal = total
+		for _, n := range completed {
+			r.OverallCompleted += n
+		}
+		mu.Unlock()
+
+		fn(r)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+// newProgressRegistry serves the model library/test, redirecting downloads
+// of its blobs as registries do. Pushes of other models are accepted
+// without uploading blobs, since the registry has them all.
+func newProgressRegistry(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	blobs := map[string][]byte{}
+	layer := func(mediatype string, b []byte) Layer {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+		blobs[digest] = b
+		return Layer{MediaType: mediatype, Digest: digest, Size: int64(len(b))}
+	}
+
+	manifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		Config:        layer("application/vnd.docker.container.image.v1+json", []byte(`{"model_format":"gguf","model_family":"llama"}`)),
+		Layers: []Layer{
+			layer("application/vnd.ollama.image.model", bytes.Repeat([]byte("ollama"), 8192)),
+			layer("application/vnd.ollama.image.template", []byte("{{ .Prompt }}")),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		digest := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/library/test/manifests/latest"):
+			w.Write(manifest)
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+			if b, ok := blobs[digest]; ok {
+				w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/"):
+			u, err := url.Parse(registry.URL)
+			if err != nil {
+				t.Error(err)
+			}
+
+			u.Host = "localhost:" + u.Port()
+			http.Redirect(w, r, u.JoinPath("direct", digest).String(), http.StatusTemporaryRedirect)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/direct/"):
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blobs[digest]))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+// progressLines returns the progress responses in body, keeping only the
+// last of consecutive responses for a layer in the same phase, as how many
+// are reported while it's transferred depends on timing
+func progressLines(t *testing.T, body io.Reader, host string) string {
+	t.Helper()
+
+	var lines []map[string]any
+	sc := bufio.NewScanner(body)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := len(lines); n > 0 && line["digest"] != nil && line["digest"] == lines[n-1]["digest"] && line["phase"] == lines[n-1]["phase"] {
+			lines[n-1] = line
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		bts, err := json.Marshal(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.WriteString(strings.ReplaceAll(string(bts), host, "registry.test"))
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+func TestProgressPhases(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_NOPRUNE", "1")
+
+	registry := newProgressRegistry(t)
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	router := s.GenerateRoutes()
+
+	cases := []struct {
+		name string
+		path string
+		body any
+	}{
+		{"pull", "/api/pull", api.PullRequest{Model: u.Host + "/library/test", Insecure: true}},
+		{"pull_cached", "/api/pull", api.PullRequest{Model: u.Host + "/library/test", Insecure: true}},
+		{"pull_error", "/api/pull", api.PullRequest{Model: u.Host + "/library/missing", Insecure: true}},
+		{"push", "/api/push", api.PushRequest{Model: u.Host + "/library/test", Destination: u.Host + "/library/pushed", Insecure: true}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(b)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			expect, err := os.ReadFile(filepath.Join("testdata", "progress", tt.name+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(string(expect), progressLines(t, w.Body, u.Host)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
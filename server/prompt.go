@@ -14,8 +14,19 @@ type tokenizeFunc func(context.Context, string) ([]int, error)
 
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
+// latest message and 2) system messages. Images are downscaled as the projector needs and counted as the tokens they take.
 func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
+	// the images of each message, prepared for the projector
+	prepared := make([][]llm.ImageData, len(msgs))
+	if p := m.visionProjector(); p != nil {
+		for i, msg := range msgs {
+			for _, data := range msg.Images {
+				data, tokens := p.prepare(data, downscaleImages(opts))
+				prepared[i] = append(prepared[i], llm.ImageData{Data: data, Tokens: tokens})
+			}
+		}
+	}
+
 	var system []api.Message
 	// always include the last message
 	n := len(msgs) - 1
@@ -39,11 +50,9 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		}
 
 		c := len(s)
-		if m.ProjectorPaths != nil {
-			for _, m := range msgs[i:] {
-				// images are represented as 768 sized embeddings
-				// TODO: get embedding length from project metadata
-				c += 768 * len(m.Images)
+		for _, images := range prepared[i:] {
+			for _, image := range images {
+				c += image.Tokens
 			}
 		}
 
@@ -61,12 +70,13 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		return "", nil, err
 	}
 
-	for _, m := range msgs[n:] {
-		for _, i := range m.Images {
-			images = append(images, llm.ImageData{
-				ID:   len(images),
-				Data: i,
-			})
+	for i, m := range msgs[n:] {
+		for j, data := range m.Images {
+			image := llm.ImageData{ID: len(images), Data: data}
+			if prepared[n+i] != nil {
+				image.Data, image.Tokens = prepared[n+i][j].Data, prepared[n+i][j].Tokens
+			}
+			images = append(images, image)
 		}
 	}
 
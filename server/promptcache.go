@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// modelPromptCache counts a model's lookups in the shared prompt cache,
+// which each runner keeps for prompts evaluated for other requests
+type modelPromptCache struct {
+	Model string `json:"model"`
+
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+
+	// Tokens is the number of prompt tokens reused by hits
+	Tokens uint64 `json:"tokens"`
+}
+
+// promptCacheStats counts shared prompt cache lookups by model path
+type promptCacheStats struct {
+	mu     sync.Mutex
+	models map[string]*modelPromptCache
+}
+
+// observe counts the prompt cache lookup of a completed request, if there was one
+func (p *promptCacheStats) observe(modelPath string, r llm.CompletionResponse) {
+	if !r.PromptCacheLookup {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.models == nil {
+		p.models = make(map[string]*modelPromptCache)
+	}
+
+	m, ok := p.models[modelPath]
+	if !ok {
+		m = &modelPromptCache{Model: modelPath}
+		p.models[modelPath] = m
+	}
+
+	if r.PromptCacheTokens > 0 {
+		m.Hits++
+		m.Tokens += uint64(r.PromptCacheTokens)
+	} else {
+		m.Misses++
+	}
+}
+
+func (p *promptCacheStats) state() []modelPromptCache {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var state []modelPromptCache
+	for _, m := range p.models {
+		state = append(state, *m)
+	}
+
+	sort.Slice(state, func(i, j int) bool {
+		return state[i].Model < state[j].Model
+	})
+	return state
+}
+
+// promptCacheHit reports whether a completed request's prompt was found in
+// the shared prompt cache, or nil if it wasn't looked up
+func promptCacheHit(r llm.CompletionResponse) *bool {
+	if !r.PromptCacheLookup {
+		return nil
+	}
+
+	hit := r.PromptCacheTokens > 0
+	return &hit
+}
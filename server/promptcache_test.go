@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func TestPromptCacheStats(t *testing.T) {
+	var p promptCacheStats
+
+	miss := llm.CompletionResponse{Done: true, PromptCacheLookup: true}
+	hit := llm.CompletionResponse{Done: true, PromptCacheLookup: true, PromptCacheTokens: 1500}
+
+	p.observe("/models/blobs/sha256-abc", llm.CompletionResponse{Done: true})
+	p.observe("/models/blobs/sha256-abc", miss)
+	p.observe("/models/blobs/sha256-abc", hit)
+	p.observe("/models/blobs/sha256-abc", hit)
+
+	state := p.state()
+	if len(state) != 1 {
+		t.Fatalf("expected one model, got %v", state)
+	}
+
+	if m := state[0]; m.Hits != 2 || m.Misses != 1 || m.Tokens != 3000 {
+		t.Errorf("unexpected state %+v", m)
+	}
+
+	if h := promptCacheHit(llm.CompletionResponse{}); h != nil {
+		t.Errorf("expected no hit without a lookup, got %v", *h)
+	}
+
+	if h := promptCacheHit(miss); h == nil || *h {
+		t.Error("expected a miss")
+	}
+
+	if h := promptCacheHit(hit); h == nil || !*h {
+		t.Error("expected a hit")
+	}
+
+	s := Server{sched: &Scheduler{}}
+	s.sched.promptCache.observe("/models/blobs/sha256-abc", hit)
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+	s.MetricsHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	for _, line := range []string{
+		"# TYPE ollama_prompt_cache_hits_total counter",
+		`ollama_prompt_cache_hits_total{model="sha256-abc"} 1`,
+		`ollama_prompt_cache_misses_total{model="sha256-abc"} 0`,
+		`ollama_prompt_cache_tokens_total{model="sha256-abc"} 1500`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("expected %q in\n%s", line, w.Body.String())
+		}
+	}
+
+	if strings.Contains(w.Body.String(), "ollama_admission") {
+		t.Errorf("expected no admission metrics before any requests, got\n%s", w.Body.String())
+	}
+}
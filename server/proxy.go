@@ -0,0 +1,44 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// registryTransport is the transport of requests to registries and the
+// blob downloads they redirect to. Only these go through
+// OLLAMA_REGISTRY_PROXY; requests between Ollama and its clients don't.
+var registryTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = registryProxy
+	return t
+}()
+
+// registryProxy returns the proxy for a request to a registry:
+// OLLAMA_REGISTRY_PROXY if it's set, otherwise HTTPS_PROXY or HTTP_PROXY,
+// unless the host is excluded by NO_PROXY
+func registryProxy(req *http.Request) (*url.URL, error) {
+	config := httpproxy.FromEnvironment()
+	if proxy := envconfig.RegistryProxy(); proxy != "" {
+		// httpproxy ignores proxies it can't parse, but requests must not
+		// bypass this one. Like it, assume http if there's no scheme.
+		u, err := url.Parse(proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			u, err = url.Parse("http://" + proxy)
+		}
+
+		if err != nil {
+			// the error includes the proxy URL, which may have credentials
+			return nil, errors.New("invalid OLLAMA_REGISTRY_PROXY")
+		}
+
+		config.HTTPProxy, config.HTTPSProxy = u.String(), u.String()
+	}
+
+	return config.ProxyFunc()(req.URL)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// pruneGracePeriod keeps recently written blobs that aren't used by any
+// model, since they may have been uploaded for a create that hasn't written
+// its manifest yet
+const pruneGracePeriod = time.Hour
+
+// brokenLayers returns the digests of the layers in m whose blobs are
+// missing or have a different size than recorded. With verify, the blobs are
+// also hashed to find those that don't match their digest.
+func (m *Manifest) brokenLayers(verify bool) []string {
+	// variants don't all have to be pulled, but at least one does
+	optional := m.variantLayers()
+	if len(m.Variants) > 0 && len(m.pulledVariants()) == 0 {
+		optional = nil
+	}
+
+	var digests []string
+	st := storage()
+	for _, layer := range m.allLayers() {
+		if layer.Digest == "" {
+			continue
+		}
+
+		fi, err := st.StatBlob(layer.Digest)
+		_, isOptional := optional[layer.Digest]
+		switch {
+		case err != nil && isOptional:
+		case err != nil:
+			digests = append(digests, layer.Digest)
+		case layer.Size > 0 && fi.Size() != layer.Size:
+			digests = append(digests, layer.Digest)
+		case verify:
+			if err := verifyBlob(layer.Digest); err != nil {
+				digests = append(digests, layer.Digest)
+			}
+		}
+	}
+
+	return digests
+}
+
+// pruneModels removes blobs that aren't used by any model and finds broken
+// models, whose manifests reference blobs that are missing or don't match.
+// Broken models are removed with removeBroken, making any of their blobs that
+// remain unused. Nothing is removed with dryRun. Pulls and creates hold
+// storeMu until their manifest is written, so a model that's still being
+// written is never seen as broken.
+func pruneModels(dryRun, removeBroken, verify bool) (*api.PruneResponse, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	unlock, err := lockStore(context.Background(), storeLockName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ms, err := Manifests()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := api.PruneResponse{Broken: []api.BrokenModel{}, Unused: []api.UnusedBlob{}}
+	used := make(map[string]struct{})
+	for n, m := range ms {
+		if missing := m.brokenLayers(verify); len(missing) > 0 {
+			resp.Broken = append(resp.Broken, api.BrokenModel{Model: n.DisplayShortest(), Missing: missing})
+			if removeBroken {
+				if !dryRun {
+					if err := m.Remove(); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+		}
+
+		for _, layer := range m.allLayers() {
+			used[layer.Digest] = struct{}{}
+		}
+	}
+
+	// models in legacy layouts that haven't been migrated, such as those
+	// whose blobs failed to verify, keep their blobs
+	legacy, err := legacyLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	for digest := range legacy {
+		used[digest] = struct{}{}
+	}
+
+	// blobs are listed in the blobs directory, which caches those of storage
+	// outside it
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// partial downloads are left for the pull that resumes them
+		if !blobNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		digest := strings.Replace(entry.Name(), "-", ":", 1)
+		if _, ok := used[digest]; ok || lockHeld(entry.Name()) {
+			continue
+		}
+
+		fi, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if time.Since(fi.ModTime()) < pruneGracePeriod {
+			continue
+		}
+
+		if !dryRun {
+			p, err := GetBlobsPath(digest)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := os.Remove(p); err != nil {
+				return nil, err
+			}
+
+			modelsVersion.Add(1)
+		}
+
+		resp.Unused = append(resp.Unused, api.UnusedBlob{Digest: digest, Size: fi.Size()})
+		resp.Reclaimed += fi.Size()
+	}
+
+	slices.SortFunc(resp.Broken, func(a, b api.BrokenModel) int {
+		return cmp.Compare(a.Model, b.Model)
+	})
+
+	return &resp, nil
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// backdate makes every blob old enough to be pruned
+func backdate(t *testing.T) {
+	t.Helper()
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * pruneGracePeriod)
+	for _, entry := range entries {
+		if err := os.Chtimes(filepath.Join(blobs, entry.Name()), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPruneModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// setup creates a healthy model and a broken one missing its model blob,
+	// returning the missing digest and an unused blob
+	setup := func(t *testing.T) (missing, unused string) {
+		t.Helper()
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		var s Server
+		for _, name := range []string{"healthy", "broken"} {
+			w := createRequest(t, s.CreateHandler, api.CreateRequest{
+				Name:      name,
+				Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, map[string]any{"general.name": name}, nil)),
+				Stream:    &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d", w.Code)
+			}
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("broken"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, layer := range m.Layers {
+			if layer.MediaType == "application/vnd.ollama.image.model" {
+				missing = layer.Digest
+				p, err := GetBlobsPath(layer.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.Remove(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		unused = writeBlob(t, os.Getenv("OLLAMA_MODELS"), "unused")
+		backdate(t)
+		return missing, unused
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		missing, unused := setup(t)
+
+		resp, err := pruneModels(true, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Broken) != 1 || resp.Broken[0].Model != "broken:latest" || !slices.Equal(resp.Broken[0].Missing, []string{missing}) {
+			t.Errorf("unexpected broken models %+v", resp.Broken)
+		}
+
+		if !slices.ContainsFunc(resp.Unused, func(b api.UnusedBlob) bool { return b.Digest == "sha256:"+unused[len("sha256-"):] }) {
+			t.Errorf("expected %s to be unused, got %+v", unused, resp.Unused)
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("broken")); err != nil {
+			t.Errorf("expected a dry run not to remove the broken model, got %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(os.Getenv("OLLAMA_MODELS"), "blobs", unused)); err != nil {
+			t.Errorf("expected a dry run not to remove unused blobs, got %v", err)
+		}
+	})
+
+	t.Run("report broken", func(t *testing.T) {
+		_, unused := setup(t)
+
+		resp, err := pruneModels(false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Broken) != 1 || len(resp.Unused) != 1 || resp.Reclaimed != int64(len("unused")) {
+			t.Errorf("expected one broken model and one unused blob, got %+v", resp)
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("broken")); err != nil {
+			t.Errorf("expected the broken model to be kept, got %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(os.Getenv("OLLAMA_MODELS"), "blobs", unused)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the unused blob to be removed, got %v", err)
+		}
+	})
+
+	t.Run("remove broken", func(t *testing.T) {
+		setup(t)
+
+		resp, err := pruneModels(false, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Broken) != 1 {
+			t.Errorf("expected one broken model, got %+v", resp.Broken)
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("broken")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the broken model to be removed, got %v", err)
+		}
+
+		healthy, err := ParseNamedManifest(model.ParseName("healthy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if broken := healthy.brokenLayers(true); len(broken) > 0 {
+			t.Errorf("expected the healthy model to be kept intact, missing %v", broken)
+		}
+
+		// the blobs left by the broken model are no longer used
+		if len(resp.Unused) < 2 {
+			t.Errorf("expected the broken model's blobs to be removed, got %+v", resp.Unused)
+		}
+	})
+
+	t.Run("mismatched digest", func(t *testing.T) {
+		setup(t)
+
+		healthy, err := ParseNamedManifest(model.ParseName("healthy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := GetBlobsPath(healthy.Layers[0].Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b[len(b)-1] ^= 0xff
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := pruneModels(true, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Broken) != 1 {
+			t.Errorf("expected blobs of the right size to be trusted without verify, got %+v", resp.Broken)
+		}
+
+		resp, err = pruneModels(true, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Broken) != 2 || resp.Broken[1].Model != "healthy:latest" {
+			t.Errorf("expected verify to find the mismatched blob, got %+v", resp.Broken)
+		}
+	})
+
+	t.Run("concurrent pull", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		// hold the store as a pull does while it writes blobs and then the
+		// manifest, which references a blob the prune could see missing
+		storeMu.RLock()
+		digest := fmt.Sprintf("sha256:%x", [32]byte{})
+		if err := WriteManifest(model.ParseName("pulling"), Layer{}, []Layer{{Digest: digest, Size: 1}}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan *api.PruneResponse)
+		go func() {
+			resp, err := pruneModels(true, false, false)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- resp
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		p, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, []byte{0}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		storeMu.RUnlock()
+
+		if resp := <-done; resp != nil && len(resp.Broken) > 0 {
+			t.Errorf("expected a model being pulled not to be broken, got %+v", resp.Broken)
+		}
+	})
+}
+
+func TestListBroken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "broken",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	m, err := ParseNamedManifest(model.ParseName("broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := GetBlobsPath(m.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+
+	w := createRequest(t, s.ListHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp api.ListResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Models) != 1 || !resp.Models[0].Broken {
+		t.Errorf("expected the model to be listed as broken, got %+v", resp.Models)
+	}
+}
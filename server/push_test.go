@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestPushModelAs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	// the registry has the blobs in have, stores manifests by repository and
+	// tag, and denies pushes to the "denied" namespace
+	var mu sync.Mutex
+	have := make(map[string]bool)
+	manifests := make(map[string][]byte)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/denied/") && r.Method != http.MethodHead:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`)
+		case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/"):
+			if !have[path.Base(r.URL.Path)] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			manifests[r.URL.Path] = b
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "local",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	manifest, err := ParseNamedManifest(model.ParseName("local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &registryOptions{Insecure: true}
+	dest := u.Host + "/user/published:v1"
+
+	var uploads []api.ProgressResponse
+	if err := PushModelAs(context.Background(), "local", dest, true, opts, false, func(r api.ProgressResponse) {
+		if r.Digest != "" {
+			uploads = append(uploads, r)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	layers := manifest.allLayers()
+	if len(uploads) != len(layers) {
+		t.Fatalf("expected %d layers to be uploaded, got %v", len(layers), uploads)
+	}
+
+	for i, layer := range layers {
+		if uploads[i].Digest != layer.Digest || uploads[i].Total != layer.Size {
+			t.Errorf("expected %s of %d bytes to be uploaded, got %s of %d", layer.Digest, layer.Size, uploads[i].Digest, uploads[i].Total)
+		}
+	}
+
+	if len(manifests) > 0 {
+		t.Fatalf("expected a dry run not to push manifests, got %v", manifests)
+	}
+
+	// the registry already has the blobs, so only the manifest is pushed
+	for _, layer := range layers {
+		have[layer.Digest] = true
+	}
+
+	if err := PushModelAs(context.Background(), "local", dest, false, opts, false, func(api.ProgressResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := manifests["/v2/user/published/manifests/v1"]; !ok || len(manifests) != 1 {
+		t.Errorf("expected the manifest to be pushed as user/published:v1, got %v", manifests)
+	}
+
+	if _, err := ParseNamedManifest(model.ParseName(dest)); err == nil {
+		t.Error("expected no local model to be created for the destination")
+	}
+
+	err = PushModelAs(context.Background(), "local", u.Host+"/denied/model:latest", false, opts, false, func(api.ProgressResponse) {})
+	if err == nil || err.Error() != "requested access to the resource is denied" {
+		t.Errorf("expected the registry's error, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/ollama/ollama/api"
+)
+
+// rawImagePattern matches the tokens that place images in raw prompts
+var rawImagePattern = regexp.MustCompile(`\[img-(\d+)\]`)
+
+// checkRawImages returns an error unless each of n images is placed exactly
+// once in the raw prompt with [img-N], N being its index, since the runner
+// only puts images where the prompt has them
+func checkRawImages(prompt string, n int) error {
+	placed := make([]bool, n)
+	for _, m := range rawImagePattern.FindAllStringSubmatch(prompt, -1) {
+		i, err := strconv.Atoi(m[1])
+		if err != nil || i >= n {
+			return fmt.Errorf("raw prompt places %s, but the request has %d image(s)", m[0], n)
+		} else if placed[i] {
+			return fmt.Errorf("raw prompt places %s more than once", m[0])
+		}
+
+		placed[i] = true
+	}
+
+	for i := range placed {
+		if !placed[i] {
+			return fmt.Errorf("raw prompt doesn't place image %d, add [img-%d] where it goes", i, i)
+		}
+	}
+
+	return nil
+}
+
+// checkRawTokens returns an error if add_bos or add_eos are set on a request
+// that isn't raw, as the template decides the tokens around its prompts
+func checkRawTokens(req api.GenerateRequest) error {
+	if !req.Raw && (req.AddBOS != nil || req.AddEOS != nil) {
+		return errors.New("add_bos and add_eos are only supported in raw mode")
+	}
+
+	return nil
+}
+
+// rawOptions removes the stop sequences of the model's parameters from the
+// options of a raw request, since they're derived from its template. Those
+// of the request, its preset or the server's defaults are kept.
+func rawOptions(opts *api.Options, m *Model, presetOpts, requestOpts map[string]any) error {
+	var fallback api.Options
+	if err := fallback.FromMap(serverOptions()); err != nil {
+		return err
+	}
+
+	if err := fallback.FromMap(presetOpts); err != nil {
+		return err
+	}
+
+	sources := optionSources(opts, m, presetOpts, requestOpts)
+	if sources["stop"] == optionSourceModel {
+		opts.Stop = fallback.Stop
+	}
+
+	if sources["stop_token_ids"] == optionSourceModel {
+		opts.StopTokenIDs = fallback.StopTokenIDs
+	}
+
+	return nil
+}
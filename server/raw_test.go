@@ -0,0 +1,30 @@
+package server
+
+import "testing"
+
+func TestCheckRawImages(t *testing.T) {
+	cases := []struct {
+		prompt string
+		n      int
+		ok     bool
+	}{
+		{"no images", 0, true},
+		{"[img-0] describe this", 1, true},
+		{"compare [img-1] with [img-0]", 2, true},
+		{"describe this", 1, false},
+		{"[img-0] and [img-0]", 1, false},
+		{"[img-0] and [img-1]", 1, false},
+		{"[img-1]", 0, false},
+		{"[img-0] but not the second", 2, false},
+		{"[img-99999999999999999999]", 1, false},
+	}
+
+	for _, tt := range cases {
+		err := checkRawImages(tt.prompt, tt.n)
+		if tt.ok && err != nil {
+			t.Errorf("%q with %d images: unexpected error %v", tt.prompt, tt.n, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%q with %d images: expected an error", tt.prompt, tt.n)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+const (
+	refreshUpToDate  = "up to date"
+	refreshUpdated   = "updated"
+	refreshAvailable = "update available"
+)
+
+// Models that fail to refresh are retried after refreshRetryMin, doubling
+// with each failure up to refreshRetryMax
+const (
+	refreshRetryMin = time.Minute
+	refreshRetryMax = time.Hour
+)
+
+// refreshMu serializes refreshes so a scheduled and a requested refresh of a
+// model don't pull it at the same time
+var refreshMu sync.Mutex
+
+// maintenanceWindow is a daily range of local time, as offsets from midnight.
+// A window that ends before it starts spans midnight.
+type maintenanceWindow struct {
+	start, end time.Duration
+}
+
+// parseMaintenanceWindow parses a window in the form "HH:MM-HH:MM", returning
+// nil if s is empty
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid maintenance window %q: expected HH:MM-HH:MM", s)
+	}
+
+	var w maintenanceWindow
+	for _, v := range []struct {
+		s string
+		d *time.Duration
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(v.s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: expected HH:MM-HH:MM", s)
+		}
+
+		*v.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid maintenance window %q: window is empty", s)
+	}
+
+	return &w, nil
+}
+
+// contains reports whether t is in the window. Every time is in a nil window.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return d >= w.start && d < w.end
+	}
+
+	return d >= w.start || d < w.end
+}
+
+// next returns the first time the window is open at or after t
+func (w *maintenanceWindow) next(t time.Time) time.Time {
+	if w.contains(t) {
+		return t
+	}
+
+	open := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(w.start)
+	if open.Before(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+
+	return open
+}
+
+// manifestDigests returns the digests of a manifest's layers and config
+func manifestDigests(m *Manifest) []string {
+	digests := make([]string, 0, len(m.Layers)+1)
+	for _, layer := range m.Layers {
+		digests = append(digests, layer.Digest)
+	}
+
+	return append(digests, m.Config.Digest)
+}
+
+// refreshModel compares the manifest of name with the registry's, pulling the
+// update if pull is set. Runners of the model are replaced with runners of
+// the update.
+func (s *Server) refreshModel(ctx context.Context, name string, pull bool) (string, error) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	mp := ParseModelPath(name)
+	regOpts := &registryOptions{Insecure: mp.ProtocolScheme == "http"}
+
+	local, _, err := GetManifest(mp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	// manifests pinned to a digest never change
+	if local != nil && mp.Digest != "" {
+		return refreshUpToDate, nil
+	}
+
+	remote, _, err := pullModelManifest(ctx, mp, regOpts)
+	if err != nil {
+		return "", fmt.Errorf("pull model manifest: %w", err)
+	}
+
+	if local != nil && slices.Equal(manifestDigests(local), manifestDigests(remote)) {
+		return refreshUpToDate, nil
+	}
+
+	if !pull {
+		return refreshAvailable, nil
+	}
+
+	// old is nil if the model hasn't been pulled before
+	old, _ := GetModel(name)
+
+	ctx, t := startTransfer(ctx, "pull", mp.GetShortTagname())
+	defer t.finish()
+
+	if err := PullModel(ctx, name, regOpts, t.update); err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errTransferCancelled) {
+			return "", cause
+		}
+		return "", err
+	}
+
+	if old != nil {
+		updated, err := GetModel(name)
+		if err != nil {
+			return "", err
+		}
+
+		// the update is pulled either way, so it's loaded the next time the
+		// model is used after the old runners expire
+		if err := s.reloadRunners(ctx, old, updated); err != nil {
+			slog.Warn("failed to reload updated model", "model", name, "error", err)
+		}
+	}
+
+	return refreshUpdated, nil
+}
+
+// reloadRunners replaces the runners of old, if it's loaded, with runners of
+// updated. updated is loaded before old is unloaded, so requests are served
+// throughout unless both don't fit at once.
+func (s *Server) reloadRunners(ctx context.Context, old, updated *Model) error {
+	if s.sched == nil || old.ModelPath == updated.ModelPath {
+		return nil
+	}
+
+	s.sched.loadedMu.Lock()
+	replicas := s.sched.replicas(old.ModelPath)
+	var sessionDuration time.Duration
+	for _, runner := range replicas {
+		runner.refMu.Lock()
+		sessionDuration = max(sessionDuration, runner.sessionDuration)
+		runner.refMu.Unlock()
+	}
+	s.sched.loadedMu.Unlock()
+
+	if len(replicas) == 0 {
+		return nil
+	}
+
+	opts, err := modelOptions(updated, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	var keepAlive *api.Duration
+	if sessionDuration > 0 {
+		keepAlive = &api.Duration{Duration: sessionDuration}
+	}
+
+	// cancelling the context releases the runner once it's loaded
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runnerCh, errCh := s.sched.GetRunner(ctx, updated, opts, keepAlive)
+	select {
+	case <-runnerCh:
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.sched.expireRunner(old)
+	slog.Info("reloaded updated model", "model", updated.ShortName)
+	return nil
+}
+
+// refreshModels checks models for updates every interval, pulling them when
+// the maintenance window is open. Failed refreshes are retried with backoff
+// until ctx is done.
+func (s *Server) refreshModels(ctx context.Context, models []string, interval time.Duration, window *maintenanceWindow) {
+	next := make(map[string]time.Time)
+	failures := make(map[string]int)
+
+	for {
+		var wake time.Time
+		for _, name := range models {
+			if now := time.Now(); !next[name].After(now) {
+				status, err := s.refreshModel(ctx, name, window.contains(now))
+				if ctx.Err() != nil {
+					return
+				}
+
+				now = time.Now()
+				switch {
+				case err != nil:
+					failures[name]++
+					retry := min(refreshRetryMin<<min(failures[name]-1, 10), refreshRetryMax, interval)
+					slog.Warn("failed to refresh model", "model", name, "error", err, "failures", failures[name], "retry", retry)
+					next[name] = now.Add(retry)
+				case status == refreshAvailable:
+					failures[name] = 0
+					slog.Info("model update available, pulling in maintenance window", "model", name, "window", envconfig.AutoPullWindow())
+					next[name] = window.next(now)
+				default:
+					failures[name] = 0
+					if status == refreshUpdated {
+						slog.Info("updated model", "model", name)
+					}
+					next[name] = now.Add(interval)
+				}
+			}
+
+			if wake.IsZero() || next[name].Before(wake) {
+				wake = next[name]
+			}
+		}
+
+		if err := sleepContext(ctx, time.Until(wake)); err != nil {
+			return
+		}
+	}
+}
+
+// startRefresher keeps the models in OLLAMA_AUTO_PULL up to date until ctx is
+// done. A misconfigured maintenance window disables scheduled refreshes
+// rather than failing the server.
+func (s *Server) startRefresher(ctx context.Context) {
+	models, interval := envconfig.AutoPull(), envconfig.AutoPullInterval()
+	if len(models) == 0 || interval <= 0 {
+		return
+	}
+
+	if envconfig.Offline() {
+		slog.Warn("scheduled model refreshes are disabled in offline mode")
+		return
+	}
+
+	window, err := parseMaintenanceWindow(envconfig.AutoPullWindow())
+	if err != nil {
+		slog.Error("scheduled model refreshes are disabled", "error", err)
+		return
+	}
+
+	slog.Info("refreshing models", "models", models, "interval", interval, "window", envconfig.AutoPullWindow())
+	go s.refreshModels(ctx, models, interval, window)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	day := func(hour, min int) time.Time {
+		return time.Date(2024, time.June, 1, hour, min, 0, 0, time.Local)
+	}
+
+	cases := []struct {
+		window   string
+		t        time.Time
+		contains bool
+		next     time.Time
+	}{
+		{"02:00-04:00", day(3, 0), true, day(3, 0)},
+		{"02:00-04:00", day(4, 0), false, day(26, 0)},
+		{"02:00-04:00", day(1, 0), false, day(2, 0)},
+		{"23:00-01:00", day(0, 30), true, day(0, 30)},
+		{"23:00-01:00", day(23, 30), true, day(23, 30)},
+		{"23:00-01:00", day(12, 0), false, day(23, 0)},
+	}
+
+	for _, tt := range cases {
+		w, err := parseMaintenanceWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if contains := w.contains(tt.t); contains != tt.contains {
+			t.Errorf("%s at %s: expected contains %v, got %v", tt.window, tt.t.Format("15:04"), tt.contains, contains)
+		}
+
+		if next := w.next(tt.t); !next.Equal(tt.next) {
+			t.Errorf("%s at %s: expected next %s, got %s", tt.window, tt.t.Format("15:04"), tt.next, next)
+		}
+	}
+
+	for _, s := range []string{"02:00", "2am-4am", "02:00-02:00", "25:00-01:00"} {
+		if _, err := parseMaintenanceWindow(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+
+	if w, err := parseMaintenanceWindow(""); err != nil || !w.contains(day(12, 0)) {
+		t.Errorf("expected an unset window to always be open, got %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	loaded := make(chan string, 1)
+	s := Server{
+		sched: &Scheduler{
+			queues:        newRequestQueues(1, 0),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				loaded <- req.model.ModelPath
+				req.successCh <- &runnerRef{llama: &mockRunner{}}
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	// the versions of the model are created locally, so pulling them only
+	// needs their manifests
+	manifests := make(map[string][]byte)
+	for i, version := range []string{"v1", "v2"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name: version,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+				"general.architecture":          "llama",
+				"general.file_type":             uint32(i),
+				"llama.block_count":             uint32(1),
+				"llama.context_length":          uint32(8192),
+				"llama.embedding_length":        uint32(4096),
+				"llama.attention.head_count":    uint32(32),
+				"llama.attention.head_count_kv": uint32(8),
+				"tokenizer.ggml.tokens":         []string{""},
+				"tokenizer.ggml.scores":         []float32{0},
+				"tokenizer.ggml.token_type":     []int32{0},
+			}, []llm.Tensor{
+				{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.attn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.ffn_down.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.ffn_gate.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.ffn_up.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.ffn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.attn_k.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.attn_output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.attn_q.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.attn_v.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			})),
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		m, err := ParseNamedManifest(model.ParseName(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if manifests[version], err = json.Marshal(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var latest atomic.Value
+	latest.Store("v1")
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/library/m/manifests/latest") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+
+		b, ok := manifests[latest.Load().(string)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Write(b)
+	}))
+	defer registry.Close()
+
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := fmt.Sprintf("http://%s/library/m:latest", u.Host)
+	refresh := func(t *testing.T, pull bool, expect string) {
+		t.Helper()
+		status, err := s.refreshModel(ctx, name, pull)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status != expect {
+			t.Errorf("expected status %q, got %q", expect, status)
+		}
+	}
+
+	digests := func(t *testing.T, version string) []string {
+		t.Helper()
+		m, err := ParseNamedManifest(model.ParseName(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return manifestDigests(m)
+	}
+
+	refresh(t, false, refreshAvailable)
+	if _, err := GetModel(name); err == nil {
+		t.Fatal("expected a check not to pull the model")
+	}
+
+	refresh(t, true, refreshUpdated)
+	refresh(t, true, refreshUpToDate)
+	if !slices.Equal(digests(t, u.Host+"/library/m"), digests(t, "v1")) {
+		t.Error("expected the model to be pulled")
+	}
+
+	old, err := GetModel(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.sched.loadedMu.Lock()
+	s.sched.loaded[old.ModelPath] = &runnerRef{modelPath: old.ModelPath, sessionDuration: time.Hour}
+	s.sched.loadedMu.Unlock()
+
+	latest.Store("v2")
+	refresh(t, false, refreshAvailable)
+	if !slices.Equal(digests(t, u.Host+"/library/m"), digests(t, "v1")) {
+		t.Error("expected a check not to pull the update")
+	}
+
+	w := httptest.NewRecorder()
+	s.GenerateRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/refresh", strings.NewReader(fmt.Sprintf(`{"model": %q}`, name))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp api.RefreshResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Models) != 1 || resp.Models[0].Status != refreshUpdated {
+		t.Fatalf("expected the model to be updated, got %+v", resp.Models)
+	}
+
+	updated, err := GetModel(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case modelPath := <-loaded:
+		if modelPath != updated.ModelPath {
+			t.Errorf("expected the update to be loaded, got %s", modelPath)
+		}
+	default:
+		t.Fatal("expected the update to be loaded")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		s.sched.loadedMu.Lock()
+		_, ok := s.sched.loaded[old.ModelPath]
+		s.sched.loadedMu.Unlock()
+		if !ok {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the old model to be unloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	latest.Store("missing")
+	if _, err := s.refreshModel(ctx, name, true); err == nil {
+		t.Error("expected an error for a manifest missing from the registry")
+	}
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// remoteListTimeout bounds how long placement waits on a remote server to
+// list its models before moving on to the next one
+const remoteListTimeout = 5 * time.Second
+
+var errRemoteRunner = errors.New("model is running on a remote server")
+
+// remoteServers is the set of Ollama servers models may be placed on when
+// they can't be fully loaded locally. It's seeded from OLLAMA_REMOTE_SERVERS
+// and can be changed at runtime through the remotes API.
+type remoteServers struct {
+	mu    sync.Mutex
+	hosts []*url.URL
+}
+
+func newRemoteServers(hosts []*url.URL) *remoteServers {
+	return &remoteServers{hosts: hosts}
+}
+
+func (r *remoteServers) list() []*url.URL {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.hosts)
+}
+
+// add registers host, returning false if it was already registered
+func (r *remoteServers) add(host *url.URL) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.ContainsFunc(r.hosts, func(u *url.URL) bool { return u.String() == host.String() }) {
+		return false
+	}
+
+	r.hosts = append(r.hosts, host)
+	return true
+}
+
+// remove unregisters host, returning false if it wasn't registered
+func (r *remoteServers) remove(host *url.URL) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.hosts)
+	r.hosts = slices.DeleteFunc(r.hosts, func(u *url.URL) bool { return u.String() == host.String() })
+	return len(r.hosts) < n
+}
+
+// remoteRunner is a model running on a remote Ollama server. Handlers proxy
+// requests for it to the remote's API, where the model is templated and
+// tokenized, so the llm.LlamaServer methods only cover loading and health
+// checks.
+type remoteRunner struct {
+	host      *url.URL
+	client    *api.Client
+	model     string // name of the model on the remote
+	keepAlive *api.Duration
+
+	// Reported by the remote once the model is loaded
+	size     uint64
+	sizeVRAM uint64
+	runner   string
+}
+
+func newRemoteRunner(host *url.URL, model string, keepAlive *api.Duration) *remoteRunner {
+	return &remoteRunner{
+		host:      host,
+		client:    api.NewClient(host, http.DefaultClient),
+		model:     model,
+		keepAlive: keepAlive,
+	}
+}
+
+func (r *remoteRunner) Ping(ctx context.Context) error {
+	return r.client.Heartbeat(ctx)
+}
+
+// WaitUntilRunning loads the model on the remote with an empty generate request
+func (r *remoteRunner) WaitUntilRunning(ctx context.Context) error {
+	if err := r.client.Generate(ctx, &api.GenerateRequest{Model: r.model, KeepAlive: r.keepAlive}, func(api.GenerateResponse) error { return nil }); err != nil {
+		return err
+	}
+
+	// Sizes are only informational, so failing to get them doesn't fail the load
+	ps, err := r.client.ListRunning(ctx)
+	if err != nil {
+		slog.Debug("unable to list running models on remote server", "host", r.host, "error", err)
+		return nil
+	}
+
+	for _, m := range ps.Models {
+		if sameModel(m.Name, r.model) {
+			r.size = uint64(m.Size)
+			r.sizeVRAM = uint64(m.SizeVRAM)
+			r.runner = m.Runner
+		}
+	}
+	return nil
+}
+
+func (r *remoteRunner) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	return errRemoteRunner
+}
+
+func (r *remoteRunner) Embedding(ctx context.Context, input string) ([]float32, error) {
+	return nil, errRemoteRunner
+}
+
+func (r *remoteRunner) Score(ctx context.Context, req llm.ScoreRequest) ([]api.TokenLogprob, error) {
+	return nil, errRemoteRunner
+}
+
+func (r *remoteRunner) Tokenize(ctx context.Context, content string) ([]int, error) {
+	return nil, errRemoteRunner
+}
+
+func (r *remoteRunner) Detokenize(ctx context.Context, tokens []int) (string, error) {
+	return "", errRemoteRunner
+}
+
+// LoadProgress isn't reported by remote servers
+func (r *remoteRunner) LoadProgress() float32 {
+	return 0
+}
+
+func (r *remoteRunner) ReleaseCache(ctx context.Context) error {
+	return errRemoteRunner
+}
+
+func (r *remoteRunner) RestoreCache(ctx context.Context) error {
+	return nil
+}
+
+// Close leaves the model loaded on the remote, which unloads it according to
+// the keep alive of the requests it served
+func (r *remoteRunner) Close() error {
+	return nil
+}
+
+func (r *remoteRunner) EstimatedVRAM() uint64                   { return r.sizeVRAM }
+func (r *remoteRunner) EstimatedTotal() uint64                  { return r.size }
+func (r *remoteRunner) EstimatedVRAMByGPU(gpuID string) uint64  { return 0 }
+func (r *remoteRunner) EstimatedCacheByGPU(gpuID string) uint64 { return 0 }
+func (r *remoteRunner) Runner() string                          { return r.runner }
+
+// Slots aren't reported by remote servers, whose own /api/ps lists them
+func (r *remoteRunner) Slots(context.Context) ([]llm.SlotStatus, error) { return nil, nil }
+
+// UseMMap and UseMLock aren't reported by remote servers, which apply their own defaults
+func (r *remoteRunner) UseMMap() bool  { return false }
+func (r *remoteRunner) UseMLock() bool { return false }
+
+func sameModel(a, b string) bool {
+	return strings.EqualFold(model.ParseName(a).String(), model.ParseName(b).String())
+}
+
+// fitsLocally reports whether the model could be fully loaded on this server
+// if the other local runners were unloaded to make room
+func (s *Scheduler) fitsLocally(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) bool {
+	if len(gpus) == 0 {
+		return false
+	}
+
+	opts := req.opts
+	opts.NumCtx = req.origNumCtx
+	if gpus[0].Library == "cpu" {
+		return llm.EstimateGPULayers(gpus, ggml, req.model.ProjectorPaths, opts).TotalSize <= gpus[0].FreeMemory
+	}
+
+	reserved := s.ledger.reserved()
+	avail := make(gpu.GpuInfoList, len(gpus))
+	for i, g := range gpus {
+		g.FreeMemory = min(g.TotalMemory, g.FreeMemory+reserved[gpuKey{g.Library, g.ID}])
+		avail[i] = g
+	}
+
+	for _, gl := range avail.ByLibrary() {
+		if ok, _ := llm.PredictServerFit(gl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, opts); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// findRemote returns a runner on the first remote server that lists the
+// requested model, or nil if none of them can serve it
+func (s *Scheduler) findRemote(ctx context.Context, req *LlmRequest) *remoteRunner {
+	for _, host := range s.remotes.list() {
+		client := api.NewClient(host, http.DefaultClient)
+		listCtx, cancel := context.WithTimeout(ctx, remoteListTimeout)
+		tags, err := client.List(listCtx)
+		cancel()
+		if err != nil {
+			slog.Warn("unable to list models on remote server", "host", host, "error", err)
+			continue
+		}
+
+		for _, m := range tags.Models {
+			if sameModel(m.Name, req.model.ShortName) {
+				slog.Info("model does not fit locally, placing on remote server", "model", req.model.ShortName, "host", host)
+				return newRemoteRunner(host, m.Name, req.sessionDuration)
+			}
+		}
+		slog.Debug("model not available on remote server", "model", req.model.ShortName, "host", host)
+	}
+
+	slog.Warn("no remote server can serve model, falling back to local placement", "model", req.model.ShortName)
+	return nil
+}
+
+// placeRemote looks for a remote server with the model without blocking the
+// scheduler, since listing models on each remote can take up to
+// remoteListTimeout. If none of them has it the request is put back on the
+// queue to be placed locally.
+func (s *Scheduler) placeRemote(req *LlmRequest) {
+	s.loadedMu.Lock()
+	if s.placing == nil {
+		s.placing = make(map[string]bool)
+	}
+	s.placing[req.model.ModelPath] = true
+	s.loadedMu.Unlock()
+
+	go func() {
+		remote := s.findRemote(req.ctx, req)
+		if remote == nil {
+			s.placed(req)
+			req.remoteFailed = true
+			s.queues.requeue(req)
+			return
+		}
+
+		s.loadRemote(req, remote)
+	}()
+}
+
+// placed ends the remote placement of the request's model, letting its other
+// requests be scheduled
+func (s *Scheduler) placed(req *LlmRequest) {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	delete(s.placing, req.model.ModelPath)
+}
+
+// loadRemote loads the model on the remote server. If the remote fails to
+// load it the request is put back on the queue to be placed locally.
+func (s *Scheduler) loadRemote(req *LlmRequest, remote *remoteRunner) {
+	sessionDuration := envconfig.KeepAlive()
+	if req.sessionDuration != nil {
+		sessionDuration = req.sessionDuration.Duration
+	}
+
+	runner := &runnerRef{
+		model:           req.model,
+		modelPath:       req.model.ModelPath,
+		llama:           remote,
+		remote:          remote,
+		Options:         &req.opts,
+		sessionDuration: sessionDuration,
+		refCount:        1,
+		numParallel:     1,
+		replica:         req.replica,
+		autoNumCtx:      req.autoNumCtx,
+	}
+	runner.startLoading()
+	runner.refMu.Lock()
+
+	s.loadedMu.Lock()
+	if s.loaded[runner.key()] != nil {
+		// Another runner was loaded for the replica in the meantime, which
+		// the request uses once it's back on the queue
+		delete(s.placing, req.model.ModelPath)
+		s.loadedMu.Unlock()
+		runner.refMu.Unlock()
+		slog.Debug("model was loaded while placing it on a remote server", "model", req.model.ModelPath, "host", remote.host)
+		s.queues.requeue(req)
+		return
+	}
+	s.loaded[runner.key()] = runner
+	s.loadedMu.Unlock()
+	s.version.Add(1)
+	req.runner = runner
+
+	go func() {
+		defer runner.refMu.Unlock()
+		if err := remote.WaitUntilRunning(req.ctx); err != nil {
+			runner.loadingStatus.Store(nil)
+			s.loadedMu.Lock()
+			if s.loaded[runner.key()] == runner {
+				delete(s.loaded, runner.key())
+			}
+			delete(s.placing, req.model.ModelPath)
+			s.loadedMu.Unlock()
+			s.version.Add(1)
+
+			if req.ctx.Err() != nil {
+				req.errCh <- err
+				return
+			}
+
+			slog.Warn("remote server failed to load model, falling back to local placement", "model", req.model.ShortName, "host", remote.host, "error", err)
+			req.remoteFailed = true
+			s.queues.requeue(req)
+			return
+		}
+
+		slog.Debug("finished setting up remote runner", "model", req.model.ModelPath, "host", remote.host)
+		runner.finishLoading()
+		runner.estimatedVRAM = remote.EstimatedVRAM()
+		runner.estimatedTotal = remote.EstimatedTotal()
+		s.placed(req)
+		s.version.Add(1)
+		go func() {
+			<-req.ctx.Done()
+			slog.Debug("context for request finished")
+			s.finishedReqCh <- req
+		}()
+		req.successCh <- runner
+	}()
+}
+
+// proxyRemote relays the responses of a request forwarded to a remote server,
+// including the remote's metrics, as either a stream or a single response
+func proxyRemote[T any](c *gin.Context, stream *bool, call func(fn func(T) error) error) {
+	if stream != nil && !*stream {
+		var resp T
+		if err := call(func(r T) error {
+			resp = r
+			return nil
+		}); err != nil {
+			handleRemoteError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		if err := call(func(r T) error {
+			ch <- r
+			return nil
+		}); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	streamResponse(c, ch)
+}
+
+func handleRemoteError(c *gin.Context, err error) {
+	var serr api.StatusError
+	if errors.As(err, &serr) {
+		c.JSON(serr.StatusCode, gin.H{"error": serr.ErrorMessage})
+		return
+	}
+
+	c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// fakeRemote is an Ollama server that lists models and serves canned
+// responses for them
+type fakeRemote struct {
+	*httptest.Server
+
+	models     []string
+	loadStatus int
+
+	// listing, if set, holds model listings until it's closed
+	listing chan struct{}
+
+	mu     sync.Mutex
+	listed int
+	served []string // model names requested for inference
+}
+
+func newFakeRemote(t *testing.T, models ...string) *fakeRemote {
+	t.Helper()
+
+	f := &fakeRemote{models: models, loadStatus: http.StatusOK}
+	mux := http.NewServeMux()
+	mux.HandleFunc("HEAD /{$}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /api/tags", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.listed++
+		f.mu.Unlock()
+
+		if f.listing != nil {
+			select {
+			case <-f.listing:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		var resp api.ListResponse
+		for _, m := range f.models {
+			resp.Models = append(resp.Models, api.ListModelResponse{Name: m, Model: m})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("GET /api/ps", func(w http.ResponseWriter, r *http.Request) {
+		var resp api.ProcessResponse
+		for _, m := range f.models {
+			resp.Models = append(resp.Models, api.ProcessModelResponse{Name: m, Model: m, Size: 100, SizeVRAM: 100, Runner: "cuda_v12"})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("POST /api/generate", func(w http.ResponseWriter, r *http.Request) {
+		var req api.GenerateRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.Prompt == "" {
+			if f.loadStatus != http.StatusOK {
+				w.WriteHeader(f.loadStatus)
+				json.NewEncoder(w).Encode(gin.H{"error": "remote failed to load"})
+				return
+			}
+			json.NewEncoder(w).Encode(api.GenerateResponse{Model: req.Model, Done: true, DoneReason: "load"})
+			return
+		}
+
+		f.serve(req.Model)
+		if req.Stream != nil && !*req.Stream {
+			json.NewEncoder(w).Encode(api.GenerateResponse{Model: req.Model, Response: "Hello world", Done: true, Metrics: api.Metrics{EvalCount: 7}})
+			return
+		}
+		json.NewEncoder(w).Encode(api.GenerateResponse{Model: req.Model, Response: "Hello "})
+		json.NewEncoder(w).Encode(api.GenerateResponse{Model: req.Model, Response: "world", Done: true, Metrics: api.Metrics{EvalCount: 7}})
+	})
+	mux.HandleFunc("POST /api/chat", func(w http.ResponseWriter, r *http.Request) {
+		var req api.ChatRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		f.serve(req.Model)
+		json.NewEncoder(w).Encode(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "Hello world"}, Done: true, Metrics: api.Metrics{EvalCount: 7}})
+	})
+	mux.HandleFunc("POST /api/embed", func(w http.ResponseWriter, r *http.Request) {
+		var req api.EmbedRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		f.serve(req.Model)
+		json.NewEncoder(w).Encode(api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{{0.6, 0.8}}, PromptEvalCount: 3})
+	})
+
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRemote) serve(model string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.served = append(f.served, model)
+}
+
+func (f *fakeRemote) host(t *testing.T) *url.URL {
+	t.Helper()
+	u, err := url.Parse(f.URL)
+	require.NoError(t, err)
+	return u
+}
+
+func TestRemoteServers(t *testing.T) {
+	a, _ := url.Parse("http://a:11434")
+	b, _ := url.Parse("http://b:11434")
+
+	r := newRemoteServers([]*url.URL{a})
+	require.True(t, r.add(b))
+	require.False(t, r.add(b))
+	require.Equal(t, []*url.URL{a, b}, r.list())
+
+	require.True(t, r.remove(a))
+	require.False(t, r.remove(a))
+	require.Equal(t, []*url.URL{b}, r.list())
+
+	var none *remoteServers
+	require.Empty(t, none.list())
+}
+
+func TestRemotePlacement(t *testing.T) {
+	tinyGPU := func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = format.KiloByte
+		g.FreeMemory = format.KiloByte
+		return []gpu.GpuInfo{g}
+	}
+
+	cases := []struct {
+		name       string
+		gpus       func() gpu.GpuInfoList
+		models     []string
+		loadStatus int
+		remote     bool
+		listed     bool
+	}{
+		{"does not fit locally", tinyGPU, []string{"other:latest", "big:latest"}, http.StatusOK, true, true},
+		{"fits locally", getGpuFn, []string{"big:latest"}, http.StatusOK, false, false},
+		{"not on remote", tinyGPU, []string{"other:latest"}, http.StatusOK, false, true},
+		{"remote fails to load", tinyGPU, []string{"big:latest"}, http.StatusInternalServerError, false, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+			defer done()
+
+			remote := newFakeRemote(t, tt.models...)
+			remote.loadStatus = tt.loadStatus
+
+			a := newScenarioRequest(t, ctx, "ollama-model-big", 10, nil)
+			a.req.model.ShortName = "big:latest"
+
+			s := InitScheduler(ctx)
+			s.reschedDelay = 5 * time.Millisecond
+			s.remotes = newRemoteServers([]*url.URL{remote.host(t)})
+			s.getGpuFn = tt.gpus
+			s.getCpuFn = getCpuFn
+			s.loadFn = func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{llama: a.srv, model: req.model, modelPath: req.model.ModelPath}
+			}
+			s.Run(ctx)
+
+			successCh, errCh := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration)
+			var runner *runnerRef
+			select {
+			case runner = <-successCh:
+			case err := <-errCh:
+				t.Fatal(err)
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+
+			remote.mu.Lock()
+			require.Equal(t, tt.listed, remote.listed > 0)
+			remote.mu.Unlock()
+
+			if !tt.remote {
+				require.Nil(t, runner.remote)
+				require.Equal(t, a.srv, runner.llama)
+				return
+			}
+
+			require.NotNil(t, runner.remote)
+			require.Equal(t, "big:latest", runner.remote.model)
+			require.Equal(t, uint64(100), runner.estimatedTotal)
+
+			srv := Server{sched: s}
+			w := createRequest(t, srv.PsHandler, nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			var ps api.ProcessResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&ps))
+			require.Len(t, ps.Models, 1)
+			require.Equal(t, "remote", ps.Models[0].Location)
+			require.Equal(t, remote.URL, ps.Models[0].Host)
+			require.Equal(t, "cuda_v12", ps.Models[0].Runner)
+		})
+	}
+}
+
+func TestRemotePlacementDoesNotBlock(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+
+	remote := newFakeRemote(t, "big:latest")
+	remote.listing = make(chan struct{})
+
+	big := newScenarioRequest(t, ctx, "ollama-model-big", 10, nil)
+	big.req.model.ShortName = "big:latest"
+	small := newScenarioRequest(t, ctx, "ollama-model-small", 10, nil)
+	small.req.opts.NumGPU = 0
+
+	s := InitScheduler(ctx)
+	s.remotes = newRemoteServers([]*url.URL{remote.host(t)})
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = format.KiloByte
+		g.FreeMemory = format.KiloByte
+		return []gpu.GpuInfo{g}
+	}
+	s.getCpuFn = getCpuFn
+	s.loadFn = func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+		req.successCh <- &runnerRef{llama: small.srv, model: req.model, modelPath: req.model.ModelPath}
+	}
+	s.Run(ctx)
+
+	bigCh, bigErrCh := s.GetRunner(big.ctx, big.req.model, big.req.opts, big.req.sessionDuration)
+	require.Eventually(t, func() bool {
+		remote.mu.Lock()
+		defer remote.mu.Unlock()
+		return remote.listed > 0
+	}, time.Second, time.Millisecond)
+
+	// the small model is loaded locally while the remote is still listing
+	smallCh, smallErrCh := s.GetRunner(small.ctx, small.req.model, small.req.opts, small.req.sessionDuration)
+	select {
+	case runner := <-smallCh:
+		require.Nil(t, runner.remote)
+	case err := <-smallErrCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for the small model behind a slow remote")
+	}
+
+	close(remote.listing)
+	select {
+	case runner := <-bigCh:
+		require.NotNil(t, runner.remote)
+	case err := <-bigErrCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestRemotePlacementConcurrent(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+
+	remote := newFakeRemote(t, "big:latest")
+	remote.listing = make(chan struct{})
+
+	a := newScenarioRequest(t, ctx, "ollama-model-big", 10, nil)
+	a.req.model.ShortName = "big:latest"
+	b := newScenarioRequest(t, ctx, "ollama-model-big", 10, nil)
+	b.req.model = a.req.model
+
+	s := InitScheduler(ctx)
+	s.reschedDelay = 5 * time.Millisecond
+	s.remotes = newRemoteServers([]*url.URL{remote.host(t)})
+	s.getGpuFn = func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "metal"}
+		g.TotalMemory = format.KiloByte
+		g.FreeMemory = format.KiloByte
+		return []gpu.GpuInfo{g}
+	}
+	s.getCpuFn = getCpuFn
+	s.loadFn = func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+		t.Error("model shouldn't be loaded locally")
+	}
+	s.Run(ctx)
+
+	aCh, aErrCh := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration)
+	require.Eventually(t, func() bool {
+		remote.mu.Lock()
+		defer remote.mu.Unlock()
+		return remote.listed > 0
+	}, time.Second, time.Millisecond)
+
+	// the second request waits for the first placement rather than
+	// starting its own
+	bCh, bErrCh := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration)
+	time.Sleep(20 * time.Millisecond)
+	close(remote.listing)
+
+	var runners []*runnerRef
+	for _, ch := range []struct {
+		success chan *runnerRef
+		err     chan error
+	}{{aCh, aErrCh}, {bCh, bErrCh}} {
+		select {
+		case runner := <-ch.success:
+			require.NotNil(t, runner.remote)
+			runners = append(runners, runner)
+		case err := <-ch.err:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	require.Same(t, runners[0], runners[1])
+
+	remote.mu.Lock()
+	require.Equal(t, 1, remote.listed)
+	remote.mu.Unlock()
+
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	require.Empty(t, s.placing)
+	s.loadedMu.Unlock()
+}
+
+func TestRemoteProxy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	remote := newFakeRemote(t, "big:latest")
+	runner := newRemoteRunner(remote.host(t), "big:latest", nil)
+
+	s := Server{
+		sched: &Scheduler{
+			queues:        newRequestQueues(1, 0),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{llama: runner, remote: runner}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	t.Run("generate", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resps []api.GenerateResponse
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			var resp api.GenerateResponse
+			require.NoError(t, json.Unmarshal([]byte(line), &resp))
+			resps = append(resps, resp)
+		}
+		require.Len(t, resps, 2)
+		require.Equal(t, "test", resps[1].Model)
+		require.Equal(t, "world", resps[1].Response)
+		require.Equal(t, 7, resps[1].EvalCount)
+	})
+
+	t.Run("generate without streaming", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp api.GenerateResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, "test", resp.Model)
+		require.Equal(t, "Hello world", resp.Response)
+		require.Equal(t, 7, resp.EvalCount)
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp api.ChatResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, "test", resp.Model)
+		require.Equal(t, "Hello world", resp.Message.Content)
+		require.Equal(t, 7, resp.EvalCount)
+	})
+
+	t.Run("embed", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model: "test",
+			Input: "Hello!",
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp api.EmbedResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, "test", resp.Model)
+		require.Equal(t, [][]float32{{0.6, 0.8}}, resp.Embeddings)
+		require.Equal(t, 3, resp.PromptEvalCount)
+	})
+
+	remote.mu.Lock()
+	require.Equal(t, []string{"big:latest", "big:latest", "big:latest", "big:latest"}, remote.served)
+	remote.mu.Unlock()
+}
+
+func TestRemotesHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := Server{sched: &Scheduler{remotes: newRemoteServers(nil)}}
+
+	w := createRequest(t, s.AddRemoteHandler, api.RemoteRequest{Host: "gpubox"})
+	require.Equal(t, http.StatusOK, w.Code)
+	w = createRequest(t, s.AddRemoteHandler, api.RemoteRequest{Host: "http://gpubox:11434"})
+	require.Equal(t, http.StatusConflict, w.Code)
+	w = createRequest(t, s.AddRemoteHandler, api.RemoteRequest{})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = createRequest(t, s.ListRemotesHandler, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list api.ListRemotesResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Equal(t, []api.RemoteResponse{{Host: "http://gpubox:11434"}}, list.Remotes)
+
+	w = createRequest(t, s.DeleteRemoteHandler, api.RemoteRequest{Host: "gpubox:11434"})
+	require.Equal(t, http.StatusOK, w.Code)
+	w = createRequest(t, s.DeleteRemoteHandler, api.RemoteRequest{Host: "gpubox"})
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Empty(t, s.sched.remotes.list())
+}
@@ -4,37 +4,46 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/sync/errgroup"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/ollama/ollama/anthropic"
 	"github.com/ollama/ollama/api"
-	"github.com/ollama/ollama/build"
 	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/runners"
 	"github.com/ollama/ollama/template"
-	"github.com/ollama/ollama/types/errtypes"
+	"github.com/ollama/ollama/tracing"
 	"github.com/ollama/ollama/types/model"
 	"github.com/ollama/ollama/version"
 )
@@ -42,8 +51,69 @@ import (
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
 	sched *Scheduler
+
+	// keys are the API keys from OLLAMA_API_KEYS, or nil if requests aren't
+	// authenticated
+	keys map[string]*apiKey
+
+	// allowedUIDs are the users allowed to connect over a unix socket, from
+	// OLLAMA_SOCKET_ALLOWED_UIDS, or nil if any user may
+	allowedUIDs []uint32
+
+	// presets are the presets from OLLAMA_PRESETS, by name
+	presets map[string]api.Preset
+
+	// aliases are the model aliases from OLLAMA_ALIASES and the aliases API
+	aliases aliasSet
+
+	// streams buffers streamed responses for clients slower than the model,
+	// or is nil if OLLAMA_STREAM_BUFFER_SIZE is zero
+	streams *streamBuffers
+
+	// generations buffers streamed generations for other clients to follow,
+	// or is nil if OLLAMA_GENERATION_BUFFER_SIZE is zero
+	generations *generationStore
+
+	// usage counts the usage of each model since the server started, or is
+	// nil if it isn't counted
+	usage *usageStats
+
+	// sessions keeps the history of chat sessions, or is nil if
+	// OLLAMA_MAX_SESSIONS is zero
+	sessions *sessionStore
+
+	// uploads are the partial uploads of blobs sent in ranges
+	uploads incomingBlobs
+
+	// owners are the namespaces that uploaded each blob
+	owners blobOwners
+
+	// ctx is cancelled when the server is shut down, stopping its scheduler
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// initRunners prepares the runners models are loaded with
+	initRunners     func() error
+	shutdownTracing func(context.Context) error
+
+	handler     http.Handler
+	handlerOnce sync.Once
+
+	// root serves requests instead of handler if it's set, as for ollama
+	// serve, which serves the profiler too
+	root http.Handler
+
+	mu sync.Mutex
+	// addr is the address the server listens on, if it's serving
+	addr       net.Addr
+	httpServer *http.Server
+}
+
+func (s *Server) listenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
 }
 
 func init() {
@@ -61,10 +131,25 @@ func init() {
 var (
 	errRequired    = errors.New("is required")
 	errBadTemplate = errors.New("template error")
+	errBadPooling  = errors.New("invalid pooling_type")
 )
 
-func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
+// modelOptions merges the options of a request for model with, in order of
+// precedence, the model's parameters, those of the request's preset, the
+// server's defaults and the built in defaults
+func modelOptions(model *Model, presetOpts, requestOpts map[string]interface{}) (api.Options, error) {
 	opts := api.DefaultOptions()
+	if mlock := envconfig.UseMLock(); mlock != nil {
+		opts.UseMLock = *mlock
+	}
+	if err := opts.FromMap(serverOptions()); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := opts.FromMap(presetOpts); err != nil {
+		return api.Options{}, err
+	}
+
 	if err := opts.FromMap(model.Options); err != nil {
 		return api.Options{}, err
 	}
@@ -73,45 +158,252 @@ func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options
 		return api.Options{}, err
 	}
 
+	// Requests and Modelfiles take precedence over the environment defaults
+	if opts.UseMMap == nil {
+		opts.UseMMap = envconfig.UseMMap()
+	}
+
+	if err := checkPoolingType(opts.PoolingType); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := llm.CheckStopRegex(opts.StopRegex); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := llm.CheckContextOptions(opts.Runner); err != nil {
+		return api.Options{}, err
+	}
+
 	return opts, nil
 }
 
+func checkPoolingType(t string) error {
+	if t != "" && !slices.Contains(api.PoolingTypes, t) {
+		return fmt.Errorf("%w '%s', expected one of %s", errBadPooling, t, strings.Join(api.PoolingTypes, ", "))
+	}
+
+	return nil
+}
+
+// effectivePooling returns the pooling type a model is loaded with, which is
+// the pooling_type option if set and otherwise the model's metadata
+func effectivePooling(override string, kv llm.KV) string {
+	return cmp.Or(override, kv.PoolingType())
+}
+
+// embedsPerToken reports whether a request for name would be loaded with
+// pooling_type none, so /api/embed can reject it before scheduling a runner.
+// Models that can't be looked up are left for scheduling to report.
+func (s *Server) embedsPerToken(ctx context.Context, name string, requestOpts map[string]any) bool {
+	name, err := s.resolveAlias(ctx, name, nil, nil, requestOpts)
+	if err != nil {
+		return false
+	}
+
+	m, err := getNamespacedModel(ctx, name)
+	if err != nil {
+		return false
+	}
+
+	opts, err := modelOptions(m, nil, requestOpts)
+	if err != nil {
+		return false
+	}
+
+	kvData, err := getKVData(m.ModelPath, false)
+	if err != nil {
+		return false
+	}
+
+	return effectivePooling(opts.PoolingType, kvData) == "none"
+}
+
+// checkChoices validates the number of choices requested with n. More than
+// one choice is only supported when streaming, where responses from each
+// choice are interleaved and identified by their index.
+func checkChoices(n int, stream *bool) error {
+	switch {
+	case n < 0:
+		return errors.New("n must not be negative")
+	case n > int(envconfig.MaxChoices()):
+		return fmt.Errorf("n must be at most %d", envconfig.MaxChoices())
+	case n > 1 && stream != nil && !*stream:
+		return errors.New("n greater than 1 requires streaming")
+	}
+
+	return nil
+}
+
+// choiceOptions returns the options used to generate choice i. A fixed seed
+// is offset by the choice index so each choice samples differently while the
+// first choice matches a request made without n.
+func choiceOptions(opts *api.Options, i int) *api.Options {
+	if i == 0 || opts.Seed < 0 {
+		return opts
+	}
+
+	o := *opts
+	o.Seed += i
+	return &o
+}
+
+// fixSeed replaces a random seed with a seed chosen here, so the options
+// returned with a response reproduce it
+func fixSeed(opts *api.Options) {
+	if opts.Seed < 0 {
+		opts.Seed = rand.IntN(math.MaxInt32)
+	}
+}
+
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
+// Aliases are resolved to the model they place, which is the model returned.
 // It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+// If progressFn is set, it's called periodically with the load progress while
+// the model is loading.
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, presetOpts, requestOpts map[string]any, keepAlive *api.Duration, promptTokens int, progressFn func(float32)) (llm.LlamaServer, *Model, *api.Options, error) {
+	runner, model, opts, err := s.scheduleRunnerRef(ctx, name, caps, presetOpts, requestOpts, keepAlive, promptTokens, progressFn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return runner.llama, model, opts, nil
+}
+
+// scheduleRunnerRef is like scheduleRunner but returns the scheduler's
+// reference to the runner, for handlers that need to know how it was loaded.
+// Errors after the model is resolved are returned with the model, so
+// handlers can count them against it.
+func (s *Server) scheduleRunnerRef(ctx context.Context, name string, caps []model.Capability, presetOpts, requestOpts map[string]any, keepAlive *api.Duration, promptTokens int, progressFn func(float32)) (*runnerRef, *Model, *api.Options, error) {
 	if name == "" {
 		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
 
-	model, err := GetModel(name)
+	name, err := s.resolveAlias(ctx, name, caps, presetOpts, requestOpts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	model, err := getNamespacedModel(ctx, name)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
+	if err := checkModelLicense(model); err != nil {
+		return nil, model, nil, err
+	}
+
 	if err := model.CheckCapabilities(caps...); err != nil {
-		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
+		return nil, model, nil, fmt.Errorf("%s %w", name, err)
 	}
 
-	opts, err := modelOptions(model, requestOpts)
+	opts, err := modelOptions(model, presetOpts, requestOpts)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, model, nil, err
+	}
+
+	if len(opts.GPUs) > 0 {
+		if opts.GPUs, err = selectGPUs(s.sched.getGpuFn(), opts.GPUs); err != nil {
+			return nil, model, nil, err
+		}
+	}
+
+	variant, err := s.sched.selectVariant(model, opts)
+	if err != nil {
+		return nil, model, nil, err
+	}
+	model = variant
+
+	if err := s.sched.admit(model, promptTokens); err != nil {
+		return nil, model, nil, err
+	}
+
+	var progressCh <-chan time.Time
+	if progressFn != nil {
+		ticker := time.NewTicker(loadStatusInterval)
+		defer ticker.Stop()
+		progressCh = ticker.C
+	}
+
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.SetAttributes(attribute.String("model", name))
+	}
+
+	// the wait for a runner, including any load, is traced separately from
+	// the completion
+	ctx, span := tracing.Start(ctx, "scheduler.queue")
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("model", name))
 	}
 
 	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
-	var runner *runnerRef
-	select {
-	case runner = <-runnerCh:
-	case err = <-errCh:
-		return nil, nil, nil, err
+	for {
+		select {
+		case runner := <-runnerCh:
+			if opts.NumCtx == 0 {
+				opts.NumCtx = runner.numCtx()
+			}
+			return runner, model, &opts, nil
+		case err = <-errCh:
+			span.SetStatus(codes.Error, err.Error())
+			return nil, model, nil, err
+		case <-progressCh:
+			if progress, ok := s.sched.loadProgress(model.ModelPath); ok {
+				progressFn(progress)
+			}
+		}
+	}
+}
+
+// loadStatusInterval is how often streamed generate and chat requests report
+// the progress of loading the model before the response starts
+const loadStatusInterval = 500 * time.Millisecond
+
+type routeContextKey struct{}
+
+// routeMiddleware adds the route of each request to its context, so the
+// scheduler can report which requests keep models loaded
+func routeMiddleware(c *gin.Context) {
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), routeContextKey{}, c.FullPath()))
+	c.Next()
+}
+
+// requestRoute returns the route added to ctx by routeMiddleware, or "" if
+// it isn't a request's context
+func requestRoute(ctx context.Context) string {
+	route, _ := ctx.Value(routeContextKey{}).(string)
+	return route
+}
+
+// streamLoadStatus returns a progressFn for scheduleRunner that streams the
+// load progress as status objects built by fn, or nil if the request isn't
+// streamed. Status objects are only part of the native API, so requests
+// translated by the compatibility endpoints don't receive them.
+func streamLoadStatus(c *gin.Context, stream *bool, fn func(status string) any) func(float32) {
+	if stream != nil && !*stream || !strings.HasPrefix(c.FullPath(), "/api/") {
+		return nil
 	}
 
-	return runner.llama, model, &opts, nil
+	return func(progress float32) {
+		bts, err := json.Marshal(fn(fmt.Sprintf("loading model: %d%%", int(progress*100))))
+		if err != nil {
+			return
+		}
+
+		c.Header("Content-Type", "application/x-ndjson")
+		if _, err := c.Writer.Write(append(bts, '\n')); err != nil {
+			slog.Info("unable to write load status", "error", err)
+			return
+		}
+		c.Writer.Flush()
+	}
 }
 
 func (s *Server) GenerateHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 	var req api.GenerateRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+	if err := bindJSON(c, &req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
@@ -121,26 +413,26 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 	// expire the runner
 	if req.Prompt == "" && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
-		model, err := GetModel(req.Model)
+		m, err := getNamespacedModel(c.Request.Context(), req.Model)
 		if err != nil {
 			switch {
 			case os.IsNotExist(err):
 				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
-			case err.Error() == "invalid model name":
+			case errors.Is(err, model.ErrInvalidName):
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			default:
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			}
 			return
 		}
-		s.sched.expireRunner(model)
+		s.sched.expireRunner(m)
 
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
 			Response:   "",
 			Done:       true,
-			DoneReason: "unload",
+			DoneReason: api.DoneReasonUnload,
 		})
 		return
 	}
@@ -151,42 +443,147 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	} else if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
 		return
+	} else if err := checkRawTokens(req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkChoices(req.N, req.Stream); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkReasoning(req.Reasoning); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkJSONStrict(req.JSONStrict, req.Format, req.JSONRetries); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preset, ok := s.preset(c, req.Preset)
+	if !ok {
+		return
 	}
 
-	caps := []Capability{CapabilityCompletion}
+	caps := []model.Capability{model.CapabilityCompletion}
 	if req.Suffix != "" {
-		caps = append(caps, CapabilityInsert)
+		caps = append(caps, model.CapabilityInsert)
+	}
+
+	if len(req.Images) > 0 {
+		caps = append(caps, model.CapabilityVision)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	// the generation can be followed by other clients, and keeps running
+	// while they are after this one leaves
+	gen := s.generations.start(c, req.Stream, mergeGenerate)
+	defer s.generations.abandon(gen)
+
+	// the runner is released as soon as the generation finishes, rather than
+	// once its responses have been written to a slow client
+	ctx, release := context.WithCancel(gen.context(c.Request.Context()))
+	defer release()
+
+	progressFn := streamLoadStatus(c, req.Stream, func(status string) any {
+		return api.GenerateResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Status: status, GenerationID: gen.ID()}
+	})
+	ref, m, opts, err := s.scheduleRunnerRef(ctx, req.Model, caps, presetOptions(preset), req.Options, req.KeepAlive, estimateTokens(req.System, req.Prompt, req.Suffix), progressFn)
+	// usage is counted whether or not a runner was scheduled, so requests
+	// that fail to load the model or whose client leaves while they're
+	// queued are counted too
+	usage := s.usage.begin(c.Request.Context(), req.Model, m)
+	defer usage.end(c)
+
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		c.JSON(http.StatusBadRequest, capabilityErrorResponse(fmt.Sprintf("%q does not support generate", req.Model), err))
 		return
 	} else if err != nil {
+		usage.fail(c.Request.Context(), err)
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	r, placementWarning := ref.llama, ref.placementWarning(opts)
+
+	if req.Raw {
+		if err := rawOptions(opts, m, presetOptions(preset), req.Options); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var sources map[string]string
+	if req.ReturnOptions {
+		fixSeed(opts)
+		sources = optionSources(opts, m, presetOptions(preset), req.Options)
+	}
+
+	c.Set(openai.ModelDigestKey, m.Digest)
+	resolved := s.resolvedModel(req.Model, m)
+
 	checkpointLoaded := time.Now()
 
 	if req.Prompt == "" {
 		c.JSON(http.StatusOK, api.GenerateResponse{
-			Model:      req.Model,
-			CreatedAt:  time.Now().UTC(),
-			Done:       true,
-			DoneReason: "load",
+			Model:         req.Model,
+			ResolvedModel: resolved,
+			CreatedAt:     time.Now().UTC(),
+			Done:          true,
+			DoneReason:    api.DoneReasonLoad,
+		})
+		return
+	}
+
+	if remote, ok := r.(*remoteRunner); ok {
+		name := req.Model
+		req.Model = remote.model
+		if preset != nil {
+			req.Preset = ""
+			req.Options = remotePresetOptions(preset, m, req.Options)
+			// the remote uses the model's SYSTEM itself
+			if !req.Raw && req.System == "" && m.System == "" {
+				req.System = presetSystem(preset, "")
+			}
+		}
+
+		done := usage.hold()
+		proxyRemote(c, req.Stream, func(fn func(api.GenerateResponse) error) error {
+			defer done()
+			err := remote.client.Generate(c.Request.Context(), &req, func(r api.GenerateResponse) error {
+				if r.Done {
+					usage.add(r.Metrics)
+				}
+
+				r.Model, r.ResolvedModel = name, resolved
+				return fn(r)
+			})
+			usage.fail(c.Request.Context(), err)
+			return err
 		})
 		return
 	}
 
 	images := make([]llm.ImageData, len(req.Images))
+	projector := m.visionProjector()
 	for i := range req.Images {
 		images[i] = llm.ImageData{ID: i, Data: req.Images[i]}
+		if projector != nil {
+			images[i].Data, images[i].Tokens = projector.prepare(req.Images[i], downscaleImages(opts))
+		}
+	}
+
+	if err := checkImageTokens(images, opts.NumCtx); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Raw {
+		if err := checkRawImages(req.Prompt, len(images)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
 	prompt := req.Prompt
+	tmpl := m.Template
 	if !req.Raw {
-		tmpl := m.Template
 		if req.Template != "" {
 			tmpl, err = template.Parse(req.Template)
 			if err != nil {
@@ -203,8 +600,8 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			var msgs []api.Message
 			if req.System != "" {
 				msgs = append(msgs, api.Message{Role: "system", Content: req.System})
-			} else if m.System != "" {
-				msgs = append(msgs, api.Message{Role: "system", Content: m.System})
+			} else if system := presetSystem(preset, m.System); system != "" {
+				msgs = append(msgs, api.Message{Role: "system", Content: system})
 			}
 
 			if req.Context == nil {
@@ -238,64 +635,123 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 	slog.Debug("generate request", "prompt", prompt, "images", images)
 
+	id := requestID(c)
 	ch := make(chan any)
+	done := usage.hold()
 	go func() {
-		// TODO (jmorganca): avoid building the response twice both here and below
-		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(cr llm.CompletionResponse) {
-			res := api.GenerateResponse{
-				Model:      req.Model,
-				CreatedAt:  time.Now().UTC(),
-				Response:   cr.Content,
-				Done:       cr.Done,
-				DoneReason: cr.DoneReason,
-				Metrics: api.Metrics{
-					PromptEvalCount:    cr.PromptEvalCount,
-					PromptEvalDuration: cr.PromptEvalDuration,
-					EvalCount:          cr.EvalCount,
-					EvalDuration:       cr.EvalDuration,
-				},
-			}
+		defer release()
+		defer done()
+		var wg sync.WaitGroup
+		for i := range max(req.N, 1) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// TODO (jmorganca): avoid building the response twice both here and below
+				var sb strings.Builder
+				choiceOpts := choiceOptions(opts, i)
+				parser := reasoningParser(req.Reasoning, tmpl, prompt)
+				complete, strict := completionFunc(traceCompletion), (*api.JSONStrictResult)(nil)
+				if req.JSONStrict != "" {
+					strict = &api.JSONStrictResult{}
+					complete = jsonStrictCompletion(req.JSONStrict, req.JSONRetries, max(req.N, 1), strict)
+				}
+				complete = usage.completion(complete)
+
+				if err := complete(ctx, r, llm.CompletionRequest{
+					ID:      id,
+					Prompt:  prompt,
+					Images:  images,
+					Format:  req.Format,
+					Options: choiceOpts,
+					AddBOS:  req.AddBOS,
+					AddEOS:  req.AddEOS != nil && *req.AddEOS,
+					MaxTime: maxTime(req.MaxTime),
+				}, func(cr llm.CompletionResponse) {
+					// the context includes the thinking, however it's returned
+					if _, err := sb.WriteString(cr.Content); err != nil {
+						ch <- gin.H{"error": err.Error()}
+					}
 
-			if _, err := sb.WriteString(cr.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
-			}
+					content, thinking := cr.Content, ""
+					if parser != nil {
+						thinking, content = parser.next(cr.Content, cr.Done, req.Reasoning)
+						if !cr.Done && thinking == "" && content == "" {
+							return
+						}
+					}
 
-			if cr.Done {
-				res.TotalDuration = time.Since(checkpointStart)
-				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+					res := api.GenerateResponse{
+						Model:         req.Model,
+						ResolvedModel: resolved,
+						CreatedAt:     time.Now().UTC(),
+						Response:      content,
+						Thinking:      thinking,
+						Done:          cr.Done,
+						DoneReason:    cr.DoneReason,
+						StopString:    cr.StopString,
+						Index:         i,
+						Metrics: api.Metrics{
+							PromptEvalCount:    cr.PromptEvalCount,
+							PromptEvalDuration: cr.PromptEvalDuration,
+							EvalCount:          cr.EvalCount,
+							EvalDuration:       cr.EvalDuration,
+							Variant:            m.Variant,
+							NumCtx:             opts.NumCtx,
+							PromptCacheHit:     promptCacheHit(cr),
+							PromptCacheTokens:  cr.PromptCacheTokens,
+						},
+					}
 
-				if !req.Raw {
-					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
-					if err != nil {
-						ch <- gin.H{"error": err.Error()}
-						return
+					if cr.Done {
+						s.sched.admission.observe(m.ModelPath, cr)
+						s.sched.promptCache.observe(m.ModelPath, cr)
+						res.PlacementWarning = placementWarning
+						res.TotalDuration = time.Since(checkpointStart)
+						res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+						res.ImageTokens = imageTokens(images)
+						res.JSONStrict = strict
+						if req.ReturnOptions {
+							res.Options = choiceOpts.Map()
+							res.OptionSources = sources
+						}
+
+						if req.Raw {
+							res.PromptTokens = cr.PromptTokens
+						} else {
+							tokens, err := r.Tokenize(ctx, prompt+sb.String())
+							if err != nil {
+								ch <- gin.H{"error": err.Error()}
+								return
+							}
+							res.Context = tokens
+						}
 					}
-					res.Context = tokens
-				}
-			}
 
-			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+					ch <- res
+				}); err != nil {
+					ch <- completionError(err)
+				}
+			}()
 		}
+		wg.Wait()
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
-		var sb strings.Builder
+		var sb, tb strings.Builder
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(t.Response)
+				tb.WriteString(t.Thinking)
 				r = t
 			case gin.H:
+				if t["code"] == invalidJSONCode {
+					c.JSON(http.StatusUnprocessableEntity, t)
+					return
+				}
+
 				msg, ok := t["error"].(string)
 				if !ok {
 					msg = "unexpected error format in response"
@@ -310,11 +766,13 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		r.Response = sb.String()
+		r.Thinking = tb.String()
 		c.JSON(http.StatusOK, r)
 		return
 	}
 
-	streamResponse(c, ch)
+	err = streamCoalesced(c, s.streams.buffer(c.Request.Context(), s.generations.tee(gen, c, ch)), streamFlushInterval(req.FlushInterval), int(envconfig.StreamFlushTokens()))
+	s.streams.abort(m.ModelPath, err)
 }
 
 func (s *Server) EmbedHandler(c *gin.Context) {
@@ -330,10 +788,18 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
-	truncate := true
+	truncate := req.TruncateModeOrDefault()
 
-	if req.Truncate != nil && !*req.Truncate {
-		truncate = false
+	if req.Concurrency < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "concurrency must be positive"})
+		return
+	}
+
+	switch req.EncodingFormat {
+	case "", "float", "base64", "int8":
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid encoding_format '%s', expected one of float, base64 or int8", req.EncodingFormat)})
+		return
 	}
 
 	var input []string
@@ -358,16 +824,45 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		}
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	// expire the runner
+	if len(input) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+		model, err := getNamespacedModel(c.Request.Context(), req.Model)
+		if err != nil {
+			handleScheduleError(c, req.Model, err)
+			return
+		}
+		s.sched.expireRunner(model)
+
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
+		return
+	}
+
+	if s.embedsPerToken(c.Request.Context(), req.Model, req.Options) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pooling_type 'none' produces an embedding per token, which isn't supported by /api/embed; use mean, cls or last"})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunnerRef(c.Request.Context(), req.Model, []model.Capability{}, nil, req.Options, req.KeepAlive, estimateTokens(input...), nil)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	resolved := s.resolvedModel(req.Model, m)
+
 	checkpointLoaded := time.Now()
 
-	if len(input) == 0 {
-		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
+	if r.remote != nil {
+		name := req.Model
+		req.Model = r.remote.model
+		resp, err := r.remote.client.Embed(c.Request.Context(), &req)
+		if err != nil {
+			handleRemoteError(c, err)
+			return
+		}
+
+		resp.Model, resp.ResolvedModel = name, resolved
+		c.JSON(http.StatusOK, resp)
 		return
 	}
 
@@ -377,68 +872,176 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	maxDimensions := int(kvData.EmbeddingLength())
+	switch {
+	case req.Dimensions < 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dimensions must be positive"})
+		return
+	case maxDimensions > 0 && req.Dimensions > maxDimensions:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("dimensions must be between 1 and %d for model '%s'", maxDimensions, req.Model)})
+		return
+	}
+
+	renormalize := true
+	if req.Normalize != nil {
+		renormalize = *req.Normalize
+	}
+
+	if len(input) == 0 {
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, ResolvedModel: resolved, Embeddings: [][]float32{}})
+		return
+	}
+
+	ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+	counts := make([]int, len(input))
+	truncated := make([]bool, len(input))
 	var count int
+	var exceeded []string
 	for i, s := range input {
-		tokens, err := r.Tokenize(c.Request.Context(), s)
+		tokens, err := r.llama.Tokenize(c.Request.Context(), s)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
 		if len(tokens) > ctxLen {
-			if !truncate {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
-				return
+			switch truncate {
+			case api.TruncateNone:
+				exceeded = append(exceeded, strconv.Itoa(i))
+				continue
+			case api.TruncateStart:
+				tokens = tokens[len(tokens)-ctxLen:]
+			default:
+				tokens = tokens[:ctxLen]
 			}
 
-			tokens = tokens[:ctxLen]
-			s, err = r.Detokenize(c.Request.Context(), tokens)
+			s, err = r.llama.Detokenize(c.Request.Context(), tokens)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
+
+			truncated[i] = true
 		}
 
+		counts[i] = len(tokens)
 		count += len(tokens)
-
 		input[i] = s
 	}
 
-	var g errgroup.Group
-	embeddings := make([][]float32, len(input))
-	for i, text := range input {
-		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
-			if err != nil {
-				return err
+	if len(exceeded) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("input length exceeds maximum context length of %d tokens for inputs at index %s", ctxLen, strings.Join(exceeded, ", "))})
+		return
+	}
+
+	// spread the inputs across the runner's parallel slots, optionally
+	// limited by the request
+	workers := max(1, r.numParallel)
+	if req.Concurrency > 0 {
+		workers = min(workers, req.Concurrency)
+	}
+
+	embeddings, errs := embedParallel(c.Request.Context(), r.llama, input, workers)
+
+	var failed int
+	for i, err := range errs {
+		if err != nil {
+			slog.Error("embedding generation failed", "index", i, "error", err)
+			embeddings[i] = []float32{}
+			failed++
+			continue
+		}
+
+		embedding := normalize(embeddings[i])
+		if req.Dimensions > 0 && req.Dimensions < len(embedding) {
+			embedding = embedding[:req.Dimensions]
+			if renormalize {
+				embedding = normalize(embedding)
 			}
-			embeddings[i] = normalize(embedding)
-			return nil
-		})
+		}
+		embeddings[i] = embedding
 	}
 
-	if err := g.Wait(); err != nil {
-		slog.Error("embedding generation failed", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embeddings: %v", err)})
+	if failed == len(input) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to generate embeddings: %v", errs[0])})
 		return
 	}
 
 	resp := api.EmbedResponse{
-		Model:           req.Model,
-		Embeddings:      embeddings,
-		TotalDuration:   time.Since(checkpointStart),
-		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
-		PromptEvalCount: count,
+		Model:            req.Model,
+		ResolvedModel:    resolved,
+		Embeddings:       embeddings,
+		TotalDuration:    time.Since(checkpointStart),
+		LoadDuration:     checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount:  count,
+		PromptEvalCounts: counts,
+		Truncated:        truncated,
+	}
+
+	if failed > 0 {
+		// report failures per input so the rest of the batch is still usable
+		resp.Errors = make([]string, len(errs))
+		for i, err := range errs {
+			if err != nil {
+				resp.Errors[i] = err.Error()
+			}
+		}
+	}
+
+	if req.EncodingFormat == "base64" || req.EncodingFormat == "int8" {
+		resp.EncodedEmbeddings = make([]api.EncodedEmbedding, len(embeddings))
+		for i, e := range embeddings {
+			resp.EncodedEmbeddings[i] = encodeEmbedding(req.EncodingFormat, e)
+		}
+		resp.Embeddings = [][]float32{}
 	}
+
 	c.JSON(http.StatusOK, resp)
 }
 
-func normalize(vec []float32) []float32 {
-	var sum float32
-	for _, v := range vec {
-		sum += v * v
-	}
+// embedMaxChunkSize caps the number of consecutive inputs a worker takes at
+// once so that large requests stay balanced across slots
+const embedMaxChunkSize = 64
+
+// embedParallel computes an embedding for each input using up to workers
+// concurrent requests to the runner. Inputs are handed out in chunks of
+// consecutive indexes and results are returned in input order, along with
+// the error for each input that failed.
+func embedParallel(ctx context.Context, r llm.LlamaServer, input []string, workers int) ([][]float32, []error) {
+	embeddings := make([][]float32, len(input))
+	errs := make([]error, len(input))
+
+	workers = max(1, min(workers, len(input)))
+	size := max(1, min(embedMaxChunkSize, len(input)/workers))
+
+	chunks := make(chan int, (len(input)+size-1)/size)
+	for start := 0; start < len(input); start += size {
+		chunks <- start
+	}
+	close(chunks)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range chunks {
+				for i := start; i < min(start+size, len(input)); i++ {
+					embeddings[i], errs[i] = r.Embedding(ctx, input[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return embeddings, errs
+}
+
+func normalize(vec []float32) []float32 {
+	var sum float32
+	for _, v := range vec {
+		sum += v * v
+	}
 
 	norm := float32(0.0)
 	if sum > 0 {
@@ -451,6 +1054,47 @@ func normalize(vec []float32) []float32 {
 	return vec
 }
 
+// encodeEmbedding packs an embedding using the "base64" or "int8" encoding
+// format. See [api.EncodedEmbedding] for the layout of each.
+func encodeEmbedding(format string, vec []float32) api.EncodedEmbedding {
+	if format == "int8" {
+		return quantizeEmbedding(vec)
+	}
+
+	b := make([]byte, 4*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return api.EncodedEmbedding{Data: base64.StdEncoding.EncodeToString(b)}
+}
+
+// quantizeEmbedding scalar quantizes an embedding to one signed byte per
+// dimension, mapping the smallest value to -128 and the largest to 127
+func quantizeEmbedding(vec []float32) api.EncodedEmbedding {
+	if len(vec) == 0 {
+		return api.EncodedEmbedding{}
+	}
+
+	lo, hi := slices.Min(vec), slices.Max(vec)
+	scale := (hi - lo) / 255
+	offset := lo + 128*scale
+
+	b := make([]byte, len(vec))
+	for i, v := range vec {
+		var q float64
+		if scale > 0 {
+			q = math.Round(float64((v - offset) / scale))
+		}
+		b[i] = byte(int8(max(-128, min(127, q))))
+	}
+
+	return api.EncodedEmbedding{
+		Data:   base64.StdEncoding.EncodeToString(b),
+		Scale:  scale,
+		Offset: offset,
+	}
+}
+
 func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	var req api.EmbeddingRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
@@ -461,7 +1105,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []model.Capability{}, nil, req.Options, req.KeepAlive, estimateTokens(req.Prompt), nil)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -473,6 +1117,18 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
+	if remote, ok := r.(*remoteRunner); ok {
+		req.Model = remote.model
+		resp, err := remote.client.Embeddings(c.Request.Context(), &req)
+		if err != nil {
+			handleRemoteError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
 	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
 	if err != nil {
 		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
@@ -491,7 +1147,121 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+func (s *Server) ScoreHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.ScoreRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunnerRef(c.Request.Context(), req.Model, []model.Capability{}, nil, req.Options, req.KeepAlive, estimateTokens(append([]string{req.Prompt}, req.Continuations...)...), nil)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	resolved := s.resolvedModel(req.Model, m)
+
+	checkpointLoaded := time.Now()
+
+	if r.remote != nil {
+		name := req.Model
+		req.Model = r.remote.model
+		resp, err := r.remote.client.Score(c.Request.Context(), &req)
+		if err != nil {
+			handleRemoteError(c, err)
+			return
+		}
+
+		resp.Model, resp.ResolvedModel = name, resolved
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	scores := make([]api.ContinuationScore, len(req.Continuations))
+	if len(req.Continuations) == 0 {
+		c.JSON(http.StatusOK, api.ScoreResponse{Model: req.Model, ResolvedModel: resolved, Scores: scores})
+		return
+	}
+
+	prompt, err := r.llama.Tokenize(c.Request.Context(), req.Prompt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// continuations that don't fit in a slot's context after the prompt are
+	// reported individually so the others are still scored
+	scored := make([]bool, len(req.Continuations))
+	for i, continuation := range req.Continuations {
+		tokens, err := r.llama.Tokenize(c.Request.Context(), continuation)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(prompt)+len(tokens) > opts.NumCtx {
+			scores[i].Error = fmt.Sprintf("prompt and continuation length of %d tokens exceeds maximum context length of %d tokens", len(prompt)+len(tokens), opts.NumCtx)
+			continue
+		}
+
+		scored[i] = len(tokens) > 0
+	}
+
+	// candidates are independent prefills, so they're spread across the
+	// runner's parallel slots
+	indexes := make(chan int, len(req.Continuations))
+	for i := range req.Continuations {
+		if scored[i] {
+			indexes <- i
+		}
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	for range max(1, r.numParallel) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				tokens, err := r.llama.Score(c.Request.Context(), llm.ScoreRequest{Prompt: req.Prompt, Continuation: req.Continuations[i]})
+				if err != nil {
+					slog.Error("scoring failed", "index", i, "error", err)
+					scores[i].Error = err.Error()
+					continue
+				}
+
+				scores[i].Tokens = tokens
+				for _, t := range tokens {
+					scores[i].Logprob += t.Logprob
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, api.ScoreResponse{
+		Model:           req.Model,
+		ResolvedModel:   resolved,
+		Scores:          scores,
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: len(prompt),
+	})
+}
+
 func (s *Server) PullHandler(c *gin.Context) {
+	if envconfig.Offline() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errOffline.Error()})
+		return
+	}
+
 	var req api.PullRequest
 	err := c.ShouldBindJSON(&req)
 	switch {
@@ -503,9 +1273,14 @@ func (s *Server) PullHandler(c *gin.Context) {
 		return
 	}
 
-	name := model.ParseName(cmp.Or(req.Model, req.Name))
-	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
+	name, err := parseModelName(cmp.Or(req.Model, req.Name))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !inNamespace(c.Request.Context(), name) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("namespace %q is not allowed", name.Namespace)})
 		return
 	}
 
@@ -517,19 +1292,38 @@ func (s *Server) PullHandler(c *gin.Context) {
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		fn := func(r api.ProgressResponse) {
-			ch <- r
+
+		ctx, t := startTransfer(c.Request.Context(), "pull", name.DisplayShortest())
+		defer t.finish()
+
+		// stop sending once the client is gone so the pull is cancelled
+		// rather than blocking
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-c.Request.Context().Done():
+			}
 		}
 
+		fn := progressPhases(func(r api.ProgressResponse) {
+			t.update(r)
+			send(r)
+		})
+
 		regOpts := &registryOptions{
 			Insecure: req.Insecure,
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
-		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		if err := PullModelWith(ctx, name.DisplayShortest(), PullOptions{Variants: req.Variants, Strict: req.Strict}, regOpts, fn); err != nil {
+			if resp, ok := licenseErrorResponse(err); ok {
+				send(progressError(resp))
+			} else if uerr, ok := unsupportedModel(err); ok {
+				send(progressError(unsupportedModelResponse(uerr)))
+			} else if cause := context.Cause(ctx); errors.Is(cause, errTransferCancelled) {
+				send(progressError(gin.H{"error": cause.Error()}))
+			} else {
+				send(progressError(gin.H{"error": err.Error()}))
+			}
 		}
 	}()
 
@@ -542,6 +1336,11 @@ func (s *Server) PullHandler(c *gin.Context) {
 }
 
 func (s *Server) PushHandler(c *gin.Context) {
+	if envconfig.Offline() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errOffline.Error()})
+		return
+	}
+
 	var req api.PushRequest
 	err := c.ShouldBindJSON(&req)
 	switch {
@@ -553,32 +1352,65 @@ func (s *Server) PushHandler(c *gin.Context) {
 		return
 	}
 
-	var model string
+	var name string
 	if req.Model != "" {
-		model = req.Model
+		name = req.Model
 	} else if req.Name != "" {
-		model = req.Name
+		name = req.Name
 	} else {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
 		return
 	}
 
+	n, err := parseModelTag(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !inNamespace(c.Request.Context(), n) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+		return
+	}
+
+	if req.Destination != "" {
+		if _, err := parseModelTag(req.Destination); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination: %v", err)})
+			return
+		}
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		fn := func(r api.ProgressResponse) {
-			ch <- r
+
+		ctx, t := startTransfer(c.Request.Context(), "push", n.DisplayShortest())
+		defer t.finish()
+
+		// stop sending once the client is gone so the push is cancelled
+		// rather than blocking
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-c.Request.Context().Done():
+			}
 		}
 
+		fn := progressPhases(func(r api.ProgressResponse) {
+			t.update(r)
+			send(r)
+		})
+
 		regOpts := &registryOptions{
 			Insecure: req.Insecure,
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
-		if err := PushModel(ctx, model, regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		if err := PushModelAs(ctx, name, req.Destination, req.DryRun, regOpts, req.Sign, fn); err != nil {
+			if cause := context.Cause(ctx); errors.Is(cause, errTransferCancelled) {
+				send(progressError(gin.H{"error": cause.Error()}))
+			} else {
+				send(progressError(gin.H{"error": err.Error()}))
+			}
 		}
 	}()
 
@@ -605,6 +1437,18 @@ func checkNameExists(name model.Name) error {
 	return nil
 }
 
+// quantizedName returns the name of the model created from name quantized to
+// q, when creating several quantizations at once
+func quantizedName(name model.Name, q string) model.Name {
+	if name.Tag == "latest" {
+		name.Tag = q
+	} else {
+		name.Tag += "-" + q
+	}
+
+	return name
+}
+
 func (s *Server) CreateHandler(c *gin.Context) {
 	var r api.CreateRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
@@ -615,17 +1459,55 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		return
 	}
 
-	name := model.ParseName(cmp.Or(r.Model, r.Name))
-	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+	name, err := parseModelTag(cmp.Or(r.Model, r.Name))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := checkNameExists(name); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !inNamespace(c.Request.Context(), name) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("namespace %q is not allowed", name.Namespace)})
 		return
 	}
 
+	// a list of quantizations creates a model for each, tagged with its
+	// quantization. The models share the conversion of the base model, and
+	// name serves them all as variants.
+	quantizations := strings.Split(cmp.Or(r.Quantize, r.Quantization), ",")
+	names := []model.Name{name}
+	if len(quantizations) > 1 {
+		if err := checkNameExists(name); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		names = nil
+	}
+
+	for i, q := range quantizations {
+		q = strings.TrimSpace(q)
+		quantizations[i] = strings.ToUpper(q)
+		if q == "" && len(quantizations) == 1 {
+			continue
+		}
+
+		if _, err := llm.ParseFileType(quantizations[i]); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported quantization type %q", q)})
+			return
+		}
+
+		if len(quantizations) > 1 {
+			names = append(names, quantizedName(name, q))
+		}
+	}
+
+	for _, name := range names {
+		if err := checkNameExists(name); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	if r.Path == "" && r.Modelfile == "" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required"})
 		return
@@ -652,18 +1534,44 @@ func (s *Server) CreateHandler(c *gin.Context) {
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		fn := func(resp api.ProgressResponse) {
+		fn := progressPhases(func(resp api.ProgressResponse) {
 			ch <- resp
-		}
+		})
 
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
-		quantization := cmp.Or(r.Quantize, r.Quantization)
-		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); errors.Is(err, errBadTemplate) {
-			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
-		} else if err != nil {
-			ch <- gin.H{"error": err.Error()}
+		for i, n := range names {
+			fn := fn
+			if len(names) > 1 {
+				fn(api.ProgressResponse{Status: fmt.Sprintf("creating %s", n.DisplayShortest()), Phase: api.PhaseResolving})
+
+				// success is only reported once every model is created
+				report := fn
+				fn = func(resp api.ProgressResponse) {
+					if resp.Phase != api.PhaseSuccess {
+						report(resp)
+					}
+				}
+			}
+
+			if err := CreateModel(ctx, n, filepath.Dir(r.Path), quantizations[i], f, r.StrictTemplate, fn); errors.Is(err, errBadTemplate) {
+				ch <- progressError(gin.H{"error": err.Error(), "status": http.StatusBadRequest})
+				return
+			} else if err != nil {
+				ch <- progressError(gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if len(names) > 1 {
+			fn(api.ProgressResponse{Status: fmt.Sprintf("creating %s with variants", name.DisplayShortest()), Phase: api.PhaseWriting})
+			if err := writeVariantsManifest(name, names, quantizations); err != nil {
+				ch <- progressError(gin.H{"error": err.Error()})
+				return
+			}
+
+			fn(api.ProgressResponse{Status: "success", Phase: api.PhaseSuccess})
 		}
 	}()
 
@@ -675,9 +1583,12 @@ func (s *Server) CreateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
-func (s *Server) DeleteHandler(c *gin.Context) {
-	var r api.DeleteRequest
-	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+// ImatrixHandler computes the importance matrix of an unquantized model over
+// calibration text, storing it as a blob that creating a quantized model can
+// refer to with IMATRIX
+func (s *Server) ImatrixHandler(c *gin.Context) {
+	var req api.ImatrixRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
@@ -685,93 +1596,342 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		return
 	}
 
-	n := model.ParseName(cmp.Or(r.Model, r.Name))
-	if !n.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+	if req.Data == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "data is required"})
 		return
 	}
 
-	m, err := ParseNamedManifest(n)
+	name, err := parseModelName(req.Model)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := m.Remove(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !inNamespace(c.Request.Context(), name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
 		return
 	}
 
-	if err := m.RemoveLayers(); err != nil {
+	m, err := GetModel(req.Model)
+	if os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-}
 
-func (s *Server) ShowHandler(c *gin.Context) {
-	var req api.ShowRequest
-	err := c.ShouldBindJSON(&req)
-	switch {
-	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
-		return
-	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	ggml, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if req.Model != "" {
-		// noop
-	} else if req.Name != "" {
-		req.Model = req.Name
-	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+	switch ft := ggml.KV().FileType().String(); ft {
+	case "F32", "F16", "BF16":
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("importance matrices are computed with an F16, BF16 or F32 model, this model is %s", ft)})
 		return
 	}
 
-	resp, err := GetModelInfo(req)
-	if err != nil {
-		switch {
-		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
-		case err.Error() == "invalid model name":
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
-		return
-	}
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
 
-	c.JSON(http.StatusOK, resp)
-}
+		var gpus gpu.GpuInfoList
+		var estimate llm.MemoryEstimate
+		if s.sched != nil {
+			var release func()
+			gpus, estimate, release = s.sched.reserveImatrix(ggml)
+			defer release()
+		} else {
+			gpus = gpu.GetGPUInfo()
+			estimate = llm.EstimateImatrix(gpus, ggml)
+		}
 
-func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
-	m, err := GetModel(req.Model)
-	if err != nil {
-		return nil, err
-	}
+		td, err := newTempDir("imatrix")
+		if err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+		defer td.Remove()
 
-	modelDetails := api.ModelDetails{
-		ParentModel:       m.ParentModel,
-		Format:            m.Config.ModelFormat,
-		Family:            m.Config.ModelFamily,
-		Families:          m.Config.ModelFamilies,
-		ParameterSize:     m.Config.ModelType,
-		QuantizationLevel: m.Config.FileType,
-	}
+		datafile := td.Path("data.txt")
+		if err := os.WriteFile(datafile, []byte(req.Data), 0o600); err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
 
-	if req.System != "" {
-		m.System = req.System
-	}
+		status := "computing importance matrix"
+		ch <- api.ProgressResponse{Status: status}
+
+		outfile := td.Path("imatrix.dat")
+		if err := llm.GenerateImatrix(c.Request.Context(), gpus, estimate, m.ModelPath, datafile, outfile, req.Chunks, func(p llm.ImatrixProgress) {
+			ch <- api.ProgressResponse{Status: status, Total: int64(p.Total), Completed: int64(p.Completed)}
+		}); err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+
+		f, err := os.Open(outfile)
+		if err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+		defer f.Close()
+
+		imatrix, err := llm.DecodeImatrix(f)
+		if err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		} else if err := imatrix.CheckModel(ggml); err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+
+		layer, err := NewLayer(f, "application/vnd.ollama.image.imatrix")
+		if err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+
+		ch <- api.ProgressResponse{Status: "success", Digest: layer.Digest}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func (s *Server) DeleteHandler(c *gin.Context) {
+	var r api.DeleteRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	names := r.Models
+	if name := cmp.Or(r.Model, r.Name); name != "" {
+		names = append([]string{name}, names...)
+	}
+
+	if len(names) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	var ns []model.Name
+	var manifests []*Manifest
+	var loaded []*runnerRef
+	for _, name := range names {
+		n, err := parseModelName(name)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !inNamespace(c.Request.Context(), n) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+			return
+		}
+
+		m, err := ParseNamedManifest(n)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// deleting a pin never deletes the tag it was resolved to
+		if n.Digest != "" && m.name.Digest == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' isn't pinned, its digest is that of %s", name, m.name.DisplayShortest())})
+			return
+		}
+
+		if s.sched != nil {
+			runners := s.sched.loadedAs(n)
+			if len(runners) > 0 && !r.Force {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model '%s' is loaded, stop it first or delete it with force", name)})
+				return
+			}
+
+			loaded = append(loaded, runners...)
+		}
+
+		ns = append(ns, n)
+		manifests = append(manifests, m)
+	}
+
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
+	reclaimed, err := reclaimable(ns)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if r.DryRun {
+		c.JSON(http.StatusOK, api.DeleteResponse{Reclaimed: reclaimed})
+		return
+	}
+
+	expired := make(map[string]bool)
+	for _, runner := range loaded {
+		// expiring the model expires all of its replicas
+		if !expired[runner.modelPath] {
+			slog.Info("unloading deleted model", "model", runner.model.ShortName)
+			s.sched.expireRunner(runner.model)
+			expired[runner.modelPath] = true
+		}
+	}
+
+	unlock, err := lockStore(c.Request.Context(), storeLockName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer unlock()
+
+	// the manifests are all removed before their layers, so layers shared
+	// only between the deleted models are removed too
+	for _, m := range manifests {
+		if err := m.Remove(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	for _, m := range manifests {
+		if err := m.RemoveLayers(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.DeleteResponse{Reclaimed: reclaimed})
+}
+
+func (s *Server) ShowHandler(c *gin.Context) {
+	var req api.ShowRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model != "" {
+		// noop
+	} else if req.Name != "" {
+		req.Model = req.Name
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	n, err := parseModelName(req.Model)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !inNamespace(c.Request.Context(), n) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	var schedVersion uint64
+	if s.sched != nil {
+		schedVersion = s.sched.version.Load()
+	}
+
+	version := modelsVersion.Load()
+	if m, err := ParseNamedManifest(n); err == nil {
+		if notModified(c, etag(version, schedVersion, m.digest, m.fi.ModTime(), req, s.localOrAdmin(c))) {
+			return
+		}
+	}
+
+	resp, err := GetModelInfo(req)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		case errors.Is(err, model.ErrInvalidName):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if s.sched != nil {
+		if m, err := GetModel(req.Model); err == nil {
+			resp.Loaded = s.sched.loadSettings(m.ModelPath)
+
+			// a running model shows the settings it was loaded with
+			if opts := s.sched.loadedOptions(m.ModelPath); opts != nil && resp.ModelInfo != nil {
+				if resp.LongContext = llm.KV(resp.ModelInfo).LongContext(opts.Runner); resp.LongContext != nil {
+					resp.LongContext.Loaded = true
+				}
+			}
+		}
+	}
+
+	if req.Layers {
+		manifest, err := ParseNamedManifest(n)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		resp.Manifest = manifest.info(s.localOrAdmin(c))
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
+	m, err := GetModel(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	modelDetails := api.ModelDetails{
+		ParentModel:       m.ParentModel,
+		Format:            m.Config.ModelFormat,
+		Family:            m.Config.ModelFamily,
+		Families:          m.Config.ModelFamilies,
+		ParameterSize:     m.Config.ModelType,
+		QuantizationLevel: m.Config.FileType,
+	}
+
+	if req.System != "" {
+		m.System = req.System
+	}
 
 	msgs := make([]api.Message, len(m.Messages))
 	for i, msg := range m.Messages {
 		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content}
 	}
 
-	n := model.ParseName(req.Model)
-	if !n.IsValid() {
-		return nil, errors.New("invalid model name")
+	n, err := parseModelName(req.Model)
+	if err != nil {
+		return nil, err
 	}
 
 	manifest, err := ParseNamedManifest(n)
@@ -780,12 +1940,17 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	}
 
 	resp := &api.ShowResponse{
-		License:    strings.Join(m.License, "\n"),
-		System:     m.System,
-		Template:   m.Template.String(),
-		Details:    modelDetails,
-		Messages:   msgs,
-		ModifiedAt: manifest.fi.ModTime(),
+		License:      strings.Join(m.License, "\n"),
+		System:       m.System,
+		Template:     m.Template.String(),
+		Details:      modelDetails,
+		Messages:     msgs,
+		Capabilities: m.Capabilities(),
+		ModifiedAt:   manifest.fi.ModTime(),
+	}
+
+	if resp.Signature, err = manifest.checkSignature(); err != nil {
+		slog.Warn("couldn't check model signature", "model", req.Model, "error", err)
 	}
 
 	var params []string
@@ -815,14 +1980,49 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	fmt.Fprint(&sb, m.String())
 	resp.Modelfile = sb.String()
 
+	// models that need a newer version of Ollama are still shown, flagged
+	// with what they need
 	kvData, err := getKVData(m.ModelPath, req.Verbose)
-	if err != nil {
+	if uerr, ok := unsupportedModel(err); ok {
+		resp.Unsupported = uerr
+	} else if err != nil {
 		return nil, err
 	}
+
+	if kvData == nil {
+		return resp, nil
+	}
+
 	delete(kvData, "general.name")
 	delete(kvData, "tokenizer.chat_template")
 	resp.ModelInfo = kvData
 
+	override, _ := m.Options["pooling_type"].(string)
+	if metadata := kvData.PoolingType(); metadata != "" || override != "" {
+		resp.Pooling = &api.Pooling{
+			Metadata:  metadata,
+			Override:  override,
+			Effective: effectivePooling(override, kvData),
+		}
+	}
+
+	var opts api.Options
+	if err := opts.FromMap(m.Options); err != nil {
+		return nil, err
+	}
+
+	resp.LongContext = kvData.LongContext(opts.Runner)
+
+	// the vocabulary is only complete in verbose metadata, and reading it
+	// otherwise would load the whole model's metadata on every request, so
+	// the template is checked against it only when verbose. Creating the
+	// model warns about the template too.
+	if m.Template != nil && req.Verbose {
+		if unknown := unknownSpecialTokens(m.Template, kvData); len(unknown) > 0 {
+			resp.Warnings = append(resp.Warnings, unknownTokensWarning(unknown))
+		}
+	}
+
 	if len(m.ProjectorPaths) > 0 {
 		projectorData, err := getKVData(m.ProjectorPaths[0], req.Verbose)
 		if err != nil {
@@ -834,6 +2034,9 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	return resp, nil
 }
 
+// getKVData returns the metadata of a model file. An
+// *llm.UnsupportedModelError is returned along with the metadata of models
+// that need a newer version of Ollama, or without it if the file can't be read.
 func getKVData(digest string, verbose bool) (llm.KV, error) {
 	maxArraySize := 0
 	if verbose {
@@ -854,21 +2057,48 @@ func getKVData(digest string, verbose bool) (llm.KV, error) {
 		}
 	}
 
-	return kv, nil
+	return kv, kvData.CheckSupported()
 }
 
 func (s *Server) ListHandler(c *gin.Context) {
+	version := modelsVersion.Load()
 	ms, err := Manifests()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	// the models only change with their manifests and blobs, so the response
+	// is tagged with those before the slower work of reading their configs
+	type tagged struct {
+		Name    string
+		Digest  string
+		ModTime time.Time
+	}
+
+	var visible []tagged
+	for n, m := range ms {
+		if !inNamespace(c.Request.Context(), n) {
+			delete(ms, n)
+			continue
+		}
+
+		visible = append(visible, tagged{n.String(), m.digest, m.fi.ModTime()})
+	}
+
+	slices.SortFunc(visible, func(a, b tagged) int { return strings.Compare(a.Name, b.Name) })
+	if notModified(c, etag(version, visible)) {
+		return
+	}
+
 	models := []api.ListModelResponse{}
 	for n, m := range ms {
 		var cf ConfigV2
+		var caps []model.Capability
+		var unsupported *api.UnsupportedModelError
 
-		if m.Config.Digest != "" {
+		broken := len(m.brokenLayers(false)) > 0
+		if m.Config.Digest != "" && !broken {
 			f, err := m.Config.Open()
 			if err != nil {
 				slog.Warn("bad manifest filepath", "name", n, "error", err)
@@ -880,6 +2110,16 @@ func (s *Server) ListHandler(c *gin.Context) {
 				slog.Warn("bad manifest config", "name", n, "error", err)
 				continue
 			}
+
+			if md, err := GetModel(n.String()); err != nil {
+				slog.Warn("couldn't read model", "name", n, "error", err)
+			} else {
+				caps = md.Capabilities()
+			}
+
+			if cf.ModelFamily != "" {
+				unsupported, _ = unsupportedModel(llm.CheckArchitecture(cf.ModelFamily))
+			}
 		}
 
 		// tag should never be masked
@@ -896,6 +2136,9 @@ func (s *Server) ListHandler(c *gin.Context) {
 				ParameterSize:     cf.ModelType,
 				QuantizationLevel: cf.FileType,
 			},
+			Capabilities: caps,
+			Broken:       broken,
+			Unsupported:  unsupported,
 		})
 	}
 
@@ -917,15 +2160,25 @@ func (s *Server) CopyHandler(c *gin.Context) {
 		return
 	}
 
-	src := model.ParseName(r.Source)
-	if !src.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", r.Source)})
+	src, err := parseModelName(r.Source)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source: %v", err)})
+		return
+	}
+
+	dst, err := parseModelTag(r.Destination)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination: %v", err)})
+		return
+	}
+
+	if !inNamespace(c.Request.Context(), src) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
 		return
 	}
 
-	dst := model.ParseName(r.Destination)
-	if !dst.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
+	if !inNamespace(c.Request.Context(), dst) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("namespace %q is not allowed", dst.Namespace)})
 		return
 	}
 
@@ -941,71 +2194,138 @@ func (s *Server) CopyHandler(c *gin.Context) {
 	}
 }
 
-func (s *Server) HeadBlobHandler(c *gin.Context) {
-	path, err := GetBlobsPath(c.Param("digest"))
+func (s *Server) GetBlobHandler(c *gin.Context) {
+	digest := c.Param("digest")
+	path, err := GetBlobsPath(digest)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if _, err := os.Stat(path); err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+	if _, err := os.Stat(path); err != nil || !s.blobUsable(c.Request.Context(), digest) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", digest)})
 		return
 	}
 
-	c.Status(http.StatusOK)
+	c.Header("Content-Type", "application/octet-stream")
+	c.File(path)
 }
 
-func (s *Server) CreateBlobHandler(c *gin.Context) {
-	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
-		p, err := GetBlobsPath(ib)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
-			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
-			delete(intermediateBlobs, c.Param("digest"))
-		} else if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		} else {
-			c.Status(http.StatusOK)
-			return
-		}
-	}
-
-	path, err := GetBlobsPath(c.Param("digest"))
+// ManifestHandler and PutManifestHandler let clients copy a model between
+// servers: the manifest is read from the source, any blobs the destination is
+// missing are uploaded to it, where they're verified against their digests,
+// and then the manifest is written to the destination.
+func (s *Server) ManifestHandler(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	n, err := parseModelName(name)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	_, err = os.Stat(path)
-	switch {
-	case errors.Is(err, os.ErrNotExist):
-		// noop
-	case err != nil:
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	m, err := ParseNamedManifest(n)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !inNamespace(c.Request.Context(), n)) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", name)})
 		return
-	default:
-		c.Status(http.StatusOK)
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	layer, err := NewLayer(c.Request.Body, "")
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	resp := api.Manifest{
+		SchemaVersion: m.SchemaVersion,
+		MediaType:     m.MediaType,
+		Config:        api.ManifestLayer{MediaType: m.Config.MediaType, Digest: m.Config.Digest, Size: m.Config.Size},
+		Annotations:   m.Annotations,
 	}
 
-	if layer.Digest != c.Param("digest") {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+	for _, layer := range m.Layers {
+		resp.Layers = append(resp.Layers, api.ManifestLayer{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) PutManifestHandler(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	n, err := parseModelTag(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !inNamespace(c.Request.Context(), n) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("namespace %q is not allowed", n.Namespace)})
+		return
+	}
+
+	var req api.Manifest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Config.Digest == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "manifest has no config"})
+		return
+	}
+
+	if err := checkNameExists(n); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.Status(http.StatusCreated)
+	config := Layer{MediaType: req.Config.MediaType, Digest: req.Config.Digest, Size: req.Config.Size}
+	layers := make([]Layer, 0, len(req.Layers))
+	for _, layer := range req.Layers {
+		layers = append(layers, Layer{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+	}
+
+	// keep the blobs from being pruned between checking and referencing them
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
+	var digests []string
+	for _, layer := range append(layers, config) {
+		if _, err := GetBlobsPath(layer.Digest); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		digests = append(digests, layer.Digest)
+	}
+
+	// blobs of models in other namespaces are reported as missing, as they
+	// are by HeadBlobHandler
+	if digest, ok := s.blobsReferenceable(c.Request.Context(), digests); !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("blob %q not found", digest)})
+		return
+	}
+
+	for _, layer := range append(layers, config) {
+		fi, err := storage().StatBlob(layer.Digest)
+		if errors.Is(err, os.ErrNotExist) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("blob %q not found", layer.Digest)})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if fi.Size() != layer.Size {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("blob %q is %d bytes, expected %d", layer.Digest, fi.Size(), layer.Size)})
+			return
+		}
+	}
+
+	if err := WriteManifest(n, config, layers, req.Annotations); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
 }
 
 func isLocalIP(ip netip.Addr) bool {
@@ -1054,8 +2374,95 @@ func allowedHost(host string) bool {
 	return false
 }
 
-func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
+// maxBodyMiddleware rejects requests with bodies larger than limit, other than
+// blob uploads, before they're buffered into memory. A zero limit accepts any
+// size.
+func maxBodyMiddleware(limit uint64) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if limit == 0 || c.Request.Body == nil || c.Request.Body == http.NoBody || c.FullPath() == "/api/blobs/:digest" {
+			c.Next()
+			return
+		}
+
+		tooLarge := func() {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body is larger than the %s limit set by OLLAMA_MAX_REQUEST_BODY", format.HumanBytes2(limit))})
+		}
+
+		if c.Request.ContentLength > int64(limit) {
+			tooLarge()
+			return
+		}
+
+		// Without a content length the size is only known once the body is
+		// read, so it's read here to fail before any handler starts on it
+		if c.Request.ContentLength < 0 {
+			body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, int64(limit)))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				tooLarge()
+				return
+			} else if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		c.Next()
+	}
+}
+
+// deadlineWriter sets the connection's write deadline before each write, so a
+// client that stops reading fails the write instead of blocking the handler
+// forever, while responses that keep writing may stream for as long as they
+// need
+type deadlineWriter struct {
+	gin.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) extend() {
+	// Not every writer supports deadlines, e.g. in tests, which is fine
+	_ = w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *deadlineWriter) WriteString(s string) (int, error) {
+	w.extend()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *deadlineWriter) Flush() {
+	w.extend()
+	w.ResponseWriter.Flush()
+}
+
+func writeDeadlineMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		rc := http.NewResponseController(c.Writer)
+		c.Writer = &deadlineWriter{ResponseWriter: c.Writer, rc: rc, timeout: timeout}
+		c.Next()
+
+		// Connections are reused for later requests, which shouldn't inherit
+		// this request's deadline
+		_ = rc.SetWriteDeadline(time.Time{})
+	}
+}
+
+func allowedHostsMiddleware(listenAddr func() net.Addr) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr := listenAddr()
 		if addr == nil {
 			c.Next()
 			return
@@ -1101,34 +2508,81 @@ func (s *Server) GenerateRoutes() http.Handler {
 	for _, prop := range openAIProperties {
 		config.AllowHeaders = append(config.AllowHeaders, "x-stainless-"+prop)
 	}
+	// headers sent by Anthropic clients, which are accepted and ignored
+	config.AllowHeaders = append(config.AllowHeaders, "x-api-key", "anthropic-version", "anthropic-beta")
+	config.AllowHeaders = append(config.AllowHeaders, "Idempotency-Key", requestIDHeader)
+	config.ExposeHeaders = append(config.ExposeHeaders, "Idempotent-Replayed", requestIDHeader)
 	config.AllowOrigins = envconfig.Origins()
 
 	r := gin.Default()
+	if tracing.Enabled() {
+		r.Use(tracingMiddleware)
+	}
+
 	r.Use(
+		writeDeadlineMiddleware(envconfig.WriteTimeout()),
 		cors.New(config),
-		allowedHostsMiddleware(s.addr),
+		allowedHostsMiddleware(s.listenAddr),
+		maxBodyMiddleware(envconfig.MaxRequestBody()),
+		peerCredMiddleware(s.allowedUIDs),
+		apiKeyMiddleware(s.keys),
+		routeMiddleware,
 	)
 
-	r.POST("/api/pull", s.PullHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
+	r.POST("/api/pull", writableStorage, s.PullHandler)
+	idempotency := newIdempotencyCache(int(envconfig.IdempotencyCacheSize()), envconfig.IdempotencyTTL())
+	r.POST("/api/generate", idempotencyMiddleware(idempotency, true), s.GenerateHandler)
+	r.POST("/api/chat", idempotencyMiddleware(idempotency, true), s.ChatHandler)
+	r.POST("/api/embed", idempotencyMiddleware(idempotency, false), s.EmbedHandler)
 	r.POST("/api/embeddings", s.EmbeddingsHandler)
-	r.POST("/api/create", s.CreateHandler)
+	r.POST("/api/score", s.ScoreHandler)
+	r.POST("/api/create", writableStorage, s.CreateHandler)
+	r.POST("/api/imatrix", s.ImatrixHandler)
 	r.POST("/api/push", s.PushHandler)
-	r.POST("/api/copy", s.CopyHandler)
-	r.DELETE("/api/delete", s.DeleteHandler)
+	r.POST("/api/copy", writableStorage, s.CopyHandler)
+	r.DELETE("/api/delete", writableStorage, s.DeleteHandler)
 	r.POST("/api/show", s.ShowHandler)
-	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
+	r.POST("/api/blobs/:digest", writableStorage, s.CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
+	r.GET("/api/blobs/:digest", s.GetBlobHandler)
+	r.HEAD("/api/p2p/blobs/:digest", s.PeerBlobHandler)
+	r.GET("/api/p2p/blobs/:digest", s.PeerBlobHandler)
+	r.GET("/api/manifests/*name", s.ManifestHandler)
+	r.PUT("/api/manifests/*name", writableStorage, s.PutManifestHandler)
 	r.GET("/api/ps", s.PsHandler)
+	r.GET("/api/generation/:id", s.GenerationHandler)
+	r.GET("/api/generation/:id/stream", s.GenerationStreamHandler)
+	r.POST("/api/sessions", s.CreateSessionHandler)
+	r.GET("/api/sessions/:id", s.SessionHandler)
+	r.DELETE("/api/sessions/:id", s.DeleteSessionHandler)
+	r.POST("/api/sessions/:id/chat", s.SessionChatHandler)
+	r.GET("/api/presets", s.ListPresetsHandler)
+	r.GET("/api/aliases", s.ListAliasesHandler)
+	r.POST("/api/aliases", requireAdmin, s.SetAliasHandler)
+	r.DELETE("/api/aliases", requireAdmin, s.DeleteAliasHandler)
+	r.GET("/api/debug/scheduler", requireAdmin, s.SchedulerDebugHandler)
+	r.GET("/api/metrics", requireAdmin, s.MetricsHandler)
+	r.GET("/api/usage", s.UsageHandler)
+	r.POST("/api/usage/reset", requireAdmin, s.ResetUsageHandler)
+	r.GET("/api/remotes", requireAdmin, s.ListRemotesHandler)
+	r.POST("/api/remotes", requireAdmin, s.AddRemoteHandler)
+	r.DELETE("/api/remotes", requireAdmin, s.DeleteRemoteHandler)
+	r.POST("/api/store/dedupe", requireAdmin, s.DedupeHandler)
+	r.POST("/api/store/prune", requireAdmin, s.PruneHandler)
+	r.POST("/api/refresh", requireAdmin, s.RefreshHandler)
+	r.POST("/api/license", s.AcceptLicenseHandler)
+	r.GET("/api/search", s.SearchHandler)
+	r.GET("/api/transfers", s.ListTransfersHandler)
+	r.DELETE("/api/transfers/:id", s.CancelTransferHandler)
 
 	// Compatibility endpoints
 	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
 	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
 	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
 	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
-	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+	r.GET("/v1/models/*model", openai.RetrieveMiddleware(), s.ShowHandler)
+
+	r.POST("/v1/messages", anthropic.MessagesMiddleware(), s.ChatHandler)
 
 	for _, method := range []string{http.MethodGet, http.MethodHead} {
 		r.Handle(method, "/", func(c *gin.Context) {
@@ -1136,14 +2590,15 @@ func (s *Server) GenerateRoutes() http.Handler {
 		})
 
 		r.Handle(method, "/api/tags", s.ListHandler)
-		r.Handle(method, "/api/version", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"version": version.Version})
-		})
+		r.Handle(method, "/api/version", s.VersionHandler)
 	}
 
 	return r
 }
 
+// Serve runs a server configured by the environment on ln until it's
+// interrupted, logging to stderr. It's what ollama serve runs, and wraps New,
+// Start and Serve as a program embedding the server would.
 func Serve(ln net.Listener) error {
 	level := slog.LevelInfo
 	if envconfig.Debug() {
@@ -1166,80 +2621,48 @@ func Serve(ln net.Listener) error {
 
 	slog.SetDefault(slog.New(handler))
 
-	blobsDir, err := GetBlobsPath("")
+	s, err := New(Config{})
 	if err != nil {
 		return err
 	}
-	if err := fixBlobs(blobsDir); err != nil {
-		return err
-	}
 
-	if !envconfig.NoPrune() {
-		// clean up unused layers and manifests
-		if err := PruneLayers(); err != nil {
-			return err
-		}
-
-		manifestsPath, err := GetManifestPath()
-		if err != nil {
-			return err
-		}
-
-		if err := PruneDirectory(manifestsPath); err != nil {
-			return err
-		}
+	if err := s.Start(); err != nil {
+		s.Shutdown(context.Background())
+		return err
 	}
 
-	ctx, done := context.WithCancel(context.Background())
-	schedCtx, schedDone := context.WithCancel(ctx)
-	sched := InitScheduler(schedCtx)
-	s := &Server{addr: ln.Addr(), sched: sched}
-
-	http.Handle("/", s.GenerateRoutes())
-
-	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
-	srvr := &http.Server{
-		// Use http.DefaultServeMux so we get net/http/pprof for
-		// free.
-		//
-		// TODO(bmizerany): Decide if we want to make this
-		// configurable so it is not exposed by default, or allow
-		// users to bind it to a different port. This was a quick
-		// and easy way to get pprof, but it may not be the best
-		// way.
-		Handler: nil,
-	}
+	// Use http.DefaultServeMux so we get net/http/pprof for
+	// free.
+	//
+	// TODO(bmizerany): Decide if we want to make this
+	// configurable so it is not exposed by default, or allow
+	// users to bind it to a different port. This was a quick
+	// and easy way to get pprof, but it may not be the best
+	// way.
+	http.Handle("/", s.Handler())
+	s.root = http.DefaultServeMux
 
 	// listen for a ctrl+c and stop any loaded llm
+	done := make(chan struct{})
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-signals
-		srvr.Close()
-		schedDone()
-		sched.unloadAllRunners()
-		runners.Cleanup(build.EmbedFS)
-		done()
-	}()
-
-	if _, err := runners.Refresh(build.EmbedFS); err != nil {
-		return fmt.Errorf("unable to initialize llm runners %w", err)
-	}
 
-	s.sched.Run(schedCtx)
-
-	// At startup we retrieve GPU information so we can get log messages before loading a model
-	// This will log warnings to the log in case we have problems with detected GPUs
-	gpus := gpu.GetGPUInfo()
-	gpus.LogDetails()
+		// requests in progress are closed rather than waited for
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.Shutdown(ctx)
+		close(done)
+	}()
 
-	err = srvr.Serve(ln)
-	// If server is closed from the signal handler, wait for the ctx to be done
-	// otherwise error out quickly
+	err = s.Serve(ln)
+	// If server is closed from the signal handler, wait for it to finish
+	// shutting down, otherwise error out quickly
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
-	<-ctx.Done()
+	<-done
 	return nil
 }
 
@@ -1257,6 +2680,10 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 			if !ok {
 				status = http.StatusInternalServerError
 			}
+			if r["code"] == licenseRequiredCode {
+				c.JSON(http.StatusUnavailableForLegalReasons, r)
+				return
+			}
 			if errorMsg, ok := r["error"].(string); ok {
 				c.JSON(status, gin.H{"error": errorMsg})
 				return
@@ -1273,58 +2700,113 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 }
 
 func streamResponse(c *gin.Context, ch chan any) {
+	streamCoalesced(c, ch, 0, 0)
+}
+
+// streamCoalesced writes each value from ch as a line of ndjson like
+// streamResponse, but flushes at most every interval or maxValues values,
+// whichever comes first, instead of after every value. The first value is
+// flushed immediately so coalescing never delays the first token, and
+// whatever is pending is flushed once ch is closed. A zero interval flushes
+// every value. It returns the error of a failed write.
+func streamCoalesced(c *gin.Context, ch chan any, interval time.Duration, maxValues int) error {
 	c.Header("Content-Type", "application/x-ndjson")
-	c.Stream(func(w io.Writer) bool {
-		val, ok := <-ch
-		if !ok {
-			return false
+	w := c.Writer
+
+	var pending int
+	var timer *time.Timer
+	var deadline <-chan time.Time
+	flush := func() {
+		w.Flush()
+		pending = 0
+		if deadline != nil && !timer.Stop() {
+			<-timer.C
 		}
+		deadline = nil
+	}
 
-		bts, err := json.Marshal(val)
-		if err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
-			return false
-		}
+	first := true
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return nil
+		case <-deadline:
+			deadline = nil
+			flush()
+		case val, ok := <-ch:
+			if !ok {
+				if pending > 0 {
+					flush()
+				}
+				return nil
+			}
+
+			// values relayed by streamBuffers are already encoded
+			bts, ok := val.(json.RawMessage)
+			if !ok {
+				var err error
+				if bts, err = json.Marshal(val); err != nil {
+					slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
+					return nil
+				}
+			}
 
-		// Delineate chunks with new-line delimiter
-		bts = append(bts, '\n')
-		if _, err := w.Write(bts); err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
-			return false
+			// Delineate chunks with new-line delimiter
+			if _, err := w.Write(append(bts, '\n')); err != nil {
+				slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
+				return err
+			}
+
+			pending++
+			switch {
+			case first, interval <= 0, maxValues > 0 && pending >= maxValues:
+				first = false
+				flush()
+			case deadline == nil:
+				if timer == nil {
+					timer = time.NewTimer(interval)
+				} else {
+					timer.Reset(interval)
+				}
+				deadline = timer.C
+			}
 		}
+	}
+}
 
-		return true
-	})
+// streamFlushInterval returns how often a streamed generation is flushed,
+// from the request if it sets flush_interval or OLLAMA_STREAM_FLUSH_INTERVAL
+func streamFlushInterval(d *api.Duration) time.Duration {
+	if d != nil {
+		return max(d.Duration, 0)
+	}
+
+	return envconfig.StreamFlushInterval()
+}
+
+// maxTime is how long a request's generation may run, or zero for no limit
+func maxTime(d *api.Duration) time.Duration {
+	if d != nil && d.Duration > 0 {
+		return d.Duration
+	}
+
+	return 0
 }
 
 func (s *Server) PsHandler(c *gin.Context) {
 	models := []api.ProcessModelResponse{}
+	verbose, _ := strconv.ParseBool(c.Query("verbose"))
+
+	// the slots of verbose responses are sampled from the runners, so only
+	// other responses are tagged
+	if !verbose && notModified(c, etag(s.sched.version.Load(), apiKeyName(c.Request.Context()))) {
+		return
+	}
 
-	for _, v := range s.sched.loaded {
-		model := v.model
-		modelDetails := api.ModelDetails{
-			Format:            model.Config.ModelFormat,
-			Family:            model.Config.ModelFamily,
-			Families:          model.Config.ModelFamilies,
-			ParameterSize:     model.Config.ModelType,
-			QuantizationLevel: model.Config.FileType,
-		}
-
-		mr := api.ProcessModelResponse{
-			Model:     model.ShortName,
-			Name:      model.ShortName,
-			Size:      int64(v.estimatedTotal),
-			SizeVRAM:  int64(v.estimatedVRAM),
-			Digest:    model.Digest,
-			Details:   modelDetails,
-			ExpiresAt: v.expiresAt,
-		}
-		// The scheduler waits to set expiresAt, so if a model is loading it's
-		// possible that it will be set to the unix epoch. For those cases, just
-		// calculate the time w/ the sessionDuration instead.
-		var epoch time.Time
-		if v.expiresAt == epoch {
-			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
+	for _, v := range s.sched.runners() {
+		mr, ok := v.status(c.Request.Context(), verbose)
+		if !ok || !inNamespace(c.Request.Context(), model.ParseName(mr.Name)) {
+			continue
 		}
 
 		models = append(models, mr)
@@ -1338,11 +2820,313 @@ func (s *Server) PsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
 }
 
+// VersionHandler reports the server's version and build. With ?verbose=true
+// it also lists the runners it has and the GPU backends it found, which are
+// slower to gather.
+func (s *Server) VersionHandler(c *gin.Context) {
+	commit, date := version.Build()
+	resp := api.VersionResponse{
+		Version:   version.Version,
+		Commit:    commit,
+		BuildDate: date,
+		GoVersion: runtime.Version(),
+		Offline:   envconfig.Offline(),
+		CPU: &api.VersionCPU{
+			Capability: gpu.GetCPUCapability().String(),
+			Runner:     runners.ServerForCpu(),
+		},
+	}
+
+	if verbose, _ := strconv.ParseBool(c.Query("verbose")); verbose {
+		getGpuFn := gpu.GetGPUInfo
+		if s.sched != nil {
+			getGpuFn = s.sched.getGpuFn
+		}
+
+		resp.Runners = runners.Available()
+		resp.Architectures = llm.Architectures()
+		resp.Backends = versionBackends(getGpuFn())
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// versionBackends returns the GPU libraries of gpus with their variants and
+// drivers
+func versionBackends(gpus gpu.GpuInfoList) []api.VersionBackend {
+	var backends []api.VersionBackend
+	for _, g := range gpus {
+		if g.Library == "cpu" {
+			continue
+		}
+
+		b := api.VersionBackend{Library: g.Library, Variant: g.Variant}
+		if g.DriverMajor > 0 {
+			b.Driver = fmt.Sprintf("%d.%d", g.DriverMajor, g.DriverMinor)
+		}
+
+		if i := slices.IndexFunc(backends, func(o api.VersionBackend) bool {
+			return o.Library == b.Library && o.Variant == b.Variant && o.Driver == b.Driver
+		}); i >= 0 {
+			backends[i].GPUs++
+		} else {
+			b.GPUs = 1
+			backends = append(backends, b)
+		}
+	}
+
+	return backends
+}
+
+// SchedulerDebugHandler reports the scheduler's internal state, including the
+// VRAM ledger, so differences between the memory the scheduler expects each
+// runner to use and what the GPUs report are visible
+func (s *Server) SchedulerDebugHandler(c *gin.Context) {
+	state := s.sched.debugState()
+	state.Runners = s.sched.runnerSlots(c.Request.Context())
+	c.JSON(http.StatusOK, state)
+}
+
+func (s *Server) ListRemotesHandler(c *gin.Context) {
+	remotes := []api.RemoteResponse{}
+	for _, host := range s.sched.remotes.list() {
+		remotes = append(remotes, api.RemoteResponse{Host: host.String()})
+	}
+
+	c.JSON(http.StatusOK, api.ListRemotesResponse{Remotes: remotes})
+}
+
+func (s *Server) AddRemoteHandler(c *gin.Context) {
+	if envconfig.Offline() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errOffline.Error()})
+		return
+	}
+
+	var req api.RemoteRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if strings.TrimSpace(req.Host) == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "host is required"})
+		return
+	}
+
+	host := envconfig.ParseHost(req.Host)
+	if !s.sched.remotes.add(host) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("remote '%s' already exists", host)})
+		return
+	}
+
+	slog.Info("added remote server", "host", host)
+	c.JSON(http.StatusOK, api.RemoteResponse{Host: host.String()})
+}
+
+func (s *Server) DeleteRemoteHandler(c *gin.Context) {
+	var req api.RemoteRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	host := envconfig.ParseHost(req.Host)
+	if strings.TrimSpace(req.Host) == "" || !s.sched.remotes.remove(host) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("remote '%s' not found", req.Host)})
+		return
+	}
+
+	slog.Info("removed remote server", "host", host)
+}
+
+func (s *Server) DedupeHandler(c *gin.Context) {
+	var req api.DedupeRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := dedupeBlobs(req.Dirs, req.DryRun)
+	if errors.Is(err, errDedupeDir) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.Info("deduplicated blobs", "duplicates", len(resp.Duplicates), "total", format.HumanBytes2(uint64(resp.Total)), "reclaimed", format.HumanBytes2(uint64(resp.Reclaimed)), "dry_run", req.DryRun)
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) PruneHandler(c *gin.Context) {
+	var req api.PruneRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := pruneModels(req.DryRun, req.Broken, req.Verify)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.Info("pruned models", "broken", len(resp.Broken), "unused", len(resp.Unused), "reclaimed", format.HumanBytes2(uint64(resp.Reclaimed)), "dry_run", req.DryRun)
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) RefreshHandler(c *gin.Context) {
+	if envconfig.Offline() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errOffline.Error()})
+		return
+	}
+
+	var req api.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	models := envconfig.AutoPull()
+	if req.Model != "" {
+		models = []string{req.Model}
+	}
+
+	resp := api.RefreshResponse{Models: []api.RefreshModelResponse{}}
+	for _, name := range models {
+		// the maintenance window only applies to scheduled refreshes
+		status, err := s.refreshModel(c.Request.Context(), name, true)
+		if err != nil {
+			slog.Warn("failed to refresh model", "model", name, "error", err)
+			resp.Models = append(resp.Models, api.RefreshModelResponse{Model: name, Status: "failed", Error: err.Error()})
+			continue
+		}
+
+		resp.Models = append(resp.Models, api.RefreshModelResponse{Model: name, Status: status})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) ListTransfersHandler(c *gin.Context) {
+	resp := api.ListTransfersResponse{Transfers: []api.TransferResponse{}}
+	for _, t := range listTransfers() {
+		if inNamespace(c.Request.Context(), model.ParseName(t.model)) {
+			resp.Transfers = append(resp.Transfers, t.response())
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) CancelTransferHandler(c *gin.Context) {
+	t, ok := getTransfer(c.Param("id"))
+	if !ok || !inNamespace(c.Request.Context(), model.ParseName(t.model)) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("transfer %q not found", c.Param("id"))})
+		return
+	}
+
+	discard, _ := strconv.ParseBool(c.Query("discard"))
+	if err := cancelTransfer(c.Request.Context(), t, discard); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) SearchHandler(c *gin.Context) {
+	if envconfig.Offline() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errOffline.Error()})
+		return
+	}
+
+	req := api.SearchRequest{Query: c.Query("q"), Sort: c.Query("sort")}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q", limit)})
+			return
+		}
+		req.Limit = n
+	}
+
+	if !slices.Contains([]string{"", "pulls", "updated", "name"}, req.Sort) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid sort %q, expected pulls, updated or name", req.Sort)})
+		return
+	}
+
+	resp, err := searchRegistry(c.Request.Context(), req)
+	if errors.Is(err, errSearchFailed) {
+		slog.Warn("search failed", "error", err)
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) AcceptLicenseHandler(c *gin.Context) {
+	var req api.AcceptLicenseRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := parseModelName(req.Model)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !inNamespace(c.Request.Context(), name) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	// the license of a model that hasn't been pulled is accepted as published
+	mp := ParseModelPath(name.DisplayShortest())
+	m, err := ParseNamedManifest(name)
+	if errors.Is(err, os.ErrNotExist) {
+		m, _, err = pullModelManifest(c.Request.Context(), mp, &registryOptions{Insecure: req.Insecure})
+	}
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !m.requiresLicenseAcceptance() {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if err := acceptLicense(mp.GetShortTagname(), m, req.User); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
 func (s *Server) ChatHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 
 	var req api.ChatRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+	if err := bindJSON(c, &req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
@@ -1352,60 +3136,164 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 	// expire the runner
 	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
-		model, err := GetModel(req.Model)
+		m, err := getNamespacedModel(c.Request.Context(), req.Model)
 		if err != nil {
 			switch {
 			case os.IsNotExist(err):
 				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
-			case err.Error() == "invalid model name":
+			case errors.Is(err, model.ErrInvalidName):
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			default:
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			}
 			return
 		}
-		s.sched.expireRunner(model)
+		s.sched.expireRunner(m)
 
 		c.JSON(http.StatusOK, api.ChatResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
 			Message:    api.Message{Role: "assistant"},
 			Done:       true,
-			DoneReason: "unload",
+			DoneReason: api.DoneReasonUnload,
 		})
 		return
 	}
 
-	caps := []Capability{CapabilityCompletion}
+	if err := checkChoices(req.N, req.Stream); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkReasoning(req.Reasoning); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkJSONStrict(req.JSONStrict, req.Format, req.JSONRetries); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preset, ok := s.preset(c, req.Preset)
+	if !ok {
+		return
+	}
+
+	var tmpl *template.Template
+	if req.Template != "" {
+		var err error
+		if tmpl, err = template.Parse(req.Template); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %s", errBadTemplate, err)})
+			return
+		}
+	}
+
+	caps := []model.Capability{model.CapabilityCompletion}
 	if len(req.Tools) > 0 {
-		caps = append(caps, CapabilityTools)
+		caps = append(caps, model.CapabilityTools)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	if slices.ContainsFunc(req.Messages, func(m api.Message) bool { return len(m.Images) > 0 }) {
+		caps = append(caps, model.CapabilityVision)
+	}
+
+	// the generation can be followed by other clients, and keeps running
+	// while they are after this one leaves
+	gen := s.generations.start(c, req.Stream, mergeChat)
+	defer s.generations.abandon(gen)
+
+	// the runner is released as soon as the generation finishes, rather than
+	// once its responses have been written to a slow client
+	ctx, release := context.WithCancel(gen.context(c.Request.Context()))
+	defer release()
+
+	progressFn := streamLoadStatus(c, req.Stream, func(status string) any {
+		return api.ChatResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Message: api.Message{Role: "assistant"}, Status: status, GenerationID: gen.ID()}
+	})
+	var text []string
+	for _, msg := range req.Messages {
+		text = append(text, msg.Content)
+	}
+
+	ref, m, opts, err := s.scheduleRunnerRef(ctx, req.Model, caps, presetOptions(preset), req.Options, req.KeepAlive, estimateTokens(text...), progressFn)
+	// usage is counted whether or not a runner was scheduled, so requests
+	// that fail to load the model or whose client leaves while they're
+	// queued are counted too
+	usage := s.usage.begin(c.Request.Context(), req.Model, m)
+	defer usage.end(c)
+
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
+		c.JSON(http.StatusBadRequest, capabilityErrorResponse(fmt.Sprintf("%q does not support chat", req.Model), err))
 		return
 	} else if err != nil {
+		usage.fail(c.Request.Context(), err)
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	r, placementWarning := ref.llama, ref.placementWarning(opts)
+
+	var sources map[string]string
+	if req.ReturnOptions {
+		fixSeed(opts)
+		sources = optionSources(opts, m, presetOptions(preset), req.Options)
+	}
+
+	c.Set(openai.ModelDigestKey, m.Digest)
+	resolved := s.resolvedModel(req.Model, m)
+
+	if tmpl != nil {
+		// the model is shared with the runner, so it's copied to override
+		// its template for this request
+		override := *m
+		override.Template = tmpl
+		m = &override
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
 		c.JSON(http.StatusOK, api.ChatResponse{
-			Model:      req.Model,
-			CreatedAt:  time.Now().UTC(),
-			Message:    api.Message{Role: "assistant"},
-			Done:       true,
-			DoneReason: "load",
+			Model:         req.Model,
+			ResolvedModel: resolved,
+			CreatedAt:     time.Now().UTC(),
+			Message:       api.Message{Role: "assistant"},
+			Done:          true,
+			DoneReason:    api.DoneReasonLoad,
+		})
+		return
+	}
+
+	if remote, ok := r.(*remoteRunner); ok {
+		name := req.Model
+		req.Model = remote.model
+		if preset != nil {
+			req.Preset = ""
+			req.Options = remotePresetOptions(preset, m, req.Options)
+			// the remote uses the model's SYSTEM itself
+			if system, source := chatSystem(req.Messages, preset, m, req.UseModelSystem == nil || *req.UseModelSystem); source == optionSourcePreset {
+				req.Messages = append([]api.Message{{Role: "system", Content: system}}, req.Messages...)
+			}
+		}
+
+		done := usage.hold()
+		proxyRemote(c, req.Stream, func(fn func(api.ChatResponse) error) error {
+			defer done()
+			err := remote.client.Chat(c.Request.Context(), &req, func(r api.ChatResponse) error {
+				if r.Done {
+					usage.add(r.Metrics)
+				}
+
+				r.Model, r.ResolvedModel = name, resolved
+				return fn(r)
+			})
+			usage.fail(c.Request.Context(), err)
+			return err
 		})
 		return
 	}
 
 	msgs := append(m.Messages, req.Messages...)
-	if req.Messages[0].Role != "system" && m.System != "" {
-		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+	system, systemSource := chatSystem(req.Messages, preset, m, req.UseModelSystem == nil || *req.UseModelSystem)
+	if systemSource != optionSourceRequest && system != "" {
+		msgs = append([]api.Message{{Role: "system", Content: system}}, msgs...)
 	}
 
 	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools)
@@ -1414,51 +3302,110 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if err := checkImageTokens(images, opts.NumCtx); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	slog.Debug("chat request", "images", len(images), "prompt", prompt)
 
+	id := requestID(c)
 	ch := make(chan any)
+	done := usage.hold()
 	go func() {
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(r llm.CompletionResponse) {
-			res := api.ChatResponse{
-				Model:      req.Model,
-				CreatedAt:  time.Now().UTC(),
-				Message:    api.Message{Role: "assistant", Content: r.Content},
-				Done:       r.Done,
-				DoneReason: r.DoneReason,
-				Metrics: api.Metrics{
-					PromptEvalCount:    r.PromptEvalCount,
-					PromptEvalDuration: r.PromptEvalDuration,
-					EvalCount:          r.EvalCount,
-					EvalDuration:       r.EvalDuration,
-				},
-			}
+		defer release()
+		defer done()
+		var wg sync.WaitGroup
+		for i := range max(req.N, 1) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				choiceOpts := choiceOptions(opts, i)
+				parser := reasoningParser(req.Reasoning, m.Template, prompt)
+				complete, strict := completionFunc(traceCompletion), (*api.JSONStrictResult)(nil)
+				if req.JSONStrict != "" {
+					strict = &api.JSONStrictResult{}
+					complete = jsonStrictCompletion(req.JSONStrict, req.JSONRetries, max(req.N, 1), strict)
+				}
+				complete = usage.completion(complete)
+
+				if err := complete(ctx, r, llm.CompletionRequest{
+					ID:      id,
+					Prompt:  prompt,
+					Images:  images,
+					Format:  req.Format,
+					Options: choiceOpts,
+					MaxTime: maxTime(req.MaxTime),
+				}, func(r llm.CompletionResponse) {
+					content, thinking := r.Content, ""
+					if parser != nil {
+						thinking, content = parser.next(r.Content, r.Done, req.Reasoning)
+						if !r.Done && thinking == "" && content == "" {
+							return
+						}
+					}
 
-			if r.Done {
-				res.TotalDuration = time.Since(checkpointStart)
-				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
-			}
+					res := api.ChatResponse{
+						Model:         req.Model,
+						ResolvedModel: resolved,
+						CreatedAt:     time.Now().UTC(),
+						Message:       api.Message{Role: "assistant", Content: content, Thinking: thinking},
+						Done:          r.Done,
+						DoneReason:    r.DoneReason,
+						StopString:    r.StopString,
+						Index:         i,
+						Metrics: api.Metrics{
+							PromptEvalCount:    r.PromptEvalCount,
+							PromptEvalDuration: r.PromptEvalDuration,
+							EvalCount:          r.EvalCount,
+							EvalDuration:       r.EvalDuration,
+							Variant:            m.Variant,
+							NumCtx:             opts.NumCtx,
+							PromptCacheHit:     promptCacheHit(r),
+							PromptCacheTokens:  r.PromptCacheTokens,
+						},
+					}
 
-			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+					if r.Done {
+						s.sched.admission.observe(m.ModelPath, r)
+						s.sched.promptCache.observe(m.ModelPath, r)
+						res.PlacementWarning = placementWarning
+						res.TotalDuration = time.Since(checkpointStart)
+						res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+						res.ImageTokens = imageTokens(images)
+						res.JSONStrict = strict
+						if req.ReturnOptions {
+							res.Options = choiceOpts.Map()
+							res.OptionSources = sources
+							res.System, res.SystemSource = system, systemSource
+						}
+					}
+
+					ch <- res
+				}); err != nil {
+					ch <- completionError(err)
+				}
+			}()
 		}
+		wg.Wait()
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
-		var sb strings.Builder
+		var sb, tb strings.Builder
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sb.WriteString(t.Message.Content)
+				tb.WriteString(t.Message.Thinking)
 				resp = t
 			case gin.H:
+				if t["code"] == invalidJSONCode {
+					c.JSON(http.StatusUnprocessableEntity, t)
+					return
+				}
+
 				msg, ok := t["error"].(string)
 				if !ok {
 					msg = "unexpected error format in response"
@@ -1473,11 +3420,14 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}
 
 		resp.Message.Content = sb.String()
+		resp.Message.Thinking = tb.String()
 
 		if len(req.Tools) > 0 {
 			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
+				assignToolCallIDs(toolCalls)
 				resp.Message.ToolCalls = toolCalls
 				resp.Message.Content = ""
+				resp.DoneReason = api.DoneReasonToolCalls
 			}
 		}
 
@@ -1485,12 +3435,82 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	streamResponse(c, ch)
+	err = streamCoalesced(c, s.streams.buffer(c.Request.Context(), s.generations.tee(gen, c, ch)), streamFlushInterval(req.FlushInterval), int(envconfig.StreamFlushTokens()))
+	s.streams.abort(m.ModelPath, err)
+}
+
+// unsupportedModelCode is the code of error responses for models that need a
+// newer version of Ollama, returned by the client as an
+// api.UnsupportedModelError
+const unsupportedModelCode = "unsupported_model"
+
+// unsupportedModel converts err to the API's description of it if it's an
+// *llm.UnsupportedModelError
+func unsupportedModel(err error) (*api.UnsupportedModelError, bool) {
+	var uerr *llm.UnsupportedModelError
+	if !errors.As(err, &uerr) {
+		return nil, false
+	}
+
+	return &api.UnsupportedModelError{
+		ErrorMessage: uerr.Error(),
+		Architecture: uerr.Architecture,
+		GGUFVersion:  uerr.GGUFVersion,
+		MinVersion:   uerr.MinVersion,
+	}, true
+}
+
+// unsupportedModelResponse is the error response for uerr, which the client
+// returns as an api.UnsupportedModelError
+func unsupportedModelResponse(uerr *api.UnsupportedModelError) gin.H {
+	return gin.H{
+		"error":        uerr.ErrorMessage,
+		"code":         unsupportedModelCode,
+		"architecture": uerr.Architecture,
+		"gguf_version": uerr.GGUFVersion,
+		"min_version":  uerr.MinVersion,
+	}
+}
+
+// missingCapabilityCode is the code of error responses for requests that use
+// capabilities the model doesn't have, such as tools
+const missingCapabilityCode = "missing_capability"
+
+// capabilityErrorResponse is the response for err, from CheckCapabilities,
+// listing the missing capabilities
+func capabilityErrorResponse(msg string, err error) gin.H {
+	return gin.H{
+		"error":        msg,
+		"code":         missingCapabilityCode,
+		"capabilities": missingCapabilities(err),
+	}
 }
 
 func handleScheduleError(c *gin.Context, name string, err error) {
+	if resp, ok := licenseErrorResponse(err); ok {
+		c.JSON(http.StatusUnavailableForLegalReasons, resp)
+		return
+	}
+
+	var terr *ttftError
+	if errors.As(err, &terr) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":          terr.Error(),
+			"predicted_ttft": terr.Predicted.Seconds(),
+			"target_ttft":    terr.Target.Seconds(),
+		})
+		return
+	}
+
+	if uerr, ok := unsupportedModel(err); ok {
+		c.JSON(http.StatusBadRequest, unsupportedModelResponse(uerr))
+		return
+	}
+
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
+	case errors.Is(err, errCapabilities):
+		c.JSON(http.StatusBadRequest, capabilityErrorResponse(err.Error(), err))
+	case errors.Is(err, errRequired), errors.Is(err, errBadPooling), errors.Is(err, llm.ErrStopRegex), errors.Is(err, llm.ErrContextOption), errors.Is(err, model.ErrInvalidName), errors.Is(err, errGPUSelection):
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
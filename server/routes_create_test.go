@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
 )
 
 var stream bool = false
@@ -66,6 +68,7 @@ func createRequest(t *testing.T, fn func(*gin.Context), body any) *httptest.Resp
 	}
 
 	c.Request = &http.Request{
+		URL:  &url.URL{},
 		Body: io.NopCloser(&b),
 	}
 
@@ -616,3 +619,183 @@ func TestCreateDetectTemplate(t *testing.T) {
 		})
 	})
 }
+
+func TestCreateQuantize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	t.Run("unsupported type", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+			Quantize:  "q4_K_M, q3_XL",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !bytes.Contains(w.Body.Bytes(), []byte(`unsupported quantization type \"q3_XL\"`)) {
+			t.Errorf("unexpected error %s", w.Body.String())
+		}
+	})
+
+	t.Run("quantized source", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name: "test",
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+				"general.architecture": "llama",
+				"general.file_type":    uint32(2),
+			}, nil)),
+			Quantize: "q4_K_M,q8_0",
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code 500, actual %d", w.Code)
+		}
+
+		if !bytes.Contains(w.Body.Bytes(), []byte("quantization is only supported for F16, BF16 and F32 models")) {
+			t.Errorf("unexpected error %s", w.Body.String())
+		}
+	})
+
+	t.Run("embedding length", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name: "test",
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+				"general.architecture":   "llama",
+				"general.file_type":      uint32(1),
+				"llama.embedding_length": uint32(100),
+			}, nil)),
+			Quantize: "q4_K_M",
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code 500, actual %d", w.Code)
+		}
+
+		if !bytes.Contains(w.Body.Bytes(), []byte("isn't a multiple of 256")) {
+			t.Errorf("unexpected error %s", w.Body.String())
+		}
+	})
+
+	t.Run("importance matrix", func(t *testing.T) {
+		writeImatrix := func(t *testing.T, name string) string {
+			t.Helper()
+
+			f, err := os.CreateTemp(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			m := llm.Imatrix{Entries: []llm.ImatrixEntry{{Name: name, Calls: 1, Values: make([]float32, 256)}}}
+			if _, err := m.WriteTo(f); err != nil {
+				t.Fatal(err)
+			}
+
+			return f.Name()
+		}
+
+		bin := createBinFile(t, llm.KV{
+			"general.architecture":   "llama",
+			"general.file_type":      uint32(1),
+			"llama.embedding_length": uint32(256),
+		}, []llm.Tensor{
+			{Name: "blk.0.attn_q.weight", Kind: 1, Shape: []uint64{256, 1}, WriterTo: bytes.NewReader(make([]byte, 512))},
+		})
+
+		cases := []struct {
+			name      string
+			modelfile string
+			quantize  string
+			expect    string
+		}{
+			{"required", fmt.Sprintf("FROM %s", bin), "iq2_XS", "requires an importance matrix"},
+			{"other model", fmt.Sprintf("FROM %s\nIMATRIX %s", bin, writeImatrix(t, "blk.9.ffn_up.weight")), "iq2_XS", "no entries for this model's tensors"},
+			{"invalid", fmt.Sprintf("FROM %s\nIMATRIX %s", bin, bin), "iq2_XS", "invalid importance matrix"},
+			{"recommended", fmt.Sprintf("FROM %s", bin), "q3_K_S", "warning: quantizing to Q3_K_S without an importance matrix"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.CreateHandler, api.CreateRequest{
+					Name:      "test",
+					Modelfile: tt.modelfile,
+					Quantize:  tt.quantize,
+				})
+
+				if !bytes.Contains(w.Body.Bytes(), []byte(tt.expect)) {
+					t.Errorf("expected %q, got %s", tt.expect, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("names", func(t *testing.T) {
+		cases := map[string]string{
+			"test":       "test:q4_K_M",
+			"test:8b":    "test:8b-q4_K_M",
+			"ns/test:v1": "ns/test:v1-q4_K_M",
+		}
+
+		for in, expect := range cases {
+			if name := quantizedName(model.ParseName(in), "q4_K_M"); name.DisplayShortest() != expect {
+				t.Errorf("%s: expected %s, got %s", in, expect, name.DisplayShortest())
+			}
+		}
+	})
+}
+
+func TestImatrixHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	for name, fileType := range map[string]uint32{"f16": 1, "q4_0": 2} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name: name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+				"general.architecture": "llama",
+				"general.file_type":    fileType,
+			}, nil)),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		req    api.ImatrixRequest
+		status int
+		expect string
+	}{
+		{"missing data", api.ImatrixRequest{Model: "f16"}, http.StatusBadRequest, "data is required"},
+		{"missing model", api.ImatrixRequest{Model: "missing", Data: "text"}, http.StatusNotFound, "not found"},
+		{"quantized model", api.ImatrixRequest{Model: "q4_0", Data: "text"}, http.StatusBadRequest, "this model is Q4_0"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.ImatrixHandler, tt.req)
+			if w.Code != tt.status {
+				t.Fatalf("expected status code %d, actual %d", tt.status, w.Code)
+			}
+
+			if !bytes.Contains(w.Body.Bytes(), []byte(tt.expect)) {
+				t.Errorf("expected %q, got %s", tt.expect, w.Body.String())
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"testing"
 
@@ -98,7 +99,7 @@ func TestDeleteDuplicateLayers(t *testing.T) {
 	}
 
 	// create a manifest with duplicate layers
-	if err := WriteManifest(n, config, []Layer{config}); err != nil {
+	if err := WriteManifest(n, config, []Layer{config}, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -109,3 +110,92 @@ func TestDeleteDuplicateLayers(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
 }
+
+func TestDeleteModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+
+	bin := createBinFile(t, nil, nil)
+	for _, name := range []string{"exp-1", "exp-2", "keep"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: fmt.Sprintf("FROM %s\nSYSTEM %s", bin, name),
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	reclaimed := func(w *httptest.ResponseRecorder) int64 {
+		t.Helper()
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.DeleteResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Reclaimed
+	}
+
+	// the weights are shared with keep, so only the system prompts and
+	// configs are reclaimed
+	dryRun := reclaimed(createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "exp-1", Models: []string{"exp-2"}, DryRun: true}))
+	if dryRun == 0 {
+		t.Error("expected space to be reclaimed")
+	}
+
+	m, err := GetModel("exp-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.sched.loaded[m.ModelPath] = &runnerRef{model: m, modelPath: m.ModelPath}
+
+	w := createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "exp-1", Models: []string{"exp-2"}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status code 409, actual %d", w.Code)
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{
+		filepath.Join(p, "manifests", "registry.ollama.ai", "library", "exp-1", "latest"),
+		filepath.Join(p, "manifests", "registry.ollama.ai", "library", "exp-2", "latest"),
+		filepath.Join(p, "manifests", "registry.ollama.ai", "library", "keep", "latest"),
+	})
+
+	// keep uses the same weights, but isn't loaded itself
+	if runners := s.sched.loadedAs(model.ParseName("keep")); len(runners) != 0 {
+		t.Errorf("expected keep not to be loaded, got %v", runners)
+	}
+
+	s.sched.expiredCh = make(chan *runnerRef, 1)
+	if got := reclaimed(createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "exp-1", Models: []string{"exp-2"}, Force: true})); got != dryRun {
+		t.Errorf("expected %d bytes reclaimed, got %d", dryRun, got)
+	}
+
+	if len(s.sched.expiredCh) != 1 {
+		t.Error("expected the loaded model to be unloaded")
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{
+		filepath.Join(p, "manifests", "registry.ollama.ai", "library", "keep", "latest"),
+	})
+
+	// a tag whose blobs are all used by another reclaims nothing
+	w = createRequest(t, s.CopyHandler, api.CopyRequest{Source: "keep", Destination: "keep-copy"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	if got := reclaimed(createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "keep-copy"})); got != 0 {
+		t.Errorf("expected nothing reclaimed, got %d", got)
+	}
+}
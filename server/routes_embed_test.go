@@ -0,0 +1,674 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+type mockEmbedRunner struct {
+	llm.LlamaServer
+
+	embeddings map[string][]float32
+
+	// slots is the number of parallel requests the runner is loaded with
+	slots int
+
+	// barrier, if set, holds each embedding until that many are running at
+	// once, so the peak concurrency doesn't depend on timing
+	barrier int
+
+	mu           sync.Mutex
+	active, peak int
+	reached      bool
+
+	// loads is the number of times the runner has been loaded
+	loads int
+}
+
+func (m *mockEmbedRunner) Embedding(_ context.Context, input string) ([]float32, error) {
+	m.mu.Lock()
+	m.active++
+	m.peak = max(m.peak, m.active)
+	if m.active >= m.barrier {
+		m.reached = true
+	}
+	m.mu.Unlock()
+
+	// the barrier is only waited for until it's first reached, and never
+	// longer than a second, so a handler that runs fewer embeddings at once
+	// fails the test rather than hanging it
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		m.mu.Lock()
+		reached := m.reached
+		m.mu.Unlock()
+		if reached {
+			break
+		}
+	}
+
+	m.mu.Lock()
+	m.active--
+	m.mu.Unlock()
+
+	e, ok := m.embeddings[input]
+	if !ok {
+		return nil, fmt.Errorf("unexpected input %q", input)
+	}
+
+	// the handler may modify the embedding in place
+	return append([]float32{}, e...), nil
+}
+
+// Tokenize returns one token per word, using the word itself as the token
+// when it is a number so that Detokenize can recover truncated inputs
+func (*mockEmbedRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
+	for _, word := range strings.Fields(s) {
+		n, err := strconv.Atoi(word)
+		if err != nil {
+			n = len(tokens)
+		}
+		tokens = append(tokens, n)
+	}
+
+	return
+}
+
+func (*mockEmbedRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = strconv.Itoa(t)
+	}
+	return strings.Join(words, " "), nil
+}
+
+func newEmbedServer(t *testing.T, mock *mockEmbedRunner) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{
+		sched: &Scheduler{
+			queues:        newRequestQueues(1, 0),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				mock.mu.Lock()
+				mock.loads++
+				mock.mu.Unlock()
+				req.successCh <- &runnerRef{
+					llama:       mock,
+					numParallel: mock.slots,
+				}
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test-embed",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":      "bert",
+			"bert.block_count":          uint32(1),
+			"bert.context_length":       uint32(8),
+			"bert.embedding_length":     uint32(4),
+			"bert.pooling_type":         uint32(1),
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	return s
+}
+
+// normalized returns the unit vector of the first n dimensions of v, computed in float64
+func normalized(v []float32, n int) []float64 {
+	var sum float64
+	for _, x := range v[:n] {
+		sum += float64(x) * float64(x)
+	}
+
+	ret := make([]float64, n)
+	for i, x := range v[:n] {
+		ret[i] = float64(x) / math.Sqrt(sum)
+	}
+	return ret
+}
+
+func TestEmbedDimensions(t *testing.T) {
+	mock := mockEmbedRunner{
+		embeddings: map[string][]float32{
+			"hello":       {0.5, -1.25, 3, 0.125},
+			"hello world": {-2, 0.75, 0.5, 4},
+		},
+	}
+	s := newEmbedServer(t, &mock)
+
+	t.Run("full", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: []string{"hello", "hello world"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, input := range []string{"hello", "hello world"} {
+			expectEmbedding(t, normalized(mock.embeddings[input], 4), resp.Embeddings[i])
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: []string{"hello", "hello world"}, Dimensions: 2})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Embeddings) != 2 {
+			t.Fatalf("expected 2 embeddings, got %d", len(resp.Embeddings))
+		}
+
+		for i, input := range []string{"hello", "hello world"} {
+			expectEmbedding(t, normalized(mock.embeddings[input], 2), resp.Embeddings[i])
+		}
+	})
+
+	t.Run("truncated without normalize", func(t *testing.T) {
+		normalize := false
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "hello", Dimensions: 3, Normalize: &normalize})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the leading dimensions of the full unit vector
+		expectEmbedding(t, normalized(mock.embeddings["hello"], 4)[:3], resp.Embeddings[0])
+	})
+
+	t.Run("maximum", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "hello", Dimensions: 4})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	for name, dimensions := range map[string]int{"too large": 5, "negative": -1} {
+		t.Run(name, func(t *testing.T) {
+			w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "hello", Dimensions: dimensions})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("too large message", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "hello", Dimensions: 1024})
+		if !strings.Contains(w.Body.String(), "between 1 and 4") {
+			t.Errorf("expected error to include the model's maximum, got %s", w.Body.String())
+		}
+	})
+}
+
+func TestEmbedEncoding(t *testing.T) {
+	mock := mockEmbedRunner{
+		embeddings: map[string][]float32{
+			"hello":       {0.5, -1.25, 3, 0.125},
+			"hello world": {-2, 0.75, 0.5, 4},
+		},
+	}
+	s := newEmbedServer(t, &mock)
+	inputs := []string{"hello", "hello world"}
+
+	embed := func(t *testing.T, format string) api.EmbedResponse {
+		t.Helper()
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: inputs, EncodingFormat: format})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if format != "float" && len(resp.Embeddings) != 0 {
+			t.Errorf("expected no float embeddings, got %d", len(resp.Embeddings))
+		}
+		return resp
+	}
+
+	t.Run("base64", func(t *testing.T) {
+		resp := embed(t, "base64")
+		if len(resp.EncodedEmbeddings) != len(inputs) {
+			t.Fatalf("expected %d encoded embeddings, got %d", len(inputs), len(resp.EncodedEmbeddings))
+		}
+
+		for i, input := range inputs {
+			b, err := base64.StdEncoding.DecodeString(resp.EncodedEmbeddings[i].Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := make([]float32, len(b)/4)
+			if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, actual); err != nil {
+				t.Fatal(err)
+			}
+
+			expectEmbedding(t, normalized(mock.embeddings[input], 4), actual)
+		}
+	})
+
+	t.Run("int8", func(t *testing.T) {
+		resp := embed(t, "int8")
+		if len(resp.EncodedEmbeddings) != len(inputs) {
+			t.Fatalf("expected %d encoded embeddings, got %d", len(inputs), len(resp.EncodedEmbeddings))
+		}
+
+		for i, input := range inputs {
+			e := resp.EncodedEmbeddings[i]
+			b, err := base64.StdEncoding.DecodeString(e.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expect := normalized(mock.embeddings[input], 4)
+			if len(b) != len(expect) {
+				t.Fatalf("expected %d dimensions, got %d", len(expect), len(b))
+			}
+
+			var lo, hi int8 = 127, -128
+			for j, q := range b {
+				lo, hi = min(lo, int8(q)), max(hi, int8(q))
+				v := float64(e.Offset + e.Scale*float32(int8(q)))
+				if math.Abs(expect[j]-v) > float64(e.Scale)/2+1e-6 {
+					t.Errorf("dimension %d: expected %f, got %f", j, expect[j], v)
+				}
+			}
+
+			if lo != -128 || hi != 127 {
+				t.Errorf("expected values to span [-128, 127], got [%d, %d]", lo, hi)
+			}
+		}
+	})
+
+	t.Run("float", func(t *testing.T) {
+		resp := embed(t, "float")
+		if len(resp.EncodedEmbeddings) != 0 {
+			t.Errorf("expected no encoded embeddings, got %d", len(resp.EncodedEmbeddings))
+		}
+
+		for i, input := range inputs {
+			expectEmbedding(t, normalized(mock.embeddings[input], 4), resp.Embeddings[i])
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "hello", EncodingFormat: "binary"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("empty input", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: []string{}, EncodingFormat: "int8"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := resp["encoded_embeddings"]; ok {
+			t.Errorf("expected no encoded embeddings, got %v", resp["encoded_embeddings"])
+		}
+	})
+}
+
+func TestEmbedTruncate(t *testing.T) {
+	long := "1 2 3 4 5 6 7 8 9 10"
+	mock := mockEmbedRunner{
+		embeddings: map[string][]float32{
+			"hello":            {0.5, -1.25, 3, 0.125},
+			"1 2 3 4 5 6 7 8":  {1, 0, 0, 0},
+			"3 4 5 6 7 8 9 10": {0, 1, 0, 0},
+		},
+	}
+	s := newEmbedServer(t, &mock)
+
+	embed := func(t *testing.T, req api.EmbedRequest) api.EmbedResponse {
+		t.Helper()
+		w := createRequest(t, s.EmbedHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	cases := []struct {
+		name     string
+		truncate api.Truncate
+		expect   []float32
+	}{
+		{"default", "", mock.embeddings["1 2 3 4 5 6 7 8"]},
+		{"end", api.TruncateEnd, mock.embeddings["1 2 3 4 5 6 7 8"]},
+		{"start", api.TruncateStart, mock.embeddings["3 4 5 6 7 8 9 10"]},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := embed(t, api.EmbedRequest{Model: "test-embed", Input: []string{"hello", long}, TruncateMode: tt.truncate})
+			if len(resp.Embeddings) != 2 {
+				t.Fatalf("expected 2 embeddings, got %d", len(resp.Embeddings))
+			}
+
+			expectEmbedding(t, normalized(mock.embeddings["hello"], 4), resp.Embeddings[0])
+			expectEmbedding(t, normalized(tt.expect, 4), resp.Embeddings[1])
+
+			if !slices.Equal(resp.PromptEvalCounts, []int{1, 8}) {
+				t.Errorf("expected prompt eval counts [1 8], got %v", resp.PromptEvalCounts)
+			}
+
+			if !slices.Equal(resp.Truncated, []bool{false, true}) {
+				t.Errorf("expected truncated [false true], got %v", resp.Truncated)
+			}
+
+			if resp.PromptEvalCount != 9 {
+				t.Errorf("expected 9 prompt tokens, got %d", resp.PromptEvalCount)
+			}
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: []string{long, "hello", long}, TruncateMode: api.TruncateNone})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), "inputs at index 0, 2") {
+			t.Errorf("expected error to list the inputs that are too long, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("none within context", func(t *testing.T) {
+		resp := embed(t, api.EmbedRequest{Model: "test-embed", Input: "hello", TruncateMode: api.TruncateNone})
+		if !slices.Equal(resp.Truncated, []bool{false}) {
+			t.Errorf("expected truncated [false], got %v", resp.Truncated)
+		}
+	})
+
+	t.Run("boolean", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, map[string]any{"model": "test-embed", "input": long, "truncate": false})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.EmbedHandler, map[string]any{"model": "test-embed", "input": long, "truncate": true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// the mode overrides the boolean
+		w = createRequest(t, s.EmbedHandler, map[string]any{"model": "test-embed", "input": long, "truncate": false, "truncate_mode": "start"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, map[string]any{"model": "test-embed", "input": long, "truncate_mode": "middle"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestEmbedParallel(t *testing.T) {
+	var input []string
+	embeddings := map[string][]float32{}
+	for i := range 32 {
+		doc := fmt.Sprintf("doc %d", i)
+		input = append(input, doc)
+		embeddings[doc] = []float32{1, float32(i), 0, 0}
+	}
+
+	embed := func(t *testing.T, mock *mockEmbedRunner, req api.EmbedRequest) api.EmbedResponse {
+		t.Helper()
+		s := newEmbedServer(t, mock)
+
+		w := createRequest(t, s.EmbedHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// inputs should be embedded on all of the runner's slots at once while
+	// results stay in input order
+	for _, slots := range []int{1, 2, 4} {
+		t.Run(fmt.Sprintf("%d slots", slots), func(t *testing.T) {
+			mock := mockEmbedRunner{embeddings: embeddings, slots: slots, barrier: slots}
+			resp := embed(t, &mock, api.EmbedRequest{Model: "test-embed", Input: input})
+
+			if mock.peak != slots {
+				t.Errorf("expected %d concurrent embeddings, got %d", slots, mock.peak)
+			}
+
+			if len(resp.Embeddings) != len(input) {
+				t.Fatalf("expected %d embeddings, got %d", len(input), len(resp.Embeddings))
+			}
+
+			for i, doc := range input {
+				expectEmbedding(t, normalized(embeddings[doc], 4), resp.Embeddings[i])
+			}
+		})
+	}
+
+	t.Run("request concurrency", func(t *testing.T) {
+		mock := mockEmbedRunner{embeddings: embeddings, slots: 4, barrier: 2}
+		embed(t, &mock, api.EmbedRequest{Model: "test-embed", Input: input, Concurrency: 2})
+		if mock.peak != 2 {
+			t.Errorf("expected 2 concurrent embeddings, got %d", mock.peak)
+		}
+	})
+
+	t.Run("request concurrency above slots", func(t *testing.T) {
+		mock := mockEmbedRunner{embeddings: embeddings, slots: 2, barrier: 2}
+		embed(t, &mock, api.EmbedRequest{Model: "test-embed", Input: input, Concurrency: 8})
+		if mock.peak != 2 {
+			t.Errorf("expected 2 concurrent embeddings, got %d", mock.peak)
+		}
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		mock := mockEmbedRunner{embeddings: embeddings, slots: 4}
+		resp := embed(t, &mock, api.EmbedRequest{Model: "test-embed", Input: []string{"doc 0", "unknown", "doc 2"}})
+
+		if len(resp.Errors) != 3 || resp.Errors[0] != "" || resp.Errors[1] == "" || resp.Errors[2] != "" {
+			t.Fatalf("expected only the second input to fail, got %q", resp.Errors)
+		}
+
+		if len(resp.Embeddings[1]) != 0 {
+			t.Errorf("expected empty embedding for the failed input, got %v", resp.Embeddings[1])
+		}
+
+		expectEmbedding(t, normalized(embeddings["doc 0"], 4), resp.Embeddings[0])
+		expectEmbedding(t, normalized(embeddings["doc 2"], 4), resp.Embeddings[2])
+	})
+
+	t.Run("complete failure", func(t *testing.T) {
+		s := newEmbedServer(t, &mockEmbedRunner{slots: 4})
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: []string{"unknown"}})
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid concurrency", func(t *testing.T) {
+		s := newEmbedServer(t, &mockEmbedRunner{})
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "doc 0", Concurrency: -1})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestEmbedPooling(t *testing.T) {
+	mock := mockEmbedRunner{
+		embeddings: map[string][]float32{
+			"hello": {0.5, -1.25, 3, 0.125},
+		},
+	}
+	s := newEmbedServer(t, &mock)
+
+	show := func(t *testing.T, name string) *api.Pooling {
+		t.Helper()
+		w := createRequest(t, s.ShowHandler, api.ShowRequest{Name: name})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ShowResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Pooling
+	}
+
+	t.Run("show metadata", func(t *testing.T) {
+		if diff := cmp.Diff(&api.Pooling{Metadata: "mean", Effective: "mean"}, show(t, "test-embed")); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("show override", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-embed-cls",
+			Modelfile: "FROM test-embed\nPARAMETER pooling_type cls",
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(&api.Pooling{Metadata: "mean", Override: "cls", Effective: "cls"}, show(t, "test-embed-cls")); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("create invalid", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-embed-max",
+			Modelfile: "FROM test-embed\nPARAMETER pooling_type max",
+		})
+		if !strings.Contains(w.Body.String(), "invalid pooling_type") {
+			t.Fatalf("expected an invalid pooling_type error, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("request override", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "hello", Options: map[string]any{"pooling_type": "last"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	for name, pooling := range map[string]string{"none": "none", "invalid": "max"} {
+		t.Run(name, func(t *testing.T) {
+			w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed", Input: "hello", Options: map[string]any{"pooling_type": pooling}})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("none before loading", func(t *testing.T) {
+		var mock mockEmbedRunner
+		s := newEmbedServer(t, &mock)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-embed-none",
+			Modelfile: "FROM test-embed\nPARAMETER pooling_type none",
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test-embed-none", Input: "hello"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		if mock.loads != 0 {
+			t.Errorf("expected the model not to be loaded, got %d loads", mock.loads)
+		}
+	})
+}
+
+func expectEmbedding(t *testing.T, expect []float64, actual []float32) {
+	t.Helper()
+
+	if len(expect) != len(actual) {
+		t.Fatalf("expected %d dimensions, got %d", len(expect), len(actual))
+	}
+
+	for i := range expect {
+		if math.Abs(expect[i]-float64(actual[i])) > 1e-6 {
+			t.Errorf("dimension %d: expected %f, got %f", i, expect[i], actual[i])
+		}
+	}
+}
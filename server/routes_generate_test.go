@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,15 +30,29 @@ type mockRunner struct {
 	// CompletionRequest is only valid until the next call to Completion
 	llm.CompletionRequest
 	llm.CompletionResponse
+
+	// seeds records the seed of each completion, as requests made with n run
+	// several completions concurrently
+	mu    sync.Mutex
+	seeds []int
+
+	loadProgress float32
 }
 
 func (m *mockRunner) Completion(_ context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	m.mu.Lock()
 	m.CompletionRequest = r
+	m.seeds = append(m.seeds, r.Options.Seed)
+	m.mu.Unlock()
 	fn(m.CompletionResponse)
 	return nil
 }
 
-func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
+func (m *mockRunner) LoadProgress() float32 {
+	return m.loadProgress
+}
+
+func (*mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
 	for range strings.Fields(s) {
 		tokens = append(tokens, len(tokens))
 	}
@@ -41,8 +60,8 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int, *llm.MemoryEstimate) (llm.LlamaServer, error) {
+	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -63,11 +82,12 @@ func TestGenerateChat(t *testing.T) {
 
 	s := Server{
 		sched: &Scheduler{
-			pendingReqCh:  make(chan *LlmRequest, 1),
+			queues:        newRequestQueues(1, 0),
 			finishedReqCh: make(chan *LlmRequest, 1),
 			expiredCh:     make(chan *runnerRef, 1),
 			unloadedCh:    make(chan any, 1),
 			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
 			newServerFn:   newMockServer(&mock),
 			getGpuFn:      gpu.GetGPUInfo,
 			getCpuFn:      gpu.GetCPUInfo,
@@ -165,7 +185,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support chat"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"capabilities":["completion"],"code":"missing_capability","error":"\"bert\" does not support chat"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -343,6 +363,276 @@ func TestGenerateChat(t *testing.T) {
 
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
+
+	t.Run("use model system", func(t *testing.T) {
+		s.presets = map[string]api.Preset{
+			"magic": {Name: "magic", System: "You can perform magic tricks."},
+		}
+		defer func() { s.presets = nil }()
+
+		f := false
+		cases := []struct {
+			name           string
+			model          string
+			system         string
+			preset         string
+			useModelSystem *bool
+			expect         string
+			source         string
+		}{
+			{"model", "test-system", "", "", nil, "You are a helpful assistant.", "model"},
+			{"without model", "test-system", "", "", &f, "", ""},
+			{"request", "test-system", "Be brief.", "", &f, "Be brief.", "request"},
+			{"model over preset", "test-system", "", "magic", nil, "You are a helpful assistant.", "model"},
+			{"preset without model", "test-system", "", "magic", &f, "You can perform magic tricks.", "preset"},
+			{"preset for model without system", "test", "", "magic", nil, "You can perform magic tricks.", "preset"},
+			{"request over preset", "test-system", "Be brief.", "magic", &f, "Be brief.", "request"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				var msgs []api.Message
+				if tt.system != "" {
+					msgs = append(msgs, api.Message{Role: "system", Content: tt.system})
+				}
+
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:          tt.model,
+					Messages:       append(msgs, api.Message{Role: "user", Content: "Hello!"}),
+					Preset:         tt.preset,
+					UseModelSystem: tt.useModelSystem,
+					ReturnOptions:  true,
+					Stream:         &stream,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				prompt := "User: Hello! "
+				if tt.expect != "" {
+					prompt = "System: " + tt.expect + " " + prompt
+				}
+
+				if diff := cmp.Diff(mock.CompletionRequest.Prompt, prompt); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				// the system message used is returned with the options
+				if resp.System != tt.expect || resp.SystemSource != tt.source {
+					t.Errorf("expected system %q from %q, got %q from %q", tt.expect, tt.source, resp.System, resp.SystemSource)
+				}
+			})
+		}
+	})
+
+	t.Run("n", func(t *testing.T) {
+		mock.mu.Lock()
+		mock.seeds = nil
+		mock.mu.Unlock()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			N:       3,
+			Options: map[string]any{"seed": 42},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var indexes []int
+		decoder := json.NewDecoder(w.Body)
+		for decoder.More() {
+			var actual api.ChatResponse
+			if err := decoder.Decode(&actual); err != nil {
+				t.Fatal(err)
+			}
+			indexes = append(indexes, actual.Index)
+		}
+
+		slices.Sort(indexes)
+		if diff := cmp.Diff(indexes, []int{0, 1, 2}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		// each choice is sampled with a different seed
+		slices.Sort(mock.seeds)
+		if diff := cmp.Diff(mock.seeds, []int{42, 43, 44}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("n without streaming", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			N:      2,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"n greater than 1 requires streaming"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("n above maximum", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_CHOICES", "2")
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			N: 3,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"n must be at most 2"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("unbounded stop regex", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"stop_regex": []string{`(?m)^User:.*`}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "may match more than 256 bytes") {
+			t.Errorf("expected the error to explain the limit, got %s", w.Body.String())
+		}
+	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:     "test-think",
+		Modelfile: "FROM test\nTEMPLATE \"{{ if .Prompt }}User: {{ .Prompt }} {{ end }}Assistant: <think>\"",
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	mock.CompletionResponse.Content = "They said hello.\n</think>\n\nHi!"
+	t.Run("reasoning", func(t *testing.T) {
+		cases := []struct {
+			reasoning         string
+			content, thinking string
+		}{
+			{"", "They said hello.\n</think>\n\nHi!", ""},
+			{"include", "They said hello.\n</think>\n\nHi!", ""},
+			{"separate", "Hi!", "They said hello.\n"},
+			{"strip", "Hi!", ""},
+		}
+
+		for _, tt := range cases {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:     "test-think",
+				Messages:  []api.Message{{Role: "user", Content: "Hello!"}},
+				Reasoning: tt.reasoning,
+				Stream:    &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status 200, got %d", tt.reasoning, w.Code)
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Message.Content != tt.content || resp.Message.Thinking != tt.thinking {
+				t.Errorf("%s: expected content %q and thinking %q, got %q and %q", tt.reasoning, tt.content, tt.thinking, resp.Message.Content, resp.Message.Thinking)
+			}
+
+			if resp.EvalCount != 1 {
+				t.Errorf("%s: expected the thinking to be counted, got %d", tt.reasoning, resp.EvalCount)
+			}
+		}
+	})
+
+	t.Run("invalid reasoning", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:     "test-think",
+			Messages:  []api.Message{{Role: "user", Content: "Hello!"}},
+			Reasoning: "hide",
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	mock.CompletionResponse.Content = "Hi!"
+	t.Run("messages with template", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test-system",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Template: `{{- range .Messages }}<{{ .Role }}>{{ .Content }}</{{ .Role }}>{{ end }}`,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "<system>You are a helpful assistant.</system><user>Hello!</user>"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		// the override is only for the request
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test-system",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "System: You are a helpful assistant. User: Hello! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test-system",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Template: `{{ .Prompt`,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -361,11 +651,12 @@ func TestGenerate(t *testing.T) {
 
 	s := Server{
 		sched: &Scheduler{
-			pendingReqCh:  make(chan *LlmRequest, 1),
+			queues:        newRequestQueues(1, 0),
 			finishedReqCh: make(chan *LlmRequest, 1),
 			expiredCh:     make(chan *runnerRef, 1),
 			unloadedCh:    make(chan any, 1),
 			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
 			newServerFn:   newMockServer(&mock),
 			getGpuFn:      gpu.GetGPUInfo,
 			getCpuFn:      gpu.GetCPUInfo,
@@ -463,7 +754,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support generate"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"capabilities":["completion"],"code":"missing_capability","error":"\"bert\" does not support generate"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -479,11 +770,76 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"test does not support insert"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"capabilities":["insert"],"code":"missing_capability","error":"test does not support insert"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("missing capabilities vision", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "describe this image",
+			Images: []api.ImageData{[]byte("image")},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"capabilities":["vision"],"code":"missing_capability","error":"test does not support vision"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
 
+	t.Run("unsupported architecture", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "unsupported",
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": "gemma3"}, nil)),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "unsupported",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		var actual struct {
+			api.UnsupportedModelError
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Code != unsupportedModelCode || actual.Architecture != "gemma3" || actual.GGUFVersion != 3 || actual.MinVersion != "0.6.0" {
+			t.Errorf("unexpected error %+v", actual)
+		}
+
+		// the model can still be shown, flagged with what it needs
+		w = createRequest(t, s.ShowHandler, api.ShowRequest{Model: "unsupported"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var show api.ShowResponse
+		if err := json.NewDecoder(w.Body).Decode(&show); err != nil {
+			t.Fatal(err)
+		}
+
+		if show.Unsupported == nil || show.Unsupported.MinVersion != "0.6.0" || show.ModelInfo["general.architecture"] != "gemma3" {
+			t.Errorf("expected the model to be flagged as unsupported, got %+v", show)
+		}
+	})
+
 	t.Run("load model", func(t *testing.T) {
 		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model: "test",
@@ -583,6 +939,95 @@ func TestGenerate(t *testing.T) {
 		checkGenerateResponse(t, w.Body, "test", "Hi!")
 	})
 
+	t.Run("return options", func(t *testing.T) {
+		t.Setenv("OLLAMA_USE_MMAP", "false")
+		t.Setenv("OLLAMA_USE_MLOCK", "true")
+		t.Setenv("OLLAMA_DEFAULT_OPTIONS", "temperature=0.3, num_ctx=4096, top_k=5")
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-params",
+			Modelfile: "FROM test\nPARAMETER temperature 0\nPARAMETER top_k 10\nPARAMETER use_mlock false",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:         "test-params",
+			Prompt:        "Hello!",
+			Stream:        &stream,
+			ReturnOptions: true,
+			Options:       map[string]any{"top_k": 20},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var actual api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		// the request's options take precedence over the model's, which take
+		// precedence over the environment and the defaults
+		expect := map[string]any{
+			"top_k":       float64(20),
+			"temperature": float64(0),
+			"num_ctx":     float64(4096),
+			"use_mlock":   false,
+			"use_mmap":    false,
+			"top_p":       float64(0.9),
+			"seed":        float64(mock.CompletionRequest.Options.Seed),
+		}
+
+		for k, v := range expect {
+			if diff := cmp.Diff(actual.Options[k], v); diff != "" {
+				t.Errorf("%s mismatch (-got +want):\n%s", k, diff)
+			}
+		}
+
+		sources := map[string]string{
+			"top_k":       "request",
+			"temperature": "model",
+			"use_mlock":   "model",
+			"num_ctx":     "server",
+			"use_mmap":    "server",
+			"top_p":       "default",
+			"seed":        "default",
+		}
+
+		for k, v := range sources {
+			if actual.OptionSources[k] != v {
+				t.Errorf("expected %s to come from %s, got %q", k, v, actual.OptionSources[k])
+			}
+		}
+
+		if mock.CompletionRequest.Options.Seed < 0 {
+			t.Errorf("expected the random seed to be replaced, got %d", mock.CompletionRequest.Options.Seed)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-params",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if strings.Contains(w.Body.String(), `"options"`) {
+			t.Errorf("expected no options without return_options, got %s", w.Body.String())
+		}
+
+		if mock.CompletionRequest.Options.Seed != -1 {
+			t.Errorf("expected the seed to be left random, got %d", mock.CompletionRequest.Options.Seed)
+		}
+	})
+
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
 		Model:     "test-system",
 		Modelfile: "FROM test\nSYSTEM You are a helpful assistant.",
@@ -630,6 +1075,93 @@ func TestGenerate(t *testing.T) {
 		checkGenerateResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
+	s.presets = map[string]api.Preset{
+		"magic": {Name: "magic", Options: map[string]any{"temperature": 0.1, "top_k": float64(5)}, System: "You can perform magic tricks."},
+	}
+	defer func() { s.presets = nil }()
+
+	t.Run("prompt with preset", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-system",
+			Prompt:  "Hello!",
+			Preset:  "magic",
+			Options: map[string]any{"top_k": 7},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		// the model's system message takes precedence over the preset's
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "System: You are a helpful assistant. User: Hello! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if opts := mock.CompletionRequest.Options; opts.Temperature != 0.1 || opts.TopK != 7 {
+			t.Errorf("expected the preset's options under the request's, got temperature %v, top_k %d", opts.Temperature, opts.TopK)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Preset: "magic",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		// models without a system message use the preset's
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "System: You can perform magic tricks. User: Hello! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("unknown preset", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Hello!",
+			Preset: "code",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"preset \"code\" not found, expected one of magic","presets":["magic"]}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("prompt with alias", func(t *testing.T) {
+		if err := s.aliases.set(api.Alias{Name: "default", Models: []string{"test-system"}}); err != nil {
+			t.Fatal(err)
+		}
+		defer s.aliases.remove("default")
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "default",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "default" || resp.ResolvedModel != "test-system:latest" {
+			t.Errorf("expected default resolved to test-system:latest, got %s resolved to %s", resp.Model, resp.ResolvedModel)
+		}
+	})
+
 	t.Run("prompt with template", func(t *testing.T) {
 		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model:  "test-system",
@@ -711,4 +1243,267 @@ TEMPLATE """{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:     "test-raw",
+		Modelfile: "FROM test\nSYSTEM You are a helpful assistant.\nMESSAGE user Hi!\nMESSAGE assistant Hello!\nPARAMETER stop User:\nPARAMETER stop_token_ids 2",
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	mock.CompletionResponse.PromptTokens = 7
+	t.Run("raw ignores the template", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-raw",
+			Prompt: "<s>[INST] Help me write tests. [/INST]",
+			Raw:    true,
+			AddBOS: &[]bool{false}[0],
+			AddEOS: &[]bool{true}[0],
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req := mock.CompletionRequest
+		if diff := cmp.Diff(req.Prompt, "<s>[INST] Help me write tests. [/INST]"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if len(req.Options.Stop) > 0 || len(req.Options.StopTokenIDs) > 0 {
+			t.Errorf("expected the model's stop sequences not to be used, got %v and %v", req.Options.Stop, req.Options.StopTokenIDs)
+		}
+
+		if req.AddBOS == nil || *req.AddBOS || !req.AddEOS {
+			t.Errorf("expected add_bos false and add_eos true, got %v and %v", req.AddBOS, req.AddEOS)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PromptTokens != 7 || resp.Context != nil {
+			t.Errorf("expected the prompt's tokens and no context, got %d and %v", resp.PromptTokens, resp.Context)
+		}
+	})
+
+	t.Run("raw with request stop", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-raw",
+			Prompt:  "Q: Help me write tests. A:",
+			Raw:     true,
+			Options: map[string]any{"stop": []string{"Q:"}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req := mock.CompletionRequest
+		if diff := cmp.Diff(req.Options.Stop, []string{"Q:"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if req.AddBOS != nil || req.AddEOS {
+			t.Errorf("expected the model's BOS and no EOS, got %v and %v", req.AddBOS, req.AddEOS)
+		}
+	})
+
+	t.Run("not raw keeps the template", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-raw",
+			Prompt: "Help me write tests.",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req := mock.CompletionRequest
+		if diff := cmp.Diff(req.Prompt, "System: You are a helpful assistant. User: Hi! Assistant: Hello! User: Help me write tests. "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(req.Options.Stop, []string{"User:"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PromptTokens != 0 {
+			t.Errorf("expected no prompt tokens outside raw mode, got %d", resp.PromptTokens)
+		}
+	})
+
+	t.Run("add_bos without raw", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-raw",
+			Prompt: "Help me write tests.",
+			AddBOS: &[]bool{true}[0],
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"add_bos and add_eos are only supported in raw mode"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+	mock.CompletionResponse.PromptTokens = 0
+
+	mock.CompletionResponse.Content = "<think>A greeting.</think>Hi!"
+	t.Run("reasoning", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:     "test",
+			Prompt:    "Hello!",
+			Template:  "Think in <think></think> tags. {{ .Prompt }}",
+			Reasoning: "separate",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hi!" || resp.Thinking != "A greeting." {
+			t.Errorf("expected the thinking to be separate, got %q and %q", resp.Response, resp.Thinking)
+		}
+	})
+}
+
+func TestGenerateLoadStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{Content: "hi", Done: true, DoneReason: "stop"},
+		loadProgress:       0.43,
+	}
+
+	var loadErr error
+	s := &Server{
+		sched: &Scheduler{
+			queues:        newRequestQueues(1, 0),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+		},
+	}
+	s.sched.loadFn = func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+		// Hold the runner in the loading state for a few status intervals
+		runner := &runnerRef{llama: &mock, model: req.model, modelPath: req.model.ModelPath, loading: true}
+		runner.refMu.Lock()
+		s.sched.loadedMu.Lock()
+		s.sched.loaded[runner.key()] = runner
+		s.sched.loadedMu.Unlock()
+
+		go func() {
+			time.Sleep(3 * loadStatusInterval / 2)
+			s.sched.loadedMu.Lock()
+			defer s.sched.loadedMu.Unlock()
+			runner.loading = false
+			runner.refMu.Unlock()
+			if loadErr != nil {
+				delete(s.sched.loaded, runner.key())
+				req.errCh <- loadErr
+				return
+			}
+			req.successCh <- runner
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	stream := false
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture": "llama",
+		}, []llm.Tensor{})),
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	generate := func(t *testing.T) []api.GenerateResponse {
+		t.Helper()
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := api.NewClient(u, srv.Client())
+		var resps []api.GenerateResponse
+		err = client.Generate(ctx, &api.GenerateRequest{Model: "test", Prompt: "hello"}, func(r api.GenerateResponse) error {
+			resps = append(resps, r)
+			return nil
+		})
+		if loadErr != nil {
+			if err == nil || !strings.Contains(err.Error(), loadErr.Error()) {
+				t.Fatalf("expected load error, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return resps
+	}
+
+	t.Run("loading", func(t *testing.T) {
+		resps := generate(t)
+		if len(resps) < 2 {
+			t.Fatalf("expected load status before the response, got %+v", resps)
+		}
+
+		for _, r := range resps[:len(resps)-1] {
+			if r.Status != "loading model: 43%" || r.Done || r.Response != "" {
+				t.Errorf("unexpected status object %+v", r)
+			}
+		}
+
+		last := resps[len(resps)-1]
+		if last.Status != "" || last.Response != "hi" || !last.Done {
+			t.Errorf("unexpected response %+v", last)
+		}
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		s.sched.loadedMu.Lock()
+		clear(s.sched.loaded)
+		s.sched.loadedMu.Unlock()
+
+		loadErr = errors.New("no progress for 5m0s, stalled at 43% loaded")
+		defer func() { loadErr = nil }()
+
+		resps := generate(t)
+		if len(resps) == 0 || resps[0].Status != "loading model: 43%" {
+			t.Errorf("expected load status before the error, got %+v", resps)
+		}
+	})
 }
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestPinned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := ParseNamedManifest(model.ParseName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := "test@sha256:" + m.digest
+	stream := false
+
+	t.Run("show", func(t *testing.T) {
+		w := createRequest(t, s.ShowHandler, api.ShowRequest{Name: pinned})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.ShowHandler, api.ShowRequest{Name: "test@sha256:" + strings.Repeat("0", 64)})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+
+		w = createRequest(t, s.ShowHandler, api.ShowRequest{Name: pinned[:len(pinned)-8]})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "digest is truncated, it has 56 of the 64 hex characters") {
+			t.Errorf("expected a truncated digest error, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("unchangeable", func(t *testing.T) {
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "test", Destination: "test2@sha256:" + m.digest})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "models pinned to a digest can't be changed") {
+			t.Errorf("expected copying to a digest to fail, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.CreateHandler, api.CreateRequest{Name: pinned, Modelfile: "FROM test"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected creating a digest to fail, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Name: pinned})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected deleting an unpinned digest to fail, got %d", w.Code)
+		}
+	})
+
+	t.Run("pull local", func(t *testing.T) {
+		// the default registry isn't reachable in tests, so this only
+		// succeeds without contacting it
+		w := createRequest(t, s.PullHandler, api.PullRequest{Name: pinned, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.ListHandler, nil)
+		var resp api.ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range resp.Models {
+			names = append(names, m.Name)
+		}
+
+		slices.Sort(names)
+		if !slices.Equal(names, []string{"test:latest", pinned}) {
+			t.Errorf("expected the pinned model to be listed, got %v", names)
+		}
+
+		// the pin outlives its tag
+		w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Name: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if _, err := GetModel(pinned); err != nil {
+			t.Fatal(err)
+		}
+
+		w = createRequest(t, s.CopyHandler, api.CopyRequest{Source: pinned, Destination: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Name: pinned})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	})
+
+	t.Run("pull registry", func(t *testing.T) {
+		b, err := os.ReadFile(filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test", "latest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var requests []string
+		registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.URL.Path)
+			w.Write(b)
+		}))
+		defer registry.Close()
+
+		u, err := url.Parse(registry.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := fmt.Sprintf("http://%s/library/test@sha256:%s", u.Host, m.digest)
+		w := createRequest(t, s.PullHandler, api.PullRequest{Name: name, Insecure: true, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		if want := []string{"/v2/library/test/manifests/sha256:" + m.digest}; !slices.Equal(requests, want) {
+			t.Errorf("expected requests %v, got %v", want, requests)
+		}
+
+		pulled, err := os.ReadFile(filepath.Join(p, "manifests", u.Host, "library", "test", "sha256-"+m.digest))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(pulled, b) {
+			t.Error("expected the manifest to be written as the registry sent it")
+		}
+
+		b = append(b, '\n')
+		name = fmt.Sprintf("http://%s/library/other@sha256:%s", u.Host, m.digest)
+		w = createRequest(t, s.PullHandler, api.PullRequest{Name: name, Insecure: true, Stream: &stream})
+		if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "the registry's manifest has the digest") {
+			t.Errorf("expected a digest mismatch, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
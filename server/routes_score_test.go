@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// mockScoreRunner scores each word of a continuation with the log-probability
+// in logprobs, failing for words it doesn't know
+type mockScoreRunner struct {
+	llm.LlamaServer
+
+	logprobs map[string]float64
+
+	mu       sync.Mutex
+	requests []llm.ScoreRequest
+}
+
+func (*mockScoreRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
+	for range strings.Fields(s) {
+		tokens = append(tokens, len(tokens))
+	}
+
+	return
+}
+
+func (m *mockScoreRunner) Score(_ context.Context, req llm.ScoreRequest) ([]api.TokenLogprob, error) {
+	m.mu.Lock()
+	m.requests = append(m.requests, req)
+	m.mu.Unlock()
+
+	var tokens []api.TokenLogprob
+	for _, word := range strings.Fields(req.Continuation) {
+		logprob, ok := m.logprobs[word]
+		if !ok {
+			return nil, errors.New("unknown word " + word)
+		}
+
+		tokens = append(tokens, api.TokenLogprob{Token: word, Logprob: logprob})
+	}
+
+	return tokens, nil
+}
+
+func TestScore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := &mockScoreRunner{logprobs: map[string]float64{"blue": -0.5, "sky": -0.25, "green": -2}}
+	s := &Server{
+		sched: &Scheduler{
+			queues:        newRequestQueues(1, 0),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{llama: mock, numParallel: 2}
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture": "llama",
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = createRequest(t, s.ScoreHandler, api.ScoreRequest{
+		Model:         "test",
+		Prompt:        "the sky is",
+		Continuations: []string{"blue", "green", "blue sky", "purple", "blue blue sky sky"},
+		Options:       map[string]any{"num_ctx": 5},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp api.ScoreResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []api.ContinuationScore{
+		{Logprob: -0.5, Tokens: []api.TokenLogprob{{Token: "blue", Logprob: -0.5}}},
+		{Logprob: -2, Tokens: []api.TokenLogprob{{Token: "green", Logprob: -2}}},
+		{Logprob: -0.75, Tokens: []api.TokenLogprob{{Token: "blue", Logprob: -0.5}, {Token: "sky", Logprob: -0.25}}},
+		{Error: "unknown word purple"},
+		{Error: "prompt and continuation length of 7 tokens exceeds maximum context length of 5 tokens"},
+	}
+
+	if diff := cmp.Diff(expect, resp.Scores); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if resp.PromptEvalCount != 3 {
+		t.Errorf("expected 3 prompt tokens, got %d", resp.PromptEvalCount)
+	}
+
+	if len(mock.requests) != 4 {
+		t.Errorf("expected the continuations that fit to be scored, got %v", mock.requests)
+	}
+
+	for _, req := range mock.requests {
+		if req.Prompt != "the sky is" {
+			t.Errorf("unexpected prompt %q", req.Prompt)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// flushRecorder records how many lines had been written at each flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+
+	mu      sync.Mutex
+	flushes []int
+}
+
+func (r *flushRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ResponseRecorder.Write(b)
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushes = append(r.flushes, bytes.Count(r.Body.Bytes(), []byte{'\n'}))
+}
+
+func (r *flushRecorder) flushed() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.flushes)
+}
+
+func TestStreamCoalesced(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stream := func(interval time.Duration, maxValues int) (*flushRecorder, chan any, chan struct{}) {
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+
+		ch := make(chan any)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			streamCoalesced(c, ch, interval, maxValues)
+		}()
+		return w, ch, done
+	}
+
+	t.Run("every value", func(t *testing.T) {
+		w, ch, done := stream(0, 0)
+		for i := range 3 {
+			ch <- api.GenerateResponse{Response: fmt.Sprint(i), Done: i == 2}
+		}
+		close(ch)
+		<-done
+
+		if flushes := w.flushed(); !slices.Equal(flushes, []int{1, 2, 3}) {
+			t.Errorf("expected a flush per value, got %v", flushes)
+		}
+	})
+
+	t.Run("max values", func(t *testing.T) {
+		w, ch, done := stream(time.Hour, 3)
+		for i := range 8 {
+			ch <- api.GenerateResponse{Response: fmt.Sprint(i), Done: i == 7}
+		}
+		close(ch)
+		<-done
+
+		// The first value is flushed immediately, then every 3 values, and
+		// the rest once the stream ends
+		if flushes := w.flushed(); !slices.Equal(flushes, []int{1, 4, 7, 8}) {
+			t.Errorf("unexpected flushes %v", flushes)
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		waitFlushed := func(t *testing.T, w *flushRecorder, within time.Duration, expect []int) {
+			t.Helper()
+			deadline := time.Now().Add(within)
+			for !slices.Equal(w.flushed(), expect) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected flushes %v, got %v", expect, w.flushed())
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		w, ch, done := stream(200*time.Millisecond, 0)
+		start := time.Now()
+		ch <- api.GenerateResponse{Response: "a"}
+		waitFlushed(t, w, 100*time.Millisecond, []int{1})
+
+		ch <- api.GenerateResponse{Response: "b"}
+		ch <- api.GenerateResponse{Response: "c"}
+		waitFlushed(t, w, 2*time.Second, []int{1, 3})
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("expected values to be held for the interval, flushed after %s", elapsed)
+		}
+
+		ch <- api.GenerateResponse{Response: "d", Done: true}
+		close(ch)
+		<-done
+
+		if flushes := w.flushed(); !slices.Equal(flushes, []int{1, 3, 4}) {
+			t.Errorf("expected the final value to be flushed when the stream ends, got %v", flushes)
+		}
+
+		if lines := bytes.Count(w.Body.Bytes(), []byte{'\n'}); lines != 4 {
+			t.Errorf("expected 4 lines, got %d", lines)
+		}
+	})
+}
+
+func TestStreamFlushInterval(t *testing.T) {
+	t.Setenv("OLLAMA_STREAM_FLUSH_INTERVAL", "20ms")
+
+	if d := streamFlushInterval(nil); d != 20*time.Millisecond {
+		t.Errorf("expected the environment default, got %s", d)
+	}
+
+	if d := streamFlushInterval(&api.Duration{Duration: 5 * time.Millisecond}); d != 5*time.Millisecond {
+		t.Errorf("expected the request to override the default, got %s", d)
+	}
+
+	if d := streamFlushInterval(&api.Duration{}); d != 0 {
+		t.Errorf("expected the request to disable coalescing, got %s", d)
+	}
+}
+
+// flushCounter discards what's written, counting flushes. Each flush ends an
+// HTTP chunk and is at least one write syscall.
+type flushCounter struct {
+	header  http.Header
+	flushes int
+}
+
+func (w *flushCounter) Header() http.Header         { return w.header }
+func (w *flushCounter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *flushCounter) WriteHeader(int)             {}
+func (w *flushCounter) Flush()                      { w.flushes++ }
+
+func BenchmarkStreamCoalesced(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+
+	const tokens = 256
+	for _, tt := range []struct {
+		interval  time.Duration
+		maxValues int
+	}{
+		{0, 0},
+		{10 * time.Millisecond, 16},
+		{10 * time.Millisecond, 64},
+		{50 * time.Millisecond, 0},
+	} {
+		b.Run(fmt.Sprintf("interval=%s,tokens=%d", tt.interval, tt.maxValues), func(b *testing.B) {
+			var flushes int
+			for range b.N {
+				w := &flushCounter{header: http.Header{}}
+				c, _ := gin.CreateTestContext(w)
+				c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+
+				ch := make(chan any)
+				go func() {
+					defer close(ch)
+					for i := range tokens {
+						ch <- api.GenerateResponse{Model: "test", Response: "token", Done: i == tokens-1}
+					}
+				}()
+
+				streamCoalesced(c, ch, tt.interval, tt.maxValues)
+				flushes += w.flushes
+			}
+
+			b.ReportMetric(float64(flushes)/float64(b.N), "flushes/op")
+			b.ReportMetric(float64(flushes)/float64(b.N*tokens), "flushes/token")
+		})
+	}
+}
@@ -11,14 +11,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/parser"
@@ -68,7 +73,7 @@ func Test_Routes(t *testing.T) {
 		fn := func(resp api.ProgressResponse) {
 			t.Logf("Status: %s", resp.Status)
 		}
-		err = CreateModel(context.TODO(), model.ParseName(name), "", "", modelfile, fn)
+		err = CreateModel(context.TODO(), model.ParseName(name), "", "", modelfile, false, fn)
 		require.NoError(t, err)
 	}
 
@@ -84,7 +89,30 @@ func Test_Routes(t *testing.T) {
 				assert.Equal(t, "application/json; charset=utf-8", contentType)
 				body, err := io.ReadAll(resp.Body)
 				require.NoError(t, err)
-				assert.Equal(t, fmt.Sprintf(`{"version":"%s"}`, version.Version), string(body))
+				var v struct {
+					Version string `json:"version"`
+					CPU     struct {
+						Capability string `json:"capability"`
+						Runner     string `json:"runner"`
+					} `json:"cpu"`
+				}
+				require.NoError(t, json.Unmarshal(body, &v))
+				assert.Equal(t, version.Version, v.Version)
+				assert.NotEmpty(t, v.CPU.Capability)
+				assert.NotEmpty(t, v.CPU.Runner)
+			},
+		},
+		{
+			Name:   "Version Handler (verbose)",
+			Method: http.MethodGet,
+			Path:   "/api/version?verbose=true",
+			Expected: func(t *testing.T, resp *http.Response) {
+				var v api.VersionResponse
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&v))
+				assert.Equal(t, version.Version, v.Version)
+				assert.Equal(t, runtime.Version(), v.GoVersion)
+				require.NotNil(t, v.CPU)
+				assert.NotEmpty(t, v.CPU.Runner)
 			},
 		},
 		{
@@ -164,6 +192,7 @@ func Test_Routes(t *testing.T) {
 				assert.Len(t, modelList.Data, 1)
 				assert.Equal(t, "test-model:latest", modelList.Data[0].Id)
 				assert.Equal(t, "library", modelList.Data[0].OwnedBy)
+				assert.NotZero(t, modelList.Data[0].Created)
 			},
 		},
 		{
@@ -270,6 +299,56 @@ func Test_Routes(t *testing.T) {
 
 				assert.Equal(t, "show-model", retrieveResp.Id)
 				assert.Equal(t, "library", retrieveResp.OwnedBy)
+
+				manifest, err := ParseNamedManifest(model.ParseName("show-model"))
+				require.NoError(t, err)
+				assert.Equal(t, manifest.fi.ModTime().Unix(), retrieveResp.Created)
+			},
+		},
+		{
+			Name:   "openai retrieve model with namespace and tag",
+			Method: http.MethodGet,
+			Path:   "/v1/models/myorg/show-model:v1",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "myorg/show-model:v1")
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				var retrieveResp api.RetrieveModelResponse
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&retrieveResp))
+				assert.Equal(t, "myorg/show-model:v1", retrieveResp.Id)
+				assert.Equal(t, "model", retrieveResp.Object)
+				assert.Equal(t, "myorg", retrieveResp.OwnedBy)
+				assert.NotZero(t, retrieveResp.Created)
+			},
+		},
+		{
+			Name:   "openai retrieve model with escaped name",
+			Method: http.MethodGet,
+			Path:   "/v1/models/myorg%2Fshow-model%3Av1",
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				var retrieveResp api.RetrieveModelResponse
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&retrieveResp))
+				assert.Equal(t, "myorg/show-model:v1", retrieveResp.Id)
+				assert.Equal(t, "myorg", retrieveResp.OwnedBy)
+			},
+		},
+		{
+			Name:   "openai retrieve missing model",
+			Method: http.MethodGet,
+			Path:   "/v1/models/missing-model",
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+				var errResp openai.ErrorResponse
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+				assert.Equal(t, "invalid_request_error", errResp.Error.Type)
+				require.NotNil(t, errResp.Error.Code)
+				assert.Equal(t, "model_not_found", *errResp.Error.Code)
+				assert.Contains(t, errResp.Error.Message, "missing-model")
 			},
 		},
 	}
@@ -303,6 +382,85 @@ func Test_Routes(t *testing.T) {
 	}
 }
 
+func TestMaxRequestBody(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_MAX_REQUEST_BODY", "1KiB")
+
+	s := &Server{}
+	httpSrv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(httpSrv.Close)
+
+	post := func(t *testing.T, path string, body io.Reader) *http.Response {
+		t.Helper()
+		resp, err := httpSrv.Client().Post(httpSrv.URL+path, "application/json", body)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	large := fmt.Sprintf(`{"model": "test", "prompt": %q}`, strings.Repeat("a", 2048))
+
+	tooLarge := func(t *testing.T, resp *http.Response) {
+		t.Helper()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+		var errResp map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+		assert.Contains(t, errResp["error"], "1.0 KiB")
+		assert.Contains(t, errResp["error"], "OLLAMA_MAX_REQUEST_BODY")
+	}
+
+	t.Run("content length", func(t *testing.T) {
+		tooLarge(t, post(t, "/api/generate", strings.NewReader(large)))
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		// A reader of unknown length is sent without a content length
+		tooLarge(t, post(t, "/api/generate", io.MultiReader(strings.NewReader(large))))
+	})
+
+	t.Run("within limit", func(t *testing.T) {
+		resp := post(t, "/api/show", io.MultiReader(strings.NewReader(`{"model": "missing"}`)))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("blob uploads", func(t *testing.T) {
+		resp := post(t, "/api/blobs/sha256:0000000000000000000000000000000000000000000000000000000000000000", strings.NewReader(large))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestWriteDeadline(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(writeDeadlineMiddleware(50 * time.Millisecond))
+	r.GET("/stream", func(c *gin.Context) {
+		// Pauses between writes for longer than the timeout, which only
+		// bounds each write
+		for i := range 4 {
+			time.Sleep(80 * time.Millisecond)
+			fmt.Fprintln(c.Writer, i)
+			c.Writer.Flush()
+		}
+	})
+
+	httpSrv := httptest.NewServer(r)
+	t.Cleanup(httpSrv.Close)
+
+	for range 2 {
+		resp, err := httpSrv.Client().Get(httpSrv.URL + "/stream")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "0\n1\n2\n3\n", string(body))
+
+		// The connection is reused, and mustn't carry the previous deadline
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func TestCase(t *testing.T) {
 	t.Setenv("OLLAMA_MODELS", t.TempDir())
 
@@ -416,6 +574,272 @@ func TestShow(t *testing.T) {
 	if resp.ProjectorInfo["general.architecture"] != "clip" {
 		t.Fatal("Expected projector architecture to be 'clip', but got", resp.ProjectorInfo["general.architecture"])
 	}
+
+	if diff := cmp.Diff([]model.Capability{model.CapabilityCompletion, model.CapabilityVision}, resp.Capabilities); diff != "" {
+		t.Errorf("unexpected capabilities (-want +got):\n%s", diff)
+	}
+}
+
+func TestModelNameErrors(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	const digest = "sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816"
+
+	cases := []struct {
+		name    string
+		handler func(*gin.Context)
+		body    any
+		expect  string
+	}{
+		{"pull", s.PullHandler, api.PullRequest{Model: "mistral:la$t"}, `invalid model name "mistral:la$t": tag "la$t" contains '$', tags may only contain letters, numbers, '_', '-' and '.'`},
+		{"create", s.CreateHandler, api.CreateRequest{Model: "j.morgan/mistral", Modelfile: "FROM mistral"}, `invalid model name "j.morgan/mistral": namespace "j.morgan" contains '.', namespaces may only contain letters, numbers, '_' and '-'`},
+		{"show", s.ShowHandler, api.ShowRequest{Model: "mistral:"}, `invalid model name "mistral:": tag is empty`},
+		{"copy source", s.CopyHandler, api.CopyRequest{Source: "a/b/c/d", Destination: "mistral"}, `source: invalid model name "a/b/c/d": name has 4 parts separated by '/', expected [host/][namespace/]model`},
+		{"copy destination", s.CopyHandler, api.CopyRequest{Source: "mistral", Destination: "mistral@" + digest}, `destination: invalid model name "mistral@` + digest + `": models pinned to a digest can't be changed, use a tag`},
+		{"delete", s.DeleteHandler, api.DeleteRequest{Model: "-mistral"}, `invalid model name "-mistral": model "-mistral" starts with '-', it must start with a letter, number or '_'`},
+		{"generate", s.GenerateHandler, api.GenerateRequest{Model: "mistral@sha256:2af3", KeepAlive: &api.Duration{}}, `invalid model name "mistral@sha256:2af3": digest is truncated, it has 4 of the 64 hex characters of a sha256 digest`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, tt.handler, tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status code 400, actual %d", w.Code)
+			}
+
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Error != tt.expect {
+				t.Errorf("expected error %q, got %q", tt.expect, resp.Error)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	cases := []struct {
+		name      string
+		modelfile string
+		expect    []model.Capability
+	}{
+		{
+			"completion",
+			fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": "llama"}, nil)),
+			[]model.Capability{model.CapabilityCompletion},
+		},
+		{
+			"embedding",
+			fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": "bert", "bert.pooling_type": uint32(1)}, nil)),
+			[]model.Capability{model.CapabilityEmbedding},
+		},
+		{
+			"tools-insert",
+			fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"{{ if .Tools }}{{ .Tools }}{{ end }}{{ if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>{{ else }}{{ .Prompt }}{{ end }}\"\"\"", createBinFile(t, llm.KV{"general.architecture": "llama"}, nil)),
+			[]model.Capability{model.CapabilityCompletion, model.CapabilityTools, model.CapabilityInsert},
+		},
+		{
+			"thinking",
+			fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"{{ range .Messages }}{{ .Content }}{{ end }}<think></think>\"\"\"", createBinFile(t, llm.KV{"general.architecture": "qwen2"}, nil)),
+			[]model.Capability{model.CapabilityCompletion, model.CapabilityThinking},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.CreateHandler, api.CreateRequest{Name: tt.name, Modelfile: tt.modelfile, Stream: &stream})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+			}
+
+			w = createRequest(t, s.ShowHandler, api.ShowRequest{Name: tt.name})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d", w.Code)
+			}
+
+			var resp api.ShowResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, resp.Capabilities); diff != "" {
+				t.Errorf("unexpected capabilities (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	w := createRequest(t, s.ListHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var list api.ListResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range list.Models {
+		for _, tt := range cases {
+			if m.Name == tt.name+":latest" {
+				if diff := cmp.Diff(tt.expect, m.Capabilities); diff != "" {
+					t.Errorf("%s: unexpected capabilities (-want +got):\n%s", m.Name, diff)
+				}
+			}
+		}
+	}
+}
+
+func TestShowLoaded(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+	createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "show-model",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": "test"}, nil)),
+	})
+
+	show := func(t *testing.T) *api.LoadSettings {
+		t.Helper()
+		w := createRequest(t, s.ShowHandler, api.ShowRequest{Name: "show-model"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ShowResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Loaded
+	}
+
+	if loaded := show(t); loaded != nil {
+		t.Fatalf("expected no load settings for a model that isn't running, got %+v", loaded)
+	}
+
+	m, err := GetModel("show-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sched.loaded[m.ModelPath] = &runnerRef{modelPath: m.ModelPath, llama: &mockLlm{useMMap: false, useMLock: true}}
+
+	require.Equal(t, &api.LoadSettings{UseMMap: false, UseMLock: true}, show(t))
+}
+
+func TestShowLayers(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "show-model",
+		Modelfile: fmt.Sprintf("FROM %s\nSYSTEM hello", createBinFile(t, llm.KV{"general.architecture": "gemma3"}, nil)),
+		Stream:    &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	show := func(t *testing.T, remoteAddr string, ctx context.Context, header http.Header) *api.ManifestInfo {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.ShowRequest{Model: "show-model", Layers: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/show", &b).WithContext(ctx)
+		c.Request.RemoteAddr = remoteAddr
+		for k, v := range header {
+			c.Request.Header[k] = v
+		}
+		s.ShowHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ShowResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the model's architecture isn't supported, but it's still shown
+		if resp.Unsupported == nil || resp.Manifest == nil {
+			t.Fatalf("expected an unsupported model with its manifest, got %+v", resp)
+		}
+		return resp.Manifest
+	}
+
+	manifest, err := ParseNamedManifest(model.ParseName("show-model"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := show(t, "127.0.0.1:5000", context.Background(), nil)
+	if local.Digest != manifest.digest || local.ConfigDigest != manifest.Config.Digest || local.Size != manifest.Size() || local.Path != manifest.filepath {
+		t.Errorf("unexpected manifest %+v", local)
+	}
+
+	var mediaTypes []string
+	for _, l := range local.Layers {
+		p, err := GetBlobsPath(l.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l.Path != p || l.Missing {
+			t.Errorf("expected %s to be stored at %s, got %+v", l.Digest, p, l)
+		}
+		mediaTypes = append(mediaTypes, l.MediaType)
+	}
+
+	expect := []string{"application/vnd.ollama.image.model", "application/vnd.ollama.image.system", "application/vnd.docker.container.image.v1+json"}
+	if diff := cmp.Diff(mediaTypes, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if remote := show(t, "10.0.0.2:5000", context.Background(), nil); remote.Path != "" || remote.Layers[0].Path != "" || remote.Layers[0].Digest != local.Layers[0].Digest {
+		t.Errorf("expected no paths for a remote request, got %+v", remote)
+	}
+
+	// a reverse proxy on the same machine connects from its loopback address
+	if proxied := show(t, "127.0.0.1:5000", context.Background(), http.Header{"X-Forwarded-For": {"10.0.0.2"}}); proxied.Path != "" {
+		t.Errorf("expected no paths for a proxied request, got %+v", proxied)
+	}
+
+	admin := &apiKey{Admin: true}
+	user := &apiKey{Namespaces: []string{"library"}}
+	s.keys = map[string]*apiKey{"admin": admin, "user": user}
+
+	if remote := show(t, "10.0.0.2:5000", context.WithValue(context.Background(), apiKeyContextKey{}, admin), nil); remote.Path == "" || remote.Layers[0].Path == "" {
+		t.Errorf("expected paths for an admin request, got %+v", remote)
+	}
+
+	if local := show(t, "127.0.0.1:5000", context.WithValue(context.Background(), apiKeyContextKey{}, user), nil); local.Path != "" {
+		t.Errorf("expected no paths for a request with a user API key, got %+v", local)
+	}
+
+	// with API keys configured, being on the same machine isn't enough
+	if local := show(t, "127.0.0.1:5000", context.Background(), nil); local.Path != "" {
+		t.Errorf("expected no paths for a local request without an admin key, got %+v", local)
+	}
+
+	if err := os.Remove(local.Layers[1].Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := manifest.info(true); !info.Layers[1].Missing || info.Layers[1].Path != "" {
+		t.Errorf("expected the system layer to be missing, got %+v", info.Layers[1])
+	}
 }
 
 func TestNormalize(t *testing.T) {
@@ -452,3 +876,21 @@ func TestNormalize(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionBackends(t *testing.T) {
+	gpus := gpu.GpuInfoList{
+		{Library: "cpu"},
+		{Library: "cuda", Variant: "v12", DriverMajor: 12, DriverMinor: 4},
+		{Library: "cuda", Variant: "v12", DriverMajor: 12, DriverMinor: 4},
+		{Library: "rocm", Variant: "v6"},
+	}
+
+	expect := []api.VersionBackend{
+		{Library: "cuda", Variant: "v12", Driver: "12.4", GPUs: 2},
+		{Library: "rocm", Variant: "v6", GPUs: 1},
+	}
+
+	if diff := cmp.Diff(expect, versionBackends(gpus)); diff != "" {
+		t.Errorf("unexpected backends (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestTransfer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nSYSTEM hello", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	ts := httptest.NewServer(s.GenerateRoutes())
+	defer ts.Close()
+
+	base, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := api.NewClient(base, http.DefaultClient)
+	ctx := context.Background()
+
+	m, err := client.Manifest(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Layers) != 2 || m.Config.Digest == "" {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	if _, err := client.Manifest(ctx, "missing"); err == nil {
+		t.Error("expected an error for a missing model")
+	}
+
+	blobs := make(map[string][]byte)
+	for _, layer := range append(m.Layers, m.Config) {
+		r, err := client.Blob(ctx, layer.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if int64(len(b)) != layer.Size {
+			t.Errorf("expected %d bytes for %s, got %d", layer.Size, layer.Digest, len(b))
+		}
+
+		blobs[layer.Digest] = b
+	}
+
+	// switch to an empty store, as if it were another server
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	if err := client.PutManifest(ctx, "copy", m); err == nil {
+		t.Error("expected the manifest to be rejected while its blobs are missing")
+	}
+
+	for digest, b := range blobs {
+		if ok, err := client.HasBlob(ctx, digest); err != nil || ok {
+			t.Errorf("expected %s to be missing, got %v, %v", digest, ok, err)
+		}
+
+		if err := client.CreateBlob(ctx, digest, bytes.NewReader(append(b, 'x'))); err == nil {
+			t.Errorf("expected a blob not matching %s to be rejected", digest)
+		}
+
+		if err := client.CreateBlob(ctx, digest, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := client.HasBlob(ctx, digest); err != nil || !ok {
+			t.Errorf("expected %s to exist, got %v, %v", digest, ok, err)
+		}
+	}
+
+	if err := client.PutManifest(ctx, "copy", m); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := GetModel("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied.System != "hello" {
+		t.Errorf("expected the copy to keep the system prompt, got %q", copied.System)
+	}
+
+	if _, err := ParseNamedManifest(model.ParseName("copy")); err != nil {
+		t.Errorf("expected the manifest to be written, got %v", err)
+	}
+}
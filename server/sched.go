@@ -8,41 +8,78 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tracing"
+	"github.com/ollama/ollama/types/model"
 )
 
 type LlmRequest struct {
 	ctx             context.Context //nolint:containedctx
 	model           *Model
 	opts            api.Options
-	origNumCtx      int // Track the initial ctx request
+	origNumCtx      int  // Track the initial ctx request
+	autoNumCtx      bool // num_ctx 0 was requested, and origNumCtx chosen for it
 	sessionDuration *api.Duration
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
+	enqueuedAt      time.Time
+	remoteFailed    bool   // a remote server failed to load the model, so only place it locally
+	replica         int    // the replica to load if the model needs another runner
+	route           string // the API route of the request, see requestRoute
+	runner          *runnerRef
+
+	// estimate is the memory estimate made for estimateGPUs, kept while
+	// the request waits for VRAM reserved by other loads
+	estimate        *llm.MemoryEstimate
+	estimateGPUs    []gpuKey
+	reserveAttempts uint
 }
 
 type Scheduler struct {
-	pendingReqCh  chan *LlmRequest
+	queues        *requestQueues
 	finishedReqCh chan *LlmRequest
 	expiredCh     chan *runnerRef
 	unloadedCh    chan interface{}
 
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
+	ledger   *vramLedger
+	remotes  *remoteServers
+
+	// placing holds the models being placed on a remote server, whose
+	// other requests wait for that placement rather than starting another.
+	// It's guarded by loadedMu.
+	placing map[string]bool
+
+	// imatrices numbers the importance matrix computations holding
+	// reservations in the ledger
+	imatrices atomic.Uint64
+
+	// version counts the changes to the loaded runners, so clients of
+	// /api/ps can tell whether its response changed
+	version atomic.Uint64
+
+	admission   admission
+	promptCache promptCacheStats
 
 	loadFn       func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int)
-	newServerFn  func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
+	newServerFn  func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error)
 	getGpuFn     func() gpu.GpuInfoList
 	getCpuFn     func() gpu.GpuInfoList
 	reschedDelay time.Duration
@@ -60,14 +97,22 @@ var defaultParallel = 4
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+// maxReserveAttempts is how many times a load waits for VRAM reserved by
+// other loads, backing off from reschedDelay, before it fails
+const maxReserveAttempts = 8
+
+var errReserveTimeout = errors.New("timed out waiting for GPU memory reserved by other model loads")
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
-		pendingReqCh:  make(chan *LlmRequest, maxQueue),
+		queues:        newRequestQueues(int(maxQueue), int(envconfig.MaxQueuePerModel())),
 		finishedReqCh: make(chan *LlmRequest, maxQueue),
 		expiredCh:     make(chan *runnerRef, maxQueue),
 		unloadedCh:    make(chan interface{}, maxQueue),
 		loaded:        make(map[string]*runnerRef),
+		ledger:        newVRAMLedger(),
+		remotes:       newRemoteServers(envconfig.RemoteServers()),
 		newServerFn:   llm.NewLlamaServer,
 		getGpuFn:      gpu.GetGPUInfo,
 		getCpuFn:      gpu.GetCPUInfo,
@@ -79,7 +124,8 @@ func InitScheduler(ctx context.Context) *Scheduler {
 
 // context must be canceled to decrement ref count and release the runner
 func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) (chan *runnerRef, chan error) {
-	if opts.NumCtx < 4 {
+	// num_ctx 0 is chosen when the model is loaded
+	if opts.NumCtx != 0 && opts.NumCtx < 4 {
 		opts.NumCtx = 4
 	}
 
@@ -88,14 +134,14 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		model:           model,
 		opts:            opts,
 		sessionDuration: sessionDuration,
+		route:           requestRoute(c),
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
 	}
 
-	select {
-	case s.pendingReqCh <- req:
-	default:
-		req.errCh <- ErrMaxQueue
+	if err := s.queues.push(req); err != nil {
+		slog.Debug("rejecting request, queue full", "model", model.ModelPath)
+		req.errCh <- err
 	}
 	return req.successCh, req.errCh
 }
@@ -118,15 +164,26 @@ func (s *Scheduler) processPending(ctx context.Context) {
 		case <-ctx.Done():
 			slog.Debug("shutting down scheduler pending loop")
 			return
-		case pending := <-s.pendingReqCh:
+		case <-s.queues.readyCh:
+			pending := s.queues.pop()
+			if pending == nil {
+				continue
+			}
+
 			// Block other requests until we get this pending request running
 			pending.schedAttempts++
 			if pending.origNumCtx == 0 {
 				pending.origNumCtx = pending.opts.NumCtx
 			}
 
-			if pending.ctx.Err() != nil {
+			if err := pending.ctx.Err(); err != nil {
 				slog.Debug("pending request cancelled or timed out, skipping scheduling")
+				pending.errCh <- err
+				continue
+			}
+
+			if err := s.admission.shed(pending, envconfig.TargetTTFT()); err != nil {
+				pending.errCh <- err
 				continue
 			}
 			numParallel := int(envconfig.NumParallel())
@@ -140,18 +197,51 @@ func (s *Scheduler) processPending(ctx context.Context) {
 			for {
 				var runnerToExpire *runnerRef
 				s.loadedMu.Lock()
-				runner := s.loaded[pending.model.ModelPath]
-				loadedCount := len(s.loaded)
+				replicas := s.replicas(pending.model.ModelPath)
+				loadedCount := s.localCount()
+				placing := s.placing[pending.model.ModelPath]
 				s.loadedMu.Unlock()
-				if runner != nil {
-					if runner.needsReload(ctx, pending) {
-						runnerToExpire = runner
+
+				if placing {
+					go func() {
+						// The request is served by the remote runner, or
+						// placed locally, once the placement finishes
+						slog.Debug("delaying scheduling while the model is placed on a remote server", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
+						time.Sleep(s.reschedDelay)
+						s.queues.requeue(pending)
+					}()
+					break
+				}
+
+				// runner is the least busy replica. If it's busy and the model
+				// may be loaded again, another replica is loaded instead when
+				// that doesn't require unloading anything
+				runner := leastBusy(replicas)
+				if placed := leastBusy(replicasPlacedWithin(replicas, pending.opts.GPUs)); placed != nil {
+					runner = placed
+				}
+				pending.replica = nextReplica(replicas)
+				if runner != nil && runner.needsReload(ctx, pending) {
+					runnerToExpire = runner
+				} else if runner != nil && pending.opts.ForcePlacement && !runner.placedWithin(pending.opts.GPUs) {
+					// the request insists on GPUs the model isn't loaded on
+					slog.Info("reloading model on the requested GPUs", "model", pending.model.ModelPath, "gpus", pending.opts.GPUs)
+					runnerToExpire = runner
+				} else if runner != nil && !wantsReplica(runner, pending, len(replicas)) {
+					// Runner is usable, return it once its KV cache is back
+					if err := s.restoreCache(runner); err != nil {
+						slog.Info("unable to restore KV cache, unloading a model to make room", "model", runner.modelPath, "error", err)
+						runnerToExpire = s.findRunnerToUnload()
 					} else {
-						// Runner is usable, return it
 						pending.useLoadedRunner(runner, s.finishedReqCh)
 						break
 					}
 				} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
+					if runner != nil {
+						slog.Debug("max runners achieved, using existing replica", "model", pending.model.ModelPath, "replica", runner.replica)
+						pending.useLoadedRunner(runner, s.finishedReqCh)
+						break
+					}
 					slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
 					runnerToExpire = s.findRunnerToUnload()
 				} else {
@@ -163,6 +253,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 					} else {
 						gpus = s.getGpuFn()
 					}
+					s.ledger.observe(gpus)
 
 					if envconfig.MaxRunners() <= 0 {
 						// No user specified MaxRunners, so figure out what automatic setting to use
@@ -186,6 +277,15 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						}
 					}
 
+					// The default above counts every GPU, not only those this
+					// request is pinned to
+					if len(pending.opts.GPUs) > 0 && pending.opts.NumGPU != 0 {
+						if gpus = filterGPUsBySelection(gpus, pending.opts.GPUs); len(gpus) == 0 {
+							pending.errCh <- fmt.Errorf("%w: GPUs %s are no longer available", errGPUSelection, strings.Join(pending.opts.GPUs, ", "))
+							break
+						}
+					}
+
 					// Load model for fitting
 					ggml, err := llm.LoadModel(pending.model.ModelPath, 0)
 					if err != nil {
@@ -193,13 +293,47 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						break
 					}
 
-					// Embedding models should always be loaded with parallel=1
-					if pending.model.CheckCapabilities(CapabilityCompletion) != nil {
+					// Models this build can't load fail here with what
+					// they need, rather than when the runner loads them
+					if err := ggml.CheckSupported(); err != nil {
+						pending.errCh <- err
+						break
+					}
+
+					if err := ggml.KV().CheckContextOptions(pending.opts.Runner); err != nil {
+						pending.errCh <- err
+						break
+					}
+
+					// Embedding models should always be loaded with parallel=1,
+					// as should those with a sliding window since it limits
+					// the context of each slot rather than the runner's
+					if pending.model.CheckCapabilities(model.CapabilityCompletion) != nil || pending.opts.SlidingWindow > 0 {
 						numParallel = 1
 					}
 
+					if pending.origNumCtx == 0 {
+						pending.autoNumCtx = true
+						pending.origNumCtx = s.autoNumCtx(pending, ggml, gpus)
+						pending.opts.NumCtx = pending.origNumCtx
+					}
+
+					// Models that can't be fully loaded here, even after unloading
+					// other models, are placed on a remote server that has them
+					// unless the server is offline
+					if runner == nil && !pending.remoteFailed && !envconfig.Offline() && len(s.remotes.list()) > 0 && !s.fitsLocally(pending, ggml, gpus) {
+						s.placeRemote(pending)
+						break
+					}
+
 					// Evaluate if the model will fit in the available system memory, or if we should unload a model first
 					if len(gpus) == 1 && gpus[0].Library == "cpu" {
+						if runner != nil {
+							// Replicas only help when they run on separate GPUs
+							pending.useLoadedRunner(runner, s.finishedReqCh)
+							break
+						}
+
 						// simplifying assumption of defaultParallel when in CPU mode
 						if numParallel <= 0 {
 							numParallel = defaultParallel
@@ -241,6 +375,13 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						// models still loading on them to avoid potential races
 						// with VRAM consumption ramping up during load
 						availGpus := s.filterGPUsWithoutLoadingModels(gpus)
+						otherModelsLoading := len(availGpus) < len(gpus)
+
+						// Skip any GPUs that already hold OLLAMA_MAX_MODELS_PER_GPU models
+						availGpus = s.filterGPUsAtModelCap(availGpus)
+
+						// Place each replica on its own GPUs
+						availGpus = filterGPUsWithReplicas(availGpus, replicas)
 
 						// Update free memory from currently loaded models
 						s.updateFreeSpace(availGpus)
@@ -251,21 +392,29 @@ func (s *Scheduler) processPending(ctx context.Context) {
 							break
 						}
 
+						if runner != nil {
+							// Another replica doesn't fit, so share the least
+							// busy one rather than unloading other models
+							slog.Debug("no room for another replica, using existing replica", "model", pending.model.ModelPath, "replica", runner.replica)
+							pending.useLoadedRunner(runner, s.finishedReqCh)
+							break
+						}
+
 						// We couldn't find a set of GPUs to fully load the new
 						// model. If no other models are loading (both GPU lists
 						// are the same) then we need to unload another model to
 						// make room
-						if len(availGpus) < len(gpus) {
+						if otherModelsLoading {
 							// There are other requests pending, and this one
 							// needs more time, so put it on the back of the
 							// queue so that we might satisfy other pending
 							// requests that aren't blocked
 							go func() {
-								// Process in a go routine to avoid deadlocking
-								// the scheduler if our queue is full
+								// Process in a go routine so requests for
+								// other models are served in the meantime
 								slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
 								time.Sleep(s.reschedDelay)
-								s.pendingReqCh <- pending
+								s.queues.requeue(pending)
 							}()
 							break
 						}
@@ -303,6 +452,8 @@ func (s *Scheduler) processPending(ctx context.Context) {
 					continue
 				}
 			}
+
+			s.version.Add(1)
 		case <-s.unloadedCh:
 			// An unload request when there are no pending request can be ignored
 			slog.Debug("ignoring unload event with no pending requests")
@@ -318,8 +469,11 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			slog.Debug("shutting down scheduler completed loop")
 			return
 		case finished := <-s.finishedReqCh:
+			runner := finished.runner
 			s.loadedMu.Lock()
-			runner := s.loaded[finished.model.ModelPath]
+			if runner != nil && s.loaded[runner.key()] != runner {
+				runner = nil
+			}
 			s.loadedMu.Unlock()
 			if runner == nil {
 				slog.Error("finished request signal received after model unloaded", "modelPath", finished.model.ModelPath)
@@ -348,14 +502,20 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 						s.expiredCh <- runner
 					})
 					runner.expiresAt = time.Now().Add(runner.sessionDuration)
+				} else if finished.opts.NoRefresh {
+					slog.Debug("runner has gone idle after a request that doesn't refresh it, keeping timer", "modelPath", runner.modelPath, "expiresAt", runner.expiresAt)
 				} else {
 					slog.Debug("runner with non-zero duration has gone idle, resetting timer", "modelPath", runner.modelPath, "duration", runner.sessionDuration)
 					runner.expireTimer.Reset(runner.sessionDuration)
 					runner.expiresAt = time.Now().Add(runner.sessionDuration)
 				}
+				if runner.sessionDuration > 0 {
+					s.scheduleCacheRelease(runner)
+				}
 			}
 			slog.Debug("after processing request finished event", "modelPath", runner.modelPath, "refCount", runner.refCount)
 			runner.refMu.Unlock()
+			s.version.Add(1)
 		case runner := <-s.expiredCh:
 			slog.Debug("runner expired event received", "modelPath", runner.modelPath)
 			runner.refMu.Lock()
@@ -373,10 +533,13 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 
 			s.loadedMu.Lock()
 			slog.Debug("got lock to unload", "modelPath", runner.modelPath)
+			runner.unloading = true
 			finished := runner.waitForVRAMRecovery()
 			runner.unload()
-			delete(s.loaded, runner.modelPath)
+			delete(s.loaded, runner.key())
+			s.ledger.release(runner.key())
 			s.loadedMu.Unlock()
+			s.version.Add(1)
 			slog.Debug("runner released", "modelPath", runner.modelPath)
 			runner.refMu.Unlock()
 
@@ -389,18 +552,27 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 
 // Complete the pending request and send the runner back to the requester
 // Wires up a finished event after the request context is completed
-// Updates session duration, and resets expiration timer
+// Updates session duration, and resets expiration timer, unless the request
+// has the no_refresh option, which leaves both as they are
 func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *LlmRequest) {
 	runner.refMu.Lock()
 	defer runner.refMu.Unlock()
 	runner.refCount++
-	if runner.expireTimer != nil {
-		runner.expireTimer.Stop()
-		runner.expireTimer = nil
+	if !pending.opts.NoRefresh {
+		if runner.expireTimer != nil {
+			runner.expireTimer.Stop()
+			runner.expireTimer = nil
+		}
+		if pending.sessionDuration != nil {
+			runner.sessionDuration = pending.sessionDuration.Duration
+		}
+		runner.refreshedBy = pending.route
 	}
-	if pending.sessionDuration != nil {
-		runner.sessionDuration = pending.sessionDuration.Duration
+	if runner.releaseTimer != nil {
+		runner.releaseTimer.Stop()
+		runner.releaseTimer = nil
 	}
+	pending.runner = runner
 	pending.successCh <- runner
 	go func() {
 		<-pending.ctx.Done()
@@ -417,8 +589,56 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
-	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+	key := replicaKey(req.model.ModelPath, req.replica)
+
+	// the load is traced as part of the request that triggered it, ending once
+	// the runner is ready
+	_, span := tracing.Start(req.ctx, "model.load")
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("model", req.model.ShortName),
+			attribute.Int("num_ctx", req.opts.NumCtx),
+			attribute.Int("num_parallel", numParallel),
+			attribute.Int("gpus", len(gpus)),
+		)
+	}
+
+	// Reserve the predicted VRAM before the runner starts allocating so that
+	// placements made while it loads don't count the same memory as free
+	var estimate *llm.MemoryEstimate
+	if len(gpus) > 0 && gpus[0].Library != "cpu" {
+		estimate = req.estimateFor(gpus, ggml)
+		sizes := map[gpuKey]uint64{}
+		for i, g := range gpus {
+			if i < len(estimate.GPUSizes) {
+				sizes[gpuKey{g.Library, g.ID}] = estimate.GPUSizes[i]
+			}
+		}
+		if err := s.ledger.reserve(key, gpus, sizes); err != nil {
+			req.reserveAttempts++
+			if req.reserveAttempts > maxReserveAttempts {
+				slog.Warn("vram reservation conflict, giving up", "model", req.model.ModelPath, "attempts", req.reserveAttempts, "error", err)
+				span.SetStatus(codes.Error, errReserveTimeout.Error())
+				span.End()
+				req.errCh <- errReserveTimeout
+				return
+			}
+
+			delay := s.reschedDelay << min(req.reserveAttempts-1, 4)
+			slog.Info("vram reservation conflict, delaying load", "model", req.model.ModelPath, "attempts", req.reserveAttempts, "delay", delay, "error", err)
+			span.AddEvent("requeued")
+			span.End()
+			go func() {
+				time.Sleep(delay)
+				s.queues.requeue(req)
+			}()
+			return
+		}
+	}
+
+	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel, estimate)
 	if err != nil {
+		s.ledger.release(key)
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
 		// check for model compatibility
@@ -426,6 +646,8 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 			err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
 		}
 		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
 		req.errCh <- err
 		return
 	}
@@ -438,29 +660,42 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 		gpus:            gpus,
 		estimatedVRAM:   llama.EstimatedVRAM(),
 		estimatedTotal:  llama.EstimatedTotal(),
-		loading:         true,
 		refCount:        1,
+		replica:         req.replica,
+		autoNumCtx:      req.autoNumCtx,
+		refreshedBy:     req.route,
 	}
 	runner.numParallel = numParallel
+	runner.startLoading()
 	runner.refMu.Lock()
 
+	// Replace the placement estimate with the one the runner was started with
+	s.ledger.update(key, runner.vramSizes())
+
 	s.loadedMu.Lock()
-	s.loaded[req.model.ModelPath] = runner
+	s.loaded[key] = runner
 	slog.Info("loaded runners", "count", len(s.loaded))
 	s.loadedMu.Unlock()
+	s.version.Add(1)
+	req.runner = runner
 
 	go func() {
 		defer runner.refMu.Unlock()
 		if err = llama.WaitUntilRunning(req.ctx); err != nil {
 			slog.Error("error loading llama server", "error", err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
 			runner.refCount--
+			runner.loadingStatus.Store(nil)
 			req.errCh <- err
 			slog.Debug("triggering expiration for failed load", "model", runner.modelPath)
 			s.expiredCh <- runner
 			return
 		}
 		slog.Debug("finished setting up runner", "model", req.model.ModelPath)
-		runner.loading = false
+		span.End()
+		runner.finishLoading()
+		s.version.Add(1)
 		go func() {
 			<-req.ctx.Done()
 			slog.Debug("context for request finished")
@@ -470,18 +705,52 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	}()
 }
 
-func (s *Scheduler) updateFreeSpace(allGpus gpu.GpuInfoList) {
-	type predKey struct {
-		Library string
-		ID      string
+// reserveImatrix places an importance matrix computation for ggml on the
+// GPUs, reserving the VRAM it offloads in the ledger so that models aren't
+// placed on top of it. The computation runs on the CPU when the offload
+// doesn't fit alongside the loaded models. release drops the reservation once
+// the computation is done.
+func (s *Scheduler) reserveImatrix(ggml *llm.GGML) (gpus gpu.GpuInfoList, estimate llm.MemoryEstimate, release func()) {
+	gpus = s.getGpuFn()
+	if len(gpus) == 0 || gpus[0].Library == "cpu" {
+		return s.getCpuFn(), llm.MemoryEstimate{}, func() {}
+	}
+
+	s.updateFreeSpace(gpus)
+	estimate = llm.EstimateImatrix(gpus, ggml)
+	if estimate.Layers == 0 {
+		return s.getCpuFn(), llm.MemoryEstimate{}, func() {}
+	}
+
+	sizes := map[gpuKey]uint64{}
+	for i, g := range gpus {
+		if i < len(estimate.GPUSizes) {
+			sizes[gpuKey{g.Library, g.ID}] = estimate.GPUSizes[i]
+		}
+	}
+
+	key := fmt.Sprintf("imatrix-%d", s.imatrices.Add(1))
+	if err := s.ledger.reserve(key, gpus, sizes); err != nil {
+		slog.Info("importance matrix doesn't fit alongside loaded models, computing on the cpu", "error", err)
+		return s.getCpuFn(), llm.MemoryEstimate{}, func() {}
 	}
-	predMap := map[predKey]uint64{} // Sum up the total predicted usage per GPU for all runners
+
+	return gpus, estimate, func() { s.ledger.release(key) }
+}
+
+func (s *Scheduler) updateFreeSpace(allGpus gpu.GpuInfoList) {
+	// Sum up the total predicted usage per GPU for all runners, starting with
+	// the reservations in the ledger which include models still loading
+	predMap := s.ledger.reserved()
 	s.loadedMu.Lock()
-	for _, r := range s.loaded {
+	for path, r := range s.loaded {
+		if s.ledger.has(path) {
+			continue
+		}
 		r.refMu.Lock()
 		if r.llama != nil {
 			for _, gpu := range allGpus {
-				predMap[predKey{gpu.Library, gpu.ID}] += r.llama.EstimatedVRAMByGPU(gpu.ID)
+				predMap[gpuKey{gpu.Library, gpu.ID}] += r.llama.EstimatedVRAMByGPU(gpu.ID)
 			}
 		} else {
 			slog.Warn("unexpected nil runner reference, memory prediction may be incorrect")
@@ -492,7 +761,7 @@ func (s *Scheduler) updateFreeSpace(allGpus gpu.GpuInfoList) {
 
 	// Now that we've summed up all the GPU usage predictions across all the loaded runners, update the gpu list
 	for i := range allGpus {
-		if p, ok := predMap[predKey{allGpus[i].Library, allGpus[i].ID}]; ok {
+		if p, ok := predMap[gpuKey{allGpus[i].Library, allGpus[i].ID}]; ok {
 			slog.Debug("gpu reported", "gpu", allGpus[i].ID, "library", allGpus[i].Library, "available", format.HumanBytes2(allGpus[i].FreeMemory))
 			if p > allGpus[i].TotalMemory {
 				// Shouldn't happen
@@ -533,15 +802,45 @@ func (s *Scheduler) filterGPUsWithoutLoadingModels(allGpus gpu.GpuInfoList) gpu.
 	return ret
 }
 
+// filterGPUsAtModelCap returns the set of GPUs that have fewer than
+// OLLAMA_MAX_MODELS_PER_GPU runners placed on them. A cap of zero disables
+// the filter and the list is returned unchanged.
+func (s *Scheduler) filterGPUsAtModelCap(allGpus gpu.GpuInfoList) gpu.GpuInfoList {
+	maxModels := int(envconfig.MaxModelsPerGPU())
+	if maxModels <= 0 {
+		return allGpus
+	}
+
+	counts := map[gpuKey]int{}
+	s.loadedMu.Lock()
+	for _, runner := range s.loaded {
+		for _, g := range runner.gpus {
+			counts[gpuKey{g.Library, g.ID}]++
+		}
+	}
+	s.loadedMu.Unlock()
+
+	ret := gpu.GpuInfoList{}
+	for _, g := range allGpus {
+		if n := counts[gpuKey{g.Library, g.ID}]; n >= maxModels {
+			slog.Info("skipping gpu, maximum models per gpu reached", "gpu", g.ID, "library", g.Library, "loaded", n, "max", maxModels)
+			continue
+		}
+		ret = append(ret, g)
+	}
+	return ret
+}
+
 // TODO consolidate sched_types.go
 type runnerRef struct {
 	refMu sync.Mutex
 	// refCond   sync.Cond // Signaled on transition from 1 -> 0 refCount
-	refCount uint // prevent unloading if > 0
-	// unloading bool      // set to true when we are trying to unload the runner
+	refCount  uint // prevent unloading if > 0
+	unloading bool // set to true when we are trying to unload the runner
 
 	llama          llm.LlamaServer
-	loading        bool            // True only during initial load, then false forever
+	loading        bool // True only during initial load, then false forever
+	loadingStatus  atomic.Pointer[loadingStatus]
 	gpus           gpu.GpuInfoList // Recorded at time of provisioning
 	estimatedVRAM  uint64
 	estimatedTotal uint64
@@ -549,19 +848,144 @@ type runnerRef struct {
 	sessionDuration time.Duration
 	expireTimer     *time.Timer
 	expiresAt       time.Time
+	releaseTimer    *time.Timer // frees the KV cache after OLLAMA_CACHE_RELEASE idle
+	cacheReleased   bool
+	refreshedBy     string // the route of the last request that reset the timer
 
 	model       *Model
 	modelPath   string
 	numParallel int
+	autoNumCtx  bool          // the context length was chosen for num_ctx 0
+	replica     int           // distinguishes runners when the model is loaded more than once
+	remote      *remoteRunner // set when the model runs on a remote server
 	*api.Options
 }
 
+// key identifies the runner in the loaded runners and the VRAM ledger
+func (runner *runnerRef) key() string {
+	return replicaKey(runner.modelPath, runner.replica)
+}
+
+func replicaKey(modelPath string, replica int) string {
+	if replica == 0 {
+		return modelPath
+	}
+	return fmt.Sprintf("%s#%d", modelPath, replica)
+}
+
+// loadingStatus is the /api/ps entry of a runner taken as its load starts.
+// The refMu is held for the whole of a load, so the entry stands in for the
+// runner until the load finishes rather than making listings wait for it.
+type loadingStatus struct {
+	api.ProcessModelResponse
+	sessionDuration time.Duration
+}
+
+// startLoading marks the runner as loading. It must be called before the
+// runner is shared with other goroutines.
+func (runner *runnerRef) startLoading() {
+	runner.loading = true
+	mr, _ := runner.statusLocked()
+	runner.loadingStatus.Store(&loadingStatus{mr, runner.sessionDuration})
+}
+
+// The refMu must already be held when calling finishLoading
+func (runner *runnerRef) finishLoading() {
+	runner.loading = false
+	runner.loadingStatus.Store(nil)
+}
+
+// status returns the runner's /api/ps entry, with its slots if verbose is
+// set. It returns false once the runner has been unloaded.
+func (runner *runnerRef) status(ctx context.Context, verbose bool) (api.ProcessModelResponse, bool) {
+	if loading := runner.loadingStatus.Load(); loading != nil {
+		mr := loading.ProcessModelResponse
+		mr.ExpiresAt = time.Now().Add(loading.sessionDuration)
+		return mr, true
+	}
+
+	runner.refMu.Lock()
+	mr, ok := runner.statusLocked()
+	runner.refMu.Unlock()
+	if ok && verbose && mr.Location == "local" {
+		mr.Slots = runner.slots(ctx)
+	}
+
+	return mr, ok
+}
+
+// The refMu must already be held when calling statusLocked
+func (runner *runnerRef) statusLocked() (api.ProcessModelResponse, bool) {
+	if runner.model == nil {
+		return api.ProcessModelResponse{}, false
+	}
+
+	model := runner.model
+	mr := api.ProcessModelResponse{
+		Model:  model.ShortName,
+		Name:   model.ShortName,
+		Size:   int64(runner.estimatedTotal),
+		Digest: model.Digest,
+		Details: api.ModelDetails{
+			Format:            model.Config.ModelFormat,
+			Family:            model.Config.ModelFamily,
+			Families:          model.Config.ModelFamilies,
+			ParameterSize:     model.Config.ModelType,
+			QuantizationLevel: model.Config.FileType,
+		},
+		SizeVRAM:    int64(runner.estimatedVRAM),
+		ExpiresAt:   runner.expiresAt,
+		Location:    "local",
+		Variant:     model.Variant,
+		Replica:     runner.replica,
+		InFlight:    int(runner.refCount),
+		State:       runner.state(),
+		NumCtx:      runner.numCtx(),
+		RefreshedBy: runner.refreshedBy,
+		GPUs:        runner.gpuIDs(),
+	}
+	if runner.llama != nil {
+		mr.Runner = runner.llama.Runner()
+	}
+	if runner.Options != nil {
+		mr.GPUConstraint = runner.Options.GPUs
+	}
+	if runner.remote != nil {
+		mr.Location = "remote"
+		mr.Host = runner.remote.host.String()
+	}
+	// The scheduler waits to set expiresAt, so if a model is loading it's
+	// possible that it will be set to the unix epoch. For those cases, just
+	// calculate the time w/ the sessionDuration instead.
+	var epoch time.Time
+	if runner.expiresAt == epoch {
+		mr.ExpiresAt = time.Now().Add(runner.sessionDuration)
+	}
+
+	return mr, true
+}
+
+// runners returns the loaded runners
+func (s *Scheduler) runners() []*runnerRef {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	runners := make([]*runnerRef, 0, len(s.loaded))
+	for _, runner := range s.loaded {
+		runners = append(runners, runner)
+	}
+	return runners
+}
+
 // The refMu must already be held when calling unload
 func (runner *runnerRef) unload() {
 	if runner.expireTimer != nil {
 		runner.expireTimer.Stop()
 		runner.expireTimer = nil
 	}
+	if runner.releaseTimer != nil {
+		runner.releaseTimer.Stop()
+		runner.releaseTimer = nil
+	}
 	if runner.llama != nil {
 		runner.llama.Close()
 	}
@@ -596,6 +1020,23 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	// Normalize the NumCtx for parallelism
 	optsExisting.NumCtx = optsExisting.NumCtx / runner.numParallel
 
+	// num_ctx 0 accepts the context length chosen when it loaded the runner
+	if optsNew.NumCtx == 0 && runner.autoNumCtx {
+		optsNew.NumCtx = optsExisting.NumCtx
+	}
+
+	// Changing the number of replicas doesn't change how each is loaded
+	optsExisting.Replicas = optsNew.Replicas
+
+	// Variants are loaded by separate runners, so forcing the one that's
+	// loaded doesn't change it
+	optsExisting.Quantization = optsNew.Quantization
+
+	// Placement is checked against the GPUs the runner is on, not the ones
+	// it was loaded with
+	optsExisting.GPUs = optsNew.GPUs
+	optsExisting.ForcePlacement = optsNew.ForcePlacement
+
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
@@ -701,9 +1142,8 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoL
 		sgl := append(make(gpu.GpuInfoList, 0, len(gl)), gl...)
 
 		// TODO - potentially sort by performance capability, existing models loaded, etc.
-		// TODO - Eliminate any GPUs that already have envconfig.MaxRunners loaded on them
-		// Note: at present, this will favor more VRAM over faster GPU speed in mixed setups
-		sort.Sort(sort.Reverse(gpu.ByFreeMemory(sgl)))
+		// Note: the default "free" ordering will favor more VRAM over faster GPU speed in mixed setups
+		order := sortGPUs(sgl)
 
 		// First attempt to fit the model into a single GPU
 		for _, p := range numParallelToTry {
@@ -711,10 +1151,11 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoL
 			if !envconfig.SchedSpread() {
 				for _, g := range sgl {
 					if ok, estimatedVRAM = llm.PredictServerFit([]gpu.GpuInfo{g}, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
-						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
+						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "order", order, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 						*numParallel = p
 						return []gpu.GpuInfo{g}
 					}
+					slog.Debug("skipping gpu, model does not fit in available VRAM", "model", req.model.ModelPath, "gpu", g.ID, "order", order, "parallel", p, "available", format.HumanBytes2(g.FreeMemory), "required", format.HumanBytes2(estimatedVRAM))
 				}
 			}
 		}
@@ -736,6 +1177,29 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoL
 	return nil
 }
 
+// sortGPUs orders the GPUs in place according to OLLAMA_GPU_ORDER and returns the ordering used
+//   - free: most free VRAM first
+//   - index: discovery order
+//   - memory: most total VRAM first
+func sortGPUs(gpus gpu.GpuInfoList) string {
+	order := envconfig.GpuOrder()
+	switch order {
+	case "index":
+		// GPUs are already in discovery order
+	case "memory":
+		sort.Stable(sort.Reverse(gpu.ByTotalMemory(gpus)))
+	default:
+		sort.Stable(sort.Reverse(gpu.ByFreeMemory(gpus)))
+	}
+
+	ids := make([]string, len(gpus))
+	for i, g := range gpus {
+		ids[i] = g.ID
+	}
+	slog.Debug("ordered gpus for placement", "order", order, "gpus", ids)
+	return order
+}
+
 // If multiple Libraries are detected, pick the Library which loads the most layers for the model
 func pickBestPartialFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel *int) gpu.GpuInfoList {
 	if *numParallel <= 0 {
@@ -763,7 +1227,10 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	s.loadedMu.Lock()
 	runnerList := make([]*runnerRef, 0, len(s.loaded))
 	for _, r := range s.loaded {
-		runnerList = append(runnerList, r)
+		// Unloading a remote runner doesn't free anything locally
+		if r.remote == nil {
+			runnerList = append(runnerList, r)
+		}
 	}
 	s.loadedMu.Unlock()
 	if len(runnerList) == 0 {
@@ -790,6 +1257,154 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	return runnerList[0]
 }
 
+// replicas returns the runners loaded for the model, ordered by replica. The
+// loadedMu must already be held when calling replicas
+func (s *Scheduler) replicas(modelPath string) []*runnerRef {
+	var replicas []*runnerRef
+	for _, r := range s.loaded {
+		if r.modelPath == modelPath {
+			replicas = append(replicas, r)
+		}
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].replica < replicas[j].replica })
+	return replicas
+}
+
+// loadSettings returns the effective memory settings of a model running on
+// this server, or nil if it isn't loaded locally
+func (s *Scheduler) loadSettings(modelPath string) *api.LoadSettings {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for _, r := range s.replicas(modelPath) {
+		if r.remote == nil && r.llama != nil {
+			return &api.LoadSettings{UseMMap: r.llama.UseMMap(), UseMLock: r.llama.UseMLock()}
+		}
+	}
+	return nil
+}
+
+// loadedOptions returns the options a model running on this server was loaded
+// with, or nil if it isn't loaded locally
+func (s *Scheduler) loadedOptions(modelPath string) *api.Options {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for _, r := range s.replicas(modelPath) {
+		if r.remote == nil && r.llama != nil && r.Options != nil {
+			opts := *r.Options
+			return &opts
+		}
+	}
+	return nil
+}
+
+// leastBusy returns the replica serving the fewest requests. Replicas that
+// are still loading are only picked if there's nothing else.
+func leastBusy(replicas []*runnerRef) *runnerRef {
+	var best *runnerRef
+	var bestCount uint
+	for _, r := range replicas {
+		// The refMu is held for the duration of a load
+		if !r.refMu.TryLock() {
+			continue
+		}
+		count := r.refCount
+		r.refMu.Unlock()
+		if best == nil || count < bestCount {
+			best, bestCount = r, count
+		}
+	}
+
+	if best == nil && len(replicas) > 0 {
+		return replicas[0]
+	}
+	return best
+}
+
+// nextReplica returns the lowest replica number not in use
+func nextReplica(replicas []*runnerRef) int {
+	var n int
+	for _, r := range replicas {
+		if r.replica != n {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// wantsReplica reports whether another replica should be loaded rather than
+// sharing runner, the least busy of the count replicas already loaded
+func wantsReplica(runner *runnerRef, req *LlmRequest, count int) bool {
+	want := req.opts.Replicas
+	if want <= 0 {
+		want = int(envconfig.ModelReplicas())
+	}
+	if runner.remote != nil || count >= want {
+		return false
+	}
+
+	if !runner.refMu.TryLock() {
+		// Still loading
+		return false
+	}
+	defer runner.refMu.Unlock()
+	return runner.refCount > 0
+}
+
+// filterGPUsWithReplicas returns the GPUs that don't hold any of the replicas
+func filterGPUsWithReplicas(allGpus gpu.GpuInfoList, replicas []*runnerRef) gpu.GpuInfoList {
+	if len(replicas) == 0 {
+		return allGpus
+	}
+
+	used := map[gpuKey]bool{}
+	for _, r := range replicas {
+		for _, g := range r.gpus {
+			used[gpuKey{g.Library, g.ID}] = true
+		}
+	}
+
+	var ret gpu.GpuInfoList
+	for _, g := range allGpus {
+		if !used[gpuKey{g.Library, g.ID}] {
+			ret = append(ret, g)
+		}
+	}
+	return ret
+}
+
+// loadProgress returns the progress of a runner loading the model, or false
+// if none is loading
+func (s *Scheduler) loadProgress(modelPath string) (float32, bool) {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for _, r := range s.replicas(modelPath) {
+		// The refMu is held for the duration of a load
+		loading := !r.refMu.TryLock()
+		if !loading {
+			loading = r.loading
+			r.refMu.Unlock()
+		}
+
+		if loading && r.llama != nil {
+			return r.llama.LoadProgress(), true
+		}
+	}
+	return 0, false
+}
+
+// localCount returns the number of runners loaded on this server. The
+// loadedMu must already be held when calling localCount
+func (s *Scheduler) localCount() int {
+	var n int
+	for _, r := range s.loaded {
+		if r.remote == nil {
+			n++
+		}
+	}
+	return n
+}
+
 func (s *Scheduler) unloadAllRunners() {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
@@ -804,8 +1419,7 @@ func (s *Scheduler) unloadAllRunners() {
 func (s *Scheduler) expireRunner(model *Model) {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
-	runner, ok := s.loaded[model.ModelPath]
-	if ok {
+	for _, runner := range s.replicas(model.ModelPath) {
 		runner.refMu.Lock()
 		runner.expiresAt = time.Now()
 		if runner.expireTimer != nil {
@@ -813,6 +1427,7 @@ func (s *Scheduler) expireRunner(model *Model) {
 			runner.expireTimer = nil
 		}
 		runner.sessionDuration = 0
+		s.version.Add(1)
 		if runner.refCount <= 0 {
 			s.expiredCh <- runner
 		}
@@ -820,6 +1435,22 @@ func (s *Scheduler) expireRunner(model *Model) {
 	}
 }
 
+// estimateFor returns the memory estimate for loading the request on gpus,
+// reusing the one made for an earlier attempt on the same GPUs
+func (req *LlmRequest) estimateFor(gpus gpu.GpuInfoList, ggml *llm.GGML) *llm.MemoryEstimate {
+	keys := make([]gpuKey, len(gpus))
+	for i, g := range gpus {
+		keys[i] = gpuKey{g.Library, g.ID}
+	}
+
+	if req.estimate == nil || !slices.Equal(keys, req.estimateGPUs) {
+		estimate := llm.EstimateGPULayers(gpus, ggml, req.model.ProjectorPaths, req.opts)
+		req.estimate, req.estimateGPUs = &estimate, keys
+	}
+
+	return req.estimate
+}
+
 // If other runners are loaded, make sure the pending request will fit in system memory
 // If not, pick a runner to unload, else return nil and the request can be loaded
 func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) *runnerRef {
@@ -834,3 +1465,20 @@ func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, ggml *llm.GGML,
 
 	return s.findRunnerToUnload()
 }
+
+// schedulerDebugState is the scheduler's internal state reported by the
+// scheduler debug endpoint
+type schedulerDebugState struct {
+	VRAM      vramLedgerState   `json:"vram"`
+	Queues    []modelQueueState `json:"queues"`
+	Admission []modelAdmission  `json:"admission,omitempty"`
+	Runners   []runnerSlots     `json:"runners,omitempty"`
+}
+
+func (s *Scheduler) debugState() schedulerDebugState {
+	return schedulerDebugState{
+		VRAM:      s.ledger.state(),
+		Queues:    s.queues.state(),
+		Admission: s.admission.state(),
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+)
+
+// cacheTimeout bounds how long the scheduler waits on a runner to free or
+// reallocate its KV cache
+const cacheTimeout = 30 * time.Second
+
+// Runner states reported by /api/ps
+const (
+	runnerStateActive        = "active"
+	runnerStateCacheReleased = "cache-released"
+	runnerStateUnloading     = "unloading"
+)
+
+// scheduleCacheRelease arms the timer that frees an idle runner's KV cache
+// once it has been idle for OLLAMA_CACHE_RELEASE. Runners that will unload
+// before then keep their cache until they do. The refMu must already be held
+// when calling scheduleCacheRelease
+func (s *Scheduler) scheduleCacheRelease(runner *runnerRef) {
+	d := envconfig.CacheRelease()
+	if d <= 0 || d >= runner.sessionDuration || runner.remote != nil || runner.cacheReleased {
+		return
+	}
+
+	if runner.releaseTimer != nil {
+		runner.releaseTimer.Reset(d)
+		return
+	}
+
+	runner.releaseTimer = time.AfterFunc(d, func() {
+		s.releaseCache(runner)
+	})
+}
+
+// releaseCache frees the KV cache of an idle runner and shrinks its ledger
+// reservation to the weights, so other models can be placed in the memory
+func (s *Scheduler) releaseCache(runner *runnerRef) {
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	runner.releaseTimer = nil
+	if runner.refCount > 0 || runner.cacheReleased || runner.unloading || runner.llama == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	if err := runner.llama.ReleaseCache(ctx); err != nil {
+		slog.Debug("unable to release KV cache", "modelPath", runner.modelPath, "error", err)
+		return
+	}
+
+	full := runner.vramSizes()
+	runner.cacheReleased = true
+	s.version.Add(1)
+	sizes := runner.vramSizes()
+	s.ledger.update(runner.key(), sizes)
+
+	var freed uint64
+	for key, size := range full {
+		freed += size - sizes[key]
+	}
+	runner.estimatedVRAM -= min(freed, runner.estimatedVRAM)
+	runner.estimatedTotal -= min(freed, runner.estimatedTotal)
+	slog.Info("released KV cache of idle model", "modelPath", runner.modelPath, "freed", format.HumanBytes2(freed))
+}
+
+// restoreCache reallocates the KV cache of a runner that released it, before
+// it's handed another request. It fails if the cache no longer fits because
+// other models were placed in the freed memory.
+func (s *Scheduler) restoreCache(runner *runnerRef) error {
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	if runner.releaseTimer != nil {
+		runner.releaseTimer.Stop()
+		runner.releaseTimer = nil
+	}
+	if !runner.cacheReleased {
+		return nil
+	}
+
+	released := runner.vramSizes()
+	runner.cacheReleased = false
+	full := runner.vramSizes()
+	if err := s.ledger.grow(runner.key(), s.getGpuFn(), full); err != nil {
+		runner.cacheReleased = true
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	if err := runner.llama.RestoreCache(ctx); err != nil {
+		runner.cacheReleased = true
+		s.ledger.update(runner.key(), released)
+		return fmt.Errorf("restoring KV cache: %w", err)
+	}
+
+	runner.estimatedVRAM = runner.llama.EstimatedVRAM()
+	runner.estimatedTotal = runner.llama.EstimatedTotal()
+	slog.Debug("restored KV cache", "modelPath", runner.modelPath)
+	return nil
+}
+
+// vramSizes returns the VRAM the runner is estimated to use on each GPU,
+// leaving out the KV cache while it's released. The refMu must already be
+// held when calling vramSizes
+func (runner *runnerRef) vramSizes() map[gpuKey]uint64 {
+	sizes := map[gpuKey]uint64{}
+	for _, g := range runner.gpus {
+		if g.Library == "cpu" {
+			continue
+		}
+
+		size := runner.llama.EstimatedVRAMByGPU(g.ID)
+		if runner.cacheReleased {
+			size -= min(runner.llama.EstimatedCacheByGPU(g.ID), size)
+		}
+		sizes[gpuKey{g.Library, g.ID}] = size
+	}
+	return sizes
+}
+
+// state reports whether the runner is serving with its KV cache, holding
+// only its weights, or unloading
+func (runner *runnerRef) state() string {
+	var epoch time.Time
+	switch {
+	case runner.unloading, runner.expiresAt != epoch && time.Now().After(runner.expiresAt) && runner.refCount == 0:
+		return runnerStateUnloading
+	case runner.cacheReleased:
+		return runnerStateCacheReleased
+	default:
+		return runnerStateActive
+	}
+}
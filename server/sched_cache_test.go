@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+)
+
+func TestCacheRelease(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+
+	t.Setenv("OLLAMA_CACHE_RELEASE", "10ms")
+	a := newScenarioRequest(t, ctx, "ollama-model-cache", 10*format.GigaByte, &api.Duration{Duration: time.Minute})
+	a.srv.estimatedVRAMByGPU = map[string]uint64{"": 10 * format.GigaByte}
+	a.srv.estimatedCacheByGPU = map[string]uint64{"": 4 * format.GigaByte}
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	s.newServerFn = a.newServer
+	s.Run(ctx)
+
+	getRunner := func(ctx context.Context) *runnerRef {
+		t.Helper()
+		successCh, errCh := s.GetRunner(ctx, a.req.model, a.req.opts, a.req.sessionDuration)
+		select {
+		case runner := <-successCh:
+			return runner
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	psState := func() string {
+		t.Helper()
+		srv := Server{sched: s}
+		w := createRequest(t, srv.PsHandler, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var ps api.ProcessResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&ps))
+		require.Len(t, ps.Models, 1)
+		return ps.Models[0].State
+	}
+
+	metal := gpuKey{"metal", ""}
+	ctx1, done1 := context.WithCancel(ctx)
+	runner := getRunner(ctx1)
+	require.Equal(t, runnerStateActive, psState())
+	require.Equal(t, 10*format.GigaByte, int(s.ledger.reserved()[metal]))
+
+	// Once idle, the cache is freed and the ledger only holds the weights
+	done1()
+	require.Eventually(t, func() bool {
+		runner.refMu.Lock()
+		defer runner.refMu.Unlock()
+		return runner.cacheReleased
+	}, time.Second, time.Millisecond)
+	require.True(t, a.srv.cacheReleased)
+	require.Equal(t, 6*format.GigaByte, int(s.ledger.reserved()[metal]))
+	require.Equal(t, runnerStateCacheReleased, psState())
+
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	s.loadedMu.Unlock()
+
+	// The next request gets the cache back
+	ctx2, done2 := context.WithCancel(ctx)
+	defer done2()
+	require.Same(t, runner, getRunner(ctx2))
+	require.False(t, a.srv.cacheReleased)
+	require.Equal(t, 10*format.GigaByte, int(s.ledger.reserved()[metal]))
+	require.Equal(t, runnerStateActive, psState())
+}
+
+func TestCacheReleaseDisabled(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	a := newScenarioRequest(t, ctx, "ollama-model-cache", 10, &api.Duration{Duration: time.Minute})
+	s := InitScheduler(ctx)
+	runner := &runnerRef{llama: a.srv, sessionDuration: time.Minute}
+
+	t.Setenv("OLLAMA_CACHE_RELEASE", "")
+	s.scheduleCacheRelease(runner)
+	require.Nil(t, runner.releaseTimer)
+
+	// Models that unload first keep their cache until then
+	t.Setenv("OLLAMA_CACHE_RELEASE", "5m")
+	s.scheduleCacheRelease(runner)
+	require.Nil(t, runner.releaseTimer)
+
+	t.Setenv("OLLAMA_CACHE_RELEASE", "10s")
+	s.scheduleCacheRelease(runner)
+	require.NotNil(t, runner.releaseTimer)
+	runner.releaseTimer.Stop()
+
+	// A busy runner keeps its cache
+	runner.refCount = 1
+	s.releaseCache(runner)
+	require.False(t, a.srv.cacheReleased)
+	require.False(t, runner.cacheReleased)
+}
+
+func TestRestoreCacheFailure(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	a := newScenarioRequest(t, ctx, "ollama-model-cache", 10*format.GigaByte, nil)
+	a.srv.estimatedVRAMByGPU = map[string]uint64{"0": 10 * format.GigaByte}
+	a.srv.estimatedCacheByGPU = map[string]uint64{"0": 4 * format.GigaByte}
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = twoGpuFn
+	runner := &runnerRef{llama: a.srv, modelPath: "a", gpus: twoGpuFn()[:1], sessionDuration: time.Minute}
+	cuda0 := gpuKey{"cuda", "0"}
+
+	s.releaseCache(runner)
+	require.True(t, runner.cacheReleased)
+	require.Equal(t, map[gpuKey]uint64{cuda0: 6 * format.GigaByte}, s.ledger.reserved())
+
+	// Another model was placed in the freed memory
+	s.ledger.update("b", map[gpuKey]uint64{cuda0: 16 * format.GigaByte})
+	require.ErrorContains(t, s.restoreCache(runner), "gpu 0 (cuda)")
+	require.True(t, runner.cacheReleased)
+
+	// The runner failing to allocate leaves the ledger as it was
+	s.ledger.release("b")
+	a.srv.restoreResp = errors.New("out of memory")
+	require.ErrorContains(t, s.restoreCache(runner), "out of memory")
+	require.True(t, runner.cacheReleased)
+	require.Equal(t, map[gpuKey]uint64{cuda0: 6 * format.GigaByte}, s.ledger.reserved())
+
+	a.srv.restoreResp = nil
+	require.NoError(t, s.restoreCache(runner))
+	require.False(t, runner.cacheReleased)
+	require.Equal(t, map[gpuKey]uint64{cuda0: 10 * format.GigaByte}, s.ledger.reserved())
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log/slog"
+	"math/bits"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// minAutoNumCtx is the smallest context length num_ctx 0 is reduced to when
+// the model's doesn't fit in memory, the default num_ctx
+const minAutoNumCtx = 2048
+
+// autoNumCtx chooses the context length of a request with num_ctx 0: the
+// length the model was trained with, capped by OLLAMA_MAX_CONTEXT, and
+// halved to powers of two until the model fits in memory.
+func (s *Scheduler) autoNumCtx(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) int {
+	trained := int(ggml.KV().ContextLength())
+	numCtx, reason := trained, "trained context length"
+	if trained == 0 {
+		numCtx, reason = api.DefaultOptions().NumCtx, "default, the model has no trained context length"
+	}
+
+	if limit := int(envconfig.MaxContext()); limit > 0 && numCtx > limit {
+		numCtx, reason = limit, "OLLAMA_MAX_CONTEXT"
+	}
+
+	fits := func(n int) bool {
+		r := *req
+		r.origNumCtx = n
+		return s.fitsLocally(&r, ggml, gpus)
+	}
+
+	if len(gpus) > 0 {
+		n := numCtx
+		for n > minAutoNumCtx && !fits(n) {
+			n = max(prevPowerOfTwo(n), minAutoNumCtx)
+		}
+
+		if n < numCtx {
+			numCtx, reason = n, "available memory"
+		}
+	}
+
+	slog.Info("choosing context length automatically", "model", req.model.ModelPath, "num_ctx", numCtx, "reason", reason, "trained", trained, "OLLAMA_MAX_CONTEXT", envconfig.MaxContext())
+	return numCtx
+}
+
+// prevPowerOfTwo returns the largest power of two less than n
+func prevPowerOfTwo(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+// numCtx returns the context length of each of the runner's parallel
+// sequences
+func (runner *runnerRef) numCtx() int {
+	if runner.Options == nil {
+		return 0
+	}
+
+	return runner.Options.NumCtx / max(runner.numParallel, 1)
+}
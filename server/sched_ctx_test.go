@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestAutoNumCtx(t *testing.T) {
+	model := func(t *testing.T, trained uint32) (*LlmRequest, *llm.GGML) {
+		f, err := os.CreateTemp(t.TempDir(), "model")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		kv := llm.KV{
+			"general.architecture":          "llama",
+			"llama.embedding_length":        uint32(4096),
+			"llama.block_count":             uint32(32),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{" "},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}
+		if trained > 0 {
+			kv["llama.context_length"] = trained
+		}
+
+		if err := llm.WriteGGUF(f, kv, []llm.Tensor{
+			{Name: "blk.0.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, err := llm.LoadModel(f.Name(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := api.DefaultOptions()
+		opts.NumCtx = 0
+		return &LlmRequest{model: &Model{ModelPath: f.Name()}, opts: opts}, ggml
+	}
+
+	// cpu returns system memory with room for the model with a context
+	// length of numCtx and a little more
+	cpu := func(req *LlmRequest, ggml *llm.GGML, numCtx int) gpu.GpuInfoList {
+		var g gpu.GpuInfo
+		g.Library = "cpu"
+		g.FreeMemory = 1 << 50
+		opts := req.opts
+		opts.NumCtx = numCtx
+		g.FreeMemory = llm.EstimateGPULayers([]gpu.GpuInfo{g}, ggml, nil, opts).TotalSize * 11 / 10
+		g.TotalMemory = g.FreeMemory
+		return gpu.GpuInfoList{g}
+	}
+
+	cases := []struct {
+		name       string
+		trained    uint32
+		maxContext string
+		fits       int
+		expect     int
+	}{
+		{name: "trained", trained: 8192, maxContext: "32768", fits: 8192, expect: 8192},
+		{name: "capped", trained: 131072, maxContext: "32768", fits: 131072, expect: 32768},
+		{name: "uncapped", trained: 131072, maxContext: "0", fits: 131072, expect: 131072},
+		{name: "memory", trained: 131072, maxContext: "0", fits: 40000, expect: 32768},
+		{name: "not a power of two", trained: 100000, maxContext: "0", fits: 80000, expect: 65536},
+		{name: "nothing fits", trained: 131072, maxContext: "0", fits: 1024, expect: 2048},
+		{name: "short", trained: 512, maxContext: "0", fits: 256, expect: 512},
+		{name: "untrained", maxContext: "0", fits: 131072, expect: 2048},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_MAX_CONTEXT", tt.maxContext)
+
+			req, ggml := model(t, tt.trained)
+			s := Scheduler{ledger: newVRAMLedger()}
+			if numCtx := s.autoNumCtx(req, ggml, cpu(req, ggml, tt.fits)); numCtx != tt.expect {
+				t.Errorf("expected num_ctx %d, got %d", tt.expect, numCtx)
+			}
+		})
+	}
+}
+
+func TestNeedsReloadAutoNumCtx(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.NumCtx = 8192
+	runner := &runnerRef{model: &Model{}, Options: &opts, numParallel: 2, llama: &mockLlm{}}
+
+	if n := runner.numCtx(); n != 4096 {
+		t.Errorf("expected a context length of 4096 per sequence, got %d", n)
+	}
+
+	req := &LlmRequest{model: &Model{}, opts: api.DefaultOptions()}
+	req.opts.NumCtx = 0
+	if !runner.needsReload(context.Background(), req) {
+		t.Error("expected num_ctx 0 to reload a runner loaded with an explicit num_ctx")
+	}
+
+	runner.autoNumCtx = true
+	if runner.needsReload(context.Background(), req) {
+		t.Error("expected num_ctx 0 to use a runner loaded with num_ctx 0")
+	}
+
+	req.opts.NumCtx = 2048
+	if !runner.needsReload(context.Background(), req) {
+		t.Error("expected an explicit num_ctx to reload the runner")
+	}
+}
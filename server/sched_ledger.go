@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+)
+
+// gpuKey identifies a GPU across libraries since IDs are only unique within a library
+type gpuKey struct {
+	Library string
+	ID      string
+}
+
+// vramLedger tracks the VRAM the scheduler expects each runner to consume on
+// each GPU. Reservations are made when a model is placed, before the runner
+// starts allocating, and released when the runner unloads. Free memory
+// reported by the GPU libraries lags behind loads that are still ramping up,
+// so placement uses the smaller of the most recent reading and the total
+// minus everything reserved in the ledger.
+type vramLedger struct {
+	mu           sync.Mutex
+	reservations map[string]map[gpuKey]uint64 // model path -> gpu -> bytes
+	readings     map[gpuKey]gpuReading
+}
+
+// gpuReading is the most recent free memory report for a GPU
+type gpuReading struct {
+	total uint64
+	free  uint64
+	at    time.Time
+}
+
+func newVRAMLedger() *vramLedger {
+	return &vramLedger{
+		reservations: make(map[string]map[gpuKey]uint64),
+		readings:     make(map[gpuKey]gpuReading),
+	}
+}
+
+// observe records the free memory reported by discovery for each GPU
+func (l *vramLedger) observe(gpus gpu.GpuInfoList) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, g := range gpus {
+		if g.Library == "cpu" {
+			continue
+		}
+		l.readings[gpuKey{g.Library, g.ID}] = gpuReading{total: g.TotalMemory, free: g.FreeMemory, at: now}
+	}
+}
+
+// reserve atomically checks that sizes fit alongside the reservations held by
+// other models and records them for modelPath, replacing any prior
+// reservation. The GPU list supplies the free and total memory to check
+// against; GPUs that report no total memory are not checked.
+func (l *vramLedger) reserve(modelPath string, gpus gpu.GpuInfoList, sizes map[gpuKey]uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, g := range gpus {
+		key := gpuKey{g.Library, g.ID}
+		size := sizes[key]
+		if size == 0 || g.TotalMemory == 0 {
+			continue
+		}
+
+		others := l.reservedLocked(key, modelPath)
+		available := g.FreeMemory
+		if others >= g.TotalMemory {
+			available = 0
+		} else if g.TotalMemory-others < available {
+			available = g.TotalMemory - others
+		}
+
+		if size > available {
+			return fmt.Errorf("gpu %s (%s) has %s available after %s reserved by other models, %s required",
+				g.ID, g.Library, format.HumanBytes2(available), format.HumanBytes2(others), format.HumanBytes2(size))
+		}
+	}
+
+	l.reservations[modelPath] = sizes
+	return nil
+}
+
+// update replaces the reservation for modelPath without checking that it fits.
+// It is used once a runner reports its own estimate for a placement that has
+// already been reserved.
+func (l *vramLedger) update(modelPath string, sizes map[gpuKey]uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reservations[modelPath] = sizes
+}
+
+// grow raises the reservation for modelPath to sizes. Only the increase over
+// the current reservation is checked, against the free memory the GPUs report
+// and the memory not reserved by any model, since the rest is already in use
+// by modelPath.
+func (l *vramLedger) grow(modelPath string, gpus gpu.GpuInfoList, sizes map[gpuKey]uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, g := range gpus {
+		key := gpuKey{g.Library, g.ID}
+		current := l.reservations[modelPath][key]
+		size := sizes[key]
+		if size <= current || g.TotalMemory == 0 {
+			continue
+		}
+
+		reserved := l.reservedLocked(key, "")
+		available := g.FreeMemory
+		if reserved >= g.TotalMemory {
+			available = 0
+		} else if g.TotalMemory-reserved < available {
+			available = g.TotalMemory - reserved
+		}
+
+		if size-current > available {
+			return fmt.Errorf("gpu %s (%s) has %s available after %s reserved, %s more required",
+				g.ID, g.Library, format.HumanBytes2(available), format.HumanBytes2(reserved), format.HumanBytes2(size-current))
+		}
+	}
+
+	l.reservations[modelPath] = sizes
+	return nil
+}
+
+// release drops the reservation held for modelPath
+func (l *vramLedger) release(modelPath string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.reservations, modelPath)
+}
+
+// has reports whether modelPath holds a reservation
+func (l *vramLedger) has(modelPath string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.reservations[modelPath]
+	return ok
+}
+
+// reserved returns the sum of all reservations per GPU
+func (l *vramLedger) reserved() map[gpuKey]uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := map[gpuKey]uint64{}
+	for _, sizes := range l.reservations {
+		for key, size := range sizes {
+			ret[key] += size
+		}
+	}
+	return ret
+}
+
+// reservedLocked returns the bytes reserved on a GPU by every model except
+// skip. The ledger lock must be held.
+func (l *vramLedger) reservedLocked(key gpuKey, skip string) uint64 {
+	var total uint64
+	for path, sizes := range l.reservations {
+		if path != skip {
+			total += sizes[key]
+		}
+	}
+	return total
+}
+
+// ledgerGPU is the state of a single GPU as seen by the ledger
+type ledgerGPU struct {
+	Library      string    `json:"library"`
+	ID           string    `json:"id"`
+	Total        uint64    `json:"total"`
+	ReportedFree uint64    `json:"reported_free"`
+	ReportedAt   time.Time `json:"reported_at"`
+	Reserved     uint64    `json:"reserved"`
+	ExpectedFree uint64    `json:"expected_free"`
+
+	// Unaccounted is memory the GPU reports in use beyond what the ledger
+	// expects, e.g. other applications or an underestimated runner. A negative
+	// value means reservations haven't been allocated yet, such as while a
+	// model is still loading.
+	Unaccounted int64 `json:"unaccounted"`
+}
+
+// ledgerReservation is a single model's reservation on a GPU
+type ledgerReservation struct {
+	Model   string `json:"model"`
+	Library string `json:"library"`
+	ID      string `json:"id"`
+	Size    uint64 `json:"size"`
+}
+
+// vramLedgerState is a point in time view of the ledger
+type vramLedgerState struct {
+	GPUs         []ledgerGPU         `json:"gpus"`
+	Reservations []ledgerReservation `json:"reservations"`
+}
+
+func (l *vramLedger) state() vramLedgerState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := vramLedgerState{
+		GPUs:         []ledgerGPU{},
+		Reservations: []ledgerReservation{},
+	}
+
+	reserved := map[gpuKey]uint64{}
+	for path, sizes := range l.reservations {
+		for key, size := range sizes {
+			reserved[key] += size
+			state.Reservations = append(state.Reservations, ledgerReservation{Model: path, Library: key.Library, ID: key.ID, Size: size})
+		}
+	}
+
+	for key, r := range l.readings {
+		g := ledgerGPU{
+			Library:      key.Library,
+			ID:           key.ID,
+			Total:        r.total,
+			ReportedFree: r.free,
+			ReportedAt:   r.at,
+			Reserved:     reserved[key],
+		}
+		if g.Reserved < g.Total {
+			g.ExpectedFree = g.Total - g.Reserved
+		}
+		if r.total >= r.free {
+			g.Unaccounted = int64(r.total-r.free) - int64(g.Reserved)
+		}
+		state.GPUs = append(state.GPUs, g)
+	}
+
+	sort.Slice(state.GPUs, func(i, j int) bool {
+		if state.GPUs[i].Library != state.GPUs[j].Library {
+			return state.GPUs[i].Library < state.GPUs[j].Library
+		}
+		return state.GPUs[i].ID < state.GPUs[j].ID
+	})
+	sort.Slice(state.Reservations, func(i, j int) bool {
+		a, b := state.Reservations[i], state.Reservations[j]
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		if a.Library != b.Library {
+			return a.Library < b.Library
+		}
+		return a.ID < b.ID
+	})
+	return state
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestVRAMLedger(t *testing.T) {
+	gpus := gpu.GpuInfoList{
+		{Library: "cuda", ID: "0"},
+		{Library: "cuda", ID: "1"},
+	}
+	gpus[0].TotalMemory = 1000
+	gpus[0].FreeMemory = 900
+	gpus[1].TotalMemory = 2000
+	gpus[1].FreeMemory = 2000
+	gpu0 := gpuKey{"cuda", "0"}
+	gpu1 := gpuKey{"cuda", "1"}
+
+	l := newVRAMLedger()
+	l.observe(gpus)
+
+	require.NoError(t, l.reserve("a", gpus, map[gpuKey]uint64{gpu0: 600, gpu1: 100}))
+	require.True(t, l.has("a"))
+
+	// The stale reading still reports 900 free on gpu 0, but only 400 is unreserved
+	err := l.reserve("b", gpus, map[gpuKey]uint64{gpu0: 500})
+	require.ErrorContains(t, err, "gpu 0 (cuda)")
+	require.False(t, l.has("b"))
+
+	require.NoError(t, l.reserve("b", gpus, map[gpuKey]uint64{gpu0: 400}))
+
+	// Reserving again for the same model replaces the prior reservation
+	require.NoError(t, l.reserve("a", gpus, map[gpuKey]uint64{gpu0: 500}))
+	require.Equal(t, map[gpuKey]uint64{gpu0: 900}, l.reserved())
+
+	// The free memory reading caps what can be reserved
+	require.Error(t, l.reserve("c", gpus, map[gpuKey]uint64{gpu1: 2001}))
+
+	// GPUs without a total are not checked
+	require.NoError(t, l.reserve("c", gpu.GpuInfoList{{Library: "metal"}}, map[gpuKey]uint64{{"metal", ""}: 1 << 40}))
+	l.release("c")
+
+	l.update("a", map[gpuKey]uint64{gpu0: 550, gpu1: 50})
+	require.Equal(t, map[gpuKey]uint64{gpu0: 950, gpu1: 50}, l.reserved())
+
+	state := l.state()
+	require.Len(t, state.GPUs, 2)
+	require.Equal(t, "0", state.GPUs[0].ID)
+	require.Equal(t, uint64(950), state.GPUs[0].Reserved)
+	require.Equal(t, uint64(50), state.GPUs[0].ExpectedFree)
+	require.Equal(t, int64(100-950), state.GPUs[0].Unaccounted)
+	require.Equal(t, uint64(1950), state.GPUs[1].ExpectedFree)
+	require.Equal(t, []ledgerReservation{
+		{Model: "a", Library: "cuda", ID: "0", Size: 550},
+		{Model: "a", Library: "cuda", ID: "1", Size: 50},
+		{Model: "b", Library: "cuda", ID: "0", Size: 400},
+	}, state.Reservations)
+
+	l.release("a")
+	l.release("b")
+	require.Empty(t, l.reserved())
+	require.Empty(t, l.state().Reservations)
+}
+
+func TestConcurrentLoadsSameGPU(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.reschedDelay = 5 * time.Millisecond
+
+	a := newScenarioRequest(t, ctx, "ollama-model-race-a", 0, nil)
+	b := newScenarioRequest(t, ctx, "ollama-model-race-b", 0, nil)
+
+	// Size the GPU so either model fits in the reported free memory, but not both
+	g := gpu.GpuInfo{Library: "cuda", ID: "0"}
+	g.TotalMemory = 1 << 40
+	g.FreeMemory = 1 << 40
+	size := llm.EstimateGPULayers(gpu.GpuInfoList{g}, a.ggml, nil, a.req.opts).GPUSizes[0]
+	require.NotZero(t, size)
+	g.TotalMemory = size * 3 / 2
+	g.FreeMemory = size * 3 / 2
+	gpus := gpu.GpuInfoList{g}
+
+	for _, r := range []*reqBundle{a, b} {
+		r.srv.estimatedVRAMByGPU = map[string]uint64{"0": size}
+	}
+	servers := map[string]*mockLlm{a.req.model.ModelPath: a.srv, b.req.model.ModelPath: b.srv}
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
+		return servers[model], nil
+	}
+
+	// Both loads were placed against the same stale snapshot of free memory
+	var wg sync.WaitGroup
+	for _, r := range []*reqBundle{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.load(r.req, r.ggml, gpus, 1)
+		}()
+	}
+	wg.Wait()
+
+	var loaded, delayed *reqBundle
+	select {
+	case <-a.req.successCh:
+		loaded, delayed = a, b
+	case <-b.req.successCh:
+		loaded, delayed = b, a
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	require.Empty(t, delayed.req.successCh)
+	require.Empty(t, delayed.req.errCh)
+
+	// The losing load is put back on the queue rather than overcommitting the GPU
+	require.Eventually(t, func() bool { return s.queues.len() == 1 }, 250*time.Millisecond, 5*time.Millisecond)
+	require.Equal(t, delayed.req, s.queues.pop())
+
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	require.NotNil(t, s.loaded[loaded.req.model.ModelPath])
+	s.loadedMu.Unlock()
+	require.Equal(t, map[gpuKey]uint64{{"cuda", "0"}: size}, s.ledger.reserved())
+
+	// Placement now sees the reservation even though the GPU still reports the stale value
+	s.updateFreeSpace(gpus)
+	require.Equal(t, size/2, gpus[0].FreeMemory)
+}
+
+func TestLoadReserveConflictGivesUp(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	s := InitScheduler(ctx)
+	s.reschedDelay = time.Millisecond
+
+	a := newScenarioRequest(t, ctx, "ollama-model-reserve", 0, nil)
+	g := gpu.GpuInfo{Library: "cuda", ID: "0"}
+	g.TotalMemory = 1 << 40
+	g.FreeMemory = 1 << 40
+	gpus := gpu.GpuInfoList{g}
+
+	// another load holds all of the GPU's memory
+	require.NoError(t, s.ledger.reserve("other", gpus, map[gpuKey]uint64{{"cuda", "0"}: 1 << 40}))
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
+		t.Fatal("expected the load not to start")
+		return nil, nil
+	}
+
+	var estimate *llm.MemoryEstimate
+	for range maxReserveAttempts {
+		s.load(a.req, a.ggml, gpus, 1)
+		require.Eventually(t, func() bool { return s.queues.len() == 1 }, time.Second, time.Millisecond)
+		require.Equal(t, a.req, s.queues.pop())
+
+		// the estimate is made once for all attempts on the same GPUs
+		if estimate == nil {
+			estimate = a.req.estimate
+		}
+		require.Same(t, estimate, a.req.estimate)
+	}
+
+	s.load(a.req, a.ggml, gpus, 1)
+	select {
+	case err := <-a.req.errCh:
+		require.ErrorIs(t, err, errReserveTimeout)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestVRAMLedgerGrow(t *testing.T) {
+	gpus := gpu.GpuInfoList{{Library: "cuda", ID: "0"}}
+	gpus[0].TotalMemory = 1000
+	gpus[0].FreeMemory = 300
+	gpu0 := gpuKey{"cuda", "0"}
+
+	l := newVRAMLedger()
+	l.update("a", map[gpuKey]uint64{gpu0: 400})
+	l.update("b", map[gpuKey]uint64{gpu0: 300})
+
+	// Only the increase has to fit, in what's free and unreserved
+	require.NoError(t, l.grow("a", gpus, map[gpuKey]uint64{gpu0: 650}))
+	require.Equal(t, map[gpuKey]uint64{gpu0: 950}, l.reserved())
+
+	err := l.grow("a", gpus, map[gpuKey]uint64{gpu0: 750})
+	require.ErrorContains(t, err, "gpu 0 (cuda)")
+	require.Equal(t, map[gpuKey]uint64{gpu0: 950}, l.reserved())
+
+	// Shrinking always succeeds
+	require.NoError(t, l.grow("a", gpus, map[gpuKey]uint64{gpu0: 100}))
+	require.Equal(t, map[gpuKey]uint64{gpu0: 400}, l.reserved())
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+// errGPUSelection is returned for gpus options that don't name GPUs the
+// server discovered
+var errGPUSelection = errors.New("invalid gpus option")
+
+// selectGPUs resolves the gpus option, where each selector is the ID of a
+// discovered GPU or its index in discovery order, to the IDs of the GPUs it
+// names. Selectors may also be comma separated, as in a Modelfile's
+// "PARAMETER gpus 1,2,3".
+func selectGPUs(gpus gpu.GpuInfoList, selectors []string) ([]string, error) {
+	var discovered gpu.GpuInfoList
+	for _, g := range gpus {
+		if g.Library != "cpu" {
+			discovered = append(discovered, g)
+		}
+	}
+
+	var ids []string
+	for _, s := range selectors {
+		for _, sel := range strings.Split(s, ",") {
+			sel = strings.TrimSpace(sel)
+			if sel == "" {
+				continue
+			}
+
+			if len(discovered) == 0 {
+				return nil, fmt.Errorf("%w: no GPUs were discovered", errGPUSelection)
+			}
+
+			id, ok := matchGPU(discovered, sel)
+			if !ok {
+				var names []string
+				for i, g := range discovered {
+					names = append(names, fmt.Sprintf("%d (%s)", i, g.ID))
+				}
+				return nil, fmt.Errorf("%w: %q isn't the index or ID of a GPU, expected one of %s", errGPUSelection, sel, strings.Join(names, ", "))
+			}
+
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// matchGPU returns the ID of the GPU with the ID sel or, failing that, at
+// index sel
+func matchGPU(gpus gpu.GpuInfoList, sel string) (string, bool) {
+	for _, g := range gpus {
+		if strings.EqualFold(g.ID, sel) {
+			return g.ID, true
+		}
+	}
+
+	if i, err := strconv.Atoi(sel); err == nil && i >= 0 && i < len(gpus) {
+		return gpus[i].ID, true
+	}
+
+	return "", false
+}
+
+// filterGPUsBySelection returns the GPUs with the IDs selected by the gpus
+// option
+func filterGPUsBySelection(allGpus gpu.GpuInfoList, selected []string) gpu.GpuInfoList {
+	var gpus gpu.GpuInfoList
+	for _, g := range allGpus {
+		if g.Library != "cpu" && slices.Contains(selected, g.ID) {
+			gpus = append(gpus, g)
+		}
+	}
+
+	return gpus
+}
+
+// gpuIDs returns the IDs of the GPUs the runner was placed on
+func (runner *runnerRef) gpuIDs() []string {
+	var ids []string
+	for _, g := range runner.gpus {
+		if g.Library != "cpu" {
+			ids = append(ids, g.ID)
+		}
+	}
+
+	return ids
+}
+
+// placedWithin reports whether the runner is only on GPUs in selected, which
+// is true of any runner if nothing is selected. Runners on the CPU or a
+// remote server can't be placed anywhere else, so they're within any
+// selection.
+func (runner *runnerRef) placedWithin(selected []string) bool {
+	if len(selected) == 0 || runner.remote != nil {
+		return true
+	}
+
+	for _, id := range runner.gpuIDs() {
+		if !slices.Contains(selected, id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// replicasPlacedWithin returns the replicas placed within selected
+func replicasPlacedWithin(replicas []*runnerRef, selected []string) []*runnerRef {
+	var placed []*runnerRef
+	for _, r := range replicas {
+		if r.placedWithin(selected) {
+			placed = append(placed, r)
+		}
+	}
+
+	return placed
+}
+
+// placementWarning explains that a request selecting GPUs was served by a
+// runner loaded elsewhere, or returns "" if it wasn't
+func (runner *runnerRef) placementWarning(opts *api.Options) string {
+	if runner.placedWithin(opts.GPUs) {
+		return ""
+	}
+
+	return fmt.Sprintf("model is already loaded on GPUs %s rather than the requested %s, set force_placement to reload it",
+		strings.Join(runner.gpuIDs(), ", "), strings.Join(opts.GPUs, ", "))
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestSelectGPUs(t *testing.T) {
+	gpus := append(gpu.GpuInfoList{{Library: "cpu", ID: "0"}}, twoGpuFn()...)
+	gpus[2].ID = "GPU-8b1c2d3e"
+
+	cases := []struct {
+		selectors []string
+		expect    []string
+		err       bool
+	}{
+		{nil, nil, false},
+		{[]string{"0"}, []string{"0"}, false},
+		{[]string{"1"}, []string{"GPU-8b1c2d3e"}, false},
+		{[]string{"gpu-8B1C2D3E"}, []string{"GPU-8b1c2d3e"}, false},
+		{[]string{"1,0"}, []string{"GPU-8b1c2d3e", "0"}, false},
+		{[]string{"0", " 0 ", "GPU-8b1c2d3e", "1"}, []string{"0", "GPU-8b1c2d3e"}, false},
+		{[]string{"2"}, nil, true},
+		{[]string{"-1"}, nil, true},
+		{[]string{"GPU-missing"}, nil, true},
+	}
+
+	for _, tt := range cases {
+		ids, err := selectGPUs(gpus, tt.selectors)
+		if tt.err {
+			if !errors.Is(err, errGPUSelection) {
+				t.Errorf("selectGPUs(%q): expected a selection error, got %v", tt.selectors, err)
+			}
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, tt.expect, ids, "selectGPUs(%q)", tt.selectors)
+	}
+
+	if _, err := selectGPUs(gpu.GpuInfoList{{Library: "cpu", ID: "0"}}, []string{"0"}); !errors.Is(err, errGPUSelection) {
+		t.Errorf("expected a selection error without GPUs, got %v", err)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+
+	a := newScenarioRequest(t, ctx, "ollama-model-placement", 10, &api.Duration{Duration: time.Minute})
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "0")
+
+	s := InitScheduler(ctx)
+	// unloading a model from a single Metal GPU doesn't wait for the
+	// system's VRAM to recover, which forcing placement does below
+	s.getGpuFn = func() gpu.GpuInfoList {
+		gpus := twoGpuFn()
+		for i := range gpus {
+			gpus[i].Library = "metal"
+		}
+		return gpus
+	}
+	s.getCpuFn = getCpuFn
+	var mu sync.Mutex
+	var loads []gpu.GpuInfoList
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads = append(loads, gpus)
+		srv := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
+		for _, g := range gpus {
+			srv.estimatedVRAMByGPU[g.ID] = 10
+		}
+		return srv, nil
+	}
+	s.Run(ctx)
+
+	getRunner := func(gpus []string, force bool) *runnerRef {
+		t.Helper()
+		opts := a.req.opts
+		opts.GPUs = gpus
+		opts.ForcePlacement = force
+		successCh, errCh := s.GetRunner(ctx, a.req.model, opts, &api.Duration{Duration: time.Minute})
+		select {
+		case runner := <-successCh:
+			runner.refMu.Lock()
+			runner.refCount--
+			runner.refMu.Unlock()
+			return runner
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	// The first load is only placed on the selected GPU
+	first := getRunner([]string{"1"}, false)
+	require.Equal(t, []string{"1"}, first.gpuIDs())
+	require.Empty(t, first.placementWarning(&api.Options{Runner: api.Runner{GPUs: []string{"1"}}}))
+
+	// The default number of loaded models counts every GPU, not only the selected one
+	require.EqualValues(t, defaultModelsPerGPU*2, envconfig.MaxRunners())
+
+	// Selecting other GPUs is served from the existing placement with a warning
+	second := getRunner([]string{"0"}, false)
+	require.Same(t, first, second)
+	require.Contains(t, second.placementWarning(&api.Options{Runner: api.Runner{GPUs: []string{"0"}}}), "force_placement")
+
+	mu.Lock()
+	require.Len(t, loads, 1)
+	mu.Unlock()
+
+	// Forcing placement reloads the model on the selected GPU
+	third := getRunner([]string{"0"}, true)
+	require.NotSame(t, first, third)
+	require.Equal(t, []string{"0"}, third.gpuIDs())
+
+	mu.Lock()
+	require.Len(t, loads, 2)
+	mu.Unlock()
+
+	// Once placed within the selection, forcing doesn't reload it again
+	require.Same(t, third, getRunner([]string{"0"}, true))
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// requestQueues holds the pending requests for each model. Requests for a
+// model are served in arrival order, while the models themselves are served
+// round-robin so a burst against one model can't starve the others. Each
+// model's queue is bounded by depth and all queues together by limit.
+type requestQueues struct {
+	mu     sync.Mutex
+	queues map[string][]*LlmRequest // model path -> pending requests
+	order  []string                 // model paths with pending requests, next to be served first
+	count  int
+	depth  int
+	limit  int
+
+	// room is broadcast when a request leaves the queues, waking requeued
+	// requests waiting for their place back
+	room    *sync.Cond
+	waiting map[string]int // model path -> requeued requests waiting for room
+
+	// readyCh is signaled while any request is pending
+	readyCh chan struct{}
+}
+
+// newRequestQueues creates queues holding at most limit requests in total and
+// at most depth for any one model. If depth isn't set a single model may use
+// the whole limit.
+func newRequestQueues(limit, depth int) *requestQueues {
+	if depth <= 0 {
+		depth = limit
+	}
+	depth = min(depth, limit)
+	q := &requestQueues{
+		queues:  make(map[string][]*LlmRequest),
+		depth:   depth,
+		limit:   limit,
+		waiting: make(map[string]int),
+		readyCh: make(chan struct{}, 1),
+	}
+	q.room = sync.NewCond(&q.mu)
+	return q
+}
+
+// push admits a new request to the back of its model's queue, returning
+// ErrMaxQueue if either the model's queue or all queues together are full
+func (q *requestQueues) push(req *LlmRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.full(req.model.ModelPath) {
+		return ErrMaxQueue
+	}
+	req.enqueuedAt = time.Now()
+	q.append(req)
+	return nil
+}
+
+// requeue puts an already admitted request back on its model's queue. It
+// counts against the same limits as new requests, so if the queues filled up
+// while the request was out it waits for room, ahead of any new requests,
+// unless the request is canceled first.
+func (q *requestQueues) requeue(req *LlmRequest) {
+	stop := context.AfterFunc(req.ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.room.Broadcast()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	path := req.model.ModelPath
+	for q.count >= q.limit || len(q.queues[path]) >= q.depth {
+		if err := req.ctx.Err(); err != nil {
+			req.errCh <- err
+			return
+		}
+
+		q.waiting[path]++
+		q.room.Wait()
+		q.waiting[path]--
+		if q.waiting[path] == 0 {
+			delete(q.waiting, path)
+		}
+	}
+	q.append(req)
+}
+
+// full reports whether a new request for the model would exceed the limits.
+// Requeued requests waiting for room count as queued so new requests can't
+// take their place. The mu must already be held when calling full
+func (q *requestQueues) full(path string) bool {
+	waiting := 0
+	for _, n := range q.waiting {
+		waiting += n
+	}
+	return q.count+waiting >= q.limit || len(q.queues[path])+q.waiting[path] >= q.depth
+}
+
+// The mu must already be held when calling append
+func (q *requestQueues) append(req *LlmRequest) {
+	path := req.model.ModelPath
+	if len(q.queues[path]) == 0 {
+		q.order = append(q.order, path)
+	}
+	q.queues[path] = append(q.queues[path], req)
+	q.count++
+	q.signal()
+}
+
+// pop removes the oldest request for the next model in round-robin order, or
+// returns nil if nothing is pending
+func (q *requestQueues) pop() *LlmRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	path := q.order[0]
+	q.order = q.order[1:]
+	req := q.queues[path][0]
+	q.queues[path][0] = nil
+	q.queues[path] = q.queues[path][1:]
+	if len(q.queues[path]) > 0 {
+		// Move to the back so the other models get a turn first
+		q.order = append(q.order, path)
+	} else {
+		delete(q.queues, path)
+	}
+	q.count--
+	q.room.Broadcast()
+
+	if q.count > 0 {
+		q.signal()
+	}
+	return req
+}
+
+// The mu must already be held when calling signal
+func (q *requestQueues) signal() {
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// modelLen returns the number of pending requests for the model
+func (q *requestQueues) modelLen(modelPath string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queues[modelPath])
+}
+
+func (q *requestQueues) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// modelQueueState is a model's pending requests reported by the scheduler
+// debug endpoint
+type modelQueueState struct {
+	Model             string    `json:"model"`
+	Length            int       `json:"length"`
+	OldestEnqueuedAt  time.Time `json:"oldest_enqueued_at"`
+	OldestWaitSeconds float64   `json:"oldest_wait_seconds"`
+}
+
+func (q *requestQueues) state() []modelQueueState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	state := []modelQueueState{}
+	for path, reqs := range q.queues {
+		// Requeued requests keep their original arrival time, so the oldest
+		// isn't necessarily at the front
+		oldest := reqs[0].enqueuedAt
+		for _, req := range reqs[1:] {
+			if req.enqueuedAt.Before(oldest) {
+				oldest = req.enqueuedAt
+			}
+		}
+		state = append(state, modelQueueState{
+			Model:             path,
+			Length:            len(reqs),
+			OldestEnqueuedAt:  oldest,
+			OldestWaitSeconds: now.Sub(oldest).Seconds(),
+		})
+	}
+
+	sort.Slice(state, func(i, j int) bool {
+		return state[i].Model < state[j].Model
+	})
+	return state
+}
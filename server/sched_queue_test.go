@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func queuedRequest(path string) *LlmRequest {
+	return &LlmRequest{ctx: context.Background(), model: &Model{ModelPath: path}, errCh: make(chan error, 1)}
+}
+
+func TestRequestQueuesRoundRobin(t *testing.T) {
+	q := newRequestQueues(16, 8)
+
+	var reqs []*LlmRequest
+	for range 4 {
+		req := queuedRequest("big")
+		require.NoError(t, q.push(req))
+		reqs = append(reqs, req)
+	}
+	small := queuedRequest("small")
+	require.NoError(t, q.push(small))
+	require.Equal(t, 5, q.len())
+
+	// The small model only waits behind the first of the big model's requests
+	var order []*LlmRequest
+	for req := q.pop(); req != nil; req = q.pop() {
+		order = append(order, req)
+	}
+	require.Equal(t, []*LlmRequest{reqs[0], small, reqs[1], reqs[2], reqs[3]}, order)
+	require.Zero(t, q.len())
+	require.Empty(t, q.state())
+}
+
+func TestRequestQueuesDepth(t *testing.T) {
+	q := newRequestQueues(4, 2)
+	require.Equal(t, 2, q.depth)
+
+	require.NoError(t, q.push(queuedRequest("big")))
+	require.NoError(t, q.push(queuedRequest("big")))
+	require.ErrorIs(t, q.push(queuedRequest("big")), ErrMaxQueue)
+
+	// A burst against one model leaves room for the others
+	require.NoError(t, q.push(queuedRequest("small")))
+	require.NoError(t, q.push(queuedRequest("other")))
+	require.ErrorIs(t, q.push(queuedRequest("another")), ErrMaxQueue)
+
+	// A requeued request fits back in the place it left
+	req := q.pop()
+	require.Equal(t, "big", req.model.ModelPath)
+	q.requeue(req)
+	require.Equal(t, 4, q.len())
+
+	require.Equal(t, 4, newRequestQueues(4, 0).depth)
+	require.Equal(t, 1, newRequestQueues(1, 0).depth)
+	require.Equal(t, 4, newRequestQueues(4, 8).depth)
+}
+
+func TestRequestQueuesRequeueFull(t *testing.T) {
+	q := newRequestQueues(2, 0)
+
+	req := queuedRequest("big")
+	require.NoError(t, q.push(req))
+	require.Equal(t, req, q.pop())
+
+	// The queue fills up while the request is out
+	require.NoError(t, q.push(queuedRequest("big")))
+	require.NoError(t, q.push(queuedRequest("other")))
+
+	done := make(chan struct{})
+	go func() {
+		q.requeue(req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("requeued past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The waiting request takes the next place ahead of new requests
+	q.pop()
+	require.ErrorIs(t, q.push(queuedRequest("new")), ErrMaxQueue)
+	<-done
+	require.Equal(t, 2, q.len())
+
+	// A canceled request stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := queuedRequest("big")
+	canceled.ctx = ctx
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	q.requeue(canceled)
+	require.ErrorIs(t, <-canceled.errCh, context.Canceled)
+	require.Equal(t, 2, q.len())
+}
+
+func TestRequestQueuesState(t *testing.T) {
+	q := newRequestQueues(16, 8)
+	first := queuedRequest("big")
+	require.NoError(t, q.push(first))
+	require.NoError(t, q.push(queuedRequest("big")))
+	require.NoError(t, q.push(queuedRequest("small")))
+
+	// Age the first request
+	first.enqueuedAt = time.Now().Add(-time.Minute)
+	state := q.state()
+	require.Len(t, state, 2)
+	require.Equal(t, "big", state[0].Model)
+	require.Equal(t, 2, state[0].Length)
+	require.Equal(t, first.enqueuedAt, state[0].OldestEnqueuedAt)
+	require.GreaterOrEqual(t, state[0].OldestWaitSeconds, 60.0)
+	require.Equal(t, "small", state[1].Model)
+	require.Equal(t, 1, state[1].Length)
+	require.Less(t, state[1].OldestWaitSeconds, 60.0)
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	big := newScenarioRequest(t, ctx, "ollama-model-big", 10, nil)
+	small := newScenarioRequest(t, ctx, "ollama-model-small", 10, nil)
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	loads := make(chan string, 8)
+	s.loadFn = func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+		loads <- req.model.ModelPath
+	}
+
+	// A burst against the big model arrives before a single small request
+	for range 4 {
+		s.GetRunner(big.ctx, big.req.model, big.req.opts, big.req.sessionDuration)
+	}
+	s.GetRunner(small.ctx, small.req.model, small.req.opts, small.req.sessionDuration)
+
+	state := s.debugState().Queues
+	require.Len(t, state, 2)
+	lengths := map[string]int{}
+	for _, q := range state {
+		lengths[q.Model] = q.Length
+	}
+	require.Equal(t, map[string]int{big.req.model.ModelPath: 4, small.req.model.ModelPath: 1}, lengths)
+
+	s.Run(ctx)
+	var order []string
+	for range 5 {
+		select {
+		case path := <-loads:
+			order = append(order, path)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	bigPath, smallPath := big.req.model.ModelPath, small.req.model.ModelPath
+	require.Equal(t, []string{bigPath, smallPath, bigPath, bigPath, bigPath}, order)
+	require.Empty(t, s.debugState().Queues)
+}
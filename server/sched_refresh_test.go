@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestNoRefresh(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+
+	a := newScenarioRequest(t, ctx, "ollama-model-refresh", 10, &api.Duration{Duration: time.Minute})
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	s.newServerFn = a.newServer
+	s.Run(ctx)
+
+	// request runs a request to route and waits for the scheduler to
+	// process it finishing
+	request := func(route string, noRefresh bool, keepAlive *api.Duration) *runnerRef {
+		t.Helper()
+		opts := a.req.opts
+		opts.NoRefresh = noRefresh
+
+		reqCtx, finish := context.WithCancel(context.WithValue(ctx, routeContextKey{}, route))
+		successCh, errCh := s.GetRunner(reqCtx, a.req.model, opts, keepAlive)
+		var runner *runnerRef
+		select {
+		case runner = <-successCh:
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+
+		finish()
+		require.Eventually(t, func() bool {
+			runner.refMu.Lock()
+			defer runner.refMu.Unlock()
+			return runner.refCount == 0
+		}, time.Second, time.Millisecond)
+		return runner
+	}
+
+	expiry := func(runner *runnerRef) (time.Time, time.Duration) {
+		runner.refMu.Lock()
+		defer runner.refMu.Unlock()
+		return runner.expiresAt, runner.sessionDuration
+	}
+
+	psRefreshedBy := func() string {
+		t.Helper()
+		srv := Server{sched: s}
+		w := createRequest(t, srv.PsHandler, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var ps api.ProcessResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&ps))
+		require.Len(t, ps.Models, 1)
+		return ps.Models[0].RefreshedBy
+	}
+
+	// a request that loads the model sets its expiry, even with no_refresh
+	runner := request("/api/embed", true, &api.Duration{Duration: time.Minute})
+	expiresAt, duration := expiry(runner)
+	require.False(t, expiresAt.IsZero())
+	require.Equal(t, time.Minute, duration)
+	require.Equal(t, "/api/embed", psRefreshedBy())
+
+	cases := []struct {
+		name      string
+		route     string
+		noRefresh bool
+		keepAlive *api.Duration
+		refreshed bool
+		duration  time.Duration
+	}{
+		{"refresh", "/api/chat", false, nil, true, time.Minute},
+		{"refresh with keep alive", "/api/embed", false, &api.Duration{Duration: 2 * time.Minute}, true, 2 * time.Minute},
+		{"no refresh", "/api/embeddings", true, nil, false, 2 * time.Minute},
+		{"no refresh with keep alive", "/api/generate", true, &api.Duration{Duration: time.Hour}, false, 2 * time.Minute},
+	}
+
+	refreshedBy := "/api/embed"
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			// expiries are compared by time, so they need to differ
+			time.Sleep(2 * time.Millisecond)
+
+			before, _ := expiry(runner)
+			require.Same(t, runner, request(tt.route, tt.noRefresh, tt.keepAlive))
+			after, duration := expiry(runner)
+
+			if tt.refreshed {
+				require.True(t, after.After(before), "expected the expiry to be extended")
+				refreshedBy = tt.route
+			} else {
+				require.Equal(t, before, after, "expected the expiry not to change")
+			}
+
+			require.Equal(t, tt.duration, duration)
+			require.Equal(t, refreshedBy, psRefreshedBy())
+
+			runner.refMu.Lock()
+			defer runner.refMu.Unlock()
+			require.NotNil(t, runner.expireTimer)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func twoGpuFn() gpu.GpuInfoList {
+	var gpus gpu.GpuInfoList
+	for _, id := range []string{"0", "1"} {
+		g := gpu.GpuInfo{Library: "cuda", ID: id}
+		g.TotalMemory = 24 * format.GigaByte
+		g.FreeMemory = 12 * format.GigaByte
+		gpus = append(gpus, g)
+	}
+	return gpus
+}
+
+func TestReplicas(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+
+	a := newScenarioRequest(t, ctx, "ollama-model-replicas", 10, nil)
+	a.req.opts.Replicas = 2
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = twoGpuFn
+	s.getCpuFn = getCpuFn
+	var mu sync.Mutex
+	var loads []gpu.GpuInfoList
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads = append(loads, gpus)
+		srv := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
+		for _, g := range gpus {
+			srv.estimatedVRAMByGPU[g.ID] = 10
+		}
+		return srv, nil
+	}
+	s.Run(ctx)
+
+	getRunner := func(ctx context.Context, duration time.Duration) *runnerRef {
+		t.Helper()
+		successCh, errCh := s.GetRunner(ctx, a.req.model, a.req.opts, &api.Duration{Duration: duration})
+		select {
+		case runner := <-successCh:
+			return runner
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	// Two concurrent requests are served by replicas on separate GPUs
+	ctx1, done1 := context.WithCancel(ctx)
+	first := getRunner(ctx1, 5*time.Millisecond)
+	ctx2, done2 := context.WithCancel(ctx)
+	second := getRunner(ctx2, time.Minute)
+	require.NotSame(t, first, second)
+	require.Equal(t, 0, first.replica)
+	require.Equal(t, 1, second.replica)
+
+	mu.Lock()
+	require.Len(t, loads, 2)
+	require.Len(t, loads[0], 1)
+	require.Len(t, loads[1], 1)
+	require.NotEqual(t, loads[0][0].ID, loads[1][0].ID)
+	mu.Unlock()
+
+	// Both replicas are listed with the requests they're serving
+	srv := Server{sched: s}
+	w := createRequest(t, srv.PsHandler, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var ps api.ProcessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&ps))
+	require.Len(t, ps.Models, 2)
+	replicas := map[int]api.ProcessModelResponse{}
+	for _, m := range ps.Models {
+		replicas[m.Replica] = m
+	}
+	require.Equal(t, []string{first.gpus[0].ID}, replicas[0].GPUs)
+	require.Equal(t, []string{second.gpus[0].ID}, replicas[1].GPUs)
+	require.Equal(t, 1, replicas[0].InFlight)
+	require.Equal(t, 1, replicas[1].InFlight)
+
+	// Once the first replica is idle, it's the least busy
+	done1()
+	require.Eventually(t, func() bool {
+		first.refMu.Lock()
+		defer first.refMu.Unlock()
+		return first.refCount == 0
+	}, time.Second, time.Millisecond)
+	ctx3, done3 := context.WithCancel(ctx)
+	require.Same(t, first, getRunner(ctx3, 5*time.Millisecond))
+
+	mu.Lock()
+	require.Len(t, loads, 2)
+	mu.Unlock()
+
+	// Replicas expire independently
+	done3()
+	done2()
+	require.Eventually(t, func() bool {
+		s.loadedMu.Lock()
+		defer s.loadedMu.Unlock()
+		return len(s.loaded) == 1
+	}, time.Second, time.Millisecond)
+	s.loadedMu.Lock()
+	require.Same(t, second, s.loaded[second.key()])
+	s.loadedMu.Unlock()
+}
+
+func TestReplicasShareWhenFull(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+
+	a := newScenarioRequest(t, ctx, "ollama-model-replicas", 10, nil)
+	a.req.opts.Replicas = 2
+
+	// With a single GPU there's nowhere to put a second replica
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	s.newServerFn = a.newServer
+	s.Run(ctx)
+
+	var runners []*runnerRef
+	for range 2 {
+		successCh, errCh := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration)
+		select {
+		case runner := <-successCh:
+			runners = append(runners, runner)
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	require.Same(t, runners[0], runners[1])
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	s.loadedMu.Unlock()
+}
+
+func TestNextReplica(t *testing.T) {
+	require.Equal(t, 0, nextReplica(nil))
+	require.Equal(t, 1, nextReplica([]*runnerRef{{replica: 0}}))
+	require.Equal(t, 0, nextReplica([]*runnerRef{{replica: 1}}))
+	require.Equal(t, 1, nextReplica([]*runnerRef{{replica: 0}, {replica: 2}}))
+}
+
+func TestLeastBusy(t *testing.T) {
+	require.Nil(t, leastBusy(nil))
+
+	busy := &runnerRef{refCount: 2}
+	idle := &runnerRef{refCount: 0, replica: 1}
+	loading := &runnerRef{replica: 2}
+	loading.refMu.Lock()
+	defer loading.refMu.Unlock()
+
+	require.Same(t, idle, leastBusy([]*runnerRef{busy, idle, loading}))
+	require.Same(t, busy, leastBusy([]*runnerRef{busy, loading}))
+	require.Same(t, loading, leastBusy([]*runnerRef{loading}))
+}
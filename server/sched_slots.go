@@ -0,0 +1,108 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// slotsTimeout bounds sampling a runner's slots, so a busy or stuck runner
+// doesn't hold up listings
+const slotsTimeout = time.Second
+
+// requestIDHeader carries the ID of a generate or chat request, which
+// identifies it in the slot statistics of its runner
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the ID a client set for the request, or a new one, and
+// returns it to the client
+func requestID(c *gin.Context) string {
+	id := c.GetHeader(requestIDHeader)
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b) //nolint:errcheck
+		id = hex.EncodeToString(b)
+	}
+
+	c.Header(requestIDHeader, id)
+	return id
+}
+
+// slots samples the state of the runner's parallel slots. Runners that are
+// loading, remote or fail to respond have none.
+func (runner *runnerRef) slots(ctx context.Context) []api.SlotStatus {
+	// the refMu is held for the whole of a load
+	if runner.loadingStatus.Load() != nil {
+		return nil
+	}
+
+	runner.refMu.Lock()
+	llama, loading := runner.llama, runner.loading
+	runner.refMu.Unlock()
+	if llama == nil || loading {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, slotsTimeout)
+	defer cancel()
+
+	slots, err := llama.Slots(ctx)
+	if err != nil {
+		slog.Debug("couldn't sample runner slots", "model", runner.modelPath, "error", err)
+		return nil
+	}
+
+	status := make([]api.SlotStatus, len(slots))
+	for i, s := range slots {
+		status[i] = api.SlotStatus{
+			ID:              s.ID,
+			State:           s.State,
+			RequestID:       s.RequestID,
+			TokensProcessed: s.TokensProcessed,
+			CacheTokens:     s.CacheTokens,
+		}
+	}
+
+	return status
+}
+
+// runnerSlots is the state of a loaded runner's slots reported by the
+// scheduler debug endpoint
+type runnerSlots struct {
+	Model   string           `json:"model"`
+	Replica int              `json:"replica,omitempty"`
+	Slots   []api.SlotStatus `json:"slots"`
+}
+
+// runnerSlots samples the slots of the loaded runners, in the order of
+// their keys
+func (s *Scheduler) runnerSlots(ctx context.Context) []runnerSlots {
+	runners := s.runners()
+	slices.SortFunc(runners, func(a, b *runnerRef) int {
+		return cmp.Compare(a.key(), b.key())
+	})
+
+	states := make([]runnerSlots, 0, len(runners))
+	for _, runner := range runners {
+		mr, ok := runner.status(ctx, true)
+		if !ok {
+			continue
+		}
+
+		states = append(states, runnerSlots{
+			Model:   mr.Name,
+			Replica: mr.Replica,
+			Slots:   mr.Slots,
+		})
+	}
+
+	return states
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestSlots(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	slots := []llm.SlotStatus{
+		{ID: 0, State: llm.SlotStatePrefill, RequestID: "a", TokensProcessed: 512, CacheTokens: 600},
+		{ID: 1, State: llm.SlotStateIdle, CacheTokens: 30},
+	}
+
+	s := Server{sched: &Scheduler{
+		loaded: map[string]*runnerRef{
+			"test": {
+				llama:     &mockLlm{slots: slots},
+				model:     &Model{ShortName: "test:latest", Digest: "sha256:abc"},
+				modelPath: "test",
+			},
+		},
+		queues: newRequestQueues(1, 0),
+		ledger: newVRAMLedger(),
+	}}
+
+	expect := []api.SlotStatus{
+		{ID: 0, State: "prefill", RequestID: "a", TokensProcessed: 512, CacheTokens: 600},
+		{ID: 1, State: "idle", CacheTokens: 30},
+	}
+
+	ps := func(t *testing.T, query string) api.ProcessResponse {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/ps?"+query, nil)
+		s.PsHandler(c)
+
+		var resp api.ProcessResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Models) != 1 {
+			t.Fatalf("expected one model, got %+v", resp.Models)
+		}
+
+		return resp
+	}
+
+	t.Run("ps", func(t *testing.T) {
+		if resp := ps(t, ""); resp.Models[0].Slots != nil {
+			t.Errorf("expected no slots without verbose, got %+v", resp.Models[0].Slots)
+		}
+
+		if diff := cmp.Diff(expect, ps(t, url.Values{"verbose": {"true"}}.Encode()).Models[0].Slots); diff != "" {
+			t.Errorf("unexpected slots (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("debug", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/debug/scheduler", nil)
+		s.SchedulerDebugHandler(c)
+
+		var state struct {
+			Runners []runnerSlots `json:"runners"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]runnerSlots{{Model: "test:latest", Slots: expect}}, state.Runners); diff != "" {
+			t.Errorf("unexpected runners (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("loading", func(t *testing.T) {
+		// the refMu is held for the whole of a load, which listings
+		// shouldn't wait for
+		loading := &runnerRef{
+			llama:           &mockLlm{slots: slots},
+			model:           &Model{ShortName: "loading:latest"},
+			modelPath:       "loading",
+			refCount:        1,
+			sessionDuration: time.Minute,
+		}
+		loading.startLoading()
+		loading.refMu.Lock()
+		defer loading.refMu.Unlock()
+
+		srv := Server{sched: &Scheduler{
+			loaded: map[string]*runnerRef{"loading": loading},
+			queues: newRequestQueues(1, 0),
+			ledger: newVRAMLedger(),
+		}}
+
+		done := make(chan api.ProcessResponse)
+		go func() {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/ps?verbose=true", nil)
+			srv.PsHandler(c)
+
+			var resp api.ProcessResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Error(err)
+			}
+			done <- resp
+		}()
+
+		select {
+		case resp := <-done:
+			if len(resp.Models) != 1 || resp.Models[0].Name != "loading:latest" || resp.Models[0].InFlight != 1 {
+				t.Fatalf("expected the loading model, got %+v", resp.Models)
+			}
+
+			if resp.Models[0].Slots != nil {
+				t.Errorf("expected no slots while loading, got %+v", resp.Models[0].Slots)
+			}
+
+			if time.Until(resp.Models[0].ExpiresAt) < 59*time.Second {
+				t.Errorf("expected the model to expire a session after now, got %s", resp.Models[0].ExpiresAt)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("listing waited for the load")
+		}
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+	c.Request.Header.Set(requestIDHeader, "abc")
+	if id := requestID(c); id != "abc" || w.Header().Get(requestIDHeader) != "abc" {
+		t.Errorf("expected the client's request ID, got %q", id)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+	if id := requestID(c); len(id) != 16 || w.Header().Get(requestIDHeader) != id {
+		t.Errorf("expected a new request ID to be returned, got %q", id)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"log/slog"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -47,7 +48,7 @@ func TestLoad(t *testing.T) {
 		sessionDuration: &api.Duration{Duration: 2 * time.Second},
 	}
 	// Fail to load model first
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
 		return nil, errors.New("something failed to load model blah")
 	}
 	gpus := gpu.GpuInfoList{}
@@ -61,7 +62,7 @@ func TestLoad(t *testing.T) {
 	require.Contains(t, err.Error(), "this model may be incompatible")
 
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, ggml, gpus, 0)
@@ -102,7 +103,7 @@ type reqBundle struct {
 	ggml    *llm.GGML
 }
 
-func (scenario *reqBundle) newServer(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (scenario *reqBundle) newServer(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
 	return scenario.srv, nil
 }
 
@@ -178,13 +179,13 @@ func TestRequestsSameModelSameRequest(t *testing.T) {
 
 	s.newServerFn = a.newServer
 	slog.Info("a")
-	s.pendingReqCh <- a.req
-	require.Len(t, s.pendingReqCh, 1)
+	require.NoError(t, s.queues.push(a.req))
+	require.Equal(t, 1, s.queues.len())
 	s.Run(ctx)
 	select {
 	case resp := <-a.req.successCh:
 		require.Equal(t, resp.llama, a.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, a.req.errCh)
 	case err := <-a.req.errCh:
 		t.Fatal(err.Error())
@@ -195,11 +196,11 @@ func TestRequestsSameModelSameRequest(t *testing.T) {
 	// Same runner as first request due to not needing a reload
 	s.newServerFn = b.newServer
 	slog.Info("b")
-	s.pendingReqCh <- b.req
+	require.NoError(t, s.queues.push(b.req))
 	select {
 	case resp := <-b.req.successCh:
 		require.Equal(t, resp.llama, a.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, b.req.errCh)
 	case err := <-b.req.errCh:
 		t.Fatal(err.Error())
@@ -222,13 +223,13 @@ func TestRequestsSimpleReloadSameModel(t *testing.T) {
 
 	s.newServerFn = a.newServer
 	slog.Info("a")
-	s.pendingReqCh <- a.req
-	require.Len(t, s.pendingReqCh, 1)
+	require.NoError(t, s.queues.push(a.req))
+	require.Equal(t, 1, s.queues.len())
 	s.Run(ctx)
 	select {
 	case resp := <-a.req.successCh:
 		require.Equal(t, resp.llama, a.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, a.req.errCh)
 	case err := <-a.req.errCh:
 		t.Fatal(err.Error())
@@ -240,14 +241,14 @@ func TestRequestsSimpleReloadSameModel(t *testing.T) {
 	s.newServerFn = b.newServer
 	b.req.model.AdapterPaths = []string{"new"}
 	slog.Info("b")
-	s.pendingReqCh <- b.req
+	require.NoError(t, s.queues.push(b.req))
 	// finish first two requests, so model can reload
 	time.Sleep(1 * time.Millisecond)
 	a.ctxDone()
 	select {
 	case resp := <-b.req.successCh:
 		require.Equal(t, resp.llama, b.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, b.req.errCh)
 	case err := <-b.req.errCh:
 		t.Fatal(err.Error())
@@ -273,12 +274,12 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "1")
 	s.newServerFn = a.newServer
 	slog.Info("a")
-	s.pendingReqCh <- a.req
+	require.NoError(t, s.queues.push(a.req))
 	s.Run(ctx)
 	select {
 	case resp := <-a.req.successCh:
 		require.Equal(t, resp.llama, a.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, a.req.errCh)
 	case err := <-a.req.errCh:
 		t.Fatal(err.Error())
@@ -292,11 +293,11 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "0")
 	s.newServerFn = b.newServer
 	slog.Info("b")
-	s.pendingReqCh <- b.req
+	require.NoError(t, s.queues.push(b.req))
 	select {
 	case resp := <-b.req.successCh:
 		require.Equal(t, resp.llama, b.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, b.req.errCh)
 	case err := <-b.req.errCh:
 		t.Fatal(err.Error())
@@ -310,11 +311,11 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	// This is a CPU load with NumGPU = 0 so it should load
 	s.newServerFn = c.newServer
 	slog.Info("c")
-	s.pendingReqCh <- c.req
+	require.NoError(t, s.queues.push(c.req))
 	select {
 	case resp := <-c.req.successCh:
 		require.Equal(t, resp.llama, c.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, c.req.errCh)
 	case err := <-c.req.errCh:
 		t.Fatal(err.Error())
@@ -333,7 +334,7 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	s.loadedMu.Unlock()
 	a.ctxDone() // Won't help since this one isn't big enough to make room
 	time.Sleep(2 * time.Millisecond)
-	s.pendingReqCh <- d.req
+	require.NoError(t, s.queues.push(d.req))
 	// finish prior request, so new model can load
 	time.Sleep(6 * time.Millisecond)
 	s.loadedMu.Lock()
@@ -343,7 +344,7 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	select {
 	case resp := <-d.req.successCh:
 		require.Equal(t, resp.llama, d.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, d.req.errCh)
 	case <-ctx.Done():
 		t.Fatal("timeout")
@@ -367,10 +368,10 @@ func TestGetRunner(t *testing.T) {
 	s.newServerFn = a.newServer
 	slog.Info("a")
 	successCh1a, errCh1a := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration)
-	require.Len(t, s.pendingReqCh, 1)
+	require.Equal(t, 1, s.queues.len())
 	slog.Info("b")
 	successCh1b, errCh1b := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration)
-	require.Len(t, s.pendingReqCh, 1)
+	require.Equal(t, 1, s.queues.len())
 	require.Empty(t, successCh1b)
 	require.Len(t, errCh1b, 1)
 	err := <-errCh1b
@@ -379,7 +380,7 @@ func TestGetRunner(t *testing.T) {
 	select {
 	case resp := <-successCh1a:
 		require.Equal(t, resp.llama, a.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, errCh1a)
 	case err := <-errCh1a:
 		t.Fatal(err.Error())
@@ -422,7 +423,7 @@ func TestExpireRunner(t *testing.T) {
 	var ggml *llm.GGML
 	gpus := gpu.GpuInfoList{}
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, ggml, gpus, 0)
@@ -468,12 +469,12 @@ func TestPrematureExpired(t *testing.T) {
 	}
 	s.newServerFn = scenario1a.newServer
 	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration)
-	require.Len(t, s.pendingReqCh, 1)
+	require.Equal(t, 1, s.queues.len())
 	s.Run(ctx)
 	select {
 	case resp := <-successCh1a:
 		require.Equal(t, resp.llama, scenario1a.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, errCh1a)
 		s.loadedMu.Lock()
 		require.Len(t, s.loaded, 1)
@@ -560,6 +561,31 @@ func TestUpdateFreeSpace(t *testing.T) {
 	require.Equal(t, uint64(2000-50-75), gpus[1].FreeMemory)
 }
 
+func TestReserveImatrix(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, nil)
+
+	gpus, estimate, release := s.reserveImatrix(a.ggml)
+	require.Equal(t, "metal", gpus[0].Library)
+	require.Positive(t, estimate.Layers)
+	require.Equal(t, map[gpuKey]uint64{{"metal", ""}: estimate.GPUSizes[0]}, s.ledger.reserved())
+
+	release()
+	require.Empty(t, s.ledger.reserved())
+
+	// Loaded models leave no room, so the matrix is computed on the CPU
+	s.ledger.update("other", map[gpuKey]uint64{{"metal", ""}: 24 * format.GigaByte})
+	gpus, estimate, release = s.reserveImatrix(a.ggml)
+	defer release()
+	require.Equal(t, "cpu", gpus[0].Library)
+	require.Zero(t, estimate.Layers)
+	require.Equal(t, map[gpuKey]uint64{{"metal", ""}: 24 * format.GigaByte}, s.ledger.reserved())
+}
+
 func TestFilterGPUsWithoutLoadingModels(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer done()
@@ -594,6 +620,134 @@ func TestFilterGPUsWithoutLoadingModels(t *testing.T) {
 	require.Len(t, tmp, 2)
 }
 
+func TestFilterGPUsAtModelCap(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+	gpus := gpu.GpuInfoList{
+		{
+			Library: "cuda",
+			ID:      "0",
+		},
+		{
+			Library: "cuda",
+			ID:      "1",
+		},
+	}
+	r1 := &runnerRef{gpus: gpu.GpuInfoList{gpus[0]}}
+	r2 := &runnerRef{gpus: gpu.GpuInfoList{gpus[0], gpus[1]}}
+
+	s := InitScheduler(ctx)
+	s.loadedMu.Lock()
+	s.loaded["a"] = r1
+	s.loaded["b"] = r2
+	s.loadedMu.Unlock()
+
+	// No cap set
+	tmp := s.filterGPUsAtModelCap(gpus)
+	require.Len(t, tmp, 2)
+
+	t.Setenv("OLLAMA_MAX_MODELS_PER_GPU", "2")
+	tmp = s.filterGPUsAtModelCap(gpus)
+	require.Len(t, tmp, 1)
+	require.Equal(t, "1", tmp[0].ID)
+
+	t.Setenv("OLLAMA_MAX_MODELS_PER_GPU", "1")
+	tmp = s.filterGPUsAtModelCap(gpus)
+	require.Empty(t, tmp)
+
+	t.Setenv("OLLAMA_MAX_MODELS_PER_GPU", "3")
+	tmp = s.filterGPUsAtModelCap(gpus)
+	require.Len(t, tmp, 2)
+}
+
+func TestGPUOrder(t *testing.T) {
+	type gpuMem struct {
+		total, free uint64
+	}
+	cases := []struct {
+		name   string
+		gpus   []gpuMem
+		expect map[string]string // order -> gpu ID
+	}{
+		{
+			name: "second gpu most free",
+			gpus: []gpuMem{{24, 10}, {12, 11}, {8, 8}},
+			expect: map[string]string{
+				"":        "1",
+				"free":    "1",
+				"index":   "0",
+				"memory":  "0",
+				"invalid": "1",
+			},
+		},
+		{
+			name: "largest gpu last",
+			gpus: []gpuMem{{8, 8}, {12, 2}, {24, 20}},
+			expect: map[string]string{
+				"":       "2",
+				"free":   "2",
+				"index":  "0",
+				"memory": "2",
+			},
+		},
+		{
+			name: "first gpu full",
+			gpus: []gpuMem{{24, 0}, {12, 12}, {8, 8}},
+			expect: map[string]string{
+				"free":   "1",
+				"index":  "1",
+				"memory": "1",
+			},
+		},
+		{
+			name: "equal gpus",
+			gpus: []gpuMem{{12, 12}, {12, 12}},
+			expect: map[string]string{
+				"free":   "0",
+				"index":  "0",
+				"memory": "0",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		for order, expect := range tt.expect {
+			t.Run(tt.name+"/"+order, func(t *testing.T) {
+				t.Setenv("OLLAMA_GPU_ORDER", order)
+				ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer done()
+				s := InitScheduler(ctx)
+				s.getGpuFn = func() gpu.GpuInfoList {
+					gpus := make(gpu.GpuInfoList, len(tt.gpus))
+					for i, m := range tt.gpus {
+						gpus[i] = gpu.GpuInfo{Library: "cuda", ID: strconv.Itoa(i)}
+						gpus[i].TotalMemory = m.total * format.GibiByte
+						gpus[i].FreeMemory = m.free * format.GibiByte
+					}
+					return gpus
+				}
+				s.getCpuFn = getCpuFn
+				a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+				s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
+					require.Len(t, gpus, 1)
+					require.Equal(t, expect, gpus[0].ID)
+					return a.newServer(gpus, model, ggml, adapters, projectors, opts, numParallel, estimate)
+				}
+				require.NoError(t, s.queues.push(a.req))
+				s.Run(ctx)
+				select {
+				case resp := <-a.req.successCh:
+					require.Equal(t, resp.llama, a.srv)
+				case err := <-a.req.errCh:
+					t.Fatal(err.Error())
+				case <-ctx.Done():
+					t.Fatal("timeout")
+				}
+			})
+		}
+	}
+}
+
 func TestFindRunnerToUnload(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer done()
@@ -701,12 +855,12 @@ func TestAlreadyCanceled(t *testing.T) {
 	scenario1a := newScenarioRequest(t, dctx, "ollama-model-1", 10, &api.Duration{Duration: 0})
 	s := InitScheduler(ctx)
 	slog.Info("scenario1a")
-	s.pendingReqCh <- scenario1a.req
-	require.Len(t, s.pendingReqCh, 1)
+	require.NoError(t, s.queues.push(scenario1a.req))
+	require.Equal(t, 1, s.queues.len())
 	s.Run(ctx)
 	time.Sleep(5 * time.Millisecond)
-	require.Empty(t, s.pendingReqCh)
-	require.Empty(t, scenario1a.req.errCh)
+	require.Zero(t, s.queues.len())
+	require.ErrorIs(t, <-scenario1a.req.errCh, context.Canceled)
 	require.Empty(t, scenario1a.req.successCh)
 }
 
@@ -729,18 +883,18 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 	s.getCpuFn = getCpuFn
 	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int, estimate *llm.MemoryEstimate) (llm.LlamaServer, error) {
 		require.Len(t, gpus, 1)
-		return a.newServer(gpus, model, ggml, adapters, projectors, opts, numParallel)
+		return a.newServer(gpus, model, ggml, adapters, projectors, opts, numParallel, estimate)
 	}
 	slog.Info("a")
-	s.pendingReqCh <- a.req
-	require.Len(t, s.pendingReqCh, 1)
+	require.NoError(t, s.queues.push(a.req))
+	require.Equal(t, 1, s.queues.len())
 	s.Run(ctx)
 	select {
 	case resp := <-a.req.successCh:
 		require.Equal(t, resp.llama, a.srv)
-		require.Empty(t, s.pendingReqCh)
+		require.Zero(t, s.queues.len())
 		require.Empty(t, a.req.errCh)
 	case err := <-a.req.errCh:
 		t.Fatal(err.Error())
@@ -750,20 +904,29 @@ func TestHomogeneousGPUs(t *testing.T) {
 }
 
 type mockLlm struct {
-	pingResp           error
-	waitResp           error
-	completionResp     error
-	embeddingResp      []float32
-	embeddingRespErr   error
-	tokenizeResp       []int
-	tokenizeRespErr    error
-	detokenizeResp     string
-	detonekizeRespErr  error
-	closeResp          error
-	closeCalled        bool
-	estimatedVRAM      uint64
-	estimatedTotal     uint64
-	estimatedVRAMByGPU map[string]uint64
+	pingResp            error
+	waitResp            error
+	completionResp      error
+	embeddingResp       []float32
+	embeddingRespErr    error
+	tokenizeResp        []int
+	tokenizeRespErr     error
+	detokenizeResp      string
+	detonekizeRespErr   error
+	closeResp           error
+	closeCalled         bool
+	estimatedVRAM       uint64
+	estimatedTotal      uint64
+	estimatedVRAMByGPU  map[string]uint64
+	estimatedCacheByGPU map[string]uint64
+	releaseResp         error
+	restoreResp         error
+	cacheReleased       bool
+	loadProgress        float32
+	runner              string
+	useMMap             bool
+	useMLock            bool
+	slots               []llm.SlotStatus
 }
 
 func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
@@ -776,6 +939,10 @@ func (s *mockLlm) Embedding(ctx context.Context, input string) ([]float32, error
 	return s.embeddingResp, s.embeddingRespErr
 }
 
+func (s *mockLlm) Score(ctx context.Context, req llm.ScoreRequest) ([]api.TokenLogprob, error) {
+	return nil, nil
+}
+
 func (s *mockLlm) Tokenize(ctx context.Context, content string) ([]int, error) {
 	return s.tokenizeResp, s.tokenizeRespErr
 }
@@ -784,10 +951,33 @@ func (s *mockLlm) Detokenize(ctx context.Context, tokens []int) (string, error)
 	return s.detokenizeResp, s.detonekizeRespErr
 }
 
+func (s *mockLlm) LoadProgress() float32 { return s.loadProgress }
+
+func (s *mockLlm) ReleaseCache(ctx context.Context) error {
+	if s.releaseResp == nil {
+		s.cacheReleased = true
+	}
+	return s.releaseResp
+}
+
+func (s *mockLlm) RestoreCache(ctx context.Context) error {
+	if s.restoreResp == nil {
+		s.cacheReleased = false
+	}
+	return s.restoreResp
+}
+
 func (s *mockLlm) Close() error {
 	s.closeCalled = true
 	return s.closeResp
 }
-func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVRAM }
-func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
-func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
+func (s *mockLlm) EstimatedVRAM() uint64                   { return s.estimatedVRAM }
+func (s *mockLlm) EstimatedTotal() uint64                  { return s.estimatedTotal }
+func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64  { return s.estimatedVRAMByGPU[gpuid] }
+func (s *mockLlm) EstimatedCacheByGPU(gpuid string) uint64 { return s.estimatedCacheByGPU[gpuid] }
+func (s *mockLlm) Runner() string                          { return s.runner }
+func (s *mockLlm) UseMMap() bool                           { return s.useMMap }
+func (s *mockLlm) UseMLock() bool                          { return s.useMLock }
+func (s *mockLlm) Slots(ctx context.Context) ([]llm.SlotStatus, error) {
+	return s.slots, nil
+}
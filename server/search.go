@@ -0,0 +1,162 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+// registrySearchURL is the registry's search endpoint
+var registrySearchURL = "https://ollama.com/api/search"
+
+// searchTimeout bounds how long a search waits on the registry before trying
+// the fallback
+const searchTimeout = 10 * time.Second
+
+// errSearchFailed wraps the reasons neither the registry nor the fallback
+// returned results, such as either being unreachable or returning an error
+var errSearchFailed = errors.New("search failed")
+
+// searchRegistry searches the registry for models matching req, falling back
+// to the models listed by OLLAMA_SEARCH_FALLBACK if the registry fails.
+// Requests go through the server's proxy settings.
+func searchRegistry(ctx context.Context, req api.SearchRequest) (*api.SearchResponse, error) {
+	resp, err := searchURL(ctx, req)
+	if err != nil {
+		fallback := envconfig.SearchFallback()
+		if fallback == "" {
+			return nil, fmt.Errorf("%w: %w", errSearchFailed, err)
+		}
+
+		slog.Warn("registry search failed, searching the fallback", "fallback", fallback, "error", err)
+		var ferr error
+		if resp, ferr = searchTags(ctx, fallback, req.Query); ferr != nil {
+			return nil, fmt.Errorf("%w: %w; fallback: %w", errSearchFailed, err, ferr)
+		}
+	}
+
+	switch req.Sort {
+	case "", "pulls":
+		slices.SortStableFunc(resp.Models, func(a, b api.SearchModelResponse) int {
+			return cmp.Or(cmp.Compare(b.Pulls, a.Pulls), cmp.Compare(a.Name, b.Name))
+		})
+	case "updated":
+		slices.SortStableFunc(resp.Models, func(a, b api.SearchModelResponse) int {
+			return cmp.Or(b.UpdatedAt.Compare(a.UpdatedAt), cmp.Compare(a.Name, b.Name))
+		})
+	case "name":
+		slices.SortStableFunc(resp.Models, func(a, b api.SearchModelResponse) int {
+			return cmp.Compare(a.Name, b.Name)
+		})
+	}
+
+	if req.Limit > 0 && len(resp.Models) > req.Limit {
+		resp.Models = resp.Models[:req.Limit]
+	}
+
+	return resp, nil
+}
+
+func searchURL(ctx context.Context, req api.SearchRequest) (*api.SearchResponse, error) {
+	u, err := url.Parse(registrySearchURL)
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	query.Set("q", req.Query)
+	u.RawQuery = query.Encode()
+
+	var resp api.SearchResponse
+	if err := getJSON(ctx, u, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// searchTags searches the models listed by the /api/tags endpoint of an
+// Ollama server or registry at base, which isn't searchable itself. Tags of a
+// model are combined into one result.
+func searchTags(ctx context.Context, base, query string) (*api.SearchResponse, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags api.ListResponse
+	if err := getJSON(ctx, u.JoinPath("/api/tags"), &tags); err != nil {
+		return nil, err
+	}
+
+	var resp api.SearchResponse
+	models := make(map[string]int)
+	for _, m := range tags.Models {
+		n := model.ParseName(m.Name)
+		name := n.DisplayShortest()
+		if n.IsValid() {
+			// drop the tag to combine the tags of a model
+			name = strings.TrimSuffix(name, ":"+n.Tag)
+		}
+
+		if !strings.Contains(strings.ToLower(name), strings.ToLower(query)) {
+			continue
+		}
+
+		i, ok := models[name]
+		if !ok {
+			i = len(resp.Models)
+			models[name] = i
+			resp.Models = append(resp.Models, api.SearchModelResponse{Name: name})
+		}
+
+		r := &resp.Models[i]
+		if m.ModifiedAt.After(r.UpdatedAt) {
+			r.UpdatedAt = m.ModifiedAt
+		}
+
+		if size := m.Details.ParameterSize; size != "" && !slices.Contains(r.Sizes, size) {
+			r.Sizes = append(r.Sizes, size)
+		}
+
+		if quantization := m.Details.QuantizationLevel; quantization != "" && !slices.Contains(r.Quantizations, quantization) {
+			r.Quantizations = append(r.Quantizations, quantization)
+		}
+	}
+
+	return &resp, nil
+}
+
+func getJSON(ctx context.Context, u *url.URL, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, searchTimeout)
+	defer cancel()
+
+	resp, err := makeRequest(ctx, http.MethodGet, u, http.Header{"Accept": {"application/json"}}, nil, &registryOptions{})
+	if err != nil {
+		return fmt.Errorf("%s unreachable: %w", u.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", u.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", u.Host, err)
+	}
+	return nil
+}
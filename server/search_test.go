@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestSearch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query().Get("q"); q != "llama" {
+			t.Errorf("expected query llama, got %q", q)
+		}
+
+		json.NewEncoder(w).Encode(api.SearchResponse{Models: []api.SearchModelResponse{
+			{Name: "llama3", Pulls: 100, UpdatedAt: now.Add(-time.Hour)},
+			{Name: "llama2", Pulls: 300, UpdatedAt: now.Add(-2 * time.Hour)},
+			{Name: "codellama", Pulls: 200, UpdatedAt: now},
+		}})
+	}))
+	defer registry.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/tags" {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(api.ListResponse{Models: []api.ListModelResponse{
+			{Name: "llama3:8b", ModifiedAt: now.Add(-time.Hour), Details: api.ModelDetails{ParameterSize: "8B", QuantizationLevel: "Q4_0"}},
+			{Name: "llama3:70b", ModifiedAt: now, Details: api.ModelDetails{ParameterSize: "70B", QuantizationLevel: "Q4_0"}},
+			{Name: "mistral:latest", ModifiedAt: now},
+		}})
+	}))
+	defer fallback.Close()
+
+	var s Server
+	search := func(t *testing.T, query string) (*httptest.ResponseRecorder, api.SearchResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.GenerateRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil))
+
+		var resp api.SearchResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return w, resp
+	}
+
+	names := func(resp api.SearchResponse) []string {
+		var names []string
+		for _, m := range resp.Models {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	t.Run("registry", func(t *testing.T) {
+		registrySearchURL = registry.URL + "/api/search"
+		t.Cleanup(func() { registrySearchURL = "https://ollama.com/api/search" })
+
+		cases := []struct {
+			query string
+			names []string
+		}{
+			{"q=llama", []string{"llama2", "codellama", "llama3"}},
+			{"q=llama&sort=updated", []string{"codellama", "llama3", "llama2"}},
+			{"q=llama&sort=name&limit=2", []string{"codellama", "llama2"}},
+		}
+
+		for _, tt := range cases {
+			w, resp := search(t, tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d", w.Code)
+			}
+
+			if got := names(resp); !slices.Equal(got, tt.names) {
+				t.Errorf("%s: expected %v, got %v", tt.query, tt.names, got)
+			}
+		}
+
+		if w, _ := search(t, "q=llama&sort=size"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code 400, actual %d", w.Code)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		registrySearchURL = "http://127.0.0.1:0/api/search"
+		t.Cleanup(func() { registrySearchURL = "https://ollama.com/api/search" })
+		t.Setenv("OLLAMA_SEARCH_FALLBACK", fallback.URL)
+
+		w, resp := search(t, "q=LLAMA")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if len(resp.Models) != 1 {
+			t.Fatalf("expected the tags of llama3 to be combined, got %v", names(resp))
+		}
+
+		m := resp.Models[0]
+		if m.Name != "llama3" || !m.UpdatedAt.Equal(now) || !slices.Equal(m.Sizes, []string{"8B", "70B"}) || !slices.Equal(m.Quantizations, []string{"Q4_0"}) {
+			t.Errorf("unexpected model %+v", m)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		registrySearchURL = "http://127.0.0.1:0/api/search"
+		t.Cleanup(func() { registrySearchURL = "https://ollama.com/api/search" })
+		t.Setenv("OLLAMA_SEARCH_FALLBACK", "")
+
+		w, _ := search(t, "q=llama")
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("expected status code 502, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "search failed: 127.0.0.1:0 unreachable") {
+			t.Errorf("expected the registry to be reported unreachable, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("registry error", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "search is down", http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+
+		registrySearchURL = failing.URL + "/api/search"
+		t.Cleanup(func() { registrySearchURL = "https://ollama.com/api/search" })
+		t.Setenv("OLLAMA_SEARCH_FALLBACK", "http://127.0.0.1:0")
+
+		w, _ := search(t, "q=llama")
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("expected status code 502, actual %d", w.Code)
+		}
+
+		// both the registry's status and why the fallback failed are reported
+		body := w.Body.String()
+		if !strings.Contains(body, "returned 503 Service Unavailable: search is down") || !strings.Contains(body, "fallback: 127.0.0.1:0 unreachable") {
+			t.Errorf("expected the underlying errors, got %s", body)
+		}
+	})
+}
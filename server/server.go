@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/build"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/runners"
+	"github.com/ollama/ollama/tracing"
+	"github.com/ollama/ollama/version"
+)
+
+// Config configures a server embedded in another program. Its fields mirror
+// the OLLAMA_* environment variables of the same names, and fields left at
+// their zero value aren't set, so the environment or the default applies.
+// Env sets any other variable by name, or one to a value its field can't
+// hold, such as a zero KeepAlive; the fields take precedence over it.
+//
+// The configuration is process wide, since it's read wherever the server
+// uses it, so a process can only run one configured server at a time.
+type Config struct {
+	// Models is the path to the models directory
+	Models string
+
+	// StorageBackend is where models are stored, as in OLLAMA_STORAGE_BACKEND
+	StorageBackend string
+
+	// Debug logs additional debug information
+	Debug bool
+
+	// KeepAlive is how long models stay loaded after a request
+	KeepAlive time.Duration
+
+	// NumParallel is the most requests each model serves at once
+	NumParallel uint
+
+	// MaxLoadedModels is the most models loaded at once per GPU
+	MaxLoadedModels uint
+
+	// MaxQueue is the most requests queued before more are rejected
+	MaxQueue uint
+
+	// Origins are the origins allowed to make cross-origin requests, in
+	// addition to the local ones
+	Origins []string
+
+	// DefaultOptions are the model options used when neither requests nor
+	// models set them, as in OLLAMA_DEFAULT_OPTIONS
+	DefaultOptions string
+
+	// Presets is the path of the presets file
+	Presets string
+
+	// Aliases is the path of the aliases file
+	Aliases string
+
+	// APIKeys is the path of the API keys file
+	APIKeys string
+
+	// Offline forbids pulls, pushes and other outbound network access
+	Offline bool
+
+	// NoPrune and NoMigrate skip pruning unused blobs and migrating models
+	// in legacy layouts when the server is created
+	NoPrune   bool
+	NoMigrate bool
+
+	// LLMLibrary is the runner library to use instead of the detected one
+	LLMLibrary string
+
+	// FlashAttention enables flash attention
+	FlashAttention bool
+
+	// Env sets variables by name
+	Env map[string]string
+}
+
+// vars returns the variables c sets
+func (c Config) vars() map[string]string {
+	vars := make(map[string]string, len(c.Env))
+	for k, v := range c.Env {
+		vars[k] = v
+	}
+
+	set := func(k, v string) {
+		if v != "" {
+			vars[k] = v
+		}
+	}
+
+	setBool := func(k string, b bool) {
+		if b {
+			vars[k] = "1"
+		}
+	}
+
+	setUint := func(k string, n uint) {
+		if n > 0 {
+			vars[k] = strconv.FormatUint(uint64(n), 10)
+		}
+	}
+
+	set("OLLAMA_MODELS", c.Models)
+	set("OLLAMA_STORAGE_BACKEND", c.StorageBackend)
+	setBool("OLLAMA_DEBUG", c.Debug)
+	if c.KeepAlive != 0 {
+		vars["OLLAMA_KEEP_ALIVE"] = c.KeepAlive.String()
+	}
+	setUint("OLLAMA_NUM_PARALLEL", c.NumParallel)
+	setUint("OLLAMA_MAX_LOADED_MODELS", c.MaxLoadedModels)
+	setUint("OLLAMA_MAX_QUEUE", c.MaxQueue)
+	set("OLLAMA_ORIGINS", strings.Join(c.Origins, ","))
+	set("OLLAMA_DEFAULT_OPTIONS", c.DefaultOptions)
+	set("OLLAMA_PRESETS", c.Presets)
+	set("OLLAMA_ALIASES", c.Aliases)
+	set("OLLAMA_API_KEYS", c.APIKeys)
+	setBool("OLLAMA_OFFLINE", c.Offline)
+	setBool("OLLAMA_NOPRUNE", c.NoPrune)
+	setBool("OLLAMA_NOMIGRATE", c.NoMigrate)
+	set("OLLAMA_LLM_LIBRARY", c.LLMLibrary)
+	setBool("OLLAMA_FLASH_ATTENTION", c.FlashAttention)
+	return vars
+}
+
+// New creates a server configured by cfg, preparing its models directory as
+// ollama serve does: blobs are checked, models in legacy layouts migrated and
+// unused blobs pruned. Requests are served by its Handler, or by Serve, once
+// it's started with Start, and it's stopped with Shutdown.
+func New(cfg Config) (*Server, error) {
+	envconfig.Override(cfg.vars())
+
+	if _, err := newStorage(envconfig.StorageBackend()); err != nil {
+		return nil, fmt.Errorf("OLLAMA_STORAGE_BACKEND: %w", err)
+	}
+
+	blobsDir, err := GetBlobsPath("")
+	if err != nil {
+		return nil, err
+	}
+	if err := fixBlobs(blobsDir); err != nil {
+		return nil, err
+	}
+
+	if !envconfig.NoTmpCleanup() {
+		// operations that were running when a server died leave their
+		// temporary files behind
+		if n, reclaimed, err := sweepTempDirs(); err != nil {
+			slog.Warn("couldn't remove orphaned temporary files", "error", err)
+		} else if n > 0 {
+			slog.Info("removed orphaned temporary files", "directories", n, "reclaimed", format.HumanBytes2(uint64(reclaimed)))
+		}
+	}
+
+	if !envconfig.NoMigrate() {
+		// models stored by older versions aren't listed until they're migrated
+		if _, err := MigrateModels(func(resp api.ProgressResponse) {
+			slog.Info(resp.Status)
+		}); err != nil {
+			slog.Warn("couldn't migrate models in legacy layouts", "error", err)
+		}
+	}
+
+	if !envconfig.NoPrune() {
+		// clean up unused layers and manifests
+		if err := PruneLayers(); err != nil {
+			return nil, err
+		}
+
+		manifestsPath, err := GetManifestPath()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := PruneDirectory(manifestsPath); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := loadAPIKeys(envconfig.APIKeys())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := parseDefaultOptions(envconfig.DefaultOptions()); err != nil {
+		return nil, fmt.Errorf("OLLAMA_DEFAULT_OPTIONS: %w", err)
+	}
+
+	presets, err := loadPresets(envconfig.Presets())
+	if err != nil {
+		return nil, fmt.Errorf("OLLAMA_PRESETS: %w", err)
+	}
+
+	aliases, err := loadAliases(envconfig.Aliases())
+	if err != nil {
+		return nil, fmt.Errorf("OLLAMA_ALIASES: %w", err)
+	}
+
+	allowedUIDs, err := parseAllowedUIDs(envconfig.SocketAllowedUIDs())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		sched:       InitScheduler(ctx),
+		keys:        keys,
+		allowedUIDs: allowedUIDs,
+		presets:     presets,
+		aliases:     aliasSet{aliases: aliases},
+		streams:     newStreamBuffers(envconfig.StreamBufferSize()),
+		generations: newGenerationStore(envconfig.GenerationBufferSize(), envconfig.GenerationTTL()),
+		sessions:    newSessionStore(envconfig.MaxSessions(), envconfig.SessionMaxSize(), envconfig.SessionTTL()),
+		usage:       newUsageStats(),
+		ctx:         ctx,
+		cancel:      cancel,
+		initRunners: func() error {
+			if _, err := runners.Refresh(build.EmbedFS); err != nil {
+				return fmt.Errorf("unable to initialize llm runners %w", err)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// Handler returns the handler serving the server's API. Requests aren't
+// checked against the allowed hosts that protect a server listening on a
+// loopback address unless it's served with Serve.
+func (s *Server) Handler() http.Handler {
+	s.handlerOnce.Do(func() {
+		s.handler = s.GenerateRoutes()
+	})
+
+	return s.handler
+}
+
+// Start starts the server's scheduler, which loads models for requests, and
+// its background work such as scheduled model refreshes
+func (s *Server) Start() error {
+	shutdownTracing, err := tracing.Init()
+	if err != nil {
+		return err
+	}
+	s.shutdownTracing = shutdownTracing
+
+	if err := s.initRunners(); err != nil {
+		return err
+	}
+
+	s.sched.Run(s.ctx)
+	s.startRefresher(s.ctx)
+
+	// At startup we retrieve GPU information so we can get log messages before loading a model
+	// This will log warnings to the log in case we have problems with detected GPUs
+	gpus := gpu.GetGPUInfo()
+	gpus.LogDetails()
+	slog.Info("cpu runner", "capability", gpu.GetCPUCapability(), "variant", runners.ServerForCpu())
+	llm.PrewarmRunners(gpus)
+	return nil
+}
+
+// Serve serves the server's API on ln until Shutdown is called, when it
+// returns http.ErrServerClosed. The server must be started first.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.httpServer != nil {
+		s.mu.Unlock()
+		return errors.New("server is already serving")
+	}
+
+	s.addr = ln.Addr()
+	if envconfig.P2P() {
+		announcePeer(s.ctx, s.addr)
+	}
+
+	handler := s.root
+	if handler == nil {
+		handler = s.Handler()
+	}
+
+	s.httpServer = &http.Server{
+		Handler:           handler,
+		ConnContext:       peerConnContext,
+		ReadHeaderTimeout: envconfig.ReadHeaderTimeout(),
+		IdleTimeout:       envconfig.IdleTimeout(),
+		// WriteTimeout is left unset since it would cut off long streaming
+		// responses. writeDeadlineMiddleware bounds each write instead.
+	}
+	srv := s.httpServer
+	s.mu.Unlock()
+
+	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
+	return srv.Serve(ln)
+}
+
+// Shutdown stops the server. If it's serving, it stops accepting requests
+// and waits for those in progress until ctx is done, when they're closed.
+// Loaded models are then unloaded and the server's configuration removed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.mu.Lock()
+	srv := s.httpServer
+	s.mu.Unlock()
+	if srv != nil {
+		if err = srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+	}
+
+	s.cancel()
+	s.sched.unloadAllRunners()
+	llm.CloseWarmPool()
+	runners.Cleanup(build.EmbedFS)
+	if s.shutdownTracing != nil {
+		if err := s.shutdownTracing(context.Background()); err != nil {
+			slog.Warn("failed to export traces", "error", err)
+		}
+	}
+
+	envconfig.Override(nil)
+	return err
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// closingRunner is a mockRunner that records being closed
+type closingRunner struct {
+	*mockRunner
+	closed bool
+}
+
+func (r *closingRunner) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestEmbeddedServer(t *testing.T) {
+	t.Cleanup(func() { envconfig.Override(nil) })
+
+	models := t.TempDir()
+	s, err := New(Config{Models: models, NumParallel: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := envconfig.Models(); got != models {
+		t.Fatalf("expected the models directory %q, got %q", models, got)
+	}
+
+	mock := &closingRunner{mockRunner: &mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}}
+
+	s.initRunners = func() error { return nil }
+	s.sched.newServerFn = func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int, *llm.MemoryEstimate) (llm.LlamaServer, error) {
+		return mock, nil
+	}
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		ref := &runnerRef{llama: mock, model: req.model, modelPath: req.model.ModelPath}
+		s.sched.loadedMu.Lock()
+		s.sched.loaded[ref.key()] = ref
+		s.sched.loadedMu.Unlock()
+		req.successCh <- ref
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	client := api.NewClient(&url.URL{Scheme: "http", Host: ln.Addr().String()}, http.DefaultClient)
+	ctx := context.Background()
+
+	if err := client.Create(ctx, &api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture": "llama",
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+	}, func(api.ProgressResponse) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	var response string
+	if err := client.Generate(ctx, &api.GenerateRequest{Model: "test", Prompt: "Hello"}, func(r api.GenerateResponse) error {
+		response += r.Response
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if response != "Hi!" {
+		t.Errorf("expected the model's response, got %q", response)
+	}
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("expected Serve to return http.ErrServerClosed, got %v", err)
+	}
+
+	if !mock.closed {
+		t.Error("expected the loaded model to be unloaded")
+	}
+
+	if got := envconfig.Models(); got == models {
+		t.Error("expected the server's configuration to be removed")
+	}
+}
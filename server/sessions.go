@@ -0,0 +1,473 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/types/model"
+)
+
+var (
+	errTooManySessions = errors.New("too many sessions")
+	errSessionTooLarge = errors.New("messages are larger than a session's history can hold")
+)
+
+// session is a chat whose history the server keeps, so its clients only send
+// each new message. Its messages are sent to the model with each one, as a
+// client of /api/chat would, so a session outlives its model being unloaded
+// and reuses the runner's cache of the history while it's loaded.
+type session struct {
+	id string
+
+	// key and ip identify the client that created the session, as for
+	// generations
+	key *apiKey
+	ip  string
+
+	model     string
+	options   map[string]any
+	keepAlive *api.Duration
+	created   time.Time
+
+	// busy is held while the session replies to a message
+	busy sync.Mutex
+
+	mu       sync.Mutex
+	messages []api.Message
+	expires  time.Time
+
+	// size is the size of messages, which is kept within maxSize by dropping
+	// the oldest messages
+	size    uint64
+	maxSize uint64
+}
+
+// sessionStore keeps up to max sessions, each until ttl after it was last
+// used and with at most size bytes of history
+type sessionStore struct {
+	max  uint
+	size uint64
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// newSessionStore returns a store of max sessions of size bytes of history
+// kept for ttl, or nil if max is zero, which disables sessions. A size of
+// zero doesn't limit the history.
+func newSessionStore(max uint, size uint64, ttl time.Duration) *sessionStore {
+	if max == 0 {
+		return nil
+	}
+
+	return &sessionStore{max: max, size: size, ttl: ttl, sessions: make(map[string]*session)}
+}
+
+// expireLocked removes the sessions whose ttl has passed
+func (s *sessionStore) expireLocked() {
+	now := time.Now()
+	for id, sess := range s.sessions {
+		sess.mu.Lock()
+		expired := now.After(sess.expires)
+		sess.mu.Unlock()
+		if expired && sess.busy.TryLock() {
+			delete(s.sessions, id)
+			sess.busy.Unlock()
+		}
+	}
+}
+
+// create starts a session for c's client
+func (s *sessionStore) create(c *gin.Context, name string, req api.CreateSessionRequest) (*session, error) {
+	b := make([]byte, 16)
+	rand.Read(b) //nolint:errcheck
+
+	now := time.Now()
+	sess := &session{
+		id:        hex.EncodeToString(b),
+		ip:        c.RemoteIP(),
+		model:     name,
+		options:   req.Options,
+		keepAlive: req.KeepAlive,
+		created:   now.UTC(),
+		expires:   now.Add(s.ttl),
+		maxSize:   s.size,
+	}
+	sess.key, _ = c.Request.Context().Value(apiKeyContextKey{}).(*apiKey)
+
+	if !sess.fits(req.Messages...) {
+		return nil, fmt.Errorf("%w, at most %s set by OLLAMA_SESSION_MAX_SIZE", errSessionTooLarge, format.HumanBytes2(s.size))
+	}
+	sess.append(req.Messages...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	if uint(len(s.sessions)) >= s.max {
+		return nil, fmt.Errorf("%w, the server keeps at most %d set by OLLAMA_MAX_SESSIONS", errTooManySessions, s.max)
+	}
+
+	s.sessions[sess.id] = sess
+	return sess, nil
+}
+
+// get returns the session id if c's client created it
+func (s *sessionStore) get(c *gin.Context, id string) (*session, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+
+	if k, _ := c.Request.Context().Value(apiKeyContextKey{}).(*apiKey); k != sess.key || k == nil && c.RemoteIP() != sess.ip {
+		return nil, false
+	}
+
+	return sess, true
+}
+
+// remove ends the session id if c's client created it
+func (s *sessionStore) remove(c *gin.Context, id string) bool {
+	sess, ok := s.get(c, id)
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sess.id)
+	return true
+}
+
+// touch keeps sess for the store's ttl from now
+func (s *sessionStore) touch(sess *session) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.expires = time.Now().Add(s.ttl)
+}
+
+func (sess *session) history() []api.Message {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return slices.Clone(sess.messages)
+}
+
+// messageSize is the memory m takes in a session's history
+func messageSize(m api.Message) uint64 {
+	size := len(m.Role) + len(m.Content)
+	for _, image := range m.Images {
+		size += len(image)
+	}
+
+	for _, call := range m.ToolCalls {
+		if b, err := json.Marshal(call); err == nil {
+			size += len(b)
+		}
+	}
+
+	return uint64(size)
+}
+
+// fits reports whether msgs fit in sess's history with its system messages,
+// once older messages are dropped
+func (sess *session) fits(msgs ...api.Message) bool {
+	if sess.maxSize == 0 {
+		return true
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	var size uint64
+	for _, m := range sess.messages {
+		if m.Role != "system" {
+			break
+		}
+		size += messageSize(m)
+	}
+
+	for _, m := range msgs {
+		size += messageSize(m)
+	}
+
+	return size <= sess.maxSize
+}
+
+// append adds msgs to sess's history, dropping its oldest messages after the
+// leading system messages until it fits in maxSize. Messages are dropped up
+// to the next user message, so the history doesn't begin with a reply, and
+// msgs themselves are always kept.
+func (sess *session) append(msgs ...api.Message) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.messages = append(sess.messages, msgs...)
+	for _, m := range msgs {
+		sess.size += messageSize(m)
+	}
+
+	if sess.maxSize == 0 {
+		return
+	}
+
+	i := slices.IndexFunc(sess.messages, func(m api.Message) bool { return m.Role != "system" })
+	keep := len(sess.messages) - len(msgs)
+	for i >= 0 && i < keep && sess.size > sess.maxSize {
+		j := i + 1
+		for j < keep && sess.messages[j].Role != "user" {
+			j++
+		}
+
+		for _, m := range sess.messages[i:j] {
+			sess.size -= messageSize(m)
+		}
+
+		sess.messages = slices.Delete(sess.messages, i, j)
+		keep -= j - i
+	}
+}
+
+func (sess *session) response(messages bool) api.SessionResponse {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	resp := api.SessionResponse{
+		ID:        sess.id,
+		Model:     sess.model,
+		Options:   sess.options,
+		CreatedAt: sess.created,
+		ExpiresAt: sess.expires.UTC(),
+	}
+
+	if messages {
+		resp.Messages = slices.Clone(sess.messages)
+		if resp.Messages == nil {
+			resp.Messages = []api.Message{}
+		}
+	}
+
+	return resp
+}
+
+// sessionWriter collects the reply of a session's chat request from the
+// responses written by ChatHandler
+type sessionWriter struct {
+	gin.ResponseWriter
+
+	// line is the part of a response that hasn't been parsed yet, which is
+	// all of it for responses that aren't streamed
+	line []byte
+
+	reply api.Message
+	done  bool
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	if w.Status() == http.StatusOK {
+		w.line = append(w.line, b...)
+		for {
+			i := bytes.IndexByte(w.line, '\n')
+			if i < 0 {
+				break
+			}
+
+			w.parse(w.line[:i])
+			w.line = w.line[i+1:]
+		}
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sessionWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *sessionWriter) parse(line []byte) {
+	var r api.ChatResponse
+	if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &r) != nil || r.Index != 0 || r.Status != "" {
+		return
+	}
+
+	w.reply.Role = "assistant"
+	w.reply.Content += r.Message.Content
+	w.reply.ToolCalls = append(w.reply.ToolCalls, r.Message.ToolCalls...)
+	if r.Done {
+		w.done = true
+	}
+}
+
+// end parses the rest of the response once the handler has returned
+func (w *sessionWriter) end() {
+	w.parse(w.line)
+	w.line = nil
+}
+
+// CreateSessionHandler starts a chat session with a model, whose history is
+// kept by the server
+func (s *Server) CreateSessionHandler(c *gin.Context) {
+	if s.sessions == nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "sessions are disabled by OLLAMA_MAX_SESSIONS"})
+		return
+	}
+
+	var req api.CreateSessionRequest
+	if err := bindJSON(c, &req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := s.sessionModel(c, req)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	sess, err := s.sessions.create(c, name, req)
+	if errors.Is(err, errTooManySessions) {
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, errSessionTooLarge) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sess.response(false))
+}
+
+// sessionModel returns the name of the model a session is created with,
+// checking that it can chat with the session's options
+func (s *Server) sessionModel(c *gin.Context, req api.CreateSessionRequest) (string, error) {
+	if req.Model == "" {
+		return "", fmt.Errorf("model %w", errRequired)
+	}
+
+	caps := []model.Capability{model.CapabilityCompletion}
+	name, err := s.resolveAlias(c.Request.Context(), req.Model, caps, nil, req.Options)
+	if err != nil {
+		return "", err
+	}
+
+	m, err := getNamespacedModel(c.Request.Context(), name)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.CheckCapabilities(caps...); err != nil {
+		return "", fmt.Errorf("%s %w", name, err)
+	}
+
+	if _, err := modelOptions(m, nil, req.Options); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// SessionChatHandler sends a user message to a session, replying as
+// ChatHandler does with the session's history. The message and its reply are
+// added to the history once the reply is done, so a reply that fails or is
+// cancelled leaves the session as it was.
+func (s *Server) SessionChatHandler(c *gin.Context) {
+	sess, ok := s.sessions.get(c, c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	var req api.SessionChatRequest
+	if err := bindJSON(c, &req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !sess.busy.TryLock() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "session is replying to another message"})
+		return
+	}
+	defer sess.busy.Unlock()
+
+	s.sessions.touch(sess)
+	defer s.sessions.touch(sess)
+
+	msg := api.Message{Role: "user", Content: req.Content, Images: req.Images}
+	if !sess.fits(msg) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("%s, at most %s set by OLLAMA_SESSION_MAX_SIZE", errSessionTooLarge, format.HumanBytes2(sess.maxSize))})
+		return
+	}
+
+	b, err := json.Marshal(api.ChatRequest{
+		Model:     sess.model,
+		Messages:  append(sess.history(), msg),
+		Options:   sess.options,
+		KeepAlive: sess.keepAlive,
+		Stream:    req.Stream,
+	})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Request.Body = io.NopCloser(bytes.NewReader(b))
+	c.Request.ContentLength = int64(len(b))
+
+	w := &sessionWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	s.ChatHandler(c)
+	w.end()
+
+	if w.done {
+		sess.append(msg, w.reply)
+	}
+}
+
+// SessionHandler returns a session with its history
+func (s *Server) SessionHandler(c *gin.Context) {
+	sess, ok := s.sessions.get(c, c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sess.response(true))
+}
+
+// DeleteSessionHandler ends a session
+func (s *Server) DeleteSessionHandler(c *gin.Context) {
+	if !s.sessions.remove(c, c.Param("id")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// sessionRequest sends a request to the session routes of s from addr
+func sessionRequest(t *testing.T, s *Server, method, path, addr string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := gin.New()
+	r.POST("/api/sessions", s.CreateSessionHandler)
+	r.GET("/api/sessions/:id", s.SessionHandler)
+	r.DELETE("/api/sessions/:id", s.DeleteSessionHandler)
+	r.POST("/api/sessions/:id/chat", s.SessionChatHandler)
+
+	var b bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, path, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = addr
+
+	w := NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.ResponseRecorder
+}
+
+func TestSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:            "Hi!",
+			Done:               true,
+			DoneReason:         "stop",
+			PromptEvalCount:    1,
+			PromptEvalDuration: 1,
+			EvalCount:          1,
+			EvalDuration:       1,
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			queues:        newRequestQueues(1, 0),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+		sessions: newSessionStore(2, 1024, time.Minute),
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf(`FROM %s
+		TEMPLATE """
+{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}"""
+`, createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.attn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.ffn_down.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.ffn_gate.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.ffn_up.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.ffn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.attn_k.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.attn_output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.attn_q.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "blk.0.attn_v.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	const addr = "10.0.0.1:1234"
+
+	t.Run("missing model", func(t *testing.T) {
+		w := sessionRequest(t, &s, http.MethodPost, "/api/sessions", addr, api.CreateSessionRequest{})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("model not found", func(t *testing.T) {
+		w := sessionRequest(t, &s, http.MethodPost, "/api/sessions", addr, api.CreateSessionRequest{Model: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	var created api.SessionResponse
+	w = sessionRequest(t, &s, http.MethodPost, "/api/sessions", addr, api.CreateSessionRequest{
+		Model:    "test",
+		Messages: []api.Message{{Role: "system", Content: "Be brief."}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d %s", w.Code, w.Body)
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	if created.ID == "" || created.Model != "test" || created.Messages != nil {
+		t.Fatalf("expected a session without its messages, got %+v", created)
+	}
+
+	chat := "/api/sessions/" + created.ID + "/chat"
+
+	t.Run("chat", func(t *testing.T) {
+		w := sessionRequest(t, &s, http.MethodPost, chat, addr, api.SessionChatRequest{Content: "Hello!", Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d %s", w.Code, w.Body)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !resp.Done || resp.Message.Content != "Hi!" {
+			t.Errorf("expected the reply, got %+v", resp)
+		}
+
+		// the history is sent with each message
+		w = sessionRequest(t, &s, http.MethodPost, chat, addr, api.SessionChatRequest{Content: "Again!"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d %s", w.Code, w.Body)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "system: Be brief. user: Hello! assistant: Hi! user: Again! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("transcript", func(t *testing.T) {
+		w := sessionRequest(t, &s, http.MethodGet, "/api/sessions/"+created.ID, addr, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.SessionResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []api.Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Hello!"},
+			{Role: "assistant", Content: "Hi!"},
+			{Role: "user", Content: "Again!"},
+			{Role: "assistant", Content: "Hi!"},
+		}
+		if diff := cmp.Diff(resp.Messages, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if resp.ExpiresAt.Before(created.ExpiresAt) {
+			t.Errorf("expected the session to be kept longer once used, got %v", resp.ExpiresAt)
+		}
+	})
+
+	t.Run("other client", func(t *testing.T) {
+		if w := sessionRequest(t, &s, http.MethodGet, "/api/sessions/"+created.ID, "10.0.0.2:1234", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected another client's session to be hidden, got %d", w.Code)
+		}
+
+		if w := sessionRequest(t, &s, http.MethodPost, chat, "10.0.0.2:1234", api.SessionChatRequest{Content: "Hello!"}); w.Code != http.StatusNotFound {
+			t.Errorf("expected another client's session to be hidden, got %d", w.Code)
+		}
+
+		// Forwarding headers are set by the client, so they can't claim
+		// another client's address
+		r := gin.New()
+		r.GET("/api/sessions/:id", s.SessionHandler)
+		req := httptest.NewRequest(http.MethodGet, "/api/sessions/"+created.ID, nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected a spoofed address to be ignored, got %d", w.Code)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		large := strings.Repeat("a", 2048)
+		if w := sessionRequest(t, &s, http.MethodPost, chat, addr, api.SessionChatRequest{Content: large}); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413, got %d", w.Code)
+		}
+
+		if w := sessionRequest(t, &s, http.MethodPost, "/api/sessions", addr, api.CreateSessionRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "system", Content: large}},
+		}); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413, got %d", w.Code)
+		}
+	})
+
+	t.Run("too many", func(t *testing.T) {
+		w := sessionRequest(t, &s, http.MethodPost, "/api/sessions", addr, api.CreateSessionRequest{Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var other api.SessionResponse
+		if err := json.NewDecoder(w.Body).Decode(&other); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := sessionRequest(t, &s, http.MethodPost, "/api/sessions", addr, api.CreateSessionRequest{Model: "test"}); w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status 429, got %d", w.Code)
+		}
+
+		if w := sessionRequest(t, &s, http.MethodDelete, "/api/sessions/"+other.ID, addr, nil); w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if w := sessionRequest(t, &s, http.MethodGet, "/api/sessions/"+other.ID, addr, nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected a deleted session to be gone, got %d", w.Code)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		sess := s.sessions.sessions[created.ID]
+		sess.expires = time.Now().Add(-time.Second)
+
+		if w := sessionRequest(t, &s, http.MethodGet, "/api/sessions/"+created.ID, addr, nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected an expired session to be gone, got %d", w.Code)
+		}
+
+		if len(s.sessions.sessions) != 0 {
+			t.Errorf("expected no sessions, got %d", len(s.sessions.sessions))
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s := Server{}
+		if w := sessionRequest(t, &s, http.MethodPost, "/api/sessions", addr, api.CreateSessionRequest{Model: "test"}); w.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", w.Code)
+		}
+
+		if w := sessionRequest(t, &s, http.MethodGet, "/api/sessions/"+created.ID, addr, nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestSessionHistorySize(t *testing.T) {
+	message := func(role, content string) api.Message {
+		return api.Message{Role: role, Content: content}
+	}
+
+	// each message is 10 bytes, counting its role
+	sess := &session{maxSize: 50}
+	sess.append(message("system", "syst"), message("user", "user01"), message("assistant", "a"))
+	sess.append(message("user", "user02"), message("assistant", "b"))
+
+	expect := []api.Message{
+		message("system", "syst"),
+		message("user", "user01"), message("assistant", "a"),
+		message("user", "user02"), message("assistant", "b"),
+	}
+	if diff := cmp.Diff(sess.history(), expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	// the oldest exchange is dropped, keeping the system message
+	sess.append(message("user", "user03"), message("assistant", "c"))
+
+	expect = []api.Message{
+		message("system", "syst"),
+		message("user", "user02"), message("assistant", "b"),
+		message("user", "user03"), message("assistant", "c"),
+	}
+	if diff := cmp.Diff(sess.history(), expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if sess.size != 50 {
+		t.Errorf("expected a size of 50, got %d", sess.size)
+	}
+
+	// messages that don't fit are still kept once appended, dropping all
+	// the older ones
+	sess.append(message("user", strings.Repeat("u", 40)), message("assistant", "d"))
+
+	expect = []api.Message{
+		message("system", "syst"),
+		message("user", strings.Repeat("u", 40)), message("assistant", "d"),
+	}
+	if diff := cmp.Diff(sess.history(), expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if sess.fits(message("user", strings.Repeat("u", 37))) {
+		t.Error("expected a message larger than the history with the system message not to fit")
+	}
+
+	if !sess.fits(message("user", strings.Repeat("u", 36))) {
+		t.Error("expected a message that fits with the system message to fit")
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/auth"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// signatureAnnotation is the manifest annotation holding a detached
+// signature of the manifest's digest, as <public key>:<signature> in base64
+const signatureAnnotation = "com.ollama.signature"
+
+const (
+	signatureVerified  = "verified"
+	signatureUntrusted = "untrusted"
+	signatureInvalid   = "invalid"
+)
+
+var errSignature = errors.New("signature verification failed")
+
+// signedDigest returns the digest that's signed for m, which is the digest
+// of the manifest as pushed without its signature
+func (m *Manifest) signedDigest() (string, error) {
+	unsigned := *m
+	unsigned.Annotations = maps.Clone(m.Annotations)
+	delete(unsigned.Annotations, signatureAnnotation)
+	if len(unsigned.Annotations) == 0 {
+		unsigned.Annotations = nil
+	}
+
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b)), nil
+}
+
+// sign signs m with the local key, replacing any existing signature
+func (m *Manifest) sign(ctx context.Context) error {
+	digest, err := m.signedDigest()
+	if err != nil {
+		return err
+	}
+
+	signature, err := auth.Sign(ctx, []byte(digest))
+	if err != nil {
+		return err
+	}
+
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]string)
+	}
+
+	m.Annotations[signatureAnnotation] = signature
+	return nil
+}
+
+// checkSignature verifies the signature of m against the keys in
+// OLLAMA_TRUSTED_SIGNERS, returning nil if m isn't signed
+func (m *Manifest) checkSignature() (*api.SignatureInfo, error) {
+	signature, ok := m.Annotations[signatureAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	invalid := &api.SignatureInfo{Status: signatureInvalid}
+
+	encodedKey, encodedSig, ok := strings.Cut(signature, ":")
+	if !ok {
+		return invalid, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return invalid, nil
+	}
+
+	key, err := ssh.ParsePublicKey(b)
+	if err != nil {
+		return invalid, nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return invalid, nil
+	}
+
+	digest, err := m.signedDigest()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &api.SignatureInfo{Signer: ssh.FingerprintSHA256(key), Status: signatureUntrusted}
+	if err := key.Verify([]byte(digest), &ssh.Signature{Format: key.Type(), Blob: sig}); err != nil {
+		info.Status = signatureInvalid
+		return info, nil
+	}
+
+	signers, err := trustedSigners()
+	if err != nil {
+		return nil, err
+	}
+
+	if name, ok := signers[string(key.Marshal())]; ok {
+		info.Signer = name
+		info.Status = signatureVerified
+	}
+
+	return info, nil
+}
+
+// trustedSigners reads the keys in OLLAMA_TRUSTED_SIGNERS, mapping each
+// marshaled key to the signer it names
+func trustedSigners() (map[string]string, error) {
+	path := envconfig.TrustedSigners()
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signers := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		signers[string(key.Marshal())] = cmp.Or(comment, ssh.FingerprintSHA256(key))
+	}
+
+	return signers, scanner.Err()
+}
+
+// checkPullSignature applies OLLAMA_SIGNATURE_POLICY to a manifest being
+// pulled, before any of its blobs are downloaded. Models that aren't signed
+// by a trusted signer are rejected when the policy is "enforce", and pulled
+// with a warning otherwise. Enforcing without any trusted signers rejects
+// every model rather than skipping verification.
+func checkPullSignature(name string, m *Manifest, fn func(api.ProgressResponse)) error {
+	if envconfig.TrustedSigners() == "" {
+		if envconfig.SignaturePolicy() == "enforce" {
+			return fmt.Errorf("%w: OLLAMA_SIGNATURE_POLICY is enforce but OLLAMA_TRUSTED_SIGNERS isn't set", errSignature)
+		}
+		return nil
+	}
+
+	info, err := m.checkSignature()
+	if err != nil {
+		return err
+	}
+
+	var reason string
+	switch {
+	case info == nil:
+		reason = "model is not signed"
+	case info.Status == signatureInvalid:
+		reason = "signature doesn't match the model"
+	case info.Status == signatureUntrusted:
+		reason = fmt.Sprintf("model is signed by untrusted key %s", info.Signer)
+	default:
+		slog.Info("verified model signature", "model", name, "signer", info.Signer)
+		return nil
+	}
+
+	if envconfig.SignaturePolicy() == "enforce" {
+		return fmt.Errorf("%w: %s", errSignature, reason)
+	}
+
+	slog.Warn("pulling model without a trusted signature", "model", name, "reason", reason)
+	fn(api.ProgressResponse{Status: fmt.Sprintf("warning: %s", reason)})
+	return nil
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// newSigningKey generates a key pair, returning the private key in the PEM
+// form of ~/.ollama/id_ed25519 and the public key in authorized_keys form
+func newSigningKey(t *testing.T, comment string) (private []byte, authorized string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorized = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	if comment != "" {
+		authorized += " " + comment
+	}
+	return pem.EncodeToMemory(block), authorized
+}
+
+// trustSigners writes keys to a trusted signers file and points
+// OLLAMA_TRUSTED_SIGNERS at it
+func trustSigners(t *testing.T, policy string, keys ...string) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "trusted_signers")
+	if err := os.WriteFile(p, []byte("# trusted model signers\n\n"+strings.Join(keys, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_TRUSTED_SIGNERS", p)
+	t.Setenv("OLLAMA_SIGNATURE_POLICY", policy)
+}
+
+// signatureRegistry is a registry that has every blob, storing manifests
+// pushed to it by tag
+type signatureRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string][]byte
+}
+
+func newSignatureRegistry(t *testing.T) *signatureRegistry {
+	t.Helper()
+	r := &signatureRegistry{manifests: make(map[string][]byte)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		tag := path.Base(req.URL.Path)
+		switch {
+		case req.Method == http.MethodHead && strings.Contains(req.URL.Path, "/blobs/"):
+		case req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/"):
+			b, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			r.manifests[tag] = b
+			w.WriteHeader(http.StatusCreated)
+		case req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/manifests/"):
+			if b, ok := r.manifests[tag]; ok {
+				w.Write(b)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		default:
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// tamper edits the manifest stored for tag
+func (r *signatureRegistry) tamper(t *testing.T, tag string, fn func(*Manifest)) {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var m Manifest
+	if err := json.Unmarshal(r.manifests[tag], &m); err != nil {
+		t.Fatal(err)
+	}
+
+	fn(&m)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.manifests[tag] = b
+}
+
+func TestSignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	private, authorized := newSigningKey(t, "build-pipeline")
+	if err := os.MkdirAll(filepath.Join(home, ".ollama"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(home, ".ollama", "id_ed25519"), private, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := newSignatureRegistry(t)
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := func(tag string) string {
+		return fmt.Sprintf("%s/library/signed:%s", u.Host, tag)
+	}
+
+	var s Server
+	for _, tag := range []string{"signed", "unsigned"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name(tag),
+			Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, nil, nil)),
+			Stream:    &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	opts := &registryOptions{Insecure: true}
+	var statuses []string
+	fn := func(r api.ProgressResponse) { statuses = append(statuses, r.Status) }
+
+	if err := PushModel(context.Background(), "http://"+name("signed"), opts, true, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PushModel(context.Background(), "http://"+name("unsigned"), opts, false, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	pull := func(t *testing.T, tag string) error {
+		t.Helper()
+		statuses = nil
+		return PullModel(context.Background(), "http://"+name(tag), opts, fn)
+	}
+
+	t.Run("show", func(t *testing.T) {
+		t.Setenv("OLLAMA_TRUSTED_SIGNERS", "")
+
+		resp, err := GetModelInfo(api.ShowRequest{Model: name("signed")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Signature == nil || resp.Signature.Status != "untrusted" || !strings.HasPrefix(resp.Signature.Signer, "SHA256:") {
+			t.Errorf("expected a valid signature from an untrusted key, got %+v", resp.Signature)
+		}
+
+		trustSigners(t, "warn", authorized)
+		resp, err = GetModelInfo(api.ShowRequest{Model: name("signed")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Signature == nil || *resp.Signature != (api.SignatureInfo{Signer: "build-pipeline", Status: "verified"}) {
+			t.Errorf("expected a verified signature, got %+v", resp.Signature)
+		}
+
+		resp, err = GetModelInfo(api.ShowRequest{Model: name("unsigned")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Signature != nil {
+			t.Errorf("expected no signature, got %+v", resp.Signature)
+		}
+	})
+
+	t.Run("enforce trusted", func(t *testing.T) {
+		trustSigners(t, "enforce", authorized)
+		if err := pull(t, "signed"); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := ParseNamedManifest(model.ParseName(name("signed")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info, err := m.checkSignature(); err != nil || info == nil || info.Status != "verified" {
+			t.Errorf("expected the pulled model to keep its signature, got %+v, %v", info, err)
+		}
+	})
+
+	t.Run("enforce unsigned", func(t *testing.T) {
+		trustSigners(t, "enforce", authorized)
+		if err := pull(t, "unsigned"); !errors.Is(err, errSignature) {
+			t.Errorf("expected the unsigned model to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("enforce untrusted", func(t *testing.T) {
+		_, other := newSigningKey(t, "someone-else")
+		trustSigners(t, "enforce", other)
+		if err := pull(t, "signed"); !errors.Is(err, errSignature) {
+			t.Errorf("expected a model signed by an untrusted key to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("enforce without signers", func(t *testing.T) {
+		t.Setenv("OLLAMA_TRUSTED_SIGNERS", "")
+		t.Setenv("OLLAMA_SIGNATURE_POLICY", "enforce")
+		for _, tag := range []string{"signed", "unsigned"} {
+			if err := pull(t, tag); !errors.Is(err, errSignature) || !strings.Contains(err.Error(), "OLLAMA_TRUSTED_SIGNERS isn't set") {
+				t.Errorf("expected %s to be rejected without trusted signers, got %v", tag, err)
+			}
+		}
+	})
+
+	t.Run("warn unsigned", func(t *testing.T) {
+		trustSigners(t, "warn", authorized)
+		if err := pull(t, "unsigned"); err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Contains(statuses, "warning: model is not signed") {
+			t.Errorf("expected a warning, got %v", statuses)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		// point the model at another blob the registry has
+		registry.tamper(t, "signed", func(m *Manifest) {
+			m.Layers[0], m.Layers[1] = m.Layers[1], m.Layers[0]
+		})
+
+		trustSigners(t, "enforce", authorized)
+		if err := pull(t, "signed"); !errors.Is(err, errSignature) {
+			t.Errorf("expected the tampered model to be rejected, got %v", err)
+		}
+
+		trustSigners(t, "warn", authorized)
+		if err := pull(t, "signed"); err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Contains(statuses, "warning: signature doesn't match the model") {
+			t.Errorf("expected a warning, got %v", statuses)
+		}
+
+		resp, err := GetModelInfo(api.ShowRequest{Model: name("signed")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Signature == nil || resp.Signature.Status != "invalid" {
+			t.Errorf("expected the tampered signature to be invalid, got %+v", resp.Signature)
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// peerCred is the credentials of the process on the other end of a unix
+// socket connection
+type peerCred struct {
+	UID uint32
+	GID uint32
+
+	// PID is zero where it isn't reported
+	PID int32
+}
+
+type peerCredContextKey struct{}
+
+// Listen listens on host, which is in the form of OLLAMA_HOST. A unix://
+// host listens on a unix socket, which is given the permissions and group of
+// OLLAMA_SOCKET_MODE and OLLAMA_SOCKET_GROUP.
+func Listen(host *url.URL) (net.Listener, error) {
+	if host.Scheme != "unix" {
+		return net.Listen("tcp", host.Host)
+	}
+
+	mode, err := parseSocketMode(envconfig.SocketMode())
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := lookupSocketGroup(envconfig.SocketGroup())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleSocket(host.Path); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", host.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chmodSocket(host.Path, mode, gid); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// parseSocketMode parses OLLAMA_SOCKET_MODE, returning 0 if it isn't set
+func parseSocketMode(s string) (fs.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n == 0 || n > 0o777 {
+		return 0, fmt.Errorf("OLLAMA_SOCKET_MODE: invalid mode %q, expected octal permissions such as 0660", s)
+	}
+
+	return fs.FileMode(n), nil
+}
+
+// lookupSocketGroup returns the id of the group named or numbered s by
+// OLLAMA_SOCKET_GROUP, or -1 if it isn't set
+func lookupSocketGroup(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+
+	if gid, err := strconv.Atoi(s); err == nil && gid >= 0 {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, fmt.Errorf("OLLAMA_SOCKET_GROUP: %w", err)
+	}
+
+	return strconv.Atoi(g.Gid)
+}
+
+// parseAllowedUIDs parses OLLAMA_SOCKET_ALLOWED_UIDS, returning nil if it
+// isn't set
+func parseAllowedUIDs(s string) ([]uint32, error) {
+	var uids []uint32
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("OLLAMA_SOCKET_ALLOWED_UIDS: invalid user id %q", field)
+		}
+
+		uids = append(uids, uint32(uid))
+	}
+
+	return uids, nil
+}
+
+// removeStaleSocket removes the socket at path left by a server that didn't
+// shut down cleanly. A socket another server is still listening on, or a
+// file that isn't a socket, is left alone, failing the listen.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+
+	slog.Info("removing stale socket", "path", path)
+	return os.Remove(path)
+}
+
+// chmodSocket gives the socket at path mode and the group gid, unless they're
+// 0 and -1
+func chmodSocket(path string, mode fs.FileMode, gid int) error {
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("OLLAMA_SOCKET_GROUP: %w", err)
+		}
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("OLLAMA_SOCKET_MODE: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// peerConnContext adds the credentials of the peer of unix socket connections
+// to their requests' contexts, logging them for auditing, or the error
+// reading them
+func peerConnContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	cred, err := peerCredentials(uc)
+	if err != nil {
+		slog.Warn("couldn't read unix socket peer credentials", "error", err)
+		return context.WithValue(ctx, peerCredContextKey{}, err)
+	}
+
+	slog.Info("unix socket connection", "uid", cred.UID, "gid", cred.GID, "pid", cred.PID)
+	return context.WithValue(ctx, peerCredContextKey{}, cred)
+}
+
+// peerCredMiddleware rejects requests over unix socket connections from users
+// not in allowed, unless it's empty, and those whose user couldn't be read
+func peerCredMiddleware(allowed []uint32) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(allowed) == 0 {
+			c.Next()
+			return
+		}
+
+		var cred peerCred
+		switch v := c.Request.Context().Value(peerCredContextKey{}).(type) {
+		case nil:
+			c.Next()
+			return
+		case error:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("couldn't check the user allowed to connect: %v", v)})
+			return
+		case peerCred:
+			if slices.Contains(allowed, v.UID) {
+				c.Next()
+				return
+			}
+			cred = v
+		}
+
+		slog.Warn("rejected unix socket request from user not in OLLAMA_SOCKET_ALLOWED_UIDS", "uid", cred.UID, "gid", cred.GID, "pid", cred.PID, "path", c.Request.URL.Path)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("user %d isn't allowed to connect", cred.UID)})
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseSocketMode(t *testing.T) {
+	cases := map[string]struct {
+		mode fs.FileMode
+		err  bool
+	}{
+		"":     {0, false},
+		"0660": {0o660, false},
+		"600":  {0o600, false},
+		"0999": {0, true},
+		"1777": {0, true},
+		"0":    {0, true},
+		"rw":   {0, true},
+	}
+
+	for s, tt := range cases {
+		mode, err := parseSocketMode(s)
+		if tt.err {
+			if err == nil || !strings.Contains(err.Error(), "OLLAMA_SOCKET_MODE") {
+				t.Errorf("%q: expected an OLLAMA_SOCKET_MODE error, got %v", s, err)
+			}
+		} else if err != nil || mode != tt.mode {
+			t.Errorf("%q: expected %o, got %o %v", s, tt.mode, mode, err)
+		}
+	}
+}
+
+func TestLookupSocketGroup(t *testing.T) {
+	if gid, err := lookupSocketGroup(""); err != nil || gid != -1 {
+		t.Errorf("expected no group, got %d %v", gid, err)
+	}
+
+	if gid, err := lookupSocketGroup("1234"); err != nil || gid != 1234 {
+		t.Errorf("expected group 1234, got %d %v", gid, err)
+	}
+
+	if _, err := lookupSocketGroup("no-such-group-ollama"); err == nil || !strings.Contains(err.Error(), "OLLAMA_SOCKET_GROUP") {
+		t.Errorf("expected an OLLAMA_SOCKET_GROUP error, got %v", err)
+	}
+}
+
+func TestParseAllowedUIDs(t *testing.T) {
+	if uids, err := parseAllowedUIDs(""); err != nil || uids != nil {
+		t.Errorf("expected no users, got %v %v", uids, err)
+	}
+
+	if uids, err := parseAllowedUIDs("0, 1000,"); err != nil || !slices.Equal(uids, []uint32{0, 1000}) {
+		t.Errorf("expected users 0 and 1000, got %v %v", uids, err)
+	}
+
+	if _, err := parseAllowedUIDs("1000,root"); err == nil || !strings.Contains(err.Error(), `"root"`) {
+		t.Errorf("expected an error naming root, got %v", err)
+	}
+}
+
+func TestPeerCredMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	request := func(allowed []uint32, cred any) int {
+		r := gin.New()
+		r.Use(peerCredMiddleware(allowed))
+		r.GET("/api/version", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		req := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+		if cred != nil {
+			req = req.WithContext(context.WithValue(req.Context(), peerCredContextKey{}, cred))
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	cases := []struct {
+		name    string
+		allowed []uint32
+		cred    any
+		expect  int
+	}{
+		{"no allowed list", nil, peerCred{UID: 1001}, http.StatusOK},
+		{"allowed", []uint32{1000}, peerCred{UID: 1000}, http.StatusOK},
+		{"not allowed", []uint32{1000}, peerCred{UID: 1001}, http.StatusForbidden},
+		{"tcp", []uint32{1000}, nil, http.StatusOK},
+		{"unreadable", []uint32{1000}, errors.ErrUnsupported, http.StatusForbidden},
+	}
+
+	for _, tt := range cases {
+		if code := request(tt.allowed, tt.cred); code != tt.expect {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expect, code)
+		}
+	}
+}
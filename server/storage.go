@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+// Storage stores the manifests and blobs of models. Runners load models from
+// real files, so a Storage that keeps blobs elsewhere copies them to the local
+// blobs directory as they're needed.
+type Storage interface {
+	// ReadOnly reports whether models can't be pulled, created or deleted
+	ReadOnly() bool
+
+	// OpenManifest opens the manifest of n
+	OpenManifest(n model.Name) (fs.File, error)
+
+	// WriteManifest replaces the manifest of n with b
+	WriteManifest(n model.Name, b []byte) error
+
+	// DeleteManifest removes the manifest of n
+	DeleteManifest(n model.Name) error
+
+	// ListManifests returns the names of the models with manifests
+	ListManifests() ([]model.Name, error)
+
+	// StatBlob describes the blob with digest
+	StatBlob(digest string) (fs.FileInfo, error)
+
+	// OpenBlob opens the blob with digest
+	OpenBlob(digest string) (io.ReadSeekCloser, error)
+
+	// WriteBlob stores the local file src, whose content has already been
+	// checked against digest, as the blob with digest. The file is moved.
+	WriteBlob(digest, src string) error
+
+	// DeleteBlob removes the blob with digest
+	DeleteBlob(digest string) error
+
+	// BlobPath returns the path of a local file with the content of the blob
+	// with digest
+	BlobPath(ctx context.Context, digest string) (string, error)
+}
+
+// errReadOnlyStorage is returned for changes to models in read-only storage
+var errReadOnlyStorage = errors.New("model storage is read-only")
+
+// newStorage returns the storage that backend selects: the models directory if
+// it's empty or "filesystem", or a read-only HTTP server if it's a URL
+func newStorage(backend string) (Storage, error) {
+	switch {
+	case backend == "" || backend == "filesystem":
+		return fileStorage{}, nil
+	case strings.HasPrefix(backend, "http://"), strings.HasPrefix(backend, "https://"):
+		if envconfig.Offline() {
+			return nil, fmt.Errorf("%s can't be used: %w", backend, errOffline)
+		}
+
+		u, err := url.Parse(backend)
+		if err != nil {
+			return nil, err
+		}
+
+		return &httpStorage{base: u, client: http.DefaultClient}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, expected filesystem or an http or https URL", backend)
+	}
+}
+
+// storage returns the storage configured by OLLAMA_STORAGE_BACKEND. Servers
+// refuse to start with an invalid backend, so it's never used.
+func storage() Storage {
+	s, err := newStorage(envconfig.StorageBackend())
+	if err != nil {
+		return fileStorage{}
+	}
+
+	return s
+}
+
+// writableStorage rejects requests that change models when storage is
+// read-only
+func writableStorage(c *gin.Context) {
+	if storage().ReadOnly() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errReadOnlyStorage.Error()})
+	}
+}
+
+// fileStorage stores models in the models directory
+type fileStorage struct{}
+
+func (fileStorage) ReadOnly() bool {
+	return false
+}
+
+func (fileStorage) manifestPath(n model.Name) (string, error) {
+	if !n.IsFullyQualified() {
+		return "", model.Unqualified(n)
+	}
+
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(manifests, n.Filepath()), nil
+}
+
+func (s fileStorage) OpenManifest(n model.Name) (fs.File, error) {
+	p, err := s.manifestPath(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+func (s fileStorage) WriteManifest(n model.Name, b []byte) error {
+	p, err := s.manifestPath(n)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	return writeManifestFile(p, b)
+}
+
+func (s fileStorage) DeleteManifest(n model.Name) error {
+	p, err := s.manifestPath(n)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	modelsVersion.Add(1)
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	return PruneDirectory(manifests)
+}
+
+func (fileStorage) ListManifests() ([]model.Name, error) {
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO(mxyng): use something less brittle
+	matches, err := filepath.Glob(filepath.Join(manifests, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []model.Name
+	for _, match := range matches {
+		fi, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.IsDir() {
+			continue
+		}
+
+		rel, err := filepath.Rel(manifests, match)
+		if err != nil {
+			slog.Warn("bad filepath", "path", match, "error", err)
+			continue
+		}
+
+		n := model.ParseNameFromFilepath(rel)
+		if !n.IsValid() {
+			slog.Warn("bad manifest name", "path", rel)
+			continue
+		}
+
+		names = append(names, n)
+	}
+
+	return names, nil
+}
+
+func (fileStorage) StatBlob(digest string) (fs.FileInfo, error) {
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(p)
+}
+
+func (fileStorage) OpenBlob(digest string) (io.ReadSeekCloser, error) {
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+func (fileStorage) WriteBlob(digest, src string) error {
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, p); err != nil {
+		return err
+	}
+
+	modelsVersion.Add(1)
+	return os.Chmod(p, 0o644)
+}
+
+func (fileStorage) DeleteBlob(digest string) error {
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	modelsVersion.Add(1)
+	return nil
+}
+
+func (fileStorage) BlobPath(_ context.Context, digest string) (string, error) {
+	return GetBlobsPath(digest)
+}
+
+// httpStorage reads models from an HTTP server with the layout of a models
+// directory, such as an object store bucket, and caches their blobs in the
+// local blobs directory. Since HTTP servers can't list directories, the
+// names of the models are listed in manifests/index, one per line in the
+// form of their manifest paths, e.g. registry.ollama.ai/library/gemma2/2b.
+type httpStorage struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func (*httpStorage) ReadOnly() bool {
+	return true
+}
+
+// request requests the file at p, relative to the base URL. Files that don't
+// exist are returned as errors wrapping fs.ErrNotExist.
+func (s *httpStorage) request(ctx context.Context, method string, p ...string) (*http.Response, error) {
+	u := s.base.JoinPath(p...)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &fs.PathError{Op: "open", Path: u.String(), Err: fs.ErrNotExist}
+	case resp.StatusCode >= http.StatusBadRequest:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+
+	return resp, nil
+}
+
+func (s *httpStorage) OpenManifest(n model.Name) (fs.File, error) {
+	if !n.IsFullyQualified() {
+		return nil, model.Unqualified(n)
+	}
+
+	p := path.Join("manifests", filepath.ToSlash(n.Filepath()))
+	resp, err := s.request(context.Background(), http.MethodGet, p)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	info := httpFileInfo{name: path.Base(p), size: int64(len(b)), modTime: lastModified(resp)}
+	return &httpFile{Reader: bytes.NewReader(b), name: s.base.JoinPath(p).String(), info: info}, nil
+}
+
+func (*httpStorage) WriteManifest(model.Name, []byte) error {
+	return errReadOnlyStorage
+}
+
+func (*httpStorage) DeleteManifest(model.Name) error {
+	return errReadOnlyStorage
+}
+
+func (s *httpStorage) ListManifests() ([]model.Name, error) {
+	resp, err := s.request(context.Background(), http.MethodGet, "manifests", "index")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var names []model.Name
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		n := model.ParseNameFromFilepath(filepath.FromSlash(line))
+		if !n.IsValid() {
+			slog.Warn("bad manifest name", "path", line)
+			continue
+		}
+
+		names = append(names, n)
+	}
+
+	return names, scanner.Err()
+}
+
+func (s *httpStorage) StatBlob(digest string) (fs.FileInfo, error) {
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi, err := os.Stat(p); err == nil {
+		return fi, nil
+	}
+
+	resp, err := s.request(context.Background(), http.MethodHead, "blobs", filepath.Base(p))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return httpFileInfo{name: filepath.Base(p), size: resp.ContentLength, modTime: lastModified(resp)}, nil
+}
+
+func (s *httpStorage) OpenBlob(digest string) (io.ReadSeekCloser, error) {
+	p, err := s.BlobPath(context.Background(), digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+func (*httpStorage) WriteBlob(string, string) error {
+	return errReadOnlyStorage
+}
+
+func (*httpStorage) DeleteBlob(string) error {
+	return errReadOnlyStorage
+}
+
+// BlobPath returns the path of the blob in the local blobs directory,
+// downloading it first if it isn't cached there. Downloads are checked
+// against digest.
+func (s *httpStorage) BlobPath(ctx context.Context, digest string) (string, error) {
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+
+	resp, err := s.request(ctx, http.MethodGet, "blobs", filepath.Base(p))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".fetch-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sha256sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, sha256sum), resp.Body); err != nil {
+		return "", err
+	}
+
+	if got := fmt.Sprintf("sha256:%x", sha256sum.Sum(nil)); got != digest {
+		return "", fmt.Errorf("%w: want %s, got %s", errDigestMismatch, digest, got)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		return "", err
+	}
+
+	slog.Debug("cached blob", "digest", digest, "path", p)
+	return p, os.Chmod(p, 0o644)
+}
+
+func lastModified(resp *http.Response) time.Time {
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Now()
+	}
+
+	return t
+}
+
+// httpFile is a file read from an httpStorage
+type httpFile struct {
+	*bytes.Reader
+	name string
+	info httpFileInfo
+}
+
+// Name returns the URL of the file
+func (f *httpFile) Name() string {
+	return f.name
+}
+
+func (f *httpFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (*httpFile) Close() error {
+	return nil
+}
+
+type httpFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi httpFileInfo) Name() string       { return fi.name }
+func (fi httpFileInfo) Size() int64        { return fi.size }
+func (fi httpFileInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi httpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi httpFileInfo) IsDir() bool        { return false }
+func (fi httpFileInfo) Sys() any           { return nil }
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// writeStore writes a models directory to dir with a manifest for name and
+// a blob, indexed for httpStorage, and returns the manifest and the blob's
+// digest
+func writeStore(t *testing.T, dir string, name model.Name, blob []byte) ([]byte, string) {
+	t.Helper()
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"layers":[{"digest":%q,"size":%d}]}`, digest, len(blob)))
+
+	p := filepath.Join(dir, "manifests", name.Filepath())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, manifest, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "manifests", "index"), []byte(filepath.ToSlash(name.Filepath())+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "blobs", "sha256-"+digest[7:]), blob, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return manifest, digest
+}
+
+// serveStore serves dir as an httpStorage, caching blobs in a new models
+// directory
+func serveStore(t *testing.T, dir string) *httpStorage {
+	t.Helper()
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(srv.Close)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &httpStorage{base: u, client: srv.Client()}
+}
+
+func TestStorage(t *testing.T) {
+	name := model.ParseName("test")
+	blob := []byte("hello")
+
+	backends := map[string]func(t *testing.T, dir string) Storage{
+		"filesystem": func(t *testing.T, dir string) Storage {
+			t.Setenv("OLLAMA_MODELS", dir)
+			return fileStorage{}
+		},
+		"http": func(t *testing.T, dir string) Storage {
+			return serveStore(t, dir)
+		},
+	}
+
+	for backend, open := range backends {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			manifest, digest := writeStore(t, dir, name, blob)
+			st := open(t, dir)
+
+			names, err := st.ListManifests()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Contains(names, name) {
+				t.Errorf("expected %s to be listed, got %v", name, names)
+			}
+
+			f, err := st.OpenManifest(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			if b, err := io.ReadAll(f); err != nil || !bytes.Equal(b, manifest) {
+				t.Errorf("unexpected manifest %q, %v", b, err)
+			}
+
+			if fi, err := f.Stat(); err != nil || fi.Size() != int64(len(manifest)) {
+				t.Errorf("unexpected manifest info %v, %v", fi, err)
+			}
+
+			if _, err := st.OpenManifest(model.ParseName("missing")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected a missing manifest to not exist, got %v", err)
+			}
+
+			if fi, err := st.StatBlob(digest); err != nil || fi.Size() != int64(len(blob)) {
+				t.Errorf("unexpected blob info %v, %v", fi, err)
+			}
+
+			missing := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))
+			if _, err := st.StatBlob(missing); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected a missing blob to not exist, got %v", err)
+			}
+
+			r, err := st.OpenBlob(digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, blob) {
+				t.Errorf("unexpected blob %q, %v", b, err)
+			}
+
+			p, err := st.BlobPath(context.Background(), digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if b, err := os.ReadFile(p); err != nil || !bytes.Equal(b, blob) {
+				t.Errorf("unexpected blob file %q, %v", b, err)
+			}
+
+			other := model.ParseName("other")
+			src := filepath.Join(t.TempDir(), "blob")
+			if err := os.WriteFile(src, []byte("missing"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if st.ReadOnly() {
+				for _, err := range []error{
+					st.WriteManifest(other, manifest),
+					st.DeleteManifest(name),
+					st.WriteBlob(missing, src),
+					st.DeleteBlob(digest),
+				} {
+					if !errors.Is(err, errReadOnlyStorage) {
+						t.Errorf("expected changes to be rejected, got %v", err)
+					}
+				}
+				return
+			}
+
+			if err := st.WriteManifest(other, manifest); err != nil {
+				t.Fatal(err)
+			}
+
+			if names, err := st.ListManifests(); err != nil || !slices.Contains(names, other) {
+				t.Errorf("expected %s to be listed, got %v, %v", other, names, err)
+			}
+
+			if err := st.DeleteManifest(other); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := st.OpenManifest(other); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected a deleted manifest to not exist, got %v", err)
+			}
+
+			if err := st.WriteBlob(missing, src); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := st.StatBlob(missing); err != nil {
+				t.Errorf("expected a written blob to exist, got %v", err)
+			}
+
+			if err := st.DeleteBlob(missing); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := st.StatBlob(missing); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected a deleted blob to not exist, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPStorageDigestMismatch(t *testing.T) {
+	dir := t.TempDir()
+	_, digest := writeStore(t, dir, model.ParseName("test"), []byte("hello"))
+	if err := os.WriteFile(filepath.Join(dir, "blobs", "sha256-"+digest[7:]), []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	st := serveStore(t, dir)
+	if _, err := st.BlobPath(context.Background(), digest); !errors.Is(err, errDigestMismatch) {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(p); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the blob not to be cached, got %v", err)
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	for _, backend := range []string{"", "filesystem", "http://localhost:8080/models", "https://bucket.example.com"} {
+		if _, err := newStorage(backend); err != nil {
+			t.Errorf("newStorage(%q) = %v", backend, err)
+		}
+	}
+
+	if _, err := newStorage("s3://bucket"); err == nil {
+		t.Error("expected an unknown backend to be rejected")
+	}
+}
+
+func TestHTTPStorageModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+	store := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", store)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nSYSTEM You are a test.", createBinFile(t, llm.KV{
+			"general.architecture": "llama",
+		}, nil)),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if err := os.WriteFile(filepath.Join(store, "manifests", "index"), []byte("registry.ollama.ai/library/test/latest\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	st := serveStore(t, store)
+	t.Setenv("OLLAMA_STORAGE_BACKEND", st.base.String())
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.System != "You are a test." {
+		t.Errorf("unexpected system message %q", m.System)
+	}
+
+	if _, err := os.Stat(m.ModelPath); err != nil {
+		t.Errorf("expected the model to be cached, got %v", err)
+	}
+
+	ms, err := Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms) != 1 {
+		t.Errorf("expected one model, got %d", len(ms))
+	}
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Name: "test"})
+	if w.Code == http.StatusOK {
+		t.Error("expected deleting from read-only storage to fail")
+	}
+
+	if _, err := GetModel("test"); err != nil {
+		t.Errorf("expected the model to remain, got %v", err)
+	}
+}
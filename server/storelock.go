@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Servers sharing a models directory, such as one on NFS, coordinate the
+// changes they make to it with lock files in its locks directory, as storeMu
+// does for the goroutines of a single server. A lock file is held by a whole
+// server, so its goroutines share it rather than waiting for each other.
+//
+// Lock files are created exclusively, which network filesystems support
+// where they may not support flock, and their holders touch them to show
+// they're still alive. A lock that isn't touched for OLLAMA_LOCK_TIMEOUT was
+// left by a server that died and is reclaimed by the next server to take it.
+// This assumes the servers' clocks agree to well within the timeout.
+//
+// Reading the store never takes a lock, so loading and running models isn't
+// slowed by servers changing it.
+
+// storeLockName is the lock held while manifests are written or removed and
+// while blobs are removed
+const storeLockName = "store"
+
+// lockPollInterval is how often a server waiting for a lock checks it again
+var lockPollInterval = 250 * time.Millisecond
+
+// lockOwner is the content of a lock file, identifying the server holding it
+type lockOwner struct {
+	Host  string `json:"host"`
+	PID   int    `json:"pid"`
+	Token string `json:"token"`
+}
+
+type fileLock struct {
+	path  string
+	owner lockOwner
+	refs  int
+	stop  chan struct{}
+}
+
+var (
+	heldLocksMu sync.Mutex
+	// heldLocks are the locks this server holds, by path
+	heldLocks = make(map[string]*fileLock)
+)
+
+func lockPath(name string) string {
+	return filepath.Join(envconfig.Models(), "locks", name+".lock")
+}
+
+// blobLockName is the name of the lock held while the blob with digest is
+// pulled and until the manifest that references it is written
+func blobLockName(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// lockStore takes the lock name, waiting while another server holds it, and
+// returns a function that releases it
+func lockStore(ctx context.Context, name string) (func(), error) {
+	p := lockPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+
+	var waiting bool
+	for {
+		l, err := tryLock(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if l != nil {
+			return func() { unlock(l) }, nil
+		}
+
+		if !waiting {
+			owner, _ := readLockOwner(p)
+			slog.Info("waiting for another server to release lock", "lock", name, "host", owner.Host, "pid", owner.PID)
+			waiting = true
+		}
+
+		if err := sleepContext(ctx, lockPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lockBlobs takes the locks of the blobs with digests, in order so servers
+// pulling models that share blobs can't deadlock
+func lockBlobs(ctx context.Context, digests []string) (func(), error) {
+	digests = slices.Clone(digests)
+	slices.Sort(digests)
+	digests = slices.Compact(digests)
+
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	for _, digest := range digests {
+		r, err := lockStore(ctx, blobLockName(digest))
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		releases = append(releases, r)
+	}
+
+	return release, nil
+}
+
+// tryLock takes the lock at p if this server holds it or no server does,
+// reclaiming it if it's stale. It returns nil if another server holds it.
+func tryLock(p string) (*fileLock, error) {
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+
+	if l, ok := heldLocks[p]; ok {
+		l.refs++
+		return l, nil
+	}
+
+	host, _ := os.Hostname()
+	l := &fileLock{path: p, owner: lockOwner{Host: host, PID: os.Getpid(), Token: lockToken()}, refs: 1, stop: make(chan struct{})}
+
+	ok, err := createLock(l)
+	if err == nil && !ok && reclaimStaleLock(p) {
+		ok, err = createLock(l)
+	}
+
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	heldLocks[p] = l
+	go l.touch()
+	return l, nil
+}
+
+// createLock creates l's lock file, returning false if it already exists
+func createLock(l *fileLock) (bool, error) {
+	b, err := json.Marshal(l.owner)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(l.path)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// reclaimStaleLock removes the lock file at p if it's stale, reporting
+// whether it did
+func reclaimStaleLock(p string) bool {
+	if !lockStale(p) {
+		return false
+	}
+
+	// The lock is moved aside before it's removed, so when servers reclaim
+	// it at the same time only one of them removes it
+	aside := p + "." + lockToken() + ".stale"
+	if err := os.Rename(p, aside); err != nil {
+		return false
+	}
+	defer os.Remove(aside)
+
+	if !lockStale(aside) {
+		// another server reclaimed the lock and took it in the meantime
+		_ = os.Link(aside, p)
+		return false
+	}
+
+	owner, _ := readLockOwner(aside)
+	slog.Warn("reclaimed stale lock", "lock", filepath.Base(p), "host", owner.Host, "pid", owner.PID)
+	return true
+}
+
+// lockStale reports whether the lock file at p hasn't been touched by its
+// holder within OLLAMA_LOCK_TIMEOUT
+func lockStale(p string) bool {
+	timeout := envconfig.LockTimeout()
+	if timeout == 0 {
+		return false
+	}
+
+	fi, err := os.Stat(p)
+	return err == nil && time.Since(fi.ModTime()) > timeout
+}
+
+// lockHeld reports whether any server, including this one, holds the lock
+// name
+func lockHeld(name string) bool {
+	p := lockPath(name)
+
+	heldLocksMu.Lock()
+	_, ok := heldLocks[p]
+	heldLocksMu.Unlock()
+	if ok {
+		return true
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		return false
+	}
+
+	return !lockStale(p)
+}
+
+// touch updates the lock file's modification time until the lock is
+// released, so other servers don't take it for stale
+func (l *fileLock) touch() {
+	timeout := envconfig.LockTimeout()
+	if timeout == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if owner, err := readLockOwner(l.path); err != nil || owner.Token != l.owner.Token {
+				slog.Warn("lock was reclaimed by another server", "lock", filepath.Base(l.path))
+				return
+			}
+
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				slog.Warn("couldn't touch lock", "lock", filepath.Base(l.path), "error", err)
+			}
+		}
+	}
+}
+
+func unlock(l *fileLock) {
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+
+	if l.refs--; l.refs > 0 {
+		return
+	}
+
+	delete(heldLocks, l.path)
+	close(l.stop)
+
+	// a lock reclaimed by another server is theirs to remove
+	if owner, err := readLockOwner(l.path); err == nil && owner.Token == l.owner.Token {
+		os.Remove(l.path)
+	}
+}
+
+func readLockOwner(p string) (lockOwner, error) {
+	var owner lockOwner
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return owner, err
+	}
+
+	return owner, json.Unmarshal(b, &owner)
+}
+
+func lockToken() string {
+	b := make([]byte, 8)
+	rand.Read(b) //nolint:errcheck
+	return hex.EncodeToString(b)
+}
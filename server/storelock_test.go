@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// writeForeignLock writes the lock name as if another server held it,
+// last touched at modTime
+func writeForeignLock(t *testing.T, name string, modTime time.Time) string {
+	t.Helper()
+
+	p := lockPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(lockOwner{Host: "other", PID: 1, Token: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestLockStore(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	unlock, err := lockStore(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's other goroutines share its lock
+	unlock2, err := lockStore(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !lockHeld("test") {
+		t.Error("expected the lock to be held")
+	}
+
+	unlock()
+	if _, err := os.Stat(lockPath("test")); err != nil {
+		t.Errorf("expected the lock to be held until it's released by all its holders, got %v", err)
+	}
+
+	unlock2()
+	if _, err := os.Stat(lockPath("test")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the lock to be removed, got %v", err)
+	}
+
+	if lockHeld("test") {
+		t.Error("expected the lock to be released")
+	}
+}
+
+func TestLockStoreOtherServer(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_LOCK_TIMEOUT", "1m")
+
+	p := writeForeignLock(t, "test", time.Now())
+	if !lockHeld("test") {
+		t.Error("expected a lock held by another server to be held")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := lockStore(ctx, "test"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait for the other server, got %v", err)
+	}
+
+	// the other server stops touching its lock
+	stale := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(p, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if lockHeld("test") {
+		t.Error("expected a stale lock not to be held")
+	}
+
+	unlock, err := lockStore(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if owner, err := readLockOwner(p); err != nil || owner.Token == "other" {
+		t.Errorf("expected the stale lock to be reclaimed, got %+v %v", owner, err)
+	}
+
+	if matches, _ := filepath.Glob(p + ".*"); len(matches) > 0 {
+		t.Errorf("expected the stale lock to be removed, found %v", matches)
+	}
+
+	unlock()
+}
+
+func TestLockStoreTouch(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_LOCK_TIMEOUT", "200ms")
+
+	unlock, err := lockStore(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	time.Sleep(500 * time.Millisecond)
+	if lockStale(lockPath("test")) {
+		t.Error("expected a held lock to be kept fresh")
+	}
+}
+
+func TestPullResumesAfterStaleLock(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_LOCK_TIMEOUT", "1m")
+
+	content := make([]byte, 64*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+
+	ranges := make(chan string, 1)
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/manifests/latest"):
+			json.NewEncoder(w).Encode(Manifest{
+				SchemaVersion: 2,
+				MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+				Layers:        []Layer{{MediaType: "application/vnd.ollama.image.model", Digest: digest, Size: int64(len(content))}},
+			})
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+digest):
+			u, err := url.Parse(registry.URL)
+			if err != nil {
+				t.Error(err)
+			}
+
+			u.Host = "localhost:" + u.Port()
+			http.Redirect(w, r, u.JoinPath("direct", digest).String(), http.StatusTemporaryRedirect)
+		case r.Method == http.MethodGet && r.URL.Path == "/direct/"+digest:
+			ranges <- r.Header.Get("Range")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := u.Host + "/library/test:latest"
+
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another server pulled half of the blob
+	b := &blobDownload{Name: fp, Digest: digest}
+	if err := b.newPart(0, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	half := int64(len(content) / 2)
+	b.Parts[0].Completed.Store(half)
+	if err := b.writePart(b.Parts[0].Name(), b.Parts[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp+"-partial", content[:half], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock := writeForeignLock(t, blobLockName(digest), time.Now())
+
+	t.Run("held", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		if err := PullModel(ctx, name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the pull to wait for the other server, got %v", err)
+		}
+
+		if err := PruneLayers(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(fp + "-partial"); err != nil {
+			t.Errorf("expected the other server's partial download to be kept, got %v", err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		stale := time.Now().Add(-2 * time.Minute)
+		if err := os.Chtimes(lock, stale, stale); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := PullModel(context.Background(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); err != nil {
+			t.Fatal(err)
+		}
+
+		if r := <-ranges; r != fmt.Sprintf("bytes=%d-%d", half, len(content)-1) {
+			t.Errorf("expected the download to resume from %d, got %q", half, r)
+		}
+
+		if got, err := os.ReadFile(fp); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("expected the blob to be pulled, got %v", err)
+		}
+
+		if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(lock), "*")); len(matches) > 0 {
+			t.Errorf("expected the locks to be released, found %v", matches)
+		}
+	})
+}
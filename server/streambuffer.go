@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/ollama/ollama/format"
+)
+
+// streamRequestBufferSize is the most memory the responses of a single
+// stream are buffered in while they wait to be written to the client
+const streamRequestBufferSize = 8 * format.MebiByte
+
+// streamBuffers buffers streamed responses between runners and clients that
+// read them slower than they're generated, so a slow client doesn't hold a
+// runner's parallel slot for longer than the generation takes. The buffers of
+// all streams together take at most size bytes; once they're full, streams
+// wait on their clients as if they weren't buffered.
+type streamBuffers struct {
+	size uint64
+
+	mu      sync.Mutex
+	used    uint64
+	aborted map[string]uint64 // model -> streams aborted for slow clients
+}
+
+// newStreamBuffers returns buffers of size bytes, or nil if size is zero,
+// which disables buffering
+func newStreamBuffers(size uint64) *streamBuffers {
+	if size == 0 {
+		return nil
+	}
+
+	return &streamBuffers{size: size, aborted: make(map[string]uint64)}
+}
+
+// reserve takes n bytes of the buffers, reporting false if they're already
+// full. held is the bytes the stream already holds, and n is always taken
+// for a stream that holds none, so every stream can make progress.
+func (b *streamBuffers) reserve(held, n uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if held > 0 && (held+n > streamRequestBufferSize || b.used+n > b.size) {
+		return false
+	}
+
+	b.used += n
+	return true
+}
+
+func (b *streamBuffers) release(n uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// buffer relays the values of ch to the returned channel as JSON, reading ch
+// as fast as it's written while the buffers have room. Once ctx is done the
+// values left are dropped and ch is drained, so its writer never blocks.
+func (b *streamBuffers) buffer(ctx context.Context, ch chan any) chan any {
+	if b == nil {
+		return ch
+	}
+
+	out := make(chan any)
+	go func() {
+		defer close(out)
+
+		var queue []json.RawMessage
+		var held uint64
+		defer func() { b.release(held) }()
+
+		// next is a value read from ch that didn't fit in the buffers
+		var next json.RawMessage
+		in := ch
+		for in != nil || next != nil || len(queue) > 0 {
+			if next != nil && b.reserve(held, uint64(len(next))) {
+				queue = append(queue, next)
+				held += uint64(len(next))
+				next = nil
+			}
+
+			recv := in
+			if next != nil {
+				recv = nil
+			}
+
+			var send chan any
+			var head any
+			if len(queue) > 0 {
+				send, head = out, queue[0]
+			}
+
+			select {
+			case <-ctx.Done():
+				if in != nil {
+					for range in {
+					}
+				}
+				return
+			case val, ok := <-recv:
+				if !ok {
+					in = nil
+					continue
+				}
+
+				bts, err := json.Marshal(val)
+				if err != nil {
+					slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
+					continue
+				}
+
+				next = bts
+			case send <- head:
+				held -= uint64(len(queue[0]))
+				b.release(uint64(len(queue[0])))
+				queue = queue[1:]
+			}
+		}
+	}()
+
+	return out
+}
+
+// abort counts a stream of model aborted because its client stopped reading,
+// if err is the failed write of one
+func (b *streamBuffers) abort(model string, err error) {
+	if b == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return
+	}
+
+	slog.Info("aborted stream to a client that stopped reading", "model", model)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.aborted[model]++
+}
+
+// abortedStreams returns the number of streams of each model aborted for slow
+// clients
+func (b *streamBuffers) abortedStreams() map[string]uint64 {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	aborted := make(map[string]uint64, len(b.aborted))
+	for model, n := range b.aborted {
+		aborted[model] = n
+	}
+
+	return aborted
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStreamBuffer(t *testing.T) {
+	b := newStreamBuffers(1024)
+
+	ch := make(chan any)
+	out := b.buffer(context.Background(), ch)
+
+	// the writer isn't held back by a reader that hasn't started reading
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(ch)
+		for i := range 3 {
+			ch <- map[string]int{"i": i}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the values to be buffered")
+	}
+
+	var got []string
+	for val := range out {
+		got = append(got, string(val.(json.RawMessage)))
+	}
+
+	if fmt.Sprint(got) != `[{"i":0} {"i":1} {"i":2}]` {
+		t.Errorf("expected the values in order, got %v", got)
+	}
+
+	if b.used != 0 {
+		t.Errorf("expected the buffers to be released, got %d bytes used", b.used)
+	}
+}
+
+func TestStreamBufferFull(t *testing.T) {
+	b := newStreamBuffers(20)
+
+	ch := make(chan any)
+	out := b.buffer(context.Background(), ch)
+
+	// {"i":0} is 7 bytes, so only two values fit
+	for i := range 3 {
+		select {
+		case ch <- map[string]int{"i": i}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected value %d to be buffered", i)
+		}
+	}
+
+	select {
+	case ch <- map[string]int{"i": 3}:
+		t.Fatal("expected a full buffer to wait for the reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	<-out
+	select {
+	case ch <- map[string]int{"i": 3}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected reading to make room")
+	}
+
+	close(ch)
+	for range out {
+	}
+}
+
+func TestStreamBufferCancel(t *testing.T) {
+	b := newStreamBuffers(1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan any)
+	out := b.buffer(ctx, ch)
+
+	ch <- "buffered"
+	cancel()
+
+	// the writer is never blocked once the reader is gone
+	for i := range 100 {
+		select {
+		case ch <- i:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected values to be drained")
+		}
+	}
+	close(ch)
+
+	for range out {
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used != 0 {
+		t.Errorf("expected the buffers to be released, got %d bytes used", b.used)
+	}
+}
+
+func TestStreamBufferAbort(t *testing.T) {
+	b := newStreamBuffers(1024)
+	b.abort("model", errors.New("broken pipe"))
+	b.abort("model", fmt.Errorf("write: %w", os.ErrDeadlineExceeded))
+	b.abort("model", nil)
+
+	if aborted := b.abortedStreams(); aborted["model"] != 1 {
+		t.Errorf("expected 1 aborted stream, got %v", aborted)
+	}
+
+	var disabled *streamBuffers
+	ch := make(chan any)
+	if disabled.buffer(context.Background(), ch) != ch {
+		t.Error("expected disabled buffers to pass the stream through")
+	}
+}
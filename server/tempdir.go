@@ -0,0 +1,192 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Operations that write large temporary files, such as converting or
+// quantizing a model, each get their own directory in OLLAMA_TMPDIR with a
+// marker file identifying the server that made it. The server touches the
+// marker while the operation runs and removes the directory when it ends,
+// whether or not it succeeded.
+//
+// Directories left by servers that died are removed when a server starts if
+// their marker hasn't been touched for tempOrphanAge and, for those made on
+// the same host, their server is gone. Servers on other hosts sharing
+// OLLAMA_TMPDIR are only judged by their markers, so they must touch them
+// on time, which assumes their clocks agree to well within tempOrphanAge.
+
+const (
+	tempDirPrefix = "ollama-op-"
+	tempMarker    = "ollama-op.json"
+)
+
+// tempOrphanAge is how long a temporary directory's marker goes untouched
+// before the directory is taken to be left by a server that died
+var tempOrphanAge = 10 * time.Minute
+
+// tempOwner is the content of a temporary directory's marker
+type tempOwner struct {
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Operation string    `json:"operation"`
+	Started   time.Time `json:"started"`
+}
+
+type tempDir struct {
+	path string
+	stop chan struct{}
+	once sync.Once
+}
+
+func tempBase() string {
+	return cmp.Or(envconfig.TmpDir(), os.TempDir())
+}
+
+// newTempDir creates a temporary directory for operation, which is removed
+// with Remove
+func newTempDir(operation string) (*tempDir, error) {
+	p, err := os.MkdirTemp(tempBase(), tempDirPrefix+operation+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	b, err := json.Marshal(tempOwner{Host: host, PID: os.Getpid(), Operation: operation, Started: time.Now().UTC()})
+	if err != nil {
+		os.RemoveAll(p)
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(p, tempMarker), b, 0o644); err != nil {
+		os.RemoveAll(p)
+		return nil, err
+	}
+
+	d := &tempDir{path: p, stop: make(chan struct{})}
+	go d.touch()
+	return d, nil
+}
+
+// Path returns the path of name in the directory
+func (d *tempDir) Path(name string) string {
+	return filepath.Join(d.path, name)
+}
+
+// Remove removes the directory and everything in it
+func (d *tempDir) Remove() {
+	d.once.Do(func() {
+		close(d.stop)
+		if err := os.RemoveAll(d.path); err != nil {
+			slog.Warn("couldn't remove temporary directory", "path", d.path, "error", err)
+		}
+	})
+}
+
+// touch updates the marker's modification time until the directory is
+// removed, so other servers don't take it for orphaned
+func (d *tempDir) touch() {
+	ticker := time.NewTicker(tempOrphanAge / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(filepath.Join(d.path, tempMarker), now, now); err != nil {
+				slog.Warn("couldn't touch temporary directory", "path", d.path, "error", err)
+			}
+		}
+	}
+}
+
+// sweepTempDirs removes the temporary directories of operations that didn't
+// finish because their server died, returning how many it removed and the
+// bytes reclaimed
+func sweepTempDirs() (int, int64, error) {
+	markers, err := filepath.Glob(filepath.Join(tempBase(), tempDirPrefix+"*", tempMarker))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	host, _ := os.Hostname()
+
+	var n int
+	var reclaimed int64
+	for _, marker := range markers {
+		if !tempOrphaned(marker, host) {
+			continue
+		}
+
+		// The directory is moved aside before it's removed, so when servers
+		// sweep at the same time only one of them removes it
+		p := filepath.Dir(marker)
+		aside := filepath.Join(filepath.Dir(p), ".removing-"+filepath.Base(p))
+		if err := os.Rename(p, aside); err != nil {
+			continue
+		}
+
+		size := dirSize(aside)
+		if err := os.RemoveAll(aside); err != nil {
+			slog.Warn("couldn't remove orphaned temporary directory", "path", p, "error", err)
+			continue
+		}
+
+		slog.Debug("removed orphaned temporary directory", "path", p)
+		n++
+		reclaimed += size
+	}
+
+	return n, reclaimed, nil
+}
+
+// tempOrphaned reports whether the temporary directory with marker was left
+// by a server that died
+func tempOrphaned(marker, host string) bool {
+	fi, err := os.Stat(marker)
+	if err != nil || time.Since(fi.ModTime()) < tempOrphanAge {
+		return false
+	}
+
+	var owner tempOwner
+	if b, err := os.ReadFile(marker); err != nil {
+		return false
+	} else if err := json.Unmarshal(b, &owner); err != nil {
+		// a marker that can't be read is as good as none
+		return true
+	}
+
+	return owner.Host != host || !processRunning(owner.PID)
+}
+
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	return err == nil && !errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// dirSize returns the total size of the files in the directory at p
+func dirSize(p string) int64 {
+	var size int64
+	filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error { //nolint:errcheck
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
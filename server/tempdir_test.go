@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTempDir(t *testing.T) {
+	t.Setenv("OLLAMA_TMPDIR", t.TempDir())
+
+	td, err := newTempDir("quantize")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(td.path) != tempBase() {
+		t.Errorf("expected a directory in OLLAMA_TMPDIR, got %s", td.path)
+	}
+
+	var owner tempOwner
+	if b, err := os.ReadFile(td.Path(tempMarker)); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(b, &owner); err != nil {
+		t.Fatal(err)
+	} else if owner.PID != os.Getpid() || owner.Operation != "quantize" {
+		t.Errorf("unexpected owner %+v", owner)
+	}
+
+	td.Remove()
+	td.Remove()
+	if _, err := os.Stat(td.path); !os.IsNotExist(err) {
+		t.Errorf("expected the directory to be removed, got %v", err)
+	}
+}
+
+func TestSweepTempDirs(t *testing.T) {
+	base := t.TempDir()
+	t.Setenv("OLLAMA_TMPDIR", base)
+
+	// the pid of a process that has exited
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := cmd.Process.Pid
+
+	host, _ := os.Hostname()
+	old := time.Now().Add(-2 * tempOrphanAge)
+
+	cases := []struct {
+		name    string
+		owner   tempOwner
+		touched time.Time
+		removed bool
+	}{
+		{"dead", tempOwner{Host: host, PID: dead}, old, true},
+		{"dead recently", tempOwner{Host: host, PID: dead}, time.Now(), false},
+		{"running", tempOwner{Host: host, PID: os.Getpid()}, old, false},
+		{"other host", tempOwner{Host: host + "-other", PID: os.Getpid()}, old, true},
+		{"other host touched", tempOwner{Host: host + "-other", PID: dead}, time.Now(), false},
+	}
+
+	dirs := make([]string, len(cases))
+	for i, tt := range cases {
+		p, err := os.MkdirTemp(base, tempDirPrefix+"test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs[i] = p
+
+		b, err := json.Marshal(tt.owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(p, tempMarker), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(p, "model.gguf"), make([]byte, 1000), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(filepath.Join(p, tempMarker), tt.touched, tt.touched); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// directories of other programs are left alone
+	other := filepath.Join(base, "ollama-other")
+	if err := os.Mkdir(other, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	n, reclaimed, err := sweepTempDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 || reclaimed < 2000 {
+		t.Errorf("expected 2 directories and at least 2000 bytes to be removed, got %d and %d", n, reclaimed)
+	}
+
+	for i, tt := range cases {
+		_, err := os.Stat(dirs[i])
+		if removed := os.IsNotExist(err); removed != tt.removed {
+			t.Errorf("%s: expected removed %v, got %v", tt.name, tt.removed, removed)
+		}
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Error(err)
+	}
+}
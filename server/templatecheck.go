@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+// specialTokenLiteral matches text in a prompt that's meant to be a special
+// token, such as <|start_header_id|>, [INST] or <start_of_turn>
+var specialTokenLiteral = regexp.MustCompile(`<\|[^|<>\s]+\|>|<｜[^｜<>\s]+｜>|\[/?[A-Z][A-Z_]*\]|</?(?:s|bos|eos|start_of_turn|end_of_turn)>`)
+
+// templateCheckValues are rendered with a template to find the special tokens
+// it uses, with and without tools so both branches of templates that
+// support them are checked
+var templateCheckValues = func() []template.Values {
+	messages := []api.Message{
+		{Role: "system", Content: "hello"},
+		{Role: "user", Content: "hello"},
+		{Role: "assistant", Content: "hello"},
+		{Role: "user", Content: "hello"},
+	}
+
+	call := api.ToolCall{ID: "call", Function: api.ToolCallFunction{Name: "hello", Arguments: api.ToolCallFunctionArguments{"hello": "hello"}}}
+	toolMessages := append(slices.Clone(messages),
+		api.Message{Role: "assistant", ToolCalls: []api.ToolCall{call}},
+		api.Message{Role: "tool", Content: "hello", ToolCallID: call.ID},
+	)
+
+	var tool api.Tool
+	tool.Type = "function"
+	tool.Function.Name = "hello"
+	tool.Function.Description = "hello"
+	tool.Function.Parameters.Type = "object"
+
+	return []template.Values{
+		{Messages: messages},
+		{Messages: toolMessages, Tools: api.Tools{tool}},
+	}
+}()
+
+// unknownSpecialTokens returns the special tokens used by tmpl that kv's
+// vocabulary doesn't have, which the model sees as plain text. Rather than
+// looking for tokens in the template's source, the template is rendered and
+// the result split on the vocabulary's special tokens, as the tokenizer
+// does, so tokens built from smaller pieces are found and tokens in unused
+// branches aren't.
+func unknownSpecialTokens(tmpl *template.Template, kv llm.KV) []string {
+	special := kv.SpecialTokens()
+	if len(special) == 0 {
+		// the vocabulary wasn't decoded, or the model has no tokenizer
+		return nil
+	}
+
+	// longer tokens are matched first, as they are when tokenizing
+	slices.SortFunc(special, func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+
+	var unknown []string
+	for _, values := range templateCheckValues {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, values); err != nil {
+			continue
+		}
+
+		for _, text := range splitSpecialTokens(b.String(), special) {
+			for _, literal := range specialTokenLiteral.FindAllString(text, -1) {
+				// [INST] and its like are plain text in SentencePiece
+				// vocabularies of models trained on them as text, such as
+				// llama2 and the first mistral models
+				if strings.HasPrefix(literal, "[") && kv.TokenizerModel() == "llama" {
+					continue
+				}
+
+				if !slices.Contains(unknown, literal) {
+					unknown = append(unknown, literal)
+				}
+			}
+		}
+	}
+
+	return unknown
+}
+
+// splitSpecialTokens returns the text between the special tokens in s
+func splitSpecialTokens(s string, special []string) []string {
+	var texts []string
+	var start int
+	for i := 0; i < len(s); {
+		j := slices.IndexFunc(special, func(t string) bool {
+			return t != "" && strings.HasPrefix(s[i:], t)
+		})
+		if j < 0 {
+			i++
+			continue
+		}
+
+		texts = append(texts, s[start:i])
+		i += len(special[j])
+		start = i
+	}
+
+	return append(texts, s[start:])
+}
+
+// templateUnknownTokens returns the special tokens used by the template
+// layer that aren't in the vocabulary of the model layer, if the layers
+// include both
+func templateUnknownTokens(layers []Layer) ([]string, error) {
+	var modelLayer, templateLayer *Layer
+	for i, layer := range layers {
+		switch layer.MediaType {
+		case "application/vnd.ollama.image.model":
+			modelLayer = &layers[i]
+		case "application/vnd.ollama.image.template":
+			templateLayer = &layers[i]
+		}
+	}
+
+	if modelLayer == nil || templateLayer == nil {
+		return nil, nil
+	}
+
+	r, err := templateLayer.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	s, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.Parse(string(s))
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := GetBlobsPath(modelLayer.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return modelUnknownTokens(blob, tmpl)
+}
+
+// modelUnknownTokens returns the special tokens used by tmpl that aren't in
+// the vocabulary of the model at modelPath
+func modelUnknownTokens(modelPath string, tmpl *template.Template) ([]string, error) {
+	// the whole vocabulary is needed, not just the first of its tokens
+	ggml, err := llm.LoadModel(modelPath, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	return unknownSpecialTokens(tmpl, ggml.KV()), nil
+}
+
+// unknownTokensWarning describes the special tokens a template uses that
+// aren't in the model's vocabulary
+func unknownTokensWarning(unknown []string) string {
+	return fmt.Sprintf("template uses special tokens that aren't in the model's vocabulary: %s", strings.Join(unknown, ", "))
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+// vocabulary returns tokenizer metadata for a vocabulary with the control
+// tokens special and a few normal tokens
+func vocabulary(tokenizer string, special ...string) llm.KV {
+	tokens := []string{"hello", "[", "INST", "]", "<", "|", ">"}
+	types := make([]int32, len(tokens))
+	for i := range types {
+		types[i] = 1
+	}
+
+	for _, s := range special {
+		tokens = append(tokens, s)
+		types = append(types, 3)
+	}
+
+	return llm.KV{
+		"tokenizer.ggml.model":      tokenizer,
+		"tokenizer.ggml.tokens":     tokens,
+		"tokenizer.ggml.token_type": types,
+	}
+}
+
+const llama3Template = `{{- range .Messages }}<|start_header_id|>{{ .Role }}<|end_header_id|>
+
+{{ .Content }}<|eot_id|>
+{{- end }}<|start_header_id|>assistant<|end_header_id|>
+
+`
+
+func TestUnknownSpecialTokens(t *testing.T) {
+	llama3 := vocabulary("gpt2", "<|begin_of_text|>", "<|start_header_id|>", "<|end_header_id|>", "<|eot_id|>")
+	mistral := vocabulary("llama", "<s>", "</s>")
+
+	cases := []struct {
+		name     string
+		template string
+		kv       llm.KV
+		expect   []string
+	}{
+		{"matching", llama3Template, llama3, nil},
+		{"mismatched", llama3Template, mistral, []string{"<|start_header_id|>", "<|end_header_id|>", "<|eot_id|>"}},
+		{"pieces", `{{ range .Messages }}{{ .Content }}{{ "<|" }}eot_id{{ "|>" }}{{ end }}`, mistral, []string{"<|eot_id|>"}},
+		{"pieces matching", `{{ range .Messages }}{{ .Content }}{{ "<|" }}eot_id{{ "|>" }}{{ end }}`, llama3, nil},
+		{"text instructions", `{{ range .Messages }}[INST] {{ .Content }} [/INST]{{ end }}`, mistral, nil},
+		{"bpe instructions", `{{ range .Messages }}[INST] {{ .Content }} [/INST]{{ end }}`, llama3, []string{"[INST]", "[/INST]"}},
+		{"unused branch", `{{ if false }}<|im_start|>{{ end }}{{ range .Messages }}{{ .Content }}{{ end }}`, mistral, nil},
+		{"tools", `{{ if .Tools }}<|python_tag|>{{ end }}{{ range .Messages }}{{ .Content }}{{ end }}`, llama3, []string{"<|python_tag|>"}},
+		{"no vocabulary", llama3Template, llm.KV{}, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(unknownSpecialTokens(tmpl, tt.kv), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCreateTemplateMismatch(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	kv := vocabulary("llama", "<s>", "</s>")
+	kv["general.architecture"] = "llama"
+	bin := createBinFile(t, kv, nil)
+	modelfile := fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"%s\"\"\"", bin, llama3Template)
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{Model: "test", Modelfile: modelfile})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var statuses []string
+	for d := json.NewDecoder(w.Body); ; {
+		var resp api.ProgressResponse
+		if err := d.Decode(&resp); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, resp.Status)
+	}
+
+	warning := "warning: template uses special tokens that aren't in the model's vocabulary: <|start_header_id|>, <|end_header_id|>, <|eot_id|>"
+	if !slices.Contains(statuses, warning) || !slices.Contains(statuses, "success") {
+		t.Errorf("expected a warning and the model to be created, got %v", statuses)
+	}
+
+	for _, verbose := range []bool{false, true} {
+		w = createRequest(t, s.ShowHandler, api.ShowRequest{Model: "test", Verbose: verbose})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var show api.ShowResponse
+		if err := json.NewDecoder(w.Body).Decode(&show); err != nil {
+			t.Fatal(err)
+		}
+
+		// only verbose responses read the whole vocabulary
+		if !verbose && len(show.Warnings) > 0 {
+			t.Errorf("expected no warnings without verbose, got %v", show.Warnings)
+		} else if verbose && (len(show.Warnings) != 1 || !strings.HasSuffix(show.Warnings[0], "<|eot_id|>")) {
+			t.Errorf("expected show to warn about the template, got %v", show.Warnings)
+		}
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{Model: "strict", Modelfile: modelfile, StrictTemplate: true, Stream: &stream})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "eot_id") {
+		t.Errorf("expected status 400 listing the unknown tokens, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{Model: "strict", Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"<s>[INST] {{ .Prompt }} [/INST]\"", bin), StrictTemplate: true, Stream: &stream})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+type thinkingState int
+
+const (
+	// thinkingStart is before any output, where the opening tag may be
+	thinkingStart thinkingState = iota
+	// thinkingOpened is just after the opening tag, where whitespace is
+	// skipped
+	thinkingOpened
+	// thinkingIn is inside the thinking
+	thinkingIn
+	// thinkingClosed is just after the closing tag, where whitespace is
+	// skipped
+	thinkingClosed
+	// thinkingDone is the rest of the output, which is all content
+	thinkingDone
+)
+
+// thinkingParser splits streamed output of a reasoning model into its
+// thinking and its content. Models think first, so the opening tag is only
+// recognized at the start of the output. Text that may be the start of a tag
+// is held back until the next chunk shows whether it is one.
+type thinkingParser struct {
+	open, close string
+	state       thinkingState
+	buf         strings.Builder
+}
+
+// newThinkingParser returns a parser for output of a model with tmpl, or nil
+// if its template doesn't delimit thinking. Templates that end the prompt
+// with the opening tag start the output in the thinking.
+func newThinkingParser(tmpl *template.Template, prompt string) *thinkingParser {
+	if tmpl == nil {
+		return nil
+	}
+
+	open, close, ok := tmpl.ThinkingTags()
+	if !ok {
+		return nil
+	}
+
+	p := thinkingParser{open: open, close: close}
+	if strings.HasSuffix(strings.TrimRightFunc(prompt, unicode.IsSpace), open) {
+		p.state = thinkingOpened
+	}
+
+	return &p
+}
+
+// add parses the next chunk of output, returning the thinking and content
+// in it that can be told apart so far
+func (p *thinkingParser) add(s string) (thinking, content string) {
+	p.buf.WriteString(s)
+	s = p.buf.String()
+	p.buf.Reset()
+
+	var tb, cb strings.Builder
+	for {
+		switch p.state {
+		case thinkingStart:
+			s = strings.TrimLeftFunc(s, unicode.IsSpace)
+			switch {
+			case strings.HasPrefix(s, p.open):
+				s = s[len(p.open):]
+				p.state = thinkingOpened
+				continue
+			case strings.HasPrefix(p.open, s):
+				// empty or the start of the opening tag
+				p.buf.WriteString(s)
+			default:
+				p.state = thinkingDone
+				continue
+			}
+		case thinkingOpened, thinkingClosed:
+			s = strings.TrimLeftFunc(s, unicode.IsSpace)
+			if s != "" {
+				p.state++
+				continue
+			}
+		case thinkingIn:
+			if before, after, ok := strings.Cut(s, p.close); ok {
+				tb.WriteString(before)
+				s = after
+				p.state = thinkingClosed
+				continue
+			}
+
+			n := partialSuffix(s, p.close)
+			tb.WriteString(s[:len(s)-n])
+			p.buf.WriteString(s[len(s)-n:])
+		case thinkingDone:
+			cb.WriteString(s)
+		}
+
+		return tb.String(), cb.String()
+	}
+}
+
+// flush returns the output held back at the end of the output, which is
+// thinking if it was cut off before the closing tag
+func (p *thinkingParser) flush() (thinking, content string) {
+	s := p.buf.String()
+	p.buf.Reset()
+
+	if p.state == thinkingIn {
+		return s, ""
+	}
+
+	return "", s
+}
+
+// next parses the next chunk of output like add, also returning what's held
+// back once the output is done. Thinking is dropped if it's to be stripped.
+func (p *thinkingParser) next(s string, done bool, reasoning string) (thinking, content string) {
+	thinking, content = p.add(s)
+	if done {
+		t, c := p.flush()
+		thinking, content = thinking+t, content+c
+	}
+
+	if reasoning == api.ReasoningStrip {
+		thinking = ""
+	}
+
+	return thinking, content
+}
+
+// partialSuffix returns the length of the longest suffix of s that's the
+// start of tag
+func partialSuffix(s, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasPrefix(tag, s[len(s)-n:]) {
+			return n
+		}
+	}
+
+	return 0
+}
+
+// checkReasoning returns an error if reasoning isn't a reasoning mode
+func checkReasoning(reasoning string) error {
+	switch reasoning {
+	case "", api.ReasoningInclude, api.ReasoningSeparate, api.ReasoningStrip:
+		return nil
+	default:
+		return fmt.Errorf("invalid reasoning %q, expected one of %s, %s or %s", reasoning, api.ReasoningInclude, api.ReasoningSeparate, api.ReasoningStrip)
+	}
+}
+
+// reasoningParser returns the parser that splits the thinking from the
+// content for the reasoning mode, or nil if output is passed through as is
+func reasoningParser(reasoning string, tmpl *template.Template, prompt string) *thinkingParser {
+	if reasoning == "" || reasoning == api.ReasoningInclude {
+		return nil
+	}
+
+	return newThinkingParser(tmpl, prompt)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/template"
+)
+
+func TestThinkingParser(t *testing.T) {
+	tmpl, err := template.Parse("{{ .Prompt }}</think>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name              string
+		prompt            string
+		chunks            []string
+		thinking, content string
+	}{
+		{
+			name:     "tags",
+			chunks:   []string{"<think>", "Let me think.", "</think>", "\n\nThe answer."},
+			thinking: "Let me think.",
+			content:  "The answer.",
+		},
+		{
+			name:     "split tags",
+			chunks:   []string{" <th", "ink>\nLet me", " think.</th", "in", "k>The", " answer."},
+			thinking: "Let me think.",
+			content:  "The answer.",
+		},
+		{
+			name:     "opened by prompt",
+			prompt:   "Question <think>\n",
+			chunks:   []string{"Let me think.", "</", "think>", "The answer."},
+			thinking: "Let me think.",
+			content:  "The answer.",
+		},
+		{
+			name:    "no thinking",
+			chunks:  []string{"The ", "answer.", " <think>"},
+			content: "The answer. <think>",
+		},
+		{
+			name:    "start of a tag",
+			chunks:  []string{"<th"},
+			content: "<th",
+		},
+		{
+			name:     "cut off",
+			chunks:   []string{"<think>Let me think.</thi"},
+			thinking: "Let me think.</thi",
+		},
+		{
+			name:     "tag-like text",
+			chunks:   []string{"<think>a </b> c</th", "e end</think>done"},
+			thinking: "a </b> c</the end",
+			content:  "done",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newThinkingParser(tmpl, tt.prompt)
+			if p == nil {
+				t.Fatal("expected a parser")
+			}
+
+			var tb, cb strings.Builder
+			for i, chunk := range tt.chunks {
+				thinking, content := p.next(chunk, i == len(tt.chunks)-1, "separate")
+				tb.WriteString(thinking)
+				cb.WriteString(content)
+			}
+
+			if tb.String() != tt.thinking || cb.String() != tt.content {
+				t.Errorf("expected thinking %q and content %q, got %q and %q", tt.thinking, tt.content, tb.String(), cb.String())
+			}
+		})
+	}
+
+	if p := newThinkingParser(template.DefaultTemplate, ""); p != nil {
+		t.Error("expected no parser for a template without thinking")
+	}
+}
+
+func TestPartialSuffix(t *testing.T) {
+	cases := []struct {
+		s      string
+		expect int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"abc<", 1},
+		{"abc</thi", 5},
+		{"</think", 7},
+		{"</think>", 0},
+		{"<</", 2},
+	}
+
+	for _, tt := range cases {
+		if n := partialSuffix(tt.s, "</think>"); n != tt.expect {
+			t.Errorf("%q: expected %d, got %d", tt.s, tt.expect, n)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ollama/ollama/api"
+)
+
+// toolParsers parse the tool calls in a model's output. Templates select one
+// with a tool_parser comment, e.g. {{/* tool_parser: python */}}, so new
+// formats of tool calls only need a template. The default, "json", finds JSON
+// objects shaped like the template's own rendering of tool calls.
+var toolParsers = map[string]func(m *Model, s string) ([]api.ToolCall, bool){
+	"json":   (*Model).parseJSONToolCalls,
+	"xml":    func(_ *Model, s string) ([]api.ToolCall, bool) { return parseXMLToolCalls(s) },
+	"python": func(_ *Model, s string) ([]api.ToolCall, bool) { return parsePythonToolCalls(s) },
+}
+
+// parseToolCalls parses the tool calls in s with the parser selected by the
+// model's template
+func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+	name := m.Template.ToolParser()
+	if name == "" {
+		name = "json"
+	}
+
+	parse, ok := toolParsers[name]
+	if !ok {
+		slog.Warn("unknown tool parser", "parser", name)
+		return nil, false
+	}
+
+	return parse(m, s)
+}
+
+// assignToolCallIDs gives the calls the model didn't generate IDs for one, so
+// their results can refer to them
+func assignToolCallIDs(calls []api.ToolCall) {
+	for i := range calls {
+		if calls[i].ID == "" {
+			b := make([]byte, 6)
+			rand.Read(b) //nolint:errcheck
+			calls[i].ID = fmt.Sprintf("call_%x", b)
+		}
+	}
+}
+
+var (
+	// xmlFunction matches <function=name>{"arg": ...}</function>
+	xmlFunction = regexp.MustCompile(`(?s)<function=([^>\s]+)>(.*?)</function>`)
+	// xmlInvoke matches <invoke name="name"><parameter name="arg">...</parameter></invoke>
+	xmlInvoke    = regexp.MustCompile(`(?s)<invoke name="([^"]+)">(.*?)</invoke>`)
+	xmlParameter = regexp.MustCompile(`(?s)<parameter name="([^"]+)">(.*?)</parameter>`)
+)
+
+// parseXMLToolCalls parses tool calls written as XML-like tags, either
+// <function=name> around JSON arguments or <invoke name="name"> around a
+// <parameter name="arg"> for each argument. Parameter values are parsed as
+// JSON if they can be, and are strings otherwise.
+func parseXMLToolCalls(s string) ([]api.ToolCall, bool) {
+	type match struct {
+		start int
+		call  api.ToolCall
+	}
+
+	var matches []match
+	for _, m := range xmlFunction.FindAllStringSubmatchIndex(s, -1) {
+		var args api.ToolCallFunctionArguments
+		if err := json.Unmarshal([]byte(strings.TrimSpace(s[m[4]:m[5]])), &args); err != nil {
+			continue
+		}
+
+		matches = append(matches, match{m[0], api.ToolCall{Function: api.ToolCallFunction{Name: s[m[2]:m[3]], Arguments: args}}})
+	}
+
+	for _, m := range xmlInvoke.FindAllStringSubmatchIndex(s, -1) {
+		args := make(api.ToolCallFunctionArguments)
+		for _, p := range xmlParameter.FindAllStringSubmatch(s[m[4]:m[5]], -1) {
+			value := strings.TrimSpace(p[2])
+			var v any
+			if err := json.Unmarshal([]byte(value), &v); err != nil {
+				v = value
+			}
+			args[p[1]] = v
+		}
+
+		matches = append(matches, match{m[0], api.ToolCall{Function: api.ToolCallFunction{Name: s[m[2]:m[3]], Arguments: args}}})
+	}
+
+	slices.SortFunc(matches, func(a, b match) int { return a.start - b.start })
+
+	var calls []api.ToolCall
+	for _, m := range matches {
+		calls = append(calls, m.call)
+	}
+
+	return calls, len(calls) > 0
+}
+
+// parsePythonToolCalls parses tool calls written as a list of Python function
+// calls with keyword arguments, e.g. [get_weather(city="Paris", days=2)].
+// The output must be only the calls, so prose that mentions a function
+// isn't taken for a call.
+func parsePythonToolCalls(s string) ([]api.ToolCall, bool) {
+	p := pythonParser{s: strings.TrimSpace(s)}
+
+	bracketed := p.consume('[')
+	var calls []api.ToolCall
+	for {
+		call, err := p.call()
+		if err != nil {
+			return nil, false
+		}
+
+		calls = append(calls, call)
+		if !p.consume(',') {
+			break
+		}
+	}
+
+	if bracketed && !p.consume(']') {
+		return nil, false
+	}
+
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, false
+	}
+
+	return calls, true
+}
+
+// pythonParser parses Python function calls whose arguments are literals
+type pythonParser struct {
+	s   string
+	pos int
+}
+
+var errPythonSyntax = errors.New("invalid python tool call")
+
+func (p *pythonParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume skips c, after any spaces, if it's next
+func (p *pythonParser) consume(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *pythonParser) identifier() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := rune(p.s[p.pos])
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && (c != '.' || p.pos == start) {
+			break
+		}
+		p.pos++
+	}
+
+	return p.s[start:p.pos]
+}
+
+func (p *pythonParser) call() (api.ToolCall, error) {
+	name := p.identifier()
+	if name == "" || !p.consume('(') {
+		return api.ToolCall{}, errPythonSyntax
+	}
+
+	args := make(api.ToolCallFunctionArguments)
+	for !p.consume(')') {
+		if len(args) > 0 && !p.consume(',') {
+			return api.ToolCall{}, errPythonSyntax
+		}
+
+		// allow a trailing comma
+		if p.consume(')') {
+			break
+		}
+
+		key := p.identifier()
+		if key == "" || !p.consume('=') {
+			return api.ToolCall{}, errPythonSyntax
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return api.ToolCall{}, err
+		}
+
+		args[key] = v
+	}
+
+	return api.ToolCall{Function: api.ToolCallFunction{Name: name, Arguments: args}}, nil
+}
+
+// value parses a string, number, True, False, None, list or dict literal
+func (p *pythonParser) value() (any, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return nil, errPythonSyntax
+	}
+
+	switch c := p.s[p.pos]; {
+	case c == '"' || c == '\'':
+		return p.string()
+	case c == '[' || c == '(':
+		end := map[byte]byte{'[': ']', '(': ')'}[c]
+		p.pos++
+		list := []any{}
+		for !p.consume(end) {
+			if len(list) > 0 && !p.consume(',') {
+				return nil, errPythonSyntax
+			}
+
+			if p.consume(end) {
+				break
+			}
+
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case c == '{':
+		p.pos++
+		dict := map[string]any{}
+		for !p.consume('}') {
+			if len(dict) > 0 && !p.consume(',') {
+				return nil, errPythonSyntax
+			}
+
+			if p.consume('}') {
+				break
+			}
+
+			k, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+
+			if !p.consume(':') {
+				return nil, errPythonSyntax
+			}
+
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			dict[fmt.Sprint(k)] = v
+		}
+		return dict, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(",)]}: \t\n", rune(p.s[p.pos])) {
+		p.pos++
+	}
+
+	switch word := p.s[start:p.pos]; word {
+	case "True":
+		return true, nil
+	case "False":
+		return false, nil
+	case "None":
+		return nil, nil
+	default:
+		// numbers are float64, as they are in JSON arguments
+		if f, err := strconv.ParseFloat(word, 64); err == nil {
+			return f, nil
+		}
+
+		return nil, errPythonSyntax
+	}
+}
+
+// string parses a single or double quoted string, with Python's common
+// escapes
+func (p *pythonParser) string() (string, error) {
+	quote := p.s[p.pos]
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return sb.String(), nil
+		case c == '\\' && p.pos < len(p.s):
+			e := p.s[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			default:
+				sb.WriteByte(e)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return "", errPythonSyntax
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+func TestParseToolCallsWithParser(t *testing.T) {
+	weather := func(args api.ToolCallFunctionArguments) api.ToolCall {
+		return api.ToolCall{Function: api.ToolCallFunction{Name: "get_current_weather", Arguments: args}}
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		output   string
+		expect   []api.ToolCall
+	}{
+		{
+			name:     "xml function",
+			template: `{{/* tool_parser: xml */}}{{ range .Messages }}{{ .Content }}{{ end }}`,
+			output:   `<function=get_current_weather>{"location": "Paris, France", "format": "celsius"}</function>`,
+			expect:   []api.ToolCall{weather(api.ToolCallFunctionArguments{"location": "Paris, France", "format": "celsius"})},
+		},
+		{
+			name:     "xml invoke",
+			template: `{{/* tool_parser: xml */}}{{ range .Messages }}{{ .Content }}{{ end }}`,
+			output: `Let me check.
+<invoke name="get_current_weather">
+<parameter name="location">Toronto, Canada</parameter>
+<parameter name="days">2</parameter>
+</invoke>
+<function=get_current_weather>{"location": "Paris, France"}</function>`,
+			expect: []api.ToolCall{
+				weather(api.ToolCallFunctionArguments{"location": "Toronto, Canada", "days": 2.0}),
+				weather(api.ToolCallFunctionArguments{"location": "Paris, France"}),
+			},
+		},
+		{
+			name:     "python",
+			template: `{{/* tool_parser: python */}}{{ range .Messages }}{{ .Content }}{{ end }}`,
+			output:   `[get_current_weather(location="Paris, France", format='celsius'), get_current_weather(location="Toronto, Canada", days=2, hourly=True, fields=["wind", "rain"], units={"speed": "kph"}, note=None)]`,
+			expect: []api.ToolCall{
+				weather(api.ToolCallFunctionArguments{"location": "Paris, France", "format": "celsius"}),
+				weather(api.ToolCallFunctionArguments{"location": "Toronto, Canada", "days": 2.0, "hourly": true, "fields": []any{"wind", "rain"}, "units": map[string]any{"speed": "kph"}, "note": nil}),
+			},
+		},
+		{
+			name:     "python without brackets",
+			template: `{{/* tool_parser: python */}}{{ range .Messages }}{{ .Content }}{{ end }}`,
+			output:   ` get_current_weather(location="Paris, France") `,
+			expect:   []api.ToolCall{weather(api.ToolCallFunctionArguments{"location": "Paris, France"})},
+		},
+		{
+			name:     "python prose",
+			template: `{{/* tool_parser: python */}}{{ range .Messages }}{{ .Content }}{{ end }}`,
+			output:   `You could call get_current_weather(location="Paris, France") to find out.`,
+		},
+		{
+			name:     "unknown parser",
+			template: `{{/* tool_parser: yaml */}}{{ range .Messages }}{{ .Content }}{{ end }}`,
+			output:   `get_current_weather(location="Paris, France")`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+			calls, ok := m.parseToolCalls(tt.output)
+			if ok != (tt.expect != nil) {
+				t.Fatalf("expected %t, got %t", tt.expect != nil, ok)
+			}
+
+			if diff := cmp.Diff(calls, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAssignToolCallIDs(t *testing.T) {
+	calls := []api.ToolCall{{ID: "a1b2c3d4e"}, {}, {}}
+	assignToolCallIDs(calls)
+
+	if calls[0].ID != "a1b2c3d4e" {
+		t.Errorf("expected the model's ID to be kept, got %s", calls[0].ID)
+	}
+
+	if calls[1].ID == "" || calls[2].ID == "" || calls[1].ID == calls[2].ID {
+		t.Errorf("expected unique IDs, got %q and %q", calls[1].ID, calls[2].ID)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tracing"
+)
+
+// tracingMiddleware traces each request as a server span, joining the trace
+// of the caller if it sent a traceparent header. It's only used while tracing
+// is enabled.
+func tracingMiddleware(c *gin.Context) {
+	ctx := tracing.Extract(c.Request.Context(), c.Request.Header)
+	ctx, span := tracing.Start(ctx, c.Request.Method+" "+c.FullPath(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("http.route", c.FullPath()),
+		),
+	)
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// traceCompletion runs a completion on r, tracing the prompt evaluation up to
+// the first response and the token generation after it. The spans are
+// recorded once the completion is done, since their attributes are only
+// known from the last response.
+func traceCompletion(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	if !tracing.Enabled() {
+		return r.Completion(ctx, req, fn)
+	}
+
+	start := time.Now()
+	var first time.Time
+	err := r.Completion(ctx, req, func(resp llm.CompletionResponse) {
+		if first.IsZero() {
+			first = time.Now()
+		}
+
+		if resp.Done {
+			_, span := tracing.Start(ctx, "llm.prompt_eval", trace.WithTimestamp(start))
+			span.SetAttributes(attribute.Int("prompt_eval_count", resp.PromptEvalCount))
+			span.End(trace.WithTimestamp(first))
+
+			_, span = tracing.Start(ctx, "llm.generate", trace.WithTimestamp(first))
+			span.SetAttributes(
+				attribute.Int("eval_count", resp.EvalCount),
+				attribute.String("done_reason", resp.DoneReason),
+			)
+			span.End()
+		}
+
+		fn(resp)
+	})
+	if err != nil {
+		_, span := tracing.Start(ctx, "llm.prompt_eval", trace.WithTimestamp(start))
+		if !first.IsZero() {
+			span.End(trace.WithTimestamp(first))
+			_, span = tracing.Start(ctx, "llm.generate", trace.WithTimestamp(first))
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+	}
+
+	return err
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tracing"
+)
+
+// tracingRunner streams a response in two parts
+type tracingRunner struct {
+	mockLlm
+}
+
+func (*tracingRunner) Completion(_ context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	fn(llm.CompletionResponse{Content: "hello"})
+	fn(llm.CompletionResponse{Content: " world", Done: true, DoneReason: "stop", PromptEvalCount: 3, EvalCount: 2})
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder := tracetest.NewSpanRecorder()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { tracing.SetTracerProvider(nil) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := Server{sched: InitScheduler(ctx)}
+	s.sched.getGpuFn = getCpuFn
+	s.sched.getCpuFn = getCpuFn
+	s.sched.newServerFn = func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int, *llm.MemoryEstimate) (llm.LlamaServer, error) {
+		return &tracingRunner{}, nil
+	}
+	s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(api.GenerateRequest{Model: "test", Prompt: "secret prompt", Stream: &stream}); err != nil {
+		t.Fatal(err)
+	}
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	r := httptest.NewRequest(http.MethodPost, "/api/generate", &b)
+	r.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", traceID, parentID))
+
+	w = httptest.NewRecorder()
+	s.GenerateRoutes().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("expected %s to join the caller's trace, got %s", span.Name(), span.SpanContext().TraceID())
+		}
+
+		for _, attr := range span.Attributes() {
+			if strings.Contains(attr.Value.Emit(), "secret") {
+				t.Errorf("expected %s not to record the prompt, got %s", span.Name(), attr.Key)
+			}
+		}
+	}
+
+	// each span and its expected parent
+	parents := map[string]string{
+		"POST /api/generate": "",
+		"scheduler.queue":    "POST /api/generate",
+		"model.load":         "scheduler.queue",
+		"llm.prompt_eval":    "POST /api/generate",
+		"llm.generate":       "POST /api/generate",
+	}
+
+	for name, parent := range parents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a %s span, got %v", name, recorder.Ended())
+			continue
+		}
+
+		want := parentID
+		if parent != "" {
+			want = spans[parent].SpanContext().SpanID().String()
+		}
+
+		if got := span.Parent().SpanID().String(); got != want {
+			t.Errorf("expected %s to be a child of %q, got parent %s", name, parent, got)
+		}
+	}
+
+	attrs := func(name string) map[attribute.Key]attribute.Value {
+		m := make(map[attribute.Key]attribute.Value)
+		for _, attr := range spans[name].Attributes() {
+			m[attr.Key] = attr.Value
+		}
+		return m
+	}
+
+	if server := attrs("POST /api/generate"); server["model"].AsString() != "test" || server["http.response.status_code"].AsInt64() != http.StatusOK {
+		t.Errorf("unexpected request attributes %v", server)
+	}
+
+	if prompt := attrs("llm.prompt_eval"); prompt["prompt_eval_count"].AsInt64() != 3 {
+		t.Errorf("unexpected prompt eval attributes %v", prompt)
+	}
+
+	if generate := attrs("llm.generate"); generate["eval_count"].AsInt64() != 2 || generate["done_reason"].AsString() != "stop" {
+		t.Errorf("unexpected generate attributes %v", generate)
+	}
+
+	if prompt, generate := spans["llm.prompt_eval"], spans["llm.generate"]; prompt != nil && generate != nil && generate.StartTime().Before(prompt.EndTime()) {
+		t.Error("expected generation to start after the prompt is evaluated")
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// errTransferCancelled is the cause of pulls and pushes cancelled through the
+// transfers API
+var errTransferCancelled = errors.New("transfer cancelled")
+
+// transfer is a pull or push in progress. Transfers are listed and cancelled
+// by id, so a pull can be stopped from a client other than the one that
+// started it.
+type transfer struct {
+	id      string
+	kind    string
+	model   string
+	started time.Time
+
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	status string
+
+	// blobs is the latest progress of each blob by digest
+	blobs map[string]api.ProgressResponse
+}
+
+var transfers = struct {
+	mu sync.Mutex
+	m  map[string]*transfer
+}{m: make(map[string]*transfer)}
+
+// startTransfer tracks a pull or push of model, returning a context that's
+// cancelled with errTransferCancelled if the transfer is cancelled. finish
+// must be called once the transfer is done.
+func startTransfer(ctx context.Context, kind, model string) (context.Context, *transfer) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	t := &transfer{
+		id:      hex.EncodeToString(b),
+		kind:    kind,
+		model:   model,
+		started: time.Now(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		blobs:   make(map[string]api.ProgressResponse),
+	}
+
+	transfers.mu.Lock()
+	transfers.m[t.id] = t
+	transfers.mu.Unlock()
+
+	return ctx, t
+}
+
+// update records the progress of the transfer
+func (t *transfer) update(resp api.ProgressResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.status = resp.Status
+	if resp.Digest != "" {
+		t.blobs[resp.Digest] = resp
+	}
+}
+
+func (t *transfer) finish() {
+	transfers.mu.Lock()
+	delete(transfers.m, t.id)
+	transfers.mu.Unlock()
+
+	t.cancel(nil)
+	close(t.done)
+}
+
+func (t *transfer) response() api.TransferResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	resp := api.TransferResponse{
+		ID:        t.id,
+		Type:      t.kind,
+		Model:     t.model,
+		Status:    t.status,
+		StartedAt: t.started,
+	}
+
+	for _, blob := range t.blobs {
+		resp.Total += blob.Total
+		resp.Completed += blob.Completed
+	}
+
+	return resp
+}
+
+// digests returns the digests of the blobs the transfer has started
+func (t *transfer) digests() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	digests := make([]string, 0, len(t.blobs))
+	for digest := range t.blobs {
+		digests = append(digests, digest)
+	}
+
+	return digests
+}
+
+func listTransfers() []*transfer {
+	transfers.mu.Lock()
+	defer transfers.mu.Unlock()
+
+	ts := make([]*transfer, 0, len(transfers.m))
+	for _, t := range transfers.m {
+		ts = append(ts, t)
+	}
+
+	slices.SortFunc(ts, func(a, b *transfer) int {
+		return cmp.Or(a.started.Compare(b.started), cmp.Compare(a.id, b.id))
+	})
+
+	return ts
+}
+
+func getTransfer(id string) (*transfer, bool) {
+	transfers.mu.Lock()
+	defer transfers.mu.Unlock()
+
+	t, ok := transfers.m[id]
+	return t, ok
+}
+
+// cancelTransfer cancels t and waits for it to stop. The partial downloads
+// of a cancelled pull are kept so pulling the model again resumes them,
+// unless discard is set.
+func cancelTransfer(ctx context.Context, t *transfer, discard bool) error {
+	t.cancel(errTransferCancelled)
+
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	slog.Info("cancelled transfer", "id", t.id, "type", t.kind, "model", t.model)
+	if !discard || t.kind != "pull" {
+		return nil
+	}
+
+	for _, digest := range t.digests() {
+		if err := removePartialDownload(ctx, digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removePartialDownload removes the partial download of a blob, unless
+// another pull is still downloading it
+func removePartialDownload(ctx context.Context, digest string) error {
+	if v, ok := blobDownloadManager.Load(digest); ok {
+		download := v.(*blobDownload)
+		if download.references.Load() > 0 {
+			return nil
+		}
+
+		// the download stops shortly after its last pull does
+		select {
+		case <-download.done:
+		case <-time.After(5 * time.Second):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	partials, err := filepath.Glob(p + "-partial*")
+	if err != nil {
+		return err
+	}
+
+	for _, partial := range partials {
+		if err := os.Remove(partial); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// newStallingRegistry serves a model with a single large blob whose download
+// sends a little of each part and then stalls until it's cancelled
+func newStallingRegistry(t *testing.T, digest string, size int64) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var stalled atomic.Int32
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/manifests/latest"):
+			json.NewEncoder(w).Encode(Manifest{
+				SchemaVersion: 2,
+				MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+				Layers:        []Layer{{MediaType: "application/vnd.ollama.image.model", Digest: digest, Size: size}},
+			})
+		case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/blobs/"+digest):
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+digest):
+			// redirect to another host, like a registry does to its CDN
+			u, err := url.Parse(registry.URL)
+			if err != nil {
+				t.Error(err)
+			}
+
+			u.Host = "localhost:" + u.Port()
+			http.Redirect(w, r, u.JoinPath("direct", digest).String(), http.StatusTemporaryRedirect)
+		case r.Method == http.MethodGet && r.URL.Path == "/direct/"+digest:
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(make([]byte, 1024))
+			w.(http.Flusher).Flush()
+
+			stalled.Add(1)
+			defer stalled.Add(-1)
+			<-r.Context().Done()
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(registry.Close)
+
+	return registry, &stalled
+}
+
+func TestCancelTransfer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	registry, stalled := newStallingRegistry(t, digest, 2*minDownloadPartSize)
+
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := fmt.Sprintf("%s/library/big:latest", u.Host)
+
+	var s Server
+	router := s.GenerateRoutes()
+
+	do := func(method, path string, body any) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&b).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, &b))
+		return w
+	}
+
+	pulled := make(chan *httptest.ResponseRecorder)
+	go func() {
+		pulled <- do(http.MethodPost, "/api/pull", api.PullRequest{Model: name, Insecure: true})
+	}()
+
+	var transfer api.TransferResponse
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var resp api.ListTransfersResponse
+		if err := json.NewDecoder(do(http.MethodGet, "/api/transfers", nil).Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Transfers) == 1 && resp.Transfers[0].Completed > 0 && stalled.Load() == 2 {
+			transfer = resp.Transfers[0]
+			break
+		}
+
+		select {
+		case w := <-pulled:
+			t.Fatalf("expected the pull to be in progress, got %s", w.Body.String())
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the pull to be listed with progress, got %+v", resp.Transfers)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if transfer.Type != "pull" || transfer.Model != name || transfer.Total != 2*minDownloadPartSize {
+		t.Errorf("unexpected transfer %+v", transfer)
+	}
+
+	if w := do(http.MethodDelete, "/api/transfers/missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status code 404, actual %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/api/transfers/"+transfer.ID+"?discard=true", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case w := <-pulled:
+		if !strings.Contains(w.Body.String(), errTransferCancelled.Error()) {
+			t.Errorf("expected the pull to report it was cancelled, got %s", w.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the pull to stop")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); stalled.Load() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected every part to stop downloading, %d still are", stalled.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if partials, err := filepath.Glob(p + "-partial*"); err != nil || len(partials) > 0 {
+		t.Errorf("expected the partial download to be discarded, got %v, %v", partials, err)
+	}
+
+	var resp api.ListTransfersResponse
+	if err := json.NewDecoder(do(http.MethodGet, "/api/transfers", nil).Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Transfers) > 0 {
+		t.Errorf("expected no transfers, got %+v", resp.Transfers)
+	}
+}
@@ -124,7 +124,6 @@ func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *reg
 // in parallel as defined by Prepare. Otherwise, parts will be uploaded serially. Run sets b.err on error.
 func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 	defer blobUploadManager.Delete(b.Digest)
-	ctx, b.CancelFunc = context.WithCancel(ctx)
 
 	p, err := GetBlobsPath(b.Digest)
 	if err != nil {
@@ -158,7 +157,9 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 					case err != nil:
 						sleep := time.Second * time.Duration(math.Pow(2, float64(try)))
 						slog.Info(fmt.Sprintf("%s part %d attempt %d failed: %v, retrying in %s", b.Digest[7:19], part.N, try, err, sleep))
-						time.Sleep(sleep)
+						if err := sleepContext(inner, sleep); err != nil {
+							return err
+						}
 						continue
 					}
 
@@ -200,7 +201,9 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 		} else if err != nil {
 			sleep := time.Second * time.Duration(math.Pow(2, float64(try)))
 			slog.Info(fmt.Sprintf("%s complete upload attempt %d failed: %v, retrying in %s", b.Digest[7:19], try, err, sleep))
-			time.Sleep(sleep)
+			if err = sleepContext(ctx, sleep); err != nil {
+				break
+			}
 			continue
 		}
 		defer resp.Body.Close()
@@ -276,13 +279,19 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 
 	case resp.StatusCode == http.StatusUnauthorized:
 		w.Rollback()
-		challenge := parseRegistryChallenge(resp.Header.Get("www-authenticate"))
-		token, err := getAuthorizationToken(ctx, challenge)
-		if err != nil {
-			return err
-		}
+		header := resp.Header.Get("www-authenticate")
+		if c := registryCredential(requestURL.Host); c != nil {
+			if err := useCredential(ctx, header, c, opts); err != nil {
+				return err
+			}
+		} else {
+			token, err := getAuthorizationToken(ctx, parseRegistryChallenge(header))
+			if err != nil {
+				return err
+			}
 
-		opts.Token = token
+			opts.Token = token
+		}
 		fallthrough
 	case resp.StatusCode >= http.StatusBadRequest:
 		w.Rollback()
@@ -295,7 +304,11 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 	}
 
 	if method == http.MethodPatch {
-		b.nextURL <- nextURL
+		select {
+		case b.nextURL <- nextURL:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	part.Hash = md5sum
@@ -317,6 +330,7 @@ func (b *blobUpload) Wait(ctx context.Context, fn func(api.ProgressResponse)) er
 	defer b.release()
 
 	ticker := time.NewTicker(60 * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
@@ -329,6 +343,7 @@ func (b *blobUpload) Wait(ctx context.Context, fn func(api.ProgressResponse)) er
 			Digest:    b.Digest,
 			Total:     b.Total,
 			Completed: b.Completed.Load(),
+			Phase:     api.PhaseUploading,
 		})
 
 		if b.done || b.err != nil {
@@ -378,6 +393,7 @@ func uploadBlob(ctx context.Context, mp ModelPath, layer Layer, opts *registryOp
 			Digest:    layer.Digest,
 			Total:     layer.Size,
 			Completed: layer.Size,
+			Phase:     api.PhaseUploading,
 		})
 
 		return nil
@@ -394,7 +410,9 @@ func uploadBlob(ctx context.Context, mp ModelPath, layer Layer, opts *registryOp
 		}
 
 		//nolint:contextcheck
-		go upload.Run(context.Background(), opts)
+		runCtx, cancel := context.WithCancel(context.Background())
+		upload.CancelFunc = cancel
+		go upload.Run(runCtx, opts)
 	}
 
 	return upload.Wait(ctx, fn)
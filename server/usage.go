@@ -0,0 +1,313 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+// usageKey identifies the usage of a model by an API key
+type usageKey struct {
+	model string // the model's path, or its name if it couldn't be resolved
+	key   string // the API key's name, or "" if keys aren't configured
+}
+
+// usageStats counts the requests, tokens and time of each model's generate
+// and chat requests since the server started or the counters were reset
+type usageStats struct {
+	mu    sync.Mutex
+	since time.Time
+	usage map[usageKey]*api.ModelUsage
+}
+
+func newUsageStats() *usageStats {
+	return &usageStats{since: time.Now().UTC(), usage: make(map[usageKey]*api.ModelUsage)}
+}
+
+// reset zeroes every counter. Requests still running are counted from when
+// they finish.
+func (s *usageStats) reset() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = time.Now().UTC()
+	clear(s.usage)
+}
+
+// add counts a finished request's usage
+func (s *usageStats) add(k usageKey, u api.ModelUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total, ok := s.usage[k]
+	if !ok {
+		total = &api.ModelUsage{Key: k.key}
+		s.usage[k] = total
+	}
+
+	// models are listed by the name they were last used by
+	total.Model = u.Model
+	sumUsage(total, u)
+}
+
+func sumUsage(total *api.ModelUsage, u api.ModelUsage) {
+	total.Requests += u.Requests
+	total.Errors += u.Errors
+	total.Aborted += u.Aborted
+	total.PromptEvalCount += u.PromptEvalCount
+	total.EvalCount += u.EvalCount
+	total.TotalDuration += u.TotalDuration
+	total.PromptEvalDuration += u.PromptEvalDuration
+	total.EvalDuration += u.EvalDuration
+}
+
+// state returns the usage of each model by the keys keep reports true for,
+// or every key if keep is nil, keyed by the model's path. Usage is summed
+// over keys unless byKey is set.
+func (s *usageStats) state(byKey bool, keep func(key string) bool) (map[usageKey]api.ModelUsage, time.Time) {
+	if s == nil {
+		return nil, time.Time{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := make(map[usageKey]api.ModelUsage)
+	for k, u := range s.usage {
+		if keep != nil && !keep(k.key) {
+			continue
+		}
+
+		if !byKey {
+			k.key = ""
+		}
+
+		sum, ok := state[k]
+		if !ok {
+			sum = api.ModelUsage{Model: u.Model, Key: k.key}
+		}
+
+		sumUsage(&sum, *u)
+		state[k] = sum
+	}
+
+	return state, s.since
+}
+
+// usageRecord accumulates the usage of a request. It's counted once the
+// handler and the work it holds the record for, such as a generation that
+// outlives its client, have all finished.
+type usageRecord struct {
+	stats *usageStats
+	key   usageKey
+	start time.Time
+
+	mu    sync.Mutex
+	refs  int
+	usage api.ModelUsage
+}
+
+// begin starts the record of a request for m, or for the model name if the
+// request failed before it was resolved, returning nil if usage isn't
+// counted or there's no model to count it against. Its methods do nothing on
+// a nil record.
+func (s *usageStats) begin(ctx context.Context, name string, m *Model) *usageRecord {
+	if s == nil {
+		return nil
+	}
+
+	key, short := name, name
+	if m != nil {
+		key, short = m.ModelPath, m.ShortName
+	}
+
+	if key == "" {
+		return nil
+	}
+
+	return &usageRecord{
+		stats: s,
+		key:   usageKey{model: key, key: apiKeyName(ctx)},
+		start: time.Now(),
+		refs:  1,
+		usage: api.ModelUsage{Model: short, Requests: 1},
+	}
+}
+
+// hold keeps the record from being counted until the returned function is
+// called
+func (u *usageRecord) hold() func() {
+	if u == nil {
+		return func() {}
+	}
+
+	u.mu.Lock()
+	u.refs++
+	u.mu.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(u.release) }
+}
+
+// end releases the handler's hold on the record, counting the request as an
+// error if the handler responded with one
+func (u *usageRecord) end(c *gin.Context) {
+	if u == nil {
+		return
+	}
+
+	if c.Writer.Status() >= http.StatusBadRequest {
+		u.mu.Lock()
+		u.usage.Errors = 1
+		u.mu.Unlock()
+	}
+
+	u.release()
+}
+
+func (u *usageRecord) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.refs--; u.refs > 0 {
+		return
+	}
+
+	// a request that was aborted isn't also an error, even if the handler
+	// responded with one once it was
+	if u.usage.Aborted > 0 {
+		u.usage.Errors = 0
+	}
+
+	u.usage.TotalDuration = time.Since(u.start)
+	u.stats.add(u.key, u.usage)
+}
+
+// add counts the tokens and time of a completion's final metrics
+func (u *usageRecord) add(m api.Metrics) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.usage.PromptEvalCount += uint64(max(m.PromptEvalCount, 0))
+	u.usage.EvalCount += uint64(max(m.EvalCount, 0))
+	u.usage.PromptEvalDuration += m.PromptEvalDuration
+	u.usage.EvalDuration += m.EvalDuration
+}
+
+// fail counts the request as aborted if err is from its context ending, or
+// as an error otherwise
+func (u *usageRecord) fail(ctx context.Context, err error) {
+	if u == nil || err == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		u.usage.Aborted = 1
+	} else {
+		u.usage.Errors = 1
+	}
+}
+
+// completion wraps complete to count the usage of its completions. The
+// runner only reports its counts once a completion is done, so one that
+// doesn't finish counts each response it streamed as a generated token.
+func (u *usageRecord) completion(complete completionFunc) completionFunc {
+	if u == nil {
+		return complete
+	}
+
+	return func(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+		start := time.Now()
+		var first time.Time
+		var streamed int
+		var final *api.Metrics
+		err := complete(ctx, r, req, func(cr llm.CompletionResponse) {
+			if cr.Done {
+				final = &api.Metrics{
+					PromptEvalCount:    cr.PromptEvalCount,
+					PromptEvalDuration: cr.PromptEvalDuration,
+					EvalCount:          cr.EvalCount,
+					EvalDuration:       cr.EvalDuration,
+				}
+			} else if cr.Content != "" {
+				if first.IsZero() {
+					first = time.Now()
+				}
+				streamed++
+			}
+
+			fn(cr)
+		})
+
+		switch {
+		case final != nil:
+			u.add(*final)
+		case streamed > 0:
+			u.add(api.Metrics{
+				PromptEvalDuration: first.Sub(start),
+				EvalCount:          streamed,
+				EvalDuration:       time.Since(first),
+			})
+		}
+
+		u.fail(ctx, err)
+		return err
+	}
+}
+
+// usageResponse returns the usage of each model, sorted by name
+func usageResponse(state map[usageKey]api.ModelUsage, since time.Time) api.UsageResponse {
+	models := make([]api.ModelUsage, 0, len(state))
+	for _, u := range state {
+		models = append(models, u)
+	}
+
+	slices.SortFunc(models, func(a, b api.ModelUsage) int {
+		return cmp.Or(cmp.Compare(a.Model, b.Model), cmp.Compare(a.Key, b.Key))
+	})
+
+	return api.UsageResponse{Since: since, Models: models}
+}
+
+// UsageHandler reports the cumulative usage of each model, grouped by API key
+// with ?by=key. Requests made with an API key that isn't an admin key only
+// see the usage of that key.
+func (s *Server) UsageHandler(c *gin.Context) {
+	by := c.Query("by")
+	if by != "" && by != "key" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "by must be empty or \"key\""})
+		return
+	}
+
+	var keep func(string) bool
+	if k, ok := c.Request.Context().Value(apiKeyContextKey{}).(*apiKey); ok && !k.Admin {
+		keep = func(key string) bool { return key == k.Name }
+	}
+
+	state, since := s.usage.state(by == "key", keep)
+	c.JSON(http.StatusOK, usageResponse(state, since))
+}
+
+// ResetUsageHandler zeroes the usage counters
+func (s *Server) ResetUsageHandler(c *gin.Context) {
+	s.usage.reset()
+	slog.Info("reset usage counters")
+}
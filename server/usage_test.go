@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// streamCompletion streams three tokens and a final response, unless its
+// context is cancelled after the second or fail is set
+func streamCompletion(cancel context.CancelFunc, fail bool) completionFunc {
+	return func(ctx context.Context, _ llm.LlamaServer, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+		for i := range 3 {
+			if i == 2 && cancel != nil {
+				cancel()
+				return ctx.Err()
+			}
+
+			fn(llm.CompletionResponse{Content: "token"})
+		}
+
+		if fail {
+			return errors.New("runner crashed")
+		}
+
+		fn(llm.CompletionResponse{Done: true, PromptEvalCount: 5, PromptEvalDuration: time.Millisecond, EvalCount: 3, EvalDuration: time.Millisecond})
+		return nil
+	}
+}
+
+func TestUsageConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stats := newUsageStats()
+	m := &Model{ShortName: "test:latest", ModelPath: "/models/blobs/sha256-test"}
+
+	// each request runs two completions at once, as requests with n do, and
+	// finishes them after its handler returns
+	const requests = 64
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var complete completionFunc
+			switch i % 4 {
+			case 0:
+				complete = streamCompletion(cancel, false)
+			case 1:
+				complete = streamCompletion(nil, true)
+			default:
+				complete = streamCompletion(nil, false)
+			}
+
+			u := stats.begin(ctx, "", m)
+			done := u.hold()
+			var choices sync.WaitGroup
+			for range 2 {
+				choices.Add(1)
+				go func() {
+					defer choices.Done()
+					u.completion(complete)(ctx, nil, llm.CompletionRequest{}, func(llm.CompletionResponse) {}) //nolint:errcheck
+				}()
+			}
+
+			u.end(c)
+			choices.Wait()
+			done()
+		}()
+	}
+
+	// the counters are read while they're being updated
+	for range 10 {
+		stats.state(false, nil)
+	}
+	wg.Wait()
+
+	state, _ := stats.state(false, nil)
+	u := state[usageKey{model: m.ModelPath}]
+	expect := api.ModelUsage{
+		Model:    "test:latest",
+		Requests: requests,
+		Errors:   requests / 4,
+		Aborted:  requests / 4,
+		// finished completions count the runner's counts, those that didn't
+		// the tokens they streamed
+		PromptEvalCount: requests / 2 * 2 * 5,
+		EvalCount:       requests/2*2*3 + requests/4*2*3 + requests/4*2*2,
+	}
+	u.TotalDuration, u.PromptEvalDuration, u.EvalDuration = 0, 0, 0
+	if u != expect {
+		t.Errorf("expected %+v, got %+v", expect, u)
+	}
+}
+
+func TestUsageRecordOutlivesHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stats := newUsageStats()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+
+	u := stats.begin(context.Background(), "", &Model{ShortName: "test:latest", ModelPath: "test"})
+	done := u.hold()
+	c.JSON(http.StatusOK, nil)
+	u.end(c)
+
+	if state, _ := stats.state(false, nil); len(state) != 0 {
+		t.Fatalf("expected the request to be counted once its generation finishes, got %v", state)
+	}
+
+	u.add(api.Metrics{PromptEvalCount: 2, EvalCount: 4})
+	done()
+	done()
+
+	state, _ := stats.state(false, nil)
+	if got := state[usageKey{model: "test"}]; got.Requests != 1 || got.EvalCount != 4 || got.Errors != 0 {
+		t.Errorf("unexpected usage %+v", got)
+	}
+
+	// a nil record, for a server that doesn't count usage, does nothing
+	var nilStats *usageStats
+	nilStats.begin(context.Background(), "", &Model{}).completion(streamCompletion(nil, false))(context.Background(), nil, llm.CompletionRequest{}, func(llm.CompletionResponse) {}) //nolint:errcheck
+}
+
+func TestUsageHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{
+		keys: map[string]*apiKey{
+			"admin-key": {Name: "admin", Admin: true},
+			"alice-key": {Name: "alice"},
+			"bob-key":   {Name: "bob"},
+		},
+		usage: newUsageStats(),
+	}
+
+	for _, key := range []string{"alice", "alice", "bob"} {
+		ctx := context.WithValue(context.Background(), apiKeyContextKey{}, &apiKey{Name: key})
+		u := s.usage.begin(ctx, "", &Model{ShortName: "test:latest", ModelPath: "test"})
+		u.add(api.Metrics{EvalCount: 10})
+		u.release()
+	}
+
+	get := func(t *testing.T, method, path, key string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		s.GenerateRoutes().ServeHTTP(w, r)
+		return w
+	}
+
+	usage := func(t *testing.T, path, key string) []api.ModelUsage {
+		t.Helper()
+		w := get(t, http.MethodGet, path, key)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.UsageResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Models
+	}
+
+	if models := usage(t, "/api/usage", "admin-key"); len(models) != 1 || models[0].Requests != 3 || models[0].EvalCount != 30 || models[0].Key != "" {
+		t.Errorf("expected the usage of every key, got %+v", models)
+	}
+
+	if models := usage(t, "/api/usage?by=key", "admin-key"); len(models) != 2 || models[0].Key != "alice" || models[0].Requests != 2 || models[1].Key != "bob" {
+		t.Errorf("expected usage by key, got %+v", models)
+	}
+
+	if models := usage(t, "/api/usage?by=key", "bob-key"); len(models) != 1 || models[0].Key != "bob" || models[0].Requests != 1 {
+		t.Errorf("expected only bob's usage, got %+v", models)
+	}
+
+	if w := get(t, http.MethodGet, "/api/usage?by=model", "admin-key"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+
+	if w := get(t, http.MethodPost, "/api/usage/reset", "bob-key"); w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", w.Code)
+	}
+
+	if w := get(t, http.MethodPost, "/api/usage/reset", "admin-key"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+
+	if models := usage(t, "/api/usage", "admin-key"); len(models) != 0 {
+		t.Errorf("expected no usage after a reset, got %+v", models)
+	}
+}
+
+func TestUsageScheduleErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	loading, loaded := make(chan struct{}), make(chan struct{})
+	s := Server{
+		usage: newUsageStats(),
+		sched: &Scheduler{
+			queues:        newRequestQueues(4, 0),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			ledger:        newVRAMLedger(),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+				// the load holds up the queue until the test lets it fail
+				close(loading)
+				<-loaded
+				req.errCh <- errors.New("llama runner process has terminated")
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	for name, arch := range map[string]string{"test": "llama", "unsupported": "gemma3"} {
+		if w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": arch}, nil)),
+			Stream:    &stream,
+		}); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	generate := func(ctx context.Context, model string) int {
+		b, err := json.Marshal(api.GenerateRequest{Model: model, Prompt: "Hello!", Stream: &stream, Options: map[string]any{"num_gpu": 0}})
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(b)).WithContext(ctx)
+		s.GenerateHandler(c)
+		return w.Code
+	}
+
+	// a request that fails to load the model, and one whose client hangs up
+	// while it's queued behind that load
+	failed, hungUp := make(chan int), make(chan int)
+	go func() { failed <- generate(context.Background(), "test") }()
+	<-loading
+
+	reqCtx, hangUp := context.WithCancel(context.Background())
+	go func() { hungUp <- generate(reqCtx, "test") }()
+	for s.sched.queues.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	hangUp()
+	close(loaded)
+
+	if code := <-failed; code != http.StatusInternalServerError {
+		t.Errorf("expected status 500 for the failed load, got %d", code)
+	}
+
+	if code := <-hungUp; code != 499 {
+		t.Errorf("expected status 499 for the client that hung up, got %d", code)
+	}
+
+	if code := generate(context.Background(), "unsupported"); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for the unsupported model, got %d", code)
+	}
+
+	if code := generate(context.Background(), "missing"); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for the missing model, got %d", code)
+	}
+
+	state, _ := s.usage.state(false, nil)
+	got := make(map[string]api.ModelUsage)
+	for _, u := range state {
+		u.TotalDuration = 0
+		got[u.Model] = u
+	}
+
+	expect := map[string]api.ModelUsage{
+		"test:latest":        {Model: "test:latest", Requests: 2, Errors: 1, Aborted: 1},
+		"unsupported:latest": {Model: "unsupported:latest", Requests: 1, Errors: 1},
+		"missing":            {Model: "missing", Requests: 1, Errors: 1},
+	}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("usage mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// ModelVariant is a pulled quantization of a model with variants
+type ModelVariant struct {
+	Quantization string
+	ModelPath    string
+	Size         int64
+}
+
+// loadVariants sets the model's pulled variants from its manifest, largest
+// first. The default variant is used if it's been pulled, otherwise the
+// largest one.
+func (m *Model) loadVariants(manifest *Manifest) error {
+	st := storage()
+	for _, v := range manifest.pulledVariants() {
+		for _, layer := range v.Layers {
+			if layer.MediaType != "application/vnd.ollama.image.model" {
+				continue
+			}
+
+			p, err := st.BlobPath(context.Background(), layer.Digest)
+			if err != nil {
+				return err
+			}
+
+			m.Variants = append(m.Variants, ModelVariant{Quantization: v.Quantization, ModelPath: p, Size: layer.Size})
+		}
+	}
+
+	if len(m.Variants) == 0 {
+		return fmt.Errorf("none of the variants of %s have been pulled", m.ShortName)
+	}
+
+	slices.SortStableFunc(m.Variants, func(a, b ModelVariant) int {
+		return cmp.Compare(b.Size, a.Size)
+	})
+
+	for _, v := range m.Variants {
+		if v.ModelPath == m.ModelPath {
+			m.Variant = v.Quantization
+			return nil
+		}
+	}
+
+	m.ModelPath, m.Variant = m.Variants[0].ModelPath, m.Variants[0].Quantization
+	m.Config.FileType = m.Variant
+	return nil
+}
+
+// withVariant returns a copy of the model that loads the variant v
+func (m *Model) withVariant(v ModelVariant) *Model {
+	n := *m
+	n.ModelPath = v.ModelPath
+	n.Variant = v.Quantization
+	n.Config.FileType = v.Quantization
+	return &n
+}
+
+// variantNames returns the quantizations of the model's pulled variants
+func (m *Model) variantNames() []string {
+	names := make([]string, len(m.Variants))
+	for i, v := range m.Variants {
+		names[i] = v.Quantization
+	}
+
+	return names
+}
+
+// selectVariant returns the model with the variant a request should use: the
+// one forced by the quantization option, one that's already loaded, or else
+// the largest that fits in the free memory, falling back to the smallest
+func (s *Scheduler) selectVariant(m *Model, opts api.Options) (*Model, error) {
+	q := opts.Quantization
+	if len(m.Variants) == 0 {
+		if q != "" && !strings.EqualFold(q, m.Config.FileType) {
+			return nil, fmt.Errorf("%s is %s and has no %s variant", m.ShortName, m.Config.FileType, q)
+		}
+
+		return m, nil
+	}
+
+	if q != "" {
+		for _, v := range m.Variants {
+			if strings.EqualFold(v.Quantization, q) {
+				return m.withVariant(v), nil
+			}
+		}
+
+		return nil, fmt.Errorf("%s has no pulled %s variant, available variants are %s", m.ShortName, q, strings.Join(m.variantNames(), ", "))
+	}
+
+	s.loadedMu.Lock()
+	for _, v := range m.Variants {
+		if len(s.replicas(v.ModelPath)) > 0 {
+			s.loadedMu.Unlock()
+			return m.withVariant(v), nil
+		}
+	}
+	s.loadedMu.Unlock()
+
+	var gpus gpu.GpuInfoList
+	if opts.NumGPU == 0 {
+		gpus = s.getCpuFn()
+	} else {
+		gpus = s.getGpuFn()
+	}
+
+	for _, v := range m.Variants {
+		ggml, err := llm.LoadModel(v.ModelPath, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if variantFits(gpus, ggml, m, opts) {
+			slog.Debug("selected variant", "model", m.ShortName, "variant", v.Quantization)
+			return m.withVariant(v), nil
+		}
+	}
+
+	smallest := m.Variants[len(m.Variants)-1]
+	slog.Info("no variant fits in free memory, using the smallest", "model", m.ShortName, "variant", smallest.Quantization)
+	return m.withVariant(smallest), nil
+}
+
+// variantFits reports whether a variant fits entirely in the free memory of
+// gpus, on the CPU or on the GPUs of one library
+func variantFits(gpus gpu.GpuInfoList, ggml *llm.GGML, m *Model, opts api.Options) bool {
+	if len(gpus) == 0 {
+		return false
+	}
+
+	if gpus[0].Library == "cpu" {
+		return llm.EstimateGPULayers(gpus, ggml, m.ProjectorPaths, opts).TotalSize <= gpus[0].FreeMemory
+	}
+
+	for _, gl := range gpus.ByLibrary() {
+		if ok, _ := llm.PredictServerFit(gl, ggml, m.AdapterPaths, m.ProjectorPaths, opts); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectVariants returns the manifest's variants with the quantizations, or
+// all of them if quantizations is empty
+func (m *Manifest) selectVariants(quantizations []string) ([]Variant, error) {
+	if len(quantizations) == 0 {
+		return m.Variants, nil
+	}
+
+	if len(m.Variants) == 0 {
+		return nil, errors.New("model has no variants")
+	}
+
+	var variants []Variant
+	for _, q := range quantizations {
+		i := slices.IndexFunc(m.Variants, func(v Variant) bool { return strings.EqualFold(v.Quantization, q) })
+		if i < 0 {
+			names := make([]string, len(m.Variants))
+			for i, v := range m.Variants {
+				names[i] = v.Quantization
+			}
+
+			return nil, fmt.Errorf("unknown variant %q, available variants are %s", q, strings.Join(names, ", "))
+		}
+
+		variants = append(variants, m.Variants[i])
+	}
+
+	return variants, nil
+}
+
+// writeVariantsManifest writes the manifest of name with the models created
+// as names as its variants, labelled by quantizations. The first is the
+// default variant.
+func writeVariantsManifest(name model.Name, names []model.Name, quantizations []string) error {
+	var m Manifest
+	for i, n := range names {
+		vm, err := ParseNamedManifest(n)
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			m.Config, m.Layers = vm.Config, vm.Layers
+		}
+
+		v := Variant{Quantization: quantizations[i]}
+		for _, layer := range vm.Layers {
+			if layer.MediaType == "application/vnd.ollama.image.model" {
+				v.Layers = append(v.Layers, layer)
+			}
+		}
+
+		m.Variants = append(m.Variants, v)
+	}
+
+	return writeManifest(name, m)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// createVariants creates mymodel with Q8_0 and Q4_K_M variants, Q8_0 being
+// the larger and the default
+func createVariants(t *testing.T) {
+	t.Helper()
+
+	var s Server
+	names := []model.Name{model.ParseName("mymodel:q8_0"), model.ParseName("mymodel:q4_K_M")}
+	for i, n := range []uint64{1024, 256} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: names[i].String(),
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+				"general.architecture":          "llama",
+				"llama.block_count":             uint32(1),
+				"llama.context_length":          uint32(2048),
+				"llama.embedding_length":        uint32(256),
+				"llama.attention.head_count":    uint32(8),
+				"llama.attention.head_count_kv": uint32(8),
+				"tokenizer.ggml.tokens":         []string{""},
+				"tokenizer.ggml.scores":         []float32{0},
+				"tokenizer.ggml.token_type":     []int32{0},
+			}, []llm.Tensor{
+				{Name: "token_embd.weight", Shape: []uint64{n}, WriterTo: bytes.NewReader(make([]byte, 4*n))},
+			})),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	if err := writeVariantsManifest(model.ParseName("mymodel"), names, []string{"Q8_0", "Q4_K_M"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModelVariants(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	createVariants(t)
+
+	m, err := GetModel("mymodel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Variants) != 2 || m.Variants[0].Quantization != "Q8_0" || m.Variants[1].Quantization != "Q4_K_M" {
+		t.Fatalf("expected variants Q8_0 and Q4_K_M, got %v", m.Variants)
+	}
+
+	if m.Variant != "Q8_0" || m.ModelPath != m.Variants[0].ModelPath {
+		t.Errorf("expected the default variant Q8_0, got %s", m.Variant)
+	}
+
+	// only Q4_K_M has been pulled
+	if err := os.Remove(m.Variants[0].ModelPath); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ParseNamedManifest(model.ParseName("mymodel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if broken := manifest.brokenLayers(false); len(broken) > 0 {
+		t.Errorf("expected no broken layers, got %v", broken)
+	}
+
+	m, err = GetModel("mymodel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Variants) != 1 || m.Variant != "Q4_K_M" || m.Config.FileType != "Q4_K_M" {
+		t.Errorf("expected only the Q4_K_M variant, got %s of %v", m.Variant, m.Variants)
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	createVariants(t)
+
+	m, err := GetModel("mymodel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free := func(n uint64) func() gpu.GpuInfoList {
+		return func() gpu.GpuInfoList {
+			g := gpu.GpuInfo{Library: "cpu"}
+			g.TotalMemory = n
+			g.FreeMemory = n
+			return []gpu.GpuInfo{g}
+		}
+	}
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 2048
+
+	cases := []struct {
+		name         string
+		free         uint64
+		quantization string
+		loaded       string
+		expect       string
+		err          bool
+	}{
+		{name: "largest fits", free: 1 << 34, expect: "Q8_0"},
+		{name: "none fit", free: 0, expect: "Q4_K_M"},
+		{name: "forced", free: 1 << 34, quantization: "q4_k_m", expect: "Q4_K_M"},
+		{name: "unknown", free: 1 << 34, quantization: "Q2_K", err: true},
+		{name: "loaded", free: 1 << 34, loaded: "Q4_K_M", expect: "Q4_K_M"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Scheduler{
+				loaded:   make(map[string]*runnerRef),
+				getGpuFn: free(tt.free),
+				getCpuFn: free(tt.free),
+			}
+
+			for _, v := range m.Variants {
+				if v.Quantization == tt.loaded {
+					s.loaded[v.ModelPath] = &runnerRef{modelPath: v.ModelPath}
+				}
+			}
+
+			opts := opts
+			opts.Quantization = tt.quantization
+
+			selected, err := s.selectVariant(m, opts)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if selected.Variant != tt.expect {
+				t.Errorf("expected %s, got %s", tt.expect, selected.Variant)
+			}
+
+			if m.Variant != "Q8_0" {
+				t.Error("the model was modified")
+			}
+		})
+	}
+}
+
+func TestSelectVariants(t *testing.T) {
+	m := Manifest{Variants: []Variant{{Quantization: "Q8_0"}, {Quantization: "Q4_K_M"}}}
+
+	if variants, err := m.selectVariants(nil); err != nil || len(variants) != 2 {
+		t.Errorf("expected every variant, got %v, %v", variants, err)
+	}
+
+	if variants, err := m.selectVariants([]string{"q4_k_m"}); err != nil || len(variants) != 1 || variants[0].Quantization != "Q4_K_M" {
+		t.Errorf("expected Q4_K_M, got %v, %v", variants, err)
+	}
+
+	if _, err := m.selectVariants([]string{"Q2_K"}); err == nil {
+		t.Error("expected an error for an unknown variant")
+	}
+
+	if _, err := (&Manifest{}).selectVariants([]string{"Q8_0"}); err == nil {
+		t.Error("expected an error for a model without variants")
+	}
+}
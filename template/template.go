@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"regexp"
 	"slices"
 	"strings"
 	"sync"
@@ -163,6 +164,42 @@ func (t *Template) Vars() []string {
 	return vars
 }
 
+// thinkingTags are the delimiters reasoning models put around their thinking,
+// which is left out of previous messages by their templates
+var thinkingTags = [][2]string{
+	{"<think>", "</think>"},
+	{"<thinking>", "</thinking>"},
+	{"<reasoning>", "</reasoning>"},
+}
+
+// ThinkingTags returns the tags that delimit the model's thinking, if the
+// template is for a reasoning model. Templates either end the prompt with
+// the opening tag or strip thinking up to the closing tag from messages.
+func (t *Template) ThinkingTags() (open, close string, ok bool) {
+	for _, tags := range thinkingTags {
+		if strings.Contains(t.raw, tags[0]) || strings.Contains(t.raw, tags[1]) {
+			return tags[0], tags[1], true
+		}
+	}
+
+	return "", "", false
+}
+
+// toolParserComment is the comment that selects the parser of a template's
+// tool calls, e.g. {{/* tool_parser: python */}}
+var toolParserComment = regexp.MustCompile(`\{\{-?\s*/\*\s*tool_parser:\s*(\w+)\s*\*/\s*-?\}\}`)
+
+// ToolParser returns the name of the parser for tool calls in the model's
+// output that the template selects with a tool_parser comment, such as
+// {{/* tool_parser: xml */}}, or "" if it doesn't select one
+func (t *Template) ToolParser() string {
+	if m := toolParserComment.FindStringSubmatch(t.raw); m != nil {
+		return strings.ToLower(m[1])
+	}
+
+	return ""
+}
+
 type Values struct {
 	Messages []api.Message
 	api.Tools
@@ -299,15 +336,28 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 }
 
 // collate messages based on role. consecutive messages of the same role are merged
-// into a single message. collate also collects and returns all system messages.
-// collate mutates message content adding image tags ([img-%d]) as needed
+// into a single message, except for tool calls and their results, which are kept
+// separate. collate also collects and returns all system messages.
+// collate mutates message content adding image tags ([img-%d]) as needed, and
+// names tool results after the calls they're for if they aren't named
 func collate(msgs []api.Message) (string, []*api.Message) {
 	var n int
 
 	var system []string
 	var collated []*api.Message
+	calls := make(map[string]string)
 	for i := range msgs {
 		msg := msgs[i]
+		for _, tc := range msg.ToolCalls {
+			if tc.ID != "" {
+				calls[tc.ID] = tc.Function.Name
+			}
+		}
+
+		if msg.Role == "tool" && msg.Name == "" {
+			msg.Name = calls[msg.ToolCallID]
+		}
+
 		for range msg.Images {
 			imageTag := fmt.Sprintf("[img-%d]", n)
 			if !strings.Contains(msg.Content, "[img]") {
@@ -322,7 +372,7 @@ func collate(msgs []api.Message) (string, []*api.Message) {
 			system = append(system, msg.Content)
 		}
 
-		if len(collated) > 0 && collated[len(collated)-1].Role == msg.Role {
+		if len(collated) > 0 && collated[len(collated)-1].Role == msg.Role && mergeable(collated[len(collated)-1]) && mergeable(&msg) {
 			collated[len(collated)-1].Content += "\n\n" + msg.Content
 		} else {
 			collated = append(collated, &msg)
@@ -332,6 +382,12 @@ func collate(msgs []api.Message) (string, []*api.Message) {
 	return strings.Join(system, "\n\n"), collated
 }
 
+// mergeable reports whether a message can be merged with others of its role,
+// which tool calls and their results can't since each is rendered on its own
+func mergeable(m *api.Message) bool {
+	return m.Role != "tool" && len(m.ToolCalls) == 0
+}
+
 // Identifiers walks the node tree returning any identifiers it finds along the way
 func Identifiers(n parse.Node) []string {
 	switch n := n.(type) {
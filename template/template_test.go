@@ -415,3 +415,83 @@ func TestExecuteWithSuffix(t *testing.T) {
 		})
 	}
 }
+
+func TestThinkingTags(t *testing.T) {
+	cases := []struct {
+		template    string
+		open, close string
+	}{
+		{"{{ .Prompt }}", "", ""},
+		{`{{ range .Messages }}{{ .Content }}{{ end }}<|Assistant|><think>`, "<think>", "</think>"},
+		{`{{ range .Messages }}{{ .Content }}{{ end }}{{/* reasoning is ended by </think> */}}<|Assistant|>`, "<think>", "</think>"},
+		{"{{ .Prompt }}<thinking>{{ .Response }}</thinking>", "<thinking>", "</thinking>"},
+	}
+
+	for _, tt := range cases {
+		t.Run("", func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			open, close, ok := tmpl.ThinkingTags()
+			if ok != (tt.close != "") || open != tt.open || close != tt.close {
+				t.Errorf("expected %q %q, got %q %q %v", tt.open, tt.close, open, close, ok)
+			}
+		})
+	}
+}
+
+func TestToolParser(t *testing.T) {
+	cases := map[string]string{
+		"{{ .Prompt }}": "",
+		`{{/* tool_parser: python */}}{{ range .Messages }}{{ .Content }}{{ end }}`:    "python",
+		"{{- /* tool_parser: XML */ -}}\n{{ range .Messages }}{{ .Content }}{{ end }}": "xml",
+	}
+
+	for template, expect := range cases {
+		tmpl, err := Parse(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parser := tmpl.ToolParser(); parser != expect {
+			t.Errorf("%s: expected %q, got %q", template, expect, parser)
+		}
+	}
+}
+
+func TestExecuteWithToolResults(t *testing.T) {
+	tmpl, err := Parse(`{{- range .Messages }}
+{{- if eq .Role "assistant" }}{{ range .ToolCalls }}[call {{ .ID }} {{ .Function.Name }}]{{ end }}
+{{- else if eq .Role "tool" }}[result {{ .ToolCallID }} {{ .Name }}: {{ .Content }}]
+{{- else }}[{{ .Role }}: {{ .Content }}]
+{{- end }}
+{{- end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(id, name string) api.ToolCall {
+		return api.ToolCall{ID: id, Function: api.ToolCallFunction{Name: name}}
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, Values{Messages: []api.Message{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call("1", "weather"), call("2", "time")}},
+		{Role: "tool", ToolCallID: "1", Content: "22"},
+		{Role: "tool", ToolCallID: "2", Name: "clock", Content: "noon"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{call("3", "weather")}},
+		{Role: "tool", ToolCallID: "3", Content: "18"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// tool calls and results aren't merged, and results are named after
+	// their calls unless they're already named
+	expect := "[user: hi][call 1 weather][call 2 time][result 1 weather: 22][result 2 clock: noon][call 3 weather][result 3 weather: 18]"
+	if diff := cmp.Diff(b.String(), expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
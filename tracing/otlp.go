@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// protocolProtobuf is the only OTLP protocol supported. The SDK's HTTP
+// exporter doesn't encode JSON, and gRPC isn't supported to avoid pulling in
+// the gRPC exporter.
+const protocolProtobuf = "http/protobuf"
+
+// newOTLPExporter configures the SDK's OTLP/HTTP exporter from the standard
+// OTEL_EXPORTER_OTLP_* variables, preferring the trace specific ones. They're
+// read through envconfig, like the server's other settings, and passed to the
+// exporter as options, which take precedence over its own reading of them.
+// It also returns the endpoint spans are exported to.
+func newOTLPExporter(ctx context.Context) (*otlptrace.Exporter, string, error) {
+	endpoint := envconfig.Var("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = strings.TrimSuffix(cmp.Or(envconfig.Var("OTEL_EXPORTER_OTLP_ENDPOINT"), "http://localhost:4318"), "/") + "/v1/traces"
+	}
+
+	protocol := cmp.Or(envconfig.Var("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"), envconfig.Var("OTEL_EXPORTER_OTLP_PROTOCOL"), protocolProtobuf)
+	if protocol != protocolProtobuf {
+		return nil, "", fmt.Errorf("unsupported OTLP protocol %q, use %s", protocol, protocolProtobuf)
+	}
+
+	headers := make(map[string]string)
+	for _, key := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		for _, header := range strings.Split(envconfig.Var(key), ",") {
+			k, v, ok := strings.Cut(header, "=")
+			if !ok {
+				continue
+			}
+
+			if unescaped, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+				v = unescaped
+			}
+
+			headers[strings.TrimSpace(k)] = v
+		}
+	}
+
+	timeout := 10 * time.Second
+	if s := cmp.Or(envconfig.Var("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT"), envconfig.Var("OTEL_EXPORTER_OTLP_TIMEOUT")); s != "" {
+		if ms, err := strconv.Atoi(s); err == nil && ms > 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		} else {
+			slog.Warn("invalid OTLP timeout, using default", "value", s, "default", timeout)
+		}
+	}
+
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(endpoint),
+		otlptracehttp.WithHeaders(headers),
+		otlptracehttp.WithTimeout(timeout),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return exporter, endpoint, nil
+}
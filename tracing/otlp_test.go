@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var exports []*coltracepb.ExportTraceServiceRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer abc=" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Header)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+		exports = append(exports, &req)
+	}))
+	defer srv.Close()
+
+	// http/protobuf is the default protocol
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", srv.URL+"/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20abc%3D")
+
+	exporter, endpoint, err := newOTLPExporter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint != srv.URL+"/v1/traces" {
+		t.Errorf("expected the traces path to be appended, got %s", endpoint)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background()) //nolint:errcheck
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent", trace.WithSpanKind(trace.SpanKindServer))
+	_, child := tp.Tracer("test").Start(ctx, "child", trace.WithAttributes(
+		attribute.String("model", "llama3"),
+		attribute.Int("eval_count", 42),
+		attribute.StringSlice("gpus", []string{"0", "1"}),
+	))
+	child.SetStatus(codes.Error, "failed")
+	child.End()
+	parent.End()
+
+	// spans are exported as they end, so the child is first
+	if len(exports) != 2 || len(exports[0].ResourceSpans) != 1 || len(exports[0].ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected spans grouped by resource and scope, got %v", exports)
+	}
+
+	scope := exports[0].ResourceSpans[0].ScopeSpans[0]
+	if scope.Scope.GetName() != "test" || len(scope.Spans) != 1 {
+		t.Fatalf("expected one span of the test scope, got %v", scope)
+	}
+
+	span := scope.Spans[0]
+	traceID, parentID := parent.SpanContext().TraceID(), parent.SpanContext().SpanID()
+	if span.Name != "child" || !bytes.Equal(span.TraceId, traceID[:]) || !bytes.Equal(span.ParentSpanId, parentID[:]) {
+		t.Errorf("unexpected span %v", span)
+	}
+
+	if span.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || span.Status.GetMessage() != "failed" {
+		t.Errorf("expected an error status, got %v", span.Status)
+	}
+
+	values := make(map[string]string)
+	for _, kv := range span.Attributes {
+		values[kv.Key] = kv.Value.String()
+	}
+
+	if !strings.Contains(values["model"], "llama3") || !strings.Contains(values["eval_count"], "42") || !strings.Contains(values["gpus"], "array_value") {
+		t.Errorf("unexpected attributes %v", values)
+	}
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/custom" {
+			t.Errorf("expected the traces endpoint to be used as is, got %s", r.URL.Path)
+		}
+		http.Error(w, "bad spans", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", srv.URL+"/custom")
+
+	exporter, _, err := newOTLPExporter(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Shutdown(context.Background()) //nolint:errcheck
+
+	tp := sdktrace.NewTracerProvider()
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	if err := exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span.(sdktrace.ReadOnlySpan)}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected the collector's error, got %v", err)
+	}
+}
+
+func TestOTLPExporterProtocol(t *testing.T) {
+	for _, protocol := range []string{"grpc", "http/json"} {
+		t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", protocol)
+		if _, _, err := newOTLPExporter(context.Background()); err == nil || !strings.Contains(err.Error(), protocol) {
+			t.Errorf("expected %s to be rejected, got %v", protocol, err)
+		}
+	}
+
+	// the trace specific variable takes precedence
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "http/protobuf")
+	if _, _, err := newOTLPExporter(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,94 @@
+// Package tracing traces requests with OpenTelemetry. Spans are only
+// recorded when OLLAMA_OTEL is set, and are exported over OTLP.
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/version"
+)
+
+// tracer is nil while tracing is disabled, so Start returns without
+// allocating
+var tracer atomic.Pointer[trace.Tracer]
+
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// Init starts exporting traces if OLLAMA_OTEL is set, returning a function
+// that flushes any spans that haven't been exported yet
+func Init() (shutdown func(context.Context) error, err error) {
+	if !envconfig.OTel() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if envconfig.Offline() {
+		slog.Warn("traces aren't exported in offline mode")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, endpoint, err := newOTLPExporter(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(
+		resource.NewSchemaless(
+			attribute.String("service.name", "ollama"),
+			attribute.String("service.version", version.Version),
+		),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	SetTracerProvider(tp)
+
+	slog.Info("exporting traces", "endpoint", endpoint, "protocol", protocolProtobuf)
+	return tp.Shutdown, nil
+}
+
+// SetTracerProvider records spans with tp, or disables tracing if tp is nil
+func SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		tracer.Store(nil)
+		return
+	}
+
+	t := tp.Tracer("github.com/ollama/ollama", trace.WithInstrumentationVersion(version.Version))
+	tracer.Store(&t)
+}
+
+// Enabled reports whether spans are recorded
+func Enabled() bool {
+	return tracer.Load() != nil
+}
+
+// Start starts a span as a child of the span in ctx. While tracing is
+// disabled, ctx is returned with a span that does nothing.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t := tracer.Load()
+	if t == nil {
+		return ctx, noopSpan
+	}
+
+	return (*t).Start(ctx, name, opts...)
+}
+
+// Extract returns ctx with the remote span of an incoming W3C traceparent
+// header, so spans started from it join the caller's trace
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+}
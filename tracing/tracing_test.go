@@ -0,0 +1,36 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStartDisabled(t *testing.T) {
+	SetTracerProvider(nil)
+
+	ctx := context.Background()
+	if got, span := Start(ctx, "test"); span.IsRecording() || got != ctx {
+		t.Error("expected no span to be recorded while tracing is disabled")
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		_, span := Start(ctx, "test")
+		span.End()
+	}); allocs > 0 {
+		t.Errorf("expected starting a span not to allocate while tracing is disabled, got %v allocations", allocs)
+	}
+}
+
+func TestInitOffline(t *testing.T) {
+	t.Setenv("OLLAMA_OTEL", "1")
+	t.Setenv("OLLAMA_OFFLINE", "1")
+	SetTracerProvider(nil)
+
+	if _, err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if Enabled() {
+		t.Error("expected traces not to be exported in offline mode")
+	}
+}
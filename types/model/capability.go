@@ -0,0 +1,18 @@
+package model
+
+// Capability is something a model can be used for, such as calling tools or
+// describing images
+type Capability string
+
+const (
+	CapabilityCompletion = Capability("completion")
+	CapabilityTools      = Capability("tools")
+	CapabilityInsert     = Capability("insert")
+	CapabilityVision     = Capability("vision")
+	CapabilityEmbedding  = Capability("embedding")
+	CapabilityThinking   = Capability("thinking")
+)
+
+func (c Capability) String() string {
+	return string(c)
+}
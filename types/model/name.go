@@ -9,6 +9,10 @@ import (
 	"log/slog"
 	"path/filepath"
 	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/envconfig"
 )
 
 // Errors
@@ -18,8 +22,37 @@ var (
 	// to avoid other packages inventing their own error type.
 	// Additionally, it can be conveniently used via [Unqualified].
 	ErrUnqualifiedName = errors.New("unqualified name")
+
+	// ErrInvalidName is the cause of the errors [ParseNameStrict] returns
+	// for names that aren't valid, which are [*NameError]s.
+	ErrInvalidName = errors.New("invalid model name")
 )
 
+// NameError describes why a name string isn't valid.
+type NameError struct {
+	// Name is the name string that was parsed.
+	Name string
+
+	// Part is the part of the name that's invalid, e.g. "tag", or empty if
+	// the problem is with the name as a whole.
+	Part string
+
+	// Offset is the byte offset in Name of the invalid character, or of
+	// the start of the invalid part.
+	Offset int
+
+	// Reason describes what's wrong with the part.
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("%s %q: %s", ErrInvalidName, e.Name, e.Reason)
+}
+
+func (e *NameError) Unwrap() error {
+	return ErrInvalidName
+}
+
 // Unqualified is a helper function that returns an error with
 // ErrUnqualifiedName as the cause and the name as the message.
 func Unqualified(n Name) error {
@@ -43,17 +76,38 @@ const (
 // DefaultName returns a name with the default values for the host, namespace,
 // and tag parts. The model and digest parts are empty.
 //
-//   - The default host is ("registry.ollama.ai")
-//   - The default namespace is ("library")
+//   - The default host is OLLAMA_DEFAULT_REGISTRY, or ("registry.ollama.ai")
+//   - The default namespace is OLLAMA_DEFAULT_NAMESPACE, or ("library")
 //   - The default tag is ("latest")
 func DefaultName() Name {
 	return Name{
-		Host:      defaultHost,
-		Namespace: defaultNamespace,
+		Host:      defaultPart(kindHost, "OLLAMA_DEFAULT_REGISTRY", envconfig.DefaultRegistry(), defaultHost),
+		Namespace: defaultPart(kindNamespace, "OLLAMA_DEFAULT_NAMESPACE", envconfig.DefaultNamespace(), defaultNamespace),
 		Tag:       defaultTag,
 	}
 }
 
+// invalidDefaults holds the invalid default parts already warned about, as
+// DefaultName is called for every name parsed
+var invalidDefaults sync.Map
+
+// defaultPart returns the default part of kind configured by the variable
+// key, or fallback if it isn't set or valid
+func defaultPart(kind partKind, key, value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	if _, reason := checkPart(kind, value); reason != "" {
+		if _, warned := invalidDefaults.LoadOrStore(key+"="+value, true); !warned {
+			slog.Warn("invalid "+key+", using default", "value", value, "default", fallback, "error", reason)
+		}
+		return fallback
+	}
+
+	return value
+}
+
 type partKind int
 
 const (
@@ -91,6 +145,12 @@ type Name struct {
 	Namespace string
 	Model     string
 	Tag       string
+
+	// Digest pins the name to the manifest with this digest, e.g.
+	// "sha256:" followed by 64 hex characters. Names pinned to a digest
+	// have no tag once merged with defaults, since the digest identifies
+	// the manifest.
+	Digest string
 }
 
 // ParseName parses and assembles a Name from a name string. The
@@ -142,6 +202,11 @@ func ParseNameBare(s string) Name {
 	var n Name
 	var promised bool
 
+	// "@" is an illegal character in every other part
+	if strings.Contains(s, "@") {
+		s, n.Digest, _ = cutPromised(s, "@")
+	}
+
 	// "/" is an illegal tag character, so we can use it to split the host
 	if strings.LastIndex(s, ":") > strings.LastIndex(s, "/") {
 		s, n.Tag, _ = cutPromised(s, ":")
@@ -168,10 +233,80 @@ func ParseNameBare(s string) Name {
 	return n
 }
 
+// ParseNameStrict parses s as a name string like [ParseName], returning a
+// [*NameError] naming the invalid part and character if it isn't valid. A
+// name can be pinned to a manifest with a digest, as in
+// "model@sha256:<64 hex characters>". A tag given with a digest is checked
+// but dropped, as the digest identifies the manifest.
+//
+// Missing parts are filled in from [DefaultName].
+func ParseNameStrict(s string) (Name, error) {
+	invalid := func(kind partKind, offset int, reason string) (Name, error) {
+		return Name{}, &NameError{Name: s, Part: kind.String(), Offset: offset, Reason: reason}
+	}
+
+	if s == "" {
+		return Name{}, &NameError{Name: s, Reason: "name is empty"}
+	}
+
+	rest, base := s, 0
+	if scheme, after, ok := strings.Cut(rest, "://"); ok {
+		if scheme != "https" && scheme != "http" {
+			return invalid(kindHost, 0, fmt.Sprintf("scheme %q isn't supported, use https:// or http://", scheme))
+		}
+		rest, base = after, len(scheme)+len("://")
+	}
+
+	var n Name
+	if i := strings.LastIndexByte(rest, '@'); i >= 0 {
+		n.Digest = rest[i+1:]
+		if offset, reason := checkDigest(n.Digest); reason != "" {
+			return invalid(kindDigest, base+i+1+offset, reason)
+		}
+		rest = rest[:i]
+	}
+
+	if i := strings.LastIndexByte(rest, ':'); i > strings.LastIndexByte(rest, '/') {
+		n.Tag = rest[i+1:]
+		if offset, reason := checkPart(kindTag, n.Tag); reason != "" {
+			return invalid(kindTag, base+i+1+offset, reason)
+		}
+		rest = rest[:i]
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) > 3 {
+		return Name{}, &NameError{Name: s, Offset: base, Reason: fmt.Sprintf("name has %d parts separated by '/', expected [host/][namespace/]model", len(parts))}
+	}
+
+	kinds := []partKind{kindHost, kindNamespace, kindModel}[3-len(parts):]
+	offset := base
+	for i, part := range parts {
+		if o, reason := checkPart(kinds[i], part); reason != "" {
+			return invalid(kinds[i], offset+o, reason)
+		}
+		offset += len(part) + 1
+	}
+
+	switch len(parts) {
+	case 3:
+		n.Host, n.Namespace, n.Model = parts[0], parts[1], parts[2]
+	case 2:
+		n.Namespace, n.Model = parts[0], parts[1]
+	default:
+		n.Model = parts[0]
+	}
+
+	return Merge(n, DefaultName()), nil
+}
+
 // ParseNameFromFilepath parses a 4-part filepath as a Name. The parts are
 // expected to be in the form:
 //
 // { host } "/" { namespace } "/" { model } "/" { tag }
+//
+// The last part of names pinned to a digest is the digest, with "-" in place
+// of ":", as in [Name.Filepath].
 func ParseNameFromFilepath(s string) (n Name) {
 	parts := strings.Split(s, string(filepath.Separator))
 	if len(parts) != 4 {
@@ -181,7 +316,12 @@ func ParseNameFromFilepath(s string) (n Name) {
 	n.Host = parts[0]
 	n.Namespace = parts[1]
 	n.Model = parts[2]
-	n.Tag = parts[3]
+	if digest, ok := digestFromFilename(parts[3]); ok {
+		n.Digest = digest
+	} else {
+		n.Tag = parts[3]
+	}
+
 	if !n.IsFullyQualified() {
 		return Name{}
 	}
@@ -190,11 +330,16 @@ func ParseNameFromFilepath(s string) (n Name) {
 }
 
 // Merge merges the host, namespace, and tag parts of the two names,
-// preferring the non-empty parts of a.
+// preferring the non-empty parts of a. If a is pinned to a digest, its tag
+// is dropped instead.
 func Merge(a, b Name) Name {
 	a.Host = cmp.Or(a.Host, b.Host)
 	a.Namespace = cmp.Or(a.Namespace, b.Namespace)
-	a.Tag = cmp.Or(a.Tag, b.Tag)
+	if a.Digest != "" {
+		a.Tag = ""
+	} else {
+		a.Tag = cmp.Or(a.Tag, b.Tag)
+	}
 	return a
 }
 
@@ -216,6 +361,10 @@ func (n Name) String() string {
 		b.WriteByte(':')
 		b.WriteString(n.Tag)
 	}
+	if n.Digest != "" {
+		b.WriteByte('@')
+		b.WriteString(n.Digest)
+	}
 	return b.String()
 }
 
@@ -223,20 +372,26 @@ func (n Name) String() string {
 func (n Name) DisplayShortest() string {
 	var sb strings.Builder
 
-	if n.Host != defaultHost {
+	d := DefaultName()
+	if n.Host != d.Host {
 		sb.WriteString(n.Host)
 		sb.WriteByte('/')
 		sb.WriteString(n.Namespace)
 		sb.WriteByte('/')
-	} else if n.Namespace != defaultNamespace {
+	} else if n.Namespace != d.Namespace {
 		sb.WriteString(n.Namespace)
 		sb.WriteByte('/')
 	}
 
-	// always include model and tag
+	// always include model and tag, or the digest of pinned names
 	sb.WriteString(n.Model)
-	sb.WriteString(":")
-	sb.WriteString(n.Tag)
+	if n.Digest != "" {
+		sb.WriteString("@")
+		sb.WriteString(n.Digest)
+	} else {
+		sb.WriteString(":")
+		sb.WriteString(n.Tag)
+	}
 	return sb.String()
 }
 
@@ -248,15 +403,13 @@ func IsValidNamespace(s string) bool {
 
 // IsValid reports whether all parts of the name are present and valid. The
 // digest is a special case, and is checked for validity only if present.
-//
-// Note: The digest check has been removed as is planned to be added back in
-// at a later time.
 func (n Name) IsValid() bool {
 	return n.IsFullyQualified()
 }
 
 // IsFullyQualified returns true if all parts of the name are present and
-// valid without the digest.
+// valid. Names pinned to a digest are fully qualified with a valid digest in
+// place of the tag.
 func (n Name) IsFullyQualified() bool {
 	parts := []string{
 		n.Host,
@@ -264,6 +417,12 @@ func (n Name) IsFullyQualified() bool {
 		n.Model,
 		n.Tag,
 	}
+	if n.Digest != "" {
+		if _, reason := checkDigest(n.Digest); reason != "" || n.Tag != "" {
+			return false
+		}
+		parts = parts[:3]
+	}
 	for i, part := range parts {
 		if !isValidPart(partKind(i), part) {
 			return false
@@ -277,6 +436,9 @@ func (n Name) IsFullyQualified() bool {
 //
 //	{host}/{namespace}/{model}/{tag}
 //
+// Names pinned to a digest have the digest in place of the tag, with "-" in
+// place of ":", e.g. sha256-<64 hex characters>.
+//
 // It uses the system's filepath separator and ensures the path is clean.
 //
 // It panics if the name is not fully qualified. Use [Name.IsFullyQualified]
@@ -285,11 +447,15 @@ func (n Name) Filepath() string {
 	if !n.IsFullyQualified() {
 		panic("illegal attempt to get filepath of invalid name")
 	}
+	tag := n.Tag
+	if n.Digest != "" {
+		tag = strings.Replace(n.Digest, ":", "-", 1)
+	}
 	return filepath.Join(
 		n.Host,
 		n.Namespace,
 		n.Model,
-		n.Tag,
+		tag,
 	)
 }
 
@@ -298,45 +464,118 @@ func (n Name) LogValue() slog.Value {
 	return slog.StringValue(n.String())
 }
 
-func isValidLen(kind partKind, s string) bool {
-	switch kind {
-	case kindHost:
-		return len(s) >= 1 && len(s) <= 350
-	case kindTag:
-		return len(s) >= 1 && len(s) <= 80
-	default:
-		return len(s) >= 1 && len(s) <= 80
+func maxLen(kind partKind) int {
+	if kind == kindHost {
+		return 350
 	}
+
+	return 80
 }
 
 func isValidPart(kind partKind, s string) bool {
-	if !isValidLen(kind, s) {
-		return false
+	_, reason := checkPart(kind, s)
+	return reason == ""
+}
+
+// checkPart returns why s isn't a valid part of kind, and the offset of the
+// invalid character in it, or an empty reason if it's valid
+func checkPart(kind partKind, s string) (int, string) {
+	if s == "" || s == MissingPart {
+		return 0, fmt.Sprintf("%s is empty", kind)
+	} else if len(s) > maxLen(kind) {
+		return 0, fmt.Sprintf("%s is %d characters, longer than the limit of %d", kind, len(s), maxLen(kind))
 	}
-	for i := range s {
+
+	for i, r := range s {
+		ascii := r < utf8.RuneSelf
 		if i == 0 {
-			if !isAlphanumericOrUnderscore(s[i]) {
-				return false
+			if !ascii || !isAlphanumericOrUnderscore(byte(r)) {
+				return i, fmt.Sprintf("%s %q starts with %q, it must start with a letter, number or '_'", kind, s, r)
 			}
 			continue
 		}
-		switch s[i] {
+
+		valid := ascii && isAlphanumericOrUnderscore(byte(r))
+		switch r {
 		case '_', '-':
+			valid = true
 		case '.':
-			if kind == kindNamespace {
-				return false
-			}
+			valid = kind != kindNamespace
 		case ':':
-			if kind != kindHost && kind != kindDigest {
-				return false
-			}
-		default:
-			if !isAlphanumericOrUnderscore(s[i]) {
-				return false
-			}
+			valid = kind == kindHost || kind == kindDigest
+		}
+
+		if !valid {
+			return i, fmt.Sprintf("%s %q contains %q, %s", kind, s, r, partChars(kind))
 		}
 	}
-	return true
+
+	// manifests pinned to a digest are stored in place of such a tag
+	if digest, ok := digestFromFilename(s); ok && kind == kindTag {
+		return 0, fmt.Sprintf("tag %q is reserved for models pinned to a digest, use @%s", s, digest)
+	}
+
+	return 0, ""
+}
+
+// partChars describes the characters valid in parts of kind
+func partChars(kind partKind) string {
+	switch kind {
+	case kindHost:
+		return "hosts may only contain letters, numbers, '_', '-', '.' and ':'"
+	case kindNamespace:
+		return "namespaces may only contain letters, numbers, '_' and '-'"
+	case kindDigest:
+		return "digests may only contain letters, numbers, '_', '-' and ':'"
+	default:
+		return fmt.Sprintf("%ss may only contain letters, numbers, '_', '-' and '.'", kind)
+	}
+}
+
+// checkDigest returns why s isn't a valid sha256 digest, and the offset of
+// the invalid character in it, or an empty reason if it's valid
+func checkDigest(s string) (int, string) {
+	algorithm, hex, ok := strings.Cut(s, ":")
+	switch {
+	case s == "":
+		return 0, "digest is empty"
+	case !ok:
+		return 0, fmt.Sprintf("digest %q must start with the algorithm, as in sha256:<64 hex characters>", s)
+	case algorithm != "sha256":
+		return 0, fmt.Sprintf("digest algorithm %q isn't supported, only sha256 is", algorithm)
+	}
+
+	offset := len(algorithm) + 1
+	for i, r := range hex {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return offset + i, fmt.Sprintf("digest contains %q, sha256 digests are lowercase hex", r)
+		}
+	}
+
+	switch {
+	case len(hex) < 64:
+		return offset, fmt.Sprintf("digest is truncated, it has %d of the 64 hex characters of a sha256 digest", len(hex))
+	case len(hex) > 64:
+		return offset, fmt.Sprintf("digest has %d hex characters, more than the 64 of a sha256 digest", len(hex))
+	}
+
+	return 0, ""
+}
+
+// digestFromFilename returns the digest of a name pinned to a digest whose
+// [Name.Filepath] ends in s, if it does
+func digestFromFilename(s string) (string, bool) {
+	hex, ok := strings.CutPrefix(s, "sha256-")
+	if !ok {
+		return "", false
+	}
+
+	digest := "sha256:" + hex
+	if _, reason := checkDigest(digest); reason != "" {
+		return "", false
+	}
+
+	return digest, true
 }
 
 func isAlphanumericOrUnderscore(c byte) bool {
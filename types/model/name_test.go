@@ -1,6 +1,8 @@
 package model
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
 	"reflect"
 	"runtime"
@@ -165,6 +167,12 @@ var testCases = map[string]bool{ // name -> valid
 	"@t":    false,
 	"m@d":   false,
 
+	// pinned to a digest
+	"h/n/m@sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816":   true,
+	"h/n/m:t@sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816": false,
+	"h/n/m@sha256:2af3b818": false,
+	"h/n/m:sha256-2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816": false,
+
 	// invalids
 	"^":      false,
 	"mm:":    false,
@@ -268,13 +276,17 @@ func TestParseNameFromFilepath(t *testing.T) {
 	cases := map[string]Name{
 		filepath.Join("host", "namespace", "model", "tag"):      {Host: "host", Namespace: "namespace", Model: "model", Tag: "tag"},
 		filepath.Join("host:port", "namespace", "model", "tag"): {Host: "host:port", Namespace: "namespace", Model: "model", Tag: "tag"},
-		filepath.Join("namespace", "model", "tag"):              {},
-		filepath.Join("model", "tag"):                           {},
-		"model":                                                 {},
-		filepath.Join("..", "..", "model", "tag"):               {},
-		filepath.Join("", "namespace", ".", "tag"):              {},
-		filepath.Join(".", ".", ".", "."):                       {},
-		filepath.Join("/", "path", "to", "random", "file"):      {},
+		filepath.Join("host", "namespace", "model", "sha256-2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816"): {
+			Host: "host", Namespace: "namespace", Model: "model", Digest: "sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816",
+		},
+		filepath.Join("host", "namespace", "model", "sha256-2af3b818"): {Host: "host", Namespace: "namespace", Model: "model", Tag: "sha256-2af3b818"},
+		filepath.Join("namespace", "model", "tag"):                     {},
+		filepath.Join("model", "tag"):                                  {},
+		"model":                                                        {},
+		filepath.Join("..", "..", "model", "tag"):                      {},
+		filepath.Join("", "namespace", ".", "tag"):                     {},
+		filepath.Join(".", ".", ".", "."):                              {},
+		filepath.Join("/", "path", "to", "random", "file"):             {},
 	}
 
 	for in, want := range cases {
@@ -295,6 +307,7 @@ func TestDisplayShortest(t *testing.T) {
 		"registry.ollama.ai/namespace/model:tag":  "namespace/model:tag",
 		"host/namespace/model:tag":                "host/namespace/model:tag",
 		"host/library/model:tag":                  "host/library/model:tag",
+		"registry.ollama.ai/library/model@sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816": "model@sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816",
 	}
 
 	for in, want := range cases {
@@ -356,3 +369,156 @@ func TestIsValidNamespace(t *testing.T) {
 		})
 	}
 }
+
+func TestParseNameStrict(t *testing.T) {
+	const digest = "sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816"
+
+	valid := map[string]Name{
+		"mistral":                           {Host: "registry.ollama.ai", Namespace: "library", Model: "mistral", Tag: "latest"},
+		"mistral:7b":                        {Host: "registry.ollama.ai", Namespace: "library", Model: "mistral", Tag: "7b"},
+		"Mistral:7B-Instruct_v0.2-q4_K_M":   {Host: "registry.ollama.ai", Namespace: "library", Model: "Mistral", Tag: "7B-Instruct_v0.2-q4_K_M"},
+		"jmorgan/mistral":                   {Host: "registry.ollama.ai", Namespace: "jmorgan", Model: "mistral", Tag: "latest"},
+		"jmorgan/mistral:7b":                {Host: "registry.ollama.ai", Namespace: "jmorgan", Model: "mistral", Tag: "7b"},
+		"example.com/jmorgan/mistral:7b":    {Host: "example.com", Namespace: "jmorgan", Model: "mistral", Tag: "7b"},
+		"example.com:5000/jmorgan/mistral":  {Host: "example.com:5000", Namespace: "jmorgan", Model: "mistral", Tag: "latest"},
+		"localhost:5000/library/mistral:7b": {Host: "localhost:5000", Namespace: "library", Model: "mistral", Tag: "7b"},
+		"https://example.com/ns/mistral":    {Host: "example.com", Namespace: "ns", Model: "mistral", Tag: "latest"},
+		"http://localhost:5000/ns/mistral":  {Host: "localhost:5000", Namespace: "ns", Model: "mistral", Tag: "latest"},
+		"_model":                            {Host: "registry.ollama.ai", Namespace: "library", Model: "_model", Tag: "latest"},
+		"0/1:2":                             {Host: "registry.ollama.ai", Namespace: "0", Model: "1", Tag: "2"},
+		"ns/" + part80:                      {Host: "registry.ollama.ai", Namespace: "ns", Model: part80, Tag: "latest"},
+		part350 + "/ns/model":               {Host: part350, Namespace: "ns", Model: "model", Tag: "latest"},
+
+		"mistral@" + digest:                           {Host: "registry.ollama.ai", Namespace: "library", Model: "mistral", Digest: digest},
+		"mistral:7b@" + digest:                        {Host: "registry.ollama.ai", Namespace: "library", Model: "mistral", Digest: digest},
+		"example.com:5000/ns/mistral:7b@" + digest:    {Host: "example.com:5000", Namespace: "ns", Model: "mistral", Digest: digest},
+		"https://example.com/ns/mistral:7b@" + digest: {Host: "example.com", Namespace: "ns", Model: "mistral", Digest: digest},
+	}
+
+	for s, want := range valid {
+		t.Run(s, func(t *testing.T) {
+			got, err := ParseNameStrict(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != want {
+				t.Errorf("ParseNameStrict(%q) = %#v; want %#v", s, got, want)
+			}
+
+			if !got.IsValid() {
+				t.Errorf("ParseNameStrict(%q) isn't valid", s)
+			}
+		})
+	}
+
+	invalid := []struct {
+		in     string
+		part   string
+		offset int
+		reason string
+	}{
+		{"", "", 0, "name is empty"},
+		{":7b", "model", 0, "model is empty"},
+		{"mistral:", "tag", 8, "tag is empty"},
+		{"/mistral", "namespace", 0, "namespace is empty"},
+		{"ns/", "model", 3, "model is empty"},
+		{"//mistral", "host", 0, "host is empty"},
+		{"a/b/c/d", "", 0, "name has 4 parts separated by '/', expected [host/][namespace/]model"},
+		{"mistral:la$t", "tag", 10, `tag "la$t" contains '$', tags may only contain letters, numbers, '_', '-' and '.'`},
+		{"mistral:-7b", "tag", 8, `tag "-7b" starts with '-', it must start with a letter, number or '_'`},
+		{"mis tral", "model", 3, `model "mis tral" contains ' ', models may only contain letters, numbers, '_', '-' and '.'`},
+		{"mistrål", "model", 5, `model "mistrål" contains 'å', models may only contain letters, numbers, '_', '-' and '.'`},
+		{".mistral", "model", 0, `model ".mistral" starts with '.', it must start with a letter, number or '_'`},
+		{"../mistral", "namespace", 0, `namespace ".." starts with '.', it must start with a letter, number or '_'`},
+		{"j.morgan/mistral", "namespace", 1, `namespace "j.morgan" contains '.', namespaces may only contain letters, numbers, '_' and '-'`},
+		{"ex$mple.com/ns/mistral", "host", 2, `host "ex$mple.com" contains '$', hosts may only contain letters, numbers, '_', '-', '.' and ':'`},
+		{"ns/mod:el/x", "namespace", 6, `namespace "mod:el" contains ':', namespaces may only contain letters, numbers, '_' and '-'`},
+		{"ftp://example.com/ns/mistral", "host", 0, `scheme "ftp" isn't supported, use https:// or http://`},
+		{"ns/" + part80 + "8", "model", 3, "model is 81 characters, longer than the limit of 80"},
+		{"mistral:" + part80 + "8", "tag", 8, "tag is 81 characters, longer than the limit of 80"},
+		{part350 + "3/ns/model", "host", 0, "host is 351 characters, longer than the limit of 350"},
+
+		{"mistral@", "digest", 8, "digest is empty"},
+		{"@" + digest, "model", 0, "model is empty"},
+		{"mistral@" + digest[7:], "digest", 8, `digest "` + digest[7:] + `" must start with the algorithm, as in sha256:<64 hex characters>`},
+		{"mistral@md5:d41d8cd98f00b204e9800998ecf8427e", "digest", 8, `digest algorithm "md5" isn't supported, only sha256 is`},
+		{"mistral@sha256:2af3b818", "digest", 15, "digest is truncated, it has 8 of the 64 hex characters of a sha256 digest"},
+		{"mistral@" + digest + "00", "digest", 15, "digest has 66 hex characters, more than the 64 of a sha256 digest"},
+		{"mistral@sha256:2AF3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816", "digest", 16, "digest contains 'A', sha256 digests are lowercase hex"},
+		{"mistral@sha256-2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816", "digest", 8, `digest "sha256-2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816" must start with the algorithm, as in sha256:<64 hex characters>`},
+		{"mistral:7b@latest@" + digest, "tag", 10, `tag "7b@latest" contains '@', tags may only contain letters, numbers, '_', '-' and '.'`},
+		{"mistral:sha256-" + digest[7:], "tag", 8, `tag "sha256-` + digest[7:] + `" is reserved for models pinned to a digest, use @` + digest},
+	}
+
+	for _, tt := range invalid {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := ParseNameStrict(tt.in)
+			var nerr *NameError
+			if !errors.As(err, &nerr) {
+				t.Fatalf("expected a NameError, got %v", err)
+			}
+
+			if !errors.Is(err, ErrInvalidName) {
+				t.Errorf("expected the error to wrap ErrInvalidName")
+			}
+
+			if nerr.Part != tt.part || nerr.Offset != tt.offset || nerr.Reason != tt.reason {
+				t.Errorf("got part %q at %d: %s; want part %q at %d: %s", nerr.Part, nerr.Offset, nerr.Reason, tt.part, tt.offset, tt.reason)
+			}
+
+			if want := fmt.Sprintf("invalid model name %q: %s", tt.in, tt.reason); err.Error() != want {
+				t.Errorf("got error %q; want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestParseNameStrictDefaults(t *testing.T) {
+	t.Setenv("OLLAMA_DEFAULT_REGISTRY", "registry.example.com:5000")
+	t.Setenv("OLLAMA_DEFAULT_NAMESPACE", "team")
+
+	n, err := ParseNameStrict("mistral")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "registry.example.com:5000/team/mistral:latest"; n.String() != want {
+		t.Errorf("got %q; want %q", n, want)
+	}
+
+	if got := ParseName("other/mistral:7b").String(); got != "registry.example.com:5000/other/mistral:7b" {
+		t.Errorf("expected ParseName to use the same defaults, got %q", got)
+	}
+
+	if got := n.DisplayShortest(); got != "mistral:latest" {
+		t.Errorf("expected the defaults to be left out of the shortest name, got %q", got)
+	}
+
+	// invalid defaults are ignored
+	t.Setenv("OLLAMA_DEFAULT_REGISTRY", "https://registry.example.com")
+	t.Setenv("OLLAMA_DEFAULT_NAMESPACE", "my.team")
+	if got := ParseName("mistral").String(); got != "registry.ollama.ai/library/mistral:latest" {
+		t.Errorf("expected the built in defaults, got %q", got)
+	}
+}
+
+func TestPinnedFilepath(t *testing.T) {
+	n, err := ParseNameStrict("mistral:7b@sha256:2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join("registry.ollama.ai", "library", "mistral", "sha256-2af3b81862c6be03c769683af18efdadb2c33f60ff32ab6f83e42c043d6c7816")
+	if got := n.Filepath(); got != want {
+		t.Errorf("Filepath() = %q; want %q", got, want)
+	}
+
+	if got := ParseNameFromFilepath(n.Filepath()); got != n {
+		t.Errorf("ParseNameFromFilepath(%q) = %#v; want %#v", n.Filepath(), got, n)
+	}
+
+	if got := ParseName(n.String()); got != n {
+		t.Errorf("ParseName(%q) = %#v; want %#v", n.String(), got, n)
+	}
+}
@@ -1,3 +1,64 @@
 package version
 
+import (
+	"runtime/debug"
+	"strings"
+)
+
 var Version string = "0.0.0"
+
+// Commit and BuildDate are set with -ldflags by the build scripts. Builds
+// without them fall back to the version control information Go records.
+var (
+	Commit    string
+	BuildDate string
+)
+
+// Build returns the commit the binary was built from and when, or empty
+// strings if they aren't known
+func Build() (commit, date string) {
+	commit, date = Commit, BuildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+
+	return commit, date
+}
+
+// Compatible reports whether versions a and b are of the same release, only
+// differing in their patch releases. Versions that can't be parsed are only
+// compatible with themselves.
+func Compatible(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	minor := func(v string) (string, bool) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+
+		parts := strings.Split(v, ".")
+		if len(parts) != 3 {
+			return "", false
+		}
+
+		return parts[0] + "." + parts[1], true
+	}
+
+	ma, ok := minor(a)
+	if !ok {
+		return false
+	}
+
+	mb, ok := minor(b)
+	return ok && ma == mb
+}
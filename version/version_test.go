@@ -0,0 +1,26 @@
+package version
+
+import "testing"
+
+func TestCompatible(t *testing.T) {
+	cases := []struct {
+		a, b string
+		ok   bool
+	}{
+		{"0.3.10", "0.3.10", true},
+		{"0.3.10", "0.3.2", true},
+		{"0.3.10-rc1", "v0.3.9", true},
+		{"0.3.10-5-gabcdef1", "0.3.10", true},
+		{"0.3.10", "0.4.0", false},
+		{"1.3.0", "0.3.0", false},
+		{"0.0.0", "0.3.10", false},
+		{"abcdef1", "0.3.10", false},
+		{"abcdef1", "abcdef1", true},
+	}
+
+	for _, tt := range cases {
+		if ok := Compatible(tt.a, tt.b); ok != tt.ok {
+			t.Errorf("Compatible(%q, %q) = %v, expected %v", tt.a, tt.b, ok, tt.ok)
+		}
+	}
+}